@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -35,7 +36,7 @@ var (
 		Use:   "addsource",
 		Short: "Add some source code to an interpreter wasm",
 		Long:  `This will embed some source code into the wasm`,
-		Run:   runAddSource,
+		RunE:  runAddSource,
 	}
 )
 
@@ -46,15 +47,15 @@ func init() {
 	cmdAddSource.Flags().StringVar(&source_file, "filename", "", "Source filename")
 }
 
-func runAddSource(ccmd *cobra.Command, args []string) {
+func runAddSource(ccmd *cobra.Command, args []string) error {
 	if Input == "" {
-		panic("No input file")
+		return errors.New("No input file")
 	}
 
 	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
 	wfile, err := wasmfile.New(Input)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Parsing custom name section...\n")
@@ -67,24 +68,30 @@ func runAddSource(ccmd *cobra.Command, args []string) {
 	memFunctions := &wasmfile.WasmFile{}
 	data, err := wat.Wat_content.ReadFile(path.Join("wat_code", "memory.wat"))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = memFunctions.DecodeWat(data)
+	err = memFunctions.DecodeWatFile("memory.wat", data)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Adding functions from memory.wat...\n")
-	wfile.AddFuncsFrom(memFunctions, func(m map[int]int) {})
+	err = wfile.AddFuncsFrom(memFunctions, func(m map[int]int) {})
+	if err != nil {
+		return err
+	}
 
 	data_ptr := wfile.Memory[0].LimitMin << 16
-	wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	err = wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	if err != nil {
+		return err
+	}
 
 	// Now we can start doing what we want...
 
 	bytes, err := os.ReadFile(source_file)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Now we just need to adjust the imported functions get_source_len and get_source_ptr and then remove them.
@@ -93,24 +100,36 @@ func runAddSource(ccmd *cobra.Command, args []string) {
 	replacedFunctions := &wasmfile.WasmFile{}
 	data, err = wat.Wat_content.ReadFile(path.Join("wat_code", "addsource.wat"))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = replacedFunctions.DecodeWat(data)
+	err = replacedFunctions.DecodeWatFile("addsource.wat", data)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Adding functions from addsource.wat...\n")
-	wfile.AddFuncsFrom(replacedFunctions, func(m map[int]int) {})
+	err = wfile.AddFuncsFrom(replacedFunctions, func(m map[int]int) {})
+	if err != nil {
+		return err
+	}
 
-	wfile.AddDataFrom(int32(data_ptr), replacedFunctions)
+	_, err = wfile.AddDataFrom(int32(data_ptr), replacedFunctions)
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Adding source data %d bytes...\n", len(bytes))
 	wfile.AddData("$source_data", bytes)
 
 	// Now we need to remap any calls to the new functions
-	wfile.RedirectImport("env", "get_source_len", "$get_source_len")
-	wfile.RedirectImport("env", "get_source", "$get_source")
+	err = wfile.RedirectImport("env", "get_source_len", "$get_source_len")
+	if err != nil {
+		return err
+	}
+	err = wfile.RedirectImport("env", "get_source", "$get_source")
+	if err != nil {
+		return err
+	}
 
 	// Find out how much data we need for the payload
 	total_payload_data := data_ptr
@@ -121,7 +140,10 @@ func runAddSource(ccmd *cobra.Command, args []string) {
 
 	payload_size := (total_payload_data + 65535) >> 16
 
-	wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	err = wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	if err != nil {
+		return err
+	}
 	wfile.Memory[0].LimitMin = wfile.Memory[0].LimitMin + payload_size
 
 	// Pass on the fact of if source_file is gzip or not.
@@ -129,82 +151,86 @@ func runAddSource(ccmd *cobra.Command, args []string) {
 	if strings.HasSuffix(source_file, ".gz") {
 		source_gzipped = 1
 	}
-	wfile.SetGlobal("$source_gzipped", types.ValI32, fmt.Sprintf("i32.const %d", source_gzipped))
+	err = wfile.SetGlobal("$source_gzipped", types.ValI32, fmt.Sprintf("i32.const %d", source_gzipped))
+	if err != nil {
+		return err
+	}
 
 	// Adjust any memory.size / memory.grow calls
 	for idx, c := range wfile.Code {
 		if idx < originalFunctionLength {
 			err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
 			if err != nil {
-				panic(err)
+				return err
 			}
 			err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
 			if err != nil {
-				panic(err)
+				return err
 			}
 		} else {
 			// Do any relocation adjustments...
 			err = c.InsertAfterRelocating(wfile, `global.get $debug_start_mem
 																						i32.add`)
 			if err != nil {
-				panic(err)
+				return err
 			}
 		}
 
 		err = c.ResolveLengths(wfile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		err = c.ResolveRelocations(wfile, data_ptr)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		err = c.ResolveGlobals(wfile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		err = c.ResolveFunctions(wfile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
 	fmt.Printf("Writing wasm out to %s...\n", Output)
 	f, err := os.Create(Output)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = wfile.EncodeBinary(f)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = f.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	/*
 	   fmt.Printf("Writing debug.wat\n")
 	   f2, err := os.Create("debug.wat")
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 
 	   err = wfile.EncodeWat(f2)
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 
 	   err = f2.Close()
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 	*/
+	return nil
 }
@@ -0,0 +1,71 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/asyncify"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdAsyncify = &cobra.Command{
+		Use:   "asyncify",
+		Short: "Let the host pause a wasm file in some imports, and resume it later",
+		Long:  `This saves the stack when the host unwinds it in one of the chosen imports, and puts it back when the host rewinds it. It's driven with the same exports as binaryen's asyncify.`,
+		RunE:  runAsyncify,
+	}
+)
+
+var asyncify_imports []string
+var asyncify_ignore_indirect = false
+
+func init() {
+	rootCmd.AddCommand(cmdAsyncify)
+	cmdAsyncify.Flags().StringArrayVar(&asyncify_imports, "import", []string{}, "Import the module can be paused in, as module:name (wildcards can be used)")
+	cmdAsyncify.Flags().BoolVar(&asyncify_ignore_indirect, "ignore-indirect", false, "Assume indirect calls never lead to an import the module can be paused in")
+}
+
+func runAsyncify(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if len(asyncify_imports) == 0 {
+		return errors.New("No imports given. Use --import module:name")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := asyncify.Asyncify_config{
+		Imports:        asyncify_imports,
+		IgnoreIndirect: asyncify_ignore_indirect,
+	}
+	newdata, err := asyncify.AddAsyncify(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
@@ -0,0 +1,175 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/bindgen"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdBindgen = &cobra.Command{
+		Use:   "bindgen",
+		Short: "Generate host bindings for the imports of a wasm file",
+	}
+
+	cmdBindgenGo = &cobra.Command{
+		Use:   "go",
+		Short: "Generate a Go file with typed host function stubs for wazero or wasmtime-go",
+		Long:  `This writes an interface for each import module, a stub implementing it, and a function to add it to a wazero runtime or wasmtime linker. Param names come from the dwarf info if there is any. WASI imports are left out unless --wasi is given, since the runtimes provide them.`,
+		RunE:  runBindgenGo,
+	}
+
+	cmdBindgenC = &cobra.Command{
+		Use:   "c",
+		Short: "Generate a C header with a prototype for each exported function",
+		Long:  `This writes a header with the signatures of the exported functions, guarded by the module name, so embedders using a wasm C API get them checked by the compiler. Exports with more than one result return a struct.`,
+		RunE:  runBindgenC,
+	}
+
+	cmdBindgenWit = &cobra.Command{
+		Use:   "wit",
+		Short: "Generate a WIT world skeleton from the imports and exports of a wasm file",
+		Long:  `This writes a WIT world with an interface for each import module and an export for each exported function, as a starting point for moving a module to the component model. Only the number types are known, so pointers and lengths need replacing with strings, lists and records by hand.`,
+		RunE:  runBindgenWit,
+	}
+)
+
+var bindgen_package = "main"
+var bindgen_runtime = bindgen.RuntimeWazero
+var bindgen_wasi = false
+var bindgen_wasmtime_import = bindgen.DefaultWasmtimeImport
+var bindgen_module = ""
+var bindgen_prefix = ""
+var bindgen_world = ""
+var bindgen_wit_package = ""
+
+func init() {
+	rootCmd.AddCommand(cmdBindgen)
+	cmdBindgen.AddCommand(cmdBindgenGo)
+	cmdBindgen.AddCommand(cmdBindgenC)
+	cmdBindgen.AddCommand(cmdBindgenWit)
+
+	cmdBindgenGo.Flags().StringVar(&bindgen_package, "package", "main", "Package name of the generated file")
+	cmdBindgenGo.Flags().StringVar(&bindgen_runtime, "runtime", bindgen.RuntimeWazero, "Runtime to generate bindings for (wazero or wasmtime)")
+	cmdBindgenGo.Flags().BoolVar(&bindgen_wasi, "wasi", false, "Include the WASI imports")
+	cmdBindgenGo.Flags().StringVar(&bindgen_wasmtime_import, "wasmtime-import", bindgen.DefaultWasmtimeImport, "Import path of wasmtime-go")
+
+	cmdBindgenC.Flags().StringVar(&bindgen_module, "module", "", "Module name for the include guard (defaults to the input file name)")
+	cmdBindgenC.Flags().StringVar(&bindgen_prefix, "prefix", "", "Prefix for the function names")
+
+	cmdBindgenWit.Flags().StringVar(&bindgen_world, "world", "", "Name of the world (defaults to the input file name)")
+	cmdBindgenWit.Flags().StringVar(&bindgen_wit_package, "package", "", "Package id, eg example:module (defaults to local:<world>)")
+	cmdBindgenWit.Flags().BoolVar(&bindgen_wasi, "wasi", false, "Include the WASI preview1 imports")
+}
+
+// Load the input, with its dwarf info if there is any for the param names
+func loadBindgenInput() (*wasmfile.WasmFile, error) {
+	if Input == "" {
+		return nil, errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return nil, err
+	}
+
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
+	if err != nil {
+		return nil, err
+	}
+	if debugSections.GetCustomSectionData(".debug_info") != nil {
+		err = wfile.Debug.ParseDwarf(debugSections)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wfile, nil
+}
+
+func runBindgenGo(ccmd *cobra.Command, args []string) error {
+	wfile, err := loadBindgenInput()
+	if err != nil {
+		return err
+	}
+
+	src, err := bindgen.Go(wfile, bindgen.Bindgen_config{
+		Package:        bindgen_package,
+		Runtime:        bindgen_runtime,
+		WASI:           bindgen_wasi,
+		WasmtimeImport: bindgen_wasmtime_import,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing go bindings to %s...\n", Output)
+	return os.WriteFile(Output, src, 0660)
+}
+
+func runBindgenC(ccmd *cobra.Command, args []string) error {
+	wfile, err := loadBindgenInput()
+	if err != nil {
+		return err
+	}
+
+	module := bindgen_module
+	if module == "" {
+		module = strings.TrimSuffix(filepath.Base(Input), filepath.Ext(Input))
+	}
+	src, err := bindgen.C(wfile, bindgen.C_config{
+		Module: module,
+		Prefix: bindgen_prefix,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing c header to %s...\n", Output)
+	return os.WriteFile(Output, src, 0660)
+}
+
+func runBindgenWit(ccmd *cobra.Command, args []string) error {
+	wfile, err := loadBindgenInput()
+	if err != nil {
+		return err
+	}
+
+	world := bindgen_world
+	if world == "" {
+		world = strings.TrimSuffix(filepath.Base(Input), filepath.Ext(Input))
+	}
+	src, err := bindgen.Wit(wfile, bindgen.Wit_config{
+		World:   world,
+		Package: bindgen_wit_package,
+		WASI:    bindgen_wasi,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wit to %s...\n", Output)
+	return os.WriteFile(Output, src, 0660)
+}
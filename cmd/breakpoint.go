@@ -0,0 +1,70 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/breakpoint"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdBreakpoint = &cobra.Command{
+		Use:   "breakpoint",
+		Short: "Add breakpoints at source lines to a wasm file",
+		Long:  `Each breakpoint calls the import wasm_toolkit.break with the PC it's at, so the host can pause the module there. With --trap, the module traps instead, and the PC is exported as the global __wasm_toolkit_breakpoint. A breakpoint can have a condition over locals, globals and memory, which is compiled into the module so it only fires when the condition holds.`,
+		RunE:  runBreakpoint,
+	}
+)
+
+var breakpoint_at []string
+var breakpoint_trap = false
+
+func init() {
+	rootCmd.AddCommand(cmdBreakpoint)
+	cmdBreakpoint.Flags().StringArrayVar(&breakpoint_at, "at", []string{}, "Source location as file:line, eg main.go:12, with an optional condition eg \"main.go:12 if n == 5\" (can be repeated)")
+	cmdBreakpoint.Flags().BoolVar(&breakpoint_trap, "trap", false, "Trap at a breakpoint, instead of calling the host")
+}
+
+func runBreakpoint(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := breakpoint.Breakpoint_config{
+		Locations: breakpoint_at,
+		Trap:      breakpoint_trap,
+		DebugDir:  filepath.Dir(Input),
+	}
+	newdata, err := breakpoint.AddBreakpoints(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
@@ -0,0 +1,104 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/callgraph"
+	"github.com/loopholelabs/wasm-toolkit/pkg/tracefmt"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCallgraph = &cobra.Command{
+		Use:   "callgraph",
+		Short: "Write the call graph of a wasm file in graphviz dot format",
+		Long:  `Direct calls are solid edges. A call_indirect has a dashed edge to every function of the right type in the elem segments. With --profile, edges are labelled with the calls seen in a strace --format=chrome trace.`,
+		RunE:  runCallgraph,
+	}
+)
+
+var callgraph_roots = []string{}
+var callgraph_profile = ""
+
+func init() {
+	rootCmd.AddCommand(cmdCallgraph)
+	cmdCallgraph.Flags().StringArrayVar(&callgraph_roots, "root", []string{}, "Only show functions reachable from this export (can be repeated)")
+	cmdCallgraph.Flags().StringVar(&callgraph_profile, "profile", "", "Trace from strace --format=chrome to count the calls on each edge")
+}
+
+func runCallgraph(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+	wfile.Debug.Demangle = !rawNames
+
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
+	if err != nil {
+		return err
+	}
+	if debugSections.GetCustomSectionData(".debug_info") != nil {
+		err = wfile.Debug.ParseDwarf(debugSections)
+		if err != nil {
+			return err
+		}
+	}
+
+	config := callgraph.Callgraph_config{
+		Roots: callgraph_roots,
+	}
+	if callgraph_profile != "" {
+		f, err := os.Open(callgraph_profile)
+		if err != nil {
+			return err
+		}
+		config.Profile, err = tracefmt.ReadEvents(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if len(config.Profile) == 0 {
+			return fmt.Errorf("No trace events found in %s", callgraph_profile)
+		}
+	}
+
+	g, err := callgraph.Build(wfile, config)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = g.WriteDot(&buf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing call graph to %s...\n", Output)
+	return os.WriteFile(Output, buf.Bytes(), 0660)
+}
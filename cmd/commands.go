@@ -31,9 +31,17 @@ var (
 var Input string
 var Output string
 
+// Show function names as they are rather than demangling them
+var rawNames = false
+
+// Skip the dwarf debug info that is only used for wat output
+var lowMemory = false
+
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&Input, "input", "i", "", "Input file name")
 	rootCmd.PersistentFlags().StringVarP(&Output, "output", "o", "output", "Output file name")
+	rootCmd.PersistentFlags().BoolVar(&rawNames, "rawnames", false, "Show raw function names instead of demangling them")
+	rootCmd.PersistentFlags().BoolVar(&lowMemory, "low-memory", false, "Use less memory for dwarf debug info, eg on CI machines")
 }
 
 func Execute() error {
@@ -0,0 +1,152 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/cover"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCover = &cobra.Command{
+		Use:   "cover",
+		Short: "Add code coverage probes to a wasm file",
+		Long:  `This records which functions (or blocks) run, and writes the coverage data to STDERR on exit. Use 'cover report' to turn it into lcov or html.`,
+		RunE:  runCover,
+	}
+
+	cmdCoverReport = &cobra.Command{
+		Use:   "report",
+		Short: "Make a coverage report from the original wasm file and the coverage data",
+		RunE:  runCoverReport,
+	}
+)
+
+var cover_blocks = false
+var cover_file = ""
+var cover_data = []string{}
+var cover_format = "lcov"
+
+func init() {
+	rootCmd.AddCommand(cmdCover)
+	cmdCover.AddCommand(cmdCoverReport)
+
+	cmdCover.Flags().BoolVar(&cover_blocks, "blocks", false, "Record coverage for each block of code, rather than each function")
+	cmdCover.Flags().StringVar(&cover_file, "file", "", "Write the coverage data to this file, relative to a preopened directory")
+
+	cmdCoverReport.Flags().StringArrayVar(&cover_data, "data", []string{}, "File containing coverage data (can be repeated to merge runs)")
+	cmdCoverReport.Flags().StringVar(&cover_format, "format", "lcov", "Report format (lcov or html)")
+}
+
+func runCover(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := cover.Cover_config{
+		Blocks: cover_blocks,
+		File:   cover_file,
+	}
+	newdata, err := cover.AddCover(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
+
+func runCoverReport(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if len(cover_data) == 0 {
+		return errors.New("No coverage data file")
+	}
+	if cover_format != "lcov" && cover_format != "html" {
+		return fmt.Errorf("Unknown report format %q", cover_format)
+	}
+
+	var data *cover.Data
+	for _, filename := range cover_data {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		d, err := cover.ReadData(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		if data == nil {
+			data = d
+		} else {
+			err = data.Merge(d)
+			if err != nil {
+				return fmt.Errorf("%s: %v", filename, err)
+			}
+		}
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	wfile.Debug.LowMemory = lowMemory
+	err = wfile.Debug.ParseDwarfLineNumbers()
+	if err != nil {
+		return err
+	}
+	if wfile.Debug.NumLines() == 0 {
+		return errors.New("The wasm file has no dwarf line numbers")
+	}
+
+	report, err := cover.BuildReport(wfile, data)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+	if cover_format == "html" {
+		err = report.WriteHTML(f)
+	} else {
+		err = report.WriteLcov(f)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	fmt.Printf("Writing %s report to %s...\n", cover_format, Output)
+	return f.Close()
+}
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -33,7 +34,7 @@ var (
 		Use:   "customs",
 		Short: "Manipulate import/export",
 		Long:  `This manipulates imports and exports`,
-		Run:   runCustoms,
+		RunE:  runCustoms,
 	}
 )
 
@@ -51,15 +52,15 @@ func init() {
 //	--muximport "env/hello,0:env/zero,1:env/one,2:env/two"
 //	--muxexport "resize,0:resize_zero,1:resize_one,2:resize_two"
 
-func runCustoms(ccmd *cobra.Command, args []string) {
+func runCustoms(ccmd *cobra.Command, args []string) error {
 	if Input == "" {
-		panic("No input file")
+		return errors.New("No input file")
 	}
 
 	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
 	wfile, err := wasmfile.New(Input)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Parsing custom name section...\n")
@@ -69,58 +70,59 @@ func runCustoms(ccmd *cobra.Command, args []string) {
 	if muxDefImport != "" {
 		ci, err := customs.ParseRemapMuxImport(muxDefImport)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		err = customs.MuxImport(wfile, *ci)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
 	if muxDefExport != "" {
 		ci, err := customs.ParseRemapMuxExport(muxDefExport)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		err = customs.MuxExport(wfile, *ci)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
 	fmt.Printf("Writing wasm out to %s...\n", Output)
 	f, err := os.Create(Output)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = wfile.EncodeBinary(f)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = f.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	/*
 	   fmt.Printf("Writing debug.wat\n")
 	   f2, err := os.Create("debug.wat")
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 
 	   err = wfile.EncodeWat(f2)
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 
 	   err = f2.Close()
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 	*/
+	return nil
 }
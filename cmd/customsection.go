@@ -0,0 +1,160 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCustomSection = &cobra.Command{
+		Use:   "customsection",
+		Short: "Add, extract or remove custom sections",
+		Long:  `This can be used to attach metadata such as licenses, build ids or signatures to a wasm file.`,
+	}
+
+	cmdCustomSectionAdd = &cobra.Command{
+		Use:   "add",
+		Short: "Add a custom section from a file",
+		RunE:  runCustomSectionAdd,
+	}
+
+	cmdCustomSectionExtract = &cobra.Command{
+		Use:   "extract",
+		Short: "Extract the data of a custom section to a file",
+		RunE:  runCustomSectionExtract,
+	}
+
+	cmdCustomSectionRemove = &cobra.Command{
+		Use:   "remove",
+		Short: "Remove a custom section",
+		RunE:  runCustomSectionRemove,
+	}
+)
+
+var customSectionName = ""
+var customSectionFile = ""
+var customSectionReplace = false
+
+func init() {
+	rootCmd.AddCommand(cmdCustomSection)
+	cmdCustomSection.AddCommand(cmdCustomSectionAdd)
+	cmdCustomSection.AddCommand(cmdCustomSectionExtract)
+	cmdCustomSection.AddCommand(cmdCustomSectionRemove)
+
+	cmdCustomSection.PersistentFlags().StringVar(&customSectionName, "name", "", "Name of the custom section")
+	cmdCustomSectionAdd.Flags().StringVar(&customSectionFile, "file", "", "File containing the section data")
+	cmdCustomSectionAdd.Flags().BoolVar(&customSectionReplace, "replace", false, "Replace the section if it already exists")
+	cmdCustomSectionExtract.Flags().StringVar(&customSectionFile, "file", "", "File to write the section data to")
+}
+
+func loadCustomSectionInput() (*wasmfile.WasmFile, error) {
+	if Input == "" {
+		return nil, errors.New("No input file")
+	}
+	if customSectionName == "" {
+		return nil, errors.New("No section name")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	return wasmfile.NewWithLayout(Input)
+}
+
+func writeCustomSectionOutput(wfile *wasmfile.WasmFile) error {
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func runCustomSectionAdd(ccmd *cobra.Command, args []string) error {
+	wfile, err := loadCustomSectionInput()
+	if err != nil {
+		return err
+	}
+	if customSectionFile == "" {
+		return errors.New("No data file")
+	}
+
+	if wfile.GetCustomSectionData(customSectionName) != nil && !customSectionReplace {
+		return fmt.Errorf("Custom section %s already exists", customSectionName)
+	}
+
+	data, err := os.ReadFile(customSectionFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Adding custom section %s (%d bytes)...\n", customSectionName, len(data))
+	wfile.SetCustomSection(customSectionName, data)
+
+	return writeCustomSectionOutput(wfile)
+}
+
+func runCustomSectionExtract(ccmd *cobra.Command, args []string) error {
+	wfile, err := loadCustomSectionInput()
+	if err != nil {
+		return err
+	}
+	if customSectionFile == "" {
+		return errors.New("No data file")
+	}
+
+	found := false
+	for _, c := range wfile.Custom {
+		if c.Name == customSectionName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("Custom section %s not found", customSectionName)
+	}
+
+	data := wfile.GetCustomSectionData(customSectionName)
+	fmt.Printf("Writing custom section %s (%d bytes) to %s...\n", customSectionName, len(data), customSectionFile)
+	return os.WriteFile(customSectionFile, data, 0644)
+}
+
+func runCustomSectionRemove(ccmd *cobra.Command, args []string) error {
+	wfile, err := loadCustomSectionInput()
+	if err != nil {
+		return err
+	}
+
+	removed := wfile.RemoveCustomSection(customSectionName)
+	if removed == 0 {
+		return fmt.Errorf("Custom section %s not found", customSectionName)
+	}
+	fmt.Printf("Removed %d custom sections\n", removed)
+
+	return writeCustomSectionOutput(wfile)
+}
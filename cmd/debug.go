@@ -0,0 +1,110 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/debugger"
+	"github.com/loopholelabs/wasm-toolkit/pkg/interp"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdDebug = &cobra.Command{
+		Use:   "debug",
+		Short: "Debug a wasm file in the built-in interpreter",
+		Long:  `This runs a module in the interpreter, with breakpoints, stepping by source line, and variables shown using the dwarf debug info. Going backwards runs the module again from the start with its WASI calls replayed, so it goes the same way. Type help at the prompt for the commands.`,
+		RunE:  runDebug,
+	}
+)
+
+var debug_func = "_start"
+var debug_args []string
+var debug_env []string
+var debug_replay = ""
+
+func init() {
+	rootCmd.AddCommand(cmdDebug)
+	cmdDebug.Flags().StringVar(&debug_func, "func", "_start", "Export to run")
+	cmdDebug.Flags().StringArrayVar(&debug_args, "arg", []string{}, "Argument for the module")
+	cmdDebug.Flags().StringArrayVar(&debug_env, "env", []string{}, "Environment variable for the module, eg HOME=/")
+	cmdDebug.Flags().StringVar(&debug_replay, "replay", "", "Answer WASI calls from a file written by run --record, to debug that run")
+}
+
+func runDebug(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+	wfile.Debug.Demangle = !rawNames
+
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
+	if err != nil {
+		return err
+	}
+	if debugSections.GetCustomSectionData(".debug_info") != nil {
+		err = wfile.Debug.ParseDwarf(debugSections)
+		if err != nil {
+			return err
+		}
+		wfile.Debug.LowMemory = true
+		err = wfile.Debug.ParseDwarfLineNumbers()
+		if err != nil {
+			return err
+		}
+		err = wfile.Debug.ParseDwarfVariables(wfile)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("There's no dwarf debug info, so stepping is by instruction\n")
+	}
+
+	config := debugger.Debugger_config{
+		Func: debug_func,
+		Interp: interp.Interp_config{
+			Args:   append([]string{Input}, debug_args...),
+			Env:    debug_env,
+			Stdin:  os.Stdin,
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+		},
+	}
+	if debug_replay != "" {
+		f, err := os.Open(debug_replay)
+		if err != nil {
+			return err
+		}
+		config.Interp.Replay, err = interp.ReadWasiLog(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	d := debugger.New(wfile, config, os.Stdout)
+	return d.Repl(os.Stdin)
+}
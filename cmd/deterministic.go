@@ -0,0 +1,143 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/wat"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdDeterministic = &cobra.Command{
+		Use:   "deterministic",
+		Short: "Make the clocks and random numbers of a wasm file repeatable",
+		Long:  `This replaces the wasi clock, random and poll calls, so the module sees the same times and random bytes every run`,
+		RunE:  runDeterministic,
+	}
+)
+
+var det_seed int64 = 1
+var det_start_time int64 = 0
+var det_tick int64 = 1000
+
+func init() {
+	rootCmd.AddCommand(cmdDeterministic)
+	cmdDeterministic.Flags().Int64Var(&det_seed, "seed", 1, "Seed for random_get")
+	cmdDeterministic.Flags().Int64Var(&det_start_time, "start-time", 0, "Realtime clock start, in nanoseconds since the epoch")
+	cmdDeterministic.Flags().Int64Var(&det_tick, "tick", 1000, "Nanoseconds the clocks move on by each time they're read")
+}
+
+func runDeterministic(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if det_tick <= 0 {
+		return errors.New("--tick must be at least 1")
+	}
+	if det_start_time < 0 {
+		return errors.New("--start-time can't be negative")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing custom name section...\n")
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	originalFunctionLength := len(wfile.Code)
+
+	// There's no payload data, so the code can go straight in
+	data, err := wat.Wat_content.ReadFile(path.Join("wat_code", "deterministic.wat"))
+	if err != nil {
+		return err
+	}
+	mod := &wasmfile.WasmFile{}
+	err = mod.DecodeWatFile("deterministic.wat", data)
+	if err != nil {
+		return err
+	}
+	err = wfile.AddFuncsFrom(mod, func(remap map[int]int) {})
+	if err != nil {
+		return err
+	}
+
+	err = wfile.SetGlobal("$det_rng", types.ValI64, fmt.Sprintf("i64.const %d", det_seed))
+	if err != nil {
+		return err
+	}
+	err = wfile.SetGlobal("$det_realtime_base", types.ValI64, fmt.Sprintf("i64.const %d", det_start_time))
+	if err != nil {
+		return err
+	}
+	err = wfile.SetGlobal("$det_tick", types.ValI64, fmt.Sprintf("i64.const %d", det_tick))
+	if err != nil {
+		return err
+	}
+
+	import_redirect_map := map[string]string{
+		"wasi_snapshot_preview1:clock_time_get": "$det_clock_time_get",
+		"wasi_snapshot_preview1:clock_res_get":  "$det_clock_res_get",
+		"wasi_snapshot_preview1:random_get":     "$det_random_get",
+		"wasi_snapshot_preview1:poll_oneoff":    "$det_poll_oneoff",
+	}
+
+	redirected, err := wfile.RedirectImportCalls(import_redirect_map, wfile.Code[:originalFunctionLength])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Redirected %d imports\n", len(redirected))
+
+	for _, c := range wfile.Code[originalFunctionLength:] {
+		err = c.ResolveGlobals(wfile)
+		if err != nil {
+			return err
+		}
+
+		err = c.ResolveFunctions(wfile)
+		if err != nil {
+			return err
+		}
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+)
+
+// The numbers splitmix64 gives for a seed
+func splitmix64(seed uint64, n int) []uint64 {
+	res := make([]uint64, 0)
+	for i := 0; i < n; i++ {
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		res = append(res, z^(z>>31))
+	}
+	return res
+}
+
+func TestDeterministic(t *testing.T) {
+	program := wasiProgram("clock", "clock", "random", "random")
+
+	r := splitmix64(1, 2)
+	out := instrument(t, program, "deterministic", "--start-time", "1000000000", "--tick", "5")
+	for i := 0; i < 2; i++ {
+		stdout, _ := runWasi(t, out, wazero.NewModuleConfig())
+		assert.Equal(t, fmt.Sprintf("1000000000\n1000000005\n%d\n%d\n", r[0], r[1]), stdout)
+	}
+
+	r = splitmix64(2, 2)
+	out = instrument(t, program, "deterministic", "--seed", "2")
+	stdout, _ := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, fmt.Sprintf("0\n1000\n%d\n%d\n", r[0], r[1]), stdout)
+}
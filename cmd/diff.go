@@ -0,0 +1,80 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/diff"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdDiff = &cobra.Command{
+		Use:   "diff <other.wasm>",
+		Short: "Compare two wasm files section by section",
+		Long:  `This reports added, removed and changed functions, types, imports, exports, globals, data and custom sections. It exits with status 1 if there are differences.`,
+		Args:  cobra.ExactArgs(1),
+		RunE:  runDiff,
+	}
+)
+
+var diffJson = false
+
+func init() {
+	rootCmd.AddCommand(cmdDiff)
+
+	cmdDiff.Flags().BoolVar(&diffJson, "json", false, "Output the report as JSON")
+}
+
+func runDiff(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	wfA, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	wfB, err := wasmfile.New(args[0])
+	if err != nil {
+		return err
+	}
+
+	report := diff.Compare(wfA, wfB)
+
+	if diffJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(report.Changes) > 0 {
+		// Like diff(1), differences give a non-zero exit status without any other message.
+		return errors.New("")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdDisassemble = &cobra.Command{
+		Use:   "disassemble [function]",
+		Short: "Disassemble a single function to wat",
+		Long:  `The function can be given by name (with or without the $) or by function index. With --objdump the output is in the format of wasm-objdump -d, and every function is written if none is given.`,
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runDisassemble,
+	}
+)
+
+var disassembleDwarf = true
+var disassembleFolded = false
+var disassembleObjdump = false
+
+func init() {
+	rootCmd.AddCommand(cmdDisassemble)
+
+	cmdDisassemble.Flags().BoolVar(&disassembleDwarf, "dwarf", true, "Include dwarf line numbers and variable names if available")
+	cmdDisassemble.Flags().BoolVar(&disassembleFolded, "folded", false, "Nest operands under the instructions that use them, and indent blocks")
+	cmdDisassemble.Flags().BoolVar(&disassembleObjdump, "objdump", false, "Write in the format of wasm-objdump -d, with file offsets and instruction bytes")
+}
+
+func findFunction(wfile *wasmfile.WasmFile, f string) (int, error) {
+	fid := wfile.Debug.LookupFunctionID(f)
+	if fid == -1 {
+		fid = wfile.Debug.LookupFunctionID("$" + f)
+	}
+	if fid == -1 {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return -1, fmt.Errorf("Function %s not found", f)
+		}
+		fid = n
+	}
+	if fid < len(wfile.Import) {
+		return -1, fmt.Errorf("Function %s is an import", f)
+	}
+	if fid >= len(wfile.Import)+len(wfile.Code) {
+		return -1, fmt.Errorf("Function %s not found", f)
+	}
+	return fid, nil
+}
+
+func runDisassemble(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if len(args) == 0 && !disassembleObjdump {
+		return errors.New("No function given")
+	}
+
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+	wfile, err := wasmfile.NewFromReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
+	if err != nil {
+		return err
+	}
+
+	if disassembleDwarf && debugSections.GetCustomSectionData(".debug_info") != nil {
+		err = wfile.Debug.ParseDwarf(debugSections)
+		if err != nil {
+			return err
+		}
+		wfile.Debug.LowMemory = lowMemory
+		err = wfile.Debug.ParseDwarfLineNumbers()
+		if err != nil {
+			return err
+		}
+		err = wfile.Debug.ParseDwarfVariables(wfile)
+		if err != nil {
+			return err
+		}
+	}
+
+	fid := -1
+	if len(args) > 0 {
+		fid, err = findFunction(wfile, args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	if disassembleObjdump {
+		fmt.Printf("\n%s:\tfile format wasm 0x1\n\nCode Disassembly:\n\n", Input)
+		return wfile.EncodeObjdump(os.Stdout, data, fid)
+	}
+
+	wfile.FoldedWat = disassembleFolded
+	return wfile.EncodeFunctionWat(os.Stdout, fid-len(wfile.Import))
+}
@@ -0,0 +1,68 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/dump"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdDump = &cobra.Command{
+		Use:   "dump",
+		Short: "Dump the structure of a wasm file as json or yaml",
+		Long:  `This writes out the types, imports, functions with their names and signatures, tables, memories, globals, exports, data segments and custom sections of a wasm file, so other tools and scripts can use them.`,
+		RunE:  runDump,
+	}
+)
+
+var dump_format = "json"
+
+func init() {
+	rootCmd.AddCommand(cmdDump)
+	cmdDump.Flags().StringVar(&dump_format, "format", "json", "Output format (json or yaml)")
+}
+
+func runDump(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if dump_format != "json" && dump_format != "yaml" {
+		return fmt.Errorf("Unknown dump format %q", dump_format)
+	}
+
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+	wfile.Debug.Demangle = !rawNames
+
+	m, err := dump.Describe(wfile)
+	if err != nil {
+		return err
+	}
+
+	if dump_format == "yaml" {
+		return m.WriteYAML(os.Stdout)
+	}
+	return m.WriteJSON(os.Stdout)
+}
@@ -0,0 +1,176 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdEmbedenv = &cobra.Command{
+		Use:   "embedenv",
+		Short: "Add environment variables to the wasm",
+		Long:  `This bakes environment variables into the wasm, which are added to (or override) the ones the host gives it`,
+		RunE:  runEmbedEnv,
+	}
+)
+
+var ee_vars []string
+
+func init() {
+	rootCmd.AddCommand(cmdEmbedenv)
+	cmdEmbedenv.Flags().StringArrayVar(&ee_vars, "env", []string{}, "Environment variable as KEY=VALUE (can be given more than once)")
+}
+
+/**
+ * Build the environment data used by env.wat. If a key is given more than once, the last value wins.
+ *
+ */
+func buildEnvTable(vars []string) ([]byte, []byte, error) {
+	keys := make([]string, 0)
+	values := make(map[string]string)
+	for _, v := range vars {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, nil, fmt.Errorf("The environment variable \"%s\" should be KEY=VALUE", v)
+		}
+		if strings.ContainsRune(v, 0) {
+			return nil, nil, fmt.Errorf("The environment variable %s can't contain a nul", key)
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+
+	env := make([]byte, 0)
+	locs := make([]byte, 0)
+	for _, key := range keys {
+		entry := fmt.Sprintf("%s=%s\x00", key, values[key])
+		locs = binary.LittleEndian.AppendUint32(locs, uint32(len(env)))
+		locs = binary.LittleEndian.AppendUint32(locs, uint32(len(entry)))
+		locs = binary.LittleEndian.AppendUint32(locs, uint32(len(key)))
+		env = append(env, []byte(entry)...)
+	}
+	return env, locs, nil
+}
+
+func runEmbedEnv(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if len(ee_vars) == 0 {
+		return errors.New("No environment variables given")
+	}
+
+	data_env, data_env_locs, err := buildEnvTable(ee_vars)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing custom name section...\n")
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	originalFunctionLength := len(wfile.Code)
+
+	// Load up the individual wat files, and add them in
+	files := []string{
+		"memory.wat",
+		"env.wat"}
+
+	payload, err := wfile.AddPayload(files)
+	if err != nil {
+		return err
+	}
+
+	payload.AddData("$wt_env", data_env)
+	payload.AddData("$wt_env_locs", data_env_locs)
+
+	for e := 0; e < len(data_env_locs); e += 12 {
+		offset := binary.LittleEndian.Uint32(data_env_locs[e:])
+		keylen := binary.LittleEndian.Uint32(data_env_locs[e+8:])
+		fmt.Printf("Embedding %s\n", data_env[offset:offset+keylen])
+	}
+
+	// Redirect the environment imports
+	import_redirect_map := map[string]string{
+		"wasi_snapshot_preview1:environ_sizes_get": "$wrap_environ_sizes_get",
+		"wasi_snapshot_preview1:environ_get":       "$wrap_environ_get",
+	}
+
+	redirected, err := wfile.RedirectImportCalls(import_redirect_map, wfile.Code[:originalFunctionLength])
+	if err != nil {
+		return err
+	}
+	if len(redirected) == 0 {
+		fmt.Printf("The module doesn't read its environment, so the variables won't be seen\n")
+	}
+
+	for _, c := range wfile.Code[:originalFunctionLength] {
+		err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
+		if err != nil {
+			return err
+		}
+		err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range wfile.Code {
+		err = payload.Resolve(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = payload.Finish()
+	if err != nil {
+		return err
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+)
+
+func TestEmbedenv(t *testing.T) {
+	long := strings.Repeat("x", 3000)
+	out := instrument(t, wasiProgram("env"), "embedenv", "--env", "B=embedded", "--env", "C=new", "--env", "LONG="+long)
+
+	stdout, _ := runWasi(t, out, wazero.NewModuleConfig().WithEnv("A", "host").WithEnv("B", "host"))
+	// B is overridden where the host had it, as well as being added
+	assert.Equal(t, "A=host\nB=embedded\nB=embedded\nC=new\nLONG="+long+"\n", stdout)
+
+	// With nothing from the host, there are just the embedded ones
+	stdout, _ = runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "B=embedded\nC=new\nLONG="+long+"\n", stdout)
+}
@@ -17,9 +17,17 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/loopholelabs/wasm-toolkit/internal/wat"
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
@@ -32,32 +40,292 @@ import (
 var (
 	cmdEmbedfile = &cobra.Command{
 		Use:   "embedfile",
-		Short: "Add a file to the wasm",
-		Long:  `This will embed a file within the wasm`,
-		Run:   runEmbedFile,
+		Short: "Add files to the wasm",
+		Long:  `This will embed files within the wasm, so the module can open and read them without a real filesystem`,
+		RunE:  runEmbedFile,
 	}
 )
 
 var em_filename = "embedtest"
 var em_content = "Yeah!"
 var em_contentfile = ""
+var em_files []string
+var em_dirs []string
+var em_write_space = 0
+var em_overlay = "embedded-first"
+var em_mounts []string
+var em_compress = false
+var em_maps []string
 
 func init() {
 	rootCmd.AddCommand(cmdEmbedfile)
 	cmdEmbedfile.Flags().StringVar(&em_filename, "filename", "embedtest", "Embed filename")
 	cmdEmbedfile.Flags().StringVar(&em_content, "content", "Hey! This isn't really a file. It's embedded in the wasm.", "Embed content")
-	cmdEmbedfile.Flags().StringVar(&em_contentfile, "contentfile", "", "Embed content from file")
+	cmdEmbedfile.Flags().StringVar(&em_contentfile, "content-file", "", "Embed the bytes of a host file as the content")
+	cmdEmbedfile.Flags().StringVar(&em_contentfile, "contentfile", "", "Embed the bytes of a host file as the content")
+	cmdEmbedfile.Flags().MarkDeprecated("contentfile", "use --content-file instead")
+	cmdEmbedfile.Flags().StringArrayVar(&em_files, "file", []string{}, "Embed a file as host_path[:guest_path] (can be given more than once)")
+	cmdEmbedfile.Flags().StringArrayVar(&em_dirs, "dir", []string{}, "Embed a directory tree as host_dir[:guest_dir] (can be given more than once)")
+	cmdEmbedfile.Flags().IntVar(&em_write_space, "write-space", 0, "Extra bytes each embedded file can grow by when it's written to")
+	cmdEmbedfile.Flags().StringVar(&em_overlay, "overlay", "embedded-first", "How embedded files overlay the host filesystem (embedded-first, host-first or embedded-only)")
+	cmdEmbedfile.Flags().StringArrayVar(&em_mounts, "mount", []string{}, "Overlay mode for paths under a prefix, as prefix:mode (can be given more than once)")
+	cmdEmbedfile.Flags().BoolVar(&em_compress, "compress", false, "Deflate the file contents, and unpack them in the module when they're first opened")
+	cmdEmbedfile.Flags().StringArrayVar(&em_maps, "map", []string{}, "Remap a guest path as guest_path:target_path, which can be embedded (can be given more than once)")
 }
 
-func runEmbedFile(ccmd *cobra.Command, args []string) {
+// How the contents of a file are unpacked, as used by embed.wat
+const (
+	packNone    = 0
+	packCopy    = 1
+	packInflate = 2
+)
+
+/**
+ * Compress the contents of each file in the file table. Files that don't get any smaller are just copied.
+ *
+ */
+func packFileTable(table []byte, contents []byte) ([]byte, []byte, error) {
+	packed := make([]byte, 0)
+	packedData := make([]byte, 0)
+	for e := 0; e < len(table); e += 32 {
+		offset := binary.LittleEndian.Uint32(table[e+8:])
+		length := binary.LittleEndian.Uint32(table[e+12:])
+		content := contents[offset : offset+length]
+
+		method := packNone
+		data := []byte{}
+		if length > 0 {
+			var buf bytes.Buffer
+			w, err := flate.NewWriter(&buf, flate.BestCompression)
+			if err != nil {
+				return nil, nil, err
+			}
+			_, err = w.Write(content)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = w.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			method = packInflate
+			data = buf.Bytes()
+			if len(data) >= len(content) {
+				method = packCopy
+				data = content
+			}
+		}
+		packed = binary.LittleEndian.AppendUint32(packed, uint32(len(packedData)))
+		packed = binary.LittleEndian.AppendUint32(packed, uint32(len(data)))
+		packed = binary.LittleEndian.AppendUint32(packed, uint32(method))
+		packedData = append(packedData, data...)
+	}
+	return packed, packedData, nil
+}
+
+// Overlay modes, as used by embed.wat
+var overlayModes = map[string]int{
+	"embedded-first": 0,
+	"host-first":     1,
+	"embedded-only":  2,
+}
+
+/**
+ * Build the mount table for embed.wat, longest prefix first so the first match wins. The root comes last, with the
+ * default mode.
+ *
+ */
+func buildMountTable(defaultMode string, mounts []string) ([]byte, []byte, error) {
+	type mount struct {
+		prefix string
+		mode   int
+	}
+	mode, ok := overlayModes[defaultMode]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown overlay mode %s", defaultMode)
+	}
+	all := []*mount{{prefix: "", mode: mode}}
+	for _, m := range mounts {
+		prefix, modeName, found := strings.Cut(m, ":")
+		if !found {
+			return nil, nil, fmt.Errorf("The mount %s should be prefix:mode", m)
+		}
+		mode, ok := overlayModes[modeName]
+		if !ok {
+			return nil, nil, fmt.Errorf("Unknown overlay mode %s", modeName)
+		}
+		prefix = strings.TrimPrefix(path.Clean("/"+prefix), "/")
+		all = append(all, &mount{prefix: prefix, mode: mode})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return len(all[i].prefix) > len(all[j].prefix)
+	})
+
+	table := make([]byte, 0)
+	prefixes := make([]byte, 0)
+	for _, m := range all {
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(prefixes)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(m.prefix)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(m.mode))
+		prefixes = append(prefixes, []byte(m.prefix)...)
+	}
+	return table, prefixes, nil
+}
+
+type embeddedFile struct {
+	name    string
+	content []byte
+}
+
+/**
+ * Split host_path[:guest_path]. The guest path defaults to the host path.
+ *
+ */
+func splitEmbedPath(v string) (string, string) {
+	host, guest, found := strings.Cut(v, ":")
+	if !found || guest == "" {
+		guest = filepath.ToSlash(host)
+	}
+	return host, strings.TrimPrefix(path.Clean(guest), "/")
+}
+
+// Wasi filetypes
+const (
+	filetypeDirectory   = 3
+	filetypeRegularFile = 4
+)
+
+/**
+ * Build the file table for embed.wat. The root directory is entry 0, and the directories above each file are
+ * added as entries too, so that they can be opened and read.
+ *
+ */
+func buildFileTable(files []*embeddedFile, writeSpace int) ([]byte, []byte, []byte, error) {
+	type tableEntry struct {
+		name     string
+		filetype int
+		parent   int
+		content  []byte
+	}
+	entries := []*tableEntry{{name: ".", filetype: filetypeDirectory, parent: -1}}
+	index := map[string]int{".": 0}
+
+	var addEntry func(name string, filetype int, content []byte) (int, error)
+	addEntry = func(name string, filetype int, content []byte) (int, error) {
+		if idx, ok := index[name]; ok {
+			if filetype == filetypeDirectory && entries[idx].filetype == filetypeDirectory {
+				return idx, nil
+			}
+			return -1, fmt.Errorf("The file %s is embedded more than once", name)
+		}
+		parent, err := addEntry(path.Dir(name), filetypeDirectory, nil)
+		if err != nil {
+			return -1, err
+		}
+		index[name] = len(entries)
+		entries = append(entries, &tableEntry{name: name, filetype: filetype, parent: parent, content: content})
+		return len(entries) - 1, nil
+	}
+
+	for _, f := range files {
+		_, err := addEntry(f.name, filetypeRegularFile, f.content)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	table := make([]byte, 0)
+	names := make([]byte, 0)
+	contents := make([]byte, 0)
+	for _, e := range entries {
+		capacity := 0
+		if e.filetype == filetypeRegularFile {
+			capacity = len(e.content) + writeSpace
+		}
+		base := 0
+		if e.parent > 0 {
+			base = len(entries[e.parent].name) + 1
+		}
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(names)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(e.name)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(contents)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(e.content)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(capacity))
+		table = binary.LittleEndian.AppendUint32(table, uint32(e.filetype))
+		table = binary.LittleEndian.AppendUint32(table, uint32(int32(e.parent)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(base))
+		names = append(names, []byte(e.name)...)
+		contents = append(contents, e.content...)
+		contents = append(contents, make([]byte, capacity-len(e.content))...)
+	}
+	return table, names, contents, nil
+}
+
+/**
+ * Get all the files to embed from the flags
+ *
+ */
+func getEmbeddedFiles() ([]*embeddedFile, error) {
+	files := make([]*embeddedFile, 0)
+
+	if len(em_files) == 0 && len(em_dirs) == 0 {
+		content := []byte(em_content)
+		if em_contentfile != "" {
+			bytes, err := os.ReadFile(em_contentfile)
+			if err != nil {
+				return nil, err
+			}
+			content = bytes
+		}
+		return append(files, &embeddedFile{name: strings.TrimPrefix(path.Clean(em_filename), "/"), content: content}), nil
+	}
+
+	for _, f := range em_files {
+		host, guest := splitEmbedPath(f)
+		content, err := os.ReadFile(host)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &embeddedFile{name: guest, content: content})
+	}
+
+	for _, d := range em_dirs {
+		host, guest := splitEmbedPath(d)
+		err := filepath.WalkDir(host, func(p string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !de.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(host, p)
+			if err != nil {
+				return err
+			}
+			content, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			files = append(files, &embeddedFile{name: path.Join(guest, filepath.ToSlash(rel)), content: content})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func runEmbedFile(ccmd *cobra.Command, args []string) error {
 	if Input == "" {
-		panic("No input file")
+		return errors.New("No input file")
 	}
 
 	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
 	wfile, err := wasmfile.New(Input)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Parsing custom name section...\n")
@@ -68,49 +336,124 @@ func runEmbedFile(ccmd *cobra.Command, args []string) {
 	memFunctions := &wasmfile.WasmFile{}
 	data, err := wat.Wat_content.ReadFile(path.Join("wat_code", "memory.wat"))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = memFunctions.DecodeWat(data)
+	err = memFunctions.DecodeWatFile("memory.wat", data)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// TODO: Wrap file imports so we can do what we want to...
 
 	originalFunctionLength := len(wfile.Code)
 
-	wfile.AddFuncsFrom(memFunctions, func(m map[int]int) {})
+	err = wfile.AddFuncsFrom(memFunctions, func(m map[int]int) {})
+	if err != nil {
+		return err
+	}
 
 	data_ptr := wfile.Memory[0].LimitMin << 16
-	wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	err = wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	if err != nil {
+		return err
+	}
 
 	// Now we can start doing interesting things...
 
-	em_content_data := []byte(em_content)
-
-	if em_contentfile != "" {
-		bytes, err := os.ReadFile(em_contentfile)
-		if err != nil {
-			panic(err)
-		}
-		em_content_data = bytes
+	files, err := getEmbeddedFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Printf("Embedding %s (%d bytes)\n", f.name, len(f.content))
 	}
 
 	// Add a payload to the wasm file
 	embedFunctions := &wasmfile.WasmFile{}
 	data, err = wat.Wat_content.ReadFile(path.Join("wat_code", "embed.wat"))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	err = embedFunctions.DecodeWatFile("embed.wat", data)
+	if err != nil {
+		return err
+	}
+
+	ptr, err := wfile.AddDataFrom(int32(data_ptr), embedFunctions)
+	if err != nil {
+		return err
+	}
+
+	inflateFunctions := &wasmfile.WasmFile{}
+	data, err = wat.Wat_content.ReadFile(path.Join("wat_code", "inflate.wat"))
+	if err != nil {
+		return err
+	}
+	err = inflateFunctions.DecodeWatFile("inflate.wat", data)
+	if err != nil {
+		return err
 	}
-	err = embedFunctions.DecodeWat(data)
+
+	ptr, err = wfile.AddDataFrom(ptr, inflateFunctions)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	// Path remapping goes in front of the embedded filesystem
+	var remapFunctions *wasmfile.WasmFile
+	if len(em_maps) > 0 {
+		data_remaps, data_remap_names, err := buildRemapTable(em_maps)
+		if err != nil {
+			return err
+		}
+		remapFunctions = &wasmfile.WasmFile{}
+		data, err = wat.Wat_content.ReadFile(path.Join("wat_code", "remap.wat"))
+		if err != nil {
+			return err
+		}
+		err = remapFunctions.DecodeWatFile("remap.wat", data)
+		if err != nil {
+			return err
+		}
+		_, err = wfile.AddDataFrom(ptr, remapFunctions)
+		if err != nil {
+			return err
+		}
+		wfile.AddData("$wt_remaps", data_remaps)
+		wfile.AddData("$wt_remap_names", data_remap_names)
 	}
 
-	wfile.AddDataFrom(int32(data_ptr), embedFunctions)
+	// The file table, which the wrapped wasi calls search by name
+	data_files, data_file_names, data_file_contents, err := buildFileTable(files, em_write_space)
+	if err != nil {
+		return err
+	}
+	wfile.AddData("$wt_files", data_files)
+	wfile.AddData("$wt_file_names", data_file_names)
+
+	// Compressed contents are unpacked after all the payload data, so they don't take up space in the wasm file.
+	data_file_packed := []byte{}
+	data_file_packed_data := []byte{}
+	unpacked_size := 0
+	if em_compress {
+		data_file_packed, data_file_packed_data, err = packFileTable(data_files, data_file_contents)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Compressed %d bytes of contents to %d\n", len(data_file_contents), len(data_file_packed_data))
+		unpacked_size = len(data_file_contents)
+		data_file_contents = []byte{}
+	}
+	wfile.AddData("$wt_file_contents", data_file_contents)
+	wfile.AddData("$wt_file_packed", data_file_packed)
+	wfile.AddData("$wt_file_packed_data", data_file_packed_data)
 
-	wfile.AddData("$file_name", []byte(em_filename))
-	wfile.AddData("$file_content", em_content_data)
+	data_mounts, data_mount_prefixes, err := buildMountTable(em_overlay, em_mounts)
+	if err != nil {
+		return err
+	}
+	wfile.AddData("$wt_mounts", data_mounts)
+	wfile.AddData("$wt_mount_prefixes", data_mount_prefixes)
 
 	// Find out how much data we need for the payload
 	total_payload_data := data_ptr
@@ -119,91 +462,142 @@ func runEmbedFile(ccmd *cobra.Command, args []string) {
 		total_payload_data = int(last_data.Offset[0].I32Value) + len(last_data.Data) - data_ptr
 	}
 
+	unpacked_offset := -1
+	if em_compress {
+		unpacked_offset = (total_payload_data + wasmfile.ALIGN_DATA - 1) & -wasmfile.ALIGN_DATA
+		total_payload_data = unpacked_offset + unpacked_size
+	}
+
 	payload_size := (total_payload_data + 65535) >> 16
 	fmt.Printf("Payload data of %d (%d pages)\n", total_payload_data, payload_size)
 
-	wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	err = wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	if err != nil {
+		return err
+	}
 	wfile.Memory[0].LimitMin = wfile.Memory[0].LimitMin + payload_size
 
-	wfile.AddFuncsFrom(embedFunctions, func(m map[int]int) {}) // NB: This may mean inserting an import which changes all func numbers.
+	err = wfile.AddFuncsFrom(embedFunctions, func(m map[int]int) {}) // NB: This may mean inserting an import which changes all func numbers.
+	if err != nil {
+		return err
+	}
+	err = wfile.AddFuncsFrom(inflateFunctions, func(m map[int]int) {})
+	if err != nil {
+		return err
+	}
+	remapStart := len(wfile.Code)
+	if remapFunctions != nil {
+		err = wfile.AddFuncsFrom(remapFunctions, func(m map[int]int) {})
+		if err != nil {
+			return err
+		}
+	}
+	remapEnd := len(wfile.Code)
+
+	err = wfile.SetGlobal("$embed_unpacked_offset", types.ValI32, fmt.Sprintf("i32.const %d", unpacked_offset))
+	if err != nil {
+		return err
+	}
 
 	// Redirect some imports...
 	import_redirect_map := map[string]string{
-		"wasi_snapshot_preview1:fd_prestat_get": "$wrap_fd_prestat_get",
-		"wasi_snapshot_preview1:path_open":      "$wrap_path_open",
-		"wasi_snapshot_preview1:fd_read":        "$wrap_fd_read",
+		"wasi_snapshot_preview1:fd_prestat_get":        "$wrap_fd_prestat_get",
+		"wasi_snapshot_preview1:path_open":             "$wrap_path_open",
+		"wasi_snapshot_preview1:fd_read":               "$wrap_fd_read",
+		"wasi_snapshot_preview1:fd_close":              "$wrap_fd_close",
+		"wasi_snapshot_preview1:fd_write":              "$wrap_fd_write",
+		"wasi_snapshot_preview1:fd_seek":               "$wrap_fd_seek",
+		"wasi_snapshot_preview1:fd_filestat_get":       "$wrap_fd_filestat_get",
+		"wasi_snapshot_preview1:path_filestat_get":     "$wrap_path_filestat_get",
+		"wasi_snapshot_preview1:fd_fdstat_get":         "$wrap_fd_fdstat_get",
+		"wasi_snapshot_preview1:fd_readdir":            "$wrap_fd_readdir",
+		"wasi_snapshot_preview1:path_create_directory": "$wrap_path_create_directory",
+		"wasi_snapshot_preview1:path_remove_directory": "$wrap_path_remove_directory",
+		"wasi_snapshot_preview1:path_unlink_file":      "$wrap_path_unlink_file",
+		"wasi_snapshot_preview1:path_rename":           "$wrap_path_rename",
 	}
 
-	for from, to := range import_redirect_map {
-		fromId := wfile.LookupImport(from)
-		toId := wfile.Debug.LookupFunctionID(to)
-
-		fmt.Printf("Redirecting code from %d to %d\n", fromId, toId)
-
-		for idx, c := range wfile.Code {
-			if idx < originalFunctionLength {
-				c.ModifyAllCalls(map[int]int{fromId: toId})
-			}
+	// With remapping, the module calls remap.wat, which then calls the embedded filesystem
+	targets := import_redirect_map
+	if remapFunctions != nil {
+		_, err = wfile.RedirectImportCalls(import_redirect_map, wfile.Code[remapStart:remapEnd])
+		if err != nil {
+			return err
+		}
+		targets = make(map[string]string)
+		for from, to := range import_redirect_map {
+			targets[from] = to
 		}
+		for from, to := range remapRedirects {
+			targets[from] = to
+		}
+	}
 
+	redirected, err := wfile.RedirectImportCalls(targets, wfile.Code[:originalFunctionLength])
+	if err != nil {
+		return err
 	}
+	fmt.Printf("Redirected %d imports\n", len(redirected))
 
 	// Adjust any memory.size / memory.grow calls
 	for idx, c := range wfile.Code {
 		if idx < originalFunctionLength {
 			err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
 			if err != nil {
-				panic(err)
+				return err
 			}
 			err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
 			if err != nil {
-				panic(err)
+				return err
 			}
 		} else {
 			// Do any relocation adjustments...
 			err = c.InsertAfterRelocating(wfile, `global.get $debug_start_mem
 																						i32.add`)
 			if err != nil {
-				panic(err)
+				return err
 			}
 		}
 
 		err = c.ResolveLengths(wfile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		err = c.ResolveRelocations(wfile, data_ptr)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		err = c.ResolveGlobals(wfile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		err = c.ResolveFunctions(wfile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 	}
 
+	// Keep the data names, so the embedded files can be found again by extract
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
 	fmt.Printf("Writing wasm out to %s...\n", Output)
 	f, err := os.Create(Output)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = wfile.EncodeBinary(f)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = f.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	/*
@@ -211,19 +605,20 @@ func runEmbedFile(ccmd *cobra.Command, args []string) {
 	   f2, err := os.Create("debug.wat")
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 
 	   err = wfile.EncodeWat(f2)
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 
 	   err = f2.Close()
 
 	   	if err != nil {
-	   		panic(err)
+	   		return err
 	   	}
 	*/
+	return nil
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+)
+
+// Make some host files to embed, as name:content
+func hostFiles(t *testing.T, files ...string) string {
+	dir := t.TempDir()
+	for _, f := range files {
+		name, content, _ := strings.Cut(f, ":")
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0777))
+		assert.NoError(t, os.WriteFile(p, []byte(content), 0666))
+	}
+	return dir
+}
+
+func TestEmbedfile(t *testing.T) {
+	host := hostFiles(t, "a.txt:Hello A", "tree/x.txt:Hello X", "tree/y/z.txt:Hello Z")
+	out := instrument(t, wasiProgram(
+		"cat 3 data/a.txt", "print \n",
+		"cat 3 /data/a.txt", "print \n",
+		"cat 3 ./data/sub/y/z.txt", "print \n",
+		"ls 3 data/sub",
+		"stat 3 data/sub/x.txt",
+		"stat 3 data/sub/y",
+		"cat 3 data/missing",
+	), "embedfile", "--file", filepath.Join(host, "a.txt")+":/data/a.txt", "--dir", filepath.Join(host, "tree")+":data/sub")
+
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(t.TempDir(), "/"))
+	stdout, _ := runWasi(t, out, config)
+	assert.Equal(t, "Hello A\nHello A\nHello Z\nx.txt\ny\ntype 4 size 7\ntype 3 size 0\nerror 44\n", stdout)
+}
+
+func TestEmbedfilePreopen(t *testing.T) {
+	host := hostFiles(t, "a.txt:Hello A")
+	out := instrument(t, wasiProgram(
+		"cat 3 a.txt", "print \n",
+		"stat 3 a.txt",
+		"ls 3 .",
+	), "embedfile", "--file", filepath.Join(host, "a.txt")+":/data/a.txt")
+
+	// The module opens the file relative to the preopen, so it only asks for a.txt
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(t.TempDir(), "/data"))
+	stdout, _ := runWasi(t, out, config)
+	assert.Equal(t, "Hello A\ntype 4 size 7\na.txt\n", stdout)
+}
+
+func TestEmbedfileMap(t *testing.T) {
+	host := hostFiles(t, "x.txt:Hello X")
+	out := instrument(t, wasiProgram(
+		"cat 3 x.txt", "print \n",
+		"stat 3 x.txt",
+	), "embedfile", "--dir", host+":/assets", "--map", "/data:/assets")
+
+	// No preopen holds /assets, so it's only embedded
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(t.TempDir(), "/data"))
+	stdout, _ := runWasi(t, out, config)
+	assert.Equal(t, "Hello X\ntype 4 size 7\n", stdout)
+}
+
+func TestEmbedfileContentFile(t *testing.T) {
+	content := make([]byte, 256)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	host := filepath.Join(t.TempDir(), "bin.dat")
+	assert.NoError(t, os.WriteFile(host, content, 0666))
+	out := instrument(t, wasiProgram("cat 3 bin.dat", "stat 3 bin.dat"), "embedfile", "--content-file", host, "--filename", "/data/bin.dat")
+
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(t.TempDir(), "/data"))
+	stdout, _ := runWasi(t, out, config)
+	assert.Equal(t, string(content)+"type 4 size 256\n", stdout)
+}
+
+func TestEmbedfileWrite(t *testing.T) {
+	host := hostFiles(t, "a.txt:Hello A", "b.txt:Hello B")
+	out := instrument(t, wasiProgram(
+		"tail 3 a.txt 3", "print \n",
+		"write 3 a.txt Bye", "cat 3 a.txt", "print \n",
+		"stat 3 a.txt",
+		"write 3 b.txt 0123456789012345678901234567890123456789",
+		"cat 3 b.txt", "print \n",
+		"ls 3 .",
+		"write 3 c.txt On the host",
+	), "embedfile", "--dir", host+":/data", "--write-space", "16")
+
+	mount := t.TempDir()
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(mount, "/data"))
+	stdout, _ := runWasi(t, out, config)
+	// b.txt can only grow by the write space, so the write is cut short
+	assert.Equal(t, "o A\nBye\ntype 4 size 3\n01234567890123456789012\na.txt\nb.txt\n", stdout)
+	data, err := os.ReadFile(filepath.Join(mount, "c.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "On the host", string(data))
+	// The embedded files are only changed in the module
+	data, err = os.ReadFile(filepath.Join(host, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello A", string(data))
+}
+
+func TestEmbedfileOverlay(t *testing.T) {
+	embedded := hostFiles(t, "a.txt:Embedded A", "e.txt:Embedded E", "secret/s.txt:Embedded S")
+	mount := hostFiles(t, "a.txt:Host A", "h.txt:Host H", "secret/h.txt:Host H")
+	program := wasiProgram(
+		"cat 3 a.txt", "print \n",
+		"cat 3 e.txt", "print \n",
+		"cat 3 h.txt", "print \n",
+		"cat 3 secret/h.txt", "print \n",
+	)
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(mount, "/data"))
+
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--overlay", "embedded-first"}, "Embedded A\nEmbedded E\nHost H\nHost H\n"},
+		{[]string{"--overlay", "host-first"}, "Host A\nEmbedded E\nHost H\nHost H\n"},
+		{[]string{"--overlay", "embedded-only"}, "Embedded A\nEmbedded E\nerror 44\n\nerror 44\n\n"},
+		{[]string{"--mount", "/data/secret:embedded-only"}, "Embedded A\nEmbedded E\nHost H\nerror 44\n\n"},
+	} {
+		out := instrument(t, program, append([]string{"embedfile", "--dir", embedded + ":/data"}, test.args...)...)
+		stdout, _ := runWasi(t, out, config)
+		assert.Equal(t, test.expected, stdout, test.args)
+	}
+}
+
+func TestEmbedfileLarge(t *testing.T) {
+	// Bigger than the buffer the module reads into, so it takes more than one read
+	big := strings.Repeat("Hello large file\n", 500)
+	host := hostFiles(t, "big.txt:"+big)
+	out := instrument(t, wasiProgram("cat 3 big.txt"), "embedfile", "--dir", host+":/data")
+
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(t.TempDir(), "/data"))
+	stdout, _ := runWasi(t, out, config)
+	assert.Equal(t, big, stdout)
+}
+
+func TestEmbedfileCompress(t *testing.T) {
+	big := strings.Repeat("Hello compressed world\n", 1000)
+	host := hostFiles(t, "big.txt:"+big, "small.txt:x")
+	program := wasiProgram("cat 3 big.txt", "cat 3 small.txt", "tail 3 big.txt 6", "stat 3 big.txt")
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(t.TempDir(), "/data"))
+
+	plain := instrument(t, program, "embedfile", "--dir", host+":/data")
+	packed := instrument(t, program, "embedfile", "--dir", host+":/data", "--compress")
+	assert.Less(t, len(packed), len(plain)-len(big)/2)
+
+	stdout, _ := runWasi(t, packed, config)
+	assert.Equal(t, big+"x"+"world\n"+"type 4 size 23000\n", stdout)
+}
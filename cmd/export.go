@@ -0,0 +1,159 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdExport = &cobra.Command{
+		Use:   "export",
+		Short: "Export internal functions, so the host can call them",
+		Long:  `This exports functions by their name section identifier, or every function matching a regex, so they can be called from the host for testing.`,
+		RunE:  runExport,
+	}
+)
+
+var exportFuncs []string
+var exportRegexes []string
+var exportPrefix = ""
+
+func init() {
+	rootCmd.AddCommand(cmdExport)
+
+	cmdExport.Flags().StringArrayVar(&exportFuncs, "func", []string{}, "Export a function by name (name, or name=exportname)")
+	cmdExport.Flags().StringArrayVar(&exportRegexes, "regex", []string{}, "Export every function whose name matches a regex")
+	cmdExport.Flags().StringVar(&exportPrefix, "prefix", "", "Prefix for the export names")
+}
+
+// Example:
+//	--func main.add
+//	--func 'main.add=test_add'
+//	--regex '^main\.'
+
+func runExport(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if len(exportFuncs) == 0 && len(exportRegexes) == 0 {
+		return errors.New("Nothing to export. Use --func or --regex")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing custom name section...\n")
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+	if len(wfile.Debug.FunctionNames) == 0 {
+		return errors.New("The module has no function names")
+	}
+
+	// Export name by function ID
+	toExport := make(map[int]string)
+
+	for _, f := range exportFuncs {
+		name, exportName, ok := strings.Cut(f, "=")
+		name = strings.TrimPrefix(name, "$")
+		if !ok {
+			exportName = exportPrefix + name
+		}
+		fid := wfile.Debug.LookupFunctionID("$" + name)
+		if fid == -1 {
+			return fmt.Errorf("Function %s not found", name)
+		}
+		toExport[fid] = exportName
+	}
+
+	for _, r := range exportRegexes {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return err
+		}
+		matched := 0
+		for idx := range wfile.Code {
+			fid := len(wfile.Import) + idx
+			name, ok := wfile.Debug.FunctionNames[fid]
+			if !ok {
+				continue
+			}
+			name = strings.TrimPrefix(name, "$")
+			if !re.MatchString(name) {
+				continue
+			}
+			matched++
+			if _, ok := toExport[fid]; !ok {
+				toExport[fid] = exportPrefix + name
+			}
+		}
+		if matched == 0 {
+			return fmt.Errorf("No functions matched %s", r)
+		}
+	}
+
+	fids := make([]int, 0)
+	for fid := range toExport {
+		fids = append(fids, fid)
+	}
+	sort.Ints(fids)
+
+	for _, fid := range fids {
+		name := toExport[fid]
+		exported := false
+		for _, e := range wfile.Export {
+			if e.Name == name && e.Type == types.ExportFunc && e.Index == fid {
+				exported = true
+			}
+		}
+		if exported {
+			fmt.Printf("Function %d is already exported as %s\n", fid, name)
+			continue
+		}
+		fmt.Printf("Exporting function %d as %s\n", fid, name)
+		err = wfile.AddExport(name, types.ExportFunc, fid)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
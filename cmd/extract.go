@@ -0,0 +1,199 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdExtract = &cobra.Command{
+		Use:   "extract",
+		Short: "Write files embedded in the wasm back out",
+		Long:  `This finds the files added by embedfile, and writes them out to a directory`,
+		RunE:  runExtract,
+	}
+)
+
+var ex_dir = "extracted"
+var ex_list = false
+
+func init() {
+	rootCmd.AddCommand(cmdExtract)
+	cmdExtract.Flags().StringVar(&ex_dir, "dir", "extracted", "Directory to write the embedded files to")
+	cmdExtract.Flags().BoolVar(&ex_list, "list", false, "Only list the embedded files")
+}
+
+/**
+ * Get the data for a named data segment, or nil if there isn't one
+ *
+ */
+func getNamedData(wfile *wasmfile.WasmFile, name string) []byte {
+	idx := wfile.Debug.LookupDataId(name)
+	if idx < 0 || idx >= len(wfile.Data) {
+		return nil
+	}
+	return wfile.Data[idx].Data
+}
+
+/**
+ * Read the embedded files from the file table, unpacking them if they were compressed
+ *
+ */
+func readFileTable(table []byte, names []byte, contents []byte, packed []byte, packedData []byte) ([]*embeddedFile, error) {
+	files := make([]*embeddedFile, 0)
+	for e := 0; e+32 <= len(table); e += 32 {
+		nameOffset := binary.LittleEndian.Uint32(table[e:])
+		nameLength := binary.LittleEndian.Uint32(table[e+4:])
+		offset := binary.LittleEndian.Uint32(table[e+8:])
+		length := binary.LittleEndian.Uint32(table[e+12:])
+		filetype := binary.LittleEndian.Uint32(table[e+20:])
+		if filetype != filetypeRegularFile {
+			continue
+		}
+		if uint64(nameOffset)+uint64(nameLength) > uint64(len(names)) {
+			return nil, fmt.Errorf("The file table entry %d has an invalid name", e/32)
+		}
+		name := string(names[nameOffset : nameOffset+nameLength])
+
+		var content []byte
+		if len(packed) > 0 {
+			p := (e / 32) * 12
+			if p+12 > len(packed) {
+				return nil, fmt.Errorf("The packed entry for %s is missing", name)
+			}
+			packedOffset := binary.LittleEndian.Uint32(packed[p:])
+			packedLength := binary.LittleEndian.Uint32(packed[p+4:])
+			method := binary.LittleEndian.Uint32(packed[p+8:])
+			if uint64(packedOffset)+uint64(packedLength) > uint64(len(packedData)) {
+				return nil, fmt.Errorf("The packed contents of %s are out of range", name)
+			}
+			data := packedData[packedOffset : packedOffset+packedLength]
+			switch method {
+			case packNone:
+				content = []byte{}
+			case packCopy:
+				content = data
+			case packInflate:
+				r := flate.NewReader(bytes.NewReader(data))
+				var err error
+				content, err = io.ReadAll(r)
+				if err != nil {
+					return nil, fmt.Errorf("Could not inflate %s: %v", name, err)
+				}
+			default:
+				return nil, fmt.Errorf("Unknown packing method %d for %s", method, name)
+			}
+			if len(content) != int(length) {
+				return nil, fmt.Errorf("The unpacked contents of %s are %d bytes, expected %d", name, len(content), length)
+			}
+		} else {
+			if uint64(offset)+uint64(length) > uint64(len(contents)) {
+				return nil, fmt.Errorf("The contents of %s are out of range", name)
+			}
+			content = contents[offset : offset+length]
+		}
+		files = append(files, &embeddedFile{name: name, content: content})
+	}
+	return files, nil
+}
+
+/**
+ * Get the host path to write an embedded file to, keeping it inside the output directory
+ *
+ */
+func extractPath(dir string, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "", fmt.Errorf("The embedded file name \"%s\" is not valid", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean[1:])), nil
+}
+
+func runExtract(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing custom name section...\n")
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	var files []*embeddedFile
+	table := getNamedData(wfile, "$wt_files")
+	if table != nil {
+		files, err = readFileTable(table,
+			getNamedData(wfile, "$wt_file_names"),
+			getNamedData(wfile, "$wt_file_contents"),
+			getNamedData(wfile, "$wt_file_packed"),
+			getNamedData(wfile, "$wt_file_packed_data"))
+		if err != nil {
+			return err
+		}
+	} else {
+		// Modules from older versions of embedfile have a single file
+		name := getNamedData(wfile, "$file_name")
+		content := getNamedData(wfile, "$file_content")
+		if name == nil || content == nil {
+			return errors.New("No embedded files found. The module needs a name section with the data names")
+		}
+		files = []*embeddedFile{{name: string(name), content: content}}
+	}
+
+	for _, f := range files {
+		fmt.Printf(" %s (%d bytes)\n", f.name, len(f.content))
+		if ex_list {
+			continue
+		}
+		target, err := extractPath(ex_dir, f.name)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(target, f.content, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !ex_list {
+		fmt.Printf("Extracted %d files to %s\n", len(files), ex_dir)
+	}
+	return nil
+}
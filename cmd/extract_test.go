@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtract(t *testing.T) {
+	host := hostFiles(t, "a.txt:Hello A", "tree/b.bin:\x00\x01\xff", "tree/sub/c.txt:Hello C Hello C Hello C Hello C")
+
+	for _, compress := range []bool{false, true} {
+		args := []string{"embedfile", "--file", filepath.Join(host, "a.txt") + ":/data/a.txt", "--dir", filepath.Join(host, "tree") + ":/data/tree"}
+		if compress {
+			args = append(args, "--compress")
+		}
+		out := instrument(t, wasiProgram(), args...)
+
+		dir := t.TempDir()
+		in := filepath.Join(dir, "in.wasm")
+		assert.NoError(t, os.WriteFile(in, out, 0666))
+		extracted := filepath.Join(dir, "extracted")
+		assert.NoError(t, toolkit(t, "extract", "-i", in, "--dir", extracted, "--list"))
+		assert.NoDirExists(t, extracted)
+		assert.NoError(t, toolkit(t, "extract", "-i", in, "--dir", extracted))
+
+		for name, from := range map[string]string{
+			"data/a.txt":          "a.txt",
+			"data/tree/b.bin":     "tree/b.bin",
+			"data/tree/sub/c.txt": "tree/sub/c.txt",
+		} {
+			expected, err := os.ReadFile(filepath.Join(host, filepath.FromSlash(from)))
+			assert.NoError(t, err)
+			data, err := os.ReadFile(filepath.Join(extracted, filepath.FromSlash(name)))
+			assert.NoError(t, err)
+			assert.Equal(t, expected, data, name)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/heaptrace"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdHeaptrace = &cobra.Command{
+		Use:   "heaptrace",
+		Short: "Add allocation tracing to a wasm file",
+		Long:  `This counts calls to malloc/free etc, and reports live bytes and the top allocation sites to STDERR on exit`,
+		RunE:  runHeaptrace,
+	}
+)
+
+var heaptrace_log = false
+var heaptrace_top = 10
+var heaptrace_table_size = 16384
+
+func init() {
+	rootCmd.AddCommand(cmdHeaptrace)
+	cmdHeaptrace.Flags().BoolVar(&heaptrace_log, "log", false, "Log every allocation and free")
+	cmdHeaptrace.Flags().IntVar(&heaptrace_top, "top", 10, "Number of allocation sites to report")
+	cmdHeaptrace.Flags().IntVar(&heaptrace_table_size, "tablesize", 16384, "Number of live allocations to keep sizes for, when free doesn't give the size (power of 2)")
+}
+
+func runHeaptrace(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := heaptrace.Heaptrace_config{
+		Log:       heaptrace_log,
+		TopSites:  heaptrace_top,
+		TableSize: heaptrace_table_size,
+	}
+	newdata, err := heaptrace.AddHeaptrace(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
@@ -0,0 +1,66 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/inline"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdInline = &cobra.Command{
+		Use:   "inline",
+		Short: "Inline calls to small functions in a wasm file",
+		Long:  `This inlines functions with no control flow, up to a size, into their callers. Wrappers such as the ones strace --imports adds are the main target.`,
+		RunE:  runInline,
+	}
+)
+
+var inlineMaxSize = inline.DefaultMaxSize
+
+func init() {
+	rootCmd.AddCommand(cmdInline)
+
+	cmdInline.Flags().IntVar(&inlineMaxSize, "max-size", inline.DefaultMaxSize, "Max number of instructions in a function to inline")
+}
+
+func runInline(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	newdata, count, err := inline.Inline(data, inline.Inline_config{
+		MaxSize: inlineMaxSize,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Inlined %d calls\n", count)
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
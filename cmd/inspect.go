@@ -0,0 +1,144 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/inspect"
+	"github.com/loopholelabs/wasm-toolkit/pkg/interp"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdInspect = &cobra.Command{
+		Use:   "inspect",
+		Short: "Show variables in memory using their dwarf types",
+		Long:  `This shows dwarf global variables, or a value of a dwarf type at an address, laid out as structs, arrays, strings and slices. The memory comes from a raw dump, or from running the module in the built-in interpreter.`,
+		RunE:  runInspect,
+	}
+)
+
+var inspect_memory = ""
+var inspect_func = ""
+var inspect_globals = []string{}
+var inspect_type = ""
+var inspect_addr = ""
+var inspect_depth = 4
+var inspect_elements = 32
+var inspect_strsize = 256
+
+func init() {
+	rootCmd.AddCommand(cmdInspect)
+	cmdInspect.Flags().StringVar(&inspect_memory, "memory", "", "Raw dump of linear memory. Otherwise the memory of the module once it's set up")
+	cmdInspect.Flags().StringVar(&inspect_func, "func", "", "Run this export in the interpreter first, eg _start")
+	cmdInspect.Flags().StringArrayVar(&inspect_globals, "global", []string{}, "Dwarf global variable to show (can be repeated)")
+	cmdInspect.Flags().StringVar(&inspect_type, "type", "", "Dwarf type to show the value at --addr as, eg main.point")
+	cmdInspect.Flags().StringVar(&inspect_addr, "addr", "", "Address of the value for --type")
+	cmdInspect.Flags().IntVar(&inspect_depth, "depth", 4, "How far to go into nested structs and arrays (0 for no limit)")
+	cmdInspect.Flags().IntVar(&inspect_elements, "elements", 32, "The most array or slice elements to show (0 for no limit)")
+	cmdInspect.Flags().IntVar(&inspect_strsize, "strsize", 256, "The most bytes of a string to show (0 for no limit)")
+}
+
+func runInspect(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if len(inspect_globals) == 0 && inspect_type == "" {
+		return errors.New("Need --global or --type")
+	}
+	if (inspect_type == "") != (inspect_addr == "") {
+		return errors.New("--type and --addr go together")
+	}
+	if inspect_memory != "" && inspect_func != "" {
+		return errors.New("Only one of --memory and --func can be used")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
+	if err != nil {
+		return err
+	}
+	if debugSections.GetCustomSectionData(".debug_info") == nil {
+		return errors.New("The wasm file has no dwarf debug info")
+	}
+	err = wfile.Debug.ParseDwarf(debugSections)
+	if err != nil {
+		return err
+	}
+	wfile.Debug.ParseDwarfGlobals()
+
+	var mem []byte
+	if inspect_memory != "" {
+		mem, err = os.ReadFile(inspect_memory)
+		if err != nil {
+			return err
+		}
+	} else {
+		m, err := interp.New(wfile, interp.Interp_config{
+			Args:   []string{Input},
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+		})
+		if err != nil {
+			return err
+		}
+		if inspect_func != "" {
+			_, err = m.Call(inspect_func)
+			var exit *interp.ExitError
+			if err != nil && !errors.As(err, &exit) {
+				return err
+			}
+		}
+		mem = m.Memory()
+	}
+
+	config := inspect.Inspect_config{
+		MaxDepth:    inspect_depth,
+		MaxElements: inspect_elements,
+		MaxString:   inspect_strsize,
+	}
+	for _, name := range inspect_globals {
+		v, err := inspect.FormatGlobal(wfile.Debug, mem, name, config)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s = %s\n", name, v)
+	}
+	if inspect_type != "" {
+		addr, err := strconv.ParseUint(inspect_addr, 0, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid --addr %q", inspect_addr)
+		}
+		v, err := inspect.FormatType(wfile.Debug, mem, inspect_type, addr, config)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("(%s)%#x = %s\n", inspect_type, addr, v)
+	}
+	return nil
+}
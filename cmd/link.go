@@ -0,0 +1,101 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdLink = &cobra.Command{
+		Use:   "link",
+		Short: "Link another module into a wasm file",
+		Long:  `This merges a second module (wasm or wat) into the input, resolving imports which the other module exports.`,
+		RunE:  runLink,
+	}
+)
+
+var linkWith = ""
+var linkModule = "env"
+var linkKeepAddresses = false
+
+func init() {
+	rootCmd.AddCommand(cmdLink)
+
+	cmdLink.Flags().StringVar(&linkWith, "with", "", "Module to link in (.wasm or .wat)")
+	cmdLink.Flags().StringVar(&linkModule, "module", "env", "Imports from this module are resolved against the other module's exports")
+	cmdLink.Flags().BoolVar(&linkKeepAddresses, "keep-addresses", false, "Keep the data and elem segments of the linked module where they are")
+}
+
+func runLink(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if linkWith == "" {
+		return errors.New("No module to link with")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Loading module \"%s\"...\n", linkWith)
+	var wfWith *wasmfile.WasmFile
+	if strings.HasSuffix(linkWith, ".wat") {
+		wfWith, err = wasmfile.NewFromWat(linkWith)
+	} else {
+		wfWith, err = wasmfile.New(linkWith)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Linking...\n")
+	err = wfile.Link(wfWith, wasmfile.LinkOptions{
+		Module:        linkModule,
+		KeepAddresses: linkKeepAddresses,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = wfile.Validate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -16,11 +16,17 @@
 
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+)
 
 func main() {
 	err := Execute()
 	if err != nil && err.Error() != "" {
 		fmt.Println(err)
 	}
+	if err != nil {
+		os.Exit(1)
+	}
 }
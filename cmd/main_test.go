@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+/**
+ * Put every flag back to its default, since cobra keeps them from one run to the next.
+ *
+ */
+/**
+ * pflag's slice values only replace their default on the first Set they ever see, after that they
+ * append. This starts them again from empty on the first Set after a reset.
+ */
+type sliceFlag struct {
+	pflag.Value
+	fresh bool
+}
+
+func (s *sliceFlag) Set(v string) error {
+	if s.fresh {
+		s.fresh = false
+		if err := s.Value.(pflag.SliceValue).Replace(nil); err != nil {
+			return err
+		}
+	}
+	return s.Value.Set(v)
+}
+
+func resetFlags(c *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if sf, ok := f.Value.(*sliceFlag); ok {
+			f.Value = sf.Value
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			def := strings.Trim(f.DefValue, "[]")
+			if def == "" {
+				sv.Replace(nil)
+			} else {
+				sv.Replace(strings.Split(def, ","))
+			}
+			f.Value = &sliceFlag{Value: f.Value, fresh: true}
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	c.Flags().VisitAll(reset)
+	c.PersistentFlags().VisitAll(reset)
+	for _, sub := range c.Commands() {
+		resetFlags(sub)
+	}
+}
+
+// Run the toolkit with these arguments, as if from the command line
+func toolkit(t *testing.T, args ...string) error {
+	resetFlags(rootCmd)
+	rootCmd.SetArgs(args)
+	return rootCmd.Execute()
+}
+
+// Write the wat as a wasm file, and run a command on it. The output wasm is returned.
+func instrument(t *testing.T, wat string, args ...string) []byte {
+	return instrumentWasm(t, testutil.Encode(t, testutil.ModuleWithDebug(t, wat)), args...)
+}
+
+// Run a toolkit command on a wasm binary, and get the output binary
+func instrumentWasm(t *testing.T, wasm []byte, args ...string) []byte {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.wasm")
+	out := filepath.Join(dir, "out.wasm")
+	assert.NoError(t, os.WriteFile(in, wasm, 0666))
+	assert.NoError(t, toolkit(t, append(args, "-i", in, "-o", out)...))
+	data, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	return data
+}
+
+// Add dwarf data with one int variable, at an address in memory
+func addDwarfVar(wf *wasmfile.WasmFile, name string, addr uint32) {
+	wf.SetCustomSection(".debug_abbrev", []byte{
+		1, 0x11, 1, 0, 0, // compile_unit, with children
+		2, 0x24, 0, 0x03, 0x08, 0x3e, 0x0b, 0x0b, 0x0b, 0, 0, // base_type: name, encoding, byte_size
+		3, 0x34, 0, 0x03, 0x08, 0x49, 0x13, 0x02, 0x18, 0, 0, // variable: name, type, location
+		0,
+	})
+	info := []byte{0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 4} // unit header, with 4 byte addresses
+	info = append(info, 1)
+	info = append(info, 2, 'i', 'n', 't', 0, 0x05, 4)
+	info = append(info, 3)
+	info = append(info, []byte(name)...)
+	info = append(info, 0, 12, 0, 0, 0, 5, 0x03) // the type is at 12, and the location is DW_OP_addr
+	info = binary.LittleEndian.AppendUint32(info, addr)
+	info = append(info, 0)
+	binary.LittleEndian.PutUint32(info, uint32(len(info)-4))
+	wf.SetCustomSection(".debug_info", info)
+}
+
+/**
+ * Run a wasi module in wazero, and get what it wrote to stdout and stderr.
+ *
+ */
+func runWasi(t *testing.T, wasm []byte, config wazero.ModuleConfig) (string, string) {
+	ctx, r := testutil.Runtime(t)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	compiled, err := r.CompileModule(ctx, wasm)
+	if !assert.NoError(t, err) {
+		return "", ""
+	}
+	var stdout, stderr bytes.Buffer
+	_, err = r.InstantiateModule(ctx, compiled, config.WithStdout(&stdout).WithStderr(&stderr))
+	var exit *sys.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 0 {
+		assert.NoError(t, err)
+	}
+	return stdout.String(), stderr.String()
+}
+
+/**
+ * A wasi module which runs some steps in order, and prints what they find. The steps are
+ *   cat fd path         - Print the contents of a file, opened relative to a preopen
+ *   tail fd path n      - Print the last n bytes of a file, using fd_seek
+ *   write fd path text  - Write a file, creating it if it isn't there
+ *   ls fd path          - Print the names in a directory, one to a line
+ *   stat fd path        - Print the filetype and size of a file
+ *   prestat fd          - Print the name of a preopen
+ *   env                 - Print the environment, one variable to a line
+ *   clock               - Print the realtime clock
+ *   random              - Print 8 random bytes, as a number
+ *   send fd             - Send some bytes to a socket with sock_send
+ *   print text          - Print some text
+ *   exit code           - Exit with proc_exit
+ * Any error is printed as "error N" with the wasi errno.
+ *
+ */
+func wasiProgram(steps ...string) string {
+	var data, body strings.Builder
+	ptr := 1024
+	str := func(s string) string {
+		fmt.Fprintf(&data, "  (data (i32.const %d) \"", ptr)
+		for _, b := range []byte(s) {
+			fmt.Fprintf(&data, "\\%02x", b)
+		}
+		data.WriteString("\")\n")
+		ret := fmt.Sprintf("    i32.const %d\n    i32.const %d\n", ptr, len(s))
+		ptr += len(s)
+		return ret
+	}
+	for _, s := range steps {
+		op, arg, _ := strings.Cut(s, " ")
+		switch op {
+		case "cat", "ls", "stat":
+			fd, path, _ := strings.Cut(arg, " ")
+			fmt.Fprintf(&body, "    i32.const %s\n%s    call $%s\n", fd, str(path), op)
+		case "tail", "write":
+			fd, rest, _ := strings.Cut(arg, " ")
+			path, last, _ := strings.Cut(rest, " ")
+			if op == "tail" {
+				last = "    i32.const " + last + "\n"
+			} else {
+				last = str(last)
+			}
+			fmt.Fprintf(&body, "    i32.const %s\n%s%s    call $%s\n", fd, str(path), last, op)
+		case "prestat", "send", "exit":
+			fmt.Fprintf(&body, "    i32.const %s\n    call $%s\n", arg, op)
+		case "env", "clock", "random":
+			fmt.Fprintf(&body, "    call $%s\n", op)
+		case "print":
+			fmt.Fprintf(&body, "%s    call $print\n", str(arg))
+		}
+	}
+	return fmt.Sprintf(wasiProgramWat, body.String(), data.String())
+}
+
+// Memory use is 0-1023 for scratch, 1024-4095 for strings, and 4096 up for buffers
+const wasiProgramWat = `(module
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (type (func (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (type (func (param i32) (result i32)))
+  (type (func (param i32 i32 i32 i64 i32) (result i32)))
+  (type (func (param i32 i32 i32 i32 i32) (result i32)))
+  (type (func (param i32 i32) (result i32)))
+  (type (func))
+  (type (func (param i32 i32)))
+  (type (func (param i32)))
+  (type (func (param i32 i32 i32)))
+  (type (func (param i64)))
+  (type (func (param i32 i64 i32 i32) (result i32)))
+  (type (func (param i32 i64 i32) (result i32)))
+  (type (func (param i32 i32 i32 i32)))
+  (type (func (param i32 i32 i32 i32 i32)))
+  (type (func (param i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (type 0)))
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (type 0)))
+  (import "wasi_snapshot_preview1" "path_open" (func $path_open (type 1)))
+  (import "wasi_snapshot_preview1" "fd_close" (func $fd_close (type 2)))
+  (import "wasi_snapshot_preview1" "fd_readdir" (func $fd_readdir (type 3)))
+  (import "wasi_snapshot_preview1" "path_filestat_get" (func $path_filestat_get (type 4)))
+  (import "wasi_snapshot_preview1" "environ_sizes_get" (func $environ_sizes_get (type 5)))
+  (import "wasi_snapshot_preview1" "environ_get" (func $environ_get (type 5)))
+  (import "wasi_snapshot_preview1" "fd_seek" (func $fd_seek (type 11)))
+  (import "wasi_snapshot_preview1" "fd_prestat_get" (func $fd_prestat_get (type 5)))
+  (import "wasi_snapshot_preview1" "fd_prestat_dir_name" (func $fd_prestat_dir_name (type 15)))
+  (import "wasi_snapshot_preview1" "clock_time_get" (func $clock_time_get (type 12)))
+  (import "wasi_snapshot_preview1" "random_get" (func $random_get (type 5)))
+  (import "wasi_snapshot_preview1" "sock_send" (func $sock_send (type 4)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (type 8)))
+  (memory 1)
+  (export "memory" (memory 0))
+  (export "_start" (func $_start))
+
+  (func $print (type 7) (param $ptr i32) (param $len i32)
+    i32.const 16
+    local.get $ptr
+    i32.store
+    i32.const 20
+    local.get $len
+    i32.store
+    i32.const 1
+    i32.const 16
+    i32.const 1
+    i32.const 24
+    call $fd_write
+    drop
+  )
+
+  (func $print_num (type 10) (param $num i64)
+    (local $ptr i32)
+    i32.const 64
+    local.set $ptr
+    loop
+      local.get $ptr
+      i32.const 1
+      i32.sub
+      local.tee $ptr
+      local.get $num
+      i64.const 10
+      i64.rem_u
+      i32.wrap_i64
+      i32.const 48
+      i32.add
+      i32.store8
+      local.get $num
+      i64.const 10
+      i64.div_u
+      local.tee $num
+      i64.const 0
+      i64.ne
+      br_if 0
+    end
+    local.get $ptr
+    i32.const 64
+    local.get $ptr
+    i32.sub
+    call $print
+  )
+
+  (func $newline (type 6)
+    i32.const 106
+    i32.const 1
+    call $print
+  )
+
+  ;; Print "error N", and return true if there was an error
+  (func $check (type 2) (param $err i32) (result i32)
+    local.get $err
+    if
+      i32.const 100
+      i32.const 6
+      call $print
+      local.get $err
+      i64.extend_i32_u
+      call $print_num
+      call $newline
+    end
+    local.get $err
+  )
+
+  ;; Open a path into the fd at 12. Directories can't be opened with fd_write rights.
+  (func $open (type 0) (param $dirfd i32) (param $ptr i32) (param $len i32) (param $oflags i32) (result i32)
+    local.get $dirfd
+    i32.const 0
+    local.get $ptr
+    local.get $len
+    local.get $oflags
+    i64.const -65
+    i64.const -1
+    local.get $oflags
+    i32.const 2
+    i32.and
+    select
+    i64.const -1
+    i32.const 0
+    i32.const 12
+    call $path_open
+    call $check
+  )
+
+  ;; Print the rest of the file at 12, and close it
+  (func $dump (type 6)
+    block
+      loop
+        i32.const 0
+        i32.const 4096
+        i32.store
+        i32.const 4
+        i32.const 4096
+        i32.store
+        i32.const 12
+        i32.load
+        i32.const 0
+        i32.const 1
+        i32.const 8
+        call $fd_read
+        call $check
+        br_if 1
+        i32.const 8
+        i32.load
+        i32.eqz
+        br_if 1
+        i32.const 4096
+        i32.const 8
+        i32.load
+        call $print
+        br 0
+      end
+    end
+    i32.const 12
+    i32.load
+    call $fd_close
+    drop
+  )
+
+  (func $cat (type 9) (param $dirfd i32) (param $ptr i32) (param $len i32)
+    local.get $dirfd
+    local.get $ptr
+    local.get $len
+    i32.const 0
+    call $open
+    if
+      return
+    end
+    call $dump
+  )
+
+  (func $tail (type 13) (param $dirfd i32) (param $ptr i32) (param $len i32) (param $n i32)
+    local.get $dirfd
+    local.get $ptr
+    local.get $len
+    i32.const 0
+    call $open
+    if
+      return
+    end
+    i32.const 12
+    i32.load
+    i64.const 0
+    local.get $n
+    i64.extend_i32_u
+    i64.sub
+    i32.const 2
+    i32.const 64
+    call $fd_seek
+    call $check
+    if
+      return
+    end
+    call $dump
+  )
+
+  (func $write (type 14) (param $dirfd i32) (param $ptr i32) (param $len i32) (param $text i32) (param $textLen i32)
+    local.get $dirfd
+    local.get $ptr
+    local.get $len
+    i32.const 9
+    call $open
+    if
+      return
+    end
+    i32.const 0
+    local.get $text
+    i32.store
+    i32.const 4
+    local.get $textLen
+    i32.store
+    i32.const 12
+    i32.load
+    i32.const 0
+    i32.const 1
+    i32.const 8
+    call $fd_write
+    call $check
+    drop
+    i32.const 12
+    i32.load
+    call $fd_close
+    drop
+  )
+
+  (func $ls (type 9) (param $dirfd i32) (param $ptr i32) (param $len i32)
+    (local $p i32)
+    (local $end i32)
+    local.get $dirfd
+    local.get $ptr
+    local.get $len
+    i32.const 2
+    call $open
+    if
+      return
+    end
+    i32.const 12
+    i32.load
+    i32.const 4096
+    i32.const 4096
+    i64.const 0
+    i32.const 8
+    call $fd_readdir
+    call $check
+    if
+      return
+    end
+    i32.const 4096
+    local.tee $p
+    i32.const 8
+    i32.load
+    i32.add
+    local.set $end
+    block
+      loop
+        local.get $p
+        i32.const 24
+        i32.add
+        local.get $end
+        i32.gt_u
+        br_if 1
+        local.get $p
+        i32.const 24
+        i32.add
+        local.get $p
+        i32.load offset=16
+        call $print
+        call $newline
+        local.get $p
+        i32.const 24
+        i32.add
+        local.get $p
+        i32.load offset=16
+        i32.add
+        local.set $p
+        br 0
+      end
+    end
+    i32.const 12
+    i32.load
+    call $fd_close
+    drop
+  )
+
+  (func $stat (type 9) (param $dirfd i32) (param $ptr i32) (param $len i32)
+    local.get $dirfd
+    i32.const 0
+    local.get $ptr
+    local.get $len
+    i32.const 4096
+    call $path_filestat_get
+    call $check
+    if
+      return
+    end
+    i32.const 107
+    i32.const 5
+    call $print
+    i32.const 4096
+    i64.load8_u offset=16
+    call $print_num
+    i32.const 112
+    i32.const 6
+    call $print
+    i32.const 4096
+    i64.load offset=32
+    call $print_num
+    call $newline
+  )
+
+  (func $prestat (type 8) (param $fd i32)
+    local.get $fd
+    i32.const 200
+    call $fd_prestat_get
+    call $check
+    if
+      return
+    end
+    local.get $fd
+    i32.const 4096
+    i32.const 204
+    i32.load
+    call $fd_prestat_dir_name
+    call $check
+    if
+      return
+    end
+    i32.const 4096
+    i32.const 204
+    i32.load
+    call $print
+    call $newline
+  )
+
+  (func $env (type 6)
+    (local $i i32)
+    (local $p i32)
+    (local $end i32)
+    i32.const 0
+    i32.const 4
+    call $environ_sizes_get
+    call $check
+    if
+      return
+    end
+    i32.const 4096
+    i32.const 8192
+    call $environ_get
+    call $check
+    if
+      return
+    end
+    block
+      loop
+        local.get $i
+        i32.const 0
+        i32.load
+        i32.ge_u
+        br_if 1
+        local.get $i
+        i32.const 2
+        i32.shl
+        i32.const 4096
+        i32.add
+        i32.load
+        local.tee $p
+        local.set $end
+        block
+          loop
+            local.get $end
+            i32.load8_u
+            i32.eqz
+            br_if 1
+            local.get $end
+            i32.const 1
+            i32.add
+            local.set $end
+            br 0
+          end
+        end
+        local.get $p
+        local.get $end
+        local.get $p
+        i32.sub
+        call $print
+        call $newline
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+  )
+
+  (func $clock (type 6)
+    i32.const 0
+    i64.const 1
+    i32.const 72
+    call $clock_time_get
+    call $check
+    if
+      return
+    end
+    i32.const 72
+    i64.load
+    call $print_num
+    call $newline
+  )
+
+  (func $random (type 6)
+    i32.const 80
+    i32.const 8
+    call $random_get
+    call $check
+    if
+      return
+    end
+    i32.const 80
+    i64.load
+    call $print_num
+    call $newline
+  )
+
+  (func $send (type 8) (param $fd i32)
+    i32.const 0
+    i32.const 100
+    i32.store
+    i32.const 4
+    i32.const 5
+    i32.store
+    local.get $fd
+    i32.const 0
+    i32.const 1
+    i32.const 0
+    i32.const 8
+    call $sock_send
+    call $check
+    drop
+  )
+
+  (func $exit (type 8) (param $code i32)
+    local.get $code
+    call $proc_exit
+  )
+
+  (func $_start (type 6)
+%s  )
+
+  (data (i32.const 100) "error \0atype  size ")
+%s)
+`
@@ -0,0 +1,95 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/meter"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdMeter = &cobra.Command{
+		Use:   "meter",
+		Short: "Add fuel metering to a wasm file",
+		Long:  `Each block of code uses up fuel as it runs, and the module traps (or calls the host) when it runs out. The fuel left is exported as the global __wasm_toolkit_fuel.`,
+		RunE:  runMeter,
+	}
+)
+
+var meter_fuel int64 = 1000000000
+var meter_host = false
+var meter_costs = []string{}
+
+func init() {
+	rootCmd.AddCommand(cmdMeter)
+	cmdMeter.Flags().Int64Var(&meter_fuel, "fuel", 1000000000, "Fuel to start with")
+	cmdMeter.Flags().BoolVar(&meter_host, "host", false, "Call the import wasm_toolkit.out_of_fuel when the fuel runs out, instead of trapping")
+	cmdMeter.Flags().StringArrayVar(&meter_costs, "cost", []string{}, "Cost of an instruction 'name=cost' eg 'call=10' (can be repeated)")
+}
+
+func runMeter(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	costs, err := meterCosts()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := meter.Meter_config{
+		Fuel:        meter_fuel,
+		HostHandler: meter_host,
+		Costs:       costs,
+	}
+	newdata, err := meter.AddMeter(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
+
+// Parse the --cost flags
+func meterCosts() (map[string]int64, error) {
+	costs := make(map[string]int64)
+	for _, c := range meter_costs {
+		name, value, ok := strings.Cut(c, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid --cost %q, expected name=cost", c)
+		}
+		cost, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --cost %q, expected name=cost", c)
+		}
+		costs[name] = cost
+	}
+	return costs, nil
+}
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -29,7 +30,7 @@ var (
 		Use:   "otel",
 		Short: "Add tracing output to as wasm file, output as otel json",
 		Long:  `This will output to STDERR`,
-		Run:   runOtel,
+		RunE:  runOtel,
 	}
 )
 
@@ -44,15 +45,15 @@ func init() {
 	cmdOtel.Flags().BoolVarP(&is_scale_host, "scale", "s", false, "Is scale host")
 }
 
-func runOtel(ccmd *cobra.Command, args []string) {
+func runOtel(ccmd *cobra.Command, args []string) error {
 	if Input == "" {
-		panic("No input file")
+		return errors.New("No input file")
 	}
 
 	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
 	data, err := os.ReadFile(Input)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	config := otel.Otel_config{
@@ -61,7 +62,10 @@ func runOtel(ccmd *cobra.Command, args []string) {
 		Scale_api:   is_scale_host,
 	}
 	newdata, err := otel.AddOtel(data, config)
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Writing wasm out to %s...\n", Output)
-	os.WriteFile(Output, newdata, 0660)
+	return os.WriteFile(Output, newdata, 0660)
 }
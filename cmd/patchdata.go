@@ -0,0 +1,147 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdPatchData = &cobra.Command{
+		Use:   "patch-data",
+		Short: "Replace bytes in the data of a wasm file",
+		Long:  `This replaces the initial bytes of memory at a dwarf global variable or an address, eg to swap an embedded config blob or version string.`,
+		RunE:  runPatchData,
+	}
+)
+
+var patchdataSymbol = ""
+var patchdataAddr = ""
+var patchdataFile = ""
+var patchdataHex = ""
+var patchdataPad = false
+
+func init() {
+	rootCmd.AddCommand(cmdPatchData)
+
+	cmdPatchData.Flags().StringVar(&patchdataSymbol, "symbol", "", "Dwarf global variable to patch")
+	cmdPatchData.Flags().StringVar(&patchdataAddr, "addr", "", "Address to patch (eg 0x1100)")
+	cmdPatchData.Flags().StringVar(&patchdataFile, "file", "", "File with the new bytes")
+	cmdPatchData.Flags().StringVar(&patchdataHex, "hex", "", "New bytes as hex")
+	cmdPatchData.Flags().BoolVar(&patchdataPad, "pad", false, "Pad the new bytes with zeros to the size of the symbol")
+}
+
+/**
+ * Get the bytes to patch in, from --file or --hex.
+ *
+ */
+func patchBytes() ([]byte, error) {
+	if patchdataFile != "" {
+		return os.ReadFile(patchdataFile)
+	}
+	h := strings.Join(strings.Fields(patchdataHex), "")
+	h = strings.TrimPrefix(h, "0x")
+	return hex.DecodeString(h)
+}
+
+func runPatchData(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if (patchdataSymbol == "") == (patchdataAddr == "") {
+		return errors.New("Need one of --symbol or --addr")
+	}
+	if (patchdataFile == "") == (patchdataHex == "") {
+		return errors.New("Need one of --file or --hex")
+	}
+	if patchdataPad && patchdataSymbol == "" {
+		return errors.New("--pad needs --symbol")
+	}
+
+	data, err := patchBytes()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("No data to patch in")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.NewIncremental(Input)
+	if err != nil {
+		return err
+	}
+
+	var addr uint64
+	if patchdataSymbol != "" {
+		ginfo, err := dwarfGlobal(wfile, patchdataSymbol)
+		if err != nil {
+			return err
+		}
+		addr = ginfo.Address
+
+		// The size is only known if dwarf has the type
+		if ginfo.Size != 0 {
+			if uint64(len(data)) > ginfo.Size {
+				return fmt.Errorf("Symbol %s (%s) is %d bytes, but the data is %d bytes", ginfo.Name, ginfo.Type, ginfo.Size, len(data))
+			}
+			if uint64(len(data)) < ginfo.Size {
+				if !patchdataPad {
+					return fmt.Errorf("Symbol %s (%s) is %d bytes, but the data is %d bytes. Use --pad to fill the rest with zeros", ginfo.Name, ginfo.Type, ginfo.Size, len(data))
+				}
+				data = append(data, make([]byte, ginfo.Size-uint64(len(data)))...)
+			}
+		}
+		fmt.Printf("Symbol %s (%s) is at %d\n", ginfo.Name, ginfo.Type, addr)
+	} else {
+		addr, err = strconv.ParseUint(patchdataAddr, 0, 32)
+		if err != nil {
+			return err
+		}
+	}
+
+	dataCount := len(wfile.Data)
+	err = wfile.PatchData(addr, data)
+	if err != nil {
+		return err
+	}
+	if len(wfile.Data) > dataCount {
+		fmt.Printf("Some bytes weren't in a data segment, so a new segment was added\n")
+	}
+	fmt.Printf("Patched %d bytes at %d\n", len(data), addr)
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+)
+
+func TestPatchData(t *testing.T) {
+	// The text to print is at 0x400
+	program := wasiProgram("print hello\n")
+
+	out := instrument(t, program, "patch-data", "--addr", "0x401", "--hex", "6f 6c")
+	stdout, _ := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "hollo\n", stdout)
+
+	file := filepath.Join(t.TempDir(), "new.bin")
+	assert.NoError(t, os.WriteFile(file, []byte("HELLO"), 0666))
+	out = instrument(t, program, "patch-data", "--addr", "1024", "--file", file)
+	stdout, _ = runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "HELLO\n", stdout)
+
+	// A 4 byte int over "hell"
+	wf := testutil.ModuleWithDebug(t, program)
+	addDwarfVar(wf, "greeting", 0x400)
+	out = instrumentWasm(t, testutil.Encode(t, wf), "patch-data", "--symbol", "greeting", "--hex", "4a 65", "--pad")
+	stdout, _ = runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "Je\x00\x00o\n", stdout)
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.wasm")
+	assert.NoError(t, os.WriteFile(in, testutil.Encode(t, wf), 0666))
+	err := toolkit(t, "patch-data", "--symbol", "greeting", "--hex", "0102030405", "-i", in, "-o", filepath.Join(dir, "out.wasm"))
+	assert.EqualError(t, err, "Symbol greeting (int) is 4 bytes, but the data is 5 bytes")
+
+	// Bytes outside the data segments get a segment of their own
+	out = instrument(t, program, "patch-data", "--addr", "0x2000", "--hex", "01")
+	wf, err = wasmfile.NewFromReader(bytes.NewReader(out))
+	assert.NoError(t, err)
+	last := wf.Data[len(wf.Data)-1]
+	assert.Equal(t, int32(0x2000), last.Offset[0].I32Value)
+	assert.Equal(t, []byte{1}, last.Data)
+}
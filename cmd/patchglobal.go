@@ -0,0 +1,162 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdPatchGlobal = &cobra.Command{
+		Use:   "patch-global",
+		Short: "Change the initial value of a global",
+		Long:  `This changes the initial value of a wasm global, found in the name section, or of a language global variable found in the dwarf debug info.`,
+		RunE:  runPatchGlobal,
+	}
+)
+
+var patchglobalName = ""
+var patchglobalValue = ""
+
+func init() {
+	rootCmd.AddCommand(cmdPatchGlobal)
+
+	cmdPatchGlobal.Flags().StringVar(&patchglobalName, "name", "", "Name of the global")
+	cmdPatchGlobal.Flags().StringVar(&patchglobalValue, "value", "", "New value as wat (eg 'i32.const 42')")
+}
+
+/**
+ * Get the little endian bytes of a const expression, as it would be stored in memory.
+ *
+ */
+func constBytes(value string) ([]byte, error) {
+	ex, err := expression.ExpressionFromWat(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(ex) != 1 {
+		return nil, errors.New("The value must be a single const instruction")
+	}
+
+	e := ex[0]
+	switch e.Opcode {
+	case expression.InstrToOpcode["i32.const"]:
+		return binary.LittleEndian.AppendUint32(nil, uint32(e.I32Value)), nil
+	case expression.InstrToOpcode["i64.const"]:
+		return binary.LittleEndian.AppendUint64(nil, uint64(e.I64Value)), nil
+	case expression.InstrToOpcode["f32.const"]:
+		return binary.LittleEndian.AppendUint32(nil, math.Float32bits(e.F32Value)), nil
+	case expression.InstrToOpcode["f64.const"]:
+		return binary.LittleEndian.AppendUint64(nil, math.Float64bits(e.F64Value)), nil
+	}
+	return nil, errors.New("The value must be an i32, i64, f32 or f64 const")
+}
+
+/**
+ * Find a global variable in the dwarf debug info.
+ *
+ */
+func dwarfGlobal(wfile *wasmfile.WasmFile, name string) (*debug.GlobalNameData, error) {
+	fmt.Printf("Parsing custom dwarf debug sections...\n")
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.Debug.ParseDwarf(debugSections)
+	if err != nil {
+		return nil, err
+	}
+	wfile.Debug.ParseDwarfGlobals()
+
+	ginfo, ok := wfile.Debug.GlobalAddresses[name]
+	if !ok {
+		return nil, fmt.Errorf("Global %s not found", name)
+	}
+	return ginfo, nil
+}
+
+func runPatchGlobal(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if patchglobalName == "" || patchglobalValue == "" {
+		return errors.New("Need --name and --value")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.NewIncremental(Input)
+	if err != nil {
+		return err
+	}
+
+	// Wasm globals come first, from the name section
+	name := patchglobalName
+	if !strings.HasPrefix(name, "$") {
+		name = "$" + name
+	}
+	gidx := wfile.Debug.LookupGlobalID(name)
+	if gidx != -1 {
+		err = wfile.SetGlobalInit(gidx, patchglobalValue)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Global %d %s set to %s\n", gidx, name, patchglobalValue)
+	} else {
+		ginfo, err := dwarfGlobal(wfile, patchglobalName)
+		if err != nil {
+			return err
+		}
+
+		data, err := constBytes(patchglobalValue)
+		if err != nil {
+			return err
+		}
+		if ginfo.Size != 0 && ginfo.Size != uint64(len(data)) {
+			return fmt.Errorf("Global %s (%s) is %d bytes, but the value is %d bytes", ginfo.Name, ginfo.Type, ginfo.Size, len(data))
+		}
+
+		err = wfile.PatchData(ginfo.Address, data)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Variable %s (%s) at %d set to %s\n", ginfo.Name, ginfo.Type, ginfo.Address, patchglobalValue)
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
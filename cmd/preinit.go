@@ -0,0 +1,73 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/preinit"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdPreinit = &cobra.Command{
+		Use:   "preinit",
+		Short: "Run a wasm file's initialization, and snapshot the result into it",
+		Long:  `This runs the init function, then writes the memory and mutable globals back into the module as data and global initializers, so it starts up already initialized.`,
+		RunE:  runPreinit,
+	}
+)
+
+var preinit_func = ""
+var preinit_marker = ""
+var preinit_args []string
+
+func init() {
+	rootCmd.AddCommand(cmdPreinit)
+	cmdPreinit.Flags().StringVar(&preinit_func, "func", "", "Export to run (default wizer.initialize, _initialize or _start)")
+	cmdPreinit.Flags().StringVar(&preinit_marker, "marker", "", "Import (module:name) the module calls once it's initialized")
+	cmdPreinit.Flags().StringArrayVar(&preinit_args, "arg", []string{}, "Argument for the module")
+}
+
+func runPreinit(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := preinit.Preinit_config{
+		Func:   preinit_func,
+		Marker: preinit_marker,
+		Args:   preinit_args,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	newdata, err := preinit.Preinit(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
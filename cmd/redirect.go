@@ -0,0 +1,105 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdRedirect = &cobra.Command{
+		Use:   "redirect",
+		Short: "Redirect imports to functions in the module, or to other imports",
+		Long:  `This points every call to an import at a function in the module, or at another import, and removes the import.`,
+		RunE:  runRedirect,
+	}
+)
+
+var redirectMaps []string
+var redirectRemoveUnused = false
+
+func init() {
+	rootCmd.AddCommand(cmdRedirect)
+
+	cmdRedirect.Flags().StringArrayVar(&redirectMaps, "map", []string{}, "Redirect an import (module:name=$function or module:name=newmodule:newname)")
+	cmdRedirect.Flags().BoolVar(&redirectRemoveUnused, "remove-unused", false, "Remove any imports nothing uses any more")
+}
+
+// Example:
+//	--map 'wasi_snapshot_preview1:fd_read=$my_fd_read'
+//	--map "env:log=host:log"
+
+func runRedirect(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if len(redirectMaps) == 0 && !redirectRemoveUnused {
+		return errors.New("Nothing to do. Use --map or --remove-unused")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing custom name section...\n")
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	for _, r := range redirectMaps {
+		from, to, err := splitRename(r)
+		if err != nil {
+			return err
+		}
+		fromModule, fromName, err := splitImport(from)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Redirecting import %s to %s\n", from, to)
+		err = wfile.RedirectImportTo(fromModule, fromName, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	if redirectRemoveUnused {
+		removed := wfile.RemoveUnusedImports()
+		fmt.Printf("Removed %d unused imports\n", removed)
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,171 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdRemap = &cobra.Command{
+		Use:   "remap",
+		Short: "Remap guest paths to other preopened directories",
+		Long:  `This rewrites preopen names and paths, so paths hardcoded in the module can point somewhere else`,
+		RunE:  runRemap,
+	}
+)
+
+var rm_maps []string
+
+func init() {
+	rootCmd.AddCommand(cmdRemap)
+	cmdRemap.Flags().StringArrayVar(&rm_maps, "map", []string{}, "Remap a guest path as guest_path:target_path (can be given more than once)")
+}
+
+// The wasi calls wrapped by remap.wat
+var remapRedirects = map[string]string{
+	"wasi_snapshot_preview1:fd_prestat_get":      "$remap_fd_prestat_get",
+	"wasi_snapshot_preview1:fd_prestat_dir_name": "$remap_fd_prestat_dir_name",
+	"wasi_snapshot_preview1:path_open":           "$remap_path_open",
+	"wasi_snapshot_preview1:path_filestat_get":   "$remap_path_filestat_get",
+}
+
+/**
+ * Build the mapping table used by remap.wat, from guest:target pairs
+ *
+ */
+func buildRemapTable(maps []string) ([]byte, []byte, error) {
+	table := make([]byte, 0)
+	names := make([]byte, 0)
+	seen := make(map[string]bool)
+	for _, m := range maps {
+		guest, target, ok := strings.Cut(m, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("The mapping \"%s\" should be guest_path:target_path", m)
+		}
+		guest = strings.Trim(path.Clean("/"+guest), "/")
+		target = strings.Trim(path.Clean("/"+target), "/")
+		if guest == "" {
+			return nil, nil, fmt.Errorf("The mapping \"%s\" can't remap the root directory", m)
+		}
+		if seen[guest] {
+			return nil, nil, fmt.Errorf("The guest path /%s is remapped more than once", guest)
+		}
+		seen[guest] = true
+
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(names)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(guest)))
+		names = append(names, []byte(guest)...)
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(names)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(target)))
+		names = append(names, []byte(target)...)
+	}
+	return table, names, nil
+}
+
+func runRemap(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	if len(rm_maps) == 0 {
+		return errors.New("No mappings given")
+	}
+
+	data_remaps, data_remap_names, err := buildRemapTable(rm_maps)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing custom name section...\n")
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	originalFunctionLength := len(wfile.Code)
+
+	// Load up the individual wat files, and add them in
+	files := []string{
+		"memory.wat",
+		"remap.wat"}
+
+	payload, err := wfile.AddPayload(files)
+	if err != nil {
+		return err
+	}
+
+	payload.AddData("$wt_remaps", data_remaps)
+	payload.AddData("$wt_remap_names", data_remap_names)
+
+	redirected, err := wfile.RedirectImportCalls(remapRedirects, wfile.Code[:originalFunctionLength])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Redirected %d imports\n", len(redirected))
+
+	for _, c := range wfile.Code[:originalFunctionLength] {
+		err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
+		if err != nil {
+			return err
+		}
+		err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range wfile.Code {
+		err = payload.Resolve(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = payload.Finish()
+	if err != nil {
+		return err
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
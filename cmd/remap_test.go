@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+)
+
+func TestRemap(t *testing.T) {
+	host := hostFiles(t, "a.txt:Hello A", "sub/b.txt:Hello B")
+	out := instrument(t, wasiProgram(
+		"prestat 3",
+		"cat 3 a.txt", "print \n",
+		"cat 3 sub/b.txt", "print \n",
+		"ls 3 sub",
+		"write 3 c.txt Written",
+		"prestat 4",
+		"cat 4 o.txt", "print \n",
+	), "remap", "--map", "/data:/mnt/host")
+
+	other := hostFiles(t, "o.txt:Hello O")
+	config := wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(host, "/mnt/host").WithDirMount(other, "/other"))
+	stdout, _ := runWasi(t, out, config)
+	// The guest sees /data instead of /mnt/host, and /other is left alone
+	assert.Equal(t, "/data\nHello A\nHello B\n.\n..\nb.txt\n/other\nHello O\n", stdout)
+	data, err := os.ReadFile(filepath.Join(host, "c.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Written", string(data))
+}
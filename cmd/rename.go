@@ -0,0 +1,168 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdRename = &cobra.Command{
+		Use:   "rename",
+		Short: "Rename imports and exports",
+		Long:  `This renames exports, retargets imports to a different module and/or name, and changes the signature of imports.`,
+		RunE:  runRename,
+	}
+)
+
+var renameExports []string
+var renameImports []string
+var renameImportModules []string
+var renameImportTypes []string
+
+func init() {
+	rootCmd.AddCommand(cmdRename)
+
+	cmdRename.Flags().StringArrayVar(&renameExports, "export", []string{}, "Rename an export (old=new)")
+	cmdRename.Flags().StringArrayVar(&renameImports, "import", []string{}, "Retarget an import (module:name=newmodule:newname)")
+	cmdRename.Flags().StringArrayVar(&renameImportModules, "import-module", []string{}, "Retarget all imports from a module (module=newmodule)")
+	cmdRename.Flags().StringArrayVar(&renameImportTypes, "import-type", []string{}, "Change the signature of an import (module:name=(param i32) (result i32))")
+}
+
+// Example:
+//	--import-module "wasi_unstable=wasi_snapshot_preview1"
+//	--import "env:hello=env:hello_v2"
+//	--export "_start=main"
+//	--import-type "env:hello=(param i32 i32) (result i32)"
+
+func splitRename(r string) (string, string, error) {
+	bits := strings.SplitN(r, "=", 2)
+	if len(bits) != 2 || bits[0] == "" || bits[1] == "" {
+		return "", "", fmt.Errorf("Invalid rename %s (expected old=new)", r)
+	}
+	return bits[0], bits[1], nil
+}
+
+func splitImport(i string) (string, string, error) {
+	bits := strings.SplitN(i, ":", 2)
+	if len(bits) != 2 {
+		return "", "", fmt.Errorf("Invalid import %s (expected module:name)", i)
+	}
+	return bits[0], bits[1], nil
+}
+
+func runRename(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.NewWithLayout(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing custom name section...\n")
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	for _, r := range renameImportModules {
+		from, to, err := splitRename(r)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Retargeting imports from %s to %s\n", from, to)
+		err = wfile.RenameImportModule(from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range renameImports {
+		from, to, err := splitRename(r)
+		if err != nil {
+			return err
+		}
+		fromModule, fromName, err := splitImport(from)
+		if err != nil {
+			return err
+		}
+		toModule, toName, err := splitImport(to)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Retargeting import %s to %s\n", from, to)
+		err = wfile.RenameImport(fromModule, fromName, toModule, toName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Signatures are changed after retargeting, so they use the new names
+	for _, r := range renameImportTypes {
+		from, sig, err := splitRename(r)
+		if err != nil {
+			return err
+		}
+		module, name, err := splitImport(from)
+		if err != nil {
+			return err
+		}
+		te := &wasmfile.TypeEntry{}
+		err = te.DecodeWat(fmt.Sprintf("(type (func %s))", sig))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Changing the signature of import %s to %s\n", from, sig)
+		err = wfile.ResignImport(module, name, te)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range renameExports {
+		from, to, err := splitRename(r)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Renaming export %s to %s\n", from, to)
+		err = wfile.RenameExport(from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
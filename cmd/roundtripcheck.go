@@ -0,0 +1,121 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdRoundtripCheck = &cobra.Command{
+		Use:   "roundtrip-check",
+		Short: "Check a wasm file survives being translated to wat and back",
+		Long:  `This translates a wasm file to wat and assembles it again, then checks the result is the same module. Custom sections are left out, since wat doesn't keep them.`,
+		RunE:  runRoundtripCheck,
+	}
+)
+
+var roundtripWat = ""
+
+func init() {
+	rootCmd.AddCommand(cmdRoundtripCheck)
+	cmdRoundtripCheck.Flags().StringVar(&roundtripWat, "wat", "", "Also write the intermediate wat to this file")
+}
+
+func runRoundtripCheck(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	fmt.Printf("Translating to wat...\n")
+	var wat bytes.Buffer
+	err = wfile.EncodeWat(&wat)
+	if err != nil {
+		return err
+	}
+
+	watName := "roundtrip.wat"
+	if roundtripWat != "" {
+		watName = roundtripWat
+		err = os.WriteFile(roundtripWat, wat.Bytes(), 0660)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Assembling the wat again...\n")
+	wfile2 := wasmfile.NewEmpty()
+	err = wfile2.DecodeWatFile(watName, wat.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, c := range wfile2.Code {
+		err = c.ResolveLengths(wfile2)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveRelocations(wfile2, 0)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveGlobals(wfile2)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveFunctions(wfile2)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Go through the binary encoding too, so the result is decoded the same way as the original
+	var wasm bytes.Buffer
+	err = wfile2.EncodeBinary(&wasm)
+	if err != nil {
+		return err
+	}
+	wfile3 := &wasmfile.WasmFile{}
+	err = wfile3.DecodeBinary(wasm.Bytes())
+	if err != nil {
+		return err
+	}
+
+	wfile.Custom = nil
+	wfile3.Custom = nil
+	err = wfile.CompareModule(wfile3)
+	if err != nil {
+		return fmt.Errorf("The module changed going through wat: %w", err)
+	}
+
+	fmt.Printf("OK - %d functions, %d globals and %d data segments are the same after going through wat\n", len(wfile.Code), len(wfile.Global), len(wfile.Data))
+	return nil
+}
@@ -0,0 +1,394 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/cover"
+	"github.com/loopholelabs/wasm-toolkit/pkg/interp"
+	"github.com/loopholelabs/wasm-toolkit/pkg/meter"
+	"github.com/loopholelabs/wasm-toolkit/pkg/shadowstack"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+var (
+	cmdRun = &cobra.Command{
+		Use:   "run",
+		Short: "Run a wasm file, optionally instrumenting it first",
+		Long:  `This instruments the module in memory (with --strace, --cover and --meter) and runs it in an embedded wazero runtime, giving it stdin, stdout, stderr, args, env and any directories given with --mount through WASI. The log of instrumenting goes to stderr, or to --log. The exit code of the module is passed on. With --interp it runs in the built-in interpreter instead, which is slow, but every instruction can be traced. The interpreter can also record every WASI call to a log with --record, and run again the same way with --replay, where the calls are answered from the log. This is done by the interpreter's own WASI shims, not by instrumenting the module, so --record and --replay always run in the interpreter.`,
+		RunE:  runRun,
+	}
+)
+
+var run_func = "_start"
+var run_args []string
+var run_env []string
+var run_trace = false
+var run_max_steps uint64 = 0
+var run_interp = false
+var run_strace = false
+var run_cover = false
+var run_meter = false
+var run_backtrace = false
+var run_record = ""
+var run_replay = ""
+var run_mounts []string
+var run_log = ""
+
+func init() {
+	rootCmd.AddCommand(cmdRun)
+	cmdRun.Flags().StringVar(&run_func, "func", "_start", "Export to run")
+	cmdRun.Flags().StringArrayVar(&run_args, "arg", []string{}, "Argument for the module")
+	cmdRun.Flags().StringArrayVar(&run_env, "env", []string{}, "Environment variable for the module, eg HOME=/")
+	cmdRun.Flags().BoolVar(&run_trace, "trace", false, "Show every instruction run on stderr")
+	cmdRun.Flags().Uint64Var(&run_max_steps, "max-steps", 0, "Stop after this many instructions (0 for no limit)")
+	cmdRun.Flags().BoolVar(&run_interp, "interp", false, "Use the built-in interpreter rather than wazero (implied by --trace, --max-steps, --record and --replay)")
+	cmdRun.Flags().StringVar(&run_record, "record", "", "Write every WASI call and what it did to this file (interpreter only)")
+	cmdRun.Flags().StringVar(&run_replay, "replay", "", "Answer WASI calls from a file written by --record, rather than the host (interpreter only)")
+	cmdRun.Flags().StringArrayVar(&run_mounts, "mount", []string{}, "Host directory to preopen for the module 'host:guest' eg '.:/data' (can be repeated)")
+	cmdRun.Flags().StringVar(&run_log, "log", "", "Write the log of instrumenting to this file, rather than stderr")
+
+	cmdRun.Flags().BoolVar(&run_strace, "strace", false, "Add strace output first")
+	cmdRun.Flags().StringArrayVar(&func_regex, "strace-func", []string{".*"}, "Func name regexp to strace (can be repeated)")
+	cmdRun.Flags().BoolVar(&include_all, "strace-all", false, "Include everything in the strace output")
+	cmdRun.Flags().BoolVar(&run_cover, "cover", false, "Add code coverage first, written to STDERR on exit")
+	cmdRun.Flags().BoolVar(&cover_blocks, "cover-blocks", false, "Record coverage for each block of code, rather than each function")
+	cmdRun.Flags().BoolVar(&run_backtrace, "backtrace", false, "Add a shadow call stack first, to show a backtrace if the module traps")
+	cmdRun.Flags().BoolVar(&run_meter, "meter", false, "Add fuel metering first, trapping when the fuel runs out")
+	cmdRun.Flags().Int64Var(&meter_fuel, "fuel", 1000000000, "Fuel to start with")
+	cmdRun.Flags().StringArrayVar(&meter_costs, "cost", []string{}, "Cost of an instruction 'name=cost' eg 'call=10' (can be repeated)")
+}
+
+func runRun(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	data, err := instrumentRun(ccmd)
+	if err != nil {
+		return err
+	}
+
+	if run_interp || run_trace || run_max_steps != 0 || run_record != "" || run_replay != "" {
+		err = runInterp(data)
+	} else {
+		err = runWazero(data)
+	}
+
+	var exit *interp.ExitError
+	var sysExit *sys.ExitError
+	if errors.As(err, &exit) {
+		if exit.Code == 0 {
+			return nil
+		}
+		// The module has already said what went wrong
+		os.Exit(int(exit.Code))
+	} else if errors.As(err, &sysExit) {
+		if sysExit.ExitCode() == 0 {
+			return nil
+		}
+		os.Exit(int(sysExit.ExitCode()))
+	}
+	return err
+}
+
+// Load the input file, adding whichever of strace, cover and meter were asked for
+func instrumentRun(ccmd *cobra.Command) ([]byte, error) {
+	var data []byte
+	var err error
+	if run_strace {
+		// Only the trace itself should be mixed in with the stdout of the module
+		strace_log = os.Stderr
+		if run_log != "" {
+			f, err := os.Create(run_log)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			strace_log = f
+		}
+		wfile, err := straceFile(ccmd)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = wfile.EncodeBinary(&buf)
+		if err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	} else {
+		data, err = os.ReadFile(Input)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if run_cover {
+		data, err = cover.AddCover(data, cover.Cover_config{Blocks: cover_blocks})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if run_backtrace {
+		data, err = shadowstack.AddShadowStack(data, shadowstack.Shadowstack_config{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Metering goes last, so the code added by the others is paid for too
+	if run_meter {
+		costs, err := meterCosts()
+		if err != nil {
+			return nil, err
+		}
+		data, err = meter.AddMeter(data, meter.Meter_config{Fuel: meter_fuel, Costs: costs})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func runWazero(data []byte) error {
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	// Report breakpoints added by the breakpoint command, and carry on
+	_, err := r.NewHostModuleBuilder("wasm_toolkit").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, pc uint32) {
+			fmt.Fprintf(os.Stderr, "Breakpoint at PC %08x\n", pc)
+		}).
+		Export("break").
+		Instantiate(ctx)
+	if err != nil {
+		return err
+	}
+
+	compiled, err := r.CompileModule(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	config := wazero.NewModuleConfig().
+		WithArgs(append([]string{Input}, run_args...)...).
+		WithStdin(os.Stdin).
+		WithStdout(os.Stdout).
+		WithStderr(os.Stderr).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader).
+		WithStartFunctions()
+	for _, e := range run_env {
+		name, value, _ := strings.Cut(e, "=")
+		config = config.WithEnv(name, value)
+	}
+	if len(run_mounts) > 0 {
+		fsconfig := wazero.NewFSConfig()
+		for _, m := range run_mounts {
+			host, guest, ok := strings.Cut(m, ":")
+			if !ok || host == "" || guest == "" {
+				return fmt.Errorf("The mount %s should be host:guest", m)
+			}
+			fsconfig = fsconfig.WithDirMount(host, guest)
+		}
+		config = config.WithFSConfig(fsconfig)
+	}
+
+	mod, err := r.InstantiateModule(ctx, compiled, config)
+	if err != nil {
+		return err
+	}
+	fn := mod.ExportedFunction(run_func)
+	if fn == nil {
+		return fmt.Errorf("The module doesn't export a function %s", run_func)
+	}
+	_, err = fn.Call(ctx)
+	var exit *sys.ExitError
+	if err != nil && !errors.As(err, &exit) && mod.ExportedFunction(shadowstack.Export) != nil {
+		showBacktrace(ctx, data, mod)
+	}
+	return err
+}
+
+/**
+ * Show the calls that were in progress when the module trapped, from its shadow call stack.
+ * The backtrace is written to a page added to the end of memory.
+ */
+func showBacktrace(ctx context.Context, data []byte, mod api.Module) {
+	pages, ok := mod.Memory().Grow(1)
+	if !ok {
+		return
+	}
+	ptr := uint64(pages) << 16
+	res, err := mod.ExportedFunction(shadowstack.Export).Call(ctx, ptr, 65536)
+	if err != nil {
+		return
+	}
+	buf, ok := mod.Memory().Read(uint32(ptr), 65536)
+	if !ok {
+		return
+	}
+
+	wfile, err := wasmfile.NewFromReader(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	wfile.Debug.Demangle = !rawNames
+	fmt.Fprintf(os.Stderr, "backtrace:\n")
+	for i, fid := range shadowstack.DecodeBacktrace(buf, uint32(res[0])) {
+		fmt.Fprintf(os.Stderr, "  #%d %s\n", i, wfile.Debug.GetFunctionIdentifier(fid, false))
+	}
+}
+
+func runInterp(data []byte) error {
+	if len(run_mounts) > 0 {
+		return errors.New("The interpreter has no files, so --mount needs wazero")
+	}
+
+	wfile, err := wasmfile.NewFromReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	config := interp.Interp_config{
+		Args:   append([]string{Input}, run_args...),
+		Env:    run_env,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		Imports: map[string]interp.HostFunc{
+			// Report breakpoints added by the breakpoint command, and carry on
+			"wasm_toolkit:break": func(m *interp.Machine, params []uint64) ([]uint64, error) {
+				frames := m.Frames()
+				fid := frames[len(frames)-1].Function
+				fmt.Fprintf(os.Stderr, "Breakpoint at PC %08x in %s\n", uint32(params[0]), wfile.Debug.GetFunctionIdentifier(fid, false))
+				return nil, nil
+			},
+		},
+	}
+	if run_replay != "" {
+		f, err := os.Open(run_replay)
+		if err != nil {
+			return err
+		}
+		config.Replay, err = interp.ReadWasiLog(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if run_record != "" {
+		f, err := os.Create(run_record)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		defer w.Flush()
+		config.Record = func(call *interp.WasiCall) {
+			interp.WriteWasiCall(w, call)
+		}
+	}
+
+	m, err := interp.New(wfile, config)
+	if err != nil {
+		return err
+	}
+
+	if run_trace {
+		return runTraced(wfile, m)
+	} else if run_max_steps == 0 {
+		_, err = m.Call(run_func)
+		return err
+	}
+	return runStepped(wfile, m, nil)
+}
+
+// Run one instruction at a time, calling trace before each one
+func runStepped(wfile *wasmfile.WasmFile, m *interp.Machine, trace func() error) error {
+	fid := -1
+	for _, e := range wfile.Export {
+		if e.Name == run_func {
+			fid = e.Index
+		}
+	}
+	if fid == -1 {
+		return fmt.Errorf("The module doesn't export a function %s", run_func)
+	}
+	err := m.Start(fid, nil)
+	if err != nil {
+		return err
+	}
+	for !m.Done() {
+		if run_max_steps != 0 && m.Steps() >= run_max_steps {
+			return fmt.Errorf("Stopped after %d instructions", m.Steps())
+		}
+		if trace != nil {
+			err = trace()
+			if err != nil {
+				return err
+			}
+		}
+		err = m.Step()
+		if err != nil {
+			return err
+		}
+	}
+	return m.Run()
+}
+
+func runTraced(wfile *wasmfile.WasmFile, m *interp.Machine) error {
+	w := bufio.NewWriter(os.Stderr)
+	defer w.Flush()
+	line := make([]byte, 0, 128)
+	return runStepped(wfile, m, func() error {
+		e := m.Next()
+		if e == nil {
+			return nil
+		}
+		frames := m.Frames()
+		fid := frames[len(frames)-1].Function
+		line = append(line[:0], fmt.Sprintf("%s %08x ", wfile.Debug.GetFunctionIdentifier(fid, false), e.PC)...)
+		var err error
+		line, err = e.AppendWat(line, "", wfile.Debug)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(line)
+		return err
+	})
+}
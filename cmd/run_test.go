@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Write the wat as a wasm file with debug info, and give its path
+func writeWasm(t *testing.T, wat string) string {
+	in := filepath.Join(t.TempDir(), "in.wasm")
+	assert.NoError(t, os.WriteFile(in, testutil.Encode(t, testutil.ModuleWithDebug(t, wat)), 0666))
+	return in
+}
+
+func TestRunMount(t *testing.T) {
+	in := writeWasm(t, wasiProgram("write 3 out.txt hello"))
+	dir := t.TempDir()
+	assert.NoError(t, toolkit(t, "run", "-i", in, "--mount", dir+":/data"))
+
+	data, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	assert.EqualError(t, toolkit(t, "run", "-i", in, "--mount", dir), "The mount "+dir+" should be host:guest")
+	assert.EqualError(t, toolkit(t, "run", "-i", in, "--mount", dir+":/data", "--interp"), "The interpreter has no files, so --mount needs wazero")
+}
+
+func TestRunLog(t *testing.T) {
+	in := writeWasm(t, wasiProgram("print hi"))
+	log := filepath.Join(t.TempDir(), "run.log")
+	assert.NoError(t, toolkit(t, "run", "-i", in, "--strace", "--log", log))
+
+	data, err := os.ReadFile(log)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "Loading wasm file \""+in+"\"...\n")
+	assert.Contains(t, string(data), "All wat code added...\n")
+}
@@ -0,0 +1,67 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdSections = &cobra.Command{
+		Use:   "sections",
+		Short: "Show the sections in a wasm file",
+		Long:  `This prints a table of the sections in a wasm file, with their offsets and sizes.`,
+		RunE:  runSections,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(cmdSections)
+}
+
+func runSections(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	wfile, err := wasmfile.NewWithLayout(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-4s %-10s %10s %10s %8s  %s\n", "#", "Section", "Offset", "Size", "Count", "Name")
+	for idx, sl := range wfile.Layout {
+		count := ""
+		name := ""
+		if sl.Id == types.SectionCustom {
+			name = sl.Custom.Name
+		} else if sl.Id != types.SectionStart && sl.Id <= types.SectionDataCount {
+			n, l := binary.Uvarint(sl.Data)
+			if l > 0 {
+				count = fmt.Sprintf("%d", n)
+			}
+		}
+		fmt.Printf("%-4d %-10s 0x%08x %10d %8s  %s\n", idx, sl.Id, sl.Offset, len(sl.Header)+len(sl.Data), count, name)
+	}
+	return nil
+}
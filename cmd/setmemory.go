@@ -0,0 +1,112 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdSetMemory = &cobra.Command{
+		Use:   "setmemory",
+		Short: "Change the memory limits of a wasm file",
+		Long:  `This changes the min and max pages of the memory, and whether it's shared. The data has to still fit in the min.`,
+		RunE:  runSetMemory,
+	}
+)
+
+var setmemoryMin = 0
+var setmemoryMax = 0
+var setmemoryShared = false
+
+func init() {
+	rootCmd.AddCommand(cmdSetMemory)
+
+	cmdSetMemory.Flags().IntVar(&setmemoryMin, "min", 0, "Min pages")
+	cmdSetMemory.Flags().IntVar(&setmemoryMax, "max", 0, "Max pages (0 for no max)")
+	cmdSetMemory.Flags().BoolVar(&setmemoryShared, "shared", false, "Make the memory shared")
+}
+
+func memoryLimits(m *wasmfile.MemoryEntry) string {
+	s := fmt.Sprintf("min %d", m.LimitMin)
+	if m.LimitMax != 0 {
+		s = fmt.Sprintf("%s max %d", s, m.LimitMax)
+	}
+	if m.Shared {
+		s = s + " shared"
+	}
+	return s
+}
+
+func runSetMemory(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+	flags := ccmd.Flags()
+	if !flags.Changed("min") && !flags.Changed("max") && !flags.Changed("shared") {
+		return errors.New("Nothing to change. Use --min, --max or --shared")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.NewWithLayout(Input)
+	if err != nil {
+		return err
+	}
+	if len(wfile.Memory) == 0 {
+		return errors.New("The module has no memory")
+	}
+
+	// Anything not given stays as it is
+	m := wfile.Memory[0]
+	min := m.LimitMin
+	max := m.LimitMax
+	shared := m.Shared
+	if flags.Changed("min") {
+		min = setmemoryMin
+	}
+	if flags.Changed("max") {
+		max = setmemoryMax
+	}
+	if flags.Changed("shared") {
+		shared = setmemoryShared
+	}
+
+	before := memoryLimits(m)
+	err = wfile.SetMemoryLimits(0, min, max, shared)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Memory changed from %s to %s\n", before, memoryLimits(m))
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,65 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/shadowstack"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdShadowstack = &cobra.Command{
+		Use:   "shadowstack",
+		Short: "Add a shadow call stack to a wasm file, for backtraces after a trap",
+		Long:  `Each function pushes its ID on entry and pops it on exit. The host can call the export __backtrace(ptr, len) after a trap to get the calls that were in progress, innermost first.`,
+		RunE:  runShadowstack,
+	}
+)
+
+var shadowstack_size = shadowstack.DefaultSize
+
+func init() {
+	rootCmd.AddCommand(cmdShadowstack)
+	cmdShadowstack.Flags().IntVar(&shadowstack_size, "size", shadowstack.DefaultSize, "The most calls to keep")
+}
+
+func runShadowstack(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := shadowstack.Shadowstack_config{
+		Size: shadowstack_size,
+	}
+	newdata, err := shadowstack.AddShadowStack(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
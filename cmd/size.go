@@ -0,0 +1,74 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/size"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdSize = &cobra.Command{
+		Use:   "size",
+		Short: "Show where the bytes in a wasm file go",
+		Long:  `This reports the size of each function, data segment and custom section.`,
+		RunE:  runSize,
+	}
+)
+
+var sizeTop = 0
+var sizeSort = "size"
+
+func init() {
+	rootCmd.AddCommand(cmdSize)
+
+	cmdSize.Flags().IntVar(&sizeTop, "top", 0, "Only show the largest N items")
+	cmdSize.Flags().StringVar(&sizeSort, "sort", "size", "Sort by size or name")
+}
+
+func runSize(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+	wfile.Debug.Demangle = !rawNames
+
+	report, err := size.Profile(wfile)
+	if err != nil {
+		return err
+	}
+
+	if sizeSort == "size" {
+		report.SortBySize()
+	} else if sizeSort == "name" {
+		report.SortByName()
+	} else {
+		return fmt.Errorf("Unknown sort %s", sizeSort)
+	}
+	report.Top(sizeTop)
+
+	return report.WriteText(os.Stdout)
+}
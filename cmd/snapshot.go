@@ -0,0 +1,67 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/snapshot"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdSnapshot = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Let the host snapshot a wasm file's memory and globals, and restore them later",
+		Long:  `This adds __snapshot and __restore exports, and tracks which pages are written to, so only those are saved and restored.`,
+		RunE:  runSnapshot,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(cmdSnapshot)
+}
+
+func runSnapshot(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	newdata, err := snapshot.AddSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	wfile := &wasmfile.WasmFile{}
+	err = wfile.DecodeBinary(data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The snapshot buffer needs %d bytes, and %d more for each page written to\n", snapshot.BufferSize(wfile, 0), snapshot.PageRecord)
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
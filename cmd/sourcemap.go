@@ -0,0 +1,115 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdSourcemap = &cobra.Command{
+		Use:   "sourcemap",
+		Short: "Generate a javascript source map from dwarf",
+		Long:  `This writes a source map from the dwarf line numbers, and adds a sourceMappingURL section pointing at it.`,
+		RunE:  runSourcemap,
+	}
+)
+
+var sourcemapFile = ""
+var sourcemapURL = ""
+
+func init() {
+	rootCmd.AddCommand(cmdSourcemap)
+
+	cmdSourcemap.Flags().StringVar(&sourcemapFile, "map", "", "Source map file to write (default is the output with .map added)")
+	cmdSourcemap.Flags().StringVar(&sourcemapURL, "url", "", "URL of the source map (default is the source map filename)")
+}
+
+func runSourcemap(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	if sourcemapFile == "" {
+		sourcemapFile = Output + ".map"
+	}
+	if sourcemapURL == "" {
+		sourcemapURL = filepath.Base(sourcemapFile)
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.NewWithLayout(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing dwarf line numbers...\n")
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
+	if err != nil {
+		return err
+	}
+	err = wfile.Debug.ParseDwarf(debugSections)
+	if err != nil {
+		return err
+	}
+	wfile.Debug.LowMemory = lowMemory
+	err = wfile.Debug.ParseDwarfLineNumbers()
+	if err != nil {
+		return err
+	}
+
+	sm, err := wfile.GenerateSourceMap()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing source map to %s...\n", sourcemapFile)
+	data, err := json.Marshal(sm)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(sourcemapFile, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.SetSourceMapURL(sourcemapURL)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
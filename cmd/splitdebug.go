@@ -0,0 +1,93 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdSplitDebug = &cobra.Command{
+		Use:   "split-debug",
+		Short: "Move dwarf debug info into a separate file",
+		Long:  `This moves the .debug_* sections into a companion file, and adds an external_debug_info section pointing at it.`,
+		RunE:  runSplitDebug,
+	}
+)
+
+var splitDebugFile = ""
+var splitDebugURL = ""
+
+func init() {
+	rootCmd.AddCommand(cmdSplitDebug)
+
+	cmdSplitDebug.Flags().StringVar(&splitDebugFile, "debug-file", "", "Companion file to write (default is the output with .debug.wasm)")
+	cmdSplitDebug.Flags().StringVar(&splitDebugURL, "url", "", "URL of the companion file (default is the companion filename)")
+}
+
+func runSplitDebug(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	if splitDebugFile == "" {
+		splitDebugFile = Output[:len(Output)-len(filepath.Ext(Output))] + ".debug.wasm"
+	}
+	if splitDebugURL == "" {
+		splitDebugURL = filepath.Base(splitDebugFile)
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.NewWithLayout(Input)
+	if err != nil {
+		return err
+	}
+
+	companion, err := wfile.SplitDwarf(splitDebugURL)
+	if err != nil {
+		return err
+	}
+
+	for _, out := range []struct {
+		filename string
+		wf       *wasmfile.WasmFile
+	}{{splitDebugFile, companion}, {Output, wfile}} {
+		fmt.Printf("Writing wasm out to %s...\n", out.filename)
+		f, err := os.Create(out.filename)
+		if err != nil {
+			return err
+		}
+
+		err = out.wf.EncodeBinary(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/stackdepth"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdStackdepth = &cobra.Command{
+		Use:   "stackdepth",
+		Short: "Add call depth and stack use tracking to a wasm file",
+		Long:  `This reports the deepest call and the stack pointer low watermark to STDERR on exit, and can trap when the call depth goes over a limit`,
+		RunE:  runStackdepth,
+	}
+)
+
+var stackdepth_limit = 0
+var stackdepth_sp_global = ""
+
+func init() {
+	rootCmd.AddCommand(cmdStackdepth)
+	cmdStackdepth.Flags().IntVar(&stackdepth_limit, "limit", 0, "Trap when the call depth goes over this (0 for no limit)")
+	cmdStackdepth.Flags().StringVar(&stackdepth_sp_global, "sp-global", "", "Name or index of the stack pointer global (defaults to __stack_pointer if there is one)")
+}
+
+func runStackdepth(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := stackdepth.Stackdepth_config{
+		Limit:    stackdepth_limit,
+		SPGlobal: stackdepth_sp_global,
+	}
+	newdata, err := stackdepth.AddStackdepth(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
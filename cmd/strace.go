@@ -18,14 +18,19 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/loopholelabs/wasm-toolkit/internal/wat"
+	"github.com/loopholelabs/wasm-toolkit/pkg/inline"
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm"
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
@@ -40,69 +45,155 @@ var (
 		Use:   "strace",
 		Short: "Use strace to add tracing output to as wasm file",
 		Long:  `This will output debug info to STDERR`,
-		Run:   runStrace,
+		RunE:  runStrace,
 	}
 )
 
 var include_imports = false
 var include_timings = false
+var include_indirect = false
+var include_branches = false
+var sample_rate = 0
+var export_stats = false
+var export_metrics = false
 var include_line_numbers = false
 var include_func_signatures = false
 var include_param_names = false
 var include_all = false
-var func_regex = ".*"
+var func_regex = []string{".*"}
+var func_exclude = []string{}
+var func_files = []string{}
+var func_at = ""
 var cfg_color = false
+var trace_format = "text"
+var trace_fd = 2
+var max_depth = 0
+var max_string_len = 32
+var trace_file = ""
 var watch_globals = ""
+var watch_addrs = []string{}
+var watch_wasm_globals = []string{}
+var trace_vars = []string{}
 var config_parse_dwarf = false
+var inline_max_size = 0
+
+// Where progress messages go while the wasm file is being patched
+var strace_log io.Writer = os.Stdout
 
 // If true, then we'll hook access to globals / locals, and output debug info...
 var config_log_globals = false
 var config_log_locals = false
 var config_log_memory = false
+var config_log_memory_reads = false
 
 var config_log_mem_ranges = make([]string, 0)
 
 func init() {
 	rootCmd.AddCommand(cmdStrace)
-	cmdStrace.Flags().StringVarP(&func_regex, "func", "f", ".*", "Func name regexp")
+	cmdStrace.Flags().StringArrayVarP(&func_regex, "func", "f", []string{".*"}, "Func name regexp (can be repeated)")
+	cmdStrace.Flags().StringArrayVar(&func_exclude, "exclude", []string{}, "Exclude functions matching this name regexp (can be repeated)")
+	cmdStrace.Flags().StringArrayVar(&func_files, "file", []string{}, "Only trace functions from source files matching this glob (can be repeated)")
+	cmdStrace.Flags().StringVar(&func_at, "func-at", "", "Only trace functions containing this source line 'file:line'")
 	cmdStrace.Flags().BoolVar(&include_line_numbers, "linenumbers", false, "Include line number info")
 	cmdStrace.Flags().BoolVar(&include_func_signatures, "funcsignatures", false, "Include function signatures")
 	cmdStrace.Flags().BoolVar(&include_param_names, "paramnames", false, "Include param names")
 	cmdStrace.Flags().BoolVar(&include_timings, "timing", false, "Include timing summary")
+	cmdStrace.Flags().BoolVar(&export_stats, "export-stats", false, "Export __wasm_toolkit_stats(ptr, len) so the host can read call counts and timings")
+	cmdStrace.Flags().BoolVar(&export_metrics, "export-metrics", false, "Export __metrics(ptr, len) so the host can scrape call counts and timings in Prometheus format")
 	cmdStrace.Flags().BoolVar(&include_imports, "imports", false, "Include imports")
+	cmdStrace.Flags().BoolVar(&include_indirect, "indirect", false, "Include call_indirect targets")
+	cmdStrace.Flags().BoolVar(&include_branches, "branches", false, "Log if each br_if / if is taken")
 	cmdStrace.Flags().BoolVar(&include_all, "all", false, "Include everything")
 
 	cmdStrace.Flags().BoolVar(&cfg_color, "color", false, "Output ANSI color in the log")
+	cmdStrace.Flags().StringVar(&trace_format, "format", "text", "Trace output format (text, json or chrome)")
+	cmdStrace.Flags().IntVar(&sample_rate, "sample", 0, "Only trace every Nth call, and the calls it makes. WASM_TOOLKIT_SAMPLE=N changes this at runtime")
+	cmdStrace.Flags().IntVar(&max_depth, "max-depth", 0, "Only trace calls nested up to this depth (0 for no limit)")
+	cmdStrace.Flags().IntVarP(&max_string_len, "strsize", "s", 32, "Maximum number of bytes of wasi data to show")
+	cmdStrace.Flags().IntVar(&trace_fd, "trace-fd", 2, "File descriptor to write the trace to")
+	cmdStrace.Flags().StringVar(&trace_file, "trace-file", "", "Write the trace to this file, relative to a preopened directory")
 	cmdStrace.Flags().BoolVar(&config_parse_dwarf, "dwarf", false, "Parse dwarf line numbers and variables")
+	cmdStrace.Flags().IntVar(&inline_max_size, "inline", 0, "Inline functions up to this many instructions that weren't traced, eg import wrappers (0 for none)")
 
 	cmdStrace.Flags().StringVarP(&watch_globals, "watch", "w", "", "List of globals to watch (, separated)")
+	cmdStrace.Flags().StringArrayVar(&watch_addrs, "watch-addr", []string{}, "Log stores to the memory range 'addr:len' from any function (can be repeated)")
+	cmdStrace.Flags().StringArrayVar(&trace_vars, "trace-var", []string{}, "Show the new value of this dwarf global variable whenever it's written to (can be repeated)")
+	cmdStrace.Flags().StringArrayVar(&watch_wasm_globals, "watch-global", []string{}, "Log global.set of this wasm global (name or index) from any function (can be repeated)")
 
 	cmdStrace.Flags().BoolVar(&config_log_globals, "logglobals", false, "Log wasm global writes")
 	cmdStrace.Flags().BoolVar(&config_log_locals, "loglocals", false, "Log wasm local writes")
 	cmdStrace.Flags().BoolVar(&config_log_memory, "logmemory", false, "Log memory writes")
+	cmdStrace.Flags().BoolVar(&config_log_memory_reads, "logmemoryreads", false, "Log memory reads")
 
 	cmdStrace.Flags().StringSliceVar(&config_log_mem_ranges, "memory", []string{"memory=0-"}, "Memory ranges to watch 'tag=<min>-<max>' max is optional.")
 }
 
-func runStrace(ccmd *cobra.Command, args []string) {
+func runStrace(ccmd *cobra.Command, args []string) error {
 	if Input == "" {
-		panic("No input file")
+		return errors.New("No input file")
+	}
+
+	wfile, err := straceFile(ccmd)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(strace_log, "Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// Load the input file and add the tracing code to it, as set up by the strace flags
+func straceFile(ccmd *cobra.Command) (*wasmfile.WasmFile, error) {
+	// The injected code calls $debug_* hooks for text output, $json_* hooks for json, or $chrome_* hooks for chrome.
+	hook := "debug"
+	if trace_format == "json" || trace_format == "chrome" {
+		hook = trace_format
+		if watch_globals != "" || len(watch_addrs) > 0 || len(watch_wasm_globals) > 0 || len(trace_vars) > 0 || config_log_globals || config_log_locals || config_log_memory || config_log_memory_reads || include_timings || include_indirect || include_branches {
+			return nil, fmt.Errorf("--watch*, --log*, --timing, --indirect and --branches are not supported with --format=%s", trace_format)
+		}
+		cfg_color = false
+	} else if trace_format != "text" {
+		return nil, fmt.Errorf("Unknown trace format %q", trace_format)
+	}
+	if include_all && hook == "debug" {
+		include_indirect = true
 	}
+	// Timings are collected for the summary, and for the stats and metrics exports
+	collect_timings := include_timings || export_stats || export_metrics
 
-	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	if trace_file != "" && ccmd.Flags().Changed("trace-fd") {
+		return nil, errors.New("Only one of --trace-fd and --trace-file can be used")
+	}
+
+	fmt.Fprintf(strace_log, "Loading wasm file \"%s\"...\n", Input)
 	wfile, err := wasmfile.New(Input)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	fmt.Printf("Parsing custom name section...\n")
+	fmt.Fprintf(strace_log, "Parsing custom name section...\n")
 	wfile.Debug = &debug.WasmDebug{}
 	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+	wfile.Debug.Demangle = !rawNames
 
-	fmt.Printf("Parsing custom dwarf debug sections...\n")
-	err = wfile.Debug.ParseDwarf(wfile)
+	fmt.Fprintf(strace_log, "Parsing custom dwarf debug sections...\n")
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	err = wfile.Debug.ParseDwarf(debugSections)
+	if err != nil {
+		return nil, err
 	}
 
 	// Keep track of wasi import wrappers so that we can add context to them later.
@@ -163,6 +254,7 @@ func runStrace(ccmd *cobra.Command, args []string) {
 	}
 
 	originalFunctionLength := len(wfile.Code)
+	originalGlobalLength := len(wfile.Global)
 
 	data_ptr := wfile.Memory[0].LimitMin << 16
 
@@ -191,24 +283,52 @@ func runStrace(ccmd *cobra.Command, args []string) {
 		"timings.wat",
 		"watch.wat",
 		"watch_dynamic.wat",
+		"watchpoint.wat",
 		"function_enter_exit.wat"}
+	if hook == "json" || hook == "chrome" {
+		files = append(files, "json.wat")
+	}
+	if hook == "chrome" {
+		files = append(files, "chrome.wat")
+	}
+	if trace_file != "" {
+		files = append(files, "trace_file.wat")
+	}
+	if include_indirect {
+		files = append(files, "indirect.wat")
+	}
+	if len(trace_vars) > 0 {
+		files = append(files, "tracevar.wat")
+	}
+	if export_metrics {
+		files = append(files, "metrics.wat")
+	}
+	if include_branches {
+		files = append(files, "branch.wat")
+	}
+	if sample_rate > 0 {
+		files = append(files, "sample.wat")
+	}
 
 	ptr := int32(data_ptr)
 	for _, file := range files {
-		fmt.Printf(" - Adding code from %s...\n", file)
+		fmt.Fprintf(strace_log, " - Adding code from %s...\n", file)
 		data, err := wat.Wat_content.ReadFile(path.Join("wat_code", file))
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		mod := &wasmfile.WasmFile{}
-		err = mod.DecodeWat(data)
+		err = mod.DecodeWatFile(file, data)
 
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		ptr, err = wfile.AddDataFrom(ptr, mod)
+		if err != nil {
+			return nil, err
 		}
-		ptr = wfile.AddDataFrom(ptr, mod)
-		wfile.AddFuncsFrom(mod, func(remap map[int]int) {
+		err = wfile.AddFuncsFrom(mod, func(remap map[int]int) {
 			// Fixup
 			// wasi_functions
 			newmap := make(map[int]string)
@@ -220,70 +340,175 @@ func runStrace(ccmd *cobra.Command, args []string) {
 			}
 			wasi_functions = newmap
 		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	fmt.Printf("All wat code added...\n")
+	fmt.Fprintf(strace_log, "All wat code added...\n")
 
-	wfile.RedirectImport("scale", "watch", "$watch_add")
-	wfile.RedirectImport("scale", "unwatch", "$watch_del")
+	err = wfile.RedirectImport("scale", "watch", "$watch_add")
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.RedirectImport("scale", "unwatch", "$watch_del")
+	if err != nil {
+		return nil, err
+	}
 
-	wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	if export_stats {
+		for _, e := range wfile.Export {
+			if e.Name == "__wasm_toolkit_stats" {
+				return nil, errors.New("The module already exports __wasm_toolkit_stats")
+			}
+		}
+		wfile.Export = append(wfile.Export, &wasmfile.ExportEntry{
+			Name:  "__wasm_toolkit_stats",
+			Type:  types.ExportFunc,
+			Index: wfile.Debug.LookupFunctionID("$__wasm_toolkit_stats"),
+		})
+	}
+	if export_metrics {
+		for _, e := range wfile.Export {
+			if e.Name == "__metrics" {
+				return nil, errors.New("The module already exports __metrics")
+			}
+		}
+		wfile.Export = append(wfile.Export, &wasmfile.ExportEntry{
+			Name:  "__metrics",
+			Type:  types.ExportFunc,
+			Index: wfile.Debug.LookupFunctionID("$__metrics"),
+		})
+	}
 
-	if config_parse_dwarf {
+	err = wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	if err != nil {
+		return nil, err
+	}
 
+	if config_parse_dwarf || func_at != "" || len(func_files) > 0 {
 		// Parse the dwarf stuff *here* incase the above messed up function IDs
-		fmt.Printf("Parsing dwarf line numbers...\n")
+		fmt.Fprintf(strace_log, "Parsing dwarf line numbers...\n")
+		wfile.Debug.LowMemory = lowMemory
 		err = wfile.Debug.ParseDwarfLineNumbers()
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
+	}
 
-		fmt.Printf("Parsing dwarf local variables...\n")
+	if config_parse_dwarf {
+
+		fmt.Fprintf(strace_log, "Parsing dwarf local variables...\n")
 		err = wfile.Debug.ParseDwarfVariables(wfile)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 	}
 
+	if len(trace_vars) > 0 && !config_parse_dwarf {
+		fmt.Fprintf(strace_log, "Parsing dwarf global variables...\n")
+		wfile.Debug.ParseDwarfGlobals()
+	}
+
 	// Get watch code
-	watch_code := GetWatchCode(wfile)
+	watch_code, err := GetWatchCode(wfile)
+	if err != nil {
+		return nil, err
+	}
 
 	// Pass some config into wasm
 	if include_timings {
-		wfile.SetGlobal("$debug_do_timings", types.ValI32, fmt.Sprintf("i32.const 1"))
+		err = wfile.SetGlobal("$debug_do_timings", types.ValI32, fmt.Sprintf("i32.const 1"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if cfg_color {
-		wfile.SetGlobal("$wt_color", types.ValI32, fmt.Sprintf("i32.const 1"))
+		err = wfile.SetGlobal("$wt_color", types.ValI32, fmt.Sprintf("i32.const 1"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if max_depth < 0 {
+		return nil, errors.New("--max-depth can't be negative")
+	}
+	if max_depth > 0 {
+		err = wfile.SetGlobal("$wt_max_depth", types.ValI32, fmt.Sprintf("i32.const %d", max_depth))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sample_rate < 0 {
+		return nil, errors.New("--sample can't be negative")
+	}
+	if sample_rate > 0 {
+		err = wfile.SetGlobal("$wt_sample_rate", types.ValI32, fmt.Sprintf("i32.const %d", sample_rate))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if max_string_len != 32 {
+		err = wfile.SetGlobal("$wt_max_string_len", types.ValI32, fmt.Sprintf("i32.const %d", max_string_len))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Send the trace somewhere other than stderr
+	if trace_file != "" {
+		// WASI paths are relative to the preopened directory
+		wfile.AddData("$wt_trace_file_path", []byte(strings.TrimLeft(trace_file, "/")))
+	} else if trace_fd != 2 {
+		err = wfile.SetGlobal("$wt_trace_fd", types.ValI32, fmt.Sprintf("i32.const %d", trace_fd))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Get a function name map, and add it as data...
 	data_function_names := make([]byte, 0)
 	data_function_locs := make([]byte, 0)
 	data_metrics_data := make([]byte, 0)
+	// Function names escaped as Prometheus label values, for the metrics export
+	data_metrics_labels := make([]byte, 0)
+	data_metrics_label_locs := make([]byte, 0)
 	for idx := range wfile.Import {
 		functionIndex := idx
-		name := wfile.Debug.GetFunctionIdentifier(functionIndex, false)
+		name := traceString(hook, wfile.Debug.GetFunctionIdentifier(functionIndex, false))
 
 		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len(data_function_names)))
 		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len([]byte(name))))
 
 		data_function_names = append(data_function_names, []byte(name)...)
 
+		label := prometheusLabel(strings.TrimPrefix(wfile.Debug.GetFunctionIdentifier(functionIndex, false), "$"))
+		data_metrics_label_locs = binary.LittleEndian.AppendUint32(data_metrics_label_locs, uint32(len(data_metrics_labels)))
+		data_metrics_label_locs = binary.LittleEndian.AppendUint32(data_metrics_label_locs, uint32(len(label)))
+		data_metrics_labels = append(data_metrics_labels, []byte(label)...)
+
 		// Just add another 16 bytes on for now...
 		data_metrics_data = append(data_metrics_data, make([]byte, 16)...)
 	}
 
 	for idx := range wfile.Code {
 		functionIndex := len(wfile.Import) + idx
-		name := wfile.Debug.GetFunctionIdentifier(functionIndex, false)
+		name := traceString(hook, wfile.Debug.GetFunctionIdentifier(functionIndex, false))
 
 		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len(data_function_names)))
 		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len([]byte(name))))
 
 		data_function_names = append(data_function_names, []byte(name)...)
 
+		label := prometheusLabel(strings.TrimPrefix(wfile.Debug.GetFunctionIdentifier(functionIndex, false), "$"))
+		data_metrics_label_locs = binary.LittleEndian.AppendUint32(data_metrics_label_locs, uint32(len(data_metrics_labels)))
+		data_metrics_label_locs = binary.LittleEndian.AppendUint32(data_metrics_label_locs, uint32(len(label)))
+		data_metrics_labels = append(data_metrics_labels, []byte(label)...)
+
 		// Just add another 16 bytes on for now...
 		data_metrics_data = append(data_metrics_data, make([]byte, 16)...)
 	}
@@ -296,15 +521,57 @@ func runStrace(ccmd *cobra.Command, args []string) {
 	wfile.AddData("$wt_all_function_names", []byte(data_function_names))
 	wfile.AddData("$wt_all_function_names_locs", []byte(data_function_locs))
 	wfile.AddData("$metrics_data", []byte(data_metrics_data))
-	wfile.SetGlobal("$wt_all_function_length", types.ValI32, fmt.Sprintf("i32.const %d", len(wfile.Import)+len(wfile.Code)))
+	if export_metrics {
+		wfile.AddData("$metrics_labels", data_metrics_labels)
+		wfile.AddData("$metrics_labels_locs", data_metrics_label_locs)
+	}
+	err = wfile.SetGlobal("$wt_all_function_length", types.ValI32, fmt.Sprintf("i32.const %d", len(wfile.Import)+len(wfile.Code)))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(strace_log, "Patching functions matching regexp \"%s\"\n", strings.Join(func_regex, "\", \""))
+
+	includes, err := compileRegexps(func_regex)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := compileRegexps(func_exclude)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range func_files {
+		_, err = wasmfile.MatchSourcePath(g, "")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --file glob %q: %v", g, err)
+		}
+	}
 
-	fmt.Printf("Patching functions matching regexp \"%s\"\n", func_regex)
+	// Restrict to the functions containing a source line
+	var func_at_ids map[int]bool
+	if func_at != "" {
+		sep := strings.LastIndex(func_at, ":")
+		if sep == -1 {
+			return nil, fmt.Errorf("Invalid --func-at %q, expected file:line", func_at)
+		}
+		line, err := strconv.Atoi(func_at[sep+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --func-at %q, expected file:line", func_at)
+		}
+		func_at_ids = make(map[int]bool)
+		for _, fid := range wfile.FindFunctionsForLine(func_at[:sep], line) {
+			func_at_ids[fid] = true
+		}
+		if len(func_at_ids) == 0 {
+			return nil, fmt.Errorf("No code found for %s", func_at)
+		}
+	}
 
 	// Add data for memory matching...
 	data_mem_ranges := make([]byte, 0)
 	data_mem_tags := make([]byte, 0)
 
-	if config_log_memory {
+	if config_log_memory || config_log_memory_reads {
 
 		for _, r := range config_log_mem_ranges {
 			// eg "tag=<min>-<max> max is optional"
@@ -316,17 +583,17 @@ func runStrace(ccmd *cobra.Command, args []string) {
 
 			memMin, err := strconv.ParseInt(vals[0], 0, 32)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 			memMax := int64(0xffffffff)
 			if len(vals) == 2 && vals[1] != "" {
 				memMax, err = strconv.ParseInt(vals[1], 0, 32)
 				if err != nil {
-					panic(err)
+					return nil, err
 				}
 			}
 
-			fmt.Printf("Adding memory watch for %s from %d -> %d\n", name, memMin, memMax)
+			fmt.Fprintf(strace_log, "Adding memory watch for %s from %d -> %d\n", name, memMin, memMax)
 
 			data_mem_ranges = binary.LittleEndian.AppendUint32(data_mem_ranges, uint32(memMin))
 			data_mem_ranges = binary.LittleEndian.AppendUint32(data_mem_ranges, uint32(memMax))
@@ -336,16 +603,85 @@ func runStrace(ccmd *cobra.Command, args []string) {
 
 		}
 
-		fmt.Printf("mem ranges %x\n", data_mem_ranges)
+		fmt.Fprintf(strace_log, "mem ranges %x\n", data_mem_ranges)
 
 	}
 
 	wfile.AddData("$wt_mem_ranges", []byte(data_mem_ranges))
 	wfile.AddData("$wt_mem_tags", []byte(data_mem_tags))
 
+	// Add data for the watchpoints, and find the watched globals
+	data_watchpoints := make([]byte, 0)
+	data_watchpoint_tags := make([]byte, 0)
+	for _, w := range watch_addrs {
+		start, end, err := parseWatchAddr(w)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(strace_log, "Adding watchpoint for %s\n", w)
+		data_watchpoints = binary.LittleEndian.AppendUint32(data_watchpoints, start)
+		data_watchpoints = binary.LittleEndian.AppendUint32(data_watchpoints, end)
+		data_watchpoints = binary.LittleEndian.AppendUint32(data_watchpoints, uint32(len(data_watchpoint_tags)))
+		data_watchpoints = binary.LittleEndian.AppendUint32(data_watchpoints, uint32(len([]byte(w))))
+		data_watchpoint_tags = append(data_watchpoint_tags, []byte(w)...)
+	}
+	wfile.AddData("$wt_watchpoints", []byte(data_watchpoints))
+	wfile.AddData("$wt_watchpoint_tags", []byte(data_watchpoint_tags))
+
+	// Add data for the traced variables
+	if len(trace_vars) > 0 {
+		data_trace_vars := make([]byte, 0)
+		data_trace_var_labels := make([]byte, 0)
+		for _, n := range trace_vars {
+			ginfo, ok := wfile.Debug.GlobalAddresses[n]
+			if !ok {
+				return nil, fmt.Errorf("Variable %s not found in the dwarf data", n)
+			}
+			if ginfo.Size == 0 {
+				return nil, fmt.Errorf("Variable %s has an unknown size", n)
+			}
+			label := fmt.Sprintf("%s (%s)", n, ginfo.Type)
+			fmt.Fprintf(strace_log, "Tracing variable %s at address %d size %d\n", label, ginfo.Address, ginfo.Size)
+			data_trace_vars = binary.LittleEndian.AppendUint32(data_trace_vars, uint32(ginfo.Address))
+			data_trace_vars = binary.LittleEndian.AppendUint32(data_trace_vars, uint32(ginfo.Address+ginfo.Size))
+			data_trace_vars = binary.LittleEndian.AppendUint32(data_trace_vars, uint32(traceVarFormat(ginfo.Type, ginfo.Size)))
+			data_trace_vars = binary.LittleEndian.AppendUint32(data_trace_vars, uint32(len(data_trace_var_labels)))
+			data_trace_vars = binary.LittleEndian.AppendUint32(data_trace_vars, uint32(len([]byte(label))))
+			data_trace_var_labels = append(data_trace_var_labels, []byte(label)...)
+		}
+		wfile.AddData("$wt_trace_vars", data_trace_vars)
+		wfile.AddData("$wt_trace_var_labels", data_trace_var_labels)
+	}
+
+	watched_globals := make(map[int]string)
+	for _, name := range watch_wasm_globals {
+		gid := -1
+		if idx, err := strconv.Atoi(name); err == nil {
+			gid = idx
+		} else {
+			if !strings.HasPrefix(name, "$") {
+				name = "$" + name
+			}
+			gid = wfile.Debug.LookupGlobalID(name)
+		}
+		if gid < 0 || gid >= originalGlobalLength {
+			return nil, fmt.Errorf("Global %s not found", name)
+		}
+		watched_globals[gid] = wfile.Debug.GetGlobalIdentifier(gid, false)
+	}
+
+	// Add the function in each table slot, so call_indirect targets can be shown
+	if include_indirect {
+		data_indirect_table := make([]byte, 0)
+		for _, fid := range wfile.TableFunctions() {
+			data_indirect_table = binary.LittleEndian.AppendUint32(data_indirect_table, uint32(fid))
+		}
+		wfile.AddData("$wt_indirect_table", data_indirect_table)
+	}
+
 	// Adjust any memory.size / memory.grow calls
 	for idx, c := range wfile.Code {
-		fmt.Printf("Processing functions [%d/%d]\n", idx, len(wfile.Code))
+		fmt.Fprintf(strace_log, "Processing functions [%d/%d]\n", idx, len(wfile.Code))
 
 		fn := wfile.Function[idx]
 		functionType := wfile.Type[fn.TypeIndex]
@@ -353,28 +689,42 @@ func runStrace(ccmd *cobra.Command, args []string) {
 		if idx < originalFunctionLength {
 			err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 			err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 
 			functionIndex := idx + len(wfile.Import)
 			fidentifier := wfile.Debug.GetFunctionIdentifier(functionIndex, false)
 
-			match, err := regexp.MatchString(func_regex, fidentifier)
-			if err != nil {
-				panic(err)
+			// Watchpoints and traced variables are checked in every function, not just the traced ones
+			if len(watch_addrs) > 0 || len(watched_globals) > 0 {
+				c.Expression, err = addWatchpoints(wfile, c, fidentifier, watched_globals)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if len(trace_vars) > 0 {
+				c.Expression, err = addTraceVars(wfile, c, fidentifier)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			match := matchFunction(wfile, functionIndex, includes, excludes)
+			if func_at_ids != nil && !func_at_ids[functionIndex] {
+				match = false
 			}
 
 			if match {
-				fmt.Printf("Patching function[%d] %s\n", idx, fidentifier)
+				fmt.Fprintf(strace_log, "Patching function[%d] %s\n", idx, fidentifier)
 				// If it's a wasi call, then output some detail here...
 				wasi_name, is_wasi := wasi_functions[functionIndex]
 
 				if is_wasi {
-					fmt.Printf(" (Wasi call to %s)\n", wasi_name)
+					fmt.Fprintf(strace_log, " (Wasi call to %s)\n", wasi_name)
 				}
 
 				blockInstr := "block"
@@ -384,17 +734,28 @@ func runStrace(ccmd *cobra.Command, args []string) {
 					blockInstr = fmt.Sprintf("block (result %s)", types.ByteToValType[t.Result[0]])
 				}
 
-				startCode := fmt.Sprintf(`%s
+				startCode := blockInstr
+				if trace_file != "" {
+					startCode = fmt.Sprintf(`%s
+			call $wt_trace_file_open`, startCode)
+				}
+
+				if sample_rate > 0 {
+					startCode = fmt.Sprintf(`%s
+			call $wt_sample_enter`, startCode)
+				}
+
+				startCode = fmt.Sprintf(`%s
 			i32.const %d
-			call $debug_enter_func
-			`, blockInstr, functionIndex)
+			call $%s_enter_func
+			`, startCode, functionIndex, hook)
 
 				// Do parameters...
 				for paramIndex, pt := range t.Param {
 					if paramIndex > 0 {
 						startCode = fmt.Sprintf(`%s
-					call $debug_param_separator
-					`, startCode)
+					call $%s_param_separator
+					`, startCode, hook)
 					}
 
 					// NB This assumes CodeSectionPtr to be correct...
@@ -402,12 +763,12 @@ func runStrace(ccmd *cobra.Command, args []string) {
 						if c.PCValid {
 							vname := wfile.Debug.GetLocalVarName(c.CodeSectionPtr, paramIndex)
 							if vname != "" {
-								wfile.AddData(fmt.Sprintf("$dd_param_name_%d_%d", functionIndex, paramIndex), []byte(vname))
+								wfile.AddData(fmt.Sprintf("$dd_param_name_%d_%d", functionIndex, paramIndex), []byte(traceString(hook, vname)))
 								startCode = fmt.Sprintf(`%s
 					i32.const offset($dd_param_name_%d_%d)
 					i32.const length($dd_param_name_%d_%d)
-					call $debug_param_name
-					`, startCode, functionIndex, paramIndex, functionIndex, paramIndex)
+					call $%s_param_name
+					`, startCode, functionIndex, paramIndex, functionIndex, paramIndex, hook)
 							}
 						}
 					}
@@ -415,40 +776,49 @@ func runStrace(ccmd *cobra.Command, args []string) {
 					i32.const %d
 					i32.const %d
 					local.get %d
-					call $debug_enter_%s
-					`, startCode, functionIndex, paramIndex, paramIndex, types.ByteToValType[pt])
+					call $%s_enter_%s
+					`, startCode, functionIndex, paramIndex, paramIndex, hook, types.ByteToValType[pt])
+
+					// Show what the param points to, if dwarf tells us
+					if config_parse_dwarf && hook == "debug" && c.PCValid && pt == types.ValI32 {
+						ty := wfile.Debug.GetLocalVarDwarfType(c.CodeSectionPtr, paramIndex)
+						startCode = fmt.Sprintf(`%s
+					%s`, startCode, wasm.GetTypedParamCode(wfile, ty, paramIndex, fmt.Sprintf("$dd_param_typed_%d_%d", functionIndex, paramIndex)))
+					}
 				}
 
 				startCode = fmt.Sprintf(`%s
 					i32.const %d
-					call $debug_enter_end
-					`, startCode, functionIndex)
+					call $%s_enter_end
+					`, startCode, functionIndex, hook)
 
 				// Now add a bit of debug....
 				funcSig := wfile.Debug.GetFunctionSignature(functionIndex)
 				if funcSig != "" && (include_all || include_func_signatures) {
-					wfile.AddData(fmt.Sprintf("$dd_function_debug_sig_%d", functionIndex), []byte(funcSig))
+					wfile.AddData(fmt.Sprintf("$dd_function_debug_sig_%d", functionIndex), []byte(traceString(hook, funcSig)))
 					startCode = fmt.Sprintf(`%s
 					i32.const offset($dd_function_debug_sig_%d)
 					i32.const length($dd_function_debug_sig_%d)
-					call $debug_func_context`, startCode, functionIndex, functionIndex)
+					call $%s_func_context`, startCode, functionIndex, functionIndex, hook)
 				}
 
 				lineRange := wfile.Debug.GetLineNumberRange(c.CodeSectionPtr, c.CodeSectionPtr+c.CodeSectionLen)
 				if lineRange != "" && (include_all || include_line_numbers) {
-					wfile.AddData(fmt.Sprintf("$dd_function_debug_lines_%d", functionIndex), []byte(lineRange))
+					wfile.AddData(fmt.Sprintf("$dd_function_debug_lines_%d", functionIndex), []byte(traceString(hook, lineRange)))
 					startCode = fmt.Sprintf(`%s
 					i32.const offset($dd_function_debug_lines_%d)
 					i32.const length($dd_function_debug_lines_%d)
-					call $debug_func_context
-					`, startCode, functionIndex, functionIndex)
+					call $%s_func_context
+					`, startCode, functionIndex, functionIndex, hook)
 				}
 
 				// Add some code to show function parameter values...
-				startCode = fmt.Sprintf(`%s
+				if hook == "debug" {
+					startCode = fmt.Sprintf(`%s
 					%s`, startCode, wasm.GetWasiParamCodeEnter(wasi_name))
+				}
 
-				if include_timings {
+				if collect_timings {
 					startCode = fmt.Sprintf(`%s
 					i32.const %d
 					call $timings_enter_func
@@ -463,7 +833,7 @@ func runStrace(ccmd *cobra.Command, args []string) {
 
 				err = c.InsertFuncStart(wfile, startCode)
 				if err != nil {
-					panic(err)
+					return nil, err
 				}
 
 				rt := types.ValNone
@@ -473,7 +843,7 @@ func runStrace(ccmd *cobra.Command, args []string) {
 
 				endCode := ""
 
-				if include_timings {
+				if collect_timings {
 					endCode = fmt.Sprintf(`%s
 					i32.const %d
 					call $timings_exit_func
@@ -482,17 +852,19 @@ func runStrace(ccmd *cobra.Command, args []string) {
 
 				endCode = fmt.Sprintf(`%s
 				i32.const %d
-				call $debug_exit_func`, endCode, functionIndex)
+				call $%s_exit_func`, endCode, functionIndex, hook)
 
 				if is_wasi && rt == types.ValI32 {
 					// We also want to output the error message
 					endCode = fmt.Sprintf(`%s
-					call $debug_exit_func_wasi
+					call $%s_exit_func_wasi`, endCode, hook)
+					if hook == "debug" {
+						endCode = fmt.Sprintf(`%s
 					%s`, endCode, wasm.GetWasiParamCodeExit(wasi_name))
-
+					}
 				} else {
 					endCode = fmt.Sprintf(`%s
-					call $debug_exit_func_%s`, endCode, types.ByteToValType[rt])
+					call $%s_exit_func_%s`, endCode, hook, types.ByteToValType[rt])
 				}
 
 				// Add any watches
@@ -501,14 +873,19 @@ func runStrace(ccmd *cobra.Command, args []string) {
 					%s`, endCode, watch_code)
 				}
 
+				if sample_rate > 0 {
+					endCode = fmt.Sprintf(`%s
+					call $wt_sample_exit`, endCode)
+				}
+
 				err = c.ReplaceInstr(wfile, "return", endCode+"\nreturn")
 				if err != nil {
-					panic(err)
+					return nil, err
 				}
 
 				err = c.InsertFuncEnd(wfile, "end\n"+endCode)
 				if err != nil {
-					panic(err)
+					return nil, err
 				}
 
 				// Add local / global logging...
@@ -536,7 +913,7 @@ func runStrace(ccmd *cobra.Command, args []string) {
 
 							wcex, err := expression.ExpressionFromWat(wcode)
 							if err != nil {
-								panic(err)
+								return nil, err
 							}
 							newCode = append(newCode, wcex...)
 
@@ -572,7 +949,7 @@ func runStrace(ccmd *cobra.Command, args []string) {
 
 							wcex, err := expression.ExpressionFromWat(wcode)
 							if err != nil {
-								panic(err)
+								return nil, err
 							}
 							newCode = append(newCode, wcex...)
 
@@ -621,6 +998,19 @@ func runStrace(ccmd *cobra.Command, args []string) {
 								call $log_mem_i32.store
 								global.get $log_memory_value_i32
 								`, e.MemOffset, e.PC, e.PC)
+						} else if e.Opcode == expression.InstrToOpcode["f32.store"] {
+							debugPrefix = "f32.store"
+							wcode = fmt.Sprintf(`
+								i32.reinterpret_f32
+								global.set $log_memory_value_i32
+								i32.const %d
+								i32.const 32
+								i32.const offset($dd_memory_set_%d)
+								i32.const length($dd_memory_set_%d)
+								call $log_mem_i32.store
+								global.get $log_memory_value_i32
+								f32.reinterpret_i32
+								`, e.MemOffset, e.PC, e.PC)
 						}
 
 						if e.Opcode == expression.InstrToOpcode["i64.store"] {
@@ -667,6 +1057,19 @@ func runStrace(ccmd *cobra.Command, args []string) {
 								call $log_mem_i64.store
 								global.get $log_memory_value_i64
 								`, e.MemOffset, e.PC, e.PC)
+						} else if e.Opcode == expression.InstrToOpcode["f64.store"] {
+							debugPrefix = "f64.store"
+							wcode = fmt.Sprintf(`
+								i64.reinterpret_f64
+								global.set $log_memory_value_i64
+								i32.const %d
+								i32.const 64
+								i32.const offset($dd_memory_set_%d)
+								i32.const length($dd_memory_set_%d)
+								call $log_mem_i64.store
+								global.get $log_memory_value_i64
+								f64.reinterpret_i64
+								`, e.MemOffset, e.PC, e.PC)
 						}
 
 						if wcode != "" {
@@ -676,15 +1079,92 @@ func runStrace(ccmd *cobra.Command, args []string) {
 
 							wcex, err := expression.ExpressionFromWat(wcode)
 							if err != nil {
-								panic(err)
+								return nil, err
+							}
+							newCode = append(newCode, wcex...)
+						}
+
+						newCode = append(newCode, e)
+					}
+					c.Expression = newCode
+				}
+
+				// Add memory read logging. The address is logged, along with the value about to be read.
+				if config_log_memory_reads {
+					newCode := make([]*expression.Expression, 0)
+					for _, e := range c.Expression {
+						load, ok := memoryLoads[e.Opcode]
+						if ok {
+							linei := wfile.Debug.GetLineNumberBefore(c.CodeSectionPtr, e.PC)
+							mdebug := fmt.Sprintf(" %s %s:%x %s", load.name, fidentifier, e.PC, linei)
+							wfile.AddData(fmt.Sprintf("$dd_memory_get_%d", e.PC), []byte(mdebug))
+
+							wcode := fmt.Sprintf(`
+								i32.const %d
+								i32.const %d
+								i32.const offset($dd_memory_get_%d)
+								i32.const length($dd_memory_get_%d)
+								call $log_mem_%s.load
+								`, e.MemOffset, load.size, e.PC, e.PC, load.valType)
+
+							wcex, err := expression.ExpressionFromWat(wcode)
+							if err != nil {
+								return nil, err
+							}
+							newCode = append(newCode, wcex...)
+						}
+						newCode = append(newCode, e)
+					}
+					c.Expression = newCode
+				}
+
+				// Add branch logging. The condition is checked before br_if / if uses it.
+				if include_branches {
+					newCode := make([]*expression.Expression, 0)
+					for _, e := range c.Expression {
+						if e.Opcode == expression.InstrToOpcode["br_if"] || e.Opcode == expression.InstrToOpcode["if"] {
+							instr := "if"
+							if e.Opcode == expression.InstrToOpcode["br_if"] {
+								instr = "br_if"
+							}
+							linei := wfile.Debug.GetLineNumberBefore(c.CodeSectionPtr, e.PC)
+							bdebug := fmt.Sprintf("%s %s:%x %s", instr, fidentifier, e.PC, linei)
+							wfile.AddData(fmt.Sprintf("$dd_branch_%d", e.PC), []byte(bdebug))
+
+							wcex, err := expression.ExpressionFromWat(fmt.Sprintf(`
+								i32.const offset($dd_branch_%d)
+								i32.const length($dd_branch_%d)
+								call $debug_branch
+								`, e.PC, e.PC))
+							if err != nil {
+								return nil, err
 							}
 							newCode = append(newCode, wcex...)
 						}
+						newCode = append(newCode, e)
+					}
+					c.Expression = newCode
+				}
 
-						/*
-							e.Opcode == InstrToOpcode["f32.store"] ||
-							e.Opcode == InstrToOpcode["f64.store"] ||
-						*/
+				// Add call_indirect logging. The table index is logged along with the function in that slot.
+				if include_indirect {
+					newCode := make([]*expression.Expression, 0)
+					for _, e := range c.Expression {
+						if e.Opcode == expression.InstrToOpcode["call_indirect"] {
+							linei := wfile.Debug.GetLineNumberBefore(c.CodeSectionPtr, e.PC)
+							idebug := fmt.Sprintf("call_indirect %s:%x %s", fidentifier, e.PC, linei)
+							wfile.AddData(fmt.Sprintf("$dd_call_indirect_%d", e.PC), []byte(idebug))
+
+							wcex, err := expression.ExpressionFromWat(fmt.Sprintf(`
+								i32.const offset($dd_call_indirect_%d)
+								i32.const length($dd_call_indirect_%d)
+								call $debug_call_indirect
+								`, e.PC, e.PC))
+							if err != nil {
+								return nil, err
+							}
+							newCode = append(newCode, wcex...)
+						}
 						newCode = append(newCode, e)
 					}
 					c.Expression = newCode
@@ -695,30 +1175,35 @@ func runStrace(ccmd *cobra.Command, args []string) {
 		err = c.InsertAfterRelocating(wfile, `global.get $debug_start_mem
 		i32.add`)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		err = c.ResolveLengths(wfile)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		err = c.ResolveRelocations(wfile, data_ptr)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		err = c.ResolveGlobals(wfile)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		err = c.ResolveFunctions(wfile)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
 
+	// Untraced import wrappers are still small, so they can be inlined
+	if inline_max_size > 0 {
+		fmt.Fprintf(strace_log, "Inlined %d calls\n", inline.InlineFunctions(wfile, inline_max_size))
+	}
+
 	// Find out how much data we need for the payload
 	total_payload_data := data_ptr
 	if len(wfile.Data) > 0 {
@@ -726,52 +1211,31 @@ func runStrace(ccmd *cobra.Command, args []string) {
 		total_payload_data = int(last_data.Offset[0].I32Value) + len(last_data.Data) - data_ptr
 	}
 
-	payload_size := (total_payload_data + 65535) >> 16
-	fmt.Printf("Payload data of %d (%d pages)\n", total_payload_data, payload_size)
-
-	wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
-	wfile.Memory[0].LimitMin = wfile.Memory[0].LimitMin + payload_size
-
-	fmt.Printf("Writing wasm out to %s...\n", Output)
-	f, err := os.Create(Output)
-	if err != nil {
-		panic(err)
+	// Timing histograms go after the data, so they don't need to be in the file
+	if collect_timings {
+		histograms_rel := (total_payload_data + 7) &^ 7
+		err = wfile.SetGlobal("$metrics_histograms_rel", types.ValI32, fmt.Sprintf("i32.const %d", histograms_rel))
+		if err != nil {
+			return nil, err
+		}
+		total_payload_data = histograms_rel + (len(wfile.Import)+len(wfile.Code))*timing_histogram_size
 	}
 
-	err = wfile.EncodeBinary(f)
-	if err != nil {
-		panic(err)
-	}
+	payload_size := (total_payload_data + 65535) >> 16
+	fmt.Fprintf(strace_log, "Payload data of %d (%d pages)\n", total_payload_data, payload_size)
 
-	err = f.Close()
+	err = wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	/*
-	   fmt.Printf("Writing debug.wat\n")
-	   f2, err := os.Create("debug.wat")
-
-	   	if err != nil {
-	   		panic(err)
-	   	}
-
-	   err = wfile.EncodeWat(f2)
-
-	   	if err != nil {
-	   		panic(err)
-	   	}
-
-	   err = f2.Close()
+	wfile.Memory[0].LimitMin = wfile.Memory[0].LimitMin + payload_size
 
-	   	if err != nil {
-	   		panic(err)
-	   	}
-	*/
+	return wfile, nil
 }
 
-func GetWatchCode(wf *wasmfile.WasmFile) string {
+func GetWatchCode(wf *wasmfile.WasmFile) (string, error) {
 	if watch_globals == "" {
-		return ""
+		return "", nil
 	}
 
 	code := ""
@@ -780,11 +1244,11 @@ func GetWatchCode(wf *wasmfile.WasmFile) string {
 		// Lookup the address...
 		ginfo, ok := wf.Debug.GlobalAddresses[w]
 		if !ok {
-			fmt.Printf("WARNING: I can't find the global %s\n", w)
+			fmt.Fprintf(strace_log, "WARNING: I can't find the global %s\n", w)
 			for n := range wf.Debug.GlobalAddresses {
-				fmt.Printf(" - Global %s\n", n)
+				fmt.Fprintf(strace_log, " - Global %s\n", n)
 			}
-			panic("Global name not found")
+			return "", fmt.Errorf("Global name %s not found", w)
 		} else {
 			// Insert some code to show global...
 			wf.AddData(fmt.Sprintf("$watch_name_%d", widx), []byte(w))
@@ -797,5 +1261,253 @@ func GetWatchCode(wf *wasmfile.WasmFile) string {
 			`, code, widx, widx, uint32(ginfo.Address))
 		}
 	}
-	return code
+	return code, nil
+}
+
+// Strings shown in json or chrome trace output need escaping, as the wat code prints them as they are
+func traceString(hook string, s string) string {
+	if hook != "json" && hook != "chrome" {
+		return s
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return s
+	}
+	return string(data[1 : len(data)-1])
+}
+
+// Escape a label value for the Prometheus text format
+func prometheusLabel(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	return strings.ReplaceAll(s, "\n", "\\n")
+}
+
+// Size of each function's timing histogram (see timings.wat)
+const timing_histogram_size = 208
+
+// Memory load instructions, with the size read and the type used to log the value
+var memoryLoads = map[expression.Opcode]struct {
+	name    string
+	size    int
+	valType string
+}{
+	expression.InstrToOpcode["i32.load"]:     {"i32.load", 32, "i32"},
+	expression.InstrToOpcode["i32.load8_s"]:  {"i32.load8_s", 8, "i32"},
+	expression.InstrToOpcode["i32.load8_u"]:  {"i32.load8_u", 8, "i32"},
+	expression.InstrToOpcode["i32.load16_s"]: {"i32.load16_s", 16, "i32"},
+	expression.InstrToOpcode["i32.load16_u"]: {"i32.load16_u", 16, "i32"},
+	expression.InstrToOpcode["f32.load"]:     {"f32.load", 32, "i32"},
+	expression.InstrToOpcode["i64.load"]:     {"i64.load", 64, "i64"},
+	expression.InstrToOpcode["i64.load8_s"]:  {"i64.load8_s", 8, "i64"},
+	expression.InstrToOpcode["i64.load8_u"]:  {"i64.load8_u", 8, "i64"},
+	expression.InstrToOpcode["i64.load16_s"]: {"i64.load16_s", 16, "i64"},
+	expression.InstrToOpcode["i64.load16_u"]: {"i64.load16_u", 16, "i64"},
+	expression.InstrToOpcode["i64.load32_s"]: {"i64.load32_s", 32, "i64"},
+	expression.InstrToOpcode["i64.load32_u"]: {"i64.load32_u", 32, "i64"},
+	expression.InstrToOpcode["f64.load"]:     {"f64.load", 64, "i64"},
+}
+
+// Memory store instructions, with the size written and how to log the value
+var memoryStores = map[expression.Opcode]struct {
+	name    string
+	size    int
+	valType string
+	toInt   string // Reinterpret the value as an int
+	fromInt string
+}{
+	expression.InstrToOpcode["i32.store"]:   {"i32.store", 32, "i32", "", ""},
+	expression.InstrToOpcode["i32.store8"]:  {"i32.store8", 8, "i32", "", ""},
+	expression.InstrToOpcode["i32.store16"]: {"i32.store16", 16, "i32", "", ""},
+	expression.InstrToOpcode["f32.store"]:   {"f32.store", 32, "i32", "i32.reinterpret_f32", "f32.reinterpret_i32"},
+	expression.InstrToOpcode["i64.store"]:   {"i64.store", 64, "i64", "", ""},
+	expression.InstrToOpcode["i64.store8"]:  {"i64.store8", 8, "i64", "", ""},
+	expression.InstrToOpcode["i64.store16"]: {"i64.store16", 16, "i64", "", ""},
+	expression.InstrToOpcode["i64.store32"]: {"i64.store32", 32, "i64", "", ""},
+	expression.InstrToOpcode["f64.store"]:   {"f64.store", 64, "i64", "i64.reinterpret_f64", "f64.reinterpret_i64"},
+}
+
+// Parse a watchpoint 'addr:len' into a start and end address
+func parseWatchAddr(w string) (uint32, uint32, error) {
+	bits := strings.Split(w, ":")
+	if len(bits) != 2 {
+		return 0, 0, fmt.Errorf("Invalid --watch-addr %q, expected addr:len", w)
+	}
+	start, err := strconv.ParseUint(bits[0], 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid --watch-addr %q, expected addr:len", w)
+	}
+	length, err := strconv.ParseUint(bits[1], 0, 32)
+	if err != nil || length == 0 || start+length > 0x100000000 {
+		return 0, 0, fmt.Errorf("Invalid --watch-addr %q, expected addr:len", w)
+	}
+	return uint32(start), uint32(start + length), nil
+}
+
+// Check every store against the watchpoints, and log every global.set of a watched global
+func addWatchpoints(wfile *wasmfile.WasmFile, c *wasmfile.CodeEntry, fidentifier string, watched_globals map[int]string) ([]*expression.Expression, error) {
+	newCode := make([]*expression.Expression, 0)
+	for _, e := range c.Expression {
+		wcode := ""
+		store, is_store := memoryStores[e.Opcode]
+		if is_store && len(watch_addrs) > 0 {
+			linei := wfile.Debug.GetLineNumberBefore(c.CodeSectionPtr, e.PC)
+			wdebug := fmt.Sprintf(" %s %s:%x %s", store.name, fidentifier, e.PC, linei)
+			wfile.AddData(fmt.Sprintf("$dd_watch_memory_%d", e.PC), []byte(wdebug))
+
+			wcode = fmt.Sprintf(`%s
+				global.set $watchpoint_value_%s
+				i32.const %d
+				i32.const %d
+				i32.const offset($dd_watch_memory_%d)
+				i32.const length($dd_watch_memory_%d)
+				call $watchpoint_%s.store
+				global.get $watchpoint_value_%s
+				%s
+				`, store.toInt, store.valType, e.MemOffset, store.size, e.PC, e.PC, store.valType, store.valType, store.fromInt)
+		} else if e.Opcode == expression.InstrToOpcode["global.set"] && !e.GlobalNeedsLinking {
+			name, ok := watched_globals[e.GlobalIndex]
+			if ok {
+				g := wfile.Global[e.GlobalIndex]
+				linei := wfile.Debug.GetLineNumberBefore(c.CodeSectionPtr, e.PC)
+				gdebug := fmt.Sprintf("global.set %s:%x %s | %s", fidentifier, e.PC, linei, name)
+				wfile.AddData(fmt.Sprintf("$dd_watch_global_%d", e.PC), []byte(gdebug))
+
+				// $log_global_<TYPE> (new_value, current_value, ptr_debug, len_debug) => new_value
+				wcode = fmt.Sprintf(`
+					global.get %d
+					i32.const offset($dd_watch_global_%d)
+					i32.const length($dd_watch_global_%d)
+					call $log_global_%s
+					`, e.GlobalIndex, e.PC, e.PC, types.ByteToValType[g.Type])
+			}
+		}
+
+		if wcode != "" {
+			wcex, err := expression.ExpressionFromWat(wcode)
+			if err != nil {
+				return nil, err
+			}
+			newCode = append(newCode, wcex...)
+		}
+		newCode = append(newCode, e)
+	}
+	return newCode, nil
+}
+
+// How the value of a traced variable is shown (see tracevar.wat)
+const (
+	traceVarBytes = iota
+	traceVarSigned
+	traceVarUnsigned
+	traceVarBool
+	traceVarHex
+)
+
+// Pick how to show a traced variable from its dwarf type name. Floats are shown in hex.
+func traceVarFormat(vtype string, size uint64) int {
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		return traceVarBytes
+	}
+	t := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(vtype, "const "), "volatile "), "_t")
+	isNumbered := func(prefix string) bool {
+		return strings.HasPrefix(t, prefix) && strings.Trim(t[len(prefix):], "0123456789") == ""
+	}
+
+	switch {
+	case strings.Contains(t, "*") || strings.HasPrefix(t, "&"):
+		return traceVarHex
+	case t == "bool" || t == "_Bool":
+		return traceVarBool
+	case strings.Contains(t, "float") || strings.Contains(t, "double") || isNumbered("f"):
+		return traceVarHex
+	case strings.Contains(t, "unsigned") || isNumbered("uint") || isNumbered("u") || t == "usize" || t == "size" || t == "uintptr":
+		return traceVarUnsigned
+	case strings.Contains(t, "int") || strings.Contains(t, "long") || strings.Contains(t, "short") || strings.Contains(t, "char") || isNumbered("i") || t == "isize":
+		return traceVarSigned
+	}
+	return traceVarHex
+}
+
+// Show the new value of any traced variable after each store
+func addTraceVars(wfile *wasmfile.WasmFile, c *wasmfile.CodeEntry, fidentifier string) ([]*expression.Expression, error) {
+	newCode := make([]*expression.Expression, 0)
+	for _, e := range c.Expression {
+		store, is_store := memoryStores[e.Opcode]
+		if !is_store {
+			newCode = append(newCode, e)
+			continue
+		}
+		linei := wfile.Debug.GetLineNumberBefore(c.CodeSectionPtr, e.PC)
+		tdebug := fmt.Sprintf(" | %s %s:%x %s", store.name, fidentifier, e.PC, linei)
+		wfile.AddData(fmt.Sprintf("$dd_trace_var_%d", e.PC), []byte(tdebug))
+
+		before, err := expression.ExpressionFromWat(fmt.Sprintf(`%s
+			global.set $tracevar_value_%s
+			i32.const %d
+			i32.const %d
+			call $tracevar_before
+			global.get $tracevar_value_%s
+			%s
+			`, store.toInt, store.valType, e.MemOffset, store.size, store.valType, store.fromInt))
+		if err != nil {
+			return nil, err
+		}
+		after, err := expression.ExpressionFromWat(fmt.Sprintf(`
+			i32.const offset($dd_trace_var_%d)
+			i32.const length($dd_trace_var_%d)
+			call $tracevar_after
+			`, e.PC, e.PC))
+		if err != nil {
+			return nil, err
+		}
+		newCode = append(newCode, before...)
+		newCode = append(newCode, e)
+		newCode = append(newCode, after...)
+	}
+	return newCode, nil
+}
+
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0)
+	for _, e := range exprs {
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// See if a function should be traced, using its names and source files
+func matchFunction(wfile *wasmfile.WasmFile, fid int, includes []*regexp.Regexp, excludes []*regexp.Regexp) bool {
+	names := wfile.Debug.GetFunctionMatchNames(fid)
+	matchAny := func(res []*regexp.Regexp) bool {
+		for _, re := range res {
+			for _, n := range names {
+				if re.MatchString(n) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if !matchAny(includes) || matchAny(excludes) {
+		return false
+	}
+
+	if len(func_files) > 0 {
+		for _, f := range wfile.GetFunctionSourceFiles(fid) {
+			for _, g := range func_files {
+				match, _ := wasmfile.MatchSourcePath(g, f)
+				if match {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
 }
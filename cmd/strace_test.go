@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func TestStraceJSON(t *testing.T) {
+	out := instrument(t, wasiProgram("print hi\n"), "strace", "--format", "json", "--func", "^\\$(_start|print)$")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "hi\n", stdout)
+
+	type param struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	type event struct {
+		Event    string  `json:"event"`
+		Function string  `json:"function"`
+		Depth    int     `json:"depth"`
+		Params   []param `json:"params"`
+		Duration *int64  `json:"duration_ns"`
+	}
+	events := make([]event, 0)
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		var e event
+		assert.NoError(t, json.Unmarshal([]byte(line), &e), line)
+		events = append(events, e)
+	}
+	assert.Equal(t, 4, len(events))
+	assert.Equal(t, event{Event: "enter", Function: "$_start", Depth: 0, Params: []param{}}, events[0])
+	assert.Equal(t, event{Event: "enter", Function: "$print", Depth: 1, Params: []param{{"i32", "0x00000400"}, {"i32", "0x00000003"}}}, events[1])
+	assert.Equal(t, "exit", events[2].Event)
+	assert.Equal(t, "$print", events[2].Function)
+	assert.NotNil(t, events[2].Duration)
+	assert.Equal(t, "exit", events[3].Event)
+	assert.Equal(t, "$_start", events[3].Function)
+}
+
+func TestStraceOutput(t *testing.T) {
+	trace := "-> $_start()\r\n  -> $print(i32:00000400, i32:00000003)\r\n  <- $print\r\n<- $_start\r\n"
+
+	out := instrument(t, wasiProgram("print hi\n"), "strace", "--func", "^\\$(_start|print)$", "--trace-fd", "1")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, strings.Replace(trace, "\r\n  <- $print", "\r\nhi\n  <- $print", 1), stdout)
+	assert.Equal(t, "", stderr)
+
+	dir := t.TempDir()
+	out = instrument(t, wasiProgram("print hi\n"), "strace", "--func", "^\\$(_start|print)$", "--trace-file", "/logs/trace.log")
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "logs"), 0777))
+	stdout, stderr = runWasi(t, out, wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(dir, "/")))
+	assert.Equal(t, "hi\n", stdout)
+	assert.Equal(t, "", stderr)
+	data, err := os.ReadFile(filepath.Join(dir, "logs", "trace.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, trace, string(data))
+}
+
+func TestStraceMaxDepth(t *testing.T) {
+	out := instrument(t, wasiProgram("print hi\n"), "strace", "--func", "^\\$(_start|print|print_num)$", "--max-depth", "1")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "hi\n", stdout)
+	assert.Equal(t, "-> $_start()\r\n<- $_start\r\n", stderr)
+
+	out = instrument(t, wasiProgram("print hi\n"), "strace", "--func", "^\\$(_start|print|print_num)$", "--max-depth", "2")
+	_, stderr = runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "-> $_start()\r\n  -> $print(i32:00000400, i32:00000003)\r\n  <- $print\r\n<- $_start\r\n", stderr)
+}
+
+func TestStraceWasiArgs(t *testing.T) {
+	dir := hostFiles(t, "a.txt:Hello\x01\n")
+	out := instrument(t, wasiProgram("cat 3 a.txt", "prestat 3", "print hi\n"), "strace", "--all", "--imports")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(dir, "/")))
+	assert.Equal(t, "Hello\x01\n/\nhi\n", stdout)
+	assert.Contains(t, stderr, "   path = \"a.txt\"\r\n")
+	assert.Contains(t, stderr, " =>path = \"/\"\r\n")
+	assert.Contains(t, stderr, "=>data = \"Hello\\x01\\n\"")
+	assert.Contains(t, stderr, "   data = \"hi\\n\"")
+}
+
+func TestStraceLogMemory(t *testing.T) {
+	dir := hostFiles(t, "a.txt:Hello A")
+	out := instrument(t, wasiProgram("cat 3 a.txt"), "strace", "--func", "^\\$(print|dump)$", "--logmemory", "--logmemoryreads")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(dir, "/")))
+	assert.Equal(t, "Hello A", stdout)
+	assert.Contains(t, stderr, "MEMORY memory i32.store $print:7  | 00000010 value 00000000=>00001000\r\n")
+	assert.Contains(t, stderr, "MEMORY memory i32.store $dump:aa  | 00000004 value 00001000=>00001000\r\n")
+	assert.Contains(t, stderr, "MEMORY memory i32.load $dump:c0  | 00000008 read 00000007\r\n")
+	assert.Contains(t, stderr, "MEMORY memory i32.load $dump:c0  | 00000008 read 00000000\r\n")
+}
+
+func TestStraceTiming(t *testing.T) {
+	out := instrument(t, wasiProgram("print hi\n", "print hi\n", "exit 0"), "strace", "--imports", "--func", "^\\$(_start|print|IMPORT_wasi_snapshot_preview1_proc_exit)$", "--timing")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "hi\nhi\n", stdout)
+	// wazero's default clock steps 1ms every time it's read
+	assert.Contains(t, stderr, "-- Summary of execution --")
+	assert.Contains(t, stderr, "| Min (ns)     | P50 (ns)     | P99 (ns)     | Max (ns)     |")
+	assert.Contains(t, stderr, "         2 |             2000000 |      1000000 |      1000000 |      1000000 |      1000000 | $print")
+}
+
+func TestStraceExportStats(t *testing.T) {
+	out := instrument(t, wasiProgram("print hi\n", "print hi\n"), "strace", "--func", "^\\$(_start|print)$", "--export-stats")
+
+	ctx, r := testutil.Runtime(t)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	mod, err := r.Instantiate(ctx, out)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The module is still live after _start, so the host can ask for the stats
+	res, err := mod.ExportedFunction("__wasm_toolkit_stats").Call(ctx, 0x8000, 0x1000)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, ok := mod.Memory().Read(0x8000, uint32(res[0]))
+	assert.True(t, ok)
+
+	stats := make(map[string][]uint64)
+	for len(data) > 0 {
+		nameLen := binary.LittleEndian.Uint32(data[48:])
+		stats[string(data[52:52+nameLen])] = []uint64{
+			uint64(binary.LittleEndian.Uint32(data[4:])),
+			binary.LittleEndian.Uint64(data[8:]),
+			binary.LittleEndian.Uint64(data[16:]),
+			binary.LittleEndian.Uint64(data[40:]),
+		}
+		data = data[52+nameLen:]
+	}
+	// wazero's default clock steps 1ms every time it's read
+	assert.Equal(t, map[string][]uint64{
+		"$print":  {2, 2000000, 1000000, 1000000},
+		"$_start": {1, 5000000, 5000000, 5000000},
+	}, stats)
+
+	// Entries that don't fit aren't written
+	res, err = mod.ExportedFunction("__wasm_toolkit_stats").Call(ctx, 0x8000, 60)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{52 + 6}, res)
+	res, err = mod.ExportedFunction("__wasm_toolkit_stats").Call(ctx, 0x8000, 57)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0}, res)
+}
+
+func TestStraceWatch(t *testing.T) {
+	out := instrument(t, wasiProgram("print hi\n", "print ho\n"), "strace", "--func", "^\\$_start$", "--watch-addr", "20:4")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "hi\nho\n", stdout)
+	assert.Equal(t, "-> $_start()\r\n"+
+		"WATCH 20:4 i32.store $print:e  | 00000014 value 00000000=>00000003\r\n"+
+		"WATCH 20:4 i32.store $print:e  | 00000014 value 00000003=>00000003\r\n"+
+		"<- $_start\r\n", stderr)
+
+	out = instrument(t, `(module
+  (func $count
+    global.get $counter
+    i32.const 1
+    i32.add
+    global.set $counter
+  )
+  (func $_start
+    call $count
+    call $count
+  )
+  (memory 1)
+  (global $counter (mut i32) (i32.const 5))
+  (export "memory" (memory 0))
+  (export "_start" (func $_start))
+)`, "strace", "--func", "^\\$_start$", "--watch-global", "$counter")
+	_, stderr = runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "-> $_start()\r\n"+
+		"GLOBAL global.set $count:8  | $counter value 00000005=>00000006\r\n"+
+		"GLOBAL global.set $count:8  | $counter value 00000006=>00000007\r\n"+
+		"<- $_start\r\n", stderr)
+}
+
+func TestStraceTraceVar(t *testing.T) {
+	wf := testutil.ModuleWithDebug(t, `(module
+  (func $bump
+    i32.const 0x100
+    i32.const 0x100
+    i32.load
+    i32.const 1
+    i32.add
+    i32.store
+  )
+  (func $_start
+    i32.const 0x100
+    i32.const 41
+    i32.store
+    i32.const 0x104
+    i32.const 5
+    i32.store
+    call $bump
+  )
+  (memory 1)
+  (export "memory" (memory 0))
+  (export "_start" (func $_start))
+)`)
+
+	addDwarfVar(wf, "counter", 0x100)
+
+	out := instrumentWasm(t, testutil.Encode(t, wf), "strace", "--func", "^\\$_start$", "--trace-var", "counter")
+	_, stderr := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "-> $_start()\r\n"+
+		"VAR counter (int) = 41 | i32.store $_start:1a \r\n"+
+		"VAR counter (int) = 42 | i32.store $bump:f \r\n"+
+		"<- $_start\r\n", stderr)
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.wasm")
+	assert.NoError(t, os.WriteFile(in, testutil.Encode(t, wf), 0666))
+	err := toolkit(t, "strace", "--trace-var", "missing", "-i", in, "-o", filepath.Join(dir, "out.wasm"))
+	assert.EqualError(t, err, "Variable missing not found in the dwarf data")
+}
+
+func TestStraceBranches(t *testing.T) {
+	dir := hostFiles(t, "a.txt:Hello A")
+	out := instrument(t, wasiProgram("cat 3 a.txt", "cat 3 b.txt"), "strace", "--func", "^\\$(print_num|check)$", "--branches")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig().WithFSConfig(wazero.NewFSConfig().WithDirMount(dir, "/")))
+	assert.Equal(t, "Hello Aerror 44\n", stdout)
+	assert.Equal(t, strings.Repeat("-> $check(i32:00000000)\r\n  if $check:61  | not taken\r\n<- $check => i32:00000000\r\n", 3)+
+		"-> $check(i32:0000002c)\r\n"+
+		"  if $check:61  | taken\r\n"+
+		"  -> $print_num(i64:000000000000002c)\r\n"+
+		"    br_if $print_num:45  | taken\r\n"+
+		"    br_if $print_num:45  | not taken\r\n"+
+		"  <- $print_num\r\n"+
+		"<- $check => i32:0000002c\r\n", stderr)
+}
+
+func TestStraceSample(t *testing.T) {
+	out := instrument(t, wasiProgram("print a\n", "print b\n", "print c\n", "print d\n"), "strace", "--func", "^\\$(_start|print)$", "--sample", "2")
+	stdout, stderr := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "a\nb\nc\nd\n", stdout)
+	// Every 2nd call is traced, starting from the 2nd
+	assert.Equal(t, "  -> $print(i32:00000400, i32:00000002)\r\n  <- $print\r\n"+
+		"  -> $print(i32:00000404, i32:00000002)\r\n  <- $print\r\n", stderr)
+
+	// The rate can be changed when it's run
+	_, stderr = runWasi(t, out, wazero.NewModuleConfig().WithEnv("WASM_TOOLKIT_SAMPLE", "1"))
+	assert.Equal(t, "-> $_start()\r\n"+
+		"  -> $print(i32:00000400, i32:00000002)\r\n  <- $print\r\n"+
+		"  -> $print(i32:00000402, i32:00000002)\r\n  <- $print\r\n"+
+		"  -> $print(i32:00000404, i32:00000002)\r\n  <- $print\r\n"+
+		"  -> $print(i32:00000406, i32:00000002)\r\n  <- $print\r\n"+
+		"<- $_start\r\n", stderr)
+}
+
+func TestStraceSockets(t *testing.T) {
+	out := instrument(t, wasiProgram("send 3"), "strace", "--imports", "--func", "sock_send")
+	_, stderr := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "-> $IMPORT_wasi_snapshot_preview1_sock_send(i32:00000003, i32:00000000, i32:00000001, i32:00000000, i32:00000008)\r\n"+
+		"   data = \"error\"\r\n"+
+		"<- $IMPORT_wasi_snapshot_preview1_sock_send => i32:00000008  WASI_EBADF\r\n"+
+		" =>bytes = 0000000000\r\n", stderr)
+}
+
+func TestStraceExportMetrics(t *testing.T) {
+	out := instrument(t, wasiProgram("print hi\n", "print hi\n"), "strace", "--func", "^\\$(_start|print)$", "--export-metrics")
+
+	ctx, r := testutil.Runtime(t)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	mod, err := r.Instantiate(ctx, out)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, err := mod.ExportedFunction("__metrics").Call(ctx, 0x8000, 0x1000)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, ok := mod.Memory().Read(0x8000, uint32(res[0]))
+	assert.True(t, ok)
+	// wazero's default clock steps 1ms every time it's read
+	summary := func(name string, ns int, count int) string {
+		return fmt.Sprintf(`wasm_function_duration_nanoseconds{function="%s",quantile="0"} %d
+wasm_function_duration_nanoseconds{function="%s",quantile="0.5"} %d
+wasm_function_duration_nanoseconds{function="%s",quantile="0.99"} %d
+wasm_function_duration_nanoseconds{function="%s",quantile="1"} %d
+wasm_function_duration_nanoseconds_sum{function="%s"} %d
+wasm_function_duration_nanoseconds_count{function="%s"} %d
+`, name, ns, name, ns, name, ns, name, ns, name, ns*count, name, count)
+	}
+	header := "# HELP wasm_function_duration_nanoseconds Time spent in calls to each function.\n" +
+		"# TYPE wasm_function_duration_nanoseconds summary\n"
+	assert.Equal(t, header+summary("print", 1000000, 2)+summary("_start", 5000000, 1), string(data))
+
+	// Only whole functions are written
+	res, err = mod.ExportedFunction("__metrics").Call(ctx, 0x8000, 0x200)
+	assert.NoError(t, err)
+	data, _ = mod.Memory().Read(0x8000, uint32(res[0]))
+	assert.Equal(t, header, string(data))
+}
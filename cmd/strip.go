@@ -0,0 +1,105 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdStrip = &cobra.Command{
+		Use:   "strip",
+		Short: "Remove custom sections from a wasm file",
+		Long:  `This removes name, dwarf, producers and any other custom sections, unless asked to keep them.`,
+		RunE:  runStrip,
+	}
+)
+
+var stripKeepNames = false
+var stripKeepDwarf = false
+var stripKeepProducers = false
+var stripKeep []string
+var stripOnly []string
+
+func init() {
+	rootCmd.AddCommand(cmdStrip)
+
+	cmdStrip.Flags().BoolVar(&stripKeepNames, "keep-names", false, "Keep the name section")
+	cmdStrip.Flags().BoolVar(&stripKeepDwarf, "keep-dwarf", false, "Keep the dwarf (.debug_*) sections")
+	cmdStrip.Flags().BoolVar(&stripKeepProducers, "keep-producers", false, "Keep the producers section")
+	cmdStrip.Flags().StringArrayVar(&stripKeep, "keep", []string{}, "Keep a custom section by name")
+	cmdStrip.Flags().StringArrayVar(&stripOnly, "section", []string{}, "Only remove these custom sections")
+}
+
+func runStrip(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.NewWithLayout(Input)
+	if err != nil {
+		return err
+	}
+
+	matcher := func(name string) bool {
+		if len(stripOnly) > 0 {
+			for _, n := range stripOnly {
+				if n == name {
+					return true
+				}
+			}
+			return false
+		}
+		for _, n := range stripKeep {
+			if n == name {
+				return false
+			}
+		}
+		if name == "name" {
+			return !stripKeepNames
+		}
+		if name == "producers" {
+			return !stripKeepProducers
+		}
+		if wasmfile.IsDwarfSection(name) {
+			return !stripKeepDwarf
+		}
+		return true
+	}
+
+	removed := wfile.StripCustom(matcher)
+	fmt.Printf("Removed %d custom sections\n", removed)
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
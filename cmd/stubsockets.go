@@ -0,0 +1,127 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdStubSockets = &cobra.Command{
+		Use:   "stubsockets",
+		Short: "Stop a wasm file from using sockets",
+		Long:  `This replaces the wasi socket imports with functions that return ENOTSUP, so the host never sees them`,
+		RunE:  runStubSockets,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(cmdStubSockets)
+}
+
+func runStubSockets(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	wfile, err := wasmfile.New(Input)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Parsing custom name section...\n")
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	// Add a stub for each socket import. RedirectImport then replaces every import of it.
+	stubs := make(map[string]string)
+	for _, i := range wfile.Import {
+		if i.Module != "wasi_snapshot_preview1" || !strings.HasPrefix(i.Name, "sock_") {
+			continue
+		}
+		if _, ok := stubs[i.Name]; ok {
+			continue
+		}
+		t := wfile.Type[i.Index]
+		if len(t.Result) != 1 || t.Result[0] != types.ValI32 {
+			return fmt.Errorf("The import %s:%s doesn't return an errno", i.Module, i.Name)
+		}
+
+		expr, err := expression.ExpressionFromWat(fmt.Sprintf("i32.const %d", wasm.Wasi_errors["WASI_ENOTSUP"]))
+		if err != nil {
+			return err
+		}
+
+		newidx := len(wfile.Import) + len(wfile.Code)
+		name := fmt.Sprintf("$wt_stub_%s", i.Name)
+		wfile.Function = append(wfile.Function, &wasmfile.FunctionEntry{
+			TypeIndex: i.Index,
+		})
+		wfile.Code = append(wfile.Code, &wasmfile.CodeEntry{
+			Locals:     make([]types.ValType, 0),
+			Expression: expr,
+		})
+		wfile.Debug.FunctionNames[newidx] = name
+		stubs[i.Name] = name
+	}
+
+	if len(stubs) == 0 {
+		fmt.Printf("The module doesn't import any sockets\n")
+	}
+
+	// Now the imports can go
+	names := make([]string, 0)
+	for from := range stubs {
+		names = append(names, from)
+	}
+	sort.Strings(names)
+	for _, from := range names {
+		fmt.Printf("Stubbing %s\n", from)
+		err = wfile.RedirectImport("wasi_snapshot_preview1", from, stubs[from])
+		if err != nil {
+			return err
+		}
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	f, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	err = wfile.EncodeBinary(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
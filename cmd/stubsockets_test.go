@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+)
+
+func TestStubSockets(t *testing.T) {
+	out := instrument(t, wasiProgram("send 3", "print ok\n"), "stubsockets")
+
+	wf, err := wasmfile.NewFromReader(bytes.NewReader(out))
+	assert.NoError(t, err)
+	for _, i := range wf.Import {
+		assert.False(t, strings.HasPrefix(i.Name, "sock_"), i.Name)
+	}
+
+	// WASI_ENOTSUP
+	stdout, _ := runWasi(t, out, wazero.NewModuleConfig())
+	assert.Equal(t, "error 58\nok\n", stdout)
+}
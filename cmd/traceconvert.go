@@ -0,0 +1,81 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/tracefmt"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdTraceConvert = &cobra.Command{
+		Use:   "trace-convert",
+		Short: "Convert a strace --format=chrome log for trace viewers",
+		Long:  `This picks the trace events out of the log, and writes them as a JSON array for chrome://tracing / speedscope, or as folded stacks for flamegraph tools`,
+		RunE:  runTraceConvert,
+	}
+)
+
+var trace_convert_to = "chrome"
+
+func init() {
+	rootCmd.AddCommand(cmdTraceConvert)
+	cmdTraceConvert.Flags().StringVar(&trace_convert_to, "to", "chrome", "Output format (chrome or folded)")
+}
+
+func runTraceConvert(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	if trace_convert_to != "chrome" && trace_convert_to != "folded" {
+		return fmt.Errorf("Unknown output format %q", trace_convert_to)
+	}
+
+	fin, err := os.Open(Input)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	events, err := tracefmt.ReadEvents(fin)
+	if err != nil {
+		return err
+	}
+
+	fout, err := os.Create(Output)
+	if err != nil {
+		return err
+	}
+
+	if trace_convert_to == "folded" {
+		err = tracefmt.WriteFolded(fout, events)
+	} else {
+		err = tracefmt.WriteChrome(fout, events)
+	}
+	if err != nil {
+		fout.Close()
+		return err
+	}
+
+	fmt.Printf("Wrote %d events to %s\n", len(events), Output)
+	return fout.Close()
+}
@@ -0,0 +1,67 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/traps"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdTraps = &cobra.Command{
+		Use:   "traps",
+		Short: "Report the call stack and locals when a wasm file hits unreachable",
+		Long:  `Before each unreachable traps, the function, source line, named locals and a backtrace are written to STDERR`,
+		RunE:  runTraps,
+	}
+)
+
+var traps_all_locals = false
+
+func init() {
+	rootCmd.AddCommand(cmdTraps)
+	cmdTraps.Flags().BoolVar(&traps_all_locals, "all-locals", false, "Show locals that have no dwarf name as well")
+}
+
+func runTraps(ccmd *cobra.Command, args []string) error {
+	if Input == "" {
+		return errors.New("No input file")
+	}
+
+	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
+	data, err := os.ReadFile(Input)
+	if err != nil {
+		return err
+	}
+
+	config := traps.Traps_config{
+		DebugDir:  filepath.Dir(Input),
+		AllLocals: traps_all_locals,
+	}
+	newdata, err := traps.AddTraps(data, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Writing wasm out to %s...\n", Output)
+	return os.WriteFile(Output, newdata, 0660)
+}
@@ -17,8 +17,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
@@ -30,60 +32,72 @@ var (
 		Use:   "wasm2wat",
 		Short: "Use wasm2wat to translate a wasm file to wat",
 		Long:  `This will include any dwarf debug information available.`,
-		Run:   runWasm2Wat,
+		RunE:  runWasm2Wat,
 	}
 )
 
+var wasm2watFolded = false
+
 func init() {
 	rootCmd.AddCommand(cmdWasm2Wat)
+
+	cmdWasm2Wat.Flags().BoolVar(&wasm2watFolded, "folded", false, "Nest operands under the instructions that use them, and indent blocks")
 }
 
-func runWasm2Wat(ccmd *cobra.Command, args []string) {
+func runWasm2Wat(ccmd *cobra.Command, args []string) error {
 	if Input == "" {
-		panic("No input file")
+		return errors.New("No input file")
 	}
 
 	fmt.Printf("Loading wasm file \"%s\"...\n", Input)
 	wfile, err := wasmfile.New(Input)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Parsing custom name section...\n")
 	wfile.Debug = &debug.WasmDebug{}
 	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+	wfile.Debug.Demangle = !rawNames
 
 	fmt.Printf("Parsing custom dwarf debug sections...\n")
-	err = wfile.Debug.ParseDwarf(wfile)
+	debugSections, err := wfile.DebugSections(filepath.Dir(Input))
+	if err != nil {
+		return err
+	}
+	err = wfile.Debug.ParseDwarf(debugSections)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Parsing dwarf line numbers...\n")
+	wfile.Debug.LowMemory = lowMemory
 	err = wfile.Debug.ParseDwarfLineNumbers()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Parsing dwarf local variables...\n")
 	err = wfile.Debug.ParseDwarfVariables(wfile)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Writing wat out to %s...\n", Output)
 	f, err := os.Create(Output)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	wfile.FoldedWat = wasm2watFolded
 	err = wfile.EncodeWat(f)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = f.Close()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return nil
 }
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -28,40 +29,81 @@ import (
 var (
 	cmdWat2Wasm = &cobra.Command{
 		Use:   "wat2wasm",
-		Short: "Use wat2wasm to translate a wat file to wasm",
-		Long:  ``,
-		Run:   runWat2Wasm,
+		Short: "Assemble a wat file into a wasm file",
+		Long:  `This resolves any names used in the wat, and adds a name section and dwarf line numbers pointing back at the wat file`,
+		RunE:  runWat2Wasm,
 	}
 )
 
+var wat2wasmNames = true
+var wat2wasmDwarf = true
+
 func init() {
 	rootCmd.AddCommand(cmdWat2Wasm)
+	cmdWat2Wasm.Flags().BoolVar(&wat2wasmNames, "names", true, "Add a name section")
+	cmdWat2Wasm.Flags().BoolVar(&wat2wasmDwarf, "dwarf", true, "Add dwarf line numbers for the wat file")
 }
 
-func runWat2Wasm(ccmd *cobra.Command, args []string) {
+func runWat2Wasm(ccmd *cobra.Command, args []string) error {
 	if Input == "" {
-		panic("No input file")
+		return errors.New("No input file")
 	}
 
 	fmt.Printf("Loading wat file \"%s\"...\n", Input)
 	wfile, err := wasmfile.NewFromWat(Input)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	for _, c := range wfile.Code {
+		err = c.ResolveLengths(wfile)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveRelocations(wfile, 0)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveGlobals(wfile)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveFunctions(wfile)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = wfile.Validate()
+	if err != nil {
+		return err
 	}
 
+	// Resolving changes the encoding, so the line addresses need working out again
+	err = wfile.AddWatDebugSections(Input)
+	if err != nil {
+		return err
+	}
+	wfile.StripCustom(func(name string) bool {
+		if name == "name" {
+			return !wat2wasmNames
+		}
+		if wasmfile.IsDwarfSection(name) {
+			return !wat2wasmDwarf
+		}
+		return false
+	})
+
 	fmt.Printf("Writing wasm out to %s...\n", Output)
 	f, err := os.Create(Output)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = wfile.EncodeBinary(f)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = f.Close()
-	if err != nil {
-		panic(err)
-	}
+	return f.Close()
 }
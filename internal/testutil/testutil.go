@@ -0,0 +1,91 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package testutil builds the test modules used by the instrumenter tests.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// The file name debug info is made for
+const WatFile = "test.wat"
+
+// Assemble a module from wat, with the function and global names resolved
+func Module(t *testing.T, wat string) *wasmfile.WasmFile {
+	wf := wasmfile.NewEmpty()
+	assert.NoError(t, wf.DecodeWatFile(WatFile, []byte(wat)))
+	for _, c := range wf.Code {
+		assert.NoError(t, c.ResolveGlobals(wf))
+		assert.NoError(t, c.ResolveFunctions(wf))
+	}
+	return wf
+}
+
+// Assemble a module from wat, with a name section and dwarf line numbers pointing into the wat
+func ModuleWithDebug(t *testing.T, wat string) *wasmfile.WasmFile {
+	wf := Module(t, wat)
+	assert.NoError(t, wf.AddWatDebugSections(WatFile))
+	return wf
+}
+
+// Encode a module as a wasm binary
+func Encode(t *testing.T, wf *wasmfile.WasmFile) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	return buf.Bytes()
+}
+
+// Assemble a module from wat into a wasm binary
+func Binary(t *testing.T, wat string) []byte {
+	return Encode(t, Module(t, wat))
+}
+
+/**
+ * Encode a module with its names, and decode it again. This gives the module as the instrumenters
+ * see it, with everything numbered and the names from the name section.
+ */
+func Reload(t *testing.T, wf *wasmfile.WasmFile) *wasmfile.WasmFile {
+	wf.SetCustomSection("name", wf.Debug.EncodeNameSectionData())
+	wf2, err := wasmfile.NewFromReader(bytes.NewReader(Encode(t, wf)))
+	assert.NoError(t, err)
+	return wf2
+}
+
+// A wazero runtime, which is closed when the test ends
+func Runtime(t *testing.T) (context.Context, wazero.Runtime) {
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	t.Cleanup(func() {
+		r.Close(ctx)
+	})
+	return ctx, r
+}
+
+// Instantiate a module which needs no imports, in a runtime of its own
+func Instantiate(t *testing.T, wasm []byte) (context.Context, api.Module) {
+	ctx, r := Runtime(t)
+	mod, err := r.Instantiate(ctx, wasm)
+	assert.NoError(t, err)
+	return ctx, mod
+}
@@ -0,0 +1,53 @@
+(module
+
+  ;; Asyncify runtime. The host drives it the same way as binaryen's asyncify.
+  ;; $asyncify_state is 0 when running normally, 1 while unwinding the stack, and 2 while rewinding it.
+  ;; $asyncify_data points at two i32s, the current end of the saved stack and the end of its buffer.
+
+  ;; asyncify_check_data - Trap if the saved stack has run past the end of its buffer
+  (func $asyncify_check_data
+    global.get $asyncify_data
+    i32.load
+    global.get $asyncify_data
+    i32.load offset=4
+    i32.gt_u
+    if
+      unreachable
+    end
+  )
+
+  (func $asyncify_start_unwind (param $data i32)
+    i32.const 1
+    global.set $asyncify_state
+    local.get $data
+    global.set $asyncify_data
+    call $asyncify_check_data
+  )
+
+  (func $asyncify_stop_unwind
+    i32.const 0
+    global.set $asyncify_state
+    call $asyncify_check_data
+  )
+
+  (func $asyncify_start_rewind (param $data i32)
+    i32.const 2
+    global.set $asyncify_state
+    local.get $data
+    global.set $asyncify_data
+    call $asyncify_check_data
+  )
+
+  (func $asyncify_stop_rewind
+    i32.const 0
+    global.set $asyncify_state
+    call $asyncify_check_data
+  )
+
+  (func $asyncify_get_state (result i32)
+    global.get $asyncify_state
+  )
+
+  (global $asyncify_state (mut i32) (i32.const 0))
+  (global $asyncify_data (mut i32) (i32.const 0))
+)
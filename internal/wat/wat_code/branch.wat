@@ -0,0 +1,71 @@
+(module
+
+  ;; debug_branch - Log if a br_if / if was taken, given its condition. Returns the condition.
+  (func $debug_branch (param $cond i32) (param $ptr i32) (param $len i32) (result i32)
+    (local $count i32)
+    call $debug_update_suppressed
+    if
+      local.get $cond
+      return
+    end
+
+    global.get $debug_current_stack_depth
+    local.set $count
+
+    block
+      loop
+        local.get $count
+        i32.eqz
+        br_if 1
+
+        i32.const offset($debug_sp)
+        i32.const length($debug_sp)
+        call $wt_print
+
+        local.get $count
+        i32.const 1
+        i32.sub
+        local.set $count
+        br 0
+      end
+    end
+
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_context)
+      i32.const length($wt_ansi_context)
+      call $wt_print
+    end
+
+    local.get $ptr
+    local.get $len
+    call $wt_print
+
+    local.get $cond
+    if
+      i32.const offset($branch_taken)
+      i32.const length($branch_taken)
+      call $wt_print
+    else
+      i32.const offset($branch_not_taken)
+      i32.const length($branch_not_taken)
+      call $wt_print
+    end
+
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_none)
+      i32.const length($wt_ansi_none)
+      call $wt_print
+    end
+
+    i32.const offset($debug_newline)
+    i32.const length($debug_newline)
+    call $wt_print
+
+    local.get $cond
+  )
+
+  (data $branch_taken " | taken")
+  (data $branch_not_taken " | not taken")
+)
@@ -0,0 +1,5 @@
+(module
+  (type (func (param i32)))
+  ;; __break - Called at each breakpoint with the PC it's at. The host can pause or inspect the module, then return to carry on.
+  (import "wasm_toolkit" "break" (func $__break (type 0)))
+)
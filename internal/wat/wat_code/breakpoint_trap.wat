@@ -0,0 +1,12 @@
+(module
+  (type (func (param i32)))
+
+  ;; __break - Called at each breakpoint with the PC it's at. The PC is kept in $breakpoint_pc, and the module traps.
+  (func $__break (type 0)
+    local.get 0
+    global.set $breakpoint_pc
+    unreachable
+  )
+
+  (global $breakpoint_pc (mut i32) (i32.const -1))
+)
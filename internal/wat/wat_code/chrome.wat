@@ -0,0 +1,309 @@
+(module
+
+  ;; Chrome trace event output. Each function entry and exit is written as a "B" or "E" event on a line of its own,
+  ;; in the JSON array format that chrome://tracing and speedscope load. Param and result values use the json.wat helpers.
+
+  ;; chrome_print_event - Start an event object, with the phase, timestamp and name
+  (func $chrome_print_event (param $fid i32) (param $phase_ptr i32) (param $phase_len i32)
+    (local $now i64)
+    global.get $chrome_started
+    i32.eqz
+    if
+      i32.const offset($chrome_array_start)
+      i32.const length($chrome_array_start)
+      call $wt_print
+
+      call $debug_gettime
+      global.set $chrome_start_time
+
+      i32.const 1
+      global.set $chrome_started
+    end
+
+    local.get $phase_ptr
+    local.get $phase_len
+    call $wt_print
+
+    ;; Timestamps are in microseconds from the first event
+    call $debug_gettime
+    global.get $chrome_start_time
+    i64.sub
+    local.tee $now
+    i64.const 1000
+    i64.div_u
+    call $json_print_i64_dec
+
+    i32.const offset($chrome_point)
+    i32.const length($chrome_point)
+    call $wt_print
+
+    local.get $now
+    i64.const 1000
+    i64.rem_u
+    i32.wrap_i64
+    call $wt_format_i32_dec
+    i32.const offset($db_number_i32)
+    i32.const 7
+    i32.add
+    i32.const 3
+    call $wt_print
+
+    i32.const offset($chrome_name)
+    i32.const length($chrome_name)
+    call $wt_print
+
+    local.get $fid
+    call $wt_print_function_name
+
+    i32.const offset($json_quote)
+    i32.const length($json_quote)
+    call $wt_print
+  )
+
+  ;; chrome_enter_func - Called when a function is first entered.
+  (func $chrome_enter_func (param $fid i32)
+    call $debug_update_suppressed
+    if
+      global.get $debug_current_stack_depth
+      i32.const 1
+      i32.add
+      global.set $debug_current_stack_depth
+      return
+    end
+
+    local.get $fid
+    i32.const offset($chrome_begin)
+    i32.const length($chrome_begin)
+    call $chrome_print_event
+
+    i32.const offset($chrome_params)
+    i32.const length($chrome_params)
+    call $wt_print
+
+    global.get $debug_current_stack_depth
+    i32.const 1
+    i32.add
+    global.set $debug_current_stack_depth
+  )
+
+  (func $chrome_param_separator
+    call $json_param_separator
+  )
+
+  (func $chrome_param_name (param $str_ptr i32) (param $str_len i32)
+    local.get $str_ptr
+    local.get $str_len
+    call $json_param_name
+  )
+
+  (func $chrome_enter_i32 (param $fid i32) (param $pid i32) (param $value i32)
+    local.get $fid
+    local.get $pid
+    local.get $value
+    call $json_enter_i32
+  )
+
+  (func $chrome_enter_i64 (param $fid i32) (param $pid i32) (param $value i64)
+    local.get $fid
+    local.get $pid
+    local.get $value
+    call $json_enter_i64
+  )
+
+  (func $chrome_enter_f32 (param $fid i32) (param $pid i32) (param $value f32)
+    local.get $fid
+    local.get $pid
+    local.get $value
+    call $json_enter_f32
+  )
+
+  (func $chrome_enter_f64 (param $fid i32) (param $pid i32) (param $value f64)
+    local.get $fid
+    local.get $pid
+    local.get $value
+    call $json_enter_f64
+  )
+
+  (func $chrome_enter_end (param $fid i32)
+    i32.const offset($chrome_params_end)
+    i32.const length($chrome_params_end)
+    call $wt_print
+  )
+
+  ;; chrome_func_context - Extra detail about the function, such as line numbers, as an instant event
+  (func $chrome_func_context (param $str_ptr i32) (param $str_len i32)
+    i32.const offset($chrome_instant)
+    i32.const length($chrome_instant)
+    call $wt_print
+
+    call $debug_gettime
+    global.get $chrome_start_time
+    i64.sub
+    i64.const 1000
+    i64.div_u
+    call $json_print_i64_dec
+
+    i32.const offset($chrome_context)
+    i32.const length($chrome_context)
+    call $wt_print
+
+    local.get $str_ptr
+    local.get $str_len
+    call $wt_print
+
+    i32.const offset($chrome_context_end)
+    i32.const length($chrome_context_end)
+    call $wt_print
+  )
+
+  ;; chrome_exit_func - Called when we first exit a function
+  (func $chrome_exit_func (param $fid i32)
+    global.get $debug_current_stack_depth
+    i32.const 1
+    i32.sub
+    global.set $debug_current_stack_depth
+
+    call $debug_update_suppressed
+    if
+      return
+    end
+
+    local.get $fid
+    i32.const offset($chrome_end)
+    i32.const length($chrome_end)
+    call $chrome_print_event
+  )
+
+  (func $chrome_exit_func_i32 (param $value i32) (result i32)
+    i32.const offset($chrome_result)
+    i32.const length($chrome_result)
+    call $wt_print
+
+    local.get $value
+    call $json_print_i32_value
+
+    i32.const offset($chrome_record_args_end)
+    i32.const length($chrome_record_args_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (func $chrome_exit_func_i64 (param $value i64) (result i64)
+    i32.const offset($chrome_result)
+    i32.const length($chrome_result)
+    call $wt_print
+
+    local.get $value
+    call $json_print_i64_value
+
+    i32.const offset($chrome_record_args_end)
+    i32.const length($chrome_record_args_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (func $chrome_exit_func_f32 (param $value f32) (result f32)
+    i32.const offset($chrome_result)
+    i32.const length($chrome_result)
+    call $wt_print
+
+    i32.const offset($json_value_f32)
+    i32.const length($json_value_f32)
+    call $wt_print
+
+    i32.const offset($chrome_record_args_end)
+    i32.const length($chrome_record_args_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (func $chrome_exit_func_f64 (param $value f64) (result f64)
+    i32.const offset($chrome_result)
+    i32.const length($chrome_result)
+    call $wt_print
+
+    i32.const offset($json_value_f64)
+    i32.const length($json_value_f64)
+    call $wt_print
+
+    i32.const offset($chrome_record_args_end)
+    i32.const length($chrome_record_args_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (func $chrome_exit_func_none
+    i32.const offset($chrome_record_end)
+    i32.const length($chrome_record_end)
+    call $wt_print
+  )
+
+  ;; chrome_exit_func_wasi - Exit a wasi call, including the errno and its name
+  (func $chrome_exit_func_wasi (param $value i32) (result i32)
+    i32.const offset($chrome_result)
+    i32.const length($chrome_result)
+    call $wt_print
+
+    local.get $value
+    call $json_print_i32_value
+
+    i32.const offset($json_errno)
+    i32.const length($json_errno)
+    call $wt_print
+
+    local.get $value
+    call $json_print_i32_dec
+
+    local.get $value
+    i32.const 77
+    i32.lt_u
+    if
+      i32.const offset($json_error)
+      i32.const length($json_error)
+      call $wt_print
+
+      i32.const offset($wasi_errors)
+      local.get $value
+      i32.const 3
+      i32.shl
+      i32.add
+      i32.load
+      i32.const offset($wasi_error_messages)
+      i32.add
+
+      i32.const offset($wasi_errors)
+      local.get $value
+      i32.const 3
+      i32.shl
+      i32.add
+      i32.load offset=4
+      call $wt_print
+
+      i32.const offset($json_quote)
+      i32.const length($json_quote)
+      call $wt_print
+    end
+
+    i32.const offset($chrome_record_args_end)
+    i32.const length($chrome_record_args_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (data $chrome_array_start "[\0a")
+  (data $chrome_begin "{\22ph\22:\22B\22,\22pid\22:1,\22tid\22:1,\22ts\22:")
+  (data $chrome_end "{\22ph\22:\22E\22,\22pid\22:1,\22tid\22:1,\22ts\22:")
+  (data $chrome_instant "{\22ph\22:\22i\22,\22s\22:\22t\22,\22pid\22:1,\22tid\22:1,\22ts\22:")
+  (data $chrome_point ".")
+  (data $chrome_name ",\22name\22:\22")
+  (data $chrome_params ",\22args\22:{\22params\22:[")
+  (data $chrome_params_end "]}},\0a")
+  (data $chrome_context ",\22name\22:\22context\22,\22args\22:{\22text\22:\22")
+  (data $chrome_context_end "\22}},\0a")
+  (data $chrome_result ",\22args\22:{\22result\22:{")
+  (data $chrome_record_args_end "}},\0a")
+  (data $chrome_record_end "},\0a")
+
+  (global $chrome_started (mut i32) (i32.const 0))
+  (global $chrome_start_time (mut i64) (i64.const 0))
+)
@@ -0,0 +1,114 @@
+(module
+
+  ;; Code coverage. Each probe has a bit in $cover_bitmap, which is set when the probe is hit.
+  ;; At exit the bitmap is written out as a line of hex after $cover_header, for `cover report` to read.
+
+  ;; cover_hit - Set the bit for a probe
+  (func $cover_hit (param $probe i32)
+    (local $ptr i32)
+    local.get $probe
+    i32.const 3
+    i32.shr_u
+    i32.const offset($cover_bitmap)
+    i32.add
+    local.tee $ptr
+    local.get $ptr
+    i32.load8_u
+    i32.const 1
+    local.get $probe
+    i32.const 7
+    i32.and
+    i32.shl
+    i32.or
+    i32.store8
+  )
+
+  ;; cover_dump - Write the bitmap out, the first time it's called
+  (func $cover_dump
+    (local $idx i32)
+    (local $buf_len i32)
+    (local $value i32)
+    global.get $cover_dumped
+    br_if 0
+
+    i32.const 1
+    global.set $cover_dumped
+
+    i32.const offset($cover_header)
+    i32.const length($cover_header)
+    call $wt_print
+
+    block
+      loop
+        local.get $idx
+        global.get $cover_bitmap_len
+        i32.ge_u
+        br_if 1
+
+        i32.const offset($cover_bitmap)
+        local.get $idx
+        i32.add
+        i32.load8_u
+        local.set $value
+
+        ;; Two hex digits for each byte
+        i32.const offset($cover_line)
+        local.get $buf_len
+        i32.add
+        local.get $value
+        i32.const 4
+        i32.shr_u
+        i32.const offset($db_hex)
+        i32.add
+        i32.load8_u
+        i32.store8
+
+        i32.const offset($cover_line)
+        local.get $buf_len
+        i32.add
+        local.get $value
+        i32.const 15
+        i32.and
+        i32.const offset($db_hex)
+        i32.add
+        i32.load8_u
+        i32.store8 offset=1
+
+        local.get $buf_len
+        i32.const 2
+        i32.add
+        local.tee $buf_len
+        i32.const length($cover_line)
+        i32.ge_u
+        if
+          i32.const offset($cover_line)
+          local.get $buf_len
+          call $wt_print
+          i32.const 0
+          local.set $buf_len
+        end
+
+        local.get $idx
+        i32.const 1
+        i32.add
+        local.set $idx
+        br 0
+      end
+    end
+
+    i32.const offset($cover_line)
+    local.get $buf_len
+    call $wt_print
+
+    i32.const offset($cover_newline)
+    i32.const length($cover_newline)
+    call $wt_print
+  )
+
+  ;; Hex output is buffered, so it isn't a write per byte
+  (data $cover_line 128)
+  (data $cover_newline "\0a")
+
+  (global $cover_dumped (mut i32) (i32.const 0))
+  (global $cover_bitmap_len (mut i32) (i32.const 0))
+)
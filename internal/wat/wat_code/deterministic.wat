@@ -0,0 +1,316 @@
+(module
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "poll_oneoff" (func $poll_oneoff (type 0)))
+
+  ;; Deterministic clocks and random numbers.
+  ;; Every clock read moves the virtual time on by $det_tick nanoseconds. The realtime clock starts at
+  ;; $det_realtime_base, and the other clocks start at 0. Random bytes come from splitmix64, seeded by $det_rng.
+  ;; poll_oneoff waits for clocks by moving the virtual time on, rather than sleeping. If any fd is being
+  ;; waited for, the host has to do the poll, since the module can't know when it'll be ready.
+
+  ;; det_next_random - Get the next random number
+  (func $det_next_random (result i64)
+    (local $z i64)
+    global.get $det_rng
+    i64.const -7046029254386353131 ;; 0x9E3779B97F4A7C15
+    i64.add
+    global.set $det_rng
+
+    global.get $det_rng
+    local.tee $z
+    local.get $z
+    i64.const 30
+    i64.shr_u
+    i64.xor
+    i64.const -4658895280553007687 ;; 0xBF58476D1CE4E5B9
+    i64.mul
+    local.tee $z
+    local.get $z
+    i64.const 27
+    i64.shr_u
+    i64.xor
+    i64.const -7723592293110705685 ;; 0x94D049BB133111EB
+    i64.mul
+    local.tee $z
+    local.get $z
+    i64.const 31
+    i64.shr_u
+    i64.xor
+  )
+
+  ;; det_clock_now - Get the virtual time of a clock, without moving it on
+  (func $det_clock_now (param $id i32) (result i64)
+    global.get $det_time
+    local.get $id
+    i32.eqz
+    if (result i64)
+      global.get $det_realtime_base
+    else
+      i64.const 0
+    end
+    i64.add
+  )
+
+  (func $det_clock_time_get (param $id i32) (param $precision i64) (param $time i32) (result i32)
+    local.get $id
+    i32.const 3
+    i32.gt_u
+    if
+      ;; WASI_EINVAL
+      i32.const 28
+      return
+    end
+
+    local.get $time
+    local.get $id
+    call $det_clock_now
+    i64.store
+
+    global.get $det_time
+    global.get $det_tick
+    i64.add
+    global.set $det_time
+    i32.const 0
+  )
+
+  (func $det_clock_res_get (param $id i32) (param $res i32) (result i32)
+    local.get $id
+    i32.const 3
+    i32.gt_u
+    if
+      ;; WASI_EINVAL
+      i32.const 28
+      return
+    end
+
+    local.get $res
+    global.get $det_tick
+    i64.const 1
+    global.get $det_tick
+    i64.const 0
+    i64.ne
+    select
+    i64.store
+    i32.const 0
+  )
+
+  (func $det_random_get (param $buf i32) (param $len i32) (result i32)
+    (local $i i32)
+    (local $v i64)
+    block
+      loop
+        local.get $i
+        local.get $len
+        i32.ge_u
+        br_if 1
+
+        local.get $i
+        i32.const 7
+        i32.and
+        i32.eqz
+        if
+          call $det_next_random
+          local.set $v
+        end
+
+        local.get $buf
+        local.get $i
+        i32.add
+        local.get $v
+        i64.store8
+
+        local.get $v
+        i64.const 8
+        i64.shr_u
+        local.set $v
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+    i32.const 0
+  )
+
+  ;; det_deadline - Get when a clock subscription is due, in virtual time
+  (func $det_deadline (param $sub i32) (result i64)
+    ;; subscription_clock is at 16: id, 24: timeout, 32: precision, 40: flags
+    local.get $sub
+    i32.load16_u offset=40
+    i32.const 1
+    i32.and
+    if (result i64)
+      ;; An absolute time on that clock
+      local.get $sub
+      i64.load offset=24
+      local.get $sub
+      i32.load offset=16
+      call $det_clock_now
+      global.get $det_time
+      i64.sub
+      i64.sub
+    else
+      global.get $det_time
+      local.get $sub
+      i64.load offset=24
+      i64.add
+    end
+  )
+
+  (func $det_poll_oneoff (param $in i32) (param $out i32) (param $nsubs i32) (param $nevents i32) (result i32)
+    (local $i i32)
+    (local $sub i32)
+    (local $event i32)
+    (local $deadline i64)
+    (local $earliest i64)
+    (local $count i32)
+
+    local.get $nsubs
+    i32.eqz
+    if
+      ;; WASI_EINVAL
+      i32.const 28
+      return
+    end
+
+    ;; Any fd subscriptions need the host
+    block
+      loop
+        local.get $i
+        local.get $nsubs
+        i32.ge_u
+        br_if 1
+
+        local.get $in
+        local.get $i
+        i32.const 48
+        i32.mul
+        i32.add
+        i32.load8_u offset=8
+        if
+          local.get $in
+          local.get $out
+          local.get $nsubs
+          local.get $nevents
+          call $poll_oneoff
+          return
+        end
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+
+    ;; Move the virtual time on to the first deadline
+    i64.const 9223372036854775807
+    local.set $earliest
+    i32.const 0
+    local.set $i
+    block
+      loop
+        local.get $i
+        local.get $nsubs
+        i32.ge_u
+        br_if 1
+
+        local.get $in
+        local.get $i
+        i32.const 48
+        i32.mul
+        i32.add
+        call $det_deadline
+        local.tee $deadline
+        local.get $earliest
+        i64.lt_s
+        if
+          local.get $deadline
+          local.set $earliest
+        end
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+
+    local.get $earliest
+    global.get $det_time
+    i64.gt_s
+    if
+      local.get $earliest
+      global.set $det_time
+    end
+
+    ;; Everything that's due now fires
+    i32.const 0
+    local.set $i
+    block
+      loop
+        local.get $i
+        local.get $nsubs
+        i32.ge_u
+        br_if 1
+
+        local.get $in
+        local.get $i
+        i32.const 48
+        i32.mul
+        i32.add
+        local.tee $sub
+        call $det_deadline
+        global.get $det_time
+        i64.le_s
+        if
+          local.get $out
+          local.get $count
+          i32.const 5
+          i32.shl
+          i32.add
+          local.tee $event
+          local.get $sub
+          i64.load
+          i64.store
+
+          ;; No error, type clock, and no fd_readwrite
+          local.get $event
+          i64.const 0
+          i64.store offset=8
+          local.get $event
+          i64.const 0
+          i64.store offset=16
+          local.get $event
+          i64.const 0
+          i64.store offset=24
+
+          local.get $count
+          i32.const 1
+          i32.add
+          local.set $count
+        end
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+
+    local.get $nevents
+    local.get $count
+    i32.store
+    i32.const 0
+  )
+
+  (global $det_rng (mut i64) (i64.const 0))
+  (global $det_time (mut i64) (i64.const 0))
+  (global $det_tick (mut i64) (i64.const 1000))
+  (global $det_realtime_base (mut i64) (i64.const 0))
+)
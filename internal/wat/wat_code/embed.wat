@@ -2,10 +2,37 @@
   (type (func (param i32 i32 i32 i32) (result i32)))
   (type (func (param i32 i32) (result i32)))
   (type (func (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (type (func (param i32) (result i32)))
+  (type (func (param i32 i64 i32 i32) (result i32)))
+  (type (func (param i32 i32 i32 i32 i32) (result i32)))
+  (type (func (param i32 i32 i32 i64 i32) (result i32)))
+  (type (func (param i32 i32 i32) (result i32)))
+  (type (func (param i32 i32 i32 i32 i32 i32) (result i32)))
   (import "wasi_snapshot_preview1" "fd_write" (func $debug_fd_write (type 0)))
   (import "wasi_snapshot_preview1" "fd_prestat_get" (func $fd_prestat_get (type 1)))
+  (import "wasi_snapshot_preview1" "fd_prestat_dir_name" (func $fd_prestat_dir_name (type 7)))
   (import "wasi_snapshot_preview1" "path_open" (func $path_open (type 2)))
   (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (type 0)))
+  (import "wasi_snapshot_preview1" "fd_close" (func $fd_close (type 3)))
+  (import "wasi_snapshot_preview1" "fd_seek" (func $fd_seek (type 4)))
+  (import "wasi_snapshot_preview1" "fd_filestat_get" (func $fd_filestat_get (type 1)))
+  (import "wasi_snapshot_preview1" "path_filestat_get" (func $path_filestat_get (type 5)))
+  (import "wasi_snapshot_preview1" "fd_fdstat_get" (func $fd_fdstat_get (type 1)))
+  (import "wasi_snapshot_preview1" "fd_readdir" (func $fd_readdir (type 6)))
+  (import "wasi_snapshot_preview1" "path_create_directory" (func $path_create_directory (type 7)))
+  (import "wasi_snapshot_preview1" "path_remove_directory" (func $path_remove_directory (type 7)))
+  (import "wasi_snapshot_preview1" "path_unlink_file" (func $path_unlink_file (type 7)))
+  (import "wasi_snapshot_preview1" "path_rename" (func $path_rename (type 8)))
+
+  ;; Embedded files. $wt_files has 32 bytes for each file or directory:
+  ;;   0 name offset, 4 name length, 8 content offset, 12 content length, 16 capacity,
+  ;;   20 wasi filetype, 24 parent index (-1 for the root), 28 where the base name starts in the name.
+  ;; Names and contents are in $wt_file_names and $wt_file_contents, and the root directory is always entry 0.
+  ;; Writes change the contents in memory, up to the capacity. Nothing is written to the host.
+  ;; Open files are kept in $embed_open, 8 bytes for each fd from 90000 (file index + 1, position).
+  ;; When the contents are compressed, they're unpacked after the payload data the first time they're opened.
+  ;; $wt_file_packed has 12 bytes for each file (offset into $wt_file_packed_data, length, method),
+  ;; where the method is 0 when there's nothing to do, 1 to copy, or 2 to inflate.
 
   (func $wrap_fd_prestat_get (param $fd i32) (param $ptr i32) (result i32)
     local.get 0
@@ -13,118 +40,1146 @@
     call $fd_prestat_get
   )
 
+  ;; embed_entry - Get the address of the file table entry for a file index
+  (func $embed_entry (param $file i32) (result i32)
+    i32.const offset($wt_files)
+    local.get $file
+    i32.const 5
+    i32.shl
+    i32.add
+  )
+
+  ;; embed_mem_eq - Compare two byte ranges of the same length
+  (func $embed_mem_eq (param $a i32) (param $b i32) (param $len i32) (result i32)
+    (local $count i32)
+    block
+      loop
+        local.get $count
+        local.get $len
+        i32.ge_u
+        br_if 1
+
+        local.get $a
+        local.get $count
+        i32.add
+        i32.load8_u
+        local.get $b
+        local.get $count
+        i32.add
+        i32.load8_u
+        i32.ne
+        if
+          i32.const 0
+          return
+        end
+
+        local.get $count
+        i32.const 1
+        i32.add
+        local.set $count
+        br 0
+      end
+    end
+    i32.const 1
+  )
+
+  ;; embed_normalise_path - Skip any leading "./" or "/", and trailing "/", into $embed_path_ptr and $embed_path_len
+  (func $embed_normalise_path (param $pathPtr i32) (param $pathLen i32)
+    block
+      loop
+        local.get $pathLen
+        i32.const 2
+        i32.ge_u
+        if
+          local.get $pathPtr
+          i32.load16_u
+          i32.const 0x2f2e ;; ./
+          i32.eq
+          if
+            local.get $pathPtr
+            i32.const 2
+            i32.add
+            local.set $pathPtr
+            local.get $pathLen
+            i32.const 2
+            i32.sub
+            local.set $pathLen
+            br 2
+          end
+        end
+        local.get $pathLen
+        i32.eqz
+        br_if 1
+        local.get $pathPtr
+        i32.load8_u
+        i32.const 47 ;; /
+        i32.ne
+        br_if 1
+        local.get $pathPtr
+        i32.const 1
+        i32.add
+        local.set $pathPtr
+        local.get $pathLen
+        i32.const 1
+        i32.sub
+        local.set $pathLen
+        br 0
+      end
+    end
+    block
+      loop
+        local.get $pathLen
+        i32.eqz
+        br_if 1
+        local.get $pathPtr
+        local.get $pathLen
+        i32.add
+        i32.const 1
+        i32.sub
+        i32.load8_u
+        i32.const 47 ;; /
+        i32.ne
+        br_if 1
+        local.get $pathLen
+        i32.const 1
+        i32.sub
+        local.set $pathLen
+        br 0
+      end
+    end
+
+    local.get $pathPtr
+    global.set $embed_path_ptr
+    local.get $pathLen
+    global.set $embed_path_len
+  )
+
+  ;; embed_resolve_path - Put a path relative to $dirfd, which is a preopen or an embedded directory, in front of
+  ;; its directory, and normalise it into $embed_path_ptr and $embed_path_len. Embedded files are named from the
+  ;; root, so they're found whichever directory they're opened from.
+  (func $embed_resolve_path (param $dirfd i32) (param $pathPtr i32) (param $pathLen i32)
+    (local $slot i32)
+    (local $entry i32)
+    (local $dirLen i32)
+
+    ;; "." is the directory itself
+    local.get $pathLen
+    i32.const 1
+    i32.eq
+    if
+      local.get $pathPtr
+      i32.load8_u
+      i32.const 46 ;; .
+      i32.eq
+      if
+        i32.const 0
+        local.set $pathLen
+      end
+    end
+
+    block
+      ;; An absolute path doesn't depend on the directory
+      local.get $pathLen
+      if
+        local.get $pathPtr
+        i32.load8_u
+        i32.const 47 ;; /
+        i32.eq
+        br_if 1
+      end
+
+      local.get $dirfd
+      call $embed_open_slot
+      local.tee $slot
+      if
+        ;; An embedded directory, named in the file table
+        local.get $slot
+        call $embed_slot_entry
+        local.tee $entry
+        i32.load offset=4
+        local.tee $dirLen
+        local.get $pathLen
+        i32.add
+        i32.const 1
+        i32.add
+        i32.const length($embed_path_buf)
+        i32.gt_u
+        br_if 1
+
+        i32.const offset($embed_path_buf)
+        i32.const offset($wt_file_names)
+        local.get $entry
+        i32.load
+        i32.add
+        local.get $dirLen
+        call $embed_copy
+      else
+        ;; A preopen, which is named by the host
+        local.get $dirfd
+        i32.const offset($embed_prestat)
+        call $fd_prestat_get
+        br_if 1
+        i32.const offset($embed_prestat)
+        i32.load8_u
+        br_if 1
+
+        i32.const offset($embed_prestat)
+        i32.load offset=4
+        local.tee $dirLen
+        local.get $pathLen
+        i32.add
+        i32.const 1
+        i32.add
+        i32.const length($embed_path_buf)
+        i32.gt_u
+        br_if 1
+
+        local.get $dirfd
+        i32.const offset($embed_path_buf)
+        local.get $dirLen
+        call $fd_prestat_dir_name
+        br_if 1
+      end
+
+      ;; dir/path
+      i32.const offset($embed_path_buf)
+      local.get $dirLen
+      i32.add
+      i32.const 47 ;; /
+      i32.store8
+      i32.const offset($embed_path_buf)
+      local.get $dirLen
+      i32.add
+      i32.const 1
+      i32.add
+      local.get $pathPtr
+      local.get $pathLen
+      call $embed_copy
+
+      i32.const offset($embed_path_buf)
+      local.set $pathPtr
+      local.get $dirLen
+      local.get $pathLen
+      i32.add
+      i32.const 1
+      i32.add
+      local.set $pathLen
+    end
+
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_normalise_path
+  )
+
+  ;; embed_find_file - Find the index of an embedded file or directory by path, or -1 if there isn't one
+  (func $embed_find_file (param $dirfd i32) (param $pathPtr i32) (param $pathLen i32) (result i32)
+    (local $file i32)
+    (local $entry i32)
+
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_resolve_path
+    global.get $embed_path_ptr
+    local.set $pathPtr
+    global.get $embed_path_len
+    local.set $pathLen
+
+    ;; The root directory
+    local.get $pathLen
+    i32.eqz
+    if
+      i32.const 0
+      return
+    end
+
+    block
+      loop
+        local.get $file
+        i32.const length($wt_files)
+        i32.const 5
+        i32.shr_u
+        i32.ge_u
+        br_if 1
+
+        local.get $file
+        call $embed_entry
+        local.tee $entry
+        i32.load offset=4
+        local.get $pathLen
+        i32.eq
+        if
+          local.get $pathPtr
+          i32.const offset($wt_file_names)
+          local.get $entry
+          i32.load
+          i32.add
+          local.get $pathLen
+          call $embed_mem_eq
+          if
+            local.get $file
+            return
+          end
+        end
+
+        local.get $file
+        i32.const 1
+        i32.add
+        local.set $file
+        br 0
+      end
+    end
+    i32.const -1
+  )
+
+  ;; embed_mount_mode - Get the overlay mode for a path, from the longest matching prefix in $wt_mounts.
+  ;; $wt_mounts has 12 bytes for each mount (prefix offset, prefix length, mode), longest first, and ends with the root.
+  ;; Modes are 0 embedded first, 1 host first, 2 embedded only.
+  (func $embed_mount_mode (param $dirfd i32) (param $pathPtr i32) (param $pathLen i32) (result i32)
+    (local $mount i32)
+    (local $prefixLen i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_resolve_path
+
+    block
+      loop
+        local.get $mount
+        i32.const length($wt_mounts)
+        i32.ge_u
+        br_if 1
+
+        i32.const offset($wt_mounts)
+        local.get $mount
+        i32.add
+        i32.load offset=4
+        local.set $prefixLen
+
+        ;; The prefix has to match a whole path or directory
+        local.get $prefixLen
+        global.get $embed_path_len
+        i32.le_u
+        if
+          global.get $embed_path_ptr
+          i32.const offset($wt_mount_prefixes)
+          i32.const offset($wt_mounts)
+          local.get $mount
+          i32.add
+          i32.load
+          i32.add
+          local.get $prefixLen
+          call $embed_mem_eq
+          if
+            local.get $prefixLen
+            i32.eqz
+            local.get $prefixLen
+            global.get $embed_path_len
+            i32.eq
+            i32.or
+            if (result i32)
+              i32.const 1
+            else
+              global.get $embed_path_ptr
+              local.get $prefixLen
+              i32.add
+              i32.load8_u
+              i32.const 47 ;; /
+              i32.eq
+            end
+            if
+              i32.const offset($wt_mounts)
+              local.get $mount
+              i32.add
+              i32.load offset=8
+              return
+            end
+          end
+        end
+
+        local.get $mount
+        i32.const 12
+        i32.add
+        local.set $mount
+        br 0
+      end
+    end
+    i32.const 0
+  )
+
+  ;; embed_copy - Copy some bytes. This is kept on its own, since wazero 1.7's compiler gets the bounds check
+  ;; wrong when the copy is part of a larger function.
+  (func $embed_copy (param $dst i32) (param $src i32) (param $len i32)
+    local.get $dst
+    local.get $src
+    local.get $len
+    memory.copy
+  )
+
+  ;; embed_contents - Get the address the file contents are relative to
+  (func $embed_contents (result i32)
+    global.get $embed_unpacked_offset
+    i32.const -1
+    i32.eq
+    if (result i32)
+      i32.const offset($wt_file_contents)
+    else
+      global.get $debug_start_mem
+      global.get $embed_unpacked_offset
+      i32.add
+    end
+  )
+
+  ;; embed_unpack - Unpack the contents of a compressed file, if it hasn't been done already
+  (func $embed_unpack (param $file i32) (result i32)
+    (local $packed i32)
+    (local $dst i32)
+    global.get $embed_unpacked_offset
+    i32.const -1
+    i32.eq
+    if
+      i32.const 0
+      return
+    end
+
+    i32.const offset($wt_file_packed)
+    local.get $file
+    i32.const 12
+    i32.mul
+    i32.add
+    local.tee $packed
+    i32.load offset=8
+    i32.eqz
+    if
+      i32.const 0
+      return
+    end
+
+    call $embed_contents
+    local.get $file
+    call $embed_entry
+    i32.load offset=8
+    i32.add
+    local.set $dst
+
+    local.get $packed
+    i32.load offset=8
+    i32.const 1
+    i32.eq
+    if
+      local.get $dst
+      i32.const offset($wt_file_packed_data)
+      local.get $packed
+      i32.load
+      i32.add
+      local.get $packed
+      i32.load offset=4
+      call $embed_copy
+    else
+      i32.const offset($wt_file_packed_data)
+      local.get $packed
+      i32.load
+      i32.add
+      local.get $packed
+      i32.load offset=4
+      local.get $dst
+      call $inflate
+      i32.const -1
+      i32.eq
+      if
+        ;; WASI_EIO
+        i32.const 29
+        return
+      end
+    end
+
+    local.get $packed
+    i32.const 0
+    i32.store offset=8
+    i32.const 0
+  )
+
+  ;; embed_open_slot - Find the open file slot for a fd, or 0 if it isn't an embedded file
+  (func $embed_open_slot (param $fd i32) (result i32)
+    (local $slot i32)
+    local.get $fd
+    i32.const 90000
+    i32.sub
+    local.tee $slot
+    i32.const length($embed_open)
+    i32.const 3
+    i32.shr_u
+    i32.ge_u
+    if
+      i32.const 0
+      return
+    end
+
+    i32.const offset($embed_open)
+    local.get $slot
+    i32.const 3
+    i32.shl
+    i32.add
+    local.tee $slot
+    i32.load
+    i32.eqz
+    if
+      i32.const 0
+      return
+    end
+    local.get $slot
+  )
+
+  ;; embed_slot_entry - Get the file table entry for an open file slot
+  (func $embed_slot_entry (param $slot i32) (result i32)
+    local.get $slot
+    i32.load
+    i32.const 1
+    i32.sub
+    call $embed_entry
+  )
+
+  ;; embed_is_dir - Is the file table entry a directory
+  (func $embed_is_dir (param $entry i32) (result i32)
+    local.get $entry
+    i32.load offset=20
+    i32.const 3 ;; FILETYPE_DIRECTORY
+    i32.eq
+  )
+
+  ;; embed_filestat - Fill in a wasi filestat for a file
+  (func $embed_filestat (param $file i32) (param $buf i32)
+    (local $entry i32)
+    local.get $file
+    call $embed_entry
+    local.set $entry
+
+    local.get $buf
+    i32.const 0
+    i32.const 64
+    memory.fill
+
+    ;; ino
+    local.get $buf
+    local.get $file
+    i32.const 1
+    i32.add
+    i64.extend_i32_u
+    i64.store offset=8
+
+    ;; filetype
+    local.get $buf
+    local.get $entry
+    i32.load offset=20
+    i32.store8 offset=16
+
+    ;; nlink
+    local.get $buf
+    i64.const 1
+    i64.store offset=24
+
+    ;; size
+    local.get $buf
+    local.get $entry
+    i32.load offset=12
+    i64.extend_i32_u
+    i64.store offset=32
+  )
+
   (func $wrap_fd_read (param $fd i32) (param $iovs i32) (param $iovsLen i32) (param $nread i32) (result i32)
     (local $bytes i32)
     (local $iov_offset i32)
-    (local $ioptr i32)
-    (local $iolen i32)
     (local $current_iov i32)
     (local $count i32)
+    (local $slot i32)
+    (local $entry i32)
+
+    local.get $fd
+    call $embed_open_slot
+    local.tee $slot
+    if
+      local.get $slot
+      call $embed_slot_entry
+      local.tee $entry
+      call $embed_is_dir
+      if
+        ;; WASI_EISDIR
+        i32.const 31
+        return
+      end
+
+      block
+        loop
+          local.get $iov_offset
+          local.get $iovsLen
+          i32.ge_u
+          br_if 1
+
+          local.get $iov_offset
+          i32.const 3
+          i32.shl
+          local.get $iovs
+          i32.add
+          local.set $current_iov
+
+          ;; Copy as much as there is left in the file
+          local.get $entry
+          i32.load offset=12
+          local.get $slot
+          i32.load offset=4
+          i32.sub
+          local.tee $count
+          local.get $current_iov
+          i32.load offset=4
+          i32.gt_u
+          if
+            local.get $current_iov
+            i32.load offset=4
+            local.set $count
+          end
+
+          local.get $slot
+          i32.load offset=4
+          local.get $entry
+          i32.load offset=12
+          i32.ge_u
+          br_if 1
+
+          local.get $current_iov
+          i32.load
+          call $embed_contents
+          local.get $entry
+          i32.load offset=8
+          i32.add
+          local.get $slot
+          i32.load offset=4
+          i32.add
+          local.get $count
+          call $embed_copy
+
+          local.get $slot
+          local.get $slot
+          i32.load offset=4
+          local.get $count
+          i32.add
+          i32.store offset=4
+
+          local.get $bytes
+          local.get $count
+          i32.add
+          local.set $bytes
+
+          local.get $iov_offset
+          i32.const 1
+          i32.add
+          local.set $iov_offset
+          br 0
+        end
+      end
+
+      local.get $nread
+      local.get $bytes
+      i32.store
+
+      ;; WASI_SUCCESS
+      i32.const 0
+      return
+    end
+
+    local.get 0
+    local.get 1
+    local.get 2
+    local.get 3
+    call $fd_read
+  )
+
+  (func $wrap_fd_write (param $fd i32) (param $iovs i32) (param $iovsLen i32) (param $nwritten i32) (result i32)
+    (local $bytes i32)
+    (local $iov_offset i32)
+    (local $current_iov i32)
+    (local $count i32)
+    (local $slot i32)
+    (local $entry i32)
+
+    local.get $fd
+    call $embed_open_slot
+    local.tee $slot
+    if
+      local.get $slot
+      call $embed_slot_entry
+      local.tee $entry
+      call $embed_is_dir
+      if
+        ;; WASI_EBADF
+        i32.const 8
+        return
+      end
+
+      block
+        loop
+          local.get $iov_offset
+          local.get $iovsLen
+          i32.ge_u
+          br_if 1
+
+          local.get $iov_offset
+          i32.const 3
+          i32.shl
+          local.get $iovs
+          i32.add
+          local.set $current_iov
+
+          ;; Copy as much as there is room for
+          local.get $slot
+          i32.load offset=4
+          local.get $entry
+          i32.load offset=16
+          i32.ge_u
+          br_if 1
+
+          local.get $entry
+          i32.load offset=16
+          local.get $slot
+          i32.load offset=4
+          i32.sub
+          local.tee $count
+          local.get $current_iov
+          i32.load offset=4
+          i32.gt_u
+          if
+            local.get $current_iov
+            i32.load offset=4
+            local.set $count
+          end
+
+          call $embed_contents
+          local.get $entry
+          i32.load offset=8
+          i32.add
+          local.get $slot
+          i32.load offset=4
+          i32.add
+          local.get $current_iov
+          i32.load
+          local.get $count
+          call $embed_copy
+
+          local.get $slot
+          local.get $slot
+          i32.load offset=4
+          local.get $count
+          i32.add
+          i32.store offset=4
+
+          ;; The file may have grown
+          local.get $slot
+          i32.load offset=4
+          local.get $entry
+          i32.load offset=12
+          i32.gt_u
+          if
+            local.get $entry
+            local.get $slot
+            i32.load offset=4
+            i32.store offset=12
+          end
+
+          local.get $bytes
+          local.get $count
+          i32.add
+          local.set $bytes
+
+          local.get $iov_offset
+          i32.const 1
+          i32.add
+          local.set $iov_offset
+          br 0
+        end
+      end
+
+      ;; Nothing could be written
+      local.get $bytes
+      i32.eqz
+      local.get $iov_offset
+      local.get $iovsLen
+      i32.lt_u
+      i32.and
+      if
+        ;; WASI_ENOSPC
+        i32.const 51
+        return
+      end
+
+      local.get $nwritten
+      local.get $bytes
+      i32.store
+
+      ;; WASI_SUCCESS
+      i32.const 0
+      return
+    end
+
+    local.get 0
+    local.get 1
+    local.get 2
+    local.get 3
+    call $debug_fd_write
+  )
 
-    i32.const 0
-    local.set $iov_offset
+  (func $wrap_fd_seek (param $fd i32) (param $offset i64) (param $whence i32) (param $newoffset i32) (result i32)
+    (local $slot i32)
+    (local $pos i64)
+    local.get $fd
+    call $embed_open_slot
+    local.tee $slot
+    if
+      block
+        ;; WHENCE_SET
+        local.get $whence
+        i32.eqz
+        if
+          local.get $offset
+          local.set $pos
+          br 1
+        end
+        ;; WHENCE_CUR
+        local.get $whence
+        i32.const 1
+        i32.eq
+        if
+          local.get $slot
+          i64.load32_u offset=4
+          local.get $offset
+          i64.add
+          local.set $pos
+          br 1
+        end
+        ;; WHENCE_END
+        local.get $whence
+        i32.const 2
+        i32.eq
+        if
+          local.get $slot
+          call $embed_slot_entry
+          i64.load32_u offset=12
+          local.get $offset
+          i64.add
+          local.set $pos
+          br 1
+        end
+        ;; WASI_EINVAL
+        i32.const 28
+        return
+      end
 
-    i32.const 0
-    local.set $bytes
+      local.get $pos
+      i64.const 0xffffffff
+      i64.gt_u
+      if
+        ;; WASI_EINVAL
+        i32.const 28
+        return
+      end
+
+      local.get $slot
+      local.get $pos
+      i64.store32 offset=4
+
+      local.get $newoffset
+      local.get $pos
+      i64.store
+
+      ;; WASI_SUCCESS
+      i32.const 0
+      return
+    end
+
+    local.get 0
+    local.get 1
+    local.get 2
+    local.get 3
+    call $fd_seek
+  )
 
+  (func $wrap_fd_filestat_get (param $fd i32) (param $buf i32) (result i32)
+    (local $slot i32)
     local.get $fd
-    i32.const 90001
+    call $embed_open_slot
+    local.tee $slot
+    if
+      local.get $slot
+      i32.load
+      i32.const 1
+      i32.sub
+      local.get $buf
+      call $embed_filestat
+
+      ;; WASI_SUCCESS
+      i32.const 0
+      return
+    end
+
+    local.get 0
+    local.get 1
+    call $fd_filestat_get
+  )
+
+  (func $wrap_path_filestat_get (param $dirfd i32) (param $flags i32) (param $pathPtr i32) (param $pathLen i32) (param $buf i32) (result i32)
+    (local $file i32)
+    (local $mode i32)
+    (local $err i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_mount_mode
+    local.tee $mode
+    i32.const 1
     i32.eq
     if
+      local.get 0
+      local.get 1
+      local.get 2
+      local.get 3
+      local.get 4
+      call $path_filestat_get
+      local.tee $err
+      i32.eqz
+      if
+        ;; WASI_SUCCESS
+        i32.const 0
+        return
+      end
+    end
 
-      block
-        loop
-        local.get $iov_offset
-        local.get $iovsLen
-        i32.ge_u
-        br_if 1
-        ;; Now go through the iov and copy as much data as we can...
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_find_file
+    local.tee $file
+    i32.const -1
+    i32.ne
+    if
+      local.get $file
+      local.get $buf
+      call $embed_filestat
 
-          local.get $iov_offset
-          i32.const 3
-          i32.shl
-          local.get $iovs
-          i32.add
-          local.set $current_iov
+      ;; WASI_SUCCESS
+      i32.const 0
+      return
+    end
 
-          local.get $current_iov
-          i32.load
-          local.set $ioptr
+    ;; The host has already been tried
+    local.get $mode
+    i32.const 1
+    i32.eq
+    if
+      local.get $err
+      return
+    end
 
-          local.get $current_iov
-          i32.load offset=4
-          local.set $iolen
+    local.get $mode
+    i32.const 2
+    i32.eq
+    if
+      ;; WASI_ENOENT
+      i32.const 44
+      return
+    end
 
-          ;; ioptr and iolen are now setup
+    local.get 0
+    local.get 1
+    local.get 2
+    local.get 3
+    local.get 4
+    call $path_filestat_get
+  )
 
-          i32.const 0
-          local.set $count
+  (func $wrap_fd_fdstat_get (param $fd i32) (param $buf i32) (result i32)
+    (local $slot i32)
+    local.get $fd
+    call $embed_open_slot
+    local.tee $slot
+    if
+      local.get $buf
+      local.get $slot
+      call $embed_slot_entry
+      i32.load offset=20
+      i32.store8
 
-          block
-            loop
-              local.get $count
-              local.get $iolen
-              i32.ge_u
-              br_if 1
+      ;; fs_flags
+      local.get $buf
+      i32.const 0
+      i32.store16 offset=2
 
-              ;; Now do the actual write if we have any data to write...
+      ;; All rights
+      local.get $buf
+      i64.const -1
+      i64.store offset=8
+      local.get $buf
+      i64.const -1
+      i64.store offset=16
 
-              ;; If there is no more data, then return
-              global.get $debug_fp
-              i32.const length($file_content)
-              i32.ge_u
-              if
-                local.get $nread
-                local.get $bytes
-                i32.store
+      ;; WASI_SUCCESS
+      i32.const 0
+      return
+    end
 
-                ;; WASI_SUCCESS
-                i32.const 0
-                return
-              end
+    local.get 0
+    local.get 1
+    call $fd_fdstat_get
+  )
 
-              ;; preload addr for write
-              local.get $count
-              local.get $ioptr
-              i32.add
+  ;; embed_out - Add bytes to the readdir buffer, as many as there's room for
+  (func $embed_out (param $ptr i32) (param $len i32)
+    local.get $len
+    global.get $embed_out_left
+    i32.gt_u
+    if
+      global.get $embed_out_left
+      local.set $len
+    end
 
-              ;; Write a byte
-              i32.const offset($file_content)
-              global.get $debug_fp
-              i32.add
-              i32.load8_u
+    global.get $embed_out_ptr
+    local.get $ptr
+    local.get $len
+    memory.copy
 
-              i32.store8
+    global.get $embed_out_ptr
+    local.get $len
+    i32.add
+    global.set $embed_out_ptr
 
-              global.get $debug_fp
-              i32.const 1
-              i32.add
-              global.set $debug_fp
+    global.get $embed_out_left
+    local.get $len
+    i32.sub
+    global.set $embed_out_left
+  )
 
-              local.get $bytes
-              i32.const 1
-              i32.add
-              local.set $bytes
+  (func $wrap_fd_readdir (param $fd i32) (param $buf i32) (param $bufLen i32) (param $cookie i64) (param $bufused i32) (result i32)
+    (local $slot i32)
+    (local $dir i32)
+    (local $file i32)
+    (local $entry i32)
+    local.get $fd
+    call $embed_open_slot
+    local.tee $slot
+    if
+      local.get $slot
+      call $embed_slot_entry
+      call $embed_is_dir
+      i32.eqz
+      if
+        ;; WASI_ENOTDIR
+        i32.const 54
+        return
+      end
 
-              local.get $count
-              i32.const 1
-              i32.add
-              local.set $count
-              br 0
-            end
+      local.get $slot
+      i32.load
+      i32.const 1
+      i32.sub
+      local.set $dir
+
+      local.get $buf
+      global.set $embed_out_ptr
+      local.get $bufLen
+      global.set $embed_out_left
+
+      ;; The cookie is the index of the next file to look at
+      local.get $cookie
+      i64.const 0xffffffff
+      i64.gt_u
+      if
+        i32.const -1
+        local.set $file
+      else
+        local.get $cookie
+        i32.wrap_i64
+        local.set $file
+      end
+
+      block
+        loop
+          local.get $file
+          i32.const length($wt_files)
+          i32.const 5
+          i32.shr_u
+          i32.ge_u
+          br_if 1
+
+          global.get $embed_out_left
+          i32.eqz
+          br_if 1
+
+          local.get $file
+          call $embed_entry
+          local.tee $entry
+          i32.load offset=24
+          local.get $dir
+          i32.eq
+          if
+            ;; d_next
+            i32.const offset($embed_dirent)
+            local.get $file
+            i32.const 1
+            i32.add
+            i64.extend_i32_u
+            i64.store
+
+            ;; d_ino
+            i32.const offset($embed_dirent)
+            local.get $file
+            i32.const 1
+            i32.add
+            i64.extend_i32_u
+            i64.store offset=8
+
+            ;; d_namlen
+            i32.const offset($embed_dirent)
+            local.get $entry
+            i32.load offset=4
+            local.get $entry
+            i32.load offset=28
+            i32.sub
+            i32.store offset=16
+
+            ;; d_type
+            i32.const offset($embed_dirent)
+            local.get $entry
+            i32.load offset=20
+            i32.store offset=20
+
+            i32.const offset($embed_dirent)
+            i32.const length($embed_dirent)
+            call $embed_out
+
+            i32.const offset($wt_file_names)
+            local.get $entry
+            i32.load
+            i32.add
+            local.get $entry
+            i32.load offset=28
+            i32.add
+            local.get $entry
+            i32.load offset=4
+            local.get $entry
+            i32.load offset=28
+            i32.sub
+            call $embed_out
           end
 
-          local.get $iov_offset
+          local.get $file
           i32.const 1
           i32.add
-          local.set $iov_offset
+          local.set $file
           br 0
         end
       end
 
-
-      local.get $nread
-      local.get $bytes
+      local.get $bufused
+      local.get $bufLen
+      global.get $embed_out_left
+      i32.sub
       i32.store
 
       ;; WASI_SUCCESS
@@ -136,78 +1191,195 @@
     local.get 1
     local.get 2
     local.get 3
-    call $fd_read
+    local.get 4
+    call $fd_readdir
   )
 
-  (func $wrap_path_open (param $dirfd i32) (param $dirflags i32) (param $pathPtr i32) (param $pathLen i32) (param $oflags i32) (param $fsRightsBase i64) (param $fsRightsInheriting i64) (param $fsFlags i32) (param $fd i32) (result i32)
-    (local $count i32)
-    ;; TODO: Check if the path is something we know about...
+  (func $wrap_fd_close (param $fd i32) (result i32)
+    (local $slot i32)
+    local.get $fd
+    call $embed_open_slot
+    local.tee $slot
+    if
+      local.get $slot
+      i64.const 0
+      i64.store
 
-    i32.const 0
-    local.set $count
+      ;; WASI_ESUCCESS
+      i32.const 0
+      return
+    end
+
+    local.get $fd
+    call $fd_close
+  )
 
+  (func $wrap_path_open (param $dirfd i32) (param $dirflags i32) (param $pathPtr i32) (param $pathLen i32) (param $oflags i32) (param $fsRightsBase i64) (param $fsRightsInheriting i64) (param $fsFlags i32) (param $fd i32) (result i32)
+    (local $file i32)
+    (local $entry i32)
+    (local $slot i32)
+    (local $mode i32)
+    (local $err i32)
+
+    local.get $dirfd
+    local.get $pathPtr
     local.get $pathLen
-    i32.const length($file_name)
+    call $embed_mount_mode
+    local.tee $mode
+    i32.const 1
     i32.eq
     if
+      local.get 0
+      local.get 1
+      local.get 2
+      local.get 3
+      local.get 4
+      local.get 5
+      local.get 6
+      local.get 7
+      local.get 8
+      call $path_open
+      local.tee $err
+      i32.eqz
+      if
+        ;; WASI_SUCCESS
+        i32.const 0
+        return
+      end
+    end
+
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_find_file
+    local.tee $file
+    i32.const -1
+    i32.ne
+    if
+      local.get $file
+      call $embed_entry
+      local.set $entry
+
+      ;; OFLAGS_DIRECTORY
+      local.get $oflags
+      i32.const 2
+      i32.and
+      if
+        local.get $entry
+        call $embed_is_dir
+        i32.eqz
+        if
+          ;; WASI_ENOTDIR
+          i32.const 54
+          return
+        end
+      end
+
+      ;; OFLAGS_EXCL
+      local.get $oflags
+      i32.const 4
+      i32.and
+      if
+        ;; WASI_EEXIST
+        i32.const 20
+        return
+      end
+
+      local.get $file
+      call $embed_unpack
+      local.tee $err
+      if
+        local.get $err
+        return
+      end
 
+      ;; Find a free slot
       block
         loop
-          local.get $count
-          i32.const length($file_name)
-          i32.eq
-          if
-            ;; Do the stuff
+          local.get $slot
+          i32.const length($embed_open)
+          i32.ge_u
+          br_if 1
 
-            ;; Set the FD
-            local.get $fd
-            i32.const 90001
+          i32.const offset($embed_open)
+          local.get $slot
+          i32.add
+          i32.load
+          i32.eqz
+          if
+            i32.const offset($embed_open)
+            local.get $slot
+            i32.add
+            local.get $file
+            i32.const 1
+            i32.add
             i32.store
 
             ;; Reset the read ptr
+            i32.const offset($embed_open)
+            local.get $slot
+            i32.add
             i32.const 0
-            global.set $debug_fp
-
-;;            i32.const offset($debug_path_open)
-;;            i32.const length($debug_path_open)
-;;            call $debug_print
-
-;;            local.get $pathPtr
-;;            local.get $pathLen
-;;            call $debug_print
+            i32.store offset=4
+
+            ;; OFLAGS_TRUNC
+            local.get $oflags
+            i32.const 8
+            i32.and
+            if
+              local.get $entry
+              call $embed_is_dir
+              i32.eqz
+              if
+                local.get $entry
+                i32.const 0
+                i32.store offset=12
+              end
+            end
 
-;;            i32.const offset($debug_newline)
-;;            i32.const length($debug_newline)
-;;            call $debug_print
+            ;; Set the FD
+            local.get $fd
+            local.get $slot
+            i32.const 3
+            i32.shr_u
+            i32.const 90000
+            i32.add
+            i32.store
 
             ;; WASI_ESUCCESS
             i32.const 0
             return
-
           end
 
-          ;; cmp bytes
-          local.get $pathPtr
-          local.get $count
-          i32.add
-          i32.load8_u
-
-          i32.const offset($file_name)
-          local.get $count
-          i32.add
-          i32.load8_u
-          
-          i32.ne
-          br_if 1 
-
-          local.get $count
-          i32.const 1
+          local.get $slot
+          i32.const 8
           i32.add
-          local.set $count
+          local.set $slot
           br 0
         end
       end
 
+      ;; WASI_EMFILE
+      i32.const 33
+      return
+    end
+
+    ;; The host has already been tried
+    local.get $mode
+    i32.const 1
+    i32.eq
+    if
+      local.get $err
+      return
+    end
+
+    local.get $mode
+    i32.const 2
+    i32.eq
+    if
+      ;; WASI_ENOENT
+      i32.const 44
+      return
     end
 
     local.get 0
@@ -224,6 +1396,102 @@
 
 
 
+  ;; embed_path_writable - Get an error if the host path can't be changed, because it's in an embedded only mount
+  (func $embed_path_writable (param $dirfd i32) (param $pathPtr i32) (param $pathLen i32) (result i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_mount_mode
+    i32.const 2
+    i32.eq
+    if
+      ;; WASI_EROFS
+      i32.const 69
+      return
+    end
+    i32.const 0
+  )
+
+  (func $wrap_path_create_directory (param $dirfd i32) (param $pathPtr i32) (param $pathLen i32) (result i32)
+    (local $err i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_path_writable
+    local.tee $err
+    if
+      local.get $err
+      return
+    end
+    local.get 0
+    local.get 1
+    local.get 2
+    call $path_create_directory
+  )
+
+  (func $wrap_path_remove_directory (param $dirfd i32) (param $pathPtr i32) (param $pathLen i32) (result i32)
+    (local $err i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_path_writable
+    local.tee $err
+    if
+      local.get $err
+      return
+    end
+    local.get 0
+    local.get 1
+    local.get 2
+    call $path_remove_directory
+  )
+
+  (func $wrap_path_unlink_file (param $dirfd i32) (param $pathPtr i32) (param $pathLen i32) (result i32)
+    (local $err i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_path_writable
+    local.tee $err
+    if
+      local.get $err
+      return
+    end
+    local.get 0
+    local.get 1
+    local.get 2
+    call $path_unlink_file
+  )
+
+  (func $wrap_path_rename (param $dirfd i32) (param $pathPtr i32) (param $pathLen i32) (param $newDirfd i32) (param $newPathPtr i32) (param $newPathLen i32) (result i32)
+    (local $err i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $embed_path_writable
+    local.tee $err
+    if
+      local.get $err
+      return
+    end
+    local.get $newDirfd
+    local.get $newPathPtr
+    local.get $newPathLen
+    call $embed_path_writable
+    local.tee $err
+    if
+      local.get $err
+      return
+    end
+    local.get 0
+    local.get 1
+    local.get 2
+    local.get 3
+    local.get 4
+    local.get 5
+    call $path_rename
+  )
+
   (func $debug_print (param $ptr i32) (param $len i32)
     (local $iovp i32)
 
@@ -503,7 +1771,15 @@
 
   (data $debug_here "HERE\0d\0a")
 
-;; TODO: Support multiple files here...
-  (global $debug_fp (mut i32) (i32.const 0))
+  (data $embed_open 128)
+  (data $embed_dirent 24)
+  (data $embed_prestat 8)
+  (data $embed_path_buf 2048)
+
+  (global $embed_out_ptr (mut i32) (i32.const 0))
+  (global $embed_path_ptr (mut i32) (i32.const 0))
+  (global $embed_unpacked_offset (mut i32) (i32.const -1))
+  (global $embed_path_len (mut i32) (i32.const 0))
+  (global $embed_out_left (mut i32) (i32.const 0))
 
 )
\ No newline at end of file
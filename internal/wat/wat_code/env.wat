@@ -0,0 +1,220 @@
+(module
+  (type (func (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "environ_sizes_get" (func $environ_sizes_get (type 0)))
+  (import "wasi_snapshot_preview1" "environ_get" (func $environ_get (type 0)))
+
+  ;; Embedded environment variables. $wt_env has each "KEY=VALUE\00" one after another, and
+  ;; $wt_env_locs has 12 bytes for each one (offset into $wt_env, length including the nul, key length).
+  ;; They're added after the host variables. A host variable with the same key is pointed at the
+  ;; embedded one instead, so the key shows up twice with the same value and the count stays right.
+
+  ;; env_key_matches - Check if a host "KEY=VALUE" string has the given key
+  (func $env_key_matches (param $str i32) (param $key i32) (param $keylen i32) (result i32)
+    (local $count i32)
+    block
+      loop
+        local.get $count
+        local.get $keylen
+        i32.ge_u
+        br_if 1
+
+        ;; The host string is nul terminated, so this stops at the end of it
+        local.get $str
+        local.get $count
+        i32.add
+        i32.load8_u
+        local.get $key
+        local.get $count
+        i32.add
+        i32.load8_u
+        i32.ne
+        if
+          i32.const 0
+          return
+        end
+
+        local.get $count
+        i32.const 1
+        i32.add
+        local.set $count
+        br 0
+      end
+    end
+
+    local.get $str
+    local.get $keylen
+    i32.add
+    i32.load8_u
+    i32.const 61 ;; '='
+    i32.eq
+  )
+
+  (func $wrap_environ_sizes_get (param $count_ptr i32) (param $size_ptr i32) (result i32)
+    (local $errno i32)
+    i32.const offset($env_host_sizes)
+    i32.const offset($env_host_sizes)
+    i32.const 4
+    i32.add
+    call $environ_sizes_get
+    local.tee $errno
+    if
+      local.get $errno
+      return
+    end
+
+    local.get $count_ptr
+    i32.const offset($env_host_sizes)
+    i32.load
+    i32.const length($wt_env_locs)
+    i32.const 12
+    i32.div_u
+    i32.add
+    i32.store
+
+    local.get $size_ptr
+    i32.const offset($env_host_sizes)
+    i32.load offset=4
+    i32.const length($wt_env)
+    i32.add
+    i32.store
+
+    i32.const 0
+  )
+
+  (func $wrap_environ_get (param $environ i32) (param $buf i32) (result i32)
+    (local $errno i32)
+    (local $host_count i32)
+    (local $dest i32)
+    (local $loc i32)
+    (local $len i32)
+    (local $slot i32)
+    (local $i i32)
+
+    i32.const offset($env_host_sizes)
+    i32.const offset($env_host_sizes)
+    i32.const 4
+    i32.add
+    call $environ_sizes_get
+    local.tee $errno
+    if
+      local.get $errno
+      return
+    end
+
+    ;; Some hosts fail environ_get when they have no variables, so only ask when there are some
+    i32.const offset($env_host_sizes)
+    i32.load
+    local.tee $host_count
+    if
+      local.get $environ
+      local.get $buf
+      call $environ_get
+      local.tee $errno
+      if
+        local.get $errno
+        return
+      end
+    end
+
+    ;; Embedded variables go in the buffer after the host ones
+    local.get $buf
+    i32.const offset($env_host_sizes)
+    i32.load offset=4
+    i32.add
+    local.set $dest
+
+    local.get $environ
+    local.get $host_count
+    i32.const 2
+    i32.shl
+    i32.add
+    local.set $slot
+
+    i32.const offset($wt_env_locs)
+    local.set $loc
+    block
+      loop
+        local.get $loc
+        i32.const offset($wt_env_locs)
+        i32.const length($wt_env_locs)
+        i32.add
+        i32.ge_u
+        br_if 1
+
+        local.get $loc
+        i32.load offset=4
+        local.set $len
+
+        local.get $dest
+        i32.const offset($wt_env)
+        local.get $loc
+        i32.load
+        i32.add
+        local.get $len
+        memory.copy
+
+        local.get $slot
+        local.get $dest
+        i32.store
+
+        ;; Point any host variable with the same key at this one
+        i32.const 0
+        local.set $i
+        block
+          loop
+            local.get $i
+            local.get $host_count
+            i32.ge_u
+            br_if 1
+
+            local.get $environ
+            local.get $i
+            i32.const 2
+            i32.shl
+            i32.add
+            i32.load
+            local.get $dest
+            local.get $loc
+            i32.load offset=8
+            call $env_key_matches
+            if
+              local.get $environ
+              local.get $i
+              i32.const 2
+              i32.shl
+              i32.add
+              local.get $dest
+              i32.store
+            end
+
+            local.get $i
+            i32.const 1
+            i32.add
+            local.set $i
+            br 0
+          end
+        end
+
+        local.get $dest
+        local.get $len
+        i32.add
+        local.set $dest
+
+        local.get $slot
+        i32.const 4
+        i32.add
+        local.set $slot
+
+        local.get $loc
+        i32.const 12
+        i32.add
+        local.set $loc
+        br 0
+      end
+    end
+
+    i32.const 0
+  )
+
+  (data $env_host_sizes 8)
+)
@@ -26,6 +26,15 @@
   ;; debug_enter_func - Called when a function is first entered.
   (func $debug_enter_func (param $fid i32)
     (local $count i32)
+    call $debug_update_suppressed
+    if
+      global.get $debug_current_stack_depth
+      i32.const 1
+      i32.add
+      global.set $debug_current_stack_depth
+      return
+    end
+
     global.get $debug_current_stack_depth
     local.set $count
 
@@ -73,6 +82,11 @@
     i32.sub
     global.set $debug_current_stack_depth
 
+    call $debug_update_suppressed
+    if
+      return
+    end
+
     global.get $debug_current_stack_depth
     local.set $count
 
@@ -0,0 +1,700 @@
+(module
+
+  ;; Heap tracing. Allocator entry points are wrapped so that allocations and frees are counted,
+  ;; along with the function that called the allocator (the allocation site).
+
+  ;; heap_print_num - Print a number, right aligned in $width characters
+  (func $heap_print_num (param $num i64) (param $width i32)
+    local.get $num
+    call $wt_format_i64_dec_nz
+
+    local.get $num
+    i64.eqz
+    if
+      i32.const offset($db_number_i64)
+      i32.const 48 ;; 0
+      i32.store8 offset=18
+    end
+
+    i32.const offset($db_number_i64)
+    i32.const 19
+    i32.add
+    local.get $width
+    i32.sub
+    local.get $width
+    call $wt_print
+  )
+
+  ;; heap_print_function_name - Given a function ID, print out the function name.
+  (func $heap_print_function_name (param $fid i32)
+    (local $ptr i32)
+    i32.const offset($wt_all_function_names_locs)
+    local.get $fid
+    i32.const 3
+    i32.shl
+    i32.add
+    local.tee $ptr
+    i32.load
+
+    i32.const offset($wt_all_function_names)
+    i32.add
+
+    local.get $ptr
+    i32.load offset=4
+    call $wt_print
+  )
+
+  ;; heap_log - Log a single allocation or free
+  (func $heap_log (param $what_ptr i32) (param $what_len i32) (param $ptr i32) (param $size i32) (param $site i32) (param $fid i32)
+    i32.const offset($heap_log_start)
+    i32.const length($heap_log_start)
+    call $wt_print
+
+    local.get $what_ptr
+    local.get $what_len
+    call $wt_print
+
+    local.get $size
+    i64.extend_i32_u
+    i32.const 10
+    call $heap_print_num
+
+    i32.const offset($heap_log_ptr)
+    i32.const length($heap_log_ptr)
+    call $wt_print
+
+    local.get $ptr
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    i32.const offset($heap_sp)
+    i32.const length($heap_sp)
+    call $wt_print
+
+    local.get $fid
+    call $heap_print_function_name
+
+    i32.const offset($heap_log_site)
+    i32.const length($heap_log_site)
+    call $wt_print
+
+    local.get $site
+    i32.const -1
+    i32.eq
+    if
+      i32.const offset($heap_unknown)
+      i32.const length($heap_unknown)
+      call $wt_print
+    else
+      local.get $site
+      call $heap_print_function_name
+    end
+
+    i32.const offset($heap_newline)
+    i32.const length($heap_newline)
+    call $wt_print
+  )
+
+  ;; heap_table_slot - Get the address of the first table slot for a pointer
+  (func $heap_table_slot (param $ptr i32) (result i32)
+    local.get $ptr
+    i32.const 3
+    i32.shr_u
+    i32.const -1640531535 ;; 2654435761
+    i32.mul
+    global.get $heap_table_size
+    i32.const 1
+    i32.sub
+    i32.and
+    i32.const 3
+    i32.shl
+    i32.const offset($heap_table)
+    i32.add
+  )
+
+  ;; heap_table_next - Move on to the next table slot, wrapping around
+  (func $heap_table_next (param $slot i32) (result i32)
+    local.get $slot
+    i32.const 8
+    i32.add
+    local.tee $slot
+    i32.const offset($heap_table)
+    global.get $heap_table_size
+    i32.const 3
+    i32.shl
+    i32.add
+    i32.ge_u
+    if
+      i32.const offset($heap_table)
+      local.set $slot
+    end
+    local.get $slot
+  )
+
+  ;; heap_table_add - Remember the size of an allocation. Keys are 0 for empty and 1 for removed.
+  (func $heap_table_add (param $ptr i32) (param $size i32)
+    (local $slot i32)
+    (local $count i32)
+    global.get $heap_table_size
+    i32.eqz
+    if
+      return
+    end
+
+    local.get $ptr
+    call $heap_table_slot
+    local.set $slot
+
+    block
+      loop
+        local.get $count
+        global.get $heap_table_size
+        i32.ge_u
+        br_if 1
+
+        local.get $slot
+        i32.load
+        i32.const 1
+        i32.le_u
+        if
+          local.get $slot
+          local.get $ptr
+          i32.store
+          local.get $slot
+          local.get $size
+          i32.store offset=4
+          return
+        end
+
+        local.get $slot
+        call $heap_table_next
+        local.set $slot
+
+        local.get $count
+        i32.const 1
+        i32.add
+        local.set $count
+        br 0
+      end
+    end
+
+    ;; The table is full
+    global.get $heap_untracked
+    i32.const 1
+    i32.add
+    global.set $heap_untracked
+  )
+
+  ;; heap_table_remove - Forget an allocation, returning its size (0 if unknown)
+  (func $heap_table_remove (param $ptr i32) (result i32)
+    (local $slot i32)
+    (local $count i32)
+    global.get $heap_table_size
+    i32.eqz
+    if
+      i32.const 0
+      return
+    end
+
+    local.get $ptr
+    call $heap_table_slot
+    local.set $slot
+
+    block
+      loop
+        local.get $count
+        global.get $heap_table_size
+        i32.ge_u
+        br_if 1
+
+        local.get $slot
+        i32.load
+        i32.eqz
+        br_if 1
+
+        local.get $slot
+        i32.load
+        local.get $ptr
+        i32.eq
+        if
+          local.get $slot
+          i32.const 1
+          i32.store
+          local.get $slot
+          i32.load offset=4
+          return
+        end
+
+        local.get $slot
+        call $heap_table_next
+        local.set $slot
+
+        local.get $count
+        i32.const 1
+        i32.add
+        local.set $count
+        br 0
+      end
+    end
+    i32.const 0
+  )
+
+  ;; heap_record_alloc - Count an allocation against the totals and the allocation site
+  (func $heap_record_alloc (param $ptr i32) (param $size i32) (param $site i32)
+    (local $site_ptr i32)
+    global.get $heap_allocs
+    i64.const 1
+    i64.add
+    global.set $heap_allocs
+
+    global.get $heap_bytes_allocated
+    local.get $size
+    i64.extend_i32_u
+    i64.add
+    global.set $heap_bytes_allocated
+
+    global.get $heap_bytes_live
+    local.get $size
+    i64.extend_i32_u
+    i64.add
+    global.set $heap_bytes_live
+
+    global.get $heap_bytes_live
+    global.get $heap_bytes_peak
+    i64.gt_s
+    if
+      global.get $heap_bytes_live
+      global.set $heap_bytes_peak
+    end
+
+    local.get $ptr
+    local.get $size
+    call $heap_table_add
+
+    local.get $site
+    i32.const -1
+    i32.ne
+    if
+      local.get $site
+      i32.const 4
+      i32.shl
+      i32.const offset($heap_sites)
+      i32.add
+      local.tee $site_ptr
+      local.get $site_ptr
+      i64.load
+      local.get $size
+      i64.extend_i32_u
+      i64.add
+      i64.store
+
+      local.get $site_ptr
+      local.get $site_ptr
+      i32.load offset=8
+      i32.const 1
+      i32.add
+      i32.store offset=8
+    end
+  )
+
+  ;; heap_record_free - Count a free. If the size isn't known (-1) it's looked up.
+  (func $heap_record_free (param $ptr i32) (param $size i32) (result i32)
+    local.get $ptr
+    call $heap_table_remove
+    local.get $size
+    local.get $size
+    i32.const -1
+    i32.eq
+    select
+    local.set $size
+
+    global.get $heap_frees
+    i64.const 1
+    i64.add
+    global.set $heap_frees
+
+    global.get $heap_bytes_freed
+    local.get $size
+    i64.extend_i32_u
+    i64.add
+    global.set $heap_bytes_freed
+
+    global.get $heap_bytes_live
+    local.get $size
+    i64.extend_i32_u
+    i64.sub
+    global.set $heap_bytes_live
+
+    local.get $size
+  )
+
+  ;; heap_enter - Called on entry to an allocator. Nested allocator calls aren't counted.
+  (func $heap_enter
+    global.get $heap_depth
+    i32.const 1
+    i32.add
+    global.set $heap_depth
+  )
+
+  ;; heap_alloc_exit - Called with the result of an allocation
+  (func $heap_alloc_exit (param $ptr i32) (param $size i32) (param $site i32) (param $fid i32) (result i32)
+    global.get $heap_depth
+    i32.const 1
+    i32.sub
+    global.set $heap_depth
+
+    global.get $heap_depth
+    local.get $ptr
+    i32.eqz
+    i32.or
+    if
+      local.get $ptr
+      return
+    end
+
+    local.get $ptr
+    local.get $size
+    local.get $site
+    call $heap_record_alloc
+
+    global.get $heap_log_enabled
+    if
+      i32.const offset($heap_log_alloc)
+      i32.const length($heap_log_alloc)
+      local.get $ptr
+      local.get $size
+      local.get $site
+      local.get $fid
+      call $heap_log
+    end
+
+    local.get $ptr
+  )
+
+  ;; heap_free_exit - Called after a free
+  (func $heap_free_exit (param $ptr i32) (param $size i32) (param $site i32) (param $fid i32)
+    global.get $heap_depth
+    i32.const 1
+    i32.sub
+    global.set $heap_depth
+
+    global.get $heap_depth
+    local.get $ptr
+    i32.eqz
+    i32.or
+    if
+      return
+    end
+
+    local.get $ptr
+    local.get $size
+    call $heap_record_free
+    local.set $size
+
+    global.get $heap_log_enabled
+    if
+      i32.const offset($heap_log_free)
+      i32.const length($heap_log_free)
+      local.get $ptr
+      local.get $size
+      local.get $site
+      local.get $fid
+      call $heap_log
+    end
+  )
+
+  ;; heap_realloc_exit - Called with the result of a realloc. Counted as a free and an allocation.
+  (func $heap_realloc_exit (param $ptr i32) (param $old_ptr i32) (param $old_size i32) (param $size i32) (param $site i32) (param $fid i32) (result i32)
+    global.get $heap_depth
+    i32.const 1
+    i32.sub
+    global.set $heap_depth
+
+    global.get $heap_depth
+    local.get $ptr
+    i32.eqz
+    i32.or
+    if
+      local.get $ptr
+      return
+    end
+
+    local.get $old_ptr
+    if
+      local.get $old_ptr
+      local.get $old_size
+      call $heap_record_free
+      local.set $old_size
+
+      global.get $heap_log_enabled
+      if
+        i32.const offset($heap_log_free)
+        i32.const length($heap_log_free)
+        local.get $old_ptr
+        local.get $old_size
+        local.get $site
+        local.get $fid
+        call $heap_log
+      end
+    end
+
+    local.get $ptr
+    local.get $size
+    local.get $site
+    call $heap_record_alloc
+
+    global.get $heap_log_enabled
+    if
+      i32.const offset($heap_log_alloc)
+      i32.const length($heap_log_alloc)
+      local.get $ptr
+      local.get $size
+      local.get $site
+      local.get $fid
+      call $heap_log
+    end
+
+    local.get $ptr
+  )
+
+  ;; heap_go_alloc - Called on entry to the go runtime allocator. Memory is garbage collected
+  ;; so there's no free, and the pointer isn't known yet.
+  (func $heap_go_alloc (param $size i64) (param $fid i32)
+    i32.const 0
+    local.get $size
+    i32.wrap_i64
+    global.get $heap_site
+    call $heap_record_alloc
+
+    global.get $heap_log_enabled
+    if
+      i32.const offset($heap_log_alloc)
+      i32.const length($heap_log_alloc)
+      i32.const 0
+      local.get $size
+      i32.wrap_i64
+      global.get $heap_site
+      local.get $fid
+      call $heap_log
+    end
+  )
+
+  ;; heap_report_line - Print a labelled number
+  (func $heap_report_line (param $str_ptr i32) (param $str_len i32) (param $num i64)
+    i32.const offset($heap_log_start)
+    i32.const length($heap_log_start)
+    call $wt_print
+
+    local.get $num
+    i32.const 12
+    call $heap_print_num
+
+    local.get $str_ptr
+    local.get $str_len
+    call $wt_print
+
+    i32.const offset($heap_newline)
+    i32.const length($heap_newline)
+    call $wt_print
+  )
+
+  ;; heap_report - Print a summary, and the top allocation sites. Only done once.
+  (func $heap_report
+    (local $count i32)
+    (local $fid i32)
+    (local $best i32)
+    (local $best_bytes i64)
+    (local $site_ptr i32)
+
+    global.get $heap_reported
+    if
+      return
+    end
+    i32.const 1
+    global.set $heap_reported
+
+    i32.const offset($heap_report_allocs)
+    i32.const length($heap_report_allocs)
+    global.get $heap_allocs
+    call $heap_report_line
+
+    i32.const offset($heap_report_allocated)
+    i32.const length($heap_report_allocated)
+    global.get $heap_bytes_allocated
+    call $heap_report_line
+
+    global.get $heap_tracks_frees
+    if
+      i32.const offset($heap_report_frees)
+      i32.const length($heap_report_frees)
+      global.get $heap_frees
+      call $heap_report_line
+
+      i32.const offset($heap_report_freed)
+      i32.const length($heap_report_freed)
+      global.get $heap_bytes_freed
+      call $heap_report_line
+
+      i32.const offset($heap_report_live)
+      i32.const length($heap_report_live)
+      global.get $heap_bytes_live
+      call $heap_report_line
+
+      i32.const offset($heap_report_peak)
+      i32.const length($heap_report_peak)
+      global.get $heap_bytes_peak
+      call $heap_report_line
+    end
+
+    global.get $heap_untracked
+    if
+      i32.const offset($heap_report_untracked)
+      i32.const length($heap_report_untracked)
+      global.get $heap_untracked
+      i64.extend_i32_u
+      call $heap_report_line
+    end
+
+    i32.const offset($heap_report_sites)
+    i32.const length($heap_report_sites)
+    call $wt_print
+
+    ;; Pick out the biggest sites one at a time
+    block
+      loop
+        local.get $count
+        global.get $heap_top_sites
+        i32.ge_u
+        br_if 1
+
+        i32.const -1
+        local.set $best
+        i64.const 0
+        local.set $best_bytes
+        i32.const 0
+        local.set $fid
+
+        block
+          loop
+            local.get $fid
+            global.get $wt_all_function_length
+            i32.ge_u
+            br_if 1
+
+            local.get $fid
+            i32.const 4
+            i32.shl
+            i32.const offset($heap_sites)
+            i32.add
+            i64.load
+            local.get $best_bytes
+            i64.gt_u
+            if
+              local.get $fid
+              local.set $best
+              local.get $fid
+              i32.const 4
+              i32.shl
+              i32.const offset($heap_sites)
+              i32.add
+              i64.load
+              local.set $best_bytes
+            end
+
+            local.get $fid
+            i32.const 1
+            i32.add
+            local.set $fid
+            br 0
+          end
+        end
+
+        local.get $best
+        i32.const -1
+        i32.eq
+        br_if 1
+
+        local.get $best
+        i32.const 4
+        i32.shl
+        i32.const offset($heap_sites)
+        i32.add
+        local.set $site_ptr
+
+        i32.const offset($heap_log_start)
+        i32.const length($heap_log_start)
+        call $wt_print
+
+        local.get $best_bytes
+        i32.const 12
+        call $heap_print_num
+
+        local.get $site_ptr
+        i64.load32_u offset=8
+        i32.const 10
+        call $heap_print_num
+
+        i32.const offset($heap_sp)
+        i32.const length($heap_sp)
+        call $wt_print
+
+        local.get $best
+        call $heap_print_function_name
+
+        i32.const offset($heap_newline)
+        i32.const length($heap_newline)
+        call $wt_print
+
+        ;; Done with this one
+        local.get $site_ptr
+        i64.const 0
+        i64.store
+
+        local.get $count
+        i32.const 1
+        i32.add
+        local.set $count
+        br 0
+      end
+    end
+  )
+
+  (data $heap_log_start "heaptrace: ")
+  (data $heap_log_alloc "alloc")
+  (data $heap_log_free "free ")
+  (data $heap_log_ptr " 0x")
+  (data $heap_log_site " <- ")
+  (data $heap_sp "  ")
+  (data $heap_unknown "?")
+  (data $heap_newline "\0d\0a")
+
+  (data $heap_report_allocs " allocations")
+  (data $heap_report_allocated " bytes allocated")
+  (data $heap_report_frees " frees")
+  (data $heap_report_freed " bytes freed")
+  (data $heap_report_live " bytes live")
+  (data $heap_report_peak " bytes peak")
+  (data $heap_report_untracked " allocations not tracked (table full)")
+  (data $heap_report_sites "heaptrace:        bytes     count  allocation site\0d\0a")
+
+  (global $heap_depth (mut i32) (i32.const 0))
+  (global $heap_site (mut i32) (i32.const -1))
+  (global $heap_reported (mut i32) (i32.const 0))
+  (global $heap_untracked (mut i32) (i32.const 0))
+
+  (global $heap_allocs (mut i64) (i64.const 0))
+  (global $heap_frees (mut i64) (i64.const 0))
+  (global $heap_bytes_allocated (mut i64) (i64.const 0))
+  (global $heap_bytes_freed (mut i64) (i64.const 0))
+  (global $heap_bytes_live (mut i64) (i64.const 0))
+  (global $heap_bytes_peak (mut i64) (i64.const 0))
+
+  ;; Config
+  (global $heap_log_enabled (mut i32) (i32.const 0))
+  (global $heap_tracks_frees (mut i32) (i32.const 0))
+  (global $heap_table_size (mut i32) (i32.const 0))
+  (global $heap_top_sites (mut i32) (i32.const 10))
+  (global $wt_all_function_length (mut i32) (i32.const 0))
+)
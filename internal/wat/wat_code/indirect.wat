@@ -0,0 +1,106 @@
+(module
+
+  ;; debug_call_indirect - Log a call_indirect, with the function in that table slot.
+  ;; $wt_indirect_table has the function ID for each slot as set up by the elem segments, or -1.
+  (func $debug_call_indirect (param $index i32) (param $ptr i32) (param $len i32) (result i32)
+    (local $count i32)
+    (local $fid i32)
+    call $debug_update_suppressed
+    if
+      local.get $index
+      return
+    end
+
+    global.get $debug_current_stack_depth
+    local.set $count
+
+    block
+      loop
+        local.get $count
+        i32.eqz
+        br_if 1
+
+        i32.const offset($debug_sp)
+        i32.const length($debug_sp)
+        call $wt_print
+
+        local.get $count
+        i32.const 1
+        i32.sub
+        local.set $count
+        br 0
+      end
+    end
+
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_context)
+      i32.const length($wt_ansi_context)
+      call $wt_print
+    end
+
+    local.get $ptr
+    local.get $len
+    call $wt_print
+
+    i32.const offset($indirect_table_start)
+    i32.const length($indirect_table_start)
+    call $wt_print
+
+    local.get $index
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    i32.const offset($indirect_table_end)
+    i32.const length($indirect_table_end)
+    call $wt_print
+
+    i32.const -1
+    local.set $fid
+    local.get $index
+    i32.const length($wt_indirect_table)
+    i32.const 2
+    i32.shr_u
+    i32.lt_u
+    if
+      i32.const offset($wt_indirect_table)
+      local.get $index
+      i32.const 2
+      i32.shl
+      i32.add
+      i32.load
+      local.set $fid
+    end
+
+    local.get $fid
+    i32.const -1
+    i32.eq
+    if
+      i32.const offset($indirect_unknown)
+      i32.const length($indirect_unknown)
+      call $wt_print
+    else
+      local.get $fid
+      call $wt_print_function_name
+    end
+
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_none)
+      i32.const length($wt_ansi_none)
+      call $wt_print
+    end
+
+    i32.const offset($debug_newline)
+    i32.const length($debug_newline)
+    call $wt_print
+
+    local.get $index
+  )
+
+  (data $indirect_table_start " | table[")
+  (data $indirect_table_end "] => ")
+  (data $indirect_unknown "?")
+)
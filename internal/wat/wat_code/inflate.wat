@@ -0,0 +1,741 @@
+(module
+
+  ;; A small raw deflate (RFC 1951) decoder, for compressed embedded files.
+  ;; Huffman trees are kept as the number of codes of each length, and the symbols sorted by code.
+
+  ;; inflate_bit - Get the next bit from the input
+  (func $inflate_bit (result i32)
+    (local $bit i32)
+    global.get $inflate_bitcount
+    i32.eqz
+    if
+      global.get $inflate_src
+      global.get $inflate_src_end
+      i32.ge_u
+      if
+        i32.const 1
+        global.set $inflate_error
+        i32.const 0
+        return
+      end
+      global.get $inflate_src
+      i32.load8_u
+      global.set $inflate_bitbuf
+      global.get $inflate_src
+      i32.const 1
+      i32.add
+      global.set $inflate_src
+      i32.const 8
+      global.set $inflate_bitcount
+    end
+
+    global.get $inflate_bitbuf
+    i32.const 1
+    i32.and
+    local.set $bit
+    global.get $inflate_bitbuf
+    i32.const 1
+    i32.shr_u
+    global.set $inflate_bitbuf
+    global.get $inflate_bitcount
+    i32.const 1
+    i32.sub
+    global.set $inflate_bitcount
+    local.get $bit
+  )
+
+  ;; inflate_bits - Get a number of bits from the input, least significant first
+  (func $inflate_bits (param $count i32) (result i32)
+    (local $value i32)
+    (local $i i32)
+    block
+      loop
+        local.get $i
+        local.get $count
+        i32.ge_u
+        br_if 1
+
+        call $inflate_bit
+        local.get $i
+        i32.shl
+        local.get $value
+        i32.or
+        local.set $value
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+    local.get $value
+  )
+
+  ;; inflate_build_tree - Build a tree from a list of code lengths
+  (func $inflate_build_tree (param $counts i32) (param $symbols i32) (param $lengths i32) (param $num i32)
+    (local $i i32)
+    (local $sum i32)
+    (local $len i32)
+    (local $ptr i32)
+
+    local.get $counts
+    i32.const 0
+    i32.const 32
+    memory.fill
+
+    block
+      loop
+        local.get $i
+        local.get $num
+        i32.ge_u
+        br_if 1
+
+        local.get $counts
+        local.get $lengths
+        local.get $i
+        i32.add
+        i32.load8_u
+        i32.const 1
+        i32.shl
+        i32.add
+        local.tee $ptr
+        local.get $ptr
+        i32.load16_u
+        i32.const 1
+        i32.add
+        i32.store16
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+
+    local.get $counts
+    i32.const 0
+    i32.store16
+
+    ;; Where the symbols of each length start
+    i32.const 0
+    local.set $i
+    block
+      loop
+        local.get $i
+        i32.const 16
+        i32.ge_u
+        br_if 1
+
+        i32.const offset($inflate_offsets)
+        local.get $i
+        i32.const 1
+        i32.shl
+        i32.add
+        local.get $sum
+        i32.store16
+
+        local.get $sum
+        local.get $counts
+        local.get $i
+        i32.const 1
+        i32.shl
+        i32.add
+        i32.load16_u
+        i32.add
+        local.set $sum
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+
+    i32.const 0
+    local.set $i
+    block
+      loop
+        local.get $i
+        local.get $num
+        i32.ge_u
+        br_if 1
+
+        local.get $lengths
+        local.get $i
+        i32.add
+        i32.load8_u
+        local.tee $len
+        if
+          i32.const offset($inflate_offsets)
+          local.get $len
+          i32.const 1
+          i32.shl
+          i32.add
+          local.tee $ptr
+          i32.load16_u
+          local.set $sum
+
+          local.get $symbols
+          local.get $sum
+          i32.const 1
+          i32.shl
+          i32.add
+          local.get $i
+          i32.store16
+
+          local.get $ptr
+          local.get $sum
+          i32.const 1
+          i32.add
+          i32.store16
+        end
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+  )
+
+  ;; inflate_symbol - Decode a symbol with a tree
+  (func $inflate_symbol (param $counts i32) (param $symbols i32) (result i32)
+    (local $sum i32)
+    (local $cur i32)
+    (local $len i32)
+    (local $count i32)
+    loop
+      local.get $cur
+      i32.const 1
+      i32.shl
+      call $inflate_bit
+      i32.add
+      local.set $cur
+
+      local.get $len
+      i32.const 1
+      i32.add
+      local.tee $len
+      i32.const 15
+      i32.gt_u
+      if
+        i32.const 1
+        global.set $inflate_error
+        i32.const 0
+        return
+      end
+
+      local.get $counts
+      local.get $len
+      i32.const 1
+      i32.shl
+      i32.add
+      i32.load16_u
+      local.set $count
+
+      local.get $sum
+      local.get $count
+      i32.add
+      local.set $sum
+
+      local.get $cur
+      local.get $count
+      i32.sub
+      local.tee $cur
+      i32.const 0
+      i32.ge_s
+      br_if 0
+    end
+
+    local.get $symbols
+    local.get $sum
+    local.get $cur
+    i32.add
+    i32.const 1
+    i32.shl
+    i32.add
+    i32.load16_u
+  )
+
+  ;; inflate_fixed_trees - Build the fixed huffman trees
+  (func $inflate_fixed_trees
+    i32.const offset($inflate_lengths)
+    i32.const 8
+    i32.const 144
+    memory.fill
+    i32.const offset($inflate_lengths)
+    i32.const 144
+    i32.add
+    i32.const 9
+    i32.const 112
+    memory.fill
+    i32.const offset($inflate_lengths)
+    i32.const 256
+    i32.add
+    i32.const 7
+    i32.const 24
+    memory.fill
+    i32.const offset($inflate_lengths)
+    i32.const 280
+    i32.add
+    i32.const 8
+    i32.const 8
+    memory.fill
+
+    i32.const offset($inflate_lt_counts)
+    i32.const offset($inflate_lt_symbols)
+    i32.const offset($inflate_lengths)
+    i32.const 288
+    call $inflate_build_tree
+
+    i32.const offset($inflate_lengths)
+    i32.const 5
+    i32.const 30
+    memory.fill
+
+    i32.const offset($inflate_dt_counts)
+    i32.const offset($inflate_dt_symbols)
+    i32.const offset($inflate_lengths)
+    i32.const 30
+    call $inflate_build_tree
+  )
+
+  ;; inflate_dynamic_trees - Read the huffman trees for a block
+  (func $inflate_dynamic_trees
+    (local $hlit i32)
+    (local $hdist i32)
+    (local $hclen i32)
+    (local $i i32)
+    (local $num i32)
+    (local $sym i32)
+    (local $fill i32)
+    (local $repeat i32)
+
+    i32.const 5
+    call $inflate_bits
+    i32.const 257
+    i32.add
+    local.set $hlit
+    i32.const 5
+    call $inflate_bits
+    i32.const 1
+    i32.add
+    local.set $hdist
+    i32.const 4
+    call $inflate_bits
+    i32.const 4
+    i32.add
+    local.set $hclen
+
+    i32.const offset($inflate_lengths)
+    i32.const 0
+    i32.const 19
+    memory.fill
+
+    block
+      loop
+        local.get $i
+        local.get $hclen
+        i32.ge_u
+        br_if 1
+
+        i32.const offset($inflate_lengths)
+        i32.const offset($inflate_clen_order)
+        local.get $i
+        i32.add
+        i32.load8_u
+        i32.add
+        i32.const 3
+        call $inflate_bits
+        i32.store8
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+
+    ;; The code length tree goes in the distance tree, as that isn't needed yet
+    i32.const offset($inflate_dt_counts)
+    i32.const offset($inflate_dt_symbols)
+    i32.const offset($inflate_lengths)
+    i32.const 19
+    call $inflate_build_tree
+
+    block
+      loop
+        local.get $num
+        local.get $hlit
+        local.get $hdist
+        i32.add
+        i32.ge_u
+        br_if 1
+
+        global.get $inflate_error
+        br_if 1
+
+        i32.const offset($inflate_dt_counts)
+        i32.const offset($inflate_dt_symbols)
+        call $inflate_symbol
+        local.tee $sym
+        i32.const 16
+        i32.lt_u
+        if
+          i32.const offset($inflate_lengths)
+          local.get $num
+          i32.add
+          local.get $sym
+          i32.store8
+          local.get $num
+          i32.const 1
+          i32.add
+          local.set $num
+        else
+          i32.const 0
+          local.set $fill
+          local.get $sym
+          i32.const 16
+          i32.eq
+          if
+            ;; Repeat the previous length
+            local.get $num
+            i32.eqz
+            if
+              i32.const 1
+              global.set $inflate_error
+              return
+            end
+            i32.const offset($inflate_lengths)
+            local.get $num
+            i32.add
+            i32.const 1
+            i32.sub
+            i32.load8_u
+            local.set $fill
+            i32.const 2
+            call $inflate_bits
+            i32.const 3
+            i32.add
+            local.set $repeat
+          else
+            local.get $sym
+            i32.const 17
+            i32.eq
+            if
+              i32.const 3
+              call $inflate_bits
+              i32.const 3
+              i32.add
+              local.set $repeat
+            else
+              i32.const 7
+              call $inflate_bits
+              i32.const 11
+              i32.add
+              local.set $repeat
+            end
+          end
+
+          local.get $num
+          local.get $repeat
+          i32.add
+          local.get $hlit
+          local.get $hdist
+          i32.add
+          i32.gt_u
+          if
+            i32.const 1
+            global.set $inflate_error
+            return
+          end
+
+          i32.const offset($inflate_lengths)
+          local.get $num
+          i32.add
+          local.get $fill
+          local.get $repeat
+          memory.fill
+
+          local.get $num
+          local.get $repeat
+          i32.add
+          local.set $num
+        end
+        br 0
+      end
+    end
+
+    i32.const offset($inflate_lt_counts)
+    i32.const offset($inflate_lt_symbols)
+    i32.const offset($inflate_lengths)
+    local.get $hlit
+    call $inflate_build_tree
+
+    i32.const offset($inflate_dt_counts)
+    i32.const offset($inflate_dt_symbols)
+    i32.const offset($inflate_lengths)
+    local.get $hlit
+    i32.add
+    local.get $hdist
+    call $inflate_build_tree
+  )
+
+  ;; inflate_block - Decode the data of a huffman block
+  (func $inflate_block
+    (local $sym i32)
+    (local $len i32)
+    (local $dist i32)
+    block
+      loop
+        global.get $inflate_error
+        br_if 1
+
+        i32.const offset($inflate_lt_counts)
+        i32.const offset($inflate_lt_symbols)
+        call $inflate_symbol
+        local.tee $sym
+        i32.const 256
+        i32.eq
+        br_if 1
+
+        local.get $sym
+        i32.const 256
+        i32.lt_u
+        if
+          global.get $inflate_dst
+          local.get $sym
+          i32.store8
+          global.get $inflate_dst
+          i32.const 1
+          i32.add
+          global.set $inflate_dst
+        else
+          local.get $sym
+          i32.const 257
+          i32.sub
+          local.tee $sym
+          i32.const 29
+          i32.ge_u
+          if
+            i32.const 1
+            global.set $inflate_error
+            return
+          end
+
+          i32.const offset($inflate_length_bits)
+          local.get $sym
+          i32.add
+          i32.load8_u
+          call $inflate_bits
+          i32.const offset($inflate_length_base)
+          local.get $sym
+          i32.const 1
+          i32.shl
+          i32.add
+          i32.load16_u
+          i32.add
+          local.set $len
+
+          i32.const offset($inflate_dt_counts)
+          i32.const offset($inflate_dt_symbols)
+          call $inflate_symbol
+          local.tee $sym
+          i32.const 30
+          i32.ge_u
+          if
+            i32.const 1
+            global.set $inflate_error
+            return
+          end
+
+          i32.const offset($inflate_dist_bits)
+          local.get $sym
+          i32.add
+          i32.load8_u
+          call $inflate_bits
+          i32.const offset($inflate_dist_base)
+          local.get $sym
+          i32.const 1
+          i32.shl
+          i32.add
+          i32.load16_u
+          i32.add
+          local.set $dist
+
+          ;; Copy a byte at a time, as the ranges can overlap
+          block
+            loop
+              local.get $len
+              i32.eqz
+              br_if 1
+
+              global.get $inflate_dst
+              global.get $inflate_dst
+              local.get $dist
+              i32.sub
+              i32.load8_u
+              i32.store8
+              global.get $inflate_dst
+              i32.const 1
+              i32.add
+              global.set $inflate_dst
+
+              local.get $len
+              i32.const 1
+              i32.sub
+              local.set $len
+              br 0
+            end
+          end
+        end
+        br 0
+      end
+    end
+  )
+
+  ;; inflate_stored - Copy a stored block
+  (func $inflate_stored
+    (local $len i32)
+    ;; Stored blocks start on a byte boundary
+    i32.const 0
+    global.set $inflate_bitcount
+
+    global.get $inflate_src
+    i32.const 4
+    i32.add
+    global.get $inflate_src_end
+    i32.gt_u
+    if
+      i32.const 1
+      global.set $inflate_error
+      return
+    end
+
+    global.get $inflate_src
+    i32.load16_u
+    local.set $len
+    global.get $inflate_src
+    i32.const 4
+    i32.add
+    global.set $inflate_src
+
+    global.get $inflate_src
+    local.get $len
+    i32.add
+    global.get $inflate_src_end
+    i32.gt_u
+    if
+      i32.const 1
+      global.set $inflate_error
+      return
+    end
+
+    global.get $inflate_dst
+    global.get $inflate_src
+    local.get $len
+    memory.copy
+
+    global.get $inflate_dst
+    local.get $len
+    i32.add
+    global.set $inflate_dst
+    global.get $inflate_src
+    local.get $len
+    i32.add
+    global.set $inflate_src
+  )
+
+  ;; inflate - Decompress raw deflate data. Returns the number of bytes written, or -1 if the data is bad.
+  (func $inflate (param $src i32) (param $srcLen i32) (param $dst i32) (result i32)
+    (local $final i32)
+    (local $type i32)
+    local.get $src
+    global.set $inflate_src
+    local.get $src
+    local.get $srcLen
+    i32.add
+    global.set $inflate_src_end
+    local.get $dst
+    global.set $inflate_dst
+    i32.const 0
+    global.set $inflate_bitcount
+    i32.const 0
+    global.set $inflate_error
+
+    block
+      loop
+        call $inflate_bit
+        local.set $final
+        i32.const 2
+        call $inflate_bits
+        local.tee $type
+        i32.eqz
+        if
+          call $inflate_stored
+        else
+          local.get $type
+          i32.const 1
+          i32.eq
+          if
+            call $inflate_fixed_trees
+          else
+            local.get $type
+            i32.const 2
+            i32.eq
+            if
+              call $inflate_dynamic_trees
+            else
+              i32.const 1
+              global.set $inflate_error
+            end
+          end
+          global.get $inflate_error
+          i32.eqz
+          if
+            call $inflate_block
+          end
+        end
+
+        global.get $inflate_error
+        br_if 1
+        local.get $final
+        i32.eqz
+        br_if 0
+      end
+    end
+
+    global.get $inflate_error
+    if
+      i32.const -1
+      return
+    end
+    global.get $inflate_dst
+    local.get $dst
+    i32.sub
+  )
+
+  (data $inflate_length_base "\03\00\04\00\05\00\06\00\07\00\08\00\09\00\0a\00\0b\00\0d\00\0f\00\11\00\13\00\17\00\1b\00\1f\00\23\00\2b\00\33\00\3b\00\43\00\53\00\63\00\73\00\83\00\a3\00\c3\00\e3\00\02\01")
+  (data $inflate_length_bits "\00\00\00\00\00\00\00\00\01\01\01\01\02\02\02\02\03\03\03\03\04\04\04\04\05\05\05\05\00")
+  (data $inflate_dist_base "\01\00\02\00\03\00\04\00\05\00\07\00\09\00\0d\00\11\00\19\00\21\00\31\00\41\00\61\00\81\00\c1\00\01\01\81\01\01\02\01\03\01\04\01\06\01\08\01\0c\01\10\01\18\01\20\01\30\01\40\01\60")
+  (data $inflate_dist_bits "\00\00\00\00\01\01\02\02\03\03\04\04\05\05\06\06\07\07\08\08\09\09\0a\0a\0b\0b\0c\0c\0d\0d")
+  (data $inflate_clen_order "\10\11\12\00\08\07\09\06\0a\05\0b\04\0c\03\0d\02\0e\01\0f")
+  (data $inflate_lt_counts 32)
+  (data $inflate_lt_symbols 576)
+  (data $inflate_dt_counts 32)
+  (data $inflate_dt_symbols 60)
+  (data $inflate_offsets 32)
+  (data $inflate_lengths 320)
+
+  (global $inflate_src (mut i32) (i32.const 0))
+  (global $inflate_src_end (mut i32) (i32.const 0))
+  (global $inflate_dst (mut i32) (i32.const 0))
+  (global $inflate_bitbuf (mut i32) (i32.const 0))
+  (global $inflate_bitcount (mut i32) (i32.const 0))
+  (global $inflate_error (mut i32) (i32.const 0))
+)
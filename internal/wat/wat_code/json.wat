@@ -0,0 +1,438 @@
+(module
+
+  ;; JSON trace output. Each function entry and exit is written as a single line of JSON.
+
+  ;; json_print_number - Print the padded number in a buffer without the padding
+  (func $json_print_number (param $ptr i32) (param $len i32)
+    block
+      loop
+        local.get $len
+        i32.eqz
+        br_if 1
+
+        local.get $ptr
+        i32.load8_u
+        i32.const 32
+        i32.ne
+        br_if 1
+
+        local.get $ptr
+        i32.const 1
+        i32.add
+        local.set $ptr
+        local.get $len
+        i32.const 1
+        i32.sub
+        local.set $len
+        br 0
+      end
+    end
+
+    local.get $len
+    i32.eqz
+    if
+      i32.const offset($json_zero)
+      i32.const length($json_zero)
+      call $wt_print
+      return
+    end
+
+    local.get $ptr
+    local.get $len
+    call $wt_print
+  )
+
+  (func $json_print_i32_dec (param $value i32)
+    local.get $value
+    call $wt_format_i32_dec_nz
+    i32.const offset($db_number_i32)
+    i32.const 10
+    call $json_print_number
+  )
+
+  (func $json_print_i64_dec (param $value i64)
+    local.get $value
+    call $wt_format_i64_dec_nz
+    i32.const offset($db_number_i64)
+    i32.const 19
+    call $json_print_number
+  )
+
+  ;; json_print_hex_value - Print the rest of a value object for an i32
+  (func $json_print_i32_value (param $value i32)
+    i32.const offset($json_type_i32)
+    i32.const length($json_type_i32)
+    call $wt_print
+
+    local.get $value
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    i32.const offset($json_value_end)
+    i32.const length($json_value_end)
+    call $wt_print
+  )
+
+  (func $json_print_i64_value (param $value i64)
+    i32.const offset($json_type_i64)
+    i32.const length($json_type_i64)
+    call $wt_print
+
+    local.get $value
+    i64.const 32
+    i64.shr_u
+    i32.wrap_i64
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    local.get $value
+    i32.wrap_i64
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    i32.const offset($json_value_end)
+    i32.const length($json_value_end)
+    call $wt_print
+  )
+
+  ;; json_print_function - Print the function name and depth fields
+  (func $json_print_function (param $fid i32)
+    i32.const offset($json_function)
+    i32.const length($json_function)
+    call $wt_print
+
+    local.get $fid
+    call $wt_print_function_name
+
+    i32.const offset($json_depth)
+    i32.const length($json_depth)
+    call $wt_print
+
+    global.get $debug_current_stack_depth
+    call $json_print_i32_dec
+  )
+
+  ;; json_enter_func - Called when a function is first entered.
+  (func $json_enter_func (param $fid i32)
+    call $debug_update_suppressed
+    if
+      global.get $debug_current_stack_depth
+      i32.const 1
+      i32.add
+      global.set $debug_current_stack_depth
+      return
+    end
+
+    ;; Keep the entry time, for the duration on exit
+    global.get $debug_current_stack_depth
+    i32.const 100
+    i32.lt_u
+    if
+      global.get $debug_current_stack_depth
+      i32.const 3
+      i32.shl
+      i32.const offset($json_timestamps)
+      i32.add
+      call $debug_gettime
+      i64.store
+    end
+
+    i32.const offset($json_enter)
+    i32.const length($json_enter)
+    call $wt_print
+
+    local.get $fid
+    call $json_print_function
+
+    i32.const offset($json_params)
+    i32.const length($json_params)
+    call $wt_print
+
+    global.get $debug_current_stack_depth
+    i32.const 1
+    i32.add
+    global.set $debug_current_stack_depth
+  )
+
+  (func $json_param_separator
+    i32.const offset($json_sep)
+    i32.const length($json_sep)
+    call $wt_print
+  )
+
+  (func $json_param_name (param $str_ptr i32) (param $str_len i32)
+    i32.const offset($json_param_name)
+    i32.const length($json_param_name)
+    call $wt_print
+
+    local.get $str_ptr
+    local.get $str_len
+    call $wt_print
+
+    i32.const offset($json_param_name_end)
+    i32.const length($json_param_name_end)
+    call $wt_print
+
+    i32.const 1
+    global.set $json_param_open
+  )
+
+  ;; json_param_start - Start a param object, unless the name already has
+  (func $json_param_start
+    global.get $json_param_open
+    i32.eqz
+    if
+      i32.const offset($json_open)
+      i32.const length($json_open)
+      call $wt_print
+    end
+    i32.const 0
+    global.set $json_param_open
+  )
+
+  (func $json_enter_i32 (param $fid i32) (param $pid i32) (param $value i32)
+    call $json_param_start
+    local.get $value
+    call $json_print_i32_value
+  )
+
+  (func $json_enter_i64 (param $fid i32) (param $pid i32) (param $value i64)
+    call $json_param_start
+    local.get $value
+    call $json_print_i64_value
+  )
+
+  (func $json_enter_f32 (param $fid i32) (param $pid i32) (param $value f32)
+    call $json_param_start
+    i32.const offset($json_value_f32)
+    i32.const length($json_value_f32)
+    call $wt_print
+  )
+
+  (func $json_enter_f64 (param $fid i32) (param $pid i32) (param $value f64)
+    call $json_param_start
+    i32.const offset($json_value_f64)
+    i32.const length($json_value_f64)
+    call $wt_print
+  )
+
+  (func $json_enter_end (param $fid i32)
+    i32.const offset($json_params_end)
+    i32.const length($json_params_end)
+    call $wt_print
+  )
+
+  ;; json_func_context - Extra detail about the function, such as line numbers
+  (func $json_func_context (param $str_ptr i32) (param $str_len i32)
+    i32.const offset($json_context)
+    i32.const length($json_context)
+    call $wt_print
+
+    global.get $debug_current_stack_depth
+    call $json_print_i32_dec
+
+    i32.const offset($json_text)
+    i32.const length($json_text)
+    call $wt_print
+
+    local.get $str_ptr
+    local.get $str_len
+    call $wt_print
+
+    i32.const offset($json_text_end)
+    i32.const length($json_text_end)
+    call $wt_print
+  )
+
+  ;; json_exit_func - Called when we first exit a function
+  (func $json_exit_func (param $fid i32)
+    global.get $debug_current_stack_depth
+    i32.const 1
+    i32.sub
+    global.set $debug_current_stack_depth
+
+    call $debug_update_suppressed
+    if
+      return
+    end
+
+    i32.const offset($json_exit)
+    i32.const length($json_exit)
+    call $wt_print
+
+    local.get $fid
+    call $json_print_function
+
+    global.get $debug_current_stack_depth
+    i32.const 100
+    i32.lt_u
+    if
+      i32.const offset($json_duration)
+      i32.const length($json_duration)
+      call $wt_print
+
+      call $debug_gettime
+      global.get $debug_current_stack_depth
+      i32.const 3
+      i32.shl
+      i32.const offset($json_timestamps)
+      i32.add
+      i64.load
+      i64.sub
+      call $json_print_i64_dec
+    end
+  )
+
+  (func $json_exit_func_i32 (param $value i32) (result i32)
+    i32.const offset($json_result)
+    i32.const length($json_result)
+    call $wt_print
+
+    local.get $value
+    call $json_print_i32_value
+
+    i32.const offset($json_record_end)
+    i32.const length($json_record_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (func $json_exit_func_i64 (param $value i64) (result i64)
+    i32.const offset($json_result)
+    i32.const length($json_result)
+    call $wt_print
+
+    local.get $value
+    call $json_print_i64_value
+
+    i32.const offset($json_record_end)
+    i32.const length($json_record_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (func $json_exit_func_f32 (param $value f32) (result f32)
+    i32.const offset($json_result)
+    i32.const length($json_result)
+    call $wt_print
+
+    i32.const offset($json_value_f32)
+    i32.const length($json_value_f32)
+    call $wt_print
+
+    i32.const offset($json_record_end)
+    i32.const length($json_record_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (func $json_exit_func_f64 (param $value f64) (result f64)
+    i32.const offset($json_result)
+    i32.const length($json_result)
+    call $wt_print
+
+    i32.const offset($json_value_f64)
+    i32.const length($json_value_f64)
+    call $wt_print
+
+    i32.const offset($json_record_end)
+    i32.const length($json_record_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (func $json_exit_func_none
+    i32.const offset($json_record_end)
+    i32.const length($json_record_end)
+    call $wt_print
+  )
+
+  ;; json_exit_func_wasi - Exit a wasi call, including the errno and its name
+  (func $json_exit_func_wasi (param $value i32) (result i32)
+    i32.const offset($json_result)
+    i32.const length($json_result)
+    call $wt_print
+
+    local.get $value
+    call $json_print_i32_value
+
+    i32.const offset($json_errno)
+    i32.const length($json_errno)
+    call $wt_print
+
+    local.get $value
+    call $json_print_i32_dec
+
+    local.get $value
+    i32.const 77
+    i32.lt_u
+    if
+      i32.const offset($json_error)
+      i32.const length($json_error)
+      call $wt_print
+
+      i32.const offset($wasi_errors)
+      local.get $value
+      i32.const 3
+      i32.shl
+      i32.add
+      i32.load
+      i32.const offset($wasi_error_messages)
+      i32.add
+
+      i32.const offset($wasi_errors)
+      local.get $value
+      i32.const 3
+      i32.shl
+      i32.add
+      i32.load offset=4
+      call $wt_print
+
+      i32.const offset($json_quote)
+      i32.const length($json_quote)
+      call $wt_print
+    end
+
+    i32.const offset($json_record_end)
+    i32.const length($json_record_end)
+    call $wt_print
+    local.get $value
+  )
+
+  (data $json_zero "0")
+  (data $json_sep ",")
+  (data $json_open "{")
+  (data $json_quote "\22")
+  (data $json_enter "{\22event\22:\22enter\22")
+  (data $json_exit "{\22event\22:\22exit\22")
+  (data $json_context "{\22event\22:\22context\22,\22depth\22:")
+  (data $json_function ",\22function\22:\22")
+  (data $json_depth "\22,\22depth\22:")
+  (data $json_params ",\22params\22:[")
+  (data $json_params_end "]}\0a")
+  (data $json_param_name "{\22name\22:\22")
+  (data $json_param_name_end "\22,")
+  (data $json_type_i32 "\22type\22:\22i32\22,\22value\22:\220x")
+  (data $json_type_i64 "\22type\22:\22i64\22,\22value\22:\220x")
+  (data $json_value_end "\22}")
+  (data $json_value_f32 "\22type\22:\22f32\22,\22value\22:null}")
+  (data $json_value_f64 "\22type\22:\22f64\22,\22value\22:null}")
+  (data $json_text ",\22text\22:\22")
+  (data $json_text_end "\22}\0a")
+  (data $json_duration ",\22duration_ns\22:")
+  (data $json_result ",\22result\22:{")
+  (data $json_errno ",\22errno\22:")
+  (data $json_error ",\22error\22:\22")
+  (data $json_record_end "}\0a")
+
+  ;; Entry times for the first 100 levels of the stack
+  (data $json_timestamps 800)
+
+  (global $json_param_open (mut i32) (i32.const 0))
+)
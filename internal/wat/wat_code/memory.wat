@@ -35,6 +35,14 @@
     ;; dest / src / size
     memory.copy
 
+    ;; The program expects new memory to be zeroed, and it's where our data was
+    global.get $debug_start_mem
+    i32.const 0
+    local.get 0
+    i32.const 16
+    i32.shl
+    memory.fill
+
     global.get $debug_start_mem
     local.get 0
     i32.const 16
@@ -0,0 +1,11 @@
+(module
+
+  ;; Fuel metering. Each block of code takes its cost from $meter_fuel before it runs.
+
+  ;; meter_exhausted - Called when the fuel runs out
+  (func $meter_exhausted
+    unreachable
+  )
+
+  (global $meter_fuel (mut i64) (i64.const 0))
+)
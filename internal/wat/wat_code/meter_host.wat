@@ -0,0 +1,16 @@
+(module
+  (type (func))
+  (import "wasm_toolkit" "out_of_fuel" (func $meter_out_of_fuel (type 0)))
+
+  ;; meter_exhausted_host - Called when the fuel runs out. The host can add more fuel, or trap itself.
+  (func $meter_exhausted_host
+    call $meter_out_of_fuel
+
+    global.get $meter_fuel
+    i64.const 0
+    i64.lt_s
+    if
+      unreachable
+    end
+  )
+)
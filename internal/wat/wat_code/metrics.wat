@@ -0,0 +1,281 @@
+(module
+
+  ;; __metrics - Render the call counts and timings in the Prometheus text exposition format, for the host
+  ;; to serve while the module runs. The counts and histograms stay where timings.wat keeps them in the
+  ;; payload, one entry per function id. Each function that has been called is written as a summary, with
+  ;; the min, p50, p99 and max as quantiles 0, 0.5, 0.99 and 1. Only whole functions are written, and
+  ;; the number of bytes written is returned.
+  ;;
+  ;; The label for each function is in $metrics_labels, already escaped, with an offset and length for
+  ;; each function id in $metrics_labels_locs.
+  (func $__metrics (param $ptr i32) (param $len i32) (result i32)
+    (local $fid i32)
+    (local $dest i32)
+    (local $end i32)
+    (local $metrics_ptr i32)
+    (local $hist_ptr i32)
+    (local $label_ptr i32)
+    (local $label_len i32)
+
+    local.get $ptr
+    local.get $len
+    i32.add
+    local.set $end
+
+    i32.const length($metrics_header)
+    local.get $len
+    i32.gt_u
+    if
+      i32.const 0
+      return
+    end
+
+    local.get $ptr
+    i32.const offset($metrics_header)
+    i32.const length($metrics_header)
+    call $metrics_copy
+    local.set $dest
+
+    block
+      loop
+        local.get $fid
+        global.get $wt_all_function_length
+        i32.ge_u
+        br_if 1
+
+        local.get $fid
+        i32.const 4
+        i32.shl
+        i32.const offset($metrics_data)
+        i32.add
+        local.tee $metrics_ptr
+        i32.load
+        if
+          i32.const offset($metrics_labels_locs)
+          local.get $fid
+          i32.const 3
+          i32.shl
+          i32.add
+          local.tee $label_ptr
+          i32.load offset=4
+          local.set $label_len
+          local.get $label_ptr
+          i32.load
+          i32.const offset($metrics_labels)
+          i32.add
+          local.set $label_ptr
+
+          ;; Stop if the whole function might not fit. Each of the 6 lines has the label, and at most
+          ;; 93 bytes of metric name, quantile and number.
+          local.get $dest
+          i32.const 558
+          i32.add
+          local.get $label_len
+          i32.const 6
+          i32.mul
+          i32.add
+          local.get $end
+          i32.gt_u
+          br_if 2
+
+          local.get $fid
+          call $timings_histogram_ptr
+          local.set $hist_ptr
+
+          ;; Min is stored inverted, so that 0 is unset
+          local.get $dest
+          i32.const 0
+          i32.const 0
+          local.get $label_ptr
+          local.get $label_len
+          i32.const offset($metrics_quantile_0)
+          i32.const length($metrics_quantile_0)
+          local.get $hist_ptr
+          i64.load
+          i64.const -1
+          i64.xor
+          i64.const 0
+          local.get $hist_ptr
+          i64.load
+          i64.const 0
+          i64.ne
+          select
+          call $metrics_sample
+          local.set $dest
+
+          local.get $dest
+          i32.const 0
+          i32.const 0
+          local.get $label_ptr
+          local.get $label_len
+          i32.const offset($metrics_quantile_50)
+          i32.const length($metrics_quantile_50)
+          local.get $hist_ptr
+          i32.const 50
+          call $timings_percentile
+          call $metrics_sample
+          local.set $dest
+
+          local.get $dest
+          i32.const 0
+          i32.const 0
+          local.get $label_ptr
+          local.get $label_len
+          i32.const offset($metrics_quantile_99)
+          i32.const length($metrics_quantile_99)
+          local.get $hist_ptr
+          i32.const 99
+          call $timings_percentile
+          call $metrics_sample
+          local.set $dest
+
+          local.get $dest
+          i32.const 0
+          i32.const 0
+          local.get $label_ptr
+          local.get $label_len
+          i32.const offset($metrics_quantile_100)
+          i32.const length($metrics_quantile_100)
+          local.get $hist_ptr
+          i64.load offset=8
+          call $metrics_sample
+          local.set $dest
+
+          local.get $dest
+          i32.const offset($metrics_sum)
+          i32.const length($metrics_sum)
+          local.get $label_ptr
+          local.get $label_len
+          i32.const offset($metrics_label_end)
+          i32.const length($metrics_label_end)
+          local.get $metrics_ptr
+          i64.load offset=4
+          call $metrics_sample
+          local.set $dest
+
+          local.get $dest
+          i32.const offset($metrics_count)
+          i32.const length($metrics_count)
+          local.get $label_ptr
+          local.get $label_len
+          i32.const offset($metrics_label_end)
+          i32.const length($metrics_label_end)
+          local.get $metrics_ptr
+          i64.load32_u
+          call $metrics_sample
+          local.set $dest
+        end
+
+        local.get $fid
+        i32.const 1
+        i32.add
+        local.set $fid
+        br 0
+      end
+    end
+
+    local.get $dest
+    local.get $ptr
+    i32.sub
+  )
+
+  ;; Write a line of the summary, eg name_sum{function="label"} 1234
+  (func $metrics_sample (param $dest i32) (param $suffix_ptr i32) (param $suffix_len i32) (param $label_ptr i32) (param $label_len i32) (param $tail_ptr i32) (param $tail_len i32) (param $value i64) (result i32)
+    local.get $dest
+    i32.const offset($metrics_name)
+    i32.const length($metrics_name)
+    call $metrics_copy
+    local.get $suffix_ptr
+    local.get $suffix_len
+    call $metrics_copy
+    i32.const offset($metrics_label_start)
+    i32.const length($metrics_label_start)
+    call $metrics_copy
+    local.get $label_ptr
+    local.get $label_len
+    call $metrics_copy
+    local.get $tail_ptr
+    local.get $tail_len
+    call $metrics_copy
+    local.get $value
+    call $metrics_number
+    local.tee $dest
+    i32.const 10
+    i32.store8
+    local.get $dest
+    i32.const 1
+    i32.add
+  )
+
+  ;; Copy some bytes, and return where they end
+  (func $metrics_copy (param $dest i32) (param $src i32) (param $len i32) (result i32)
+    local.get $dest
+    local.get $src
+    local.get $len
+    memory.copy
+    local.get $dest
+    local.get $len
+    i32.add
+  )
+
+  ;; Write a number in decimal, and return where it ends
+  (func $metrics_number (param $dest i32) (param $value i64) (result i32)
+    (local $end i32)
+    (local $v i64)
+
+    ;; Count the digits first, since they're written from the end
+    local.get $dest
+    local.set $end
+    local.get $value
+    local.set $v
+    loop
+      local.get $end
+      i32.const 1
+      i32.add
+      local.set $end
+      local.get $v
+      i64.const 10
+      i64.div_u
+      local.tee $v
+      i64.const 0
+      i64.ne
+      br_if 0
+    end
+
+    local.get $end
+    local.set $dest
+    loop
+      local.get $dest
+      i32.const 1
+      i32.sub
+      local.tee $dest
+      local.get $value
+      i64.const 10
+      i64.rem_u
+      i32.wrap_i64
+      i32.const 48
+      i32.add
+      i32.store8
+      local.get $value
+      i64.const 10
+      i64.div_u
+      local.tee $value
+      i64.const 0
+      i64.ne
+      br_if 0
+    end
+
+    local.get $end
+  )
+
+  (data $metrics_header "# HELP wasm_function_duration_nanoseconds Time spent in calls to each function.\0a# TYPE wasm_function_duration_nanoseconds summary\0a")
+  (data $metrics_name "wasm_function_duration_nanoseconds")
+  (data $metrics_sum "_sum")
+  (data $metrics_count "_count")
+  (data $metrics_label_start "{function=\22")
+  (data $metrics_label_end "\22} ")
+  (data $metrics_quantile_0 "\22,quantile=\220\22} ")
+  (data $metrics_quantile_50 "\22,quantile=\220.5\22} ")
+  (data $metrics_quantile_99 "\22,quantile=\220.99\22} ")
+  (data $metrics_quantile_100 "\22,quantile=\221\22} ")
+)
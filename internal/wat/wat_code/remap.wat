@@ -0,0 +1,740 @@
+(module
+  (type (func (param i32 i32) (result i32)))
+  (type (func (param i32 i32 i32) (result i32)))
+  (type (func (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (type (func (param i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_prestat_get" (func $fd_prestat_get (type 0)))
+  (import "wasi_snapshot_preview1" "fd_prestat_dir_name" (func $fd_prestat_dir_name (type 1)))
+  (import "wasi_snapshot_preview1" "path_open" (func $path_open (type 2)))
+  (import "wasi_snapshot_preview1" "path_filestat_get" (func $path_filestat_get (type 3)))
+
+  ;; Path remapping. $wt_remaps has 16 bytes for each mapping:
+  ;;   0 guest offset, 4 guest length, 8 target offset, 12 target length
+  ;; The names are in $wt_remap_names, without any leading or trailing "/".
+  ;; A preopen called target is shown to the module as /guest. Any other path under /guest is
+  ;; rewritten to be under target instead, relative to whichever preopen holds it.
+
+  ;; remap_entry - Get the address of a mapping
+  (func $remap_entry (param $idx i32) (result i32)
+    i32.const offset($wt_remaps)
+    local.get $idx
+    i32.const 4
+    i32.shl
+    i32.add
+  )
+
+  ;; remap_mem_eq - Compare two byte ranges of the same length
+  (func $remap_mem_eq (param $a i32) (param $b i32) (param $len i32) (result i32)
+    (local $count i32)
+    block
+      loop
+        local.get $count
+        local.get $len
+        i32.ge_u
+        br_if 1
+
+        local.get $a
+        local.get $count
+        i32.add
+        i32.load8_u
+        local.get $b
+        local.get $count
+        i32.add
+        i32.load8_u
+        i32.ne
+        if
+          i32.const 0
+          return
+        end
+
+        local.get $count
+        i32.const 1
+        i32.add
+        local.set $count
+        br 0
+      end
+    end
+    i32.const 1
+  )
+
+  ;; remap_copy - Copy some bytes, and return the address after them
+  (func $remap_copy (param $dst i32) (param $src i32) (param $len i32) (result i32)
+    local.get $dst
+    local.get $src
+    local.get $len
+    memory.copy
+    local.get $dst
+    local.get $len
+    i32.add
+  )
+
+  ;; remap_normalise - Skip any leading "./" or "/", and trailing "/", into $remap_ptr and $remap_len. "." is empty.
+  (func $remap_normalise (param $ptr i32) (param $len i32)
+    block
+      loop
+        local.get $len
+        i32.const 2
+        i32.ge_u
+        if
+          local.get $ptr
+          i32.load16_u
+          i32.const 0x2f2e ;; ./
+          i32.eq
+          if
+            local.get $ptr
+            i32.const 2
+            i32.add
+            local.set $ptr
+            local.get $len
+            i32.const 2
+            i32.sub
+            local.set $len
+            br 2
+          end
+        end
+        local.get $len
+        if
+          local.get $ptr
+          i32.load8_u
+          i32.const 0x2f ;; /
+          i32.eq
+          if
+            local.get $ptr
+            i32.const 1
+            i32.add
+            local.set $ptr
+            local.get $len
+            i32.const 1
+            i32.sub
+            local.set $len
+            br 2
+          end
+        end
+      end
+    end
+
+    block
+      loop
+        local.get $len
+        i32.eqz
+        br_if 1
+        local.get $ptr
+        local.get $len
+        i32.add
+        i32.const 1
+        i32.sub
+        i32.load8_u
+        i32.const 0x2f ;; /
+        i32.ne
+        br_if 1
+        local.get $len
+        i32.const 1
+        i32.sub
+        local.set $len
+        br 0
+      end
+    end
+
+    local.get $len
+    i32.const 1
+    i32.eq
+    if
+      local.get $ptr
+      i32.load8_u
+      i32.const 0x2e ;; .
+      i32.eq
+      if
+        i32.const 0
+        local.set $len
+      end
+    end
+
+    local.get $ptr
+    global.set $remap_ptr
+    local.get $len
+    global.set $remap_len
+  )
+
+  ;; remap_has_prefix - Check if a path is a directory prefix, or the same path. An empty prefix matches everything.
+  (func $remap_has_prefix (param $ptr i32) (param $len i32) (param $prefixPtr i32) (param $prefixLen i32) (result i32)
+    local.get $prefixLen
+    i32.eqz
+    if
+      i32.const 1
+      return
+    end
+    local.get $len
+    local.get $prefixLen
+    i32.lt_u
+    if
+      i32.const 0
+      return
+    end
+    local.get $ptr
+    local.get $prefixPtr
+    local.get $prefixLen
+    call $remap_mem_eq
+    i32.eqz
+    if
+      i32.const 0
+      return
+    end
+    local.get $len
+    local.get $prefixLen
+    i32.eq
+    if
+      i32.const 1
+      return
+    end
+    local.get $ptr
+    local.get $prefixLen
+    i32.add
+    i32.load8_u
+    i32.const 0x2f ;; /
+    i32.eq
+  )
+
+  ;; remap_find_target - Find the mapping with exactly this target, or -1
+  (func $remap_find_target (param $ptr i32) (param $len i32) (result i32)
+    (local $idx i32)
+    (local $entry i32)
+    block
+      loop
+        local.get $idx
+        i32.const length($wt_remaps)
+        i32.const 4
+        i32.shr_u
+        i32.ge_u
+        br_if 1
+
+        local.get $idx
+        call $remap_entry
+        local.tee $entry
+        i32.load offset=12
+        local.get $len
+        i32.eq
+        if
+          local.get $ptr
+          i32.const offset($wt_remap_names)
+          local.get $entry
+          i32.load offset=8
+          i32.add
+          local.get $len
+          call $remap_mem_eq
+          if
+            local.get $idx
+            return
+          end
+        end
+
+        local.get $idx
+        i32.const 1
+        i32.add
+        local.set $idx
+        br 0
+      end
+    end
+    i32.const -1
+  )
+
+  ;; remap_find_guest - Find the mapping with the longest guest prefix of a path, or -1
+  (func $remap_find_guest (param $ptr i32) (param $len i32) (result i32)
+    (local $idx i32)
+    (local $entry i32)
+    (local $best i32)
+    (local $bestLen i32)
+    i32.const -1
+    local.set $best
+    i32.const -1
+    local.set $bestLen
+    block
+      loop
+        local.get $idx
+        i32.const length($wt_remaps)
+        i32.const 4
+        i32.shr_u
+        i32.ge_u
+        br_if 1
+
+        local.get $idx
+        call $remap_entry
+        local.set $entry
+        local.get $entry
+        i32.load offset=4
+        local.get $bestLen
+        i32.gt_s
+        if
+          local.get $ptr
+          local.get $len
+          i32.const offset($wt_remap_names)
+          local.get $entry
+          i32.load
+          i32.add
+          local.get $entry
+          i32.load offset=4
+          call $remap_has_prefix
+          if
+            local.get $idx
+            local.set $best
+            local.get $entry
+            i32.load offset=4
+            local.set $bestLen
+          end
+        end
+
+        local.get $idx
+        i32.const 1
+        i32.add
+        local.set $idx
+        br 0
+      end
+    end
+    local.get $best
+  )
+
+  ;; remap_dir_name - Get the host name of a preopened directory into $remap_dir, and return its length or -1
+  (func $remap_dir_name (param $fd i32) (result i32)
+    (local $len i32)
+    local.get $fd
+    i32.const offset($remap_prestat)
+    call $fd_prestat_get
+    if
+      i32.const -1
+      return
+    end
+    i32.const offset($remap_prestat)
+    i32.load8_u
+    if
+      ;; Not a directory
+      i32.const -1
+      return
+    end
+    i32.const offset($remap_prestat)
+    i32.load offset=4
+    local.tee $len
+    i32.const length($remap_dir)
+    i32.gt_u
+    if
+      i32.const -1
+      return
+    end
+    local.get $fd
+    i32.const offset($remap_dir)
+    local.get $len
+    call $fd_prestat_dir_name
+    if
+      i32.const -1
+      return
+    end
+    local.get $len
+  )
+
+  ;; remap_set_path - Set $remap_path_ptr and $remap_path_len, using "." for an empty path
+  (func $remap_set_path (param $ptr i32) (param $len i32)
+    local.get $ptr
+    local.get $len
+    call $remap_normalise
+    global.get $remap_len
+    if
+      global.get $remap_ptr
+      global.set $remap_path_ptr
+      global.get $remap_len
+      global.set $remap_path_len
+    else
+      i32.const offset($remap_dot)
+      global.set $remap_path_ptr
+      i32.const 1
+      global.set $remap_path_len
+    end
+  )
+
+  ;; remap_resolve - Work out the fd and path to really use into $remap_fd, $remap_path_ptr and $remap_path_len
+  (func $remap_resolve (param $fd i32) (param $pathPtr i32) (param $pathLen i32)
+    (local $len i32)
+    (local $dirPtr i32)
+    (local $dirLen i32)
+    (local $p i32)
+    (local $idx i32)
+    (local $entry i32)
+    (local $absPtr i32)
+    (local $absLen i32)
+    (local $newPtr i32)
+    (local $newLen i32)
+    (local $bestFd i32)
+    (local $bestLen i32)
+    (local $f i32)
+
+    local.get $fd
+    global.set $remap_fd
+    local.get $pathPtr
+    global.set $remap_path_ptr
+    local.get $pathLen
+    global.set $remap_path_len
+
+    local.get $fd
+    call $remap_dir_name
+    local.tee $len
+    i32.const 0
+    i32.lt_s
+    if
+      return
+    end
+    i32.const offset($remap_dir)
+    local.get $len
+    call $remap_normalise
+    global.get $remap_ptr
+    local.set $dirPtr
+    global.get $remap_len
+    local.set $dirLen
+
+    ;; The module already sees this preopen as the guest path, so the path is fine as it is
+    local.get $dirPtr
+    local.get $dirLen
+    call $remap_find_target
+    i32.const -1
+    i32.ne
+    if
+      return
+    end
+
+    ;; The full path, as dir/path
+    local.get $dirLen
+    local.get $pathLen
+    i32.add
+    i32.const 1
+    i32.add
+    i32.const length($remap_abs)
+    i32.gt_u
+    if
+      return
+    end
+    i32.const offset($remap_abs)
+    local.get $dirPtr
+    local.get $dirLen
+    call $remap_copy
+    local.set $p
+    local.get $dirLen
+    if
+      local.get $p
+      i32.const 0x2f ;; /
+      i32.store8
+      local.get $p
+      i32.const 1
+      i32.add
+      local.set $p
+    end
+    local.get $p
+    local.get $pathPtr
+    local.get $pathLen
+    call $remap_copy
+    local.set $p
+    i32.const offset($remap_abs)
+    local.get $p
+    i32.const offset($remap_abs)
+    i32.sub
+    call $remap_normalise
+    global.get $remap_ptr
+    local.set $absPtr
+    global.get $remap_len
+    local.set $absLen
+
+    local.get $absPtr
+    local.get $absLen
+    call $remap_find_guest
+    local.tee $idx
+    i32.const -1
+    i32.eq
+    if
+      return
+    end
+    local.get $idx
+    call $remap_entry
+    local.set $entry
+
+    ;; The new path is "/", the target, then whatever came after the guest path
+    local.get $entry
+    i32.load offset=12
+    local.get $absLen
+    i32.add
+    local.get $entry
+    i32.load offset=4
+    i32.sub
+    i32.const 1
+    i32.add
+    i32.const length($remap_out)
+    i32.gt_u
+    if
+      return
+    end
+    i32.const offset($remap_out)
+    i32.const 0x2f ;; /
+    i32.store8
+    i32.const offset($remap_out)
+    i32.const 1
+    i32.add
+    i32.const offset($wt_remap_names)
+    local.get $entry
+    i32.load offset=8
+    i32.add
+    local.get $entry
+    i32.load offset=12
+    call $remap_copy
+    local.get $absPtr
+    local.get $entry
+    i32.load offset=4
+    i32.add
+    local.get $absLen
+    local.get $entry
+    i32.load offset=4
+    i32.sub
+    call $remap_copy
+    local.set $p
+    i32.const offset($remap_out)
+    local.get $p
+    i32.const offset($remap_out)
+    i32.sub
+    call $remap_normalise
+    global.get $remap_ptr
+    local.set $newPtr
+    global.get $remap_len
+    local.set $newLen
+
+    ;; Find the preopen with the longest name that holds the new path, starting with this one.
+    ;; They're numbered from 3 with no gaps.
+    i32.const -1
+    local.set $bestFd
+    i32.const -1
+    local.set $bestLen
+    local.get $newPtr
+    local.get $newLen
+    local.get $dirPtr
+    local.get $dirLen
+    call $remap_has_prefix
+    if
+      local.get $fd
+      local.set $bestFd
+      local.get $dirLen
+      local.set $bestLen
+    end
+    i32.const 3
+    local.set $f
+    block
+      loop
+        local.get $f
+        i32.const 67
+        i32.ge_u
+        br_if 1
+
+        local.get $f
+        call $remap_dir_name
+        local.tee $len
+        i32.const 0
+        i32.lt_s
+        br_if 1
+
+        i32.const offset($remap_dir)
+        local.get $len
+        call $remap_normalise
+        global.get $remap_len
+        local.get $bestLen
+        i32.gt_s
+        if
+          local.get $newPtr
+          local.get $newLen
+          global.get $remap_ptr
+          global.get $remap_len
+          call $remap_has_prefix
+          if
+            local.get $f
+            local.set $bestFd
+            global.get $remap_len
+            local.set $bestLen
+          end
+        end
+
+        local.get $f
+        i32.const 1
+        i32.add
+        local.set $f
+        br 0
+      end
+    end
+
+    local.get $bestFd
+    i32.const -1
+    i32.eq
+    if
+      ;; Nothing holds it on the host, but it may still be an embedded file. The path is given from the root,
+      ;; with the "/" before it, since it isn't under the directory.
+      local.get $newPtr
+      i32.const 1
+      i32.sub
+      global.set $remap_path_ptr
+      local.get $newLen
+      i32.const 1
+      i32.add
+      global.set $remap_path_len
+      return
+    end
+
+    local.get $bestFd
+    global.set $remap_fd
+    local.get $newPtr
+    local.get $bestLen
+    i32.add
+    local.get $newLen
+    local.get $bestLen
+    i32.sub
+    call $remap_set_path
+  )
+
+  (func $remap_fd_prestat_get (param $fd i32) (param $buf i32) (result i32)
+    (local $err i32)
+    (local $len i32)
+    (local $idx i32)
+    local.get $fd
+    local.get $buf
+    call $fd_prestat_get
+    local.tee $err
+    if
+      local.get $err
+      return
+    end
+
+    local.get $fd
+    call $remap_dir_name
+    local.tee $len
+    i32.const 0
+    i32.ge_s
+    if
+      i32.const offset($remap_dir)
+      local.get $len
+      call $remap_normalise
+      global.get $remap_ptr
+      global.get $remap_len
+      call $remap_find_target
+      local.tee $idx
+      i32.const -1
+      i32.ne
+      if
+        ;; The name is "/" and the guest path
+        local.get $buf
+        local.get $idx
+        call $remap_entry
+        i32.load offset=4
+        i32.const 1
+        i32.add
+        i32.store offset=4
+      end
+    end
+    i32.const 0
+  )
+
+  (func $remap_fd_prestat_dir_name (param $fd i32) (param $buf i32) (param $bufLen i32) (result i32)
+    (local $len i32)
+    (local $idx i32)
+    (local $entry i32)
+    local.get $fd
+    call $remap_dir_name
+    local.tee $len
+    i32.const 0
+    i32.ge_s
+    if
+      i32.const offset($remap_dir)
+      local.get $len
+      call $remap_normalise
+      global.get $remap_ptr
+      global.get $remap_len
+      call $remap_find_target
+      local.tee $idx
+      i32.const -1
+      i32.ne
+      if
+        local.get $idx
+        call $remap_entry
+        local.set $entry
+        local.get $bufLen
+        if
+          local.get $buf
+          i32.const 0x2f ;; /
+          i32.store8
+
+          ;; Copy as much of the guest path as fits
+          local.get $entry
+          i32.load offset=4
+          local.tee $len
+          local.get $bufLen
+          i32.const 1
+          i32.sub
+          i32.gt_u
+          if
+            local.get $bufLen
+            i32.const 1
+            i32.sub
+            local.set $len
+          end
+          local.get $buf
+          i32.const 1
+          i32.add
+          i32.const offset($wt_remap_names)
+          local.get $entry
+          i32.load
+          i32.add
+          local.get $len
+          memory.copy
+        end
+        i32.const 0
+        return
+      end
+    end
+
+    local.get $fd
+    local.get $buf
+    local.get $bufLen
+    call $fd_prestat_dir_name
+  )
+
+  (func $remap_path_open (param $dirfd i32) (param $dirflags i32) (param $pathPtr i32) (param $pathLen i32) (param $oflags i32) (param $fsRightsBase i64) (param $fsRightsInheriting i64) (param $fsFlags i32) (param $fd i32) (result i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $remap_resolve
+
+    global.get $remap_fd
+    local.get $dirflags
+    global.get $remap_path_ptr
+    global.get $remap_path_len
+    local.get $oflags
+    local.get $fsRightsBase
+    local.get $fsRightsInheriting
+    local.get $fsFlags
+    local.get $fd
+    call $path_open
+  )
+
+  (func $remap_path_filestat_get (param $dirfd i32) (param $flags i32) (param $pathPtr i32) (param $pathLen i32) (param $buf i32) (result i32)
+    local.get $dirfd
+    local.get $pathPtr
+    local.get $pathLen
+    call $remap_resolve
+
+    global.get $remap_fd
+    local.get $flags
+    global.get $remap_path_ptr
+    global.get $remap_path_len
+    local.get $buf
+    call $path_filestat_get
+  )
+
+  (data $remap_dot ".")
+  (data $remap_prestat 8)
+  (data $remap_dir 1024)
+  (data $remap_abs 2048)
+  (data $remap_out 2048)
+
+  (global $remap_ptr (mut i32) (i32.const 0))
+  (global $remap_len (mut i32) (i32.const 0))
+  (global $remap_fd (mut i32) (i32.const 0))
+  (global $remap_path_ptr (mut i32) (i32.const 0))
+  (global $remap_path_len (mut i32) (i32.const 0))
+)
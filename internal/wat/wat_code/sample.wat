@@ -0,0 +1,195 @@
+(module
+  (type (func (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "environ_sizes_get" (func $sample_environ_sizes_get (type 0)))
+  (import "wasi_snapshot_preview1" "environ_get" (func $sample_environ_get (type 0)))
+
+  ;; Sampling. Only every Nth call is traced, along with everything it calls.
+  ;; $wt_sample_depth is the depth of the call being traced, or -1 between samples.
+
+  ;; wt_sample_read_env - Read the sample rate from WASM_TOOLKIT_SAMPLE if it's set.
+  (func $wt_sample_read_env
+    (local $count i32)
+    (local $size i32)
+    (local $env i32)
+    (local $ptr i32)
+    (local $c i32)
+    (local $rate i32)
+
+    i32.const offset($sample_env_sizes)
+    i32.const offset($sample_env_sizes)
+    i32.const 4
+    i32.add
+    call $sample_environ_sizes_get
+    br_if 0
+
+    i32.const offset($sample_env_sizes)
+    i32.load
+    local.tee $count
+
+    ;; The pointers and strings need to fit in the buffer
+    i32.const 2
+    i32.shl
+    i32.const offset($sample_env_sizes)
+    i32.load offset=4
+    i32.add
+    i32.const length($sample_env_buffer)
+    i32.gt_u
+    br_if 0
+
+    i32.const offset($sample_env_buffer)
+    i32.const offset($sample_env_buffer)
+    local.get $count
+    i32.const 2
+    i32.shl
+    i32.add
+    call $sample_environ_get
+    br_if 0
+
+    block
+      loop
+        local.get $env
+        local.get $count
+        i32.ge_u
+        br_if 1
+
+        i32.const offset($sample_env_buffer)
+        local.get $env
+        i32.const 2
+        i32.shl
+        i32.add
+        i32.load
+        local.set $ptr
+
+        ;; Compare the name
+        i32.const 0
+        local.set $c
+        block
+          loop
+            local.get $c
+            i32.const length($sample_env_name)
+            i32.ge_u
+            br_if 1
+
+            local.get $ptr
+            local.get $c
+            i32.add
+            i32.load8_u
+            i32.const offset($sample_env_name)
+            local.get $c
+            i32.add
+            i32.load8_u
+            i32.ne
+            br_if 1
+
+            local.get $c
+            i32.const 1
+            i32.add
+            local.set $c
+            br 0
+          end
+        end
+
+        local.get $c
+        i32.const length($sample_env_name)
+        i32.eq
+        if
+          ;; Parse the number
+          local.get $ptr
+          local.get $c
+          i32.add
+          local.set $ptr
+          i32.const 0
+          local.set $rate
+          block
+            loop
+              local.get $ptr
+              i32.load8_u
+              i32.const 48
+              i32.sub
+              local.tee $c
+              i32.const 9
+              i32.gt_u
+              br_if 1
+
+              local.get $rate
+              i32.const 10
+              i32.mul
+              local.get $c
+              i32.add
+              local.set $rate
+
+              local.get $ptr
+              i32.const 1
+              i32.add
+              local.set $ptr
+              br 0
+            end
+          end
+          local.get $rate
+          global.set $wt_sample_rate
+          return
+        end
+
+        local.get $env
+        i32.const 1
+        i32.add
+        local.set $env
+        br 0
+      end
+    end
+  )
+
+  ;; wt_sample_enter - Called before a traced function is entered, to see if it's in a sample.
+  (func $wt_sample_enter
+    global.get $wt_sample_env_read
+    i32.eqz
+    if
+      i32.const 1
+      global.set $wt_sample_env_read
+      call $wt_sample_read_env
+    end
+
+    ;; Already inside a sampled call
+    global.get $wt_sample_depth
+    i32.const -1
+    i32.ne
+    if
+      return
+    end
+
+    global.get $wt_sample_count
+    i32.const 1
+    i32.add
+    global.set $wt_sample_count
+
+    global.get $wt_sample_count
+    global.get $wt_sample_rate
+    i32.ge_u
+    if
+      i32.const 0
+      global.set $wt_sample_count
+      global.get $debug_current_stack_depth
+      global.set $wt_sample_depth
+    end
+  )
+
+  ;; wt_sample_exit - Called after a traced function exits, to end the sample.
+  (func $wt_sample_exit
+    global.get $debug_current_stack_depth
+    global.get $wt_sample_depth
+    i32.eq
+    if
+      i32.const -1
+      global.set $wt_sample_depth
+      i32.const 1
+      global.set $wt_trace_suppressed
+    end
+  )
+
+  (data $sample_env_name "WASM_TOOLKIT_SAMPLE=")
+  (data $sample_env_sizes 8)
+  (data $sample_env_buffer 4096)
+
+  (global $wt_sample_env_read (mut i32) (i32.const 0))
+  (global $wt_sample_count (mut i32) (i32.const 0))
+)
@@ -0,0 +1,104 @@
+(module
+
+  ;; Shadow call stack. The function ID of each call in progress is kept, so a host can get a backtrace
+  ;; from __backtrace after a trap. Only the innermost $shadow_size calls are kept, as a ring of 4 byte
+  ;; entries in $shadow_stack.
+
+  ;; shadow_enter - Called when a function is entered
+  (func $shadow_enter (param $fid i32)
+    i32.const offset($shadow_stack)
+    global.get $shadow_depth
+    global.get $shadow_size
+    i32.rem_u
+    i32.const 2
+    i32.shl
+    i32.add
+    local.get $fid
+    i32.store
+
+    global.get $shadow_depth
+    i32.const 1
+    i32.add
+    global.set $shadow_depth
+  )
+
+  ;; shadow_exit - Called when a function returns
+  (func $shadow_exit
+    global.get $shadow_depth
+    i32.const 1
+    i32.sub
+    global.set $shadow_depth
+  )
+
+  ;; __backtrace - Write the function IDs of the calls in progress to $ptr as i32s, innermost first.
+  ;; No more than $len bytes are written. Returns how many were written.
+  (func $__backtrace (param $ptr i32) (param $len i32) (result i32)
+    (local $i i32)
+    (local $count i32)
+
+    ;; The smallest of the depth, the ring size, and the room given
+    global.get $shadow_depth
+    local.set $count
+    local.get $count
+    global.get $shadow_size
+    i32.gt_u
+    if
+      global.get $shadow_size
+      local.set $count
+    end
+    local.get $count
+    local.get $len
+    i32.const 2
+    i32.shr_u
+    i32.gt_u
+    if
+      local.get $len
+      i32.const 2
+      i32.shr_u
+      local.set $count
+    end
+
+    block
+      loop
+        local.get $i
+        local.get $count
+        i32.ge_u
+        br_if 1
+
+        local.get $ptr
+        local.get $i
+        i32.const 2
+        i32.shl
+        i32.add
+
+        i32.const offset($shadow_stack)
+        global.get $shadow_depth
+        i32.const 1
+        i32.sub
+        local.get $i
+        i32.sub
+        global.get $shadow_size
+        i32.rem_u
+        i32.const 2
+        i32.shl
+        i32.add
+        i32.load
+
+        i32.store
+
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+
+    local.get $count
+  )
+
+  (global $shadow_depth (mut i32) (i32.const 0))
+
+  ;; Config
+  (global $shadow_size (mut i32) (i32.const 0))
+)
@@ -0,0 +1,223 @@
+(module
+
+  ;; Snapshot and restore. The host gives a buffer laid out as
+  ;;   0     i32 end of the buffer (set by the host)
+  ;;   4     i32 where the next saved page goes
+  ;;   8     dirty page bitmap, one bit for each of the 65536 possible pages
+  ;;   8200  mutable globals, 8 bytes each
+  ;;   then  saved pages, an i32 page number and the 65536 bytes it had at the snapshot
+  ;; A page is saved the first time it's written to after a snapshot, so restoring only copies those back.
+
+  ;; __snapshot_touch - Called before every write to memory
+  (func $__snapshot_touch (param $addr i32) (param $offset i32) (param $len i32)
+    (local $page i32)
+    (local $last i32)
+    (local $p i64)
+    global.get $__snapshot_ptr
+    i32.eqz
+    if
+      return
+    end
+    local.get $len
+    i32.eqz
+    if
+      return
+    end
+    local.get $addr
+    i64.extend_i32_u
+    local.get $offset
+    i64.extend_i32_u
+    i64.add
+    local.tee $p
+    i64.const 16
+    i64.shr_u
+    i32.wrap_i64
+    local.set $page
+    local.get $p
+    local.get $len
+    i64.extend_i32_u
+    i64.add
+    i64.const 1
+    i64.sub
+    i64.const 16
+    i64.shr_u
+    i32.wrap_i64
+    local.set $last
+    ;; The write is going to trap if it's past the end of memory
+    local.get $last
+    memory.size
+    i32.ge_u
+    if
+      return
+    end
+    block
+      loop
+        local.get $page
+        local.get $last
+        i32.gt_u
+        br_if 1
+        local.get $page
+        call $__snapshot_save_page
+        local.get $page
+        i32.const 1
+        i32.add
+        local.set $page
+        br 0
+      end
+    end
+  )
+
+  ;; __snapshot_save_page - Save a page unless it's already dirty
+  (func $__snapshot_save_page (param $page i32)
+    (local $byte i32)
+    (local $bit i32)
+    (local $rec i32)
+    global.get $__snapshot_ptr
+    local.get $page
+    i32.const 3
+    i32.shr_u
+    i32.add
+    local.tee $byte
+    i32.load8_u offset=8
+    i32.const 1
+    local.get $page
+    i32.const 7
+    i32.and
+    i32.shl
+    local.tee $bit
+    i32.and
+    if
+      return
+    end
+    local.get $byte
+    local.get $byte
+    i32.load8_u offset=8
+    local.get $bit
+    i32.or
+    i32.store8 offset=8
+    global.get $__snapshot_ptr
+    i32.load offset=4
+    local.tee $rec
+    i32.const 65540
+    i32.add
+    global.get $__snapshot_ptr
+    i32.load
+    i32.gt_u
+    if
+      unreachable
+    end
+    local.get $rec
+    local.get $page
+    i32.store
+    local.get $rec
+    i32.const 4
+    i32.add
+    local.get $page
+    i32.const 16
+    i32.shl
+    call $__snapshot_copy_page
+    global.get $__snapshot_ptr
+    local.get $rec
+    i32.const 65540
+    i32.add
+    i32.store offset=4
+  )
+
+  ;; __snapshot_copy_page - Copy a whole page. This is kept on its own, since wazero 1.7's
+  ;; compiler gets the bounds check wrong when the copy is part of $__snapshot_save_page.
+  (func $__snapshot_copy_page (param $dest i32) (param $src i32)
+    local.get $dest
+    local.get $src
+    i32.const 65536
+    memory.copy
+  )
+
+  ;; __snapshot_reset - Start tracking writes with no pages saved
+  (func $__snapshot_reset (param $ptr i32)
+    local.get $ptr
+    global.set $__snapshot_ptr
+    local.get $ptr
+    local.get $ptr
+    i32.const 8200
+    i32.add
+    global.get $__snapshot_globals_size
+    i32.add
+    i32.store offset=4
+    local.get $ptr
+    i32.load offset=4
+    local.get $ptr
+    i32.load
+    i32.gt_u
+    if
+      unreachable
+    end
+    local.get $ptr
+    i32.const 8
+    i32.add
+    i32.const 0
+    i32.const 8192
+    memory.fill
+  )
+
+  ;; __snapshot - Take a snapshot into the buffer at $ptr. A $ptr of 0 stops tracking.
+  (func $__snapshot (param $ptr i32)
+    local.get $ptr
+    i32.eqz
+    if
+      i32.const 0
+      global.set $__snapshot_ptr
+      return
+    end
+    local.get $ptr
+    call $__snapshot_reset
+    local.get $ptr
+    i32.const 8200
+    i32.add
+    call $__snapshot_save_globals
+  )
+
+  ;; __restore - Go back to the snapshot in the buffer at $ptr. It can be restored again later.
+  (func $__restore (param $ptr i32)
+    (local $rec i32)
+    (local $end i32)
+    local.get $ptr
+    i32.load offset=4
+    local.set $end
+    local.get $ptr
+    i32.const 8200
+    i32.add
+    global.get $__snapshot_globals_size
+    i32.add
+    local.set $rec
+    block
+      loop
+        local.get $rec
+        local.get $end
+        i32.ge_u
+        br_if 1
+        local.get $rec
+        i32.load
+        i32.const 16
+        i32.shl
+        local.get $rec
+        i32.const 4
+        i32.add
+        call $__snapshot_copy_page
+        local.get $rec
+        i32.const 65540
+        i32.add
+        local.set $rec
+        br 0
+      end
+    end
+    local.get $ptr
+    i32.const 8200
+    i32.add
+    call $__snapshot_load_globals
+    local.get $ptr
+    call $__snapshot_reset
+  )
+
+  (global $__snapshot_ptr (mut i32) (i32.const 0))
+  (global $__snapshot_globals_size (mut i32) (i32.const 0))
+)
@@ -0,0 +1,217 @@
+(module
+
+  ;; Stack depth tracking. Every function counts its depth on entry and exit, and the deepest call is kept.
+  ;; The lowest value of the stack pointer global is kept too, as linear memory stacks grow down.
+
+  ;; stack_print_num - Print a number, right aligned to a width
+  (func $stack_print_num (param $num i64) (param $width i32)
+    local.get $num
+    call $wt_format_i64_dec_nz
+
+    local.get $num
+    i64.eqz
+    if
+      i32.const offset($db_number_i64)
+      i32.const 48 ;; 0
+      i32.store8 offset=18
+    end
+
+    i32.const offset($db_number_i64)
+    i32.const 19
+    i32.add
+    local.get $width
+    i32.sub
+    local.get $width
+    call $wt_print
+  )
+
+  ;; stack_print_function_name - Given a function ID, print out the function name.
+  (func $stack_print_function_name (param $fid i32)
+    (local $ptr i32)
+    i32.const offset($wt_all_function_names_locs)
+    local.get $fid
+    i32.const 3
+    i32.shl
+    i32.add
+    local.tee $ptr
+    i32.load
+
+    i32.const offset($wt_all_function_names)
+    i32.add
+
+    local.get $ptr
+    i32.load offset=4
+    call $wt_print
+  )
+
+  ;; stack_enter - Called when a function is entered
+  (func $stack_enter (param $fid i32)
+    global.get $stack_depth
+    i32.const 1
+    i32.add
+    global.set $stack_depth
+
+    global.get $stack_depth
+    global.get $stack_max_depth
+    i32.gt_u
+    if
+      global.get $stack_depth
+      global.set $stack_max_depth
+      local.get $fid
+      global.set $stack_max_fid
+    end
+
+    global.get $stack_limit
+    i32.eqz
+    if
+      return
+    end
+
+    global.get $stack_depth
+    global.get $stack_limit
+    i32.gt_u
+    if
+      i32.const offset($stack_log_start)
+      i32.const length($stack_log_start)
+      call $wt_print
+
+      i32.const offset($stack_limit_exceeded)
+      i32.const length($stack_limit_exceeded)
+      call $wt_print
+
+      local.get $fid
+      call $stack_print_function_name
+
+      i32.const offset($stack_newline)
+      i32.const length($stack_newline)
+      call $wt_print
+
+      call $stack_report
+      unreachable
+    end
+  )
+
+  ;; stack_enter_sp - Called when a function is entered, with the current stack pointer
+  (func $stack_enter_sp (param $fid i32) (param $sp i32)
+    local.get $sp
+    global.get $stack_sp_lowest
+    i32.lt_u
+    if
+      local.get $sp
+      global.set $stack_sp_lowest
+    end
+
+    local.get $fid
+    call $stack_enter
+  )
+
+  ;; stack_exit - Called when a function returns
+  (func $stack_exit
+    global.get $stack_depth
+    i32.const 1
+    i32.sub
+    global.set $stack_depth
+  )
+
+  ;; stack_report - Print the deepest call, and stack pointer use. Only done once.
+  (func $stack_report
+    global.get $stack_reported
+    if
+      return
+    end
+    i32.const 1
+    global.set $stack_reported
+
+    i32.const offset($stack_log_start)
+    i32.const length($stack_log_start)
+    call $wt_print
+
+    global.get $stack_max_depth
+    i64.extend_i32_u
+    i32.const 12
+    call $stack_print_num
+
+    i32.const offset($stack_report_depth)
+    i32.const length($stack_report_depth)
+    call $wt_print
+
+    global.get $stack_max_depth
+    if
+      i32.const offset($stack_report_in)
+      i32.const length($stack_report_in)
+      call $wt_print
+
+      global.get $stack_max_fid
+      call $stack_print_function_name
+
+      i32.const offset($stack_report_in_end)
+      i32.const length($stack_report_in_end)
+      call $wt_print
+    end
+
+    i32.const offset($stack_newline)
+    i32.const length($stack_newline)
+    call $wt_print
+
+    ;; Stack pointer use, if there's a stack pointer and it was seen
+    global.get $stack_sp_tracked
+    i32.eqz
+    if
+      return
+    end
+    global.get $stack_sp_lowest
+    i32.const -1
+    i32.eq
+    if
+      return
+    end
+
+    i32.const offset($stack_log_start)
+    i32.const length($stack_log_start)
+    call $wt_print
+
+    global.get $stack_sp_start
+    global.get $stack_sp_lowest
+    i32.sub
+    i64.extend_i32_u
+    i32.const 12
+    call $stack_print_num
+
+    i32.const offset($stack_report_used)
+    i32.const length($stack_report_used)
+    call $wt_print
+
+    global.get $stack_sp_lowest
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    i32.const offset($stack_report_in_end)
+    i32.const length($stack_report_in_end)
+    call $wt_print
+
+    i32.const offset($stack_newline)
+    i32.const length($stack_newline)
+    call $wt_print
+  )
+
+  (data $stack_log_start "stackdepth: ")
+  (data $stack_newline "\0d\0a")
+  (data $stack_limit_exceeded "call depth limit exceeded, calling ")
+  (data $stack_report_depth " max call depth")
+  (data $stack_report_in " (in ")
+  (data $stack_report_in_end ")")
+  (data $stack_report_used " stack bytes used (lowest stack pointer 0x")
+
+  (global $stack_depth (mut i32) (i32.const 0))
+  (global $stack_max_depth (mut i32) (i32.const 0))
+  (global $stack_max_fid (mut i32) (i32.const 0))
+  (global $stack_reported (mut i32) (i32.const 0))
+  (global $stack_sp_lowest (mut i32) (i32.const -1))
+
+  ;; Config
+  (global $stack_limit (mut i32) (i32.const 0))
+  (global $stack_sp_tracked (mut i32) (i32.const 0))
+  (global $stack_sp_start (mut i32) (i32.const 0))
+)
@@ -6,6 +6,12 @@
   (func $wt_print (param $ptr i32) (param $len i32)
     (local $iovp i32)
 
+    ;; Nothing is printed while the trace is too deep
+    global.get $wt_trace_suppressed
+    if
+      return
+    end
+
     i32.const offset($iovec)
 
     local.tee $iovp
@@ -16,7 +22,7 @@
     local.get $len
     i32.store offset=4
 
-    i32.const 2
+    global.get $wt_trace_fd
     local.get $iovp
     i32.const 1
     i32.const offset($bytes_written)
@@ -528,6 +534,10 @@
   (data $iovec 8)
   (data $bytes_written 4)
 
+  ;; Where the output goes, stderr by default
+  (global $wt_trace_fd (mut i32) (i32.const 2))
+  (global $wt_trace_suppressed (mut i32) (i32.const 0))
+
   ;; For number to string conversions
   (data $db_hex "0123456789abcdef ")
   (data $db_number_i32 10)
@@ -83,6 +83,35 @@
   )
 
 
+  ;; debug_update_suppressed - Suppress output if the current depth is past the max depth, or between samples.
+  (func $debug_update_suppressed (result i32)
+    global.get $wt_max_depth
+    if
+      global.get $debug_current_stack_depth
+      global.get $wt_max_depth
+      i32.ge_u
+      global.set $wt_trace_suppressed
+    end
+    global.get $wt_sample_rate
+    if
+      global.get $wt_sample_depth
+      i32.const -1
+      i32.eq
+      if
+        i32.const 1
+        global.set $wt_trace_suppressed
+      else
+        global.get $wt_max_depth
+        i32.eqz
+        if
+          i32.const 0
+          global.set $wt_trace_suppressed
+        end
+      end
+    end
+    global.get $wt_trace_suppressed
+  )
+
   (func $debug_param_separator
     i32.const offset($debug_param_sep)
     i32.const length($debug_param_sep)
@@ -94,11 +123,11 @@
     global.get $debug_current_stack_depth
     local.set $count
 
-    block
-      loop
+    block $done
+      loop $next
         local.get $count
         i32.eqz
-        br_if 1
+        br_if $done
 
         i32.const offset($debug_sp)
         i32.const length($debug_sp)
@@ -108,7 +137,7 @@
         i32.const 1
         i32.sub
         local.set $count
-        br 0
+        br $next
       end
     end
 
@@ -239,35 +268,81 @@
   (func $debug_strlen (param $ptr i32) (result i32)
     (local $count i32)
 
-    block
-      loop
+    block $done
+      loop $next
         local.get $count
         local.get $ptr
         i32.add
         i32.load8_u
         i32.eqz
-        br_if 1
+        br_if $done
 
         local.get $count
         i32.const 1
         i32.add
         local.set $count
-        br 0
+        br $next
       end
     end
 
     local.get $count
   )
 
+  ;; debug_print_string - Print a string from memory in quotes, up to 64 bytes of it
+  (func $debug_print_string (param $ptr i32) (param $len i32)
+    local.get $ptr
+    i32.eqz
+    if
+      i32.const offset($debug_null)
+      i32.const length($debug_null)
+      call $wt_print
+      return
+    end
+
+    i32.const offset($debug_quote)
+    i32.const length($debug_quote)
+    call $wt_print
+
+    local.get $ptr
+    local.get $len
+    i32.const 64
+    local.get $len
+    i32.const 64
+    i32.lt_u
+    select
+    call $wt_print
+
+    i32.const offset($debug_quote)
+    i32.const length($debug_quote)
+    call $wt_print
+  )
+
+  ;; debug_print_cstring - Print a zero terminated string
+  (func $debug_print_cstring (param $ptr i32)
+    local.get $ptr
+    i32.eqz
+    if
+      i32.const offset($debug_null)
+      i32.const length($debug_null)
+      call $wt_print
+      return
+    end
+
+    local.get $ptr
+    local.get $ptr
+    call $debug_strlen
+    call $debug_print_string
+  )
+
   (func $dd_wasi_get_something (param $argv i32) (param $argvBuf i32) (param $len i32) (param $str_ptr i32) (param $str_len i32)
     (local $count i32)
 
-    block
-      loop
+    block $done
+      loop $next
         local.get $count
         local.get $len
         i32.eq
-        br_if 1
+        br_if $done
 
         ;; Print out the arg here...
         local.get $str_ptr
@@ -293,12 +368,265 @@
         i32.const 1
         i32.add
         local.set $count
+        br $next
+      end
+    end
+  )
+
+  ;; debug_print_escaped_char - Print a single byte as an escape sequence
+  (func $debug_print_escaped_char (param $c i32)
+    (local $e i32)
+    block
+      block
+        local.get $c
+        i32.const 10
+        i32.eq
+        if
+          i32.const 110 ;; n
+          local.set $e
+          br 1
+        end
+        local.get $c
+        i32.const 13
+        i32.eq
+        if
+          i32.const 114 ;; r
+          local.set $e
+          br 1
+        end
+        local.get $c
+        i32.const 9
+        i32.eq
+        if
+          i32.const 116 ;; t
+          local.set $e
+          br 1
+        end
+        local.get $c
+        i32.const 34
+        i32.eq
+        local.get $c
+        i32.const 92
+        i32.eq
+        i32.or
+        if
+          local.get $c
+          local.set $e
+          br 1
+        end
+
+        ;; Anything else is printed as hex \xNN
+        i32.const offset($dd_escape_hex)
+        local.get $c
+        i32.const 4
+        i32.shr_u
+        i32.const offset($db_hex)
+        i32.add
+        i32.load8_u
+        i32.store8 offset=2
+
+        i32.const offset($dd_escape_hex)
+        local.get $c
+        i32.const 15
+        i32.and
+        i32.const offset($db_hex)
+        i32.add
+        i32.load8_u
+        i32.store8 offset=3
+
+        i32.const offset($dd_escape_hex)
+        i32.const length($dd_escape_hex)
+        call $wt_print
+        br 1
+      end
+
+      i32.const offset($dd_escape)
+      local.get $e
+      i32.store8 offset=1
+
+      i32.const offset($dd_escape)
+      i32.const length($dd_escape)
+      call $wt_print
+    end
+  )
+
+  ;; debug_print_escaped - Print a buffer with any non printable bytes escaped. At most $limit
+  ;; bytes are printed, and the limit left over is returned (negative if the buffer was truncated).
+  (func $debug_print_escaped (param $ptr i32) (param $len i32) (param $limit i32) (result i32)
+    (local $end i32)
+    (local $run i32)
+    (local $c i32)
+
+    local.get $ptr
+    local.get $len
+    local.get $limit
+    local.get $len
+    local.get $limit
+    i32.lt_s
+    select
+    i32.const 0
+    local.get $limit
+    i32.const 0
+    i32.gt_s
+    select
+    i32.add
+    local.set $end
+
+    local.get $ptr
+    local.set $run
+
+    block
+      loop
+        local.get $ptr
+        local.get $end
+        i32.ge_u
+        br_if 1
+
+        local.get $ptr
+        i32.load8_u
+        local.tee $c
+        i32.const 32
+        i32.lt_u
+        local.get $c
+        i32.const 127
+        i32.ge_u
+        i32.or
+        local.get $c
+        i32.const 34
+        i32.eq
+        i32.or
+        local.get $c
+        i32.const 92
+        i32.eq
+        i32.or
+        if
+          ;; Flush anything printable so far, then the escape
+          local.get $run
+          local.get $ptr
+          local.get $run
+          i32.sub
+          call $wt_print
+
+          local.get $c
+          call $debug_print_escaped_char
+
+          local.get $ptr
+          i32.const 1
+          i32.add
+          local.set $run
+        end
+
+        local.get $ptr
+        i32.const 1
+        i32.add
+        local.set $ptr
         br 0
       end
     end
+
+    local.get $run
+    local.get $end
+    local.get $run
+    i32.sub
+    call $wt_print
+
+    local.get $limit
+    local.get $len
+    i32.sub
+  )
+
+  ;; debug_print_path - Print a whole string escaped, without quotes
+  (func $debug_print_path (param $ptr i32) (param $len i32)
+    local.get $ptr
+    local.get $len
+    local.get $len
+    call $debug_print_escaped
+    drop
+  )
+
+  ;; debug_print_iovecs - Print the contents of an iovec array, up to $total bytes and at most
+  ;; $wt_max_string_len bytes.
+  (func $debug_print_iovecs (param $str_ptr i32) (param $str_len i32) (param $iovs i32) (param $iovs_len i32) (param $total i32)
+    (local $limit i32)
+    (local $len i32)
+
+    local.get $str_ptr
+    local.get $str_len
+    call $debug_func_wasi_context
+
+    global.get $wt_max_string_len
+    local.set $limit
+
+    block
+      loop
+        local.get $iovs_len
+        i32.eqz
+        local.get $total
+        i32.eqz
+        i32.or
+        local.get $limit
+        i32.const 0
+        i32.lt_s
+        i32.or
+        br_if 1
+
+        ;; Only the bytes actually transferred are printed
+        local.get $iovs
+        i32.load offset=4
+        local.tee $len
+        local.get $total
+        local.get $len
+        local.get $total
+        i32.lt_u
+        select
+        local.set $len
+
+        local.get $total
+        local.get $len
+        i32.sub
+        local.set $total
+
+        local.get $iovs
+        i32.load
+        local.get $len
+        local.get $limit
+        call $debug_print_escaped
+        local.set $limit
+
+        local.get $iovs
+        i32.const 8
+        i32.add
+        local.set $iovs
+
+        local.get $iovs_len
+        i32.const 1
+        i32.sub
+        local.set $iovs_len
+        br 0
+      end
+    end
+
+    i32.const offset($debug_quote)
+    i32.const length($debug_quote)
+    call $wt_print
+
+    local.get $limit
+    i32.const 0
+    i32.lt_s
+    if
+      i32.const offset($dd_wasi_var_truncated)
+      i32.const length($dd_wasi_var_truncated)
+      call $wt_print
+    end
+
+    call $debug_func_wasi_done
   )
 
   (data $debug_param_name_end "=")
+  (data $debug_typed_start " {")
+  (data $debug_typed_end "}")
+  (data $debug_null "NULL")
+  (data $debug_quote "\22")
 
   (data $debug_newline "\0d\0a")
   (data $debug_enter "-> ")
@@ -320,15 +648,25 @@
   (data $dd_wasi_res_sizeenvs " =>size_envs = ")
   (data $dd_wasi_res_envs " =>envs = \22")
   (data $dd_wasi_res_timestamp " =>timestamp = ")
+  (data $dd_wasi_res_fd " =>fd = ")
 
   (data $dd_wasi_var_path "   path = \22")
   (data $dd_wasi_var_rename "\22 -> \22")
   (data $dd_wasi_var_end_string "\22\0d\0a")
   (data $dd_wasi_var_end "\0d\0a")
+  (data $dd_wasi_var_data "   data = \22")
+  (data $dd_wasi_res_data " =>data = \22")
+  (data $dd_wasi_var_truncated "...")
+  (data $dd_escape "\5c ")
+  (data $dd_escape_hex "\5cx00")
 
   (data $error_stack_overflow "Error: The timings stack overflowed. You win some you lose some I guess.\0d\0a")
 
   (global $debug_current_stack_depth (mut i32) (i32.const 0))
+  (global $wt_max_depth (mut i32) (i32.const 0))
+  (global $wt_sample_rate (mut i32) (i32.const 0))
+  (global $wt_sample_depth (mut i32) (i32.const -1))
+  (global $wt_max_string_len (mut i32) (i32.const 32))
 
   (global $wasi_result_args_get_count (mut i32) (i32.const 0))
   (global $wasi_result_envs_get_count (mut i32) (i32.const 0))
@@ -60,6 +60,7 @@
 
   (func $timings_exit_func (param $fid i32)
     (local $metrics_ptr i32)
+    (local $duration i64)
 
     ;; Update metrics
     local.get $fid
@@ -83,11 +84,227 @@
     i64.load
 
     i64.sub
+    local.tee $duration
 
     local.get $metrics_ptr
     i64.load offset=4
     i64.add
     i64.store offset=4  
+
+    local.get $fid
+    local.get $duration
+    call $timings_histogram_add
+  )
+
+  ;; timings_histogram_ptr - Get the histogram for a function. These live after the payload data.
+  ;;
+  ;; histogram entry
+  ;; 8 bytes i64  Min time (inverted, so that 0 means unset)
+  ;; 8 bytes i64  Max time
+  ;; 48 x 4 bytes i32  Counts for each log2 bucket. Bucket n has times up to 2^n - 1
+  (func $timings_histogram_ptr (param $fid i32) (result i32)
+    global.get $debug_start_mem
+    global.get $metrics_histograms_rel
+    i32.add
+    local.get $fid
+    i32.const 208
+    i32.mul
+    i32.add
+  )
+
+  (func $timings_histogram_add (param $fid i32) (param $duration i64)
+    (local $hist_ptr i32)
+    (local $bucket i32)
+    local.get $fid
+    call $timings_histogram_ptr
+    local.tee $hist_ptr
+
+    ;; Min
+    local.get $duration
+    i64.const -1
+    i64.xor
+    local.get $hist_ptr
+    i64.load
+    local.get $duration
+    i64.const -1
+    i64.xor
+    local.get $hist_ptr
+    i64.load
+    i64.gt_u
+    select
+    i64.store
+
+    ;; Max
+    local.get $hist_ptr
+    local.get $duration
+    local.get $hist_ptr
+    i64.load offset=8
+    local.get $duration
+    local.get $hist_ptr
+    i64.load offset=8
+    i64.gt_u
+    select
+    i64.store offset=8
+
+    ;; Bucket is the number of bits needed for the duration
+    i64.const 64
+    local.get $duration
+    i64.clz
+    i64.sub
+    i32.wrap_i64
+    local.tee $bucket
+    i32.const 47
+    local.get $bucket
+    i32.const 47
+    i32.lt_u
+    select
+    i32.const 2
+    i32.shl
+    local.get $hist_ptr
+    i32.add
+    local.tee $hist_ptr
+    local.get $hist_ptr
+    i32.load offset=16
+    i32.const 1
+    i32.add
+    i32.store offset=16
+  )
+
+  ;; timings_percentile - Estimate a percentile from the histogram, as the top of the bucket it's in.
+  (func $timings_percentile (param $hist_ptr i32) (param $percent i32) (result i64)
+    (local $total i32)
+    (local $target i32)
+    (local $bucket i32)
+    (local $value i64)
+
+    ;; Count everything up
+    block
+      loop
+        local.get $bucket
+        i32.const 48
+        i32.ge_u
+        br_if 1
+
+        local.get $bucket
+        i32.const 2
+        i32.shl
+        local.get $hist_ptr
+        i32.add
+        i32.load offset=16
+        local.get $total
+        i32.add
+        local.set $total
+
+        local.get $bucket
+        i32.const 1
+        i32.add
+        local.set $bucket
+        br 0
+      end
+    end
+
+    local.get $total
+    i32.eqz
+    if
+      i64.const 0
+      return
+    end
+
+    ;; target = ceil(total * percent / 100)
+    local.get $total
+    i64.extend_i32_u
+    local.get $percent
+    i64.extend_i32_u
+    i64.mul
+    i64.const 99
+    i64.add
+    i64.const 100
+    i64.div_u
+    i32.wrap_i64
+    local.set $target
+
+    i32.const 0
+    local.set $total
+    i32.const 0
+    local.set $bucket
+    block
+      loop
+        local.get $bucket
+        i32.const 2
+        i32.shl
+        local.get $hist_ptr
+        i32.add
+        i32.load offset=16
+        local.get $total
+        i32.add
+        local.tee $total
+        local.get $target
+        i32.ge_u
+        br_if 1
+
+        local.get $bucket
+        i32.const 1
+        i32.add
+        local.tee $bucket
+        i32.const 47
+        i32.lt_u
+        br_if 0
+      end
+    end
+
+    ;; Top of the bucket, limited to the min and max seen
+    i64.const 1
+    local.get $bucket
+    i64.extend_i32_u
+    i64.shl
+    i64.const 1
+    i64.sub
+    local.tee $value
+    local.get $hist_ptr
+    i64.load offset=8
+    local.get $value
+    local.get $hist_ptr
+    i64.load offset=8
+    i64.lt_u
+    select
+    local.set $value
+
+    local.get $hist_ptr
+    i64.load
+    i64.const -1
+    i64.xor
+    local.get $value
+    local.get $value
+    local.get $hist_ptr
+    i64.load
+    i64.const -1
+    i64.xor
+    i64.lt_u
+    select
+  )
+
+  ;; timings_print_ns - Print a time column
+  (func $timings_print_ns (param $value i64)
+    local.get $value
+    call $wt_format_i64_dec_nz
+
+    local.get $value
+    i64.eqz
+    if
+      i32.const offset($db_number_i64)
+      i32.const 48 ;; 0
+      i32.store8 offset=18
+    end
+
+    i32.const offset($db_number_i64)
+    i32.const 7
+    i32.add
+    i32.const 12
+    call $wt_print
+
+    i32.const offset($debug_table_sep)
+    i32.const length($debug_table_sep)
+    call $wt_print
   )
 
   (func $debug_summary_maybe
@@ -103,6 +320,7 @@
   (func $debug_summary_func (param $fid i32)
     (local $metric_count i32)
     (local $metrics_ptr i32)
+    (local $hist_ptr i32)
     local.get $fid
     i32.const 4
     i32.shl
@@ -138,6 +356,37 @@
     i32.const length($debug_table_sep)
     call $wt_print
 
+    ;; Latency distribution
+    local.get $fid
+    call $timings_histogram_ptr
+    local.set $hist_ptr
+
+    local.get $hist_ptr
+    i64.load
+    i64.const -1
+    i64.xor
+    i64.const 0
+    local.get $hist_ptr
+    i64.load
+    i64.const 0
+    i64.ne
+    select
+    call $timings_print_ns
+
+    local.get $hist_ptr
+    i32.const 50
+    call $timings_percentile
+    call $timings_print_ns
+
+    local.get $hist_ptr
+    i32.const 99
+    call $timings_percentile
+    call $timings_print_ns
+
+    local.get $hist_ptr
+    i64.load offset=8
+    call $timings_print_ns
+
     local.get $fid
     call $wt_print_function_name
 
@@ -185,6 +434,146 @@
     end
   )
 
+  ;; __wasm_toolkit_stats - Copy the current call counts and timings into memory, for the host to read while the module runs.
+  ;; Only whole entries are written, and the number of bytes written is returned.
+  ;;
+  ;; stats entry (little endian, no padding), for each function that has been called
+  ;; 4 bytes i32  Function id
+  ;; 4 bytes i32  Call count
+  ;; 8 bytes i64  Total time (ns)
+  ;; 8 bytes i64  Min time (ns)
+  ;; 8 bytes i64  P50 time (ns)
+  ;; 8 bytes i64  P99 time (ns)
+  ;; 8 bytes i64  Max time (ns)
+  ;; 4 bytes i32  Name length
+  ;; n bytes      Name
+  (func $__wasm_toolkit_stats (param $ptr i32) (param $len i32) (result i32)
+    (local $fid i32)
+    (local $written i32)
+    (local $dest i32)
+    (local $metrics_ptr i32)
+    (local $hist_ptr i32)
+    (local $name_ptr i32)
+    (local $name_len i32)
+
+    block
+      loop
+        local.get $fid
+        global.get $wt_all_function_length
+        i32.ge_u
+        br_if 1
+
+        local.get $fid
+        i32.const 4
+        i32.shl
+        i32.const offset($metrics_data)
+        i32.add
+        local.tee $metrics_ptr
+        i32.load
+        if
+          i32.const offset($wt_all_function_names_locs)
+          local.get $fid
+          i32.const 3
+          i32.shl
+          i32.add
+          local.tee $name_ptr
+          i32.load offset=4
+          local.set $name_len
+
+          ;; Stop if the whole entry doesn't fit
+          local.get $written
+          i32.const 52
+          i32.add
+          local.get $name_len
+          i32.add
+          local.get $len
+          i32.gt_u
+          br_if 2
+
+          local.get $fid
+          call $timings_histogram_ptr
+          local.set $hist_ptr
+
+          local.get $ptr
+          local.get $written
+          i32.add
+          local.tee $dest
+          local.get $fid
+          i32.store
+
+          local.get $dest
+          local.get $metrics_ptr
+          i32.load
+          i32.store offset=4
+
+          local.get $dest
+          local.get $metrics_ptr
+          i64.load offset=4
+          i64.store offset=8
+
+          local.get $dest
+          local.get $hist_ptr
+          i64.load
+          i64.const -1
+          i64.xor
+          i64.const 0
+          local.get $hist_ptr
+          i64.load
+          i64.const 0
+          i64.ne
+          select
+          i64.store offset=16
+
+          local.get $dest
+          local.get $hist_ptr
+          i32.const 50
+          call $timings_percentile
+          i64.store offset=24
+
+          local.get $dest
+          local.get $hist_ptr
+          i32.const 99
+          call $timings_percentile
+          i64.store offset=32
+
+          local.get $dest
+          local.get $hist_ptr
+          i64.load offset=8
+          i64.store offset=40
+
+          local.get $dest
+          local.get $name_len
+          i32.store offset=48
+
+          local.get $dest
+          i32.const 52
+          i32.add
+          local.get $name_ptr
+          i32.load
+          i32.const offset($wt_all_function_names)
+          i32.add
+          local.get $name_len
+          memory.copy
+
+          local.get $written
+          i32.const 52
+          i32.add
+          local.get $name_len
+          i32.add
+          local.set $written
+        end
+
+        local.get $fid
+        i32.const 1
+        i32.add
+        local.set $fid
+        br 0
+      end
+    end
+
+    local.get $written
+  )
+
   (func $debug_find_expensive_function (result i32)
     (local $f_id i32)
     (local $best_id i32)
@@ -237,11 +626,14 @@
 
   (data $debug_clock_loc 8)
 
-  (data $debug_summary "\0d\0a-- Summary of execution --\0d\0aCount      | Time (ns)           | Function\0d\0a-----------+---------------------+\0d\0a")
+  (data $debug_summary "\0d\0a-- Summary of execution --\0d\0aCount      | Time (ns)           | Min (ns)     | P50 (ns)     | P99 (ns)     | Max (ns)     | Function\0d\0a-----------+---------------------+--------------+--------------+--------------+--------------+\0d\0a")
 
   ;; Only allow 100 function stack for now
   (data $debug_timestamps_stack 800)
 
   (global $debug_timestamps_stack_pointer (mut i32) (i32.const 0))
 
+  ;; Where the histograms are, relative to the start of the payload
+  (global $metrics_histograms_rel (mut i32) (i32.const 0))
+
 )
\ No newline at end of file
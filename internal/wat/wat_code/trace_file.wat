@@ -0,0 +1,56 @@
+(module
+  (type (func (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "path_open" (func $debug_path_open (type 0)))
+
+  ;; wt_trace_file_open - Open the trace file the first time it's needed, and send output there.
+  ;; The path is relative to a preopened directory, so try each of them in turn.
+  (func $wt_trace_file_open
+    (local $dirfd i32)
+    global.get $wt_trace_file_opened
+    br_if 0
+
+    i32.const 1
+    global.set $wt_trace_file_opened
+
+    i32.const 3
+    local.set $dirfd
+
+    block
+      loop
+        local.get $dirfd
+        ;; No dirflags
+        i32.const 0
+        i32.const offset($wt_trace_file_path)
+        i32.const length($wt_trace_file_path)
+        ;; O_CREAT | O_TRUNC
+        i32.const 9
+        ;; Rights fd_write
+        i64.const 64
+        i64.const 0
+        ;; No fdflags
+        i32.const 0
+        i32.const offset($wt_trace_file_fd)
+        call $debug_path_open
+        i32.eqz
+        if
+          i32.const offset($wt_trace_file_fd)
+          i32.load
+          global.set $wt_trace_fd
+          br 2
+        end
+
+        local.get $dirfd
+        i32.const 1
+        i32.add
+        local.tee $dirfd
+        i32.const 16
+        i32.lt_u
+        br_if 0
+      end
+    end
+  )
+
+  (data $wt_trace_file_fd 4)
+
+  (global $wt_trace_file_opened (mut i32) (i32.const 0))
+)
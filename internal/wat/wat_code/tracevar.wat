@@ -0,0 +1,345 @@
+(module
+
+  ;; Tracing of dwarf global variables. Before each store the address is kept, and after the store the new
+  ;; value of any variable in $wt_trace_vars that was written to is shown.
+  ;; $wt_trace_vars has 20 bytes for each variable (start, end, format, label offset, label length).
+  ;; Formats are 0 hex bytes, 1 signed, 2 unsigned, 3 bool, 4 hex.
+
+  ;; tracevar_before - Remember the range that the store at address+offset will write to.
+  (func $tracevar_before (param $address i32) (param $offset i32) (param $size i32) (result i32)
+    local.get $address
+    local.get $offset
+    i32.add
+    global.set $tracevar_start
+
+    global.get $tracevar_start
+    local.get $size
+    i32.const 3
+    i32.shr_u
+    i32.add
+    global.set $tracevar_end
+
+    local.get $address
+  )
+
+  ;; tracevar_after - Show the new value of each variable the store wrote to
+  (func $tracevar_after (param $debug_ptr i32) (param $debug_len i32)
+    (local $c i32)
+    block
+      loop
+        local.get $c
+        i32.const length($wt_trace_vars)
+        i32.ge_u
+        br_if 1
+
+        ;; Overlapping if start < var end, and var start < end
+        global.get $tracevar_start
+        local.get $c
+        i32.const offset($wt_trace_vars)
+        i32.add
+        i32.load offset=4
+        i32.lt_u
+        if
+          local.get $c
+          i32.const offset($wt_trace_vars)
+          i32.add
+          i32.load
+          global.get $tracevar_end
+          i32.lt_u
+          if
+            local.get $c
+            i32.const offset($wt_trace_vars)
+            i32.add
+            local.get $debug_ptr
+            local.get $debug_len
+            call $tracevar_print
+          end
+        end
+
+        local.get $c
+        i32.const 20
+        i32.add
+        local.set $c
+        br 0
+      end
+    end
+  )
+
+  ;; tracevar_print_dec - Print an unsigned number without padding
+  (func $tracevar_print_dec (param $num i64)
+    (local $p i32)
+    local.get $num
+    i64.eqz
+    if
+      i32.const offset($tracevar_zero)
+      i32.const length($tracevar_zero)
+      call $wt_print
+      return
+    end
+
+    local.get $num
+    call $wt_format_i64_dec_nz
+
+    ;; Skip the leading spaces
+    block
+      loop
+        i32.const offset($db_number_i64)
+        local.get $p
+        i32.add
+        i32.load8_u
+        i32.const 32
+        i32.ne
+        br_if 1
+        local.get $p
+        i32.const 1
+        i32.add
+        local.set $p
+        br 0
+      end
+    end
+
+    i32.const offset($db_number_i64)
+    local.get $p
+    i32.add
+    i32.const 19
+    local.get $p
+    i32.sub
+    call $wt_print
+  )
+
+  ;; tracevar_print_hex - Print the low size bytes of a value in hex
+  (func $tracevar_print_hex (param $value i64) (param $size i32)
+    i32.const offset($tracevar_hex)
+    i32.const length($tracevar_hex)
+    call $wt_print
+
+    local.get $value
+    call $wt_format_i64_hex
+
+    i32.const offset($db_number_i64)
+    i32.const 16
+    i32.add
+    local.get $size
+    i32.const 1
+    i32.shl
+    i32.sub
+    local.get $size
+    i32.const 1
+    i32.shl
+    call $wt_print
+  )
+
+  ;; tracevar_load - Load a value of 1, 2, 4 or 8 bytes, sign extended if needed
+  (func $tracevar_load (param $ptr i32) (param $size i32) (param $signed i32) (result i64)
+    local.get $size
+    i32.const 8
+    i32.eq
+    if
+      local.get $ptr
+      i64.load
+      return
+    end
+    local.get $size
+    i32.const 4
+    i32.eq
+    if
+      local.get $signed
+      if
+        local.get $ptr
+        i64.load32_s
+        return
+      end
+      local.get $ptr
+      i64.load32_u
+      return
+    end
+    local.get $size
+    i32.const 2
+    i32.eq
+    if
+      local.get $signed
+      if
+        local.get $ptr
+        i64.load16_s
+        return
+      end
+      local.get $ptr
+      i64.load16_u
+      return
+    end
+    local.get $signed
+    if
+      local.get $ptr
+      i64.load8_s
+      return
+    end
+    local.get $ptr
+    i64.load8_u
+  )
+
+  ;; tracevar_print - Show the value of a variable
+  (func $tracevar_print (param $var i32) (param $debug_ptr i32) (param $debug_len i32)
+    (local $ptr i32)
+    (local $size i32)
+    (local $format i32)
+    (local $value i64)
+    local.get $var
+    i32.load
+    local.set $ptr
+    local.get $var
+    i32.load offset=4
+    local.get $ptr
+    i32.sub
+    local.set $size
+    local.get $var
+    i32.load offset=8
+    local.set $format
+
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_watch)
+      i32.const length($wt_ansi_watch)
+      call $wt_print
+    end
+
+    i32.const offset($tracevar_start)
+    i32.const length($tracevar_start)
+    call $wt_print
+
+    local.get $var
+    i32.load offset=12
+    i32.const offset($wt_trace_var_labels)
+    i32.add
+    local.get $var
+    i32.load offset=16
+    call $wt_print
+
+    i32.const offset($tracevar_equals)
+    i32.const length($tracevar_equals)
+    call $wt_print
+
+    block
+      ;; signed
+      local.get $format
+      i32.const 1
+      i32.eq
+      if
+        local.get $ptr
+        local.get $size
+        i32.const 1
+        call $tracevar_load
+        local.tee $value
+        i64.const 0
+        i64.lt_s
+        if
+          i32.const offset($tracevar_minus)
+          i32.const length($tracevar_minus)
+          call $wt_print
+          i64.const 0
+          local.get $value
+          i64.sub
+          local.set $value
+        end
+        local.get $value
+        call $tracevar_print_dec
+        br 1
+      end
+
+      ;; unsigned, shown in hex if it's too big for a signed i64
+      local.get $format
+      i32.const 2
+      i32.eq
+      if
+        local.get $ptr
+        local.get $size
+        i32.const 0
+        call $tracevar_load
+        local.tee $value
+        i64.const 0
+        i64.lt_s
+        if
+          local.get $value
+          local.get $size
+          call $tracevar_print_hex
+        else
+          local.get $value
+          call $tracevar_print_dec
+        end
+        br 1
+      end
+
+      ;; bool
+      local.get $format
+      i32.const 3
+      i32.eq
+      if
+        local.get $ptr
+        i32.load8_u
+        if
+          i32.const offset($tracevar_true)
+          i32.const length($tracevar_true)
+          call $wt_print
+        else
+          i32.const offset($tracevar_false)
+          i32.const length($tracevar_false)
+          call $wt_print
+        end
+        br 1
+      end
+
+      ;; hex
+      local.get $format
+      i32.const 4
+      i32.eq
+      if
+        local.get $ptr
+        local.get $size
+        i32.const 0
+        call $tracevar_load
+        local.get $size
+        call $tracevar_print_hex
+        br 1
+      end
+
+      ;; Anything else is shown as bytes
+      local.get $ptr
+      local.get $size
+      global.get $wt_max_string_len
+      i32.gt_u
+      if (result i32)
+        global.get $wt_max_string_len
+      else
+        local.get $size
+      end
+      call $wt_print_hex
+    end
+
+    local.get $debug_ptr
+    local.get $debug_len
+    call $wt_print
+
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_none)
+      i32.const length($wt_ansi_none)
+      call $wt_print
+    end
+
+    i32.const offset($debug_newline)
+    i32.const length($debug_newline)
+    call $wt_print
+  )
+
+  (data $tracevar_start "VAR ")
+  (data $tracevar_equals " = ")
+  (data $tracevar_zero "0")
+  (data $tracevar_minus "-")
+  (data $tracevar_hex "0x")
+  (data $tracevar_true "true")
+  (data $tracevar_false "false")
+
+  (global $tracevar_start (mut i32) (i32.const 0))
+  (global $tracevar_end (mut i32) (i32.const 0))
+  (global $tracevar_value_i32 (mut i32) (i32.const 0))
+  (global $tracevar_value_i64 (mut i64) (i64.const 0))
+)
@@ -0,0 +1,407 @@
+(module
+
+  ;; Trap reports. A shadow call stack is kept, with the function ID and the call site for each call.
+  ;; Only the innermost 256 calls are kept, as a ring of 8 byte entries in $trap_stack.
+  ;; Call sites are an index into $trap_sites (pc, line index), and line indexes are into $trap_lines_locs.
+
+  ;; trap_enter - Called when a function is entered
+  (func $trap_enter (param $fid i32)
+    (local $ptr i32)
+    i32.const offset($trap_stack)
+    global.get $trap_depth
+    i32.const 255
+    i32.and
+    i32.const 3
+    i32.shl
+    i32.add
+    local.tee $ptr
+    local.get $fid
+    i32.store
+
+    local.get $ptr
+    global.get $trap_site
+    i32.store offset=4
+
+    i32.const -1
+    global.set $trap_site
+
+    global.get $trap_depth
+    i32.const 1
+    i32.add
+    global.set $trap_depth
+  )
+
+  ;; trap_exit - Called when a function returns
+  (func $trap_exit
+    global.get $trap_depth
+    i32.const 1
+    i32.sub
+    global.set $trap_depth
+  )
+
+  ;; trap_print_hex - Print a number in hex, without the leading zeros
+  (func $trap_print_hex (param $num i32)
+    (local $p i32)
+    local.get $num
+    call $wt_format_i32_hex
+    block
+      loop
+        local.get $p
+        i32.const 7
+        i32.ge_u
+        br_if 1
+        i32.const offset($db_number_i32)
+        local.get $p
+        i32.add
+        i32.load8_u
+        i32.const 48 ;; 0
+        i32.ne
+        br_if 1
+        local.get $p
+        i32.const 1
+        i32.add
+        local.set $p
+        br 0
+      end
+    end
+    i32.const offset($db_number_i32)
+    local.get $p
+    i32.add
+    i32.const 8
+    local.get $p
+    i32.sub
+    call $wt_print
+  )
+
+  ;; trap_print_function_name - Print the name of the function for a stack entry
+  (func $trap_print_function_name (param $entry i32)
+    (local $ptr i32)
+    i32.const offset($wt_all_function_names_locs)
+    local.get $entry
+    i32.load
+    i32.const 3
+    i32.shl
+    i32.add
+    local.tee $ptr
+    i32.load
+    i32.const offset($wt_all_function_names)
+    i32.add
+    local.get $ptr
+    i32.load offset=4
+    call $wt_print
+  )
+
+  ;; trap_print_site - Print the pc and source line of a call site
+  (func $trap_print_site (param $site i32)
+    (local $ptr i32)
+    (local $line i32)
+    local.get $site
+    i32.const -1
+    i32.eq
+    if
+      return
+    end
+
+    i32.const offset($trap_colon)
+    i32.const length($trap_colon)
+    call $wt_print
+
+    i32.const offset($trap_sites)
+    local.get $site
+    i32.const 3
+    i32.shl
+    i32.add
+    local.tee $ptr
+    i32.load
+    call $trap_print_hex
+
+    local.get $ptr
+    i32.load offset=4
+    local.tee $line
+    i32.const -1
+    i32.eq
+    if
+      return
+    end
+
+    i32.const offset($trap_space)
+    i32.const length($trap_space)
+    call $wt_print
+
+    i32.const offset($trap_lines_locs)
+    local.get $line
+    i32.const 3
+    i32.shl
+    i32.add
+    local.tee $ptr
+    i32.load
+    i32.const offset($trap_lines)
+    i32.add
+    local.get $ptr
+    i32.load offset=4
+    call $wt_print
+  )
+
+  ;; trap_start - Print the start of the report, before the locals.
+  (func $trap_start (param $site i32)
+    i32.const offset($trap_header)
+    i32.const length($trap_header)
+    call $wt_print
+
+    i32.const offset($trap_stack)
+    global.get $trap_depth
+    i32.const 1
+    i32.sub
+    i32.const 255
+    i32.and
+    i32.const 3
+    i32.shl
+    i32.add
+    call $trap_print_function_name
+
+    local.get $site
+    call $trap_print_site
+
+    i32.const offset($trap_newline)
+    i32.const length($trap_newline)
+    call $wt_print
+  )
+
+  ;; trap_local_start - Print the name of a local
+  (func $trap_local_start (param $ptr i32) (param $len i32)
+    global.get $trap_locals_shown
+    i32.eqz
+    if
+      i32.const 1
+      global.set $trap_locals_shown
+      i32.const offset($trap_locals)
+      i32.const length($trap_locals)
+      call $wt_print
+    end
+
+    i32.const offset($trap_indent)
+    i32.const length($trap_indent)
+    call $wt_print
+
+    local.get $ptr
+    local.get $len
+    call $wt_print
+  )
+
+  (func $trap_local_i32 (param $ptr i32) (param $len i32) (param $value i32)
+    local.get $ptr
+    local.get $len
+    call $trap_local_start
+
+    i32.const offset($trap_type_i32)
+    i32.const length($trap_type_i32)
+    call $wt_print
+
+    local.get $value
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    i32.const offset($trap_newline)
+    i32.const length($trap_newline)
+    call $wt_print
+  )
+
+  (func $trap_local_i64 (param $ptr i32) (param $len i32) (param $value i64)
+    local.get $ptr
+    local.get $len
+    call $trap_local_start
+
+    i32.const offset($trap_type_i64)
+    i32.const length($trap_type_i64)
+    call $wt_print
+
+    local.get $value
+    call $wt_format_i64_hex
+    i32.const offset($db_number_i64)
+    i32.const 16
+    call $wt_print
+
+    i32.const offset($trap_newline)
+    i32.const length($trap_newline)
+    call $wt_print
+  )
+
+  (func $trap_local_f32 (param $ptr i32) (param $len i32) (param $value f32)
+    local.get $ptr
+    local.get $len
+    call $trap_local_start
+
+    i32.const offset($trap_type_f32)
+    i32.const length($trap_type_f32)
+    call $wt_print
+
+    local.get $value
+    i32.reinterpret_f32
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    i32.const offset($trap_newline)
+    i32.const length($trap_newline)
+    call $wt_print
+  )
+
+  (func $trap_local_f64 (param $ptr i32) (param $len i32) (param $value f64)
+    local.get $ptr
+    local.get $len
+    call $trap_local_start
+
+    i32.const offset($trap_type_f64)
+    i32.const length($trap_type_f64)
+    call $wt_print
+
+    local.get $value
+    i64.reinterpret_f64
+    call $wt_format_i64_hex
+    i32.const offset($db_number_i64)
+    i32.const 16
+    call $wt_print
+
+    i32.const offset($trap_newline)
+    i32.const length($trap_newline)
+    call $wt_print
+  )
+
+  ;; trap_backtrace - Print the shadow call stack, innermost first. $site is where the trap is.
+  (func $trap_backtrace (param $site i32)
+    (local $frame i32)
+    (local $depth i32)
+    (local $entry i32)
+
+    i32.const offset($trap_backtrace_start)
+    i32.const length($trap_backtrace_start)
+    call $wt_print
+
+    global.get $trap_depth
+    local.set $depth
+
+    block
+      loop
+        local.get $depth
+        i32.eqz
+        br_if 1
+        local.get $frame
+        i32.const 256
+        i32.ge_u
+        br_if 1
+
+        local.get $depth
+        i32.const 1
+        i32.sub
+        local.set $depth
+
+        i32.const offset($trap_stack)
+        local.get $depth
+        i32.const 255
+        i32.and
+        i32.const 3
+        i32.shl
+        i32.add
+        local.set $entry
+
+        i32.const offset($trap_frame)
+        i32.const length($trap_frame)
+        call $wt_print
+
+        local.get $frame
+        call $trap_print_dec
+
+        i32.const offset($trap_space)
+        i32.const length($trap_space)
+        call $wt_print
+
+        local.get $entry
+        call $trap_print_function_name
+
+        local.get $site
+        call $trap_print_site
+
+        i32.const offset($trap_newline)
+        i32.const length($trap_newline)
+        call $wt_print
+
+        ;; The call site for the next frame out
+        local.get $entry
+        i32.load offset=4
+        local.set $site
+
+        local.get $frame
+        i32.const 1
+        i32.add
+        local.set $frame
+        br 0
+      end
+    end
+
+    local.get $depth
+    if
+      i32.const offset($trap_more_frames)
+      i32.const length($trap_more_frames)
+      call $wt_print
+    end
+  )
+
+  ;; trap_print_hex_dec - Print a small number in decimal
+  (func $trap_print_dec (param $num i32)
+    local.get $num
+    i32.const 100
+    i32.ge_u
+    if
+      i32.const offset($db_hex)
+      local.get $num
+      i32.const 100
+      i32.div_u
+      i32.add
+      i32.const 1
+      call $wt_print
+    end
+    local.get $num
+    i32.const 10
+    i32.ge_u
+    if
+      i32.const offset($db_hex)
+      local.get $num
+      i32.const 10
+      i32.div_u
+      i32.const 10
+      i32.rem_u
+      i32.add
+      i32.const 1
+      call $wt_print
+    end
+    i32.const offset($db_hex)
+    local.get $num
+    i32.const 10
+    i32.rem_u
+    i32.add
+    i32.const 1
+    call $wt_print
+  )
+
+  (data $trap_header "trap: unreachable in ")
+  (data $trap_locals "locals:\0d\0a")
+  (data $trap_backtrace_start "backtrace:\0d\0a")
+  (data $trap_more_frames "  ... more frames\0d\0a")
+  (data $trap_frame "  #")
+  (data $trap_indent "  ")
+  (data $trap_colon ":")
+  (data $trap_space " ")
+  (data $trap_newline "\0d\0a")
+  (data $trap_type_i32 " = i32:")
+  (data $trap_type_i64 " = i64:")
+  (data $trap_type_f32 " = f32:")
+  (data $trap_type_f64 " = f64:")
+  (data $trap_stack 2048)
+
+  (global $trap_depth (mut i32) (i32.const 0))
+  (global $trap_site (mut i32) (i32.const -1))
+  (global $trap_locals_shown (mut i32) (i32.const 0))
+)
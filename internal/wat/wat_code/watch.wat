@@ -593,6 +593,178 @@
     local.get $address
   )
 
+  ;; log_mem_load_start - Print the start of a memory read log line, up to the value
+  (func $log_mem_load_start (param $address i32) (param $offset i32) (param $memrange i32) (param $debug_ptr i32) (param $debug_len i32)
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_watch)
+      i32.const length($wt_ansi_watch)
+      call $wt_print
+    end
+
+    i32.const offset($log_watch_memory_0)
+    i32.const length($log_watch_memory_0)
+    call $wt_print
+
+    local.get $memrange
+    i32.load offset=12
+    if
+      local.get $memrange
+      i32.load offset=8
+      i32.const offset($wt_mem_tags)
+      i32.add
+      local.get $memrange
+      i32.load offset=12
+      call $wt_print
+    else
+      ;; It's an ID instead...
+      local.get $memrange
+      i32.load offset=8
+      i32.const offset($wt_id_tag)
+      i32.const 4
+      i32.add
+      call $wt_conv_byte_dec
+      i32.const offset($wt_id_tag)
+      i32.const length($wt_id_tag)
+      call $wt_print
+    end
+
+    local.get $debug_ptr
+    local.get $debug_len
+    call $wt_print
+
+    i32.const offset($log_watch_memory_1)
+    i32.const length($log_watch_memory_1)
+    call $wt_print
+
+    local.get $address
+    call $wt_format_i32_hex
+
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    local.get $offset
+    if
+      i32.const offset($log_watch_memory_1b)
+      i32.const length($log_watch_memory_1b)
+      call $wt_print
+
+      local.get $offset
+      call $wt_format_i32_hex
+
+      i32.const offset($db_number_i32)
+      i32.const 8
+      call $wt_print
+    end
+
+    i32.const offset($log_watch_memory_read)
+    i32.const length($log_watch_memory_read)
+    call $wt_print
+  )
+
+  ;; log_mem_i32.load - Log an i32 (or f32) read from memory. Called before the load with the address.
+  (func $log_mem_i32.load (param $address i32) (param $offset i32) (param $size i32) (param $debug_ptr i32) (param $debug_len i32) (result i32)
+    (local $memrange i32)
+    local.get $address
+    local.get $offset
+    i32.add
+    local.get $address
+    local.get $offset
+    i32.add
+    local.get $size
+    i32.const 3
+    i32.shr_u
+    i32.add
+    call $log_mem_filter
+    local.tee $memrange
+    i32.eqz
+    if
+      local.get $address
+      return
+    end
+
+    local.get $address
+    local.get $offset
+    local.get $memrange
+    local.get $debug_ptr
+    local.get $debug_len
+    call $log_mem_load_start
+
+    local.get $address
+    local.get $offset
+    i32.add
+    i32.load
+    call $wt_format_i32_hex
+
+    local.get $size
+    call $log_print_i32_size
+
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_none)
+      i32.const length($wt_ansi_none)
+      call $wt_print
+    end
+
+    i32.const offset($debug_newline)
+    i32.const length($debug_newline)
+    call $wt_print
+
+    local.get $address
+  )
+
+  ;; log_mem_i64.load - Log an i64 (or f64) read from memory. Called before the load with the address.
+  (func $log_mem_i64.load (param $address i32) (param $offset i32) (param $size i32) (param $debug_ptr i32) (param $debug_len i32) (result i32)
+    (local $memrange i32)
+    local.get $address
+    local.get $offset
+    i32.add
+    local.get $address
+    local.get $offset
+    i32.add
+    local.get $size
+    i32.const 3
+    i32.shr_u
+    i32.add
+    call $log_mem_filter
+    local.tee $memrange
+    i32.eqz
+    if
+      local.get $address
+      return
+    end
+
+    local.get $address
+    local.get $offset
+    local.get $memrange
+    local.get $debug_ptr
+    local.get $debug_len
+    call $log_mem_load_start
+
+    local.get $address
+    local.get $offset
+    i32.add
+    i64.load
+    call $wt_format_i64_hex
+
+    local.get $size
+    call $log_print_i64_size
+
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_none)
+      i32.const length($wt_ansi_none)
+      call $wt_print
+    end
+
+    i32.const offset($debug_newline)
+    i32.const length($debug_newline)
+    call $wt_print
+
+    local.get $address
+  )
+
   (data $wt_id_tag "tag_+++")
 
   (data $log_watch_global_1 "GLOBAL ")
@@ -609,6 +781,7 @@
   (data $log_watch_memory_1b "+")
   (data $log_watch_memory_2 " value ")
   (data $log_watch_memory_3 "=>")
+  (data $log_watch_memory_read " read ")
 
   (global $log_memory_value_i32 (mut i32) (i32.const 0))
   (global $log_memory_value_i64 (mut i64) (i64.const 0))
@@ -0,0 +1,245 @@
+(module
+
+  ;; Software watchpoints. Every store is checked against the watched address ranges in $wt_watchpoints,
+  ;; which has 16 bytes for each watch (start, end, tag offset, tag length).
+
+  ;; watchpoint_filter - Return a ptr to the first watch which overlaps start-end, or 0
+  (func $watchpoint_filter (param $start i32) (param $end i32) (result i32)
+    (local $c i32)
+    block
+      loop
+        local.get $c
+        i32.const length($wt_watchpoints)
+        i32.ge_u
+        br_if 1
+
+        ;; Overlapping if start < watch end, and watch start < end
+        local.get $start
+        local.get $c
+        i32.const offset($wt_watchpoints)
+        i32.add
+        i32.load offset=4
+        i32.lt_u
+        if
+          local.get $c
+          i32.const offset($wt_watchpoints)
+          i32.add
+          i32.load
+          local.get $end
+          i32.lt_u
+          if
+            local.get $c
+            i32.const offset($wt_watchpoints)
+            i32.add
+            return
+          end
+        end
+
+        local.get $c
+        i32.const 16
+        i32.add
+        local.set $c
+        br 0
+      end
+    end
+    i32.const 0
+  )
+
+  ;; watchpoint_start - Print the start of the log line, with the watch tag, the store debug info and the address
+  (func $watchpoint_start (param $watch i32) (param $address i32) (param $debug_ptr i32) (param $debug_len i32)
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_watch)
+      i32.const length($wt_ansi_watch)
+      call $wt_print
+    end
+
+    i32.const offset($watchpoint_log_start)
+    i32.const length($watchpoint_log_start)
+    call $wt_print
+
+    local.get $watch
+    i32.load offset=8
+    i32.const offset($wt_watchpoint_tags)
+    i32.add
+    local.get $watch
+    i32.load offset=12
+    call $wt_print
+
+    local.get $debug_ptr
+    local.get $debug_len
+    call $wt_print
+
+    i32.const offset($watchpoint_log_addr)
+    i32.const length($watchpoint_log_addr)
+    call $wt_print
+
+    local.get $address
+    call $wt_format_i32_hex
+    i32.const offset($db_number_i32)
+    i32.const 8
+    call $wt_print
+
+    i32.const offset($watchpoint_log_value)
+    i32.const length($watchpoint_log_value)
+    call $wt_print
+  )
+
+  ;; watchpoint_end - Finish off the log line
+  (func $watchpoint_end
+    global.get $wt_color
+    if
+      i32.const offset($wt_ansi_none)
+      i32.const length($wt_ansi_none)
+      call $wt_print
+    end
+
+    i32.const offset($debug_newline)
+    i32.const length($debug_newline)
+    call $wt_print
+  )
+
+  ;; $watchpoint_i32.store (address, offset, size, ptr_debug, len_debug) => address
+  ;; The value being stored is in $watchpoint_value_i32
+  (func $watchpoint_i32.store (param $address i32) (param $offset i32) (param $size i32) (param $debug_ptr i32) (param $debug_len i32) (result i32)
+    (local $watch i32)
+    (local $ea i32)
+    local.get $address
+    local.get $offset
+    i32.add
+    local.tee $ea
+    local.get $ea
+    local.get $size
+    i32.const 3
+    i32.shr_u
+    i32.add
+    call $watchpoint_filter
+    local.tee $watch
+    i32.eqz
+    if
+      local.get $address
+      return
+    end
+
+    local.get $watch
+    local.get $ea
+    local.get $debug_ptr
+    local.get $debug_len
+    call $watchpoint_start
+
+    ;; Old value
+    local.get $size
+    i32.const 8
+    i32.eq
+    if (result i32)
+      local.get $ea
+      i32.load8_u
+    else
+      local.get $size
+      i32.const 16
+      i32.eq
+      if (result i32)
+        local.get $ea
+        i32.load16_u
+      else
+        local.get $ea
+        i32.load
+      end
+    end
+    call $wt_format_i32_hex
+    local.get $size
+    call $log_print_i32_size
+
+    i32.const offset($watchpoint_log_arrow)
+    i32.const length($watchpoint_log_arrow)
+    call $wt_print
+
+    global.get $watchpoint_value_i32
+    call $wt_format_i32_hex
+    local.get $size
+    call $log_print_i32_size
+
+    call $watchpoint_end
+    local.get $address
+  )
+
+  ;; $watchpoint_i64.store (address, offset, size, ptr_debug, len_debug) => address
+  ;; The value being stored is in $watchpoint_value_i64
+  (func $watchpoint_i64.store (param $address i32) (param $offset i32) (param $size i32) (param $debug_ptr i32) (param $debug_len i32) (result i32)
+    (local $watch i32)
+    (local $ea i32)
+    local.get $address
+    local.get $offset
+    i32.add
+    local.tee $ea
+    local.get $ea
+    local.get $size
+    i32.const 3
+    i32.shr_u
+    i32.add
+    call $watchpoint_filter
+    local.tee $watch
+    i32.eqz
+    if
+      local.get $address
+      return
+    end
+
+    local.get $watch
+    local.get $ea
+    local.get $debug_ptr
+    local.get $debug_len
+    call $watchpoint_start
+
+    ;; Old value
+    local.get $size
+    i32.const 8
+    i32.eq
+    if (result i64)
+      local.get $ea
+      i64.load8_u
+    else
+      local.get $size
+      i32.const 16
+      i32.eq
+      if (result i64)
+        local.get $ea
+        i64.load16_u
+      else
+        local.get $size
+        i32.const 32
+        i32.eq
+        if (result i64)
+          local.get $ea
+          i64.load32_u
+        else
+          local.get $ea
+          i64.load
+        end
+      end
+    end
+    call $wt_format_i64_hex
+    local.get $size
+    call $log_print_i64_size
+
+    i32.const offset($watchpoint_log_arrow)
+    i32.const length($watchpoint_log_arrow)
+    call $wt_print
+
+    global.get $watchpoint_value_i64
+    call $wt_format_i64_hex
+    local.get $size
+    call $log_print_i64_size
+
+    call $watchpoint_end
+    local.get $address
+  )
+
+  (data $watchpoint_log_start "WATCH ")
+  (data $watchpoint_log_addr " | ")
+  (data $watchpoint_log_value " value ")
+  (data $watchpoint_log_arrow "=>")
+
+  (global $watchpoint_value_i32 (mut i32) (i32.const 0))
+  (global $watchpoint_value_i64 (mut i64) (i64.const 0))
+)
@@ -52,15 +52,21 @@ func AddSource(wasmInput []byte, sourceCode []byte, sourceGzipped bool) ([]byte,
 	if err != nil {
 		return nil, err
 	}
-	err = memFunctions.DecodeWat(data)
+	err = memFunctions.DecodeWatFile("memory.wat", data)
 	if err != nil {
 		return nil, err
 	}
 
-	wfile.AddFuncsFrom(memFunctions, func(m map[int]int) {})
+	err = wfile.AddFuncsFrom(memFunctions, func(m map[int]int) {})
+	if err != nil {
+		return nil, err
+	}
 
 	data_ptr := wfile.Memory[0].LimitMin << 16
-	wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	err = wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	if err != nil {
+		return nil, err
+	}
 
 	// Now we just need to adjust the imported functions get_source_len and get_source_ptr and then remove them.
 
@@ -70,21 +76,33 @@ func AddSource(wasmInput []byte, sourceCode []byte, sourceGzipped bool) ([]byte,
 	if err != nil {
 		return nil, err
 	}
-	err = replacedFunctions.DecodeWat(data)
+	err = replacedFunctions.DecodeWatFile("addsource.wat", data)
 	if err != nil {
 		return nil, err
 	}
 
-	wfile.AddFuncsFrom(replacedFunctions, func(m map[int]int) {})
+	err = wfile.AddFuncsFrom(replacedFunctions, func(m map[int]int) {})
+	if err != nil {
+		return nil, err
+	}
 
-	wfile.AddDataFrom(int32(data_ptr), replacedFunctions)
+	_, err = wfile.AddDataFrom(int32(data_ptr), replacedFunctions)
+	if err != nil {
+		return nil, err
+	}
 
 	wfile.AddData("$source_data", sourceCode)
 
 	// Now we need to remap any calls to the new functions
 
-	wfile.RedirectImport("env", "get_source_len", "$get_source_len")
-	wfile.RedirectImport("env", "get_source", "$get_source")
+	err = wfile.RedirectImport("env", "get_source_len", "$get_source_len")
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.RedirectImport("env", "get_source", "$get_source")
+	if err != nil {
+		return nil, err
+	}
 
 	// Find out how much data we need for the payload
 	total_payload_data := data_ptr
@@ -95,7 +113,10 @@ func AddSource(wasmInput []byte, sourceCode []byte, sourceGzipped bool) ([]byte,
 
 	payload_size := (total_payload_data + 65535) >> 16
 
-	wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	err = wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	if err != nil {
+		return nil, err
+	}
 	wfile.Memory[0].LimitMin = wfile.Memory[0].LimitMin + payload_size
 
 	// Pass on the fact of if source_file is gzip or not.
@@ -103,7 +124,10 @@ func AddSource(wasmInput []byte, sourceCode []byte, sourceGzipped bool) ([]byte,
 	if sourceGzipped {
 		source_gzipped = 1
 	}
-	wfile.SetGlobal("$source_gzipped", types.ValI32, fmt.Sprintf("i32.const %d", source_gzipped))
+	err = wfile.SetGlobal("$source_gzipped", types.ValI32, fmt.Sprintf("i32.const %d", source_gzipped))
+	if err != nil {
+		return nil, err
+	}
 
 	// Adjust any memory.size / memory.grow calls
 	for idx, c := range wfile.Code {
@@ -148,6 +172,9 @@ func AddSource(wasmInput []byte, sourceCode []byte, sourceGzipped bool) ([]byte,
 
 	var buf bytes.Buffer
 	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
 
 	return buf.Bytes(), nil
 }
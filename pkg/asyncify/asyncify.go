@@ -0,0 +1,204 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package asyncify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/wat"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+// The functions the host uses to pause and resume the module. They're the same as binaryen's asyncify.
+var Exports = []string{
+	"asyncify_start_unwind",
+	"asyncify_stop_unwind",
+	"asyncify_start_rewind",
+	"asyncify_stop_rewind",
+	"asyncify_get_state",
+}
+
+type Asyncify_config struct {
+	Imports        []string // Imports the module can be paused in, as module:name. Wildcards can be used, eg wasi_snapshot_preview1:*
+	IgnoreIndirect bool     // Assume call_indirect never leads to an import the module can be paused in
+}
+
+/**
+ * Check if an import matches any of the patterns.
+ *
+ */
+func MatchImport(patterns []string, module string, name string) (bool, error) {
+	for _, p := range patterns {
+		m, err := path.Match(p, fmt.Sprintf("%s:%s", module, name))
+		if err != nil {
+			return false, fmt.Errorf("Bad import pattern %q: %w", p, err)
+		}
+		if m {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/**
+ * Work out which functions the module can be paused in. These are the chosen imports, and any
+ * function which can call one of them, directly or through other functions.
+ */
+func AsyncFunctions(wfile *wasmfile.WasmFile, config Asyncify_config) (map[int]bool, error) {
+	async := make(map[int]bool)
+	todo := make([]int, 0)
+	for idx, i := range wfile.Import {
+		m, err := MatchImport(config.Imports, i.Module, i.Name)
+		if err != nil {
+			return nil, err
+		}
+		if m {
+			async[idx] = true
+			todo = append(todo, idx)
+		}
+	}
+	if len(todo) == 0 {
+		return nil, errors.New("None of the imports matched")
+	}
+
+	callers := make(map[int][]int)
+	for idx, c := range wfile.Code {
+		fid := len(wfile.Import) + idx
+		for _, e := range c.Expression {
+			if e.Opcode == expression.InstrToOpcode["call"] {
+				callers[e.FuncIndex] = append(callers[e.FuncIndex], fid)
+			} else if e.Opcode == expression.InstrToOpcode["call_indirect"] && !config.IgnoreIndirect && !async[fid] {
+				async[fid] = true
+				todo = append(todo, fid)
+			}
+		}
+	}
+
+	// Work back through the callers
+	for len(todo) > 0 {
+		fid := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for _, caller := range callers[fid] {
+			if !async[caller] {
+				async[caller] = true
+				todo = append(todo, caller)
+			}
+		}
+	}
+	return async, nil
+}
+
+/**
+ * Add asyncify to a wasm, so the host can pause it in the chosen imports and resume it later.
+ *
+ */
+func AddAsyncify(wasmInput []byte, config Asyncify_config) ([]byte, error) {
+	if len(config.Imports) == 0 {
+		return nil, errors.New("No imports to pause in were given")
+	}
+
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	if len(wfile.Memory) == 0 {
+		return nil, errors.New("The module has no memory")
+	}
+	for _, e := range wfile.Export {
+		for _, name := range Exports {
+			if e.Name == name {
+				return nil, fmt.Errorf("The module already exports %s", name)
+			}
+		}
+	}
+
+	async, err := AsyncFunctions(wfile, config)
+	if err != nil {
+		return nil, err
+	}
+
+	originalFunctionLength := len(wfile.Code)
+
+	data, err := wat.Wat_content.ReadFile(path.Join("wat_code", "asyncify.wat"))
+	if err != nil {
+		return nil, err
+	}
+	mod := &wasmfile.WasmFile{}
+	err = mod.DecodeWatFile("asyncify.wat", data)
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.AddFuncsFrom(mod, func(remap map[int]int) {})
+	if err != nil {
+		return nil, err
+	}
+
+	stateGlobal := wfile.Debug.LookupGlobalID("$asyncify_state")
+	dataGlobal := wfile.Debug.LookupGlobalID("$asyncify_data")
+
+	for idx, c := range wfile.Code {
+		if idx < originalFunctionLength {
+			fid := len(wfile.Import) + idx
+			if async[fid] {
+				_, err = RewriteCode(wfile, c, wfile.Type[wfile.Function[idx].TypeIndex], async, config.IgnoreIndirect, stateGlobal, dataGlobal)
+				if err != nil {
+					return nil, fmt.Errorf("Function %d (%s): %w", fid, wfile.Debug.GetFunctionIdentifier(fid, false), err)
+				}
+			}
+		}
+
+		err = c.ResolveGlobals(wfile)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.ResolveFunctions(wfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range Exports {
+		wfile.Export = append(wfile.Export, &wasmfile.ExportEntry{
+			Name:  name,
+			Type:  types.ExportFunc,
+			Index: wfile.Debug.LookupFunctionID("$" + name),
+		})
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
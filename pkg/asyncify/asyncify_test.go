@@ -0,0 +1,164 @@
+package asyncify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const testWat = `(module
+  (type (func (param i32) (result i32)))
+  (type (func (result i32)))
+  (import "env" "sleep" (func $sleep (type 0)))
+  (memory 1)
+  (func $work (param $n i32) (result i32)
+    (local $i i32)
+    (local $acc i32)
+    ;; acc += 10 + sleep(i), with the 10 on the stack while sleeping
+    block
+      loop
+        local.get $i
+        local.get $n
+        i32.ge_u
+        br_if 1
+        local.get $acc
+        i32.const 10
+        local.get $i
+        call 0
+        i32.add
+        i32.add
+        local.set $acc
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br 0
+      end
+    end
+    ;; A block result from a br_if, and sleeping in an if
+    block (result i32)
+      local.get $acc
+      local.get $acc
+      i32.const 1000
+      i32.gt_u
+      br_if 0
+      drop
+      local.get $acc
+      i32.const 1
+      i32.and
+      if (result i32)
+        i32.const 7
+        call 0
+      else
+        i32.const 3
+        call 0
+      end
+      local.get $acc
+      i32.add
+    end
+  )
+  (func $run (result i32)
+    i32.const 100
+    i32.const 5
+    call 1
+    i32.add
+  )
+  (func $other (result i32)
+    i32.const 1
+  )
+  (export "memory" (memory 0))
+  (export "run" (func 2))
+)
+`
+
+func TestAsyncFunctions(t *testing.T) {
+	wf := testutil.Module(t, testWat)
+
+	async, err := AsyncFunctions(wf, Asyncify_config{Imports: []string{"env:*"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]bool{0: true, 1: true, 2: true}, async)
+
+	_, err = AsyncFunctions(wf, Asyncify_config{Imports: []string{"wasi_snapshot_preview1:*"}})
+	assert.Error(t, err)
+
+	m, err := MatchImport([]string{"env:sl*"}, "env", "sleep")
+	assert.NoError(t, err)
+	assert.True(t, m)
+}
+
+func TestAsyncify(t *testing.T) {
+	wasm := testutil.Binary(t, testWat)
+
+	// Without asyncify, to get the result it should have
+	ctx, r := testutil.Runtime(t)
+	_, err := r.NewHostModuleBuilder("env").NewFunctionBuilder().
+		WithFunc(func(x uint32) uint32 {
+			return x * 2
+		}).Export("sleep").Instantiate(ctx)
+	assert.NoError(t, err)
+	mod, err := r.Instantiate(ctx, wasm)
+	assert.NoError(t, err)
+	res, err := mod.ExportedFunction("run").Call(ctx)
+	assert.NoError(t, err)
+	expected := res[0]
+
+	asyncData, err := AddAsyncify(wasm, Asyncify_config{Imports: []string{"env:sleep"}})
+	assert.NoError(t, err)
+
+	wfAsync := &wasmfile.WasmFile{}
+	assert.NoError(t, wfAsync.DecodeBinary(asyncData))
+	assert.NoError(t, wfAsync.Validate())
+
+	// Now pause in every sleep, and resume from the top
+	const dataAddr = 16
+	pauses := 0
+	_, ra := testutil.Runtime(t)
+	_, err = ra.NewHostModuleBuilder("env").NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, x uint32) uint32 {
+			state, err := m.ExportedFunction("asyncify_get_state").Call(ctx)
+			assert.NoError(t, err)
+			if state[0] == 2 {
+				_, err = m.ExportedFunction("asyncify_stop_rewind").Call(ctx)
+				assert.NoError(t, err)
+				return x * 2
+			}
+			pauses++
+			_, err = m.ExportedFunction("asyncify_start_unwind").Call(ctx, dataAddr)
+			assert.NoError(t, err)
+			return 0
+		}).Export("sleep").Instantiate(ctx)
+	assert.NoError(t, err)
+	amod, err := ra.Instantiate(ctx, asyncData)
+	assert.NoError(t, err)
+
+	mem := amod.Memory()
+	mem.WriteUint32Le(dataAddr, 1024)
+	mem.WriteUint32Le(dataAddr+4, 2048)
+
+	res, err = amod.ExportedFunction("run").Call(ctx)
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		state, err := amod.ExportedFunction("asyncify_get_state").Call(ctx)
+		assert.NoError(t, err)
+		if state[0] != 1 {
+			break
+		}
+		_, err = amod.ExportedFunction("asyncify_stop_unwind").Call(ctx)
+		assert.NoError(t, err)
+		_, err = amod.ExportedFunction("asyncify_start_rewind").Call(ctx, dataAddr)
+		assert.NoError(t, err)
+		res, err = amod.ExportedFunction("run").Call(ctx)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, 6, pauses)
+	assert.Equal(t, expected, res[0])
+
+	// Everything saved has been loaded back again
+	ptr, _ := mem.ReadUint32Le(dataAddr)
+	assert.Equal(t, uint32(1024), ptr)
+}
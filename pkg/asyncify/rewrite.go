@@ -0,0 +1,668 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package asyncify
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+// How a rewritten function works:
+//
+// The code is split at every call that can pause, and at every block, loop, if, else and end. The code
+// between these splits only runs when not rewinding. Nothing is left on the operand stack at a split, so
+// any values that are go in locals. Blocks with results get them through locals too.
+//
+// When a call comes back while unwinding, the locals and the call's index are saved, and the function
+// returns. When the function is entered while rewinding, the locals are loaded back, and it goes straight
+// down through the blocks, loops and ifs (whose conditions are kept in locals) to the call it paused in.
+
+// A value on the operand stack. It's either on the real stack, or held in a local.
+type stackValue struct {
+	t     types.ValType
+	local int  // -1 if it's on the real stack
+	home  bool // Held in the local kept for its stack position
+}
+
+// A block, loop or if being rewritten. The function body is the outermost one.
+type frame struct {
+	opcode  expression.Opcode
+	results []types.ValType
+	height  int
+	depth   int
+	dead    bool // After a br, br_table, return or unreachable, until the end of the frame
+}
+
+// Labels for a loop refer to the start, so take no values
+func (f *frame) labelTypes() []types.ValType {
+	if f.opcode == expression.InstrToOpcode["loop"] {
+		return nil
+	}
+	return f.results
+}
+
+const (
+	slotPosition  = iota // A value at a stack position
+	slotResult           // The results of a block, by depth
+	slotCondition        // The condition of an if, by depth
+)
+
+type slotKey struct {
+	kind  int
+	index int
+	sub   int
+	t     types.ValType
+}
+
+type rewriter struct {
+	wf             *wasmfile.WasmFile
+	async          map[int]bool
+	ignoreIndirect bool
+	te             *wasmfile.TypeEntry
+	locals         []types.ValType
+	slots          map[slotKey]int
+	stack          []stackValue
+	frames         []*frame
+	out            []*expression.Expression
+	seg            []*expression.Expression
+	skip           int
+	calls          int
+	callLocal      int
+	spLocal        int
+	scratchLocal   int
+	stateGlobal    int
+	dataGlobal     int
+}
+
+func instr(name string) *expression.Expression {
+	return &expression.Expression{Opcode: expression.InstrToOpcode[name]}
+}
+
+func localInstr(name string, l int) *expression.Expression {
+	return &expression.Expression{Opcode: expression.InstrToOpcode[name], LocalIndex: l}
+}
+
+func globalGet(g int) *expression.Expression {
+	return &expression.Expression{Opcode: expression.InstrToOpcode["global.get"], GlobalIndex: g}
+}
+
+func i32Const(v int) *expression.Expression {
+	return &expression.Expression{Opcode: expression.InstrToOpcode["i32.const"], I32Value: int32(v)}
+}
+
+func blockInstr(name string) *expression.Expression {
+	return &expression.Expression{Opcode: expression.InstrToOpcode[name], Result: types.ValNone}
+}
+
+func labelInstr(name string, l int) *expression.Expression {
+	return &expression.Expression{Opcode: expression.InstrToOpcode[name], LabelIndex: l}
+}
+
+func memInstr(name string, align int, offset int) *expression.Expression {
+	return &expression.Expression{Opcode: expression.InstrToOpcode[name], MemAlign: align, MemOffset: offset}
+}
+
+func (r *rewriter) newLocal(t types.ValType) int {
+	r.locals = append(r.locals, t)
+	return len(r.locals) - 1
+}
+
+func (r *rewriter) slot(kind int, index int, sub int, t types.ValType) int {
+	k := slotKey{kind: kind, index: index, sub: sub, t: t}
+	l, ok := r.slots[k]
+	if !ok {
+		l = r.newLocal(t)
+		r.slots[k] = l
+	}
+	return l
+}
+
+func (r *rewriter) resultSlots(f *frame) []int {
+	slots := make([]int, 0, len(f.results))
+	for i, t := range f.results {
+		slots = append(slots, r.slot(slotResult, f.depth, i, t))
+	}
+	return slots
+}
+
+func (r *rewriter) frame() *frame {
+	return r.frames[len(r.frames)-1]
+}
+
+func (r *rewriter) label(l int) (*frame, error) {
+	if l < 0 || l >= len(r.frames) {
+		return nil, fmt.Errorf("label %d out of range", l)
+	}
+	return r.frames[len(r.frames)-1-l], nil
+}
+
+func (r *rewriter) emit(e ...*expression.Expression) {
+	r.seg = append(r.seg, e...)
+}
+
+/**
+ * Make sure the top n values are on the real stack. Values held in locals are loaded at the start of
+ * the current piece of code, underneath anything it has pushed since.
+ */
+func (r *rewriter) materialize(n int) error {
+	if len(r.stack)-n < r.frame().height {
+		return errors.New("stack underflow")
+	}
+	live := 0
+	for i := len(r.stack) - 1; i >= 0 && r.stack[i].local == -1; i-- {
+		live++
+	}
+	if live >= n {
+		return nil
+	}
+	gets := make([]*expression.Expression, 0)
+	for i := len(r.stack) - n; i < len(r.stack)-live; i++ {
+		gets = append(gets, localInstr("local.get", r.stack[i].local))
+		r.stack[i].local = -1
+		r.stack[i].home = false
+	}
+	r.seg = append(gets, r.seg...)
+	return nil
+}
+
+func (r *rewriter) pop(n int) {
+	r.stack = r.stack[:len(r.stack)-n]
+}
+
+func (r *rewriter) push(t ...types.ValType) {
+	for _, v := range t {
+		r.stack = append(r.stack, stackValue{t: v, local: -1})
+	}
+}
+
+// Store the top values in some locals, taking them off the stack
+func (r *rewriter) store(locals []int) error {
+	err := r.materialize(len(locals))
+	if err != nil {
+		return err
+	}
+	for i := len(locals) - 1; i >= 0; i-- {
+		r.emit(localInstr("local.set", locals[i]))
+	}
+	r.pop(len(locals))
+	return nil
+}
+
+func (r *rewriter) setDead() {
+	f := r.frame()
+	f.dead = true
+	r.stack = r.stack[:f.height]
+}
+
+/**
+ * Finish the current piece of code, wrapping it so it only runs when not rewinding.
+ * Anything left on the real stack goes into locals first.
+ */
+func (r *rewriter) endSegment() {
+	for i := len(r.stack) - 1; i >= 0 && r.stack[i].local == -1; i-- {
+		l := r.slot(slotPosition, i, 0, r.stack[i].t)
+		r.emit(localInstr("local.set", l))
+		r.stack[i].local = l
+		r.stack[i].home = true
+	}
+	// Block results would be overwritten by the next block at the same depth, so move them.
+	for i, v := range r.stack {
+		if !v.home {
+			l := r.slot(slotPosition, i, 0, v.t)
+			r.emit(localInstr("local.get", v.local), localInstr("local.set", l))
+			r.stack[i].local = l
+			r.stack[i].home = true
+		}
+	}
+
+	if len(r.seg) > 0 {
+		r.out = append(r.out, globalGet(r.stateGlobal), instr("i32.eqz"), blockInstr("if"))
+		r.out = append(r.out, r.seg...)
+		r.out = append(r.out, instr("end"))
+	}
+	r.seg = make([]*expression.Expression, 0)
+}
+
+/**
+ * A call which can pause. It runs when not rewinding, or when rewinding back to this call. If the
+ * stack is being unwound when it returns, the call index is kept and the locals are saved.
+ */
+func (r *rewriter) callSite(e *expression.Expression, params []types.ValType, results []types.ValType) error {
+	if len(r.stack)-len(params) < r.frame().height {
+		return errors.New("stack underflow")
+	}
+	r.endSegment()
+	idx := r.calls
+	r.calls++
+
+	r.out = append(r.out,
+		globalGet(r.stateGlobal),
+		instr("i32.eqz"),
+		localInstr("local.get", r.callLocal),
+		i32Const(idx),
+		instr("i32.eq"),
+		instr("i32.or"),
+		blockInstr("if"))
+	for _, v := range r.stack[len(r.stack)-len(params):] {
+		r.out = append(r.out, localInstr("local.get", v.local))
+	}
+	r.out = append(r.out, e)
+
+	// The labels are this if, the one above, the original blocks, then the function body and the unwind block.
+	r.out = append(r.out,
+		globalGet(r.stateGlobal),
+		i32Const(1),
+		instr("i32.eq"),
+		blockInstr("if"),
+		i32Const(idx),
+		localInstr("local.set", r.callLocal),
+		labelInstr("br", len(r.frames)+2),
+		instr("end"))
+
+	r.pop(len(params))
+	base := len(r.stack)
+	for i := len(results) - 1; i >= 0; i-- {
+		r.out = append(r.out, localInstr("local.set", r.slot(slotPosition, base+i, 0, results[i])))
+	}
+	r.out = append(r.out, instr("end"))
+	for i, t := range results {
+		r.stack = append(r.stack, stackValue{t: t, local: r.slot(slotPosition, base+i, 0, t), home: true})
+	}
+	return nil
+}
+
+func (r *rewriter) rewriteInstr(e *expression.Expression) error {
+	op := e.Opcode
+
+	// Skip over any unreachable code, keeping track of blocks inside it
+	if r.frame().dead {
+		if op == expression.InstrToOpcode["block"] ||
+			op == expression.InstrToOpcode["loop"] ||
+			op == expression.InstrToOpcode["if"] {
+			r.skip++
+			return nil
+		} else if op == expression.InstrToOpcode["end"] && r.skip > 0 {
+			r.skip--
+			return nil
+		} else if op != expression.InstrToOpcode["end"] && (op != expression.InstrToOpcode["else"] || r.skip > 0) {
+			return nil
+		}
+	}
+
+	if op == expression.InstrToOpcode["block"] ||
+		op == expression.InstrToOpcode["loop"] ||
+		op == expression.InstrToOpcode["if"] {
+		if e.TypedBlock {
+			return fmt.Errorf("unsupported block type (type %d)", e.TypeIndex)
+		}
+		var results []types.ValType
+		if e.Result != types.ValNone {
+			_, ok := types.ByteToValType[e.Result]
+			if !ok {
+				return fmt.Errorf("unsupported block type %x", byte(e.Result))
+			}
+			results = []types.ValType{e.Result}
+		}
+		if op == expression.InstrToOpcode["if"] {
+			err := r.store([]int{r.slot(slotCondition, len(r.frames), 0, types.ValI32)})
+			if err != nil {
+				return err
+			}
+		}
+		r.endSegment()
+		if op == expression.InstrToOpcode["if"] {
+			r.out = append(r.out, localInstr("local.get", r.slot(slotCondition, len(r.frames), 0, types.ValI32)))
+		}
+		r.out = append(r.out, blockInstr(e.Name()))
+		r.frames = append(r.frames, &frame{
+			opcode:  op,
+			results: results,
+			height:  len(r.stack),
+			depth:   len(r.frames),
+		})
+	} else if op == expression.InstrToOpcode["else"] || op == expression.InstrToOpcode["end"] {
+		f := r.frame()
+		if len(r.frames) == 1 {
+			return errors.New("end without matching block")
+		}
+		if !f.dead {
+			err := r.store(r.resultSlots(f))
+			if err != nil {
+				return err
+			}
+			if len(r.stack) != f.height {
+				return fmt.Errorf("%d values left on stack at end of block", len(r.stack)-f.height)
+			}
+		}
+		r.endSegment()
+		r.out = append(r.out, instr(e.Name()))
+		r.stack = r.stack[:f.height]
+		if op == expression.InstrToOpcode["else"] {
+			f.dead = false
+		} else {
+			r.frames = r.frames[:len(r.frames)-1]
+			for i, l := range r.resultSlots(f) {
+				r.stack = append(r.stack, stackValue{t: f.results[i], local: l})
+			}
+		}
+	} else if op == expression.InstrToOpcode["br"] {
+		target, err := r.label(e.LabelIndex)
+		if err != nil {
+			return err
+		}
+		if len(target.labelTypes()) > 0 {
+			err = r.store(r.resultSlots(target))
+			if err != nil {
+				return err
+			}
+		}
+		r.emit(labelInstr("br", e.LabelIndex+1))
+		r.setDead()
+	} else if op == expression.InstrToOpcode["br_if"] {
+		target, err := r.label(e.LabelIndex)
+		if err != nil {
+			return err
+		}
+		err = r.store([]int{r.scratchLocal})
+		if err != nil {
+			return err
+		}
+		// The values stay on the stack if the branch isn't taken
+		if len(target.labelTypes()) > 0 {
+			slots := r.resultSlots(target)
+			err = r.store(slots)
+			if err != nil {
+				return err
+			}
+			for _, l := range slots {
+				r.emit(localInstr("local.get", l))
+			}
+			r.push(target.labelTypes()...)
+		}
+		r.emit(localInstr("local.get", r.scratchLocal), labelInstr("br_if", e.LabelIndex+1))
+	} else if op == expression.InstrToOpcode["br_table"] {
+		def, err := r.label(e.LabelIndex)
+		if err != nil {
+			return err
+		}
+		err = r.store([]int{r.scratchLocal})
+		if err != nil {
+			return err
+		}
+		labels := make([]int, 0, len(e.Labels))
+		for _, l := range e.Labels {
+			labels = append(labels, l+1)
+		}
+		if len(def.labelTypes()) > 0 {
+			slots := r.resultSlots(def)
+			err = r.store(slots)
+			if err != nil {
+				return err
+			}
+			// Every other block being branched to needs them too
+			for _, l := range e.Labels {
+				target, err := r.label(l)
+				if err != nil {
+					return err
+				}
+				for i, tl := range r.resultSlots(target) {
+					if tl != slots[i] {
+						r.emit(localInstr("local.get", slots[i]), localInstr("local.set", tl))
+					}
+				}
+			}
+		}
+		r.emit(localInstr("local.get", r.scratchLocal), &expression.Expression{
+			Opcode:     op,
+			LabelIndex: e.LabelIndex + 1,
+			Labels:     labels,
+		})
+		r.setDead()
+	} else if op == expression.InstrToOpcode["return"] {
+		err := r.materialize(len(r.te.Result))
+		if err != nil {
+			return err
+		}
+		r.emit(e)
+		r.setDead()
+	} else if op == expression.InstrToOpcode["unreachable"] {
+		r.emit(e)
+		r.setDead()
+	} else if op == expression.InstrToOpcode["nop"] {
+		// Nothing to do
+	} else if op == expression.InstrToOpcode["drop"] {
+		if len(r.stack) == r.frame().height {
+			return errors.New("stack underflow")
+		}
+		// Values in locals can just be forgotten about
+		if r.stack[len(r.stack)-1].local == -1 {
+			r.emit(e)
+		}
+		r.pop(1)
+	} else if op == expression.InstrToOpcode["select"] {
+		err := r.materialize(3)
+		if err != nil {
+			return err
+		}
+		t := r.stack[len(r.stack)-3].t
+		r.emit(e)
+		r.pop(3)
+		r.push(t)
+	} else {
+		params, results, err := r.wf.StackEffect(e, r.locals)
+		if err != nil {
+			return err
+		}
+		if (op == expression.InstrToOpcode["call"] && r.async[e.FuncIndex]) ||
+			(op == expression.InstrToOpcode["call_indirect"] && !r.ignoreIndirect) {
+			return r.callSite(e, params, results)
+		}
+		err = r.materialize(len(params))
+		if err != nil {
+			return err
+		}
+		r.emit(e)
+		r.pop(len(params))
+		r.push(results...)
+	}
+	return nil
+}
+
+// The size of each type of local in a saved stack frame
+var localSizes = map[types.ValType]int{
+	types.ValI64: 8,
+	types.ValF64: 8,
+	types.ValI32: 4,
+	types.ValF32: 4,
+}
+
+var localLoads = map[types.ValType]string{
+	types.ValI64: "i64.load",
+	types.ValF64: "f64.load",
+	types.ValI32: "i32.load",
+	types.ValF32: "f32.load",
+}
+
+var localStores = map[types.ValType]string{
+	types.ValI64: "i64.store",
+	types.ValF64: "f64.store",
+	types.ValI32: "i32.store",
+	types.ValF32: "f32.store",
+}
+
+var zeroConsts = map[types.ValType]string{
+	types.ValI64: "i64.const",
+	types.ValF64: "f64.const",
+	types.ValI32: "i32.const",
+	types.ValF32: "f32.const",
+}
+
+/**
+ * Work out where each local goes in a saved stack frame. The 8 byte ones go first, to keep them aligned.
+ * Returns the offsets by local, and the frame size.
+ */
+func (r *rewriter) frameLayout() (map[int]int, int) {
+	offsets := make(map[int]int)
+	ptr := 0
+	for _, size := range []int{8, 4} {
+		for l, t := range r.locals {
+			if l != r.spLocal && localSizes[t] == size {
+				offsets[l] = ptr
+				ptr += size
+			}
+		}
+	}
+	return offsets, (ptr + 7) &^ 7
+}
+
+/**
+ * Rewrite a function so that it can be unwound and rewound at any call which can pause.
+ * Returns the number of calls which can pause. If there are none, the code is left as it is.
+ */
+func RewriteCode(wf *wasmfile.WasmFile, c *wasmfile.CodeEntry, te *wasmfile.TypeEntry, async map[int]bool, ignoreIndirect bool, stateGlobal int, dataGlobal int) (int, error) {
+	r := &rewriter{
+		wf:             wf,
+		async:          async,
+		ignoreIndirect: ignoreIndirect,
+		te:             te,
+		slots:          make(map[slotKey]int),
+		seg:            make([]*expression.Expression, 0),
+		out:            make([]*expression.Expression, 0),
+		stateGlobal:    stateGlobal,
+		dataGlobal:     dataGlobal,
+	}
+	r.locals = append(r.locals, te.Param...)
+	r.locals = append(r.locals, c.Locals...)
+	for _, t := range r.locals {
+		_, ok := localSizes[t]
+		if !ok {
+			return 0, fmt.Errorf("unsupported local type %x", byte(t))
+		}
+	}
+	originalLocals := len(r.locals)
+	r.callLocal = r.newLocal(types.ValI32)
+	r.spLocal = r.newLocal(types.ValI32)
+	r.scratchLocal = r.newLocal(types.ValI32)
+
+	r.frames = []*frame{{
+		opcode:  expression.InstrToOpcode["block"],
+		results: te.Result,
+	}}
+
+	for _, e := range c.Expression {
+		err := r.rewriteInstr(e)
+		if err != nil {
+			return 0, fmt.Errorf("PC %d (%s): %w", e.PC, e.Name(), err)
+		}
+	}
+	if len(r.frames) != 1 {
+		return 0, fmt.Errorf("%d blocks not closed with end", len(r.frames)-1)
+	}
+	body := r.frames[0]
+	if !body.dead {
+		err := r.store(r.resultSlots(body))
+		if err != nil {
+			return 0, err
+		}
+		if len(r.stack) != 0 {
+			return 0, fmt.Errorf("%d values left on stack at end of function", len(r.stack))
+		}
+	}
+	r.endSegment()
+
+	if r.calls == 0 {
+		return 0, nil
+	}
+
+	offsets, size := r.frameLayout()
+	code := make([]*expression.Expression, 0, len(r.out)+4*len(r.locals)+32)
+
+	// When rewinding, take this function's frame off the saved stack and put the locals back.
+	code = append(code,
+		globalGet(r.stateGlobal),
+		i32Const(2),
+		instr("i32.eq"),
+		blockInstr("if"),
+		globalGet(r.dataGlobal),
+		globalGet(r.dataGlobal),
+		memInstr("i32.load", 2, 0),
+		i32Const(size),
+		instr("i32.sub"),
+		localInstr("local.tee", r.spLocal),
+		memInstr("i32.store", 2, 0))
+	for l, t := range r.locals {
+		if l == r.spLocal {
+			continue
+		}
+		code = append(code,
+			localInstr("local.get", r.spLocal),
+			memInstr(localLoads[t], 0, offsets[l]),
+			localInstr("local.set", l))
+	}
+	code = append(code, instr("end"))
+
+	// The unwind block, and the original function body inside it
+	code = append(code, blockInstr("block"), blockInstr("block"))
+	code = append(code, r.out...)
+	code = append(code, instr("end"))
+	for _, l := range r.resultSlots(body) {
+		code = append(code, localInstr("local.get", l))
+	}
+	code = append(code, instr("return"), instr("end"))
+
+	// Unwinding, so push this function's frame onto the saved stack, checking there's room for it.
+	code = append(code,
+		globalGet(r.dataGlobal),
+		memInstr("i32.load", 2, 0),
+		localInstr("local.tee", r.spLocal),
+		i32Const(size),
+		instr("i32.add"),
+		globalGet(r.dataGlobal),
+		memInstr("i32.load", 2, 4),
+		instr("i32.gt_u"),
+		blockInstr("if"),
+		instr("unreachable"),
+		instr("end"))
+	for l, t := range r.locals {
+		if l == r.spLocal {
+			continue
+		}
+		code = append(code,
+			localInstr("local.get", r.spLocal),
+			localInstr("local.get", l),
+			memInstr(localStores[t], 0, offsets[l]))
+	}
+	code = append(code,
+		globalGet(r.dataGlobal),
+		localInstr("local.get", r.spLocal),
+		i32Const(size),
+		instr("i32.add"),
+		memInstr("i32.store", 2, 0))
+
+	// The results don't matter, as the host won't use them
+	for _, t := range te.Result {
+		code = append(code, &expression.Expression{Opcode: expression.InstrToOpcode[zeroConsts[t]]})
+	}
+
+	c.Locals = append(c.Locals, r.locals[originalLocals:]...)
+	c.Expression = code
+	return r.calls, nil
+}
@@ -0,0 +1,406 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package bindgen
+
+import (
+	"debug/dwarf"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/token"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+const (
+	RuntimeWazero   = "wazero"
+	RuntimeWasmtime = "wasmtime"
+)
+
+// The wasmtime-go package used if the config doesn't say
+const DefaultWasmtimeImport = "github.com/bytecodealliance/wasmtime-go/v25"
+
+const wasiModule = "wasi_snapshot_preview1"
+
+type Bindgen_config struct {
+	Package        string // Package of the generated file. Defaults to main
+	Runtime        string // RuntimeWazero or RuntimeWasmtime. Defaults to wazero
+	WasmtimeImport string // Import path of wasmtime-go. Defaults to DefaultWasmtimeImport
+	WASI           bool   // Include the WASI imports, which the runtimes usually provide themselves
+}
+
+// An import to generate a host function for
+type hostFunc struct {
+	name    string // The import name
+	method  string // The Go method name
+	params  []*param
+	results []string // Go types
+	sig     string   // The wasm signature, for the comment
+}
+
+type param struct {
+	name   string
+	goType string
+}
+
+// The imports of one module
+type hostModule struct {
+	name  string
+	iface string // The Go interface name
+	funcs []*hostFunc
+}
+
+/**
+ * Generate Go host function bindings for the imports of a module. Each import module becomes an
+ * interface with a method for each of its functions, a stub type that implements it by panicking,
+ * and a function to add it to a wazero runtime or wasmtime linker. Param names come from the
+ * dwarf declarations of the imports if there are any, or the WASI function descriptions.
+ */
+func Go(wf *wasmfile.WasmFile, config Bindgen_config) ([]byte, error) {
+	if config.Package == "" {
+		config.Package = "main"
+	}
+	if config.Runtime == "" {
+		config.Runtime = RuntimeWazero
+	}
+	if config.WasmtimeImport == "" {
+		config.WasmtimeImport = DefaultWasmtimeImport
+	}
+	if config.Runtime != RuntimeWazero && config.Runtime != RuntimeWasmtime {
+		return nil, fmt.Errorf("Unknown runtime %q", config.Runtime)
+	}
+	if !token.IsIdentifier(config.Package) {
+		return nil, fmt.Errorf("Invalid package name %q", config.Package)
+	}
+
+	modules, err := hostModules(wf, config)
+	if err != nil {
+		return nil, err
+	}
+	if len(modules) == 0 {
+		if config.WASI {
+			return nil, errors.New("The module has no function imports")
+		}
+		return nil, errors.New("The module has no function imports apart from WASI, which needs --wasi")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Code generated by wasm-toolkit bindgen. DO NOT EDIT.\n\npackage %s\n\n", config.Package)
+	if config.Runtime == RuntimeWazero {
+		b.WriteString("import (\n\"context\"\n\n\"github.com/tetratelabs/wazero\"\n\"github.com/tetratelabs/wazero/api\"\n)\n")
+	} else {
+		fmt.Fprintf(&b, "import %q\n", config.WasmtimeImport)
+	}
+
+	for _, m := range modules {
+		writeModule(&b, m, config)
+	}
+
+	src, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return nil, fmt.Errorf("Generated code doesn't parse: %w", err)
+	}
+	return src, nil
+}
+
+// Group the function imports by module, in the order they're first imported
+func hostModules(wf *wasmfile.WasmFile, config Bindgen_config) ([]*hostModule, error) {
+	modules := make([]*hostModule, 0)
+	byName := make(map[string]*hostModule)
+	seen := make(map[string]*hostFunc)
+	ifaces := make(map[string]bool)
+	for fid, imp := range wf.Import {
+		if imp.Type != types.ExportFunc || (imp.Module == wasiModule && !config.WASI) {
+			continue
+		}
+		if imp.Index < 0 || imp.Index >= len(wf.Type) {
+			return nil, fmt.Errorf("Import %s.%s has an invalid type %d", imp.Module, imp.Name, imp.Index)
+		}
+		te := wf.Type[imp.Index]
+		sig := signature(te)
+
+		// A host function is only generated once, so repeated imports of it must agree on its type
+		key := imp.Module + "." + imp.Name
+		if f, ok := seen[key]; ok {
+			if f.sig != sig {
+				return nil, fmt.Errorf("Import %s is imported with different types", key)
+			}
+			continue
+		}
+
+		m, ok := byName[imp.Module]
+		if !ok {
+			m = &hostModule{name: imp.Module, iface: unique(goName(imp.Module), ifaces)}
+			// The stub type and the function to add it are named after the interface too
+			ifaces[m.iface+"Stub"] = true
+			ifaces["Instantiate"+m.iface] = true
+			ifaces["Define"+m.iface] = true
+			byName[imp.Module] = m
+			modules = append(modules, m)
+		}
+
+		methods := make(map[string]bool)
+		for _, f := range m.funcs {
+			methods[f.method] = true
+		}
+		f := &hostFunc{
+			name:   imp.Name,
+			method: unique(goName(imp.Name), methods),
+			sig:    sig,
+		}
+		names := paramNames(wf, fid, imp, len(te.Param))
+		used := map[string]bool{"ctx": true, "mod": true, "caller": true}
+		for i, vt := range te.Param {
+			f.params = append(f.params, &param{
+				name:   unique(identifier(names[i].name, fmt.Sprintf("p%d", i)), used),
+				goType: goType(vt, names[i].unsigned),
+			})
+		}
+		for _, vt := range te.Result {
+			f.results = append(f.results, goType(vt, imp.Module == wasiModule))
+		}
+		seen[key] = f
+		m.funcs = append(m.funcs, f)
+	}
+	return modules, nil
+}
+
+type paramName struct {
+	name     string
+	unsigned bool // Pointers and unsigned ints are best as unsigned Go types
+}
+
+/**
+ * Work out the names of the params of an import. The dwarf declaration is used if it has the
+ * right number of params, then the WASI descriptions, and otherwise p0, p1... The names still
+ * need making into identifiers.
+ */
+func paramNames(wf *wasmfile.WasmFile, fid int, imp *wasmfile.ImportEntry, count int) []paramName {
+	names := make([]paramName, count)
+	for i := range names {
+		names[i] = paramName{name: fmt.Sprintf("p%d", i), unsigned: imp.Module == wasiModule}
+	}
+
+	if imp.Module == wasiModule {
+		desc, ok := wasm.Debug_wasi_snapshot_preview1[imp.Name]
+		if ok {
+			start := strings.Index(desc, "(")
+			end := strings.LastIndex(desc, ")")
+			list := make([]string, 0)
+			if start != -1 && end > start && strings.TrimSpace(desc[start+1:end]) != "" {
+				list = strings.Split(desc[start+1:end], ",")
+			}
+			if len(list) == count {
+				for i, n := range list {
+					names[i].name = strings.TrimSpace(n)
+				}
+			}
+		}
+	}
+
+	dwarfParamNames(wf, fid, imp.Name, names)
+	return names
+}
+
+// Use the dwarf declaration of a function for the param names, if it has the right number of params
+func dwarfParamNames(wf *wasmfile.WasmFile, fid int, name string, names []paramName) {
+	if wf.Debug == nil || wf.Debug.DwarfData == nil {
+		return
+	}
+	// The name section has the symbol name, which is what the dwarf uses
+	lookup := []string{name}
+	if n, ok := wf.Debug.FunctionNames[fid]; ok {
+		lookup = append([]string{strings.TrimPrefix(n, "$")}, lookup...)
+	}
+	for _, n := range lookup {
+		params, err := wf.Debug.LookupFunctionParams(n)
+		if err != nil || len(params) != len(names) {
+			continue
+		}
+		for i, p := range params {
+			names[i].name = p.Name
+			names[i].unsigned = isUnsigned(p.Type)
+		}
+		return
+	}
+}
+
+func isUnsigned(ty dwarf.Type) bool {
+	for {
+		td, ok := ty.(*dwarf.TypedefType)
+		if !ok {
+			break
+		}
+		ty = td.Type
+	}
+	switch ty.(type) {
+	case *dwarf.PtrType, *dwarf.UintType, *dwarf.BoolType:
+		return true
+	}
+	return false
+}
+
+func goType(vt types.ValType, unsigned bool) string {
+	switch vt {
+	case types.ValI32:
+		if unsigned {
+			return "uint32"
+		}
+		return "int32"
+	case types.ValI64:
+		if unsigned {
+			return "uint64"
+		}
+		return "int64"
+	case types.ValF32:
+		return "float32"
+	case types.ValF64:
+		return "float64"
+	}
+	return "uint64"
+}
+
+// Describe a type as wat does
+func signature(te *wasmfile.TypeEntry) string {
+	parts := make([]string, 0, 2)
+	if len(te.Param) > 0 {
+		p := make([]string, 0, len(te.Param))
+		for _, vt := range te.Param {
+			p = append(p, types.ByteToValType[vt])
+		}
+		parts = append(parts, fmt.Sprintf("(param %s)", strings.Join(p, " ")))
+	}
+	if len(te.Result) > 0 {
+		r := make([]string, 0, len(te.Result))
+		for _, vt := range te.Result {
+			r = append(r, types.ByteToValType[vt])
+		}
+		parts = append(parts, fmt.Sprintf("(result %s)", strings.Join(r, " ")))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Turn a name like fd_write or wasi-snapshot into an exported Go name like FdWrite
+func goName(n string) string {
+	var b strings.Builder
+	upper := true
+	for _, c := range n {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			if upper && c >= 'a' && c <= 'z' {
+				c = c - 'a' + 'A'
+			}
+			b.WriteRune(c)
+			upper = false
+		} else {
+			upper = true
+		}
+	}
+	s := b.String()
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "X" + s
+	}
+	return s
+}
+
+// Make a name safe to use as a Go param, or use def if there's nothing left of it
+func identifier(n string, def string) string {
+	var b strings.Builder
+	for _, c := range n {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			b.WriteRune(c)
+		}
+	}
+	s := b.String()
+	if s == "" || s == "_" || (s[0] >= '0' && s[0] <= '9') {
+		return def
+	}
+	if token.IsKeyword(s) {
+		return s + "_"
+	}
+	return s
+}
+
+// Add a number to a name if it's already been used
+func unique(n string, used map[string]bool) string {
+	name := n
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s%d", n, i)
+	}
+	used[name] = true
+	return name
+}
+
+func (f *hostFunc) paramList(first string) string {
+	list := []string{first}
+	for _, p := range f.params {
+		list = append(list, p.name+" "+p.goType)
+	}
+	return strings.Join(list, ", ")
+}
+
+func (f *hostFunc) resultList() string {
+	switch len(f.results) {
+	case 0:
+		return ""
+	case 1:
+		return " " + f.results[0]
+	}
+	return " (" + strings.Join(f.results, ", ") + ")"
+}
+
+func writeModule(b *strings.Builder, m *hostModule, config Bindgen_config) {
+	first := "ctx context.Context, mod api.Module"
+	if config.Runtime == RuntimeWasmtime {
+		first = "caller *wasmtime.Caller"
+	}
+
+	fmt.Fprintf(b, "\n// %s is the host side of the imports from %q\n", m.iface, m.name)
+	fmt.Fprintf(b, "type %s interface {\n", m.iface)
+	for _, f := range m.funcs {
+		fmt.Fprintf(b, "// %s\n", strings.TrimSpace(f.name+" "+f.sig))
+		fmt.Fprintf(b, "%s(%s)%s\n", f.method, f.paramList(first), f.resultList())
+	}
+	b.WriteString("}\n")
+
+	fmt.Fprintf(b, "\n// %sStub implements %s by panicking. Embed it to only implement some of the functions.\n", m.iface, m.iface)
+	fmt.Fprintf(b, "type %sStub struct{}\n", m.iface)
+	for _, f := range m.funcs {
+		fmt.Fprintf(b, "\nfunc (%sStub) %s(%s)%s {\n", m.iface, f.method, f.paramList(first), f.resultList())
+		fmt.Fprintf(b, "panic(%q)\n}\n", fmt.Sprintf("%s.%s isn't implemented", m.name, f.name))
+	}
+
+	if config.Runtime == RuntimeWazero {
+		fmt.Fprintf(b, "\n// Instantiate%s adds the host module %q to a runtime, calling impl for each function\n", m.iface, m.name)
+		fmt.Fprintf(b, "func Instantiate%s(ctx context.Context, r wazero.Runtime, impl %s) (api.Module, error) {\n", m.iface, m.iface)
+		fmt.Fprintf(b, "b := r.NewHostModuleBuilder(%q)\n", m.name)
+		for _, f := range m.funcs {
+			fmt.Fprintf(b, "b.NewFunctionBuilder().WithFunc(impl.%s).Export(%q)\n", f.method, f.name)
+		}
+		b.WriteString("return b.Instantiate(ctx)\n}\n")
+		return
+	}
+
+	fmt.Fprintf(b, "\n// Define%s adds the functions of %q to a linker, calling impl for each one\n", m.iface, m.name)
+	fmt.Fprintf(b, "func Define%s(linker *wasmtime.Linker, impl %s) error {\n", m.iface, m.iface)
+	for _, f := range m.funcs {
+		fmt.Fprintf(b, "if err := linker.FuncWrap(%q, %q, impl.%s); err != nil {\nreturn err\n}\n", m.name, f.name, f.method)
+	}
+	b.WriteString("return nil\n}\n")
+}
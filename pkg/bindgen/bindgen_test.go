@@ -0,0 +1,100 @@
+package bindgen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32 i64) (result i32)))
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (type (func (param f64)))
+  (import "env" "add" (func $add (type 0)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (type 1)))
+  (import "env" "log-value" (func $log (type 2)))
+  (import "env" "add" (func $add_again (type 0)))
+  (memory 1)
+)
+`
+
+func testModule(t *testing.T, src string) *wasmfile.WasmFile {
+	wf := wasmfile.NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(src)))
+	return wf
+}
+
+func TestGoWazero(t *testing.T) {
+	src, err := Go(testModule(t, testWat), Bindgen_config{})
+	assert.NoError(t, err)
+	code := string(src)
+
+	assert.Contains(t, code, "// Code generated by wasm-toolkit bindgen. DO NOT EDIT.")
+	assert.Contains(t, code, "package main")
+	assert.Contains(t, code, "type Env interface {")
+	assert.Contains(t, code, "Add(ctx context.Context, mod api.Module, p0 int32, p1 int64) int32")
+	assert.Contains(t, code, "LogValue(ctx context.Context, mod api.Module, p0 float64)")
+	assert.Contains(t, code, `panic("env.add isn't implemented")`)
+	assert.Contains(t, code, `b := r.NewHostModuleBuilder("env")`)
+	assert.Contains(t, code, `b.NewFunctionBuilder().WithFunc(impl.LogValue).Export("log-value")`)
+
+	// WASI is left to the runtime, and add is only bound once
+	assert.NotContains(t, code, "FdWrite")
+	assert.Equal(t, 1, strings.Count(code, `Export("add")`))
+}
+
+func TestGoWasmtime(t *testing.T) {
+	src, err := Go(testModule(t, testWat), Bindgen_config{Package: "host", Runtime: RuntimeWasmtime, WASI: true})
+	assert.NoError(t, err)
+	code := string(src)
+
+	assert.Contains(t, code, "package host")
+	assert.Contains(t, code, `import "`+DefaultWasmtimeImport+`"`)
+	assert.Contains(t, code, "Add(caller *wasmtime.Caller, p0 int32, p1 int64) int32")
+	assert.Contains(t, code, "func DefineEnv(linker *wasmtime.Linker, impl Env) error {")
+	assert.Contains(t, code, `linker.FuncWrap("env", "add", impl.Add)`)
+
+	// WASI params are named from the descriptions, and are unsigned
+	assert.Contains(t, code, "type WasiSnapshotPreview1 interface {")
+	assert.Contains(t, code, "FdWrite(caller *wasmtime.Caller, fd uint32, iovs uint32, iovsLen uint32, nwritten uint32) uint32")
+}
+
+func TestGoErrors(t *testing.T) {
+	wasiOnly := testModule(t, `(module
+  (type (func (param i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (type 0)))
+)
+`)
+	_, err := Go(wasiOnly, Bindgen_config{})
+	assert.Error(t, err)
+	_, err = Go(wasiOnly, Bindgen_config{WASI: true})
+	assert.NoError(t, err)
+
+	_, err = Go(testModule(t, testWat), Bindgen_config{Runtime: "wasmer"})
+	assert.Error(t, err)
+	_, err = Go(testModule(t, testWat), Bindgen_config{Package: "not-a-package"})
+	assert.Error(t, err)
+
+	_, err = Go(testModule(t, `(module
+  (type (func (param i32)))
+  (type (func (param i64)))
+  (import "env" "f" (func $f (type 0)))
+  (import "env" "f" (func $g (type 1)))
+)
+`), Bindgen_config{})
+	assert.Error(t, err)
+}
+
+func TestNames(t *testing.T) {
+	assert.Equal(t, "FdWrite", goName("fd_write"))
+	assert.Equal(t, "WasiSnapshotPreview1", goName("wasi_snapshot_preview1"))
+	assert.Equal(t, "X2d", goName("2d"))
+	assert.Equal(t, "type_", identifier("type", "p0"))
+	assert.Equal(t, "p1", identifier("*", "p1"))
+
+	used := map[string]bool{"ctx": true}
+	assert.Equal(t, "ctx2", unique("ctx", used))
+	assert.Equal(t, "ctx3", unique("ctx", used))
+}
@@ -0,0 +1,168 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package bindgen
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+type C_config struct {
+	Module string // Name of the module, used for the include guard. Defaults to module
+	Prefix string // Added to the start of each function name
+}
+
+var cKeywords = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true, "continue": true,
+	"default": true, "do": true, "double": true, "else": true, "enum": true, "extern": true,
+	"float": true, "for": true, "goto": true, "if": true, "inline": true, "int": true,
+	"long": true, "register": true, "restrict": true, "return": true, "short": true,
+	"signed": true, "sizeof": true, "static": true, "struct": true, "switch": true,
+	"typedef": true, "union": true, "unsigned": true, "void": true, "volatile": true,
+	"while": true, "bool": true, "true": true, "false": true,
+}
+
+/**
+ * Generate a C header with a prototype for each exported function, so embedders get their
+ * signatures checked. Exports with more than one result return a struct of them. Param names
+ * come from the dwarf declarations if there are any.
+ */
+func C(wf *wasmfile.WasmFile, config C_config) ([]byte, error) {
+	if config.Module == "" {
+		config.Module = "module"
+	}
+	if config.Prefix != "" && cIdentifier(config.Prefix, "") != config.Prefix {
+		return nil, fmt.Errorf("Invalid prefix %q", config.Prefix)
+	}
+	guard := strings.ToUpper(cIdentifier(config.Module, "module")) + "_WASM_H"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "/* Code generated by wasm-toolkit bindgen. DO NOT EDIT. */\n\n")
+	fmt.Fprintf(&b, "#ifndef %s\n#define %s\n\n#include <stdint.h>\n\n", guard, guard)
+	b.WriteString("#ifdef __cplusplus\nextern \"C\" {\n#endif\n")
+
+	used := make(map[string]bool)
+	count := 0
+	for _, e := range wf.Export {
+		if e.Type != types.ExportFunc {
+			continue
+		}
+		te, err := funcType(wf, e.Index)
+		if err != nil {
+			return nil, fmt.Errorf("Export %s: %w", e.Name, err)
+		}
+		name := unique(config.Prefix+cIdentifier(e.Name, "func"), used)
+
+		names := make([]paramName, len(te.Param))
+		dwarfParamNames(wf, e.Index, e.Name, names)
+		paramsUsed := make(map[string]bool)
+		params := make([]string, 0, len(te.Param))
+		for i, vt := range te.Param {
+			pn := unique(cIdentifier(names[i].name, fmt.Sprintf("p%d", i)), paramsUsed)
+			params = append(params, cType(vt, names[i].unsigned)+" "+pn)
+		}
+		if len(params) == 0 {
+			params = append(params, "void")
+		}
+
+		result := "void"
+		if len(te.Result) == 1 {
+			result = cType(te.Result[0], false)
+		} else if len(te.Result) > 1 {
+			result = unique(name+"_results_t", used)
+			fmt.Fprintf(&b, "\ntypedef struct {\n")
+			for i, vt := range te.Result {
+				fmt.Fprintf(&b, "  %s r%d;\n", cType(vt, false), i)
+			}
+			fmt.Fprintf(&b, "} %s;\n", result)
+		}
+
+		fmt.Fprintf(&b, "\n/* %s */\n", strings.TrimSpace(e.Name+" "+signature(te)))
+		fmt.Fprintf(&b, "%s %s(%s);\n", result, name, strings.Join(params, ", "))
+		count++
+	}
+	if count == 0 {
+		return nil, errors.New("The module has no function exports")
+	}
+
+	b.WriteString("\n#ifdef __cplusplus\n}\n#endif\n")
+	fmt.Fprintf(&b, "\n#endif /* %s */\n", guard)
+	return []byte(b.String()), nil
+}
+
+// Find the type of a function, which may be imported
+func funcType(wf *wasmfile.WasmFile, fid int) (*wasmfile.TypeEntry, error) {
+	tid := -1
+	if fid < len(wf.Import) {
+		if wf.Import[fid].Type == types.ExportFunc {
+			tid = wf.Import[fid].Index
+		}
+	} else if fid-len(wf.Import) < len(wf.Function) {
+		tid = wf.Function[fid-len(wf.Import)].TypeIndex
+	}
+	if tid < 0 || tid >= len(wf.Type) {
+		return nil, fmt.Errorf("Function %d doesn't have a valid type", fid)
+	}
+	return wf.Type[tid], nil
+}
+
+func cType(vt types.ValType, unsigned bool) string {
+	switch vt {
+	case types.ValI32:
+		if unsigned {
+			return "uint32_t"
+		}
+		return "int32_t"
+	case types.ValI64:
+		if unsigned {
+			return "uint64_t"
+		}
+		return "int64_t"
+	case types.ValF32:
+		return "float"
+	case types.ValF64:
+		return "double"
+	}
+	return "uint64_t"
+}
+
+// Make a name safe to use in C, or use def if there's nothing left of it
+func cIdentifier(n string, def string) string {
+	var b strings.Builder
+	for _, c := range n {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	s := b.String()
+	if strings.Trim(s, "_") == "" {
+		return def
+	}
+	if s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	if cKeywords[s] {
+		return s + "_"
+	}
+	return s
+}
@@ -0,0 +1,59 @@
+package bindgen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testExportsWat = `(module
+  (type (func (param i32 i64) (result i32)))
+  (type (func))
+  (type (func (param f32) (result f64) (result i32)))
+  (import "env" "add" (func $add (type 0)))
+  (func $start (type 1))
+  (func $split (type 2)
+    f64.const 0
+    i32.const 0
+  )
+  (memory 1)
+  (export "add" (func $add))
+  (export "_start" (func $start))
+  (export "split-float" (func $split))
+  (export "int" (func $start))
+  (export "memory" (memory 0))
+)
+`
+
+func TestC(t *testing.T) {
+	src, err := C(testModule(t, testExportsWat), C_config{Module: "my-module"})
+	assert.NoError(t, err)
+	code := string(src)
+
+	assert.Contains(t, code, "#ifndef MY_MODULE_WASM_H\n#define MY_MODULE_WASM_H\n")
+	assert.Contains(t, code, "#include <stdint.h>")
+	assert.Contains(t, code, "/* add (param i32 i64) (result i32) */\nint32_t add(int32_t p0, int64_t p1);\n")
+	assert.Contains(t, code, "void _start(void);\n")
+	assert.Contains(t, code, "typedef struct {\n  double r0;\n  int32_t r1;\n} split_float_results_t;\n")
+	assert.Contains(t, code, "split_float_results_t split_float(float p0);\n")
+	assert.Contains(t, code, "void int_(void);\n")
+	assert.NotContains(t, code, "memory")
+	assert.Contains(t, code, "#endif /* MY_MODULE_WASM_H */\n")
+
+	src, err = C(testModule(t, testExportsWat), C_config{Prefix: "mod_"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(src), "#ifndef MODULE_WASM_H")
+	assert.Contains(t, string(src), "int32_t mod_add(int32_t p0, int64_t p1);")
+}
+
+func TestCErrors(t *testing.T) {
+	_, err := C(testModule(t, testExportsWat), C_config{Prefix: "bad prefix"})
+	assert.Error(t, err)
+
+	_, err = C(testModule(t, `(module
+  (memory 1)
+  (export "memory" (memory 0))
+)
+`), C_config{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package bindgen
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+type Wit_config struct {
+	World   string // Name of the world. Defaults to module
+	Package string // Package id, eg example:module. Defaults to local:<world>
+	WASI    bool   // Include the WASI preview1 imports, which would usually become wasi:* imports instead
+}
+
+var witKeywords = map[string]bool{
+	"as": true, "async": true, "bool": true, "borrow": true, "char": true, "constructor": true,
+	"enum": true, "export": true, "f32": true, "f64": true, "flags": true, "from": true,
+	"func": true, "future": true, "import": true, "include": true, "interface": true,
+	"list": true, "option": true, "own": true, "package": true, "record": true,
+	"resource": true, "result": true, "s8": true, "s16": true, "s32": true, "s64": true,
+	"static": true, "stream": true, "string": true, "tuple": true, "type": true, "u8": true,
+	"u16": true, "u32": true, "u64": true, "use": true, "variant": true, "with": true,
+	"world": true,
+}
+
+/**
+ * Generate a WIT world from the imports and exports of a core module, as a starting point for
+ * making it a component. Each import module becomes an inline interface, and each exported
+ * function an export. Only the core number types are known, so pointers and lengths are left
+ * for the user to turn into strings, lists and records.
+ */
+func Wit(wf *wasmfile.WasmFile, config Wit_config) ([]byte, error) {
+	world := witName(config.World)
+	if world == "" {
+		world = "module"
+	}
+	pkg := config.Package
+	if pkg == "" {
+		pkg = "local:" + world
+	}
+	ns, name, ok := strings.Cut(pkg, ":")
+	if !ok || witName(ns) != ns || witName(strings.Split(name, "@")[0]) != strings.Split(name, "@")[0] {
+		return nil, fmt.Errorf("Invalid package %q, it should be like namespace:name", pkg)
+	}
+
+	var b strings.Builder
+	b.WriteString("// Generated by wasm-toolkit bindgen from the imports and exports of a core module. Only the\n")
+	b.WriteString("// number types are known, so pointers and lengths will want replacing with strings, lists and records.\n")
+	fmt.Fprintf(&b, "package %s;\n\nworld %s {\n", pkg, witIdentifier(world))
+
+	// The imports, an interface for each module in the order they're first imported
+	modules := make([]string, 0)
+	funcs := make(map[string][]string)
+	sigs := make(map[string]string)
+	for fid, imp := range wf.Import {
+		if imp.Type != types.ExportFunc || (imp.Module == wasiModule && !config.WASI) {
+			continue
+		}
+		if imp.Index < 0 || imp.Index >= len(wf.Type) {
+			return nil, fmt.Errorf("Import %s.%s has an invalid type %d", imp.Module, imp.Name, imp.Index)
+		}
+		te := wf.Type[imp.Index]
+		key := imp.Module + "." + imp.Name
+		if sig, ok := sigs[key]; ok {
+			if sig != signature(te) {
+				return nil, fmt.Errorf("Import %s is imported with different types", key)
+			}
+			continue
+		}
+		sigs[key] = signature(te)
+		if _, ok := funcs[imp.Module]; !ok {
+			modules = append(modules, imp.Module)
+		}
+		names := paramNames(wf, fid, imp, len(te.Param))
+		funcs[imp.Module] = append(funcs[imp.Module], witFunc(imp.Name, te, names, imp.Module == wasiModule))
+	}
+
+	used := make(map[string]bool)
+	for _, m := range modules {
+		fmt.Fprintf(&b, "  import %s: interface {\n", witIdentifier(unique(witName(m), used)))
+		fnames := make(map[string]bool)
+		for _, f := range funcs[m] {
+			// Names that differ in wasm can be the same once they're kebab case
+			n, rest, _ := strings.Cut(f, ":")
+			fmt.Fprintf(&b, "    %s:%s\n", witIdentifier(unique(n, fnames)), rest)
+		}
+		b.WriteString("  }\n")
+	}
+
+	exports := make([]string, 0)
+	for _, e := range wf.Export {
+		if e.Type != types.ExportFunc {
+			continue
+		}
+		te, err := funcType(wf, e.Index)
+		if err != nil {
+			return nil, fmt.Errorf("Export %s: %w", e.Name, err)
+		}
+		names := make([]paramName, len(te.Param))
+		dwarfParamNames(wf, e.Index, e.Name, names)
+		f := witFunc(e.Name, te, names, false)
+		n, rest, _ := strings.Cut(f, ":")
+		exports = append(exports, fmt.Sprintf("  export %s:%s\n", witIdentifier(unique(n, used)), rest))
+	}
+
+	if len(modules) == 0 && len(exports) == 0 {
+		return nil, errors.New("The module has no function imports or exports")
+	}
+	if len(modules) > 0 && len(exports) > 0 {
+		b.WriteString("\n")
+	}
+	for _, e := range exports {
+		b.WriteString(e)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String()), nil
+}
+
+// A function as name: func(...) -> result;
+func witFunc(name string, te *wasmfile.TypeEntry, names []paramName, unsigned bool) string {
+	used := make(map[string]bool)
+	params := make([]string, 0, len(te.Param))
+	for i, vt := range te.Param {
+		pn := witName(names[i].name)
+		if pn == "" {
+			pn = fmt.Sprintf("p%d", i)
+		}
+		params = append(params, fmt.Sprintf("%s: %s", witIdentifier(unique(pn, used)), witType(vt, names[i].unsigned)))
+	}
+	results := make([]string, 0, len(te.Result))
+	for _, vt := range te.Result {
+		results = append(results, witType(vt, unsigned))
+	}
+	result := ""
+	if len(results) == 1 {
+		result = " -> " + results[0]
+	} else if len(results) > 1 {
+		result = " -> tuple<" + strings.Join(results, ", ") + ">"
+	}
+	fname := witName(name)
+	if fname == "" {
+		fname = "func"
+	}
+	return fmt.Sprintf("%s: func(%s)%s;", fname, strings.Join(params, ", "), result)
+}
+
+func witType(vt types.ValType, unsigned bool) string {
+	switch vt {
+	case types.ValI32:
+		if unsigned {
+			return "u32"
+		}
+		return "s32"
+	case types.ValI64:
+		if unsigned {
+			return "u64"
+		}
+		return "s64"
+	case types.ValF32:
+		return "f32"
+	case types.ValF64:
+		return "f64"
+	}
+	return "u64"
+}
+
+/**
+ * Turn a name like fd_write, addNumbers or __main_void into kebab case, eg fd-write. Each part has
+ * to start with a letter, so a part starting with a digit is joined to the one before it.
+ */
+func witName(n string) string {
+	parts := make([]string, 0)
+	var cur []rune
+	var prev rune
+	flush := func() {
+		if len(cur) == 0 {
+			return
+		}
+		p := strings.ToLower(string(cur))
+		if p[0] >= '0' && p[0] <= '9' {
+			if len(parts) > 0 {
+				parts[len(parts)-1] += p
+			} else {
+				parts = append(parts, "x"+p)
+			}
+		} else {
+			parts = append(parts, p)
+		}
+		cur = nil
+	}
+	for _, c := range n {
+		lower := c >= 'a' && c <= 'z'
+		upper := c >= 'A' && c <= 'Z'
+		digit := c >= '0' && c <= '9'
+		if !lower && !upper && !digit {
+			flush()
+			prev = 0
+			continue
+		}
+		if upper && ((prev >= 'a' && prev <= 'z') || (prev >= '0' && prev <= '9')) {
+			flush()
+		}
+		cur = append(cur, c)
+		prev = c
+	}
+	flush()
+	return strings.Join(parts, "-")
+}
+
+// Keywords can be used as names with a %
+func witIdentifier(n string) string {
+	if witKeywords[n] {
+		return "%" + n
+	}
+	return n
+}
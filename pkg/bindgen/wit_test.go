@@ -0,0 +1,73 @@
+package bindgen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testWitWat = `(module
+  (type (func (param i32 i64) (result i32)))
+  (type (func))
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (type (func (param f32) (result f64) (result i32)))
+  (import "env" "add" (func $add (type 0)))
+  (import "env" "add_numbers" (func $add_numbers (type 0)))
+  (import "env" "addNumbers" (func $addNumbers (type 0)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (type 2)))
+  (func $start (type 1))
+  (func $split (type 3)
+    f64.const 0
+    i32.const 0
+  )
+  (export "_start" (func $start))
+  (export "splitFloat" (func $split))
+  (export "type" (func $start))
+)
+`
+
+func TestWit(t *testing.T) {
+	src, err := Wit(testModule(t, testWitWat), Wit_config{World: "my_module"})
+	assert.NoError(t, err)
+	assert.Equal(t, `// Generated by wasm-toolkit bindgen from the imports and exports of a core module. Only the
+// number types are known, so pointers and lengths will want replacing with strings, lists and records.
+package local:my-module;
+
+world my-module {
+  import env: interface {
+    add: func(p0: s32, p1: s64) -> s32;
+    add-numbers: func(p0: s32, p1: s64) -> s32;
+    add-numbers2: func(p0: s32, p1: s64) -> s32;
+  }
+
+  export start: func();
+  export split-float: func(p0: f32) -> tuple<f64, s32>;
+  export %type: func();
+}
+`, string(src))
+
+	// WASI params are named from the descriptions
+	src, err = Wit(testModule(t, testWitWat), Wit_config{Package: "example:thing@0.1.0", WASI: true})
+	assert.NoError(t, err)
+	assert.Contains(t, string(src), "package example:thing@0.1.0;\n\nworld module {\n")
+	assert.Contains(t, string(src), "  import wasi-snapshot-preview1: interface {\n    fd-write: func(fd: u32, iovs: u32, iovs-len: u32, nwritten: u32) -> u32;\n  }\n")
+}
+
+func TestWitErrors(t *testing.T) {
+	_, err := Wit(testModule(t, testWitWat), Wit_config{Package: "nocolon"})
+	assert.Error(t, err)
+	_, err = Wit(testModule(t, testWitWat), Wit_config{Package: "a:B_c"})
+	assert.Error(t, err)
+	_, err = Wit(testModule(t, "(module\n  (memory 1)\n)\n"), Wit_config{})
+	assert.Error(t, err)
+}
+
+func TestWitName(t *testing.T) {
+	assert.Equal(t, "fd-write", witName("fd_write"))
+	assert.Equal(t, "add-numbers", witName("addNumbers"))
+	assert.Equal(t, "wasi-snapshot-preview1", witName("wasi_snapshot_preview1"))
+	assert.Equal(t, "main-void", witName("__main_void"))
+	assert.Equal(t, "x2d-point", witName("2d_point"))
+	assert.Equal(t, "vec3-add", witName("vec3Add"))
+	assert.Equal(t, "", witName("__"))
+}
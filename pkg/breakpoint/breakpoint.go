@@ -0,0 +1,174 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package breakpoint
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/wat"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+// With Trap, the PC of the breakpoint that was hit is exported as this global
+const PCExport = "__wasm_toolkit_breakpoint"
+
+type Breakpoint_config struct {
+	Locations []string // Source locations as file:line, where the file can be a path suffix eg "main.go:12". Add " if <predicate>" for a condition
+	Trap      bool     // Trap at a breakpoint, instead of calling the wasm_toolkit.break import
+	DebugDir  string   // Where to look for split dwarf files. If empty, only the dwarf sections in the wasm are used
+}
+
+// Split a file:line location
+func ParseLocation(loc string) (string, int, error) {
+	i := strings.LastIndex(loc, ":")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("Invalid location %q, expected file:line", loc)
+	}
+	line, err := strconv.Atoi(loc[i+1:])
+	if err != nil || line <= 0 {
+		return "", 0, fmt.Errorf("Invalid location %q, expected file:line", loc)
+	}
+	return loc[:i], line, nil
+}
+
+// Split a location such as "main.go:12 if n == 5" into the location and the condition, which can be empty
+func SplitCondition(loc string) (string, string) {
+	i := strings.Index(loc, " if ")
+	if i == -1 {
+		return strings.TrimSpace(loc), ""
+	}
+	return strings.TrimSpace(loc[:i]), strings.TrimSpace(loc[i+4:])
+}
+
+/**
+ * Add breakpoints at source lines, using the dwarf line numbers. Each one calls the import
+ * wasm_toolkit.break with the PC it's at, so the host can pause the module there. With Trap,
+ * the module traps instead. A breakpoint with a condition only fires when it holds.
+ */
+func AddBreakpoints(wasmInput []byte, config Breakpoint_config) ([]byte, error) {
+	type location struct {
+		file string
+		line int
+		cond string
+	}
+	locations := make([]location, 0)
+	for _, l := range config.Locations {
+		loc, cond := SplitCondition(l)
+		file, line, err := ParseLocation(loc)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location{file: file, line: line, cond: cond})
+	}
+	if len(locations) == 0 {
+		return nil, errors.New("No breakpoint locations given")
+	}
+
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	debugSections, err := wfile.DebugSections(config.DebugDir)
+	if err != nil {
+		return nil, err
+	}
+	if debugSections.GetCustomSectionData(".debug_line") == nil {
+		return nil, errors.New("The module has no dwarf line numbers")
+	}
+	err = wfile.Debug.ParseDwarf(debugSections)
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.Debug.ParseDwarfLineNumbers()
+	if err != nil {
+		return nil, err
+	}
+
+	if wfile.Debug.LookupFunctionID(wasmfile.BreakpointHandler) != -1 {
+		return nil, fmt.Errorf("The module already has a function %s", wasmfile.BreakpointHandler)
+	}
+
+	originalFunctionLength := len(wfile.Code)
+
+	file := "breakpoint_host.wat"
+	if config.Trap {
+		file = "breakpoint_trap.wat"
+	}
+	data, err := wat.Wat_content.ReadFile(path.Join("wat_code", file))
+	if err != nil {
+		return nil, err
+	}
+	mod := &wasmfile.WasmFile{}
+	err = mod.DecodeWatFile(file, data)
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.AddFuncsFrom(mod, func(remap map[int]int) {})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range wfile.Code[originalFunctionLength:] {
+		err = c.ResolveGlobals(wfile)
+		if err != nil {
+			return nil, err
+		}
+		err = c.ResolveFunctions(wfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Trap {
+		err = wfile.AddExport(PCExport, types.ExportGlobal, wfile.Debug.LookupGlobalID("$breakpoint_pc"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The line numbers are for the PCs the code was decoded with, so every breakpoint goes in before encoding
+	for _, loc := range locations {
+		_, err = wfile.InsertConditionalBreakpoint(loc.file, loc.line, loc.cond)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The handler moves the functions after the imports along, so the names need writing out again
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,127 @@
+package breakpoint
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32) (result i32)))
+  (func $double (type 0)
+    local.get 0
+    local.get 0
+    i32.add
+  )
+  (func $run (type 0)
+    local.get 0
+    call $double
+    i32.const 1
+    i32.add
+  )
+  (export "run" (func $run))
+)
+`
+
+func TestParseLocation(t *testing.T) {
+	file, line, err := ParseLocation("src/main.go:12")
+	assert.NoError(t, err)
+	assert.Equal(t, "src/main.go", file)
+	assert.Equal(t, 12, line)
+
+	for _, loc := range []string{"main.go", ":12", "main.go:x", "main.go:0"} {
+		_, _, err = ParseLocation(loc)
+		assert.Error(t, err, loc)
+	}
+}
+
+func TestSplitCondition(t *testing.T) {
+	loc, cond := SplitCondition("main.go:12 if n == 5 && mem[i32:16] != 0")
+	assert.Equal(t, "main.go:12", loc)
+	assert.Equal(t, "n == 5 && mem[i32:16] != 0", cond)
+
+	loc, cond = SplitCondition("main.go:12")
+	assert.Equal(t, "main.go:12", loc)
+	assert.Equal(t, "", cond)
+}
+
+func TestAddBreakpoints(t *testing.T) {
+	in := testutil.Encode(t, testutil.ModuleWithDebug(t, testWat))
+
+	_, err := AddBreakpoints(in, Breakpoint_config{})
+	assert.Error(t, err)
+	_, err = AddBreakpoints(in, Breakpoint_config{Locations: []string{"test.wat:100"}})
+	assert.Error(t, err)
+
+	// Lines 4 and 10 are the first instructions of $double and the call to it
+	out, err := AddBreakpoints(in, Breakpoint_config{Locations: []string{"test.wat:4", "test.wat:10"}})
+	assert.NoError(t, err)
+
+	ctx, r := testutil.Runtime(t)
+	hits := make([]uint32, 0)
+	_, err = r.NewHostModuleBuilder("wasm_toolkit").NewFunctionBuilder().
+		WithFunc(func(pc uint32) {
+			hits = append(hits, pc)
+		}).Export("break").Instantiate(ctx)
+	assert.NoError(t, err)
+	mod, err := r.Instantiate(ctx, out)
+	assert.NoError(t, err)
+	res, err := mod.ExportedFunction("run").Call(ctx, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), res[0])
+
+	// The call is hit first, then $double
+	assert.Equal(t, 2, len(hits))
+	assert.True(t, hits[0] > hits[1])
+
+	wf := &wasmfile.WasmFile{}
+	assert.NoError(t, wf.DecodeBinary(in))
+	assert.Equal(t, uint64(hits[1]), wf.Code[0].Expression[0].PC)
+	assert.Equal(t, uint64(hits[0]), wf.Code[1].Expression[1].PC)
+}
+
+func TestAddBreakpointsTrap(t *testing.T) {
+	out, err := AddBreakpoints(testutil.Encode(t, testutil.ModuleWithDebug(t, testWat)), Breakpoint_config{Locations: []string{"test.wat:4"}, Trap: true})
+	assert.NoError(t, err)
+
+	ctx, mod := testutil.Instantiate(t, out)
+	_, err = mod.ExportedFunction("run").Call(ctx, 5)
+	assert.Error(t, err)
+
+	wf := &wasmfile.WasmFile{}
+	assert.NoError(t, wf.DecodeBinary(testutil.Encode(t, testutil.ModuleWithDebug(t, testWat))))
+	g := mod.ExportedGlobal(PCExport)
+	assert.Equal(t, wf.Code[0].Expression[0].PC, uint64(uint32(g.Get())))
+}
+
+func TestAddBreakpointsConditional(t *testing.T) {
+	in := testutil.Encode(t, testutil.ModuleWithDebug(t, testWat))
+
+	_, err := AddBreakpoints(in, Breakpoint_config{Locations: []string{"test.wat:4 if missing == 1"}})
+	assert.Error(t, err)
+
+	out, err := AddBreakpoints(in, Breakpoint_config{Locations: []string{"test.wat:4 if local0 == 3"}})
+	assert.NoError(t, err)
+
+	ctx, r := testutil.Runtime(t)
+	hits := 0
+	_, err = r.NewHostModuleBuilder("wasm_toolkit").NewFunctionBuilder().
+		WithFunc(func(pc uint32) {
+			hits++
+		}).Export("break").Instantiate(ctx)
+	assert.NoError(t, err)
+	mod, err := r.Instantiate(ctx, out)
+	assert.NoError(t, err)
+
+	res, err := mod.ExportedFunction("run").Call(ctx, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), res[0])
+	assert.Equal(t, 0, hits)
+
+	res, err = mod.ExportedFunction("run").Call(ctx, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), res[0])
+	assert.Equal(t, 1, hits)
+}
@@ -0,0 +1,344 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package callgraph
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/demangle"
+	"github.com/loopholelabs/wasm-toolkit/pkg/tracefmt"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+type Callgraph_config struct {
+	Roots   []string          // Only keep the functions reachable from these exports
+	Profile []*tracefmt.Event // Events from strace --format=chrome, to count the calls on each edge
+}
+
+type Node struct {
+	Index  int
+	Name   string
+	Import bool
+}
+
+type Edge struct {
+	From     int
+	To       int
+	Indirect bool   // A call_indirect that can reach To through the elem segments, or a call only seen in the profile
+	Calls    uint64 // Calls seen in the profile
+}
+
+type Graph struct {
+	Nodes    []*Node // By function index
+	Edges    []*Edge // By caller, then callee
+	Profiled bool
+}
+
+type edgeKey struct {
+	from int
+	to   int
+}
+
+/**
+ * Build the call graph of a module. Direct calls give an edge to the function called. A
+ * call_indirect gives an edge to every function in the elem segments of its table that has the
+ * right type, since any of them could be called.
+ */
+func Build(wf *wasmfile.WasmFile, config Callgraph_config) (*Graph, error) {
+	numFuncs := len(wf.Import) + len(wf.Code)
+
+	// The functions each table can hold, by type
+	targets := make(map[int]map[string][]int)
+	for _, el := range wf.Elem {
+		byType, ok := targets[el.TableIndex]
+		if !ok {
+			byType = make(map[string][]int)
+			targets[el.TableIndex] = byType
+		}
+		for _, idx := range el.Indexes {
+			fid := int(idx)
+			te, err := funcType(wf, fid)
+			if err != nil {
+				return nil, err
+			}
+			sig := signature(te)
+			if !contains(byType[sig], fid) {
+				byType[sig] = append(byType[sig], fid)
+			}
+		}
+	}
+
+	edges := make(map[edgeKey]*Edge)
+	for idx, c := range wf.Code {
+		from := len(wf.Import) + idx
+		for _, e := range c.Expression {
+			if e.Opcode == expression.InstrToOpcode["call"] {
+				if e.FuncIndex < 0 || e.FuncIndex >= numFuncs {
+					return nil, fmt.Errorf("Function %d calls function %d, which doesn't exist", from, e.FuncIndex)
+				}
+				addEdge(edges, from, e.FuncIndex, false)
+			} else if e.Opcode == expression.InstrToOpcode["call_indirect"] {
+				if e.TypeIndex < 0 || e.TypeIndex >= len(wf.Type) {
+					return nil, fmt.Errorf("Function %d has a call_indirect with an invalid type %d", from, e.TypeIndex)
+				}
+				for _, to := range targets[e.TableIndex][signature(wf.Type[e.TypeIndex])] {
+					addEdge(edges, from, to, true)
+				}
+			}
+		}
+	}
+
+	g := &Graph{
+		Nodes: make([]*Node, 0),
+		Edges: make([]*Edge, 0),
+	}
+	if len(config.Profile) > 0 {
+		g.Profiled = true
+		addProfile(wf, edges, config.Profile)
+	}
+
+	keep := make(map[int]bool)
+	if len(config.Roots) > 0 {
+		calls := make(map[int][]int)
+		for k := range edges {
+			calls[k.from] = append(calls[k.from], k.to)
+		}
+		todo := make([]int, 0)
+		for _, r := range config.Roots {
+			fid, err := exportedFunction(wf, r)
+			if err != nil {
+				return nil, err
+			}
+			todo = append(todo, fid)
+		}
+		for len(todo) > 0 {
+			fid := todo[len(todo)-1]
+			todo = todo[:len(todo)-1]
+			if keep[fid] {
+				continue
+			}
+			keep[fid] = true
+			todo = append(todo, calls[fid]...)
+		}
+	}
+
+	names := functionNames(wf)
+	for fid := 0; fid < numFuncs; fid++ {
+		if len(config.Roots) > 0 && !keep[fid] {
+			continue
+		}
+		g.Nodes = append(g.Nodes, &Node{Index: fid, Name: names[fid], Import: fid < len(wf.Import)})
+	}
+	for k, e := range edges {
+		if len(config.Roots) > 0 && !keep[k.from] {
+			continue
+		}
+		g.Edges = append(g.Edges, e)
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	return g, nil
+}
+
+// A direct call is kept over an indirect one between the same functions
+func addEdge(edges map[edgeKey]*Edge, from int, to int, indirect bool) *Edge {
+	k := edgeKey{from, to}
+	e, ok := edges[k]
+	if !ok {
+		e = &Edge{From: from, To: to, Indirect: indirect}
+		edges[k] = e
+	} else if !indirect {
+		e.Indirect = false
+	}
+	return e
+}
+
+/**
+ * Count the calls between each pair of functions in a chrome trace. The trace has the names strace
+ * gave the functions, which can be the raw or demangled name, and a name strace made up for imports.
+ * Calls that aren't in the graph already, such as to a function put in a table at runtime, are added.
+ */
+func addProfile(wf *wasmfile.WasmFile, edges map[edgeKey]*Edge, events []*tracefmt.Event) {
+	byName := make(map[string]int)
+	for fid := 0; fid < len(wf.Import)+len(wf.Code); fid++ {
+		for _, n := range wf.Debug.GetFunctionMatchNames(fid) {
+			byName[n] = fid
+		}
+		if fid < len(wf.Import) {
+			byName[fmt.Sprintf("$IMPORT_%s_%s", wf.Import[fid].Module, wf.Import[fid].Name)] = fid
+		}
+	}
+
+	stacks := make(map[int][]int)
+	for _, ev := range events {
+		switch ev.Ph {
+		case "B":
+			fid, ok := byName[ev.Name]
+			if !ok {
+				fid = -1
+			}
+			stack := stacks[ev.Tid]
+			if fid != -1 && len(stack) > 0 && stack[len(stack)-1] != -1 {
+				addEdge(edges, stack[len(stack)-1], fid, true).Calls++
+			}
+			stacks[ev.Tid] = append(stack, fid)
+		case "E":
+			if len(stacks[ev.Tid]) > 0 {
+				stacks[ev.Tid] = stacks[ev.Tid][:len(stacks[ev.Tid])-1]
+			}
+		}
+	}
+}
+
+/**
+ * Name each function, from the name section (demangled if the debug info says so), then the dwarf,
+ * then an export or import name.
+ */
+func functionNames(wf *wasmfile.WasmFile) map[int]string {
+	names := make(map[int]string)
+	for fid, n := range wf.Debug.FunctionNames {
+		n = strings.TrimPrefix(n, "$")
+		if wf.Debug.Demangle {
+			n = demangle.Demangle(n)
+		}
+		names[fid] = n
+	}
+
+	if wf.Debug.DwarfData != nil {
+		dwarfNames, err := wf.Debug.GetSubprogramNames()
+		if err == nil {
+			for pc, n := range dwarfNames {
+				fid := wf.FindFunction(pc)
+				if fid != -1 && names[fid] == "" {
+					names[fid] = n
+				}
+			}
+		}
+	}
+
+	for _, e := range wf.Export {
+		if e.Type == types.ExportFunc && names[e.Index] == "" {
+			names[e.Index] = e.Name
+		}
+	}
+	for fid, imp := range wf.Import {
+		if imp.Type == types.ExportFunc && names[fid] == "" {
+			names[fid] = imp.Module + "." + imp.Name
+		}
+	}
+	for fid := 0; fid < len(wf.Import)+len(wf.Code); fid++ {
+		if names[fid] == "" {
+			names[fid] = fmt.Sprintf("func[%d]", fid)
+		}
+	}
+	return names
+}
+
+func exportedFunction(wf *wasmfile.WasmFile, name string) (int, error) {
+	for _, e := range wf.Export {
+		if e.Name == name {
+			if e.Type != types.ExportFunc {
+				return -1, fmt.Errorf("Export %s isn't a function", name)
+			}
+			return e.Index, nil
+		}
+	}
+	return -1, fmt.Errorf("Export %s not found", name)
+}
+
+// Find the type of a function, which may be imported
+func funcType(wf *wasmfile.WasmFile, fid int) (*wasmfile.TypeEntry, error) {
+	tid := -1
+	if fid < len(wf.Import) {
+		if wf.Import[fid].Type == types.ExportFunc {
+			tid = wf.Import[fid].Index
+		}
+	} else if fid-len(wf.Import) < len(wf.Function) {
+		tid = wf.Function[fid-len(wf.Import)].TypeIndex
+	}
+	if tid < 0 || tid >= len(wf.Type) {
+		return nil, fmt.Errorf("Function %d doesn't have a valid type", fid)
+	}
+	return wf.Type[tid], nil
+}
+
+// Types are matched on their params and results, as call_indirect does
+func signature(te *wasmfile.TypeEntry) string {
+	return fmt.Sprintf("%v -> %v", te.Param, te.Result)
+}
+
+func contains(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Write the graph in graphviz dot format. Imports are ellipses, and indirect calls are dashed.
+ * With a profile, each edge is labelled with its calls, and is thicker the more calls it had.
+ */
+func (g *Graph) WriteDot(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph callgraph {\n")
+	b.WriteString("  node [shape=box, fontname=\"monospace\"];\n")
+	for _, n := range g.Nodes {
+		attrs := fmt.Sprintf("label=%s", dotString(n.Name))
+		if n.Import {
+			attrs += ", shape=ellipse"
+		}
+		fmt.Fprintf(&b, "  f%d [%s];\n", n.Index, attrs)
+	}
+	for _, e := range g.Edges {
+		attrs := make([]string, 0)
+		if e.Indirect {
+			attrs = append(attrs, "style=dashed")
+		}
+		if g.Profiled {
+			attrs = append(attrs, fmt.Sprintf("label=\"%d\"", e.Calls))
+			if e.Calls > 0 {
+				attrs = append(attrs, fmt.Sprintf("penwidth=%d", 1+int(math.Log10(float64(e.Calls)))))
+			}
+		}
+		fmt.Fprintf(&b, "  f%d -> f%d", e.From, e.To)
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dotString(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	return "\"" + s + "\""
+}
@@ -0,0 +1,125 @@
+package callgraph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/tracefmt"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32) (result i32)))
+  (type (func))
+  (import "env" "log" (func $log (type 1)))
+  (table 2 funcref)
+  (elem (i32.const 0) $double $triple)
+  (func $main (type 1)
+    i32.const 1
+    i32.const 0
+    call_indirect (type 0)
+    drop
+    call 0
+  )
+  (func $double (type 0)
+    local.get 0
+    i32.const 2
+    i32.mul
+  )
+  (func $triple (type 0)
+    local.get 0
+    call 2
+    local.get 0
+    i32.add
+  )
+  (func $unused (type 1)
+    call 0
+  )
+  (export "_start" (func $main))
+)
+`
+
+func TestBuild(t *testing.T) {
+	g, err := Build(testutil.Module(t, testWat), Callgraph_config{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []*Node{
+		{Index: 0, Name: "log", Import: true},
+		{Index: 1, Name: "main"},
+		{Index: 2, Name: "double"},
+		{Index: 3, Name: "triple"},
+		{Index: 4, Name: "unused"},
+	}, g.Nodes)
+	assert.Equal(t, []*Edge{
+		{From: 1, To: 0},
+		{From: 1, To: 2, Indirect: true},
+		{From: 1, To: 3, Indirect: true},
+		{From: 3, To: 2},
+		{From: 4, To: 0},
+	}, g.Edges)
+
+	// Only what _start can reach
+	g, err = Build(testutil.Module(t, testWat), Callgraph_config{Roots: []string{"_start"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(g.Nodes))
+	assert.Equal(t, 4, len(g.Edges))
+
+	_, err = Build(testutil.Module(t, testWat), Callgraph_config{Roots: []string{"missing"}})
+	assert.Error(t, err)
+}
+
+func TestProfile(t *testing.T) {
+	trace := `{"ph":"B","pid":1,"tid":1,"ts":1,"name":"$main"}
+{"ph":"B","pid":1,"tid":1,"ts":2,"name":"$triple"}
+{"ph":"B","pid":1,"tid":1,"ts":3,"name":"$double"}
+{"ph":"E","pid":1,"tid":1,"ts":4,"name":"$double"}
+{"ph":"E","pid":1,"tid":1,"ts":5,"name":"$triple"}
+{"ph":"B","pid":1,"tid":1,"ts":6,"name":"$IMPORT_env_log"}
+{"ph":"E","pid":1,"tid":1,"ts":7,"name":"$IMPORT_env_log"}
+{"ph":"B","pid":1,"tid":1,"ts":8,"name":"$IMPORT_env_log"}
+{"ph":"E","pid":1,"tid":1,"ts":9,"name":"$IMPORT_env_log"}
+{"ph":"B","pid":1,"tid":1,"ts":10,"name":"$unused"}
+{"ph":"E","pid":1,"tid":1,"ts":11,"name":"$unused"}
+{"ph":"E","pid":1,"tid":1,"ts":12,"name":"$main"}
+`
+	events, err := tracefmt.ReadEvents(strings.NewReader(trace))
+	assert.NoError(t, err)
+	g, err := Build(testutil.Module(t, testWat), Callgraph_config{Profile: events})
+	assert.NoError(t, err)
+
+	calls := make(map[[2]int]uint64)
+	for _, e := range g.Edges {
+		calls[[2]int{e.From, e.To}] = e.Calls
+	}
+	assert.Equal(t, uint64(2), calls[[2]int{1, 0}])
+	assert.Equal(t, uint64(1), calls[[2]int{1, 3}])
+	assert.Equal(t, uint64(1), calls[[2]int{3, 2}])
+	assert.Equal(t, uint64(0), calls[[2]int{1, 2}])
+	// Only seen in the profile, so it's shown as indirect
+	assert.Equal(t, uint64(1), calls[[2]int{1, 4}])
+	assert.Equal(t, &Edge{From: 1, To: 4, Indirect: true, Calls: 1}, g.Edges[3])
+
+	var out bytes.Buffer
+	assert.NoError(t, g.WriteDot(&out))
+	assert.Contains(t, out.String(), "  f1 -> f0 [label=\"2\", penwidth=1];\n")
+	assert.Contains(t, out.String(), "  f1 -> f2 [style=dashed, label=\"0\"];\n")
+}
+
+func TestWriteDot(t *testing.T) {
+	g := &Graph{
+		Nodes: []*Node{{Index: 0, Name: "env.log", Import: true}, {Index: 1, Name: `say "hi"`}},
+		Edges: []*Edge{{From: 1, To: 0}, {From: 1, To: 1, Indirect: true}},
+	}
+	var out bytes.Buffer
+	assert.NoError(t, g.WriteDot(&out))
+	assert.Equal(t, `digraph callgraph {
+  node [shape=box, fontname="monospace"];
+  f0 [label="env.log", shape=ellipse];
+  f1 [label="say \"hi\""];
+  f1 -> f0;
+  f1 -> f1 [style=dashed];
+}
+`, out.String())
+}
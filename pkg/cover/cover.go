@@ -0,0 +1,264 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+// Each coverage dump is a single line starting with this
+const DataPrefix = "wasm-toolkit-cover"
+
+const (
+	ModeFunctions = "functions"
+	ModeBlocks    = "blocks"
+)
+
+type Cover_config struct {
+	Blocks bool   // A probe for each block of code, rather than each function
+	File   string // Write the coverage data to this file, relative to a preopened directory. Otherwise STDERR.
+}
+
+/**
+ * A probe is set when a range of code runs. The range is in code section offsets, as used by dwarf line numbers.
+ * ExprIndex is the instruction the probe goes after, or -1 for the start of the function.
+ */
+type Probe struct {
+	CodeIndex int
+	ExprIndex int
+	Start     uint64
+	End       uint64
+}
+
+/**
+ * Work out the probes for a wasm file. This only depends on the code, so `cover report` can work them out again from
+ * the original file.
+ * In blocks mode, a probe follows each instruction where the code may not carry straight on.
+ */
+func FindProbes(wfile *wasmfile.WasmFile, blocks bool) []*Probe {
+	probes := make([]*Probe, 0)
+	for idx, c := range wfile.Code {
+		first := len(probes)
+		probes = append(probes, &Probe{CodeIndex: idx, ExprIndex: -1, Start: c.CodeSectionPtr})
+
+		if blocks {
+			depth := 0
+			for eidx, e := range c.Expression {
+				split := false
+				switch e.Opcode {
+				case expression.InstrToOpcode["block"]:
+					depth++
+				case expression.InstrToOpcode["loop"], expression.InstrToOpcode["if"]:
+					depth++
+					split = true
+				case expression.InstrToOpcode["else"], expression.InstrToOpcode["br_if"]:
+					split = true
+				case expression.InstrToOpcode["end"]:
+					// The final end of the function isn't a block end
+					if depth > 0 {
+						depth--
+						split = true
+					}
+				}
+				if split {
+					probes = append(probes, &Probe{CodeIndex: idx, ExprIndex: eidx, Start: e.PCNext})
+				}
+			}
+		}
+
+		for p := first; p < len(probes); p++ {
+			if p+1 < len(probes) {
+				probes[p].End = probes[p+1].Start
+			} else {
+				probes[p].End = c.CodeSectionPtr + c.CodeSectionLen
+			}
+		}
+	}
+	return probes
+}
+
+func modeName(blocks bool) string {
+	if blocks {
+		return ModeBlocks
+	}
+	return ModeFunctions
+}
+
+/**
+ * Add coverage probes to a wasm.
+ *
+ */
+func AddCover(wasmInput []byte, config Cover_config) ([]byte, error) {
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	if len(wfile.Memory) == 0 {
+		return nil, errors.New("The module has no memory")
+	}
+
+	originalFunctionLength := len(wfile.Code)
+
+	// Work out the probes before adding any code
+	probes := FindProbes(wfile, config.Blocks)
+	probesByCode := make(map[int]map[int]int)
+	for pid, p := range probes {
+		if probesByCode[p.CodeIndex] == nil {
+			probesByCode[p.CodeIndex] = make(map[int]int)
+		}
+		probesByCode[p.CodeIndex][p.ExprIndex] = pid
+	}
+	fmt.Printf("Adding %d coverage probes\n", len(probes))
+
+	// Load up the individual wat files, and add them in
+	files := []string{
+		"memory.wat",
+		"stdout.wat",
+		"cover.wat"}
+	if config.File != "" {
+		files = append(files, "trace_file.wat")
+	}
+
+	payload, err := wfile.AddPayload(files)
+	if err != nil {
+		return nil, err
+	}
+
+	bitmap_len := (len(probes) + 7) >> 3
+	payload.AddData("$cover_header", []byte(fmt.Sprintf("%s %s %d ", DataPrefix, modeName(config.Blocks), len(probes))))
+	payload.AddData("$cover_bitmap", make([]byte, bitmap_len))
+	err = wfile.SetGlobal("$cover_bitmap_len", types.ValI32, fmt.Sprintf("i32.const %d", bitmap_len))
+	if err != nil {
+		return nil, err
+	}
+
+	dumpCode := "call $cover_dump"
+	if config.File != "" {
+		payload.AddData("$wt_trace_file_path", []byte(strings.TrimLeft(config.File, "/")))
+		dumpCode = "call $wt_trace_file_open\ncall $cover_dump"
+	}
+
+	// The data is written at proc_exit, or when _start returns
+	procExit := -1
+	for idx, i := range wfile.Import {
+		if i.Module == "wasi_snapshot_preview1" && i.Name == "proc_exit" {
+			procExit = idx
+		}
+	}
+	startFid := -1
+	for _, ex := range wfile.Export {
+		if ex.Type == types.ExportFunc && ex.Name == "_start" {
+			startFid = ex.Index
+		}
+	}
+
+	for idx, c := range wfile.Code {
+		if idx < originalFunctionLength {
+			err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
+			if err != nil {
+				return nil, err
+			}
+			err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
+			if err != nil {
+				return nil, err
+			}
+
+			functionIndex := idx + len(wfile.Import)
+			codeProbes := probesByCode[idx]
+
+			var walkErr error
+			c.Walk(wfile, func(ctx *expression.WalkContext, e *expression.Expression) expression.WalkAction {
+				// Calls added above (eg $debug_memory_grow) aren't resolved yet, so their FuncIndex means nothing
+				if e.Opcode == expression.InstrToOpcode["call"] && !e.FunctionNeedsLinking && e.FuncIndex == procExit {
+					wcex, err := expression.ExpressionFromWat(dumpCode)
+					if err != nil {
+						walkErr = err
+						return expression.WalkStop
+					}
+					ctx.InsertBefore(wcex...)
+				}
+				pid, ok := codeProbes[ctx.Index]
+				if ok {
+					wcex, err := expression.ExpressionFromWat(fmt.Sprintf(`i32.const %d
+						call $cover_hit`, pid))
+					if err != nil {
+						walkErr = err
+						return expression.WalkStop
+					}
+					ctx.InsertAfter(wcex...)
+				}
+				return expression.WalkContinue
+			})
+			if walkErr != nil {
+				return nil, walkErr
+			}
+
+			err = c.InsertFuncStart(wfile, fmt.Sprintf(`i32.const %d
+				call $cover_hit`, codeProbes[-1]))
+			if err != nil {
+				return nil, err
+			}
+
+			if functionIndex == startFid {
+				err = c.InsertFuncStart(wfile, "block")
+				if err != nil {
+					return nil, err
+				}
+				err = c.ReplaceInstr(wfile, "return", dumpCode+"\nreturn")
+				if err != nil {
+					return nil, err
+				}
+				err = c.InsertFuncEnd(wfile, "end\n"+dumpCode)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		err = payload.Resolve(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = payload.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,109 @@
+package cover
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32) (result i32)))
+  (memory 1)
+  (func $abs (type 0)
+    local.get 0
+    i32.const 0
+    i32.lt_s
+    if (result i32)
+      i32.const 0
+      local.get 0
+      i32.sub
+    else
+      local.get 0
+    end
+  )
+  (func $unused (type 0)
+    local.get 0
+  )
+)
+`
+
+func TestFindProbes(t *testing.T) {
+	wf := testutil.Reload(t, testutil.Module(t, testWat))
+
+	probes := FindProbes(wf, false)
+	assert.Equal(t, 2, len(probes))
+	assert.Equal(t, 1, probes[1].CodeIndex)
+
+	// $abs has the entry, if, else and end
+	probes = FindProbes(wf, true)
+	assert.Equal(t, 5, len(probes))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, probes[i].End, probes[i+1].Start)
+		assert.Less(t, probes[i].Start, probes[i].End)
+	}
+}
+
+func TestReadData(t *testing.T) {
+	data, err := ReadData(strings.NewReader("program output\nwasm-toolkit-cover blocks 10 0102\nmore output wasm-toolkit-cover blocks 10 0300\n"))
+	assert.NoError(t, err)
+	assert.True(t, data.Blocks)
+	assert.Equal(t, 10, data.NumProbes)
+	assert.Equal(t, []byte{3, 2}, data.Bitmap)
+	assert.True(t, data.Hit(1))
+	assert.True(t, data.Hit(9))
+	assert.False(t, data.Hit(8))
+
+	_, err = ReadData(strings.NewReader("wasm-toolkit-cover blocks 10 0102\nwasm-toolkit-cover functions 10 0102\n"))
+	assert.Error(t, err)
+
+	_, err = ReadData(strings.NewReader("nothing here\n"))
+	assert.Error(t, err)
+}
+
+func TestReport(t *testing.T) {
+	wf := testutil.Reload(t, testutil.Module(t, testWat))
+	probes := FindProbes(wf, true)
+
+	// One line for each probe, with the else branch and $unused not run
+	for i, p := range probes {
+		wf.Debug.AddLineInfo(p.Start, debug.LineInfo{Filename: "abs.c", Linenumber: i + 1})
+	}
+	data := &Data{Blocks: true, NumProbes: len(probes), Bitmap: []byte{0x0b}}
+
+	report, err := BuildReport(wf, data)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(report.Files))
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: false, 4: true, 5: false}, report.Files[0].Lines)
+
+	var buf bytes.Buffer
+	assert.NoError(t, report.WriteLcov(&buf))
+	assert.Equal(t, `TN:
+SF:abs.c
+FN:1,$abs
+FN:5,$unused
+FNDA:1,$abs
+FNDA:0,$unused
+FNF:2
+FNH:1
+DA:1,1
+DA:2,1
+DA:3,0
+DA:4,1
+DA:5,0
+LF:5
+LH:3
+end_of_record
+`, buf.String())
+
+	buf.Reset()
+	assert.NoError(t, report.WriteHTML(&buf))
+	assert.Contains(t, buf.String(), "3 / 5")
+
+	// Data from some other module
+	_, err = BuildReport(wf, &Data{Blocks: true, NumProbes: 3, Bitmap: []byte{0}})
+	assert.Error(t, err)
+}
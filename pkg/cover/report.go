@@ -0,0 +1,338 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package cover
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+// Coverage data, as written by a module at exit
+type Data struct {
+	Blocks    bool
+	NumProbes int
+	Bitmap    []byte
+}
+
+func (d *Data) Hit(probe int) bool {
+	return d.Bitmap[probe>>3]&(1<<(probe&7)) != 0
+}
+
+/**
+ * Merge in data from another run of the same module
+ *
+ */
+func (d *Data) Merge(other *Data) error {
+	if d.Blocks != other.Blocks || d.NumProbes != other.NumProbes {
+		return errors.New("Coverage data is from a different module or mode")
+	}
+	for i := range d.Bitmap {
+		d.Bitmap[i] |= other.Bitmap[i]
+	}
+	return nil
+}
+
+/**
+ * Read coverage data from the output of a module. Anything that isn't coverage data (such as program output) is
+ * skipped, and data from several runs is merged.
+ */
+func ReadData(r io.Reader) (*Data, error) {
+	var data *Data
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.Index(line, DataPrefix+" ")
+		if idx == -1 {
+			continue
+		}
+		fields := strings.Fields(line[idx:])
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Invalid coverage data %q", line)
+		}
+		if fields[1] != ModeBlocks && fields[1] != ModeFunctions {
+			return nil, fmt.Errorf("Unknown coverage mode %q", fields[1])
+		}
+		numProbes, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		bitmap, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		if len(bitmap) != (numProbes+7)>>3 {
+			return nil, fmt.Errorf("Coverage data has %d bytes for %d probes", len(bitmap), numProbes)
+		}
+		d := &Data{Blocks: fields[1] == ModeBlocks, NumProbes: numProbes, Bitmap: bitmap}
+		if data == nil {
+			data = d
+		} else {
+			err = data.Merge(d)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("No coverage data found")
+	}
+	return data, nil
+}
+
+type FunctionCoverage struct {
+	Name string
+	Line int
+	Hit  bool
+}
+
+type FileCoverage struct {
+	Filename  string
+	Lines     map[int]bool // Whether each line with code was run
+	Functions []*FunctionCoverage
+}
+
+func (fc *FileCoverage) LinesHit() int {
+	hit := 0
+	for _, h := range fc.Lines {
+		if h {
+			hit++
+		}
+	}
+	return hit
+}
+
+func (fc *FileCoverage) SortedLines() []int {
+	lines := make([]int, 0, len(fc.Lines))
+	for l := range fc.Lines {
+		lines = append(lines, l)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+type Report struct {
+	Files []*FileCoverage
+}
+
+/**
+ * Join coverage data with the dwarf line numbers of the original (uninstrumented) wasm.
+ * Dwarf line numbers must already have been parsed.
+ */
+func BuildReport(wfile *wasmfile.WasmFile, data *Data) (*Report, error) {
+	probes := FindProbes(wfile, data.Blocks)
+	if len(probes) != data.NumProbes {
+		return nil, fmt.Errorf("Coverage data has %d probes, but the wasm file has %d. Use the file before cover was run.", data.NumProbes, len(probes))
+	}
+
+	sortedProbes := make([]int, len(probes))
+	for i := range sortedProbes {
+		sortedProbes[i] = i
+	}
+	sort.Slice(sortedProbes, func(i, j int) bool { return probes[sortedProbes[i]].Start < probes[sortedProbes[j]].Start })
+
+	// Find the probe covering an address
+	findProbe := func(pc uint64) int {
+		i := sort.Search(len(sortedProbes), func(i int) bool { return probes[sortedProbes[i]].Start > pc })
+		if i == 0 {
+			return -1
+		}
+		pid := sortedProbes[i-1]
+		if pc >= probes[pid].End {
+			return -1
+		}
+		return pid
+	}
+
+	files := make(map[string]*FileCoverage)
+	getFile := func(filename string) *FileCoverage {
+		fc, ok := files[filename]
+		if !ok {
+			fc = &FileCoverage{Filename: filename, Lines: make(map[int]bool)}
+			files[filename] = fc
+		}
+		return fc
+	}
+
+	functionLines := make(map[int]bool)
+	wfile.Debug.EachLine(func(pc uint64, _ uint64, li debug.LineInfo) {
+		if li.Linenumber == 0 {
+			return
+		}
+		pid := findProbe(pc)
+		if pid == -1 {
+			return
+		}
+		fc := getFile(li.Filename)
+		fc.Lines[li.Linenumber] = fc.Lines[li.Linenumber] || data.Hit(pid)
+
+		// A function is reported at its first line, and was run if its entry probe was hit
+		codeIndex := probes[pid].CodeIndex
+		if !functionLines[codeIndex] {
+			functionLines[codeIndex] = true
+			entry := pid
+			for entry > 0 && probes[entry].ExprIndex != -1 {
+				entry--
+			}
+			fc.Functions = append(fc.Functions, &FunctionCoverage{
+				Name: wfile.Debug.GetFunctionIdentifier(len(wfile.Import)+codeIndex, false),
+				Line: li.Linenumber,
+				Hit:  data.Hit(entry),
+			})
+		}
+	})
+
+	report := &Report{}
+	for _, fc := range files {
+		report.Files = append(report.Files, fc)
+	}
+	sort.Slice(report.Files, func(i, j int) bool { return report.Files[i].Filename < report.Files[j].Filename })
+	return report, nil
+}
+
+/**
+ * Write the report in lcov tracefile format
+ *
+ */
+func (r *Report) WriteLcov(w io.Writer) error {
+	for _, fc := range r.Files {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "TN:\nSF:%s\n", fc.Filename)
+		fnHit := 0
+		for _, fn := range fc.Functions {
+			fmt.Fprintf(&sb, "FN:%d,%s\n", fn.Line, fn.Name)
+		}
+		for _, fn := range fc.Functions {
+			hits := 0
+			if fn.Hit {
+				hits = 1
+				fnHit++
+			}
+			fmt.Fprintf(&sb, "FNDA:%d,%s\n", hits, fn.Name)
+		}
+		fmt.Fprintf(&sb, "FNF:%d\nFNH:%d\n", len(fc.Functions), fnHit)
+		for _, l := range fc.SortedLines() {
+			hits := 0
+			if fc.Lines[l] {
+				hits = 1
+			}
+			fmt.Fprintf(&sb, "DA:%d,%d\n", l, hits)
+		}
+		fmt.Fprintf(&sb, "LF:%d\nLH:%d\nend_of_record\n", len(fc.Lines), fc.LinesHit())
+
+		_, err := io.WriteString(w, sb.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type htmlLine struct {
+	Number int
+	Text   string
+	Class  string
+}
+
+type htmlFile struct {
+	Filename string
+	Hit      int
+	Total    int
+	Percent  string
+	Lines    []htmlLine
+}
+
+var htmlTemplate = template.Must(template.New("cover").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage</title>
+<style>
+body { font-family: sans-serif; }
+table.summary td { padding: 2px 12px; }
+pre { margin: 0; }
+.hit { background: #dfd; }
+.miss { background: #fdd; }
+.num { color: #888; display: inline-block; width: 5em; text-align: right; margin-right: 1em; }
+</style>
+</head>
+<body>
+<h1>Coverage</h1>
+<table class="summary">
+<tr><th>File</th><th>Lines</th><th>Covered</th></tr>
+{{range $i, $f := .}}<tr><td><a href="#file{{$i}}">{{$f.Filename}}</a></td><td>{{$f.Hit}} / {{$f.Total}}</td><td>{{$f.Percent}}</td></tr>
+{{end}}</table>
+{{range $i, $f := .}}<h2 id="file{{$i}}">{{$f.Filename}}</h2>
+{{range $f.Lines}}<pre class="{{.Class}}"><span class="num">{{.Number}}</span>{{.Text}}</pre>
+{{end}}{{end}}</body>
+</html>
+`))
+
+/**
+ * Write the report as a html page. Source files are shown if they can be read, otherwise just the lines with code.
+ *
+ */
+func (r *Report) WriteHTML(w io.Writer) error {
+	files := make([]*htmlFile, 0, len(r.Files))
+	for _, fc := range r.Files {
+		hf := &htmlFile{
+			Filename: fc.Filename,
+			Hit:      fc.LinesHit(),
+			Total:    len(fc.Lines),
+		}
+		if hf.Total > 0 {
+			hf.Percent = fmt.Sprintf("%.1f%%", float64(hf.Hit)*100/float64(hf.Total))
+		}
+
+		lineClass := func(l int) string {
+			hit, ok := fc.Lines[l]
+			if !ok {
+				return ""
+			} else if hit {
+				return "hit"
+			}
+			return "miss"
+		}
+
+		source, err := os.ReadFile(fc.Filename)
+		if err == nil {
+			for i, text := range strings.Split(strings.TrimRight(string(source), "\n"), "\n") {
+				hf.Lines = append(hf.Lines, htmlLine{Number: i + 1, Text: text, Class: lineClass(i + 1)})
+			}
+		} else {
+			for _, l := range fc.SortedLines() {
+				hf.Lines = append(hf.Lines, htmlLine{Number: l, Class: lineClass(l)})
+			}
+		}
+		files = append(files, hf)
+	}
+	return htmlTemplate.Execute(w, files)
+}
@@ -0,0 +1,723 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/inspect"
+	"github.com/loopholelabs/wasm-toolkit/pkg/interp"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+const Prompt = "(wdb) "
+
+// How much of a variable print shows
+var printConfig = inspect.Inspect_config{MaxDepth: 4, MaxElements: 32, MaxString: 256}
+
+type Debugger_config struct {
+	Func   string               // Export to run. Defaults to _start
+	Interp interp.Interp_config // Used each time the module is run. Its Record is told about every WASI call, including replayed ones
+}
+
+type breakpoint struct {
+	id   int
+	desc string
+	pcs  []uint64
+}
+
+/**
+ * A debugger session for a module, run in the interpreter. Commands are given as lines of text,
+ * and anything they show is written to out. The module should have its dwarf parsed already, for
+ * line numbers and variable names. Without it, stepping is by instruction.
+ * Going backwards runs the module again from the start, with the WASI calls replayed, up to the
+ * instruction before.
+ */
+type Debugger struct {
+	wf          *wasmfile.WasmFile
+	config      Debugger_config
+	out         io.Writer
+	m           *interp.Machine
+	breakpoints []*breakpoint
+	nextID      int
+	last        string
+	log         []*interp.WasiCall // The WASI calls of this run, so it can be run again the same way
+}
+
+func New(wf *wasmfile.WasmFile, config Debugger_config, out io.Writer) *Debugger {
+	if config.Func == "" {
+		config.Func = "_start"
+	}
+	return &Debugger{
+		wf:     wf,
+		config: config,
+		out:    out,
+		nextID: 1,
+	}
+}
+
+/**
+ * Read commands from in until it ends or quit is given. An empty line repeats the last command.
+ *
+ */
+func (d *Debugger) Repl(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(d.out, Prompt)
+		if !scanner.Scan() {
+			fmt.Fprintln(d.out)
+			return scanner.Err()
+		}
+		quit, err := d.Execute(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+var help = `Commands:
+  run                 Start the module again from the beginning
+  continue (c)        Run until a breakpoint, or the module finishes
+  step (s)            Run to the next source line, going into calls
+  next (n)            Run to the next source line in this function
+  stepi (si)          Run one instruction
+  finish              Run until the current function returns
+  reverse-step (rs)   Go back to the start of the previous source line
+  reverse-stepi (rsi) Go back one instruction
+  reverse-continue (rc) Go back to the last breakpoint, or the start
+  break (b) <where>   Stop at file:line, a function, or *PC
+  delete (d) <n>      Remove breakpoint n
+  info breakpoints    List the breakpoints
+  print (p) <var>     Show a local or global, by dwarf name or as $name
+  x/NN <addr>         Show NN bytes of memory at an address or global variable
+  backtrace (bt)      Show the calls in progress
+  quit (q)            Leave the debugger`
+
+/**
+ * Run a single command. Returns true once the debugger should exit.
+ *
+ */
+func (d *Debugger) Execute(line string) (bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		line = d.last
+	}
+	if line == "" {
+		return false, nil
+	}
+	d.last = line
+
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	if strings.HasPrefix(cmd, "x/") {
+		return false, d.examine(cmd[2:], arg)
+	}
+
+	switch cmd {
+	case "help", "h":
+		fmt.Fprintln(d.out, help)
+	case "quit", "q":
+		return true, nil
+	case "run", "r":
+		err := d.start(d.config.Interp.Replay)
+		if err != nil {
+			return false, err
+		}
+		return false, d.run(func() bool { return false }, false)
+	case "continue", "c":
+		return false, d.resume(func() bool { return false })
+	case "stepi", "si":
+		return false, d.stepi()
+	case "step", "s":
+		return false, d.stepLine(false)
+	case "next", "n":
+		return false, d.stepLine(true)
+	case "finish":
+		return false, d.finish()
+	case "reverse-stepi", "rsi":
+		return false, d.reverseStepi()
+	case "reverse-step", "rs":
+		return false, d.reverseStep()
+	case "reverse-continue", "rc":
+		return false, d.reverseContinue()
+	case "break", "b":
+		return false, d.addBreakpoint(arg)
+	case "delete", "d":
+		return false, d.deleteBreakpoint(arg)
+	case "info", "i":
+		if arg != "breakpoints" && arg != "b" {
+			return false, errors.New("Only info breakpoints is supported atm")
+		}
+		d.listBreakpoints()
+	case "print", "p":
+		return false, d.print(arg)
+	case "backtrace", "bt", "where":
+		return false, d.backtrace()
+	default:
+		return false, fmt.Errorf("Unknown command %q, try help", cmd)
+	}
+	return false, nil
+}
+
+// Instantiate the module again, and get ready to run it. WASI calls are answered from replay while it lasts.
+func (d *Debugger) start(replay []*interp.WasiCall) error {
+	config := d.config.Interp
+	config.Replay = replay
+	log := make([]*interp.WasiCall, 0)
+	config.Record = func(call *interp.WasiCall) {
+		log = append(log, call)
+		d.log = log
+		if d.config.Interp.Record != nil {
+			d.config.Interp.Record(call)
+		}
+	}
+	m, err := interp.New(d.wf, config)
+	if err != nil {
+		return err
+	}
+	fid := -1
+	for _, e := range d.wf.Export {
+		if e.Name == d.config.Func {
+			fid = e.Index
+		}
+	}
+	if fid == -1 {
+		return fmt.Errorf("The module doesn't export a function %s", d.config.Func)
+	}
+	d.log = log
+	err = m.Start(fid, nil)
+	if err != nil {
+		return err
+	}
+	d.m = m
+	return nil
+}
+
+func (d *Debugger) running() error {
+	if d.m == nil || d.m.Done() {
+		return errors.New("The module isn't running")
+	}
+	return nil
+}
+
+func (d *Debugger) atBreakpoint(pc uint64) *breakpoint {
+	for _, b := range d.breakpoints {
+		for _, bpc := range b.pcs {
+			if bpc == pc {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+/**
+ * Run until stop says so, a breakpoint is reached, or the module finishes.
+ * At least one instruction is run, so carrying on from a breakpoint doesn't stop straight away.
+ */
+func (d *Debugger) resume(stop func() bool) error {
+	return d.run(stop, true)
+}
+
+// Run, stopping at breakpoints. Unless skip is set, a breakpoint at the next instruction stops straight away.
+func (d *Debugger) run(stop func() bool, skip bool) error {
+	err := d.running()
+	if err != nil {
+		return err
+	}
+	first := skip
+	for !d.m.Done() {
+		if !first {
+			if stop() {
+				break
+			}
+			e := d.m.Next()
+			if e != nil {
+				b := d.atBreakpoint(e.PC)
+				if b != nil {
+					fmt.Fprintf(d.out, "Breakpoint %d, ", b.id)
+					break
+				}
+			}
+		}
+		first = false
+		err = d.m.Step()
+		if err != nil {
+			break
+		}
+	}
+	d.showStop()
+	return nil
+}
+
+// Say where the module has stopped, or how it finished
+func (d *Debugger) showStop() {
+	if d.m.Done() {
+		err := d.m.Run()
+		var exit *interp.ExitError
+		if errors.As(err, &exit) {
+			fmt.Fprintf(d.out, "The module exited with code %d\n", exit.Code)
+		} else if err != nil {
+			fmt.Fprintf(d.out, "The module stopped: %v\n", err)
+		} else {
+			fmt.Fprintf(d.out, "The module finished, returning %v\n", d.m.Results())
+		}
+		return
+	}
+	frames := d.m.Frames()
+	f := frames[len(frames)-1]
+	fmt.Fprintf(d.out, "%s at %s\n", d.wf.Debug.GetFunctionIdentifier(f.Function, false), d.location(f.PC))
+	e := d.m.Next()
+	if e != nil {
+		line, err := e.AppendWat(make([]byte, 0, 64), "  ", d.wf.Debug)
+		if err == nil {
+			d.out.Write(line)
+		}
+	}
+}
+
+// Describe a PC, with the source line if there is one
+func (d *Debugger) location(pc uint64) string {
+	li, ok := d.lineAt(pc)
+	if ok {
+		return fmt.Sprintf("%s:%d (PC %08x)", li.Filename, li.Linenumber, pc)
+	}
+	return fmt.Sprintf("PC %08x", pc)
+}
+
+// Get the line table row covering a PC
+func (d *Debugger) lineAt(pc uint64) (debug.LineInfo, bool) {
+	var found debug.LineInfo
+	ok := false
+	d.wf.Debug.EachLineInRange(pc, pc, func(start uint64, end uint64, li debug.LineInfo) {
+		if pc >= start && pc < end && li.Linenumber != 0 {
+			found = li
+			ok = true
+		}
+	})
+	return found, ok
+}
+
+func (d *Debugger) stepi() error {
+	err := d.running()
+	if err != nil {
+		return err
+	}
+	d.m.Step()
+	d.showStop()
+	return nil
+}
+
+/**
+ * Run until the source line changes. With over, calls are run to completion, and returning counts
+ * as a change of line. Without line numbers for where it starts, this is a single instruction.
+ */
+func (d *Debugger) stepLine(over bool) error {
+	err := d.running()
+	if err != nil {
+		return err
+	}
+	frames := d.m.Frames()
+	depth := len(frames)
+	start, ok := d.lineAt(frames[depth-1].PC)
+	if !ok {
+		return d.stepi()
+	}
+	return d.resume(func() bool {
+		frames := d.m.Frames()
+		if over && len(frames) > depth {
+			return false
+		}
+		li, ok := d.lineAt(frames[len(frames)-1].PC)
+		if !ok {
+			// Keep going through code with no line numbers, unless it has returned
+			return len(frames) < depth
+		}
+		return li != start || len(frames) != depth
+	})
+}
+
+func (d *Debugger) finish() error {
+	err := d.running()
+	if err != nil {
+		return err
+	}
+	depth := len(d.m.Frames())
+	if depth == 1 {
+		return d.resume(func() bool { return false })
+	}
+	return d.resume(func() bool {
+		return len(d.m.Frames()) < depth
+	})
+}
+
+/**
+ * Run the module again from the start, with the WASI calls of this run replayed so it goes the
+ * same way. visit is called before each instruction up to the one at step now.
+ */
+func (d *Debugger) replay(now uint64, visit func(step uint64)) error {
+	err := d.start(d.log)
+	if err != nil {
+		return err
+	}
+	for !d.m.Done() && d.m.Steps() < now {
+		visit(d.m.Steps())
+		err = d.m.Step()
+		if err != nil {
+			break
+		}
+	}
+	if d.m.Steps() != now {
+		return fmt.Errorf("Running again only got to instruction %d of %d", d.m.Steps(), now)
+	}
+	return nil
+}
+
+// Go back to just before step target
+func (d *Debugger) rewind(target uint64) error {
+	err := d.replay(target, func(step uint64) {})
+	if err != nil {
+		return err
+	}
+	d.showStop()
+	return nil
+}
+
+// How many instructions have run, if there are any to go back over
+func (d *Debugger) stepsSoFar() (uint64, error) {
+	if d.m == nil {
+		return 0, errors.New("The module isn't running")
+	}
+	now := d.m.Steps()
+	if now == 0 {
+		return 0, errors.New("Already at the start")
+	}
+	return now, nil
+}
+
+func (d *Debugger) reverseStepi() error {
+	now, err := d.stepsSoFar()
+	if err != nil {
+		return err
+	}
+	return d.rewind(now - 1)
+}
+
+// Where the module is, as the source line and call depth
+type place struct {
+	line  debug.LineInfo
+	depth int
+}
+
+func (d *Debugger) place() (place, bool) {
+	frames := d.m.Frames()
+	if len(frames) == 0 {
+		return place{}, false
+	}
+	li, ok := d.lineAt(frames[len(frames)-1].PC)
+	return place{line: li, depth: len(frames)}, ok
+}
+
+/**
+ * Go back to the first instruction of the last stretch of another source line. Code with no line
+ * numbers is skipped over. Without any line numbers, this goes back one instruction.
+ */
+func (d *Debugger) reverseStep() error {
+	now, err := d.stepsSoFar()
+	if err != nil {
+		return err
+	}
+	current, ok := place{}, false
+	if !d.m.Done() {
+		current, ok = d.place()
+	}
+	if !ok && !d.m.Done() {
+		return d.rewind(now - 1)
+	}
+
+	var prev place
+	havePrev := false
+	start := uint64(0)
+	target := uint64(0)
+	found := false
+	err = d.replay(now, func(step uint64) {
+		p, ok := d.place()
+		if !ok {
+			return
+		}
+		if !havePrev || p != prev {
+			start = step
+		}
+		prev = p
+		havePrev = true
+		if p != current {
+			target = start
+			found = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		fmt.Fprintln(d.out, "No earlier source line, back at the start")
+	}
+	return d.rewind(target)
+}
+
+// Go back to the last time a breakpoint was reached, or the start if there wasn't one
+func (d *Debugger) reverseContinue() error {
+	now, err := d.stepsSoFar()
+	if err != nil {
+		return err
+	}
+	target := uint64(0)
+	var hit *breakpoint
+	err = d.replay(now, func(step uint64) {
+		e := d.m.Next()
+		if e == nil {
+			return
+		}
+		b := d.atBreakpoint(e.PC)
+		if b != nil {
+			target = step
+			hit = b
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if hit == nil {
+		fmt.Fprintln(d.out, "No earlier breakpoint, back at the start")
+	} else {
+		fmt.Fprintf(d.out, "Breakpoint %d, ", hit.id)
+	}
+	return d.rewind(target)
+}
+
+func (d *Debugger) addBreakpoint(where string) error {
+	if where == "" {
+		return errors.New("break needs a location, eg main.go:12, a function, or *PC")
+	}
+	pcs := make([]uint64, 0)
+	if strings.HasPrefix(where, "*") {
+		pc, err := strconv.ParseUint(where[1:], 0, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid PC %q", where[1:])
+		}
+		pcs = append(pcs, pc)
+	} else if file, lineStr, ok := cutLast(where, ":"); ok {
+		line, err := strconv.Atoi(lineStr)
+		if err != nil {
+			return fmt.Errorf("Invalid line %q", lineStr)
+		}
+		pcs = d.wf.FindAddressesForLine(file, line)
+	} else {
+		fid := d.wf.Debug.LookupFunctionID(where)
+		if fid == -1 {
+			fid = d.wf.Debug.LookupFunctionID("$" + where)
+		}
+		idx := fid - len(d.wf.Import)
+		if fid == -1 || idx < 0 || idx >= len(d.wf.Code) || len(d.wf.Code[idx].Expression) == 0 {
+			return fmt.Errorf("Function %s not found", where)
+		}
+		pcs = append(pcs, d.wf.Code[idx].Expression[0].PC)
+	}
+	if len(pcs) == 0 {
+		return fmt.Errorf("No code found for %s", where)
+	}
+	b := &breakpoint{id: d.nextID, desc: where, pcs: pcs}
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, b)
+	fmt.Fprintf(d.out, "Breakpoint %d at %s\n", b.id, d.location(pcs[0]))
+	return nil
+}
+
+func cutLast(s string, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i <= 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func (d *Debugger) deleteBreakpoint(arg string) error {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return fmt.Errorf("Invalid breakpoint %q", arg)
+	}
+	for i, b := range d.breakpoints {
+		if b.id == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No breakpoint %d", id)
+}
+
+func (d *Debugger) listBreakpoints() {
+	if len(d.breakpoints) == 0 {
+		fmt.Fprintln(d.out, "No breakpoints")
+		return
+	}
+	for _, b := range d.breakpoints {
+		fmt.Fprintf(d.out, "%d  %s  %s\n", b.id, b.desc, d.location(b.pcs[0]))
+	}
+}
+
+func (d *Debugger) backtrace() error {
+	err := d.running()
+	if err != nil {
+		return err
+	}
+	frames := d.m.Frames()
+	for i := len(frames) - 1; i >= 0; i-- {
+		f := frames[i]
+		fmt.Fprintf(d.out, "#%d  %s at %s\n", len(frames)-1-i, d.wf.Debug.GetFunctionIdentifier(f.Function, false), d.location(f.PC))
+	}
+	return nil
+}
+
+/**
+ * Show a variable. Dwarf locals in scope come first, then dwarf globals in memory, then wasm
+ * locals and globals by their identifier (eg $0 or $__stack_pointer).
+ */
+func (d *Debugger) print(name string) error {
+	if name == "" {
+		return errors.New("print needs a variable")
+	}
+
+	if d.m != nil && !d.m.Done() {
+		frames := d.m.Frames()
+		f := frames[len(frames)-1]
+		localTypes := d.localTypes(f.Function)
+		locals := d.m.Locals()
+
+		// Inner scopes come later, so the last match wins
+		var found *debug.LocalNameData
+		for _, l := range d.wf.Debug.GetLocalsAt(f.PC) {
+			if l.VarName == name && l.Index < len(locals) {
+				found = l
+			}
+		}
+		if found != nil {
+			fmt.Fprintf(d.out, "%s = %s\n", name, formatValue(locals[found.Index], localTypes[found.Index], found.VarType))
+			return nil
+		}
+
+		if strings.HasPrefix(name, "$") {
+			idx, err := strconv.Atoi(name[1:])
+			if err == nil && idx >= 0 && idx < len(locals) {
+				fmt.Fprintf(d.out, "%s = %s\n", name, formatValue(locals[idx], localTypes[idx], ""))
+				return nil
+			}
+		}
+	}
+
+	g, ok := d.wf.Debug.GlobalAddresses[name]
+	if ok {
+		data, err := d.memory(g.Address, g.Size)
+		if err != nil {
+			return err
+		}
+		if g.DwarfType != nil {
+			// Lay out structs, arrays, strings and slices
+			v, err := inspect.Format(d.m.Memory(), g.Address, g.DwarfType, printConfig)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(d.out, "%s = %s\n", name, v)
+			return nil
+		}
+		fmt.Fprintf(d.out, "%s = %s\n", name, formatMemory(data, g.Type))
+		return nil
+	}
+
+	gid := d.wf.Debug.LookupGlobalID(name)
+	if gid != -1 && gid < len(d.wf.Global) {
+		if d.m == nil {
+			return errors.New("The module hasn't been run yet")
+		}
+		fmt.Fprintf(d.out, "%s = %s\n", name, formatValue(d.m.Global(gid), d.wf.Global[gid].Type, ""))
+		return nil
+	}
+
+	return fmt.Errorf("No variable %s", name)
+}
+
+// The wasm types of the params and locals of a function
+func (d *Debugger) localTypes(fid int) []types.ValType {
+	idx := fid - len(d.wf.Import)
+	if idx < 0 || idx >= len(d.wf.Code) {
+		return nil
+	}
+	params := d.wf.Type[d.wf.Function[idx].TypeIndex].Param
+	return append(append([]types.ValType{}, params...), d.wf.Code[idx].Locals...)
+}
+
+func (d *Debugger) memory(addr uint64, size uint64) ([]byte, error) {
+	if d.m == nil {
+		return nil, errors.New("The module hasn't been run yet")
+	}
+	mem := d.m.Memory()
+	if addr+size > uint64(len(mem)) {
+		return nil, fmt.Errorf("Address %#x is outside memory", addr)
+	}
+	return mem[addr : addr+size], nil
+}
+
+// Show memory as a hex dump, 16 bytes to a line
+func (d *Debugger) examine(count string, where string) error {
+	n, err := strconv.ParseUint(count, 0, 32)
+	if err != nil || n == 0 {
+		return fmt.Errorf("Invalid count %q", count)
+	}
+	addr, err := strconv.ParseUint(where, 0, 32)
+	if err != nil {
+		g, ok := d.wf.Debug.GlobalAddresses[where]
+		if !ok {
+			return fmt.Errorf("Invalid address %q", where)
+		}
+		addr = g.Address
+	}
+	data, err := d.memory(addr, n)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		hex := make([]string, 0, 16)
+		for _, b := range data[i:end] {
+			hex = append(hex, fmt.Sprintf("%02x", b))
+		}
+		fmt.Fprintf(d.out, "%08x: %s\n", addr+uint64(i), strings.Join(hex, " "))
+	}
+	return nil
+}
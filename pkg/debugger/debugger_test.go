@@ -0,0 +1,236 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/interp"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32) (result i32)))
+  (type (func))
+  (memory 1)
+  (global $counter (mut i32) (i32.const 0))
+  (func $double (type 0)
+    local.get 0
+    local.get 0
+    i32.add
+  )
+  (func $_start (type 1)
+    (local i32)
+    i32.const 21
+    call $double
+    local.set 0
+    i32.const 100
+    local.get 0
+    i32.store
+    local.get 0
+    global.set $counter
+  )
+  (export "_start" (func $_start))
+)
+`
+
+func testModule(t *testing.T) *wasmfile.WasmFile {
+	wf := testutil.Reload(t, testutil.ModuleWithDebug(t, testWat))
+	assert.NoError(t, wf.Debug.ParseDwarf(wf))
+	assert.NoError(t, wf.Debug.ParseDwarfLineNumbers())
+	return wf
+}
+
+func TestDebugger(t *testing.T) {
+	wf := testModule(t)
+	start := wf.Code[1]
+	wf.Debug.LocalNames = append(wf.Debug.LocalNames, &debug.LocalNameData{
+		StartPC: start.CodeSectionPtr,
+		EndPC:   start.CodeSectionPtr + start.CodeSectionLen,
+		Index:   0,
+		VarName: "answer",
+		VarType: "int",
+	})
+	wf.Debug.GlobalAddresses = map[string]*debug.GlobalNameData{
+		"total": {Name: "total", Address: 100, Size: 4, Type: "unsigned int"},
+	}
+
+	var out bytes.Buffer
+	d := New(wf, Debugger_config{}, &out)
+	script := []string{
+		"step",
+		"break test.wat:14",
+		"run",
+		"step",
+		"bt",
+		"print $0",
+		"finish",
+		"next",
+		"",
+		"print answer",
+		"next",
+		"next",
+		"x/4 100",
+		"print total",
+		"c",
+		"print $counter",
+		"quit",
+	}
+	assert.NoError(t, d.Repl(strings.NewReader(strings.Join(script, "\n"))))
+	for _, want := range []string{
+		"(wdb) The module isn't running\n",
+		"Breakpoint 1, $_start at test.wat:14",
+		"(wdb) $double at test.wat:7",
+		"#0  $double at test.wat:7",
+		"#1  $_start at test.wat:14",
+		"$0 = 21\n",
+		"(wdb) $_start at test.wat:15",
+		"(wdb) $_start at test.wat:16",
+		"(wdb) $_start at test.wat:17",
+		"answer = 42\n",
+		"00000064: 2a 00 00 00\n",
+		"total = 42\n",
+		"The module finished",
+		"$counter = 42\n",
+	} {
+		assert.True(t, strings.Contains(out.String(), want), want)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	wf := testModule(t)
+	var out bytes.Buffer
+	d := New(wf, Debugger_config{}, &out)
+
+	_, err := d.Execute("break nothing")
+	assert.Error(t, err)
+	_, err = d.Execute("break test.wat:100")
+	assert.Error(t, err)
+	_, err = d.Execute("break double")
+	assert.NoError(t, err)
+	_, err = d.Execute("break *0x16")
+	assert.NoError(t, err)
+	_, err = d.Execute("delete 3")
+	assert.Error(t, err)
+
+	out.Reset()
+	_, err = d.Execute("run")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "Breakpoint 1, $double at test.wat:7"), out.String())
+
+	out.Reset()
+	_, err = d.Execute("c")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "Breakpoint 2, $_start at test.wat:17"), out.String())
+
+	_, err = d.Execute("delete 2")
+	assert.NoError(t, err)
+	out.Reset()
+	_, err = d.Execute("c")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "The module finished"), out.String())
+
+	// A breakpoint at the first instruction stops before it runs
+	_, err = d.Execute("delete 1")
+	assert.NoError(t, err)
+	_, err = d.Execute("break _start")
+	assert.NoError(t, err)
+	out.Reset()
+	_, err = d.Execute("run")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "Breakpoint 3, $_start at test.wat:13"), out.String())
+
+	quit, err := d.Execute("q")
+	assert.NoError(t, err)
+	assert.True(t, quit)
+}
+
+const testRandomWat = `(module
+  (type (func (param i32 i32) (result i32)))
+  (type (func))
+  (import "wasi_snapshot_preview1" "random_get" (func $random_get (type 0)))
+  (memory 1)
+  (global $counter (mut i32) (i32.const 0))
+  (func $_start (type 1)
+    i32.const 100
+    i32.const 4
+    call $random_get
+    drop
+    i32.const 100
+    i32.load
+    global.set $counter
+    global.get $counter
+    global.set $counter
+  )
+  (export "_start" (func $_start))
+)
+`
+
+// Gives different bytes every time it's read
+type countingReader struct {
+	n byte
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		r.n++
+		p[i] = r.n
+	}
+	return len(p), nil
+}
+
+func TestReverse(t *testing.T) {
+	wf := wasmfile.NewEmpty()
+	assert.NoError(t, wf.DecodeWatFile("test.wat", []byte(testRandomWat)))
+	for _, c := range wf.Code {
+		assert.NoError(t, c.ResolveGlobals(wf))
+		assert.NoError(t, c.ResolveFunctions(wf))
+	}
+	assert.NoError(t, wf.AddWatDebugSections("test.wat"))
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	wf2 := &wasmfile.WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	wf2.Debug = &debug.WasmDebug{}
+	wf2.Debug.ParseNameSectionData(wf2.GetCustomSectionData("name"))
+	assert.NoError(t, wf2.Debug.ParseDwarf(wf2))
+	assert.NoError(t, wf2.Debug.ParseDwarfLineNumbers())
+
+	var out bytes.Buffer
+	d := New(wf2, Debugger_config{Interp: interp.Interp_config{Random: &countingReader{}}}, &out)
+	run := func(cmd string) string {
+		out.Reset()
+		_, err := d.Execute(cmd)
+		assert.NoError(t, err, cmd)
+		return out.String()
+	}
+
+	_, err := d.Execute("rsi")
+	assert.Error(t, err)
+	_, err = d.Execute("break test.wat:15")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(run("run"), "Breakpoint 1, $_start at test.wat:15"))
+	assert.Equal(t, "$counter = 67305985\n", run("print $counter"))
+
+	// Back over the line that set it, and the random bytes are the same when it runs again
+	assert.True(t, strings.HasPrefix(run("rsi"), "$_start at test.wat:14"))
+	assert.True(t, strings.HasPrefix(run("rs"), "$_start at test.wat:13"))
+	assert.True(t, strings.HasPrefix(run("rs"), "$_start at test.wat:12"))
+	assert.Equal(t, "$counter = 0\n", run("print $counter"))
+	assert.True(t, strings.HasPrefix(run("c"), "Breakpoint 1, $_start at test.wat:15"))
+	assert.Equal(t, "$counter = 67305985\n", run("print $counter"))
+
+	// Back to the breakpoint from the end, then to the start
+	assert.True(t, strings.HasPrefix(run("c"), "The module finished"))
+	assert.True(t, strings.HasPrefix(run("rc"), "Breakpoint 1, $_start at test.wat:15"))
+	assert.True(t, strings.HasPrefix(run("rc"), "No earlier breakpoint, back at the start\n$_start at test.wat:8"))
+	assert.True(t, strings.HasPrefix(run("c"), "Breakpoint 1, $_start at test.wat:15"))
+	assert.Equal(t, "$counter = 67305985\n", run("print $counter"))
+
+	// Running from the start again goes to the host
+	run("run")
+	assert.Equal(t, "$counter = 134678021\n", run("print $counter"))
+}
@@ -0,0 +1,89 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package debugger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+/**
+ * Format a wasm value. The dwarf type, if there is one, says whether it's signed, unsigned or a pointer.
+ *
+ */
+func formatValue(v uint64, t types.ValType, dwarfType string) string {
+	switch t {
+	case types.ValI32:
+		return formatInt(v, 4, dwarfType)
+	case types.ValI64:
+		return formatInt(v, 8, dwarfType)
+	case types.ValF32:
+		return fmt.Sprintf("%g", math.Float32frombits(uint32(v)))
+	case types.ValF64:
+		return fmt.Sprintf("%g", math.Float64frombits(v))
+	}
+	return fmt.Sprintf("%#x", v)
+}
+
+func formatInt(v uint64, size int, dwarfType string) string {
+	if strings.HasSuffix(dwarfType, "*") {
+		return fmt.Sprintf("%#x", v)
+	}
+	if strings.Contains(dwarfType, "unsigned") || dwarfType == "bool" || strings.HasPrefix(dwarfType, "uint") {
+		return fmt.Sprintf("%d", v)
+	}
+	switch size {
+	case 1:
+		return fmt.Sprintf("%d", int8(v))
+	case 2:
+		return fmt.Sprintf("%d", int16(v))
+	case 4:
+		return fmt.Sprintf("%d", int32(v))
+	}
+	return fmt.Sprintf("%d", int64(v))
+}
+
+// Format a variable in memory, by its dwarf type
+func formatMemory(data []byte, dwarfType string) string {
+	switch {
+	case dwarfType == "float" && len(data) == 4:
+		return fmt.Sprintf("%g", math.Float32frombits(binary.LittleEndian.Uint32(data)))
+	case (dwarfType == "double" || dwarfType == "float64") && len(data) == 8:
+		return fmt.Sprintf("%g", math.Float64frombits(binary.LittleEndian.Uint64(data)))
+	case dwarfType == "float32" && len(data) == 4:
+		return fmt.Sprintf("%g", math.Float32frombits(binary.LittleEndian.Uint32(data)))
+	}
+	switch len(data) {
+	case 1:
+		return formatInt(uint64(data[0]), 1, dwarfType)
+	case 2:
+		return formatInt(uint64(binary.LittleEndian.Uint16(data)), 2, dwarfType)
+	case 4:
+		return formatInt(uint64(binary.LittleEndian.Uint32(data)), 4, dwarfType)
+	case 8:
+		return formatInt(binary.LittleEndian.Uint64(data), 8, dwarfType)
+	}
+	hex := make([]string, 0, len(data))
+	for _, b := range data {
+		hex = append(hex, fmt.Sprintf("%02x", b))
+	}
+	return "{" + strings.Join(hex, " ") + "}"
+}
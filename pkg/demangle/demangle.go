@@ -0,0 +1,181 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package demangle
+
+import (
+	"errors"
+	"strings"
+)
+
+var errUnsupported = errors.New("Unsupported mangling")
+
+/**
+ * Demangle a Rust (legacy or v0) or Itanium C++ symbol. Anything which isn't mangled, or which uses
+ * parts of the manglings we don't support, is returned unchanged.
+ */
+func Demangle(name string) (demangled string) {
+	// A bug in the parsers shouldn't stop a tool showing the name, so fall back to the raw one
+	raw := name
+	defer func() {
+		if r := recover(); r != nil {
+			demangled = raw
+		}
+	}()
+
+	// The name section has identifiers with a $ in front
+	prefix := ""
+	if strings.HasPrefix(name, "$") {
+		prefix = "$"
+		name = name[1:]
+	}
+
+	// Keep anything like .llvm.1234 or .cold on the end as it is. Rust legacy names can have
+	// dots in them too, so try the whole name first and then shorter and shorter prefixes.
+	if strings.HasPrefix(name, "_Z") || strings.HasPrefix(name, "_R") {
+		end := len(name)
+		for end > 0 {
+			d, err := demangleSymbol(name[:end])
+			if err == nil {
+				return prefix + d + name[end:]
+			}
+			end = strings.LastIndex(name[:end], ".")
+		}
+	}
+	return prefix + name
+}
+
+func demangleSymbol(name string) (string, error) {
+	if strings.HasPrefix(name, "_R") {
+		return demangleRust(name[2:])
+	} else if strings.HasPrefix(name, "_ZN") && isRustLegacy(name) {
+		return demangleRustLegacy(name[3:])
+	} else if strings.HasPrefix(name, "_Z") {
+		return demangleItanium(name[2:])
+	}
+	return "", errUnsupported
+}
+
+// Rust legacy names are Itanium nested names, ending with a hash like 17h0123456789abcdefE
+func isRustLegacy(name string) bool {
+	if len(name) < 20 || !strings.HasSuffix(name, "E") {
+		return false
+	}
+	hash := name[len(name)-20 : len(name)-1]
+	if !strings.HasPrefix(hash, "17h") {
+		return false
+	}
+	for _, c := range hash[3:] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+var rustLegacyEscapes = map[string]string{
+	"SP": "@",
+	"BP": "*",
+	"RF": "&",
+	"LT": "<",
+	"GT": ">",
+	"LP": "(",
+	"RP": ")",
+	"C":  ",",
+}
+
+func demangleRustLegacy(s string) (string, error) {
+	parts := make([]string, 0)
+	for len(s) > 0 && s[0] != 'E' {
+		n, rest, err := readDecimal(s)
+		if err != nil || n > len(rest) {
+			return "", errUnsupported
+		}
+		parts = append(parts, unescapeRustLegacy(rest[:n]))
+		s = rest[n:]
+	}
+	if len(parts) < 2 {
+		return "", errUnsupported
+	}
+	// Drop the hash
+	return strings.Join(parts[:len(parts)-1], "::"), nil
+}
+
+func unescapeRustLegacy(s string) string {
+	if strings.HasPrefix(s, "_$") {
+		s = s[1:]
+	}
+	var sb strings.Builder
+	for len(s) > 0 {
+		if strings.HasPrefix(s, "..") {
+			sb.WriteString("::")
+			s = s[2:]
+		} else if s[0] == '$' {
+			end := strings.Index(s[1:], "$")
+			if end == -1 {
+				sb.WriteString(s)
+				break
+			}
+			code := s[1 : end+1]
+			s = s[end+2:]
+			if r, ok := rustLegacyEscapes[code]; ok {
+				sb.WriteString(r)
+			} else if strings.HasPrefix(code, "u") {
+				v, ok := parseHex(code[1:])
+				if ok {
+					sb.WriteRune(rune(v))
+				}
+			}
+		} else {
+			sb.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+	return sb.String()
+}
+
+func parseHex(s string) (uint64, bool) {
+	if len(s) == 0 {
+		return 0, false
+	}
+	v := uint64(0)
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			v = v*16 + uint64(c-'0')
+		} else if c >= 'a' && c <= 'f' {
+			v = v*16 + uint64(c-'a'+10)
+		} else {
+			return 0, false
+		}
+	}
+	return v, true
+}
+
+func readDecimal(s string) (int, string, error) {
+	i := 0
+	n := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		n = n*10 + int(s[i]-'0')
+		if n > 1<<20 {
+			return 0, s, errUnsupported
+		}
+		i++
+	}
+	if i == 0 {
+		return 0, s, errUnsupported
+	}
+	return n, s[i:], nil
+}
@@ -0,0 +1,122 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package demangle
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDemangleRustLegacy(t *testing.T) {
+	assert.Equal(t, "core::ptr::drop_in_place<alloc::vec::Vec<u8>>",
+		Demangle("_ZN4core3ptr46drop_in_place$LT$alloc..vec..Vec$LT$u8$GT$$GT$17h0123456789abcdefE"))
+	assert.Equal(t, "$std::rt::lang_start", Demangle("$_ZN3std2rt10lang_start17h0123456789abcdefE"))
+	assert.Equal(t, "<T as core::any::Any>::type_id",
+		Demangle("_ZN36_$LT$T$u20$as$u20$core..any..Any$GT$7type_id17h0123456789abcdefE"))
+}
+
+func TestDemangleRustV0(t *testing.T) {
+	assert.Equal(t, "std::rt::lang_start", Demangle("_RNvNtCs1234_3std2rt10lang_start"))
+	assert.Equal(t, "mycrate::foo::<u8, bool>", Demangle("_RINvCs123_7mycrate3foohbEB2_"))
+	assert.Equal(t, "<mycrate::Foo as core::fmt::Debug>::fmt",
+		Demangle("_RNvXs_Cs123_7mycrateNtB4_3FooNtNtCs456_4core3fmt5Debug3fmt"))
+	assert.Equal(t, "mycrate::main::{closure#0}", Demangle("_RNCNvCs123_7mycrate4main0B3_"))
+	assert.Equal(t, "std::rt::lang_start.llvm.42", Demangle("_RNvNtCs1234_3std2rt10lang_start.llvm.42"))
+	assert.Equal(t, "mycrate::foo::<31, true>", Demangle("_RINvCs123_7mycrate3fooKj1f_Kb1_E"))
+	assert.Equal(t, "<[u8; 8] as core::Debug>::fmt", Demangle("_RNvYAhj8_NtCs456_4core5Debug3fmt"))
+}
+
+func TestDemangleItanium(t *testing.T) {
+	assert.Equal(t, "foo(int, char)", Demangle("_Z3fooic"))
+	assert.Equal(t, "ns::Bar::baz() const", Demangle("_ZNK2ns3Bar3bazEv"))
+	assert.Equal(t, "ns::Bar::Bar(ns::Bar const&)", Demangle("_ZN2ns3BarC2ERKS0_"))
+	assert.Equal(t, "std::vector<int, std::allocator<int>>::push_back(int const&)",
+		Demangle("_ZNSt6vectorIiSaIiEE9push_backERKi"))
+	assert.Equal(t, "vtable for ns::Bar", Demangle("_ZTVN2ns3BarE"))
+	assert.Equal(t, "apply(void (*)(int))", Demangle("_Z5applyPFviE"))
+	assert.Equal(t, "foo(int).cold", Demangle("_Z3fooi.cold"))
+	assert.Equal(t, "operator delete(void*)", Demangle("_ZdlPv"))
+	assert.Equal(t, "operator new(unsigned long)", Demangle("_Znwm"))
+	assert.Equal(t, "operator new[](unsigned long)", Demangle("_Znam"))
+	assert.Equal(t, "operator==(int, int)", Demangle("_Zeqii"))
+	assert.Equal(t, "foo::bar(int (*)(), int (*) [10])", Demangle("_ZN3foo3barEPFivEPA10_i"))
+	assert.Equal(t, "f(int (&) [10])", Demangle("_Z1fRA10_i"))
+	assert.Equal(t, "f(int (**) [10])", Demangle("_Z1fPPA10_i"))
+	assert.Equal(t, "f(int (*) [2][3])", Demangle("_Z1fPA2_A3_i"))
+	assert.Equal(t, "f(void (**)(int))", Demangle("_Z1fPPFviE"))
+	assert.Equal(t, "f(void (* (*) [2])())", Demangle("_Z1fPA2_PFvvE"))
+	assert.Equal(t, "f(void (* [2])())", Demangle("_Z1fA2_PFvvE"))
+	assert.Equal(t, "f8(int (*(*)(int)) [4])", Demangle("_Z2f8PFPA4_iiE"))
+	assert.Equal(t, "f14(int (*(&)(double)) [7])", Demangle("_Z3f14RFPA7_idE"))
+}
+
+func TestDemangleUnchanged(t *testing.T) {
+	assert.Equal(t, "main", Demangle("main"))
+	assert.Equal(t, "$runtime.main", Demangle("$runtime.main"))
+	assert.Equal(t, "_Zbroken", Demangle("_Zbroken"))
+	assert.Equal(t, "_RNvC", Demangle("_RNvC"))
+}
+
+var demangleSamples = []string{
+	"_ZN4core3ptr46drop_in_place$LT$alloc..vec..Vec$LT$u8$GT$$GT$17h0123456789abcdefE",
+	"_RNvNtCs1234_3std2rt10lang_start",
+	"_RINvCs123_7mycrate3foohbEB2_",
+	"_RNvXs_Cs123_7mycrateNtB4_3FooNtNtCs456_4core3fmt5Debug3fmt",
+	"_RNCNvCs123_7mycrate4main0B3_",
+	"_RINvCs123_7mycrate3fooKj1f_Kb1_E",
+	"_RNvYAhj8_NtCs456_4core5Debug3fmt",
+	"_ZNK2ns3Bar3bazEv",
+	"_ZN2ns3BarC2ERKS0_",
+	"_ZNSt6vectorIiSaIiEE9push_backERKi",
+	"_ZTVN2ns3BarE",
+	"_Z5applyPFviE",
+	"_Z3maxIiET_S0_S0_",
+	"_Z1fILi3ELb1EEvv",
+}
+
+func TestDemangleTruncated(t *testing.T) {
+	// These used to panic, or recurse forever
+	for _, s := range []string{"_RYAz", "_RN7YAf", "_RIC3K3ItK.Q85JYKh9", "_RYAC00B4_", "_ZS2000000000000_"} {
+		assert.Equal(t, s, Demangle(s))
+	}
+
+	// Every prefix of a valid name either demangles or is left alone, without panicking
+	for _, s := range demangleSamples {
+		for i := 2; i <= len(s); i++ {
+			assert.NotPanics(t, func() { demangleSymbol(s[:i]) }, s[:i])
+			assert.NotPanics(t, func() { demangleSymbol(s[:i] + "E") }, s[:i])
+		}
+	}
+}
+
+func FuzzDemangle(f *testing.F) {
+	for _, s := range demangleSamples {
+		f.Add(s)
+	}
+	f.Add("_RYAz")
+	f.Add("_RN7YAf")
+	f.Fuzz(func(t *testing.T, s string) {
+		d, err := demangleSymbol(s)
+		// The Itanium parser marks where pointers go in function types, which mustn't be left in
+		itanium := strings.HasPrefix(s, "_Z") && !isRustLegacy(s)
+		if err == nil && itanium && strings.ContainsAny(d, "\x00\x01") && !strings.ContainsAny(s, "\x00\x01") {
+			t.Errorf("%q demangled to %q, with markers left in", s, d)
+		}
+	})
+}
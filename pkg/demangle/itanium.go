@@ -0,0 +1,720 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package demangle
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The parts of the Itanium C++ ABI mangling which show up in practice. Local names, expressions
+// and pointers to members aren't supported.
+type itaniumParser struct {
+	s         string
+	pos       int
+	subs      []string // Substitution candidates
+	targs     []string // Template args of the function, for T_
+	targDepth int
+	depth     int
+}
+
+// Function and array types have a \x00 where the pointer or reference goes, eg "void\x00(int)"
+const funcMarker = "\x00"
+
+// Once they have one, a \x01 is where any more go, eg "int (*\x01) [10]"
+const ptrMarker = "\x01"
+
+var itaniumBuiltins = map[byte]string{
+	'v': "void",
+	'w': "wchar_t",
+	'b': "bool",
+	'c': "char",
+	'a': "signed char",
+	'h': "unsigned char",
+	's': "short",
+	't': "unsigned short",
+	'i': "int",
+	'j': "unsigned int",
+	'l': "long",
+	'm': "unsigned long",
+	'x': "long long",
+	'y': "unsigned long long",
+	'n': "__int128",
+	'o': "unsigned __int128",
+	'f': "float",
+	'd': "double",
+	'e': "long double",
+	'g': "__float128",
+	'z': "...",
+}
+
+var itaniumBuiltinsD = map[byte]string{
+	'n': "decltype(nullptr)",
+	's': "char16_t",
+	'i': "char32_t",
+	'u': "char8_t",
+	'a': "auto",
+	'c': "decltype(auto)",
+	'f': "decimal32",
+	'd': "decimal64",
+	'e': "decimal128",
+	'h': "half",
+}
+
+var itaniumOperators = map[string]string{
+	"nw": "new", "na": "new[]", "dl": "delete", "da": "delete[]",
+	"ps": "+", "ng": "-", "ad": "&", "de": "*", "co": "~",
+	"pl": "+", "mi": "-", "ml": "*", "dv": "/", "rm": "%", "an": "&", "or": "|", "eo": "^",
+	"aS": "=", "pL": "+=", "mI": "-=", "mL": "*=", "dV": "/=", "rM": "%=", "aN": "&=", "oR": "|=", "eO": "^=",
+	"ls": "<<", "rs": ">>", "lS": "<<=", "rS": ">>=",
+	"eq": "==", "ne": "!=", "lt": "<", "gt": ">", "le": "<=", "ge": ">=", "ss": "<=>",
+	"nt": "!", "aa": "&&", "oo": "||", "pp": "++", "mm": "--", "cm": ",",
+	"pm": "->*", "pt": "->", "cl": "()", "ix": "[]", "qu": "?",
+}
+
+var itaniumSpecialSubs = map[byte]string{
+	'a': "std::allocator",
+	'b': "std::basic_string",
+	's': "std::string",
+	'i': "std::istream",
+	'o': "std::ostream",
+	'd': "std::iostream",
+}
+
+func demangleItanium(s string) (string, error) {
+	p := &itaniumParser{s: s}
+
+	special := map[string]string{
+		"TV": "vtable for ",
+		"TI": "typeinfo for ",
+		"TS": "typeinfo name for ",
+	}
+	if len(s) > 2 {
+		if prefix, ok := special[s[:2]]; ok {
+			p.pos = 2
+			t, err := p.parseType()
+			if err != nil || p.pos != len(s) {
+				return "", errUnsupported
+			}
+			return prefix + itaniumClean(t), nil
+		}
+	}
+
+	name, isTemplate, isCtor, cv, err := p.parseName()
+	if err != nil {
+		return "", err
+	}
+	if p.pos == len(s) {
+		return name, nil
+	}
+
+	// Template functions have their return type encoded
+	if isTemplate && !isCtor && !isConversion(name) {
+		_, err = p.parseType()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	params := make([]string, 0)
+	for p.pos < len(s) {
+		t, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		params = append(params, t)
+	}
+	if len(params) == 1 && params[0] == "void" {
+		params = params[:0]
+	}
+	return itaniumClean(name + "(" + strings.Join(params, ", ") + ")" + cv), nil
+}
+
+// Take the markers out of a type
+func itaniumClean(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, funcMarker, " "), ptrMarker, "")
+}
+
+// Conversion operators, like operator int, have no return type encoded even as templates
+func isConversion(name string) bool {
+	last := lastComponent(name)
+	if !strings.HasPrefix(last, "operator ") {
+		return false
+	}
+	switch last[len("operator "):] {
+	case "new", "new[]", "delete", "delete[]":
+		return false
+	}
+	return true
+}
+
+func (p *itaniumParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *itaniumParser) peekAt(n int) byte {
+	if p.pos+n >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos+n]
+}
+
+// Returns the name, whether it ends in template args, whether it's a constructor or destructor,
+// and any method qualifiers.
+func (p *itaniumParser) parseName() (string, bool, bool, string, error) {
+	if p.peek() == 'N' {
+		return p.parseNestedName()
+	}
+	if p.peek() == 'Z' {
+		return "", false, false, "", errUnsupported
+	}
+
+	name := ""
+	if p.peek() == 'S' && p.peekAt(1) == 't' {
+		p.pos += 2
+		u, _, err := p.parseUnqualifiedName("")
+		if err != nil {
+			return "", false, false, "", err
+		}
+		name = "std::" + u
+	} else if p.peek() == 'S' {
+		sub, err := p.parseSubstitution()
+		if err != nil {
+			return "", false, false, "", err
+		}
+		if p.peek() != 'I' {
+			return "", false, false, "", errUnsupported
+		}
+		args, err := p.parseTemplateArgs()
+		return sub + args, true, false, "", err
+	} else {
+		u, _, err := p.parseUnqualifiedName("")
+		if err != nil {
+			return "", false, false, "", err
+		}
+		name = u
+	}
+
+	if p.peek() == 'I' {
+		p.subs = append(p.subs, name)
+		args, err := p.parseTemplateArgs()
+		return name + args, true, false, "", err
+	}
+	return name, false, false, "", nil
+}
+
+func (p *itaniumParser) parseCVQualifiers() string {
+	cv := ""
+	for {
+		c := p.peek()
+		if c == 'r' {
+			cv = cv + " restrict"
+		} else if c == 'V' {
+			cv = cv + " volatile"
+		} else if c == 'K' {
+			cv = cv + " const"
+		} else {
+			return cv
+		}
+		p.pos++
+	}
+}
+
+func (p *itaniumParser) parseNestedName() (string, bool, bool, string, error) {
+	p.pos++ // N
+	cv := p.parseCVQualifiers()
+	if p.peek() == 'R' {
+		cv = cv + " &"
+		p.pos++
+	} else if p.peek() == 'O' {
+		cv = cv + " &&"
+		p.pos++
+	}
+
+	prefix := ""
+	last := ""
+	isTemplate := false
+	isCtor := false
+	for {
+		c := p.peek()
+		if c == 'E' {
+			p.pos++
+			break
+		}
+		if c == 0 {
+			return "", false, false, "", errUnsupported
+		}
+		isTemplate = false
+		isCtor = false
+		if c == 'S' && p.peekAt(1) == 't' {
+			p.pos += 2
+			prefix = "std"
+			continue
+		} else if c == 'S' {
+			if prefix != "" {
+				return "", false, false, "", errUnsupported
+			}
+			sub, err := p.parseSubstitution()
+			if err != nil {
+				return "", false, false, "", err
+			}
+			prefix = sub
+			last = lastComponent(sub)
+			continue
+		} else if c == 'I' {
+			if prefix == "" {
+				return "", false, false, "", errUnsupported
+			}
+			args, err := p.parseTemplateArgs()
+			if err != nil {
+				return "", false, false, "", err
+			}
+			prefix = prefix + args
+			isTemplate = true
+		} else if c == 'T' {
+			t, err := p.parseTemplateParam()
+			if err != nil {
+				return "", false, false, "", err
+			}
+			prefix = t
+			last = lastComponent(t)
+		} else {
+			u, ctor, err := p.parseUnqualifiedName(last)
+			if err != nil {
+				return "", false, false, "", err
+			}
+			if prefix != "" {
+				prefix = prefix + "::"
+			}
+			prefix = prefix + u
+			last = u
+			isCtor = ctor
+		}
+		if p.peek() != 'E' {
+			p.subs = append(p.subs, prefix)
+		}
+	}
+	return prefix, isTemplate, isCtor, cv, nil
+}
+
+// The last part of a qualified name, without any template args
+func lastComponent(s string) string {
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '<' {
+			depth++
+		} else if s[i] == '>' {
+			depth--
+		} else if depth == 0 && s[i] == ':' && i+1 < len(s) && s[i+1] == ':' {
+			start = i + 2
+		}
+	}
+	s = s[start:]
+	if idx := strings.Index(s, "<"); idx > 0 {
+		s = s[:idx]
+	}
+	return s
+}
+
+func (p *itaniumParser) parseUnqualifiedName(last string) (string, bool, error) {
+	c := p.peek()
+	if c >= '0' && c <= '9' {
+		name, err := p.parseSourceName()
+		return name, false, err
+	}
+	if c == 'L' {
+		// Internal linkage
+		p.pos++
+		name, err := p.parseSourceName()
+		return name, false, err
+	}
+	if c == 'C' && strings.ContainsRune("12345", rune(p.peekAt(1))) {
+		p.pos += 2
+		if last == "" {
+			return "", false, errUnsupported
+		}
+		return last, true, nil
+	}
+	if c == 'D' && strings.ContainsRune("01245", rune(p.peekAt(1))) {
+		p.pos += 2
+		if last == "" {
+			return "", false, errUnsupported
+		}
+		return "~" + last, true, nil
+	}
+	if c >= 'a' && c <= 'z' && p.pos+2 <= len(p.s) {
+		code := p.s[p.pos : p.pos+2]
+		if code == "cv" {
+			p.pos += 2
+			t, err := p.parseType()
+			return "operator " + t, false, err
+		}
+		op, ok := itaniumOperators[code]
+		if ok {
+			p.pos += 2
+			if op[0] >= 'a' && op[0] <= 'z' {
+				return "operator " + op, false, nil
+			}
+			return "operator" + op, false, nil
+		}
+	}
+	return "", false, errUnsupported
+}
+
+func (p *itaniumParser) parseSourceName() (string, error) {
+	n, rest, err := readDecimal(p.s[p.pos:])
+	if err != nil || n > len(rest) {
+		return "", errUnsupported
+	}
+	p.pos = len(p.s) - len(rest) + n
+	name := rest[:n]
+	if strings.HasPrefix(name, "_GLOBAL__N") {
+		return "(anonymous namespace)", nil
+	}
+	return name, nil
+}
+
+func (p *itaniumParser) parseSubstitution() (string, error) {
+	p.pos++ // S
+	c := p.peek()
+	if sub, ok := itaniumSpecialSubs[c]; ok {
+		p.pos++
+		return sub, nil
+	}
+	idx := 0
+	if c != '_' {
+		v := 0
+		for {
+			c = p.peek()
+			if c >= '0' && c <= '9' {
+				v = v*36 + int(c-'0')
+			} else if c >= 'A' && c <= 'Z' {
+				v = v*36 + int(c-'A') + 10
+			} else {
+				break
+			}
+			if v > 1<<24 {
+				return "", errUnsupported
+			}
+			p.pos++
+		}
+		if c != '_' {
+			return "", errUnsupported
+		}
+		idx = v + 1
+	}
+	p.pos++ // _
+	if idx >= len(p.subs) {
+		return "", errUnsupported
+	}
+	return p.subs[idx], nil
+}
+
+func (p *itaniumParser) parseTemplateParam() (string, error) {
+	p.pos++ // T
+	idx := 0
+	if p.peek() != '_' {
+		n, rest, err := readDecimal(p.s[p.pos:])
+		if err != nil {
+			return "", err
+		}
+		p.pos = len(p.s) - len(rest)
+		idx = n + 1
+	}
+	if p.peek() != '_' {
+		return "", errUnsupported
+	}
+	p.pos++
+	if idx >= len(p.targs) {
+		return "", errUnsupported
+	}
+	return p.targs[idx], nil
+}
+
+func (p *itaniumParser) parseTemplateArgs() (string, error) {
+	p.pos++ // I
+	p.targDepth++
+	args := make([]string, 0)
+	for p.peek() != 'E' {
+		if p.peek() == 0 {
+			return "", errUnsupported
+		}
+		arg, err := p.parseTemplateArg()
+		if err != nil {
+			return "", err
+		}
+		args = append(args, arg)
+	}
+	p.pos++ // E
+	p.targDepth--
+	if p.targDepth == 0 {
+		p.targs = args
+	}
+	return "<" + strings.Join(args, ", ") + ">", nil
+}
+
+func (p *itaniumParser) parseTemplateArg() (string, error) {
+	c := p.peek()
+	if c == 'L' {
+		// A literal
+		p.pos++
+		if p.peek() == '_' {
+			return "", errUnsupported
+		}
+		t, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		end := strings.IndexByte(p.s[p.pos:], 'E')
+		if end == -1 {
+			return "", errUnsupported
+		}
+		value := p.s[p.pos : p.pos+end]
+		p.pos += end + 1
+		if strings.HasPrefix(value, "n") {
+			value = "-" + value[1:]
+		}
+		if t == "bool" {
+			if value == "0" {
+				return "false", nil
+			}
+			return "true", nil
+		} else if t == "int" {
+			return value, nil
+		} else if t == "unsigned int" {
+			return value + "u", nil
+		}
+		return "(" + t + ")" + value, nil
+	} else if c == 'J' {
+		// An argument pack
+		p.pos++
+		args := make([]string, 0)
+		for p.peek() != 'E' {
+			if p.peek() == 0 {
+				return "", errUnsupported
+			}
+			arg, err := p.parseTemplateArg()
+			if err != nil {
+				return "", err
+			}
+			args = append(args, arg)
+		}
+		p.pos++
+		return strings.Join(args, ", "), nil
+	} else if c == 'X' {
+		return "", errUnsupported
+	}
+	return p.parseType()
+}
+
+func (p *itaniumParser) parseType() (string, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > 100 {
+		return "", errUnsupported
+	}
+
+	c := p.peek()
+	if b, ok := itaniumBuiltins[c]; ok {
+		p.pos++
+		return b, nil
+	}
+
+	if c == 'D' {
+		if b, ok := itaniumBuiltinsD[p.peekAt(1)]; ok {
+			p.pos += 2
+			return b, nil
+		}
+		if p.peekAt(1) == 'p' {
+			p.pos += 2
+			t, err := p.parseType()
+			if err != nil {
+				return "", err
+			}
+			p.subs = append(p.subs, t+"...")
+			return t + "...", nil
+		}
+		return "", errUnsupported
+	}
+
+	var t string
+	var err error
+	if c == 'K' || c == 'V' || c == 'r' {
+		cv := p.parseCVQualifiers()
+		t, err = p.parseType()
+		if err != nil {
+			return "", err
+		}
+		t = t + cv
+	} else if c == 'P' || c == 'R' || c == 'O' {
+		p.pos++
+		t, err = p.parseType()
+		if err != nil {
+			return "", err
+		}
+		mark := map[byte]string{'P': "*", 'R': "&", 'O': "&&"}[c]
+		if strings.Contains(t, ptrMarker) {
+			t = strings.Replace(t, ptrMarker, mark+ptrMarker, 1)
+		} else if idx := strings.Index(t, funcMarker); idx != -1 {
+			// Arrays have a space before the size, eg int (*) [10], but functions don't. Functions
+			// inside another declarator don't have one before either, eg int (*(*)(int)) [4]
+			lead := " "
+			space := ""
+			if idx+1 < len(t) && t[idx+1] == '[' {
+				space = " "
+			} else if idx > 0 && (t[idx-1] == '*' || t[idx-1] == '&') {
+				lead = ""
+			}
+			t = t[:idx] + lead + "(" + mark + ptrMarker + ")" + space + t[idx+1:]
+		} else {
+			t = t + mark
+		}
+	} else if c == 'F' {
+		p.pos++
+		if p.peek() == 'Y' {
+			p.pos++
+		}
+		ret, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		params := make([]string, 0)
+		for p.peek() != 'E' {
+			if p.peek() == 0 {
+				return "", errUnsupported
+			}
+			if (p.peek() == 'R' || p.peek() == 'O') && p.peekAt(1) == 'E' {
+				p.pos++
+				continue
+			}
+			pt, err := p.parseType()
+			if err != nil {
+				return "", err
+			}
+			params = append(params, pt)
+		}
+		p.pos++
+		if len(params) == 1 && params[0] == "void" {
+			params = params[:0]
+		}
+		if idx := strings.Index(ret, ptrMarker); idx != -1 {
+			// Returning a pointer to a function or array, eg int (*\x00(int)) [4]
+			t = ret[:idx] + funcMarker + "(" + strings.Join(params, ", ") + ")" + ret[idx+1:]
+		} else {
+			t = ret + funcMarker + "(" + strings.Join(params, ", ") + ")"
+		}
+	} else if c == 'A' {
+		p.pos++
+		n, rest, err := readDecimal(p.s[p.pos:])
+		if err != nil || len(rest) == 0 || rest[0] != '_' {
+			return "", errUnsupported
+		}
+		p.pos = len(p.s) - len(rest) + 1
+		et, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		size := "[" + strconv.Itoa(n) + "]"
+		if idx := strings.Index(et, ptrMarker); idx != -1 {
+			// An array of pointers to functions or arrays, eg void (* [2])()
+			t = et[:idx] + funcMarker + size + et[idx+1:]
+		} else if idx := strings.Index(et, funcMarker); idx != -1 && idx+1 < len(et) && et[idx+1] == '[' {
+			// An array of arrays, eg int [2][3]
+			t = et[:idx+1] + size + et[idx+1:]
+		} else {
+			t = et + funcMarker + size
+		}
+	} else if c == 'T' {
+		t, err = p.parseTemplateParam()
+		if err != nil {
+			return "", err
+		}
+		p.subs = append(p.subs, t)
+		if p.peek() == 'I' {
+			args, err := p.parseTemplateArgs()
+			if err != nil {
+				return "", err
+			}
+			t = t + args
+		}
+	} else if c == 'S' && p.peekAt(1) == 't' {
+		p.pos += 2
+		u, _, err := p.parseUnqualifiedName("")
+		if err != nil {
+			return "", err
+		}
+		t = "std::" + u
+		if p.peek() == 'I' {
+			p.subs = append(p.subs, t)
+			args, err := p.parseTemplateArgs()
+			if err != nil {
+				return "", err
+			}
+			t = t + args
+		}
+	} else if c == 'S' {
+		t, err = p.parseSubstitution()
+		if err != nil {
+			return "", err
+		}
+		if p.peek() != 'I' {
+			return t, nil
+		}
+		args, err := p.parseTemplateArgs()
+		if err != nil {
+			return "", err
+		}
+		t = t + args
+	} else if c == 'N' {
+		t, _, _, _, err = p.parseNestedName()
+		if err != nil {
+			return "", err
+		}
+	} else if c >= '0' && c <= '9' {
+		t, err = p.parseSourceName()
+		if err != nil {
+			return "", err
+		}
+		if p.peek() == 'I' {
+			p.subs = append(p.subs, t)
+			args, err := p.parseTemplateArgs()
+			if err != nil {
+				return "", err
+			}
+			t = t + args
+		}
+	} else if c == 'u' {
+		p.pos++
+		t, err = p.parseSourceName()
+		if err != nil {
+			return "", err
+		}
+	} else {
+		return "", errUnsupported
+	}
+
+	// Substitutions can double the length of a name each time they're used
+	if len(t) > 1<<16 {
+		return "", errUnsupported
+	}
+	p.subs = append(p.subs, t)
+	return t, nil
+}
@@ -0,0 +1,529 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package demangle
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Rust v0 mangling (https://doc.rust-lang.org/rustc/symbol-mangling/v0.html). Punycode identifiers
+// aren't supported.
+type rustParser struct {
+	s     string // Everything after the _R
+	pos   int
+	depth int
+	steps int // Backrefs can make the work grow exponentially, so it's limited
+}
+
+var rustBasicTypes = map[byte]string{
+	'a': "i8",
+	'b': "bool",
+	'c': "char",
+	'd': "f64",
+	'e': "str",
+	'f': "f32",
+	'h': "u8",
+	'i': "isize",
+	'j': "usize",
+	'l': "i32",
+	'm': "u32",
+	'n': "i128",
+	'o': "u128",
+	's': "i16",
+	't': "u16",
+	'u': "()",
+	'v': "...",
+	'x': "i64",
+	'y': "u64",
+	'z': "!",
+	'p': "_",
+}
+
+func demangleRust(s string) (string, error) {
+	p := &rustParser{s: s}
+	if c := p.peek(); c >= '0' && c <= '9' {
+		// Only version 0 exists, and that isn't encoded
+		return "", errUnsupported
+	}
+	name, err := p.parsePath(true)
+	if err != nil {
+		return "", err
+	}
+	// Anything after the path is the instantiating crate, which we don't show
+	if p.pos < len(p.s) {
+		_, err = p.parsePath(false)
+		if err != nil || p.pos != len(p.s) {
+			return "", errUnsupported
+		}
+	}
+	return name, nil
+}
+
+func (p *rustParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *rustParser) next() byte {
+	c := p.peek()
+	if c != 0 {
+		p.pos++
+	}
+	return c
+}
+
+func (p *rustParser) enter() error {
+	p.depth++
+	p.steps++
+	if p.depth > 100 || p.steps > 10000 {
+		return errUnsupported
+	}
+	return nil
+}
+
+func (p *rustParser) parseBase62() (int, error) {
+	if p.peek() == '_' {
+		p.pos++
+		return 0, nil
+	}
+	v := 0
+	for {
+		c := p.next()
+		if c >= '0' && c <= '9' {
+			v = v*62 + int(c-'0')
+		} else if c >= 'a' && c <= 'z' {
+			v = v*62 + int(c-'a') + 10
+		} else if c >= 'A' && c <= 'Z' {
+			v = v*62 + int(c-'A') + 36
+		} else if c == '_' {
+			return v + 1, nil
+		} else {
+			return 0, errUnsupported
+		}
+		if v > 1<<24 {
+			return 0, errUnsupported
+		}
+	}
+}
+
+func (p *rustParser) parseDisambiguator() (int, error) {
+	if p.peek() != 's' {
+		return 0, nil
+	}
+	p.pos++
+	v, err := p.parseBase62()
+	return v + 1, err
+}
+
+func (p *rustParser) parseIdentifier() (string, int, error) {
+	dis, err := p.parseDisambiguator()
+	if err != nil {
+		return "", 0, err
+	}
+	if p.peek() == 'u' {
+		return "", 0, errUnsupported
+	}
+	n, rest, err := readDecimal(p.s[p.pos:])
+	if err != nil {
+		return "", 0, err
+	}
+	p.pos = len(p.s) - len(rest)
+	if p.peek() == '_' {
+		p.pos++
+	}
+	if p.pos+n > len(p.s) {
+		return "", 0, errUnsupported
+	}
+	name := p.s[p.pos : p.pos+n]
+	p.pos += n
+	return name, dis, nil
+}
+
+// Follow a backref, parsing from the position it points to
+func (p *rustParser) backref(parse func() (string, error)) (string, error) {
+	start := p.pos
+	p.pos++ // B
+	target, err := p.parseBase62()
+	if err != nil {
+		return "", err
+	}
+	// Backrefs only go backwards, so they can't loop
+	if target >= start {
+		return "", errUnsupported
+	}
+	saved := p.pos
+	p.pos = target
+	s, err := parse()
+	p.pos = saved
+	return s, err
+}
+
+func (p *rustParser) parsePath(inValue bool) (string, error) {
+	err := p.enter()
+	if err != nil {
+		return "", err
+	}
+	defer func() { p.depth-- }()
+
+	c := p.peek()
+	if c == 'B' {
+		return p.backref(func() (string, error) { return p.parsePath(inValue) })
+	}
+	if c == 0 {
+		return "", errUnsupported
+	}
+	p.pos++
+	if c == 'C' {
+		name, _, err := p.parseIdentifier()
+		return name, err
+	} else if c == 'M' || c == 'X' {
+		_, err = p.parseDisambiguator()
+		if err != nil {
+			return "", err
+		}
+		_, err = p.parsePath(false)
+		if err != nil {
+			return "", err
+		}
+		t, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		if c == 'M' {
+			return "<" + t + ">", nil
+		}
+		trait, err := p.parsePath(false)
+		if err != nil {
+			return "", err
+		}
+		return "<" + t + " as " + trait + ">", nil
+	} else if c == 'Y' {
+		t, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		trait, err := p.parsePath(false)
+		if err != nil {
+			return "", err
+		}
+		return "<" + t + " as " + trait + ">", nil
+	} else if c == 'N' {
+		ns := p.next()
+		prefix, err := p.parsePath(inValue)
+		if err != nil {
+			return "", err
+		}
+		name, dis, err := p.parseIdentifier()
+		if err != nil {
+			return "", err
+		}
+		if ns >= 'A' && ns <= 'Z' {
+			kind := map[byte]string{'C': "closure", 'S': "shim"}[ns]
+			if kind == "" {
+				kind = string(ns)
+			}
+			if name != "" {
+				kind = kind + ":" + name
+			}
+			return prefix + "::{" + kind + "#" + strconv.Itoa(dis) + "}", nil
+		}
+		return prefix + "::" + name, nil
+	} else if c == 'I' {
+		prefix, err := p.parsePath(inValue)
+		if err != nil {
+			return "", err
+		}
+		args, err := p.parseGenericArgs()
+		if err != nil {
+			return "", err
+		}
+		if inValue {
+			return prefix + "::" + args, nil
+		}
+		return prefix + args, nil
+	}
+	return "", errUnsupported
+}
+
+func (p *rustParser) parseGenericArgs() (string, error) {
+	args := make([]string, 0)
+	for p.peek() != 'E' {
+		c := p.peek()
+		if c == 0 {
+			return "", errUnsupported
+		}
+		if c == 'L' {
+			// Lifetimes aren't interesting here
+			p.pos++
+			_, err := p.parseBase62()
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		var arg string
+		var err error
+		if c == 'K' {
+			p.pos++
+			arg, err = p.parseConst()
+		} else {
+			arg, err = p.parseType()
+		}
+		if err != nil {
+			return "", err
+		}
+		args = append(args, arg)
+	}
+	p.pos++ // E
+	return "<" + strings.Join(args, ", ") + ">", nil
+}
+
+func (p *rustParser) parseConst() (string, error) {
+	err := p.enter()
+	if err != nil {
+		return "", err
+	}
+	defer func() { p.depth-- }()
+
+	c := p.peek()
+	if c == 'B' {
+		return p.backref(p.parseConst)
+	}
+	if c == 0 {
+		return "", errUnsupported
+	}
+	p.pos++
+	if c == 'p' {
+		return "_", nil
+	}
+	negative := false
+	if p.peek() == 'n' {
+		negative = true
+		p.pos++
+	}
+	end := strings.IndexByte(p.s[p.pos:], '_')
+	if end == -1 {
+		return "", errUnsupported
+	}
+	hex := p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	v := uint64(0)
+	if hex != "" {
+		var ok bool
+		v, ok = parseHex(hex)
+		if !ok {
+			return "", errUnsupported
+		}
+	}
+	if c == 'b' {
+		if v == 0 {
+			return "false", nil
+		}
+		return "true", nil
+	} else if c == 'c' {
+		return strconv.QuoteRune(rune(v)), nil
+	} else if _, ok := rustBasicTypes[c]; ok {
+		s := strconv.FormatUint(v, 10)
+		if negative {
+			s = "-" + s
+		}
+		return s, nil
+	}
+	return "", errUnsupported
+}
+
+func (p *rustParser) parseType() (string, error) {
+	err := p.enter()
+	if err != nil {
+		return "", err
+	}
+	defer func() { p.depth-- }()
+
+	c := p.peek()
+	if b, ok := rustBasicTypes[c]; ok {
+		p.pos++
+		return b, nil
+	}
+	if c == 'B' {
+		return p.backref(p.parseType)
+	}
+	if c == 'R' || c == 'Q' || c == 'P' || c == 'O' {
+		p.pos++
+		if (c == 'R' || c == 'Q') && p.peek() == 'L' {
+			p.pos++
+			_, err = p.parseBase62()
+			if err != nil {
+				return "", err
+			}
+		}
+		t, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		prefix := map[byte]string{'R': "&", 'Q': "&mut ", 'P': "*const ", 'O': "*mut "}[c]
+		return prefix + t, nil
+	}
+	if c == 'A' || c == 'S' {
+		p.pos++
+		t, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		if c == 'S' {
+			return "[" + t + "]", nil
+		}
+		n, err := p.parseConst()
+		if err != nil {
+			return "", err
+		}
+		return "[" + t + "; " + n + "]", nil
+	}
+	if c == 'T' {
+		p.pos++
+		types := make([]string, 0)
+		for p.peek() != 'E' {
+			if p.peek() == 0 {
+				return "", errUnsupported
+			}
+			t, err := p.parseType()
+			if err != nil {
+				return "", err
+			}
+			types = append(types, t)
+		}
+		p.pos++
+		if len(types) == 1 {
+			return "(" + types[0] + ",)", nil
+		}
+		return "(" + strings.Join(types, ", ") + ")", nil
+	}
+	if c == 'F' {
+		return p.parseFnSig()
+	}
+	if c == 'D' {
+		return p.parseDyn()
+	}
+	return p.parsePath(false)
+}
+
+func (p *rustParser) parseBinder() error {
+	if p.peek() == 'G' {
+		p.pos++
+		_, err := p.parseBase62()
+		return err
+	}
+	return nil
+}
+
+func (p *rustParser) parseFnSig() (string, error) {
+	p.pos++ // F
+	err := p.parseBinder()
+	if err != nil {
+		return "", err
+	}
+	prefix := ""
+	if p.peek() == 'U' {
+		p.pos++
+		prefix = "unsafe "
+	}
+	if p.peek() == 'K' {
+		p.pos++
+		if p.peek() == 'C' {
+			p.pos++
+			prefix = prefix + "extern \"C\" "
+		} else {
+			abi, _, err := p.parseIdentifier()
+			if err != nil {
+				return "", err
+			}
+			prefix = prefix + "extern \"" + strings.ReplaceAll(abi, "_", "-") + "\" "
+		}
+	}
+	params := make([]string, 0)
+	for p.peek() != 'E' {
+		if p.peek() == 0 {
+			return "", errUnsupported
+		}
+		t, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		params = append(params, t)
+	}
+	p.pos++
+	ret, err := p.parseType()
+	if err != nil {
+		return "", err
+	}
+	s := prefix + "fn(" + strings.Join(params, ", ") + ")"
+	if ret != "()" {
+		s = s + " -> " + ret
+	}
+	return s, nil
+}
+
+func (p *rustParser) parseDyn() (string, error) {
+	p.pos++ // D
+	err := p.parseBinder()
+	if err != nil {
+		return "", err
+	}
+	traits := make([]string, 0)
+	for p.peek() != 'E' {
+		if p.peek() == 0 {
+			return "", errUnsupported
+		}
+		trait, err := p.parsePath(false)
+		if err != nil {
+			return "", err
+		}
+		bindings := make([]string, 0)
+		for p.peek() == 'p' {
+			p.pos++
+			name, _, err := p.parseIdentifier()
+			if err != nil {
+				return "", err
+			}
+			t, err := p.parseType()
+			if err != nil {
+				return "", err
+			}
+			bindings = append(bindings, name+" = "+t)
+		}
+		if len(bindings) > 0 {
+			if strings.HasSuffix(trait, ">") {
+				trait = trait[:len(trait)-1] + ", " + strings.Join(bindings, ", ") + ">"
+			} else {
+				trait = trait + "<" + strings.Join(bindings, ", ") + ">"
+			}
+		}
+		traits = append(traits, trait)
+	}
+	p.pos++
+	// The lifetime
+	if p.next() != 'L' {
+		return "", errUnsupported
+	}
+	_, err = p.parseBase62()
+	if err != nil {
+		return "", err
+	}
+	return "dyn " + strings.Join(traits, " + "), nil
+}
@@ -0,0 +1,510 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+const (
+	KindAdded   = "added"
+	KindRemoved = "removed"
+	KindChanged = "changed"
+)
+
+type Change struct {
+	Section string `json:"section"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+type Report struct {
+	Changes []*Change `json:"changes"`
+}
+
+func (r *Report) add(section string, kind string, name string, detail string) {
+	r.Changes = append(r.Changes, &Change{
+		Section: section,
+		Kind:    kind,
+		Name:    name,
+		Detail:  detail,
+	})
+}
+
+/**
+ * Write the report out in a human readable form, one change per line.
+ *
+ */
+func (r *Report) WriteText(w io.Writer) error {
+	for _, c := range r.Changes {
+		mark := "~"
+		if c.Kind == KindAdded {
+			mark = "+"
+		} else if c.Kind == KindRemoved {
+			mark = "-"
+		}
+		line := fmt.Sprintf("%s %-8s %s", mark, c.Section, c.Name)
+		if c.Detail != "" {
+			line = fmt.Sprintf("%s: %s", line, c.Detail)
+		}
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// One side of the comparison
+type side struct {
+	wf *wasmfile.WasmFile
+}
+
+func (s *side) functionName(fid int) string {
+	if s.wf.Debug != nil {
+		n, ok := s.wf.Debug.FunctionNames[fid]
+		if ok && n != "" {
+			return n
+		}
+	}
+	// Use something which doesn't change when imports are added or removed
+	if fid >= 0 && fid < len(s.wf.Import) {
+		return fmt.Sprintf("%s:%s", s.wf.Import[fid].Module, s.wf.Import[fid].Name)
+	}
+	return fmt.Sprintf("code[%d]", fid-len(s.wf.Import))
+}
+
+func (s *side) globalName(gid int) string {
+	if s.wf.Debug != nil {
+		n, ok := s.wf.Debug.GlobalNames[gid]
+		if ok && n != "" {
+			return n
+		}
+	}
+	return fmt.Sprintf("global[%d]", gid)
+}
+
+func (s *side) dataName(did int) string {
+	if s.wf.Debug != nil {
+		n, ok := s.wf.Debug.DataNames[did]
+		if ok && n != "" {
+			return n
+		}
+	}
+	return fmt.Sprintf("data[%d]", did)
+}
+
+func (s *side) typeString(tid int) string {
+	if tid < 0 || tid >= len(s.wf.Type) {
+		return fmt.Sprintf("type[%d]", tid)
+	}
+	return signature(s.wf.Type[tid])
+}
+
+func (s *side) functionType(fid int) string {
+	if fid < len(s.wf.Import) {
+		return s.typeString(s.wf.Import[fid].Index)
+	}
+	cid := fid - len(s.wf.Import)
+	if cid < len(s.wf.Function) {
+		return s.typeString(s.wf.Function[cid].TypeIndex)
+	}
+	return "?"
+}
+
+func signature(t *wasmfile.TypeEntry) string {
+	return fmt.Sprintf("(param%s) (result%s)", valTypes(t.Param), valTypes(t.Result))
+}
+
+func valTypes(vt []types.ValType) string {
+	s := ""
+	for _, v := range vt {
+		s = s + " " + types.ByteToValType[v]
+	}
+	return s
+}
+
+/**
+ * Compare two modules section by section. Functions, globals and data are matched by name
+ * where there is one, and by index otherwise.
+ */
+func Compare(a *wasmfile.WasmFile, b *wasmfile.WasmFile) *Report {
+	r := &Report{
+		Changes: make([]*Change, 0),
+	}
+	sa := &side{wf: a}
+	sb := &side{wf: b}
+
+	r.compareTypes(sa, sb)
+	r.compareImports(sa, sb)
+	r.compareFunctions(sa, sb)
+	r.compareTables(sa, sb)
+	r.compareMemories(sa, sb)
+	r.compareGlobals(sa, sb)
+	r.compareExports(sa, sb)
+	r.compareElems(sa, sb)
+	r.compareData(sa, sb)
+	r.compareCustoms(sa, sb)
+	return r
+}
+
+// Compare two keyed lists, in the order of the first then any new keys from the second.
+func compareKeyed(keysA []string, keysB []string, fn func(key string, ia int, ib int)) {
+	inA := make(map[string]int)
+	for i, k := range keysA {
+		inA[k] = i
+	}
+	inB := make(map[string]int)
+	for i, k := range keysB {
+		inB[k] = i
+	}
+	for ia, k := range keysA {
+		ib, ok := inB[k]
+		if !ok {
+			ib = -1
+		}
+		fn(k, ia, ib)
+	}
+	for ib, k := range keysB {
+		_, ok := inA[k]
+		if !ok {
+			fn(k, -1, ib)
+		}
+	}
+}
+
+func (r *Report) compareTypes(a *side, b *side) {
+	keysA := make([]string, 0)
+	for _, t := range a.wf.Type {
+		keysA = append(keysA, signature(t))
+	}
+	keysB := make([]string, 0)
+	for _, t := range b.wf.Type {
+		keysB = append(keysB, signature(t))
+	}
+	compareKeyed(keysA, keysB, func(key string, ia int, ib int) {
+		if ib == -1 {
+			r.add("type", KindRemoved, key, "")
+		} else if ia == -1 {
+			r.add("type", KindAdded, key, "")
+		}
+	})
+}
+
+func (r *Report) compareImports(a *side, b *side) {
+	keys := func(s *side) []string {
+		k := make([]string, 0)
+		for _, i := range s.wf.Import {
+			k = append(k, fmt.Sprintf("%s:%s", i.Module, i.Name))
+		}
+		return k
+	}
+	compareKeyed(keys(a), keys(b), func(key string, ia int, ib int) {
+		if ib == -1 {
+			r.add("import", KindRemoved, key, "")
+		} else if ia == -1 {
+			r.add("import", KindAdded, key, b.functionType(ib))
+		} else if a.functionType(ia) != b.functionType(ib) {
+			r.add("import", KindChanged, key, fmt.Sprintf("type %s -> %s", a.functionType(ia), b.functionType(ib)))
+		}
+	})
+}
+
+func (r *Report) compareFunctions(a *side, b *side) {
+	keys := func(s *side) []string {
+		k := make([]string, 0)
+		for cid := range s.wf.Code {
+			k = append(k, s.functionName(len(s.wf.Import)+cid))
+		}
+		return k
+	}
+	compareKeyed(keys(a), keys(b), func(key string, ia int, ib int) {
+		if ib == -1 {
+			r.add("function", KindRemoved, key, "")
+			return
+		} else if ia == -1 {
+			r.add("function", KindAdded, key, fmt.Sprintf("%d instructions", len(b.wf.Code[ib].Expression)))
+			return
+		}
+		fidA := len(a.wf.Import) + ia
+		fidB := len(b.wf.Import) + ib
+		details := make([]string, 0)
+		if a.functionType(fidA) != b.functionType(fidB) {
+			details = append(details, fmt.Sprintf("type %s -> %s", a.functionType(fidA), b.functionType(fidB)))
+		}
+		ca := a.wf.Code[ia]
+		cb := b.wf.Code[ib]
+		if valTypes(ca.Locals) != valTypes(cb.Locals) {
+			details = append(details, fmt.Sprintf("locals%s ->%s", valTypes(ca.Locals), valTypes(cb.Locals)))
+		}
+		d := compareCode(a, ca.Expression, b, cb.Expression)
+		if d != "" {
+			details = append(details, d)
+		}
+		if len(details) > 0 {
+			r.add("function", KindChanged, key, strings.Join(details, ", "))
+		}
+	})
+}
+
+// Compare two function bodies, looking through any renumbering of functions and globals.
+func compareCode(a *side, ea []*expression.Expression, b *side, eb []*expression.Expression) string {
+	for i := 0; i < len(ea) && i < len(eb); i++ {
+		if !sameInstruction(a, ea[i], b, eb[i]) {
+			return fmt.Sprintf("%d -> %d instructions, first difference at %d (%s -> %s)",
+				len(ea), len(eb), i, ea[i].Name(), eb[i].Name())
+		}
+	}
+	if len(ea) != len(eb) {
+		return fmt.Sprintf("%d -> %d instructions", len(ea), len(eb))
+	}
+	return ""
+}
+
+func sameInstruction(a *side, ea *expression.Expression, b *side, eb *expression.Expression) bool {
+	if ea.Opcode != eb.Opcode || ea.OpcodeExt != eb.OpcodeExt {
+		return false
+	}
+	ca := ea.Clone()
+	cb := eb.Clone()
+	if ea.Opcode == expression.InstrToOpcode["call"] {
+		if a.functionName(ea.FuncIndex) != b.functionName(eb.FuncIndex) {
+			return false
+		}
+		ca.FuncIndex = 0
+		cb.FuncIndex = 0
+	} else if ea.Opcode == expression.InstrToOpcode["global.get"] ||
+		ea.Opcode == expression.InstrToOpcode["global.set"] {
+		if a.globalName(ea.GlobalIndex) != b.globalName(eb.GlobalIndex) {
+			return false
+		}
+		ca.GlobalIndex = 0
+		cb.GlobalIndex = 0
+	} else if ea.HasTypeIndex() {
+		if a.typeString(ea.TypeIndex) != b.typeString(eb.TypeIndex) {
+			return false
+		}
+		ca.TypeIndex = 0
+		cb.TypeIndex = 0
+	}
+	return ca.Equals(cb)
+}
+
+func limits(min int, max int) string {
+	if max == 0 {
+		return fmt.Sprintf("%d", min)
+	}
+	return fmt.Sprintf("%d..%d", min, max)
+}
+
+func (r *Report) compareTables(a *side, b *side) {
+	for i := 0; i < len(a.wf.Table) || i < len(b.wf.Table); i++ {
+		name := fmt.Sprintf("table[%d]", i)
+		if i >= len(b.wf.Table) {
+			r.add("table", KindRemoved, name, "")
+		} else if i >= len(a.wf.Table) {
+			r.add("table", KindAdded, name, limits(b.wf.Table[i].LimitMin, b.wf.Table[i].LimitMax))
+		} else {
+			ta := a.wf.Table[i]
+			tb := b.wf.Table[i]
+			if ta.LimitMin != tb.LimitMin || ta.LimitMax != tb.LimitMax || ta.TableType != tb.TableType {
+				r.add("table", KindChanged, name, fmt.Sprintf("limits %s -> %s", limits(ta.LimitMin, ta.LimitMax), limits(tb.LimitMin, tb.LimitMax)))
+			}
+		}
+	}
+}
+
+func (r *Report) compareMemories(a *side, b *side) {
+	for i := 0; i < len(a.wf.Memory) || i < len(b.wf.Memory); i++ {
+		name := fmt.Sprintf("memory[%d]", i)
+		if i >= len(b.wf.Memory) {
+			r.add("memory", KindRemoved, name, "")
+		} else if i >= len(a.wf.Memory) {
+			r.add("memory", KindAdded, name, limits(b.wf.Memory[i].LimitMin, b.wf.Memory[i].LimitMax))
+		} else {
+			ma := a.wf.Memory[i]
+			mb := b.wf.Memory[i]
+			if ma.LimitMin != mb.LimitMin || ma.LimitMax != mb.LimitMax {
+				r.add("memory", KindChanged, name, fmt.Sprintf("pages %s -> %s", limits(ma.LimitMin, ma.LimitMax), limits(mb.LimitMin, mb.LimitMax)))
+			}
+		}
+	}
+}
+
+func (r *Report) compareGlobals(a *side, b *side) {
+	keys := func(s *side) []string {
+		k := make([]string, 0)
+		for gid := range s.wf.Global {
+			k = append(k, s.globalName(gid))
+		}
+		return k
+	}
+	describe := func(g *wasmfile.GlobalEntry) string {
+		mut := ""
+		if g.Mut != 0 {
+			mut = "mut "
+		}
+		return fmt.Sprintf("%s%s", mut, types.ByteToValType[g.Type])
+	}
+	compareKeyed(keys(a), keys(b), func(key string, ia int, ib int) {
+		if ib == -1 {
+			r.add("global", KindRemoved, key, "")
+		} else if ia == -1 {
+			r.add("global", KindAdded, key, describe(b.wf.Global[ib]))
+		} else {
+			ga := a.wf.Global[ia]
+			gb := b.wf.Global[ib]
+			details := make([]string, 0)
+			if describe(ga) != describe(gb) {
+				details = append(details, fmt.Sprintf("type %s -> %s", describe(ga), describe(gb)))
+			}
+			if compareCode(a, ga.Expression, b, gb.Expression) != "" {
+				details = append(details, "init changed")
+			}
+			if len(details) > 0 {
+				r.add("global", KindChanged, key, strings.Join(details, ", "))
+			}
+		}
+	})
+}
+
+func (r *Report) compareExports(a *side, b *side) {
+	keys := func(s *side) []string {
+		k := make([]string, 0)
+		for _, e := range s.wf.Export {
+			k = append(k, e.Name)
+		}
+		return k
+	}
+	target := func(s *side, e *wasmfile.ExportEntry) string {
+		if e.Type == types.ExportFunc {
+			return "func " + s.functionName(e.Index)
+		} else if e.Type == types.ExportGlobal {
+			return "global " + s.globalName(e.Index)
+		} else if e.Type == types.ExportMem {
+			return fmt.Sprintf("memory %d", e.Index)
+		}
+		return fmt.Sprintf("table %d", e.Index)
+	}
+	compareKeyed(keys(a), keys(b), func(key string, ia int, ib int) {
+		if ib == -1 {
+			r.add("export", KindRemoved, key, "")
+		} else if ia == -1 {
+			r.add("export", KindAdded, key, target(b, b.wf.Export[ib]))
+		} else {
+			ta := target(a, a.wf.Export[ia])
+			tb := target(b, b.wf.Export[ib])
+			if ta != tb {
+				r.add("export", KindChanged, key, fmt.Sprintf("%s -> %s", ta, tb))
+			}
+		}
+	})
+}
+
+func (r *Report) compareElems(a *side, b *side) {
+	for i := 0; i < len(a.wf.Elem) || i < len(b.wf.Elem); i++ {
+		name := fmt.Sprintf("elem[%d]", i)
+		if i >= len(b.wf.Elem) {
+			r.add("elem", KindRemoved, name, "")
+		} else if i >= len(a.wf.Elem) {
+			r.add("elem", KindAdded, name, fmt.Sprintf("%d entries", len(b.wf.Elem[i].Indexes)))
+		} else {
+			ea := a.wf.Elem[i]
+			eb := b.wf.Elem[i]
+			changed := len(ea.Indexes) != len(eb.Indexes) || compareCode(a, ea.Offset, b, eb.Offset) != ""
+			for n := 0; !changed && n < len(ea.Indexes); n++ {
+				changed = a.functionName(int(ea.Indexes[n])) != b.functionName(int(eb.Indexes[n]))
+			}
+			if changed {
+				r.add("elem", KindChanged, name, fmt.Sprintf("%d -> %d entries", len(ea.Indexes), len(eb.Indexes)))
+			}
+		}
+	}
+}
+
+func offsetString(exp []*expression.Expression) string {
+	if len(exp) == 1 && exp[0].Opcode == expression.InstrToOpcode["i32.const"] {
+		return fmt.Sprintf("%d", exp[0].I32Value)
+	}
+	return "?"
+}
+
+func (r *Report) compareData(a *side, b *side) {
+	keys := func(s *side) []string {
+		k := make([]string, 0)
+		for did := range s.wf.Data {
+			k = append(k, s.dataName(did))
+		}
+		return k
+	}
+	compareKeyed(keys(a), keys(b), func(key string, ia int, ib int) {
+		if ib == -1 {
+			r.add("data", KindRemoved, key, "")
+		} else if ia == -1 {
+			d := b.wf.Data[ib]
+			r.add("data", KindAdded, key, fmt.Sprintf("%d bytes at %s", len(d.Data), offsetString(d.Offset)))
+		} else {
+			da := a.wf.Data[ia]
+			db := b.wf.Data[ib]
+			details := make([]string, 0)
+			if offsetString(da.Offset) != offsetString(db.Offset) {
+				details = append(details, fmt.Sprintf("offset %s -> %s", offsetString(da.Offset), offsetString(db.Offset)))
+			}
+			if len(da.Data) != len(db.Data) {
+				details = append(details, fmt.Sprintf("%d -> %d bytes", len(da.Data), len(db.Data)))
+			} else if !bytes.Equal(da.Data, db.Data) {
+				details = append(details, "contents changed")
+			}
+			if len(details) > 0 {
+				r.add("data", KindChanged, key, strings.Join(details, ", "))
+			}
+		}
+	})
+}
+
+func (r *Report) compareCustoms(a *side, b *side) {
+	keys := func(s *side) []string {
+		k := make([]string, 0)
+		for _, c := range s.wf.Custom {
+			k = append(k, c.Name)
+		}
+		return k
+	}
+	compareKeyed(keys(a), keys(b), func(key string, ia int, ib int) {
+		if ib == -1 {
+			r.add("custom", KindRemoved, key, "")
+		} else if ia == -1 {
+			r.add("custom", KindAdded, key, fmt.Sprintf("%d bytes", len(b.wf.Custom[ib].Data)))
+		} else {
+			ca := a.wf.Custom[ia]
+			cb := b.wf.Custom[ib]
+			if len(ca.Data) != len(cb.Data) {
+				r.add("custom", KindChanged, key, fmt.Sprintf("%d -> %d bytes", len(ca.Data), len(cb.Data)))
+			} else if !bytes.Equal(ca.Data, cb.Data) {
+				r.add("custom", KindChanged, key, "contents changed")
+			}
+		}
+	})
+}
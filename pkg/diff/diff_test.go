@@ -0,0 +1,71 @@
+package diff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (type 0)))
+  (memory 1)
+  (global $counter (mut i32) (i32.const 0))
+
+  (func $add (param $a i32) (param $b i32) (result i32)
+    local.get $a
+    local.get $b
+    i32.add
+  )
+
+  (func $hello
+    global.get $counter
+    i32.const 1
+    call $add
+    global.set $counter
+  )
+
+  (data $message "Hello world")
+  (export "hello" (func $hello))
+)
+`
+
+func TestCompareSame(t *testing.T) {
+	a := testutil.Module(t, testWat)
+	assert.Equal(t, 0, len(Compare(a, a.Clone()).Changes))
+}
+
+func TestCompare(t *testing.T) {
+	a := testutil.Module(t, testWat)
+	b := a.Clone()
+
+	// Renumbering functions alone isn't a change
+	_, err := b.AddFunctionFromWat("$new", "(func\n nop\n)")
+	assert.NoError(t, err)
+	b.Import = append(b.Import, &wasmfile.ImportEntry{Module: "env", Name: "log", Index: 0})
+	b.Debug.RenumberFunctions(map[int]int{0: 0, 1: 2, 2: 3, 3: 4})
+	for _, c := range b.Code {
+		c.ModifyAllCalls(map[int]int{0: 0, 1: 2, 2: 3, 3: 4})
+	}
+	b.Export[0].Index = 3
+
+	b.Code[1].Expression[1] = &expression.Expression{Opcode: expression.InstrToOpcode["i32.const"], I32Value: 2}
+	b.Data[0].Data = []byte("Hello there")
+	b.Memory[0].LimitMin = 2
+	b.Custom = append(b.Custom, &wasmfile.CustomEntry{Name: "producers", Data: []byte{1, 2}})
+
+	r := Compare(a, b)
+	var buf bytes.Buffer
+	assert.NoError(t, r.WriteText(&buf))
+	assert.Equal(t, `+ import   env:log: (param i32 i32 i32 i32) (result i32)
+~ function $hello: 4 -> 4 instructions, first difference at 1 (i32.const -> i32.const)
++ function $new: 1 instructions
+~ memory   memory[0]: pages 1 -> 2
+~ data     $message: contents changed
++ custom   producers: 2 bytes
+`, buf.String())
+}
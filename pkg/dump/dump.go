@@ -0,0 +1,299 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package dump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/demangle"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"gopkg.in/yaml.v3"
+)
+
+// The structure of a module, for other tools to read. Names come from the name section, without the $.
+type Module struct {
+	Types     []*Type     `json:"types" yaml:"types"`
+	Imports   []*Import   `json:"imports" yaml:"imports"`
+	Functions []*Function `json:"functions" yaml:"functions"`
+	Tables    []*Table    `json:"tables" yaml:"tables"`
+	Memories  []*Memory   `json:"memories" yaml:"memories"`
+	Globals   []*Global   `json:"globals" yaml:"globals"`
+	Exports   []*Export   `json:"exports" yaml:"exports"`
+	Data      []*Data     `json:"data" yaml:"data"`
+	Custom    []*Custom   `json:"custom" yaml:"custom"`
+}
+
+type Type struct {
+	Index   int      `json:"index" yaml:"index"`
+	Params  []string `json:"params" yaml:"params"`
+	Results []string `json:"results" yaml:"results"`
+}
+
+type Import struct {
+	Module string `json:"module" yaml:"module"`
+	Name   string `json:"name" yaml:"name"`
+	Kind   string `json:"kind" yaml:"kind"`
+	Index  int    `json:"index" yaml:"index"` // Position in the import section, which is the function index for a function
+}
+
+// Functions include the imported ones, so the index is the function index
+type Function struct {
+	Index     int    `json:"index" yaml:"index"`
+	Name      string `json:"name,omitempty" yaml:"name,omitempty"`
+	Type      int    `json:"type" yaml:"type"`
+	Signature string `json:"signature" yaml:"signature"`               // eg (param i32 i32) (result i32)
+	Import    string `json:"import,omitempty" yaml:"import,omitempty"` // module.name, if it's imported
+	Locals    int    `json:"locals" yaml:"locals"`
+	Size      int    `json:"size" yaml:"size"` // Bytes the body takes in the code section
+}
+
+type Table struct {
+	Index int `json:"index" yaml:"index"`
+	Min   int `json:"min" yaml:"min"`
+	Max   int `json:"max,omitempty" yaml:"max,omitempty"`
+}
+
+type Memory struct {
+	Index  int  `json:"index" yaml:"index"`
+	Min    int  `json:"min" yaml:"min"` // In 64k pages
+	Max    int  `json:"max,omitempty" yaml:"max,omitempty"`
+	Shared bool `json:"shared,omitempty" yaml:"shared,omitempty"`
+}
+
+type Global struct {
+	Index   int    `json:"index" yaml:"index"`
+	Name    string `json:"name,omitempty" yaml:"name,omitempty"`
+	Type    string `json:"type" yaml:"type"`
+	Mutable bool   `json:"mutable" yaml:"mutable"`
+	Init    string `json:"init" yaml:"init"` // The initializer as wat, eg i32.const 1024
+}
+
+type Export struct {
+	Name  string `json:"name" yaml:"name"`
+	Kind  string `json:"kind" yaml:"kind"`
+	Index int    `json:"index" yaml:"index"`
+}
+
+// A data segment. The offset is only given when it's a constant.
+type Data struct {
+	Index  int    `json:"index" yaml:"index"`
+	Name   string `json:"name,omitempty" yaml:"name,omitempty"`
+	Memory int    `json:"memory" yaml:"memory"`
+	Offset *int64 `json:"offset,omitempty" yaml:"offset,omitempty"`
+	Size   int    `json:"size" yaml:"size"`
+}
+
+type Custom struct {
+	Name string `json:"name" yaml:"name"`
+	Size int    `json:"size" yaml:"size"`
+}
+
+var kinds = map[types.ExportType]string{
+	types.ExportFunc:   "func",
+	types.ExportTable:  "table",
+	types.ExportMem:    "memory",
+	types.ExportGlobal: "global",
+}
+
+func valTypes(vts []types.ValType) []string {
+	s := make([]string, 0, len(vts))
+	for _, vt := range vts {
+		s = append(s, types.ByteToValType[vt])
+	}
+	return s
+}
+
+// Describe a type as wat does
+func signature(te *wasmfile.TypeEntry) string {
+	parts := make([]string, 0, 2)
+	if len(te.Param) > 0 {
+		parts = append(parts, fmt.Sprintf("(param %s)", strings.Join(valTypes(te.Param), " ")))
+	}
+	if len(te.Result) > 0 {
+		parts = append(parts, fmt.Sprintf("(result %s)", strings.Join(valTypes(te.Result), " ")))
+	}
+	return strings.Join(parts, " ")
+}
+
+func kind(t types.ExportType) string {
+	k, ok := kinds[t]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", t)
+	}
+	return k
+}
+
+func name(names map[int]string, idx int) string {
+	return strings.TrimPrefix(names[idx], "$")
+}
+
+// Function names are demangled if the debug info says so
+func functionName(wf *wasmfile.WasmFile, fid int) string {
+	n := name(wf.Debug.FunctionNames, fid)
+	if wf.Debug.Demangle {
+		n = demangle.Demangle(n)
+	}
+	return n
+}
+
+/**
+ * Describe a module. Function sizes come from the original binary where possible, otherwise the
+ * body is encoded to find out.
+ */
+func Describe(wf *wasmfile.WasmFile) (*Module, error) {
+	m := &Module{
+		Types:     make([]*Type, 0),
+		Imports:   make([]*Import, 0),
+		Functions: make([]*Function, 0),
+		Tables:    make([]*Table, 0),
+		Memories:  make([]*Memory, 0),
+		Globals:   make([]*Global, 0),
+		Exports:   make([]*Export, 0),
+		Data:      make([]*Data, 0),
+		Custom:    make([]*Custom, 0),
+	}
+
+	for idx, te := range wf.Type {
+		m.Types = append(m.Types, &Type{Index: idx, Params: valTypes(te.Param), Results: valTypes(te.Result)})
+	}
+
+	for idx, imp := range wf.Import {
+		m.Imports = append(m.Imports, &Import{Module: imp.Module, Name: imp.Name, Kind: kind(imp.Type), Index: idx})
+		if imp.Type != types.ExportFunc {
+			continue
+		}
+		f := &Function{
+			Index:  idx,
+			Name:   functionName(wf, idx),
+			Type:   imp.Index,
+			Import: imp.Module + "." + imp.Name,
+		}
+		if imp.Index >= 0 && imp.Index < len(wf.Type) {
+			f.Signature = signature(wf.Type[imp.Index])
+		}
+		m.Functions = append(m.Functions, f)
+	}
+
+	for idx, c := range wf.Code {
+		fid := len(wf.Import) + idx
+		f := &Function{
+			Index:  fid,
+			Name:   functionName(wf, fid),
+			Locals: len(c.Locals),
+			Size:   int(c.CodeSectionLen),
+		}
+		if idx < len(wf.Function) {
+			f.Type = wf.Function[idx].TypeIndex
+			if f.Type >= 0 && f.Type < len(wf.Type) {
+				f.Signature = signature(wf.Type[f.Type])
+			}
+		}
+		if f.Size == 0 {
+			// Not from a binary, so encode it to find out, without the length prefix
+			var buf bytes.Buffer
+			err := c.EncodeBinary(&buf)
+			if err != nil {
+				return nil, err
+			}
+			_, l := binary.Uvarint(buf.Bytes())
+			f.Size = buf.Len() - l
+		}
+		m.Functions = append(m.Functions, f)
+	}
+
+	for idx, t := range wf.Table {
+		m.Tables = append(m.Tables, &Table{Index: idx, Min: t.LimitMin, Max: t.LimitMax})
+	}
+
+	for idx, mem := range wf.Memory {
+		m.Memories = append(m.Memories, &Memory{Index: idx, Min: mem.LimitMin, Max: mem.LimitMax, Shared: mem.Shared})
+	}
+
+	for idx, g := range wf.Global {
+		init, err := wat(wf, g.Expression)
+		if err != nil {
+			return nil, err
+		}
+		m.Globals = append(m.Globals, &Global{
+			Index:   idx,
+			Name:    name(wf.Debug.GlobalNames, idx),
+			Type:    types.ByteToValType[g.Type],
+			Mutable: g.Mut == 0x01,
+			Init:    init,
+		})
+	}
+
+	for _, e := range wf.Export {
+		m.Exports = append(m.Exports, &Export{Name: e.Name, Kind: kind(e.Type), Index: e.Index})
+	}
+
+	for idx, d := range wf.Data {
+		data := &Data{
+			Index:  idx,
+			Name:   name(wf.Debug.DataNames, idx),
+			Memory: d.MemIndex,
+			Size:   len(d.Data),
+		}
+		if len(d.Offset) == 1 && d.Offset[0].Opcode == expression.InstrToOpcode["i32.const"] {
+			offset := int64(uint32(d.Offset[0].I32Value))
+			data.Offset = &offset
+		}
+		m.Data = append(m.Data, data)
+	}
+
+	for _, c := range wf.Custom {
+		m.Custom = append(m.Custom, &Custom{Name: c.Name, Size: len(c.Data)})
+	}
+
+	return m, nil
+}
+
+// A constant expression as wat, on one line
+func wat(wf *wasmfile.WasmFile, exp []*expression.Expression) (string, error) {
+	parts := make([]string, 0, len(exp))
+	for _, e := range exp {
+		b, err := e.AppendWat(nil, "", wf.Debug)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, strings.TrimSpace(string(b)))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func (m *Module) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+func (m *Module) WriteYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(m)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
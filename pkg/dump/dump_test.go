@@ -0,0 +1,81 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+const testWat = `(module
+  (type (func (param i32 i32) (result i32)))
+  (type (func))
+  (import "env" "add" (func $add (type 0)))
+  (memory 2 10)
+  (table 1 funcref)
+  (global $counter (mut i32) (i32.const 7))
+  (data $greeting (i32.const 1024) "hello")
+  (func $_start (type 1)
+    (local i32 i64)
+    i32.const 1
+    i32.const 2
+    call $add
+    global.set $counter
+  )
+  (export "_start" (func $_start))
+  (export "memory" (memory 0))
+)
+`
+
+func TestDescribe(t *testing.T) {
+	m, err := Describe(testutil.Reload(t, testutil.Module(t, testWat)))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []*Type{
+		{Index: 0, Params: []string{"i32", "i32"}, Results: []string{"i32"}},
+		{Index: 1, Params: []string{}, Results: []string{}},
+	}, m.Types)
+	assert.Equal(t, []*Import{{Module: "env", Name: "add", Kind: "func", Index: 0}}, m.Imports)
+
+	assert.Equal(t, 2, len(m.Functions))
+	assert.Equal(t, &Function{Index: 0, Name: "add", Type: 0, Signature: "(param i32 i32) (result i32)", Import: "env.add"}, m.Functions[0])
+	f := m.Functions[1]
+	assert.Equal(t, "_start", f.Name)
+	assert.Equal(t, "", f.Signature)
+	assert.Equal(t, 2, f.Locals)
+	assert.True(t, f.Size > 0)
+
+	assert.Equal(t, []*Table{{Index: 0, Min: 1}}, m.Tables)
+	assert.Equal(t, []*Memory{{Index: 0, Min: 2, Max: 10}}, m.Memories)
+	assert.Equal(t, []*Global{{Index: 0, Name: "counter", Type: "i32", Mutable: true, Init: "i32.const 7"}}, m.Globals)
+	assert.Equal(t, []*Export{{Name: "_start", Kind: "func", Index: 1}, {Name: "memory", Kind: "memory", Index: 0}}, m.Exports)
+
+	assert.Equal(t, 1, len(m.Data))
+	assert.Equal(t, "greeting", m.Data[0].Name)
+	assert.Equal(t, int64(1024), *m.Data[0].Offset)
+	assert.Equal(t, 5, m.Data[0].Size)
+
+	assert.Equal(t, "name", m.Custom[0].Name)
+	assert.True(t, m.Custom[0].Size > 0)
+}
+
+func TestWrite(t *testing.T) {
+	m, err := Describe(testutil.Reload(t, testutil.Module(t, testWat)))
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, m.WriteJSON(&buf))
+	m2 := &Module{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), m2))
+	assert.Equal(t, m, m2)
+
+	buf.Reset()
+	assert.NoError(t, m.WriteYAML(&buf))
+	m3 := &Module{}
+	assert.NoError(t, yaml.Unmarshal(buf.Bytes(), m3))
+	assert.Equal(t, m.Functions, m3.Functions)
+	assert.Equal(t, m.Data, m3.Data)
+}
@@ -0,0 +1,394 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package heaptrace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/demangle"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+type Heaptrace_config struct {
+	Log       bool // Log every allocation and free
+	TopSites  int  // Number of allocation sites to show in the report
+	TableSize int  // Number of live allocations remembered, for allocators where free doesn't give a size
+}
+
+type AllocatorKind int
+
+const (
+	AllocatorAlloc AllocatorKind = iota
+	AllocatorFree
+	AllocatorRealloc
+	AllocatorGo
+)
+
+/**
+ * An allocator entry point, and which params hold what. Unused params are -1.
+ *
+ */
+type Allocator struct {
+	Kind         AllocatorKind
+	PtrParam     int
+	SizeParam    int
+	CountParam   int
+	OldSizeParam int
+	NumParams    int
+}
+
+// The allocator entry points we know about, by name
+var Allocators = map[string]Allocator{
+	"malloc":              {AllocatorAlloc, -1, 0, -1, -1, 1},
+	"calloc":              {AllocatorAlloc, -1, 1, 0, -1, 2},
+	"aligned_alloc":       {AllocatorAlloc, -1, 1, -1, -1, 2},
+	"realloc":             {AllocatorRealloc, 0, 1, -1, -1, 2},
+	"free":                {AllocatorFree, 0, -1, -1, -1, 1},
+	"__rust_alloc":        {AllocatorAlloc, -1, 0, -1, -1, 2},
+	"__rust_alloc_zeroed": {AllocatorAlloc, -1, 0, -1, -1, 2},
+	"__rust_realloc":      {AllocatorRealloc, 0, 3, -1, 1, 4},
+	"__rust_dealloc":      {AllocatorFree, 0, 1, -1, -1, 3},
+	"runtime.mallocgc":    {AllocatorGo, -1, -1, -1, -1, 1},
+}
+
+/**
+ * Find the allocator entry points in a wasm file, by function ID.
+ * Names are matched raw or demangled, ignoring any path prefix (eg std::__rust_alloc).
+ *
+ */
+func FindAllocators(wfile *wasmfile.WasmFile) map[int]Allocator {
+	found := make(map[int]Allocator)
+	for idx := range wfile.Code {
+		fid := len(wfile.Import) + idx
+		name, ok := wfile.Debug.FunctionNames[fid]
+		if !ok {
+			continue
+		}
+		name = strings.TrimPrefix(name, "$")
+		for _, n := range []string{name, demangle.Demangle(name)} {
+			if sep := strings.LastIndex(n, "::"); sep != -1 {
+				n = n[sep+2:]
+			}
+			a, ok := Allocators[n]
+			if !ok {
+				continue
+			}
+			// Make sure it looks right
+			t := wfile.Type[wfile.Function[idx].TypeIndex]
+			if len(t.Param) != a.NumParams {
+				continue
+			}
+			if (a.Kind == AllocatorFree && len(t.Result) != 0) || (a.Kind != AllocatorFree && len(t.Result) != 1) {
+				continue
+			}
+			found[fid] = a
+			break
+		}
+	}
+	return found
+}
+
+/**
+ * Add heap tracing to a wasm.
+ *
+ */
+func AddHeaptrace(wasmInput []byte, config Heaptrace_config) ([]byte, error) {
+	if config.TableSize&(config.TableSize-1) != 0 {
+		return nil, errors.New("The table size must be a power of 2")
+	}
+
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	originalFunctionLength := len(wfile.Code)
+
+	// Load up the individual wat files, and add them in
+	files := []string{
+		"memory.wat",
+		"stdout.wat",
+		"heaptrace.wat"}
+
+	payload, err := wfile.AddPayload(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// Function IDs are stable from here on
+	allocators := FindAllocators(wfile)
+	if len(allocators) == 0 {
+		return nil, errors.New("No allocator functions found")
+	}
+
+	tracksFrees := false
+	needsTable := false
+	for fid, a := range allocators {
+		fmt.Printf("Found allocator %s\n", wfile.Debug.GetFunctionIdentifier(fid, false))
+		if a.Kind == AllocatorFree {
+			tracksFrees = true
+			if a.SizeParam == -1 {
+				needsTable = true
+			}
+		}
+	}
+
+	// Function names, and per function allocation site stats
+	num_functions := len(wfile.Import) + len(wfile.Code)
+	data_function_names := make([]byte, 0)
+	data_function_locs := make([]byte, 0)
+	for fid := 0; fid < num_functions; fid++ {
+		name := wfile.Debug.GetFunctionIdentifier(fid, false)
+		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len(data_function_names)))
+		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len([]byte(name))))
+		data_function_names = append(data_function_names, []byte(name)...)
+	}
+	payload.AddData("$wt_all_function_names", data_function_names)
+	payload.AddData("$wt_all_function_names_locs", data_function_locs)
+	payload.AddData("$heap_sites", make([]byte, num_functions*16))
+
+	tableSize := 0
+	if needsTable {
+		tableSize = config.TableSize
+	}
+	payload.AddData("$heap_table", make([]byte, (tableSize*8)+8))
+
+	for _, g := range []struct {
+		name  string
+		value int
+	}{
+		{"$wt_all_function_length", num_functions},
+		{"$heap_table_size", tableSize},
+		{"$heap_top_sites", config.TopSites},
+		{"$heap_log_enabled", boolToInt(config.Log)},
+		{"$heap_tracks_frees", boolToInt(tracksFrees)},
+	} {
+		err = wfile.SetGlobal(g.name, types.ValI32, fmt.Sprintf("i32.const %d", g.value))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The report is shown at proc_exit, or when _start returns
+	procExit := -1
+	for idx, i := range wfile.Import {
+		if i.Module == "wasi_snapshot_preview1" && i.Name == "proc_exit" {
+			procExit = idx
+		}
+	}
+	startFid := -1
+	for _, ex := range wfile.Export {
+		if ex.Type == types.ExportFunc && ex.Name == "_start" {
+			startFid = ex.Index
+		}
+	}
+
+	for idx, c := range wfile.Code {
+		if idx < originalFunctionLength {
+			err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
+			if err != nil {
+				return nil, err
+			}
+			err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
+			if err != nil {
+				return nil, err
+			}
+
+			functionIndex := idx + len(wfile.Import)
+
+			// Set the allocation site before any allocator calls, and report before exit
+			newCode := make([]*expression.Expression, 0)
+			for _, e := range c.Expression {
+				// Calls added above (eg $debug_memory_grow) aren't resolved yet, so their FuncIndex means nothing
+				if e.Opcode == expression.InstrToOpcode["call"] && !e.FunctionNeedsLinking {
+					wcode := ""
+					if _, ok := allocators[e.FuncIndex]; ok {
+						wcode = fmt.Sprintf(`i32.const %d
+							global.set $heap_site`, functionIndex)
+					} else if e.FuncIndex == procExit {
+						wcode = "call $heap_report"
+					}
+					if wcode != "" {
+						wcex, err := expression.ExpressionFromWat(wcode)
+						if err != nil {
+							return nil, err
+						}
+						newCode = append(newCode, wcex...)
+					}
+				}
+				newCode = append(newCode, e)
+			}
+			c.Expression = newCode
+
+			a, ok := allocators[functionIndex]
+			if ok {
+				err = addAllocatorHooks(wfile, c, functionIndex, a)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if functionIndex == startFid {
+				err = c.InsertFuncStart(wfile, "block")
+				if err != nil {
+					return nil, err
+				}
+				err = c.ReplaceInstr(wfile, "return", "call $heap_report\nreturn")
+				if err != nil {
+					return nil, err
+				}
+				err = c.InsertFuncEnd(wfile, "end\ncall $heap_report")
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		err = payload.Resolve(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = payload.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+/**
+ * Wrap an allocator function so that the result gets recorded
+ *
+ */
+func addAllocatorHooks(wfile *wasmfile.WasmFile, c *wasmfile.CodeEntry, fid int, a Allocator) error {
+	if a.Kind == AllocatorGo {
+		// Go functions can be re-entered to resume them, so only count a fresh call. The size is the
+		// first arg on the go stack ($SP is global 0).
+		return c.InsertFuncStart(wfile, fmt.Sprintf(`local.get 0
+			i32.eqz
+			if
+			global.get 0
+			i64.load offset=8
+			i32.const %d
+			call $heap_go_alloc
+			end`, fid))
+	}
+
+	// Keep copies of the params, incase the function modifies them
+	t := wfile.Type[wfile.Function[fid-len(wfile.Import)].TypeIndex]
+	local_site := len(t.Param) + len(c.Locals)
+	local_ptr := local_site + 1
+	local_size := local_site + 2
+	local_old_size := local_site + 3
+	c.Locals = append(c.Locals, types.ValI32, types.ValI32, types.ValI32, types.ValI32)
+
+	startCode := fmt.Sprintf(`global.get $heap_site
+		local.set %d
+		i32.const -1
+		local.set %d`, local_site, local_size)
+	if a.PtrParam != -1 {
+		startCode = fmt.Sprintf(`%s
+			local.get %d
+			local.set %d`, startCode, a.PtrParam, local_ptr)
+	}
+	if a.SizeParam != -1 {
+		startCode = fmt.Sprintf(`%s
+			local.get %d
+			local.set %d`, startCode, a.SizeParam, local_size)
+	}
+	if a.CountParam != -1 {
+		startCode = fmt.Sprintf(`%s
+			local.get %d
+			local.get %d
+			i32.mul
+			local.set %d`, startCode, a.CountParam, a.SizeParam, local_size)
+	}
+	oldSize := "i32.const -1"
+	if a.OldSizeParam != -1 {
+		oldSize = fmt.Sprintf("local.get %d", local_old_size)
+		startCode = fmt.Sprintf(`%s
+			local.get %d
+			local.set %d`, startCode, a.OldSizeParam, local_old_size)
+	}
+
+	blockInstr := "block"
+	if len(t.Result) > 0 {
+		blockInstr = fmt.Sprintf("block (result %s)", types.ByteToValType[t.Result[0]])
+	}
+	startCode = fmt.Sprintf(`%s
+		call $heap_enter
+		%s`, startCode, blockInstr)
+
+	var endCode string
+	switch a.Kind {
+	case AllocatorAlloc:
+		endCode = fmt.Sprintf(`local.get %d
+			local.get %d
+			i32.const %d
+			call $heap_alloc_exit`, local_size, local_site, fid)
+	case AllocatorFree:
+		endCode = fmt.Sprintf(`local.get %d
+			local.get %d
+			local.get %d
+			i32.const %d
+			call $heap_free_exit`, local_ptr, local_size, local_site, fid)
+	case AllocatorRealloc:
+		endCode = fmt.Sprintf(`local.get %d
+			%s
+			local.get %d
+			local.get %d
+			i32.const %d
+			call $heap_realloc_exit`, local_ptr, oldSize, local_size, local_site, fid)
+	}
+
+	err := c.InsertFuncStart(wfile, startCode)
+	if err != nil {
+		return err
+	}
+	err = c.ReplaceInstr(wfile, "return", endCode+"\nreturn")
+	if err != nil {
+		return err
+	}
+	return c.InsertFuncEnd(wfile, "end\n"+endCode)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
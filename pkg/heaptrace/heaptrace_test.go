@@ -0,0 +1,41 @@
+package heaptrace
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindAllocators(t *testing.T) {
+	wf := wasmfile.NewEmpty()
+	wf.Type = []*wasmfile.TypeEntry{
+		{Param: []types.ValType{types.ValI32}, Result: []types.ValType{types.ValI32}},
+		{Param: []types.ValType{types.ValI32}, Result: []types.ValType{}},
+		{Param: []types.ValType{types.ValI32, types.ValI32}, Result: []types.ValType{types.ValI32}},
+	}
+	wf.Import = []*wasmfile.ImportEntry{{Module: "env", Name: "f"}}
+	for fid, fn := range []struct {
+		name      string
+		typeIndex int
+	}{
+		{"$malloc", 0},
+		{"$free", 1},
+		{"$_ZN3std5alloc12__rust_alloc17h1234567890abcdefE", 2},
+		{"$runtime.mallocgc", 0},
+		{"$calloc", 0}, // Wrong signature
+		{"$main", 1},
+	} {
+		wf.Function = append(wf.Function, &wasmfile.FunctionEntry{TypeIndex: fn.typeIndex})
+		wf.Code = append(wf.Code, &wasmfile.CodeEntry{})
+		wf.Debug.FunctionNames[fid+1] = fn.name
+	}
+
+	allocators := FindAllocators(wf)
+	assert.Equal(t, 4, len(allocators))
+	assert.Equal(t, AllocatorAlloc, allocators[1].Kind)
+	assert.Equal(t, AllocatorFree, allocators[2].Kind)
+	assert.Equal(t, AllocatorAlloc, allocators[3].Kind)
+	assert.Equal(t, AllocatorGo, allocators[4].Kind)
+}
@@ -0,0 +1,246 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package inline
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+const DefaultMaxSize = 8
+
+type Inline_config struct {
+	MaxSize int // Functions with up to this many instructions are inlined
+}
+
+// Control flow can't be inlined without wrapping the body in a block, so functions using it are left alone
+var controlOps = map[expression.Opcode]bool{
+	expression.InstrToOpcode["block"]:    true,
+	expression.InstrToOpcode["loop"]:     true,
+	expression.InstrToOpcode["if"]:       true,
+	expression.InstrToOpcode["else"]:     true,
+	expression.InstrToOpcode["end"]:      true,
+	expression.InstrToOpcode["br"]:       true,
+	expression.InstrToOpcode["br_if"]:    true,
+	expression.InstrToOpcode["br_table"]: true,
+	expression.InstrToOpcode["return"]:   true,
+}
+
+// Locals start at zero, so inlined locals are zeroed with these
+var zeroConsts = map[types.ValType]string{
+	types.ValI32: "i32.const",
+	types.ValI64: "i64.const",
+	types.ValF32: "f32.const",
+	types.ValF64: "f64.const",
+}
+
+type callee struct {
+	te     *wasmfile.TypeEntry
+	locals []types.ValType
+	body   []*expression.Expression
+	// The body starts by loading the params in order and never uses them again, as import
+	// wrappers do, so the args can stay on the stack.
+	forward bool
+}
+
+func isLocalOp(e *expression.Expression) bool {
+	return e.Opcode == expression.InstrToOpcode["local.get"] ||
+		e.Opcode == expression.InstrToOpcode["local.set"] ||
+		e.Opcode == expression.InstrToOpcode["local.tee"]
+}
+
+/**
+ * Get a function if it can be inlined, or nil.
+ *
+ */
+func getCallee(wfile *wasmfile.WasmFile, fid int, maxSize int) *callee {
+	c := wfile.Code[fid-len(wfile.Import)]
+	if len(c.Expression) > maxSize {
+		return nil
+	}
+	for _, t := range c.Locals {
+		if _, ok := zeroConsts[t]; !ok {
+			return nil
+		}
+	}
+	for _, e := range c.Expression {
+		if controlOps[e.Opcode] {
+			return nil
+		}
+		if e.Opcode == expression.InstrToOpcode["call"] && (e.FunctionNeedsLinking || e.FuncIndex == fid) {
+			return nil
+		}
+	}
+
+	cal := &callee{
+		te:     wfile.Type[wfile.Function[fid-len(wfile.Import)].TypeIndex],
+		locals: c.Locals,
+		body:   expression.CloneExpressions(c.Expression),
+	}
+
+	nparams := len(cal.te.Param)
+	cal.forward = len(cal.body) >= nparams
+	for i := 0; cal.forward && i < nparams; i++ {
+		e := cal.body[i]
+		cal.forward = e.Opcode == expression.InstrToOpcode["local.get"] && e.LocalIndex == i
+	}
+	if cal.forward {
+		for _, e := range cal.body[nparams:] {
+			if isLocalOp(e) && e.LocalIndex < nparams {
+				cal.forward = false
+				break
+			}
+		}
+	}
+	return cal
+}
+
+/**
+ * Inline calls to small functions with no control flow. The callee's params and locals become
+ * new locals in the caller. The callees are left in place, since they may be exported or in a table.
+ * Returns the number of calls inlined.
+ */
+func InlineFunctions(wfile *wasmfile.WasmFile, maxSize int) int {
+	// Take copies of the callees first, as they may be callers too
+	callees := make(map[int]*callee)
+	for idx := range wfile.Code {
+		fid := len(wfile.Import) + idx
+		cal := getCallee(wfile, fid, maxSize)
+		if cal != nil {
+			callees[fid] = cal
+		}
+	}
+	if len(callees) == 0 {
+		return 0
+	}
+
+	count := 0
+	for idx, c := range wfile.Code {
+		fid := len(wfile.Import) + idx
+		te := wfile.Type[wfile.Function[idx].TypeIndex]
+		hasLines := len(c.WatLines) == len(c.Expression)
+
+		// Each callee gets one set of locals in the caller, shared by all its call sites
+		localBase := make(map[int]int)
+
+		newCode := make([]*expression.Expression, 0, len(c.Expression))
+		newLines := make([]int, 0, len(c.WatLines))
+		for i, e := range c.Expression {
+			cal, ok := callees[e.FuncIndex]
+			if e.Opcode != expression.InstrToOpcode["call"] || e.FunctionNeedsLinking || !ok || e.FuncIndex == fid {
+				newCode = append(newCode, e)
+				if hasLines {
+					newLines = append(newLines, c.WatLines[i])
+				}
+				continue
+			}
+
+			nparams := len(cal.te.Param)
+			base, ok := localBase[e.FuncIndex]
+			if !ok {
+				base = len(te.Param) + len(c.Locals)
+				localBase[e.FuncIndex] = base
+				if !cal.forward {
+					c.Locals = append(c.Locals, cal.te.Param...)
+				}
+				c.Locals = append(c.Locals, cal.locals...)
+			}
+			localMap := func(l int) int {
+				if cal.forward {
+					return base + l - nparams
+				}
+				return base + l
+			}
+
+			inlined := make([]*expression.Expression, 0)
+			start := nparams
+			if !cal.forward {
+				start = 0
+				for p := nparams - 1; p >= 0; p-- {
+					inlined = append(inlined, &expression.Expression{
+						Opcode:     expression.InstrToOpcode["local.set"],
+						LocalIndex: localMap(p),
+					})
+				}
+			}
+			for l, t := range cal.locals {
+				inlined = append(inlined, &expression.Expression{
+					Opcode: expression.InstrToOpcode[zeroConsts[t]],
+				}, &expression.Expression{
+					Opcode:     expression.InstrToOpcode["local.set"],
+					LocalIndex: localMap(nparams + l),
+				})
+			}
+			for _, be := range cal.body[start:] {
+				ne := be.Clone()
+				if isLocalOp(ne) {
+					ne.LocalIndex = localMap(ne.LocalIndex)
+				}
+				inlined = append(inlined, ne)
+			}
+
+			newCode = append(newCode, inlined...)
+			if hasLines {
+				for range inlined {
+					newLines = append(newLines, c.WatLines[i])
+				}
+			}
+			count++
+		}
+
+		c.Expression = newCode
+		if hasLines {
+			c.WatLines = newLines
+		}
+	}
+	return count
+}
+
+/**
+ * Inline small functions in a wasm. Returns the new wasm and the number of calls inlined.
+ *
+ */
+func Inline(wasmInput []byte, config Inline_config) ([]byte, int, error) {
+	if config.MaxSize < 1 {
+		return nil, 0, errors.New("The max size must be at least 1")
+	}
+
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	count := InlineFunctions(wfile, config.MaxSize)
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), count, nil
+}
@@ -0,0 +1,107 @@
+package inline
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32 i32) (result i32)))
+  (type (func (param i32) (result i32)))
+  (import "env" "mul" (func $mul (type 0)))
+  (func $wrap_mul (type 0)
+    local.get 0
+    local.get 1
+    call 0
+  )
+  (func $sub_swap (type 0)
+    (local i32)
+    local.get 0
+    local.set 2
+    local.get 1
+    local.get 2
+    i32.sub
+  )
+  (func $abs (type 1)
+    local.get 0
+    i32.const 0
+    i32.lt_s
+    if (result i32)
+    i32.const 0
+    local.get 0
+    i32.sub
+    else
+    local.get 0
+    end
+  )
+  (func $run (type 1)
+    (local i32)
+    local.get 0
+    i32.const 3
+    call 1
+    local.set 1
+    local.get 1
+    local.get 0
+    call 2
+    call 3
+    local.get 1
+    local.get 1
+    call 2
+    i32.add
+  )
+  (export "run" (func 4))
+)
+`
+
+func run(t *testing.T, wasm []byte, x uint32) uint32 {
+	ctx, r := testutil.Runtime(t)
+	_, err := r.NewHostModuleBuilder("env").NewFunctionBuilder().
+		WithFunc(func(a uint32, b uint32) uint32 {
+			return a * b
+		}).Export("mul").Instantiate(ctx)
+	assert.NoError(t, err)
+	mod, err := r.Instantiate(ctx, wasm)
+	assert.NoError(t, err)
+	res, err := mod.ExportedFunction("run").Call(ctx, uint64(x))
+	assert.NoError(t, err)
+	return uint32(res[0])
+}
+
+func TestInline(t *testing.T) {
+	in := testutil.Binary(t, testWat)
+
+	_, _, err := Inline(in, Inline_config{MaxSize: 0})
+	assert.Error(t, err)
+
+	out, count, err := Inline(in, Inline_config{MaxSize: DefaultMaxSize})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	wf := &wasmfile.WasmFile{}
+	assert.NoError(t, wf.DecodeBinary(out))
+	assert.NoError(t, wf.Validate())
+
+	// Only the call to the import, and the one to $abs, are left in $run
+	calls := make([]int, 0)
+	for _, e := range wf.Code[3].Expression {
+		if e.Opcode == expression.InstrToOpcode["call"] {
+			calls = append(calls, e.FuncIndex)
+		}
+	}
+	assert.Equal(t, []int{0, 3}, calls)
+	// The wrapper needs no locals, and $sub_swap needs its params and local once
+	assert.Equal(t, 4, len(wf.Code[3].Locals))
+
+	for _, x := range []uint32{0, 1, 5, 100} {
+		assert.Equal(t, run(t, in, x), run(t, out, x))
+	}
+
+	// Nothing is small enough
+	_, count, err = Inline(in, Inline_config{MaxSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
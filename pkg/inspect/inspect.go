@@ -0,0 +1,386 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package inspect
+
+import (
+	"debug/dwarf"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+)
+
+type Inspect_config struct {
+	MaxDepth    int // How far to go into nested structs and arrays (0 for no limit)
+	MaxElements int // The most array or slice elements to show (0 for no limit)
+	MaxString   int // The most bytes of a string to show (0 for no limit)
+}
+
+/**
+ * Render the value at addr in memory, using its dwarf type.
+ * Structs, unions, arrays, enums, C strings, Go strings and slices, and Rust &str and slices are laid
+ * out as such. Other pointers are shown as addresses.
+ */
+func Format(mem []byte, addr uint64, ty dwarf.Type, config Inspect_config) (string, error) {
+	if ty == nil {
+		return "", errors.New("No type")
+	}
+	size := ty.Size()
+	if size < 0 {
+		size = 0
+	}
+	if addr+uint64(size) > uint64(len(mem)) {
+		return "", fmt.Errorf("Address %#x is outside memory", addr)
+	}
+	f := &formatter{mem: mem, config: config}
+	f.value(addr, ty, 0)
+	return f.b.String(), nil
+}
+
+// Render a dwarf global variable, found in GlobalAddresses
+func FormatGlobal(wd *debug.WasmDebug, mem []byte, name string, config Inspect_config) (string, error) {
+	g, ok := wd.GlobalAddresses[name]
+	if !ok {
+		return "", fmt.Errorf("Global %s not found", name)
+	}
+	if g.DwarfType == nil {
+		return "", fmt.Errorf("Global %s has no dwarf type", name)
+	}
+	return Format(mem, g.Address, g.DwarfType, config)
+}
+
+// Render the value at addr as a dwarf type, found by name
+func FormatType(wd *debug.WasmDebug, mem []byte, typeName string, addr uint64, config Inspect_config) (string, error) {
+	ty, err := wd.LookupType(typeName)
+	if err != nil {
+		return "", err
+	}
+	return Format(mem, addr, ty, config)
+}
+
+type formatter struct {
+	mem    []byte
+	config Inspect_config
+	b      strings.Builder
+}
+
+// Get part of memory, or nil if it's out of bounds
+func (f *formatter) bytes(addr uint64, size uint64) []byte {
+	if addr+size < addr || addr+size > uint64(len(f.mem)) {
+		return nil
+	}
+	return f.mem[addr : addr+size]
+}
+
+// Read a little endian number of up to 8 bytes
+func (f *formatter) uint(addr uint64, size int64) (uint64, bool) {
+	if size < 0 || size > 8 {
+		return 0, false
+	}
+	data := f.bytes(addr, uint64(size))
+	if data == nil {
+		return 0, false
+	}
+	v := uint64(0)
+	for i := len(data) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(data[i])
+	}
+	return v, true
+}
+
+func (f *formatter) int(addr uint64, size int64) (int64, bool) {
+	v, ok := f.uint(addr, size)
+	if !ok || size == 0 {
+		return 0, ok
+	}
+	shift := 64 - 8*size
+	return int64(v<<shift) >> shift, true
+}
+
+func (f *formatter) badAddress(addr uint64) {
+	fmt.Fprintf(&f.b, "<bad address %#x>", addr)
+}
+
+func (f *formatter) value(addr uint64, ty dwarf.Type, depth int) {
+	size := ty.Size()
+	switch t := underlyingType(ty).(type) {
+	case *dwarf.BoolType:
+		v, ok := f.uint(addr, size)
+		if !ok {
+			f.badAddress(addr)
+		} else {
+			f.b.WriteString(strconv.FormatBool(v != 0))
+		}
+	case *dwarf.CharType, *dwarf.IntType:
+		v, ok := f.int(addr, size)
+		if !ok {
+			f.badAddress(addr)
+		} else {
+			f.b.WriteString(strconv.FormatInt(v, 10))
+			f.char(t, v)
+		}
+	case *dwarf.UcharType, *dwarf.UintType:
+		v, ok := f.uint(addr, size)
+		if !ok {
+			f.badAddress(addr)
+		} else {
+			f.b.WriteString(strconv.FormatUint(v, 10))
+			f.char(t, int64(v))
+		}
+	case *dwarf.EnumType:
+		v, ok := f.int(addr, size)
+		if !ok {
+			f.badAddress(addr)
+			return
+		}
+		for _, ev := range t.Val {
+			if ev.Val == v {
+				f.b.WriteString(ev.Name)
+				return
+			}
+		}
+		f.b.WriteString(strconv.FormatInt(v, 10))
+	case *dwarf.FloatType:
+		v, ok := f.uint(addr, size)
+		if !ok {
+			f.badAddress(addr)
+		} else if size == 4 {
+			f.b.WriteString(strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32))
+		} else if size == 8 {
+			f.b.WriteString(strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64))
+		} else {
+			f.hex(addr, size)
+		}
+	case *dwarf.PtrType:
+		ptr, ok := f.uint(addr, size)
+		if !ok {
+			f.badAddress(addr)
+			return
+		}
+		fmt.Fprintf(&f.b, "%#x", ptr)
+		if ptr != 0 && t.Type != nil && isChar(t.Type) {
+			f.b.WriteString(" ")
+			f.cstring(ptr, -1)
+		}
+	case *dwarf.StructType:
+		f.structure(addr, t, depth)
+	case *dwarf.ArrayType:
+		if t.Count < 0 || t.Type == nil {
+			f.b.WriteString("[...]")
+		} else if isChar(t.Type) {
+			f.cstring(addr, t.Count)
+		} else {
+			f.list(addr, t.Type, t.Count, depth)
+		}
+	default:
+		f.hex(addr, size)
+	}
+}
+
+// Show a single byte character after its value, if it's printable
+func (f *formatter) char(ty dwarf.Type, v int64) {
+	if isChar(ty) && v >= 0x20 && v < 0x7f {
+		fmt.Fprintf(&f.b, " %q", rune(v))
+	}
+}
+
+func (f *formatter) hex(addr uint64, size int64) {
+	if size <= 0 {
+		f.b.WriteString("{}")
+		return
+	}
+	data := f.bytes(addr, uint64(size))
+	if data == nil {
+		f.badAddress(addr)
+		return
+	}
+	f.b.WriteString("{")
+	for i, v := range data {
+		if i > 0 {
+			f.b.WriteString(" ")
+		}
+		fmt.Fprintf(&f.b, "%02x", v)
+	}
+	f.b.WriteString("}")
+}
+
+/**
+ * Show a nul terminated string, reading no more than max bytes (-1 for no limit).
+ *
+ */
+func (f *formatter) cstring(addr uint64, max int64) {
+	if addr >= uint64(len(f.mem)) {
+		f.badAddress(addr)
+		return
+	}
+	data := f.mem[addr:]
+	if max >= 0 && int64(len(data)) > max {
+		data = data[:max]
+	}
+	for i, v := range data {
+		if v == 0 {
+			data = data[:i]
+			break
+		}
+	}
+	f.string(data)
+}
+
+func (f *formatter) string(data []byte) {
+	truncated := false
+	if f.config.MaxString > 0 && len(data) > f.config.MaxString {
+		data = data[:f.config.MaxString]
+		truncated = true
+	}
+	f.b.WriteString(strconv.Quote(string(data)))
+	if truncated {
+		f.b.WriteString("...")
+	}
+}
+
+func (f *formatter) list(addr uint64, elem dwarf.Type, count int64, depth int) {
+	if f.config.MaxDepth > 0 && depth >= f.config.MaxDepth {
+		f.b.WriteString("[...]")
+		return
+	}
+	esize := elem.Size()
+	if esize < 0 {
+		f.badAddress(addr)
+		return
+	}
+	// A length that's been overwritten shouldn't be looped over
+	limit := uint64(len(f.mem))
+	if esize > 0 {
+		limit = limit / uint64(esize)
+	}
+	if uint64(count) > limit || f.bytes(addr, uint64(count)*uint64(esize)) == nil {
+		f.badAddress(addr)
+		return
+	}
+	f.b.WriteString("[")
+	for i := int64(0); i < count; i++ {
+		if i > 0 {
+			f.b.WriteString(", ")
+		}
+		if f.config.MaxElements > 0 && i == int64(f.config.MaxElements) {
+			f.b.WriteString("...")
+			break
+		}
+		f.value(addr+uint64(i*esize), elem, depth+1)
+	}
+	f.b.WriteString("]")
+}
+
+func (f *formatter) structure(addr uint64, st *dwarf.StructType, depth int) {
+	if st.Incomplete {
+		f.b.WriteString("{...}")
+		return
+	}
+
+	if ptr, length, ok := f.header(addr, st); ok {
+		pt := underlyingType(ptr.Type).(*dwarf.PtrType)
+		data, _ := f.uint(addr+uint64(ptr.ByteOffset), ptr.Type.Size())
+		if pt.Type == nil {
+			fmt.Fprintf(&f.b, "%#x", data)
+		} else if st.StructName == "string" || st.StructName == "&str" || (isChar(pt.Type) && !strings.HasPrefix(st.StructName, "[]")) {
+			b := f.bytes(data, length)
+			if b == nil {
+				f.badAddress(data)
+			} else {
+				f.string(b)
+			}
+		} else {
+			f.list(data, pt.Type, int64(length), depth)
+		}
+		return
+	}
+
+	if f.config.MaxDepth > 0 && depth >= f.config.MaxDepth {
+		f.b.WriteString("{...}")
+		return
+	}
+	f.b.WriteString("{")
+	for i, field := range st.Field {
+		if i > 0 {
+			f.b.WriteString(", ")
+		}
+		if field.Name != "" {
+			f.b.WriteString(field.Name)
+			f.b.WriteString(": ")
+		}
+		if field.BitSize != 0 {
+			// Bit fields aren't laid out the same way by every compiler
+			f.b.WriteString("?")
+			continue
+		}
+		f.value(addr+uint64(field.ByteOffset), field.Type, depth+1)
+	}
+	f.b.WriteString("}")
+}
+
+/**
+ * Find the data pointer and length of a string or slice header. These are Go strings and slices,
+ * and Rust &str and slices.
+ */
+func (f *formatter) header(addr uint64, st *dwarf.StructType) (*dwarf.StructField, uint64, bool) {
+	var ptr, length *dwarf.StructField
+	switch {
+	case st.StructName == "string" && len(st.Field) == 2 && st.Field[0].Name == "str" && st.Field[1].Name == "len":
+		ptr, length = st.Field[0], st.Field[1]
+	case strings.HasPrefix(st.StructName, "[]") && len(st.Field) == 3 && st.Field[0].Name == "array" && st.Field[1].Name == "len":
+		ptr, length = st.Field[0], st.Field[1]
+	case strings.HasPrefix(st.StructName, "&") && len(st.Field) == 2 && st.Field[0].Name == "data_ptr" && st.Field[1].Name == "length":
+		ptr, length = st.Field[0], st.Field[1]
+	default:
+		return nil, 0, false
+	}
+	if _, ok := underlyingType(ptr.Type).(*dwarf.PtrType); !ok {
+		return nil, 0, false
+	}
+	n, ok := f.uint(addr+uint64(length.ByteOffset), length.Type.Size())
+	if !ok {
+		return nil, 0, false
+	}
+	return ptr, n, true
+}
+
+// Remove typedefs and const/volatile
+func underlyingType(ty dwarf.Type) dwarf.Type {
+	for {
+		if t, ok := ty.(*dwarf.TypedefType); ok {
+			ty = t.Type
+		} else if t, ok := ty.(*dwarf.QualType); ok {
+			ty = t.Type
+		} else {
+			return ty
+		}
+	}
+}
+
+// Is this a single byte character
+func isChar(ty dwarf.Type) bool {
+	switch t := underlyingType(ty).(type) {
+	case *dwarf.CharType:
+		return t.Size() == 1
+	case *dwarf.UcharType:
+		return t.Size() == 1
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package inspect
+
+import (
+	"debug/dwarf"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/stretchr/testify/assert"
+)
+
+func basic(name string, size int64) dwarf.BasicType {
+	return dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: size, Name: name}}
+}
+
+var (
+	i32     = &dwarf.IntType{BasicType: basic("int", 4)}
+	i64     = &dwarf.IntType{BasicType: basic("int", 8)}
+	u8      = &dwarf.UintType{BasicType: basic("uint8", 1)}
+	char    = &dwarf.CharType{BasicType: basic("char", 1)}
+	f64     = &dwarf.FloatType{BasicType: basic("double", 8)}
+	boolean = &dwarf.BoolType{BasicType: basic("bool", 1)}
+	charPtr = &dwarf.PtrType{CommonType: dwarf.CommonType{ByteSize: 4}, Type: char}
+)
+
+func TestFormat(t *testing.T) {
+	mem := make([]byte, 256)
+	binary.LittleEndian.PutUint32(mem[0:], 0xfffffffe)
+	binary.LittleEndian.PutUint64(mem[8:], math.Float64bits(1.5))
+	mem[16] = 1
+	copy(mem[32:], "hello\x00")
+	binary.LittleEndian.PutUint32(mem[40:], 32)
+
+	conf := Inspect_config{}
+	check := func(addr uint64, ty dwarf.Type, expected string) {
+		s, err := Format(mem, addr, ty, conf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, s)
+	}
+
+	check(0, i32, "-2")
+	check(0, &dwarf.UintType{BasicType: basic("unsigned int", 4)}, "4294967294")
+	check(8, f64, "1.5")
+	check(16, boolean, "true")
+	check(32, char, "104 'h'")
+	check(40, charPtr, `0x20 "hello"`)
+	check(40, &dwarf.TypedefType{CommonType: dwarf.CommonType{Name: "name_t"}, Type: charPtr}, `0x20 "hello"`)
+
+	// char arrays are strings, up to the nul
+	check(32, &dwarf.ArrayType{CommonType: dwarf.CommonType{ByteSize: 8}, Type: char, Count: 8}, `"hello"`)
+	check(32, &dwarf.ArrayType{CommonType: dwarf.CommonType{ByteSize: 3}, Type: char, Count: 3}, `"hel"`)
+
+	colour := &dwarf.EnumType{CommonType: dwarf.CommonType{ByteSize: 4}, Val: []*dwarf.EnumValue{{Name: "RED", Val: 1}, {Name: "BLUE", Val: -2}}}
+	check(0, colour, "BLUE")
+
+	// Structs and arrays nest
+	point := &dwarf.StructType{CommonType: dwarf.CommonType{ByteSize: 8}, StructName: "point", Kind: "struct", Field: []*dwarf.StructField{
+		{Name: "x", Type: i32, ByteOffset: 0},
+		{Name: "y", Type: i32, ByteOffset: 4},
+	}}
+	binary.LittleEndian.PutUint32(mem[64:], 1)
+	binary.LittleEndian.PutUint32(mem[68:], 2)
+	binary.LittleEndian.PutUint32(mem[72:], 3)
+	binary.LittleEndian.PutUint32(mem[76:], 4)
+	check(64, point, "{x: 1, y: 2}")
+	line := &dwarf.ArrayType{CommonType: dwarf.CommonType{ByteSize: 16}, Type: point, Count: 2}
+	check(64, line, "[{x: 1, y: 2}, {x: 3, y: 4}]")
+
+	conf = Inspect_config{MaxDepth: 1, MaxElements: 1, MaxString: 3}
+	check(64, line, "[{...}, ...]")
+	check(32, &dwarf.ArrayType{CommonType: dwarf.CommonType{ByteSize: 8}, Type: char, Count: 8}, `"hel"...`)
+	conf = Inspect_config{}
+
+	// Outside memory
+	_, err := Format(mem, 252, i64, conf)
+	assert.Error(t, err)
+}
+
+func TestFormatHeaders(t *testing.T) {
+	mem := make([]byte, 256)
+	u8Ptr := &dwarf.PtrType{CommonType: dwarf.CommonType{ByteSize: 8}, Type: u8}
+	i64Ptr := &dwarf.PtrType{CommonType: dwarf.CommonType{ByteSize: 8}, Type: i64}
+
+	// Go string
+	str := &dwarf.StructType{CommonType: dwarf.CommonType{ByteSize: 16}, StructName: "string", Kind: "struct", Field: []*dwarf.StructField{
+		{Name: "str", Type: u8Ptr, ByteOffset: 0},
+		{Name: "len", Type: i64, ByteOffset: 8},
+	}}
+	copy(mem[128:], "gopher")
+	binary.LittleEndian.PutUint64(mem[0:], 128)
+	binary.LittleEndian.PutUint64(mem[8:], 6)
+	s, err := Format(mem, 0, str, Inspect_config{})
+	assert.NoError(t, err)
+	assert.Equal(t, `"gopher"`, s)
+
+	// Go slice
+	slice := &dwarf.StructType{CommonType: dwarf.CommonType{ByteSize: 24}, StructName: "[]int", Kind: "struct", Field: []*dwarf.StructField{
+		{Name: "array", Type: i64Ptr, ByteOffset: 0},
+		{Name: "len", Type: i64, ByteOffset: 8},
+		{Name: "cap", Type: i64, ByteOffset: 16},
+	}}
+	binary.LittleEndian.PutUint64(mem[32:], 160)
+	binary.LittleEndian.PutUint64(mem[40:], 3)
+	binary.LittleEndian.PutUint64(mem[48:], 4)
+	binary.LittleEndian.PutUint64(mem[160:], 7)
+	binary.LittleEndian.PutUint64(mem[168:], 8)
+	binary.LittleEndian.PutUint64(mem[176:], math.MaxUint64)
+	s, err = Format(mem, 32, slice, Inspect_config{})
+	assert.NoError(t, err)
+	assert.Equal(t, "[7, 8, -1]", s)
+
+	// A struct holding them, with a length that's garbage
+	holder := &dwarf.StructType{CommonType: dwarf.CommonType{ByteSize: 40}, StructName: "main.T", Kind: "struct", Field: []*dwarf.StructField{
+		{Name: "Name", Type: str, ByteOffset: 0},
+		{Name: "Values", Type: slice, ByteOffset: 16},
+	}}
+	copy(mem[16:], mem[32:56])
+	binary.LittleEndian.PutUint64(mem[24:], 1<<40)
+	s, err = Format(mem, 0, holder, Inspect_config{})
+	assert.NoError(t, err)
+	assert.Equal(t, `{Name: "gopher", Values: <bad address 0xa0>}`, s)
+}
+
+func TestFormatGlobal(t *testing.T) {
+	mem := make([]byte, 64)
+	binary.LittleEndian.PutUint32(mem[16:], 42)
+	wd := debug.NewEmpty()
+	wd.GlobalAddresses["counter"] = &debug.GlobalNameData{Name: "counter", Address: 16, Size: 4, Type: "int", DwarfType: i32}
+	wd.GlobalAddresses["untyped"] = &debug.GlobalNameData{Name: "untyped", Address: 16, Size: 4, Type: "int"}
+
+	s, err := FormatGlobal(wd, mem, "counter", Inspect_config{})
+	assert.NoError(t, err)
+	assert.Equal(t, "42", s)
+
+	_, err = FormatGlobal(wd, mem, "untyped", Inspect_config{})
+	assert.Error(t, err)
+	_, err = FormatGlobal(wd, mem, "missing", Inspect_config{})
+	assert.Error(t, err)
+	_, err = FormatType(wd, mem, "int", 16, Inspect_config{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,486 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package interp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+var (
+	opBlock = expression.InstrToOpcode["block"]
+	opLoop  = expression.InstrToOpcode["loop"]
+	opIf    = expression.InstrToOpcode["if"]
+	opElse  = expression.InstrToOpcode["else"]
+	opEnd   = expression.InstrToOpcode["end"]
+)
+
+// Where the blocks of a function end, worked out the first time it's called
+type codeInfo struct {
+	end    []int // For block, loop, if and else, the index of the matching end
+	elseAt []int // For if, the index of its else, or -1
+}
+
+func newCodeInfo(code []*expression.Expression) *codeInfo {
+	ci := &codeInfo{
+		end:    make([]int, len(code)),
+		elseAt: make([]int, len(code)),
+	}
+	open := make([]int, 0)
+	for i, e := range code {
+		// A block that isn't closed runs to the end of the function
+		ci.end[i] = len(code)
+		ci.elseAt[i] = -1
+		switch e.Opcode {
+		case opBlock, opLoop, opIf:
+			open = append(open, i)
+		case opElse:
+			if len(open) > 0 {
+				ci.elseAt[open[len(open)-1]] = i
+			}
+		case opEnd:
+			if len(open) > 0 {
+				b := open[len(open)-1]
+				open = open[:len(open)-1]
+				ci.end[b] = i
+				if ci.elseAt[b] != -1 {
+					ci.end[ci.elseAt[b]] = i
+				}
+			}
+		}
+	}
+	return ci
+}
+
+/**
+ * Run a single instruction of the current call. A call into the module is one step, and so is
+ * a call to an import. Once a call traps or exits, Step keeps returning that error.
+ */
+func (m *Machine) Step() (err error) {
+	if m.err != nil {
+		return m.err
+	}
+	if len(m.frames) == 0 {
+		return errors.New("Nothing is running")
+	}
+	f := m.frames[len(m.frames)-1]
+	if f.pc >= len(f.code) {
+		// Running off the end of the code is the same as its final end
+		m.doReturn(f)
+		return nil
+	}
+	e := f.code[f.pc]
+	f.pc++
+	m.steps++
+
+	// Code that doesn't validate can take too much off the stack, or use locals that don't exist
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = m.located(trap("malformed code: %v", r), f, e)
+		}
+	}()
+
+	var op opFunc
+	if e.Opcode == expression.ExtendedOpcodeFC {
+		op = opsFC[e.OpcodeExt]
+	} else {
+		op = ops[e.Opcode]
+	}
+	if op == nil {
+		err = trap("%s isn't supported", e.Name())
+	} else {
+		err = op(m, f, e)
+	}
+	if err != nil {
+		return m.located(err, f, e)
+	}
+	return nil
+}
+
+// Fill in where a trap happened, and stop the call
+func (m *Machine) located(err error, f *frame, e *expression.Expression) error {
+	var t *Trap
+	if errors.As(err, &t) && !t.located {
+		t.Function = f.fid
+		t.PC = e.PC
+		t.located = true
+	}
+	m.err = err
+	return err
+}
+
+func (m *Machine) push(v uint64) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *Machine) pop() uint64 {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+func (m *Machine) pushFrame(fid int) error {
+	if len(m.frames) >= m.config.MaxDepth {
+		return trap("call stack exhausted")
+	}
+	te, err := m.functionType(fid)
+	if err != nil {
+		return err
+	}
+	idx := fid - len(m.wf.Import)
+	c := m.wf.Code[idx]
+	if m.code[idx] == nil {
+		m.code[idx] = newCodeInfo(c.Expression)
+	}
+
+	np := len(te.Param)
+	base := len(m.stack) - np
+	locals := make([]uint64, np+len(c.Locals))
+	copy(locals, m.stack[base:])
+	m.stack = m.stack[:base]
+
+	f := &frame{
+		fid:     fid,
+		code:    c.Expression,
+		info:    m.code[idx],
+		locals:  locals,
+		labels:  make([]label, 1, 8),
+		base:    base,
+		results: len(te.Result),
+	}
+	f.labels[0] = label{arity: f.results, height: base, fn: true}
+	m.frames = append(m.frames, f)
+	return nil
+}
+
+// Return from a function, leaving just its results on the stack
+func (m *Machine) doReturn(f *frame) {
+	copy(m.stack[f.base:], m.stack[len(m.stack)-f.results:])
+	m.stack = m.stack[:f.base+f.results]
+	m.frames = m.frames[:len(m.frames)-1]
+	if len(m.frames) == 0 {
+		m.results = append([]uint64{}, m.stack...)
+	}
+}
+
+func (m *Machine) branch(f *frame, depth int) {
+	l := f.labels[len(f.labels)-1-depth]
+	if l.fn {
+		m.doReturn(f)
+		return
+	}
+	copy(m.stack[l.height:], m.stack[len(m.stack)-l.arity:])
+	m.stack = m.stack[:l.height+l.arity]
+	if l.loop {
+		f.labels = f.labels[:len(f.labels)-depth]
+	} else {
+		f.labels = f.labels[:len(f.labels)-1-depth]
+	}
+	f.pc = l.cont
+}
+
+func (m *Machine) blockArity(e *expression.Expression) (int, int) {
+	if e.TypedBlock {
+		te := m.wf.Type[e.TypeIndex]
+		return len(te.Param), len(te.Result)
+	}
+	if e.Result == types.ValNone || e.Result == 0 {
+		return 0, 0
+	}
+	return 0, 1
+}
+
+func (m *Machine) call(fid int) error {
+	if fid >= len(m.wf.Import) {
+		return m.pushFrame(fid)
+	}
+	te, err := m.functionType(fid)
+	if err != nil {
+		return err
+	}
+	n := len(te.Param)
+	params := append([]uint64{}, m.stack[len(m.stack)-n:]...)
+	m.stack = m.stack[:len(m.stack)-n]
+	results, err := m.callHost(fid, params)
+	if err != nil {
+		return err
+	}
+	m.stack = append(m.stack, results...)
+	return nil
+}
+
+func (m *Machine) callHost(fid int, params []uint64) ([]uint64, error) {
+	te, err := m.functionType(fid)
+	if err != nil {
+		return nil, err
+	}
+	results, err := m.host[fid](m, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(te.Result) {
+		imp := m.wf.Import[fid]
+		return nil, fmt.Errorf("Import %s:%s gave %d results, not %d", imp.Module, imp.Name, len(results), len(te.Result))
+	}
+	return results, nil
+}
+
+// Get the memory an access uses, or trap if it's out of bounds
+func (m *Machine) access(e *expression.Expression, size uint64) ([]byte, error) {
+	addr := uint64(uint32(m.pop())) + uint64(e.MemOffset)
+	if addr+size > uint64(len(m.memory)) {
+		return nil, trap("out of bounds memory access")
+	}
+	return m.memory[addr : addr+size], nil
+}
+
+type opFunc func(m *Machine, f *frame, e *expression.Expression) error
+
+var ops [256]opFunc
+var opsFC = make(map[int]opFunc)
+
+func define(name string, fn opFunc) {
+	info := expression.LookupOpcode(name)
+	if info.Opcode == expression.ExtendedOpcodeFC {
+		opsFC[info.OpcodeExt] = fn
+	} else {
+		ops[info.Opcode] = fn
+	}
+}
+
+func load(name string, size uint64, fn func(b []byte) uint64) {
+	define(name, func(m *Machine, f *frame, e *expression.Expression) error {
+		b, err := m.access(e, size)
+		if err != nil {
+			return err
+		}
+		m.push(fn(b))
+		return nil
+	})
+}
+
+func store(name string, size uint64, fn func(b []byte, v uint64)) {
+	define(name, func(m *Machine, f *frame, e *expression.Expression) error {
+		v := m.pop()
+		b, err := m.access(e, size)
+		if err != nil {
+			return err
+		}
+		fn(b, v)
+		return nil
+	})
+}
+
+func init() {
+	define("unreachable", func(m *Machine, f *frame, e *expression.Expression) error {
+		return trap("unreachable")
+	})
+	define("nop", func(m *Machine, f *frame, e *expression.Expression) error {
+		return nil
+	})
+	define("block", func(m *Machine, f *frame, e *expression.Expression) error {
+		params, results := m.blockArity(e)
+		f.labels = append(f.labels, label{arity: results, height: len(m.stack) - params, cont: f.info.end[f.pc-1] + 1})
+		return nil
+	})
+	define("loop", func(m *Machine, f *frame, e *expression.Expression) error {
+		params, _ := m.blockArity(e)
+		f.labels = append(f.labels, label{arity: params, height: len(m.stack) - params, cont: f.pc, loop: true})
+		return nil
+	})
+	define("if", func(m *Machine, f *frame, e *expression.Expression) error {
+		c := m.pop()
+		params, results := m.blockArity(e)
+		idx := f.pc - 1
+		f.labels = append(f.labels, label{arity: results, height: len(m.stack) - params, cont: f.info.end[idx] + 1})
+		if c == 0 {
+			if f.info.elseAt[idx] != -1 {
+				f.pc = f.info.elseAt[idx] + 1
+			} else {
+				// The end takes the label off again
+				f.pc = f.info.end[idx]
+			}
+		}
+		return nil
+	})
+	define("else", func(m *Machine, f *frame, e *expression.Expression) error {
+		// Only reached at the end of the then branch
+		f.labels = f.labels[:len(f.labels)-1]
+		f.pc = f.info.end[f.pc-1] + 1
+		return nil
+	})
+	define("end", func(m *Machine, f *frame, e *expression.Expression) error {
+		l := f.labels[len(f.labels)-1]
+		f.labels = f.labels[:len(f.labels)-1]
+		if l.fn {
+			m.doReturn(f)
+		}
+		return nil
+	})
+	define("br", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.branch(f, e.LabelIndex)
+		return nil
+	})
+	define("br_if", func(m *Machine, f *frame, e *expression.Expression) error {
+		if m.pop() != 0 {
+			m.branch(f, e.LabelIndex)
+		}
+		return nil
+	})
+	define("br_table", func(m *Machine, f *frame, e *expression.Expression) error {
+		i := uint32(m.pop())
+		if uint64(i) < uint64(len(e.Labels)) {
+			m.branch(f, e.Labels[i])
+		} else {
+			m.branch(f, e.LabelIndex)
+		}
+		return nil
+	})
+	define("return", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.doReturn(f)
+		return nil
+	})
+	define("call", func(m *Machine, f *frame, e *expression.Expression) error {
+		return m.call(e.FuncIndex)
+	})
+	define("call_indirect", func(m *Machine, f *frame, e *expression.Expression) error {
+		i := uint32(m.pop())
+		if uint64(i) >= uint64(len(m.table)) {
+			return trap("undefined element %d", i)
+		}
+		fid := m.table[i]
+		if fid == -1 {
+			return trap("uninitialized element %d", i)
+		}
+		te, err := m.functionType(fid)
+		if err != nil {
+			return err
+		}
+		if !te.Equals(m.wf.Type[e.TypeIndex]) {
+			return trap("indirect call type mismatch")
+		}
+		return m.call(fid)
+	})
+
+	define("drop", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.pop()
+		return nil
+	})
+	define("select", func(m *Machine, f *frame, e *expression.Expression) error {
+		c := m.pop()
+		b := m.pop()
+		a := m.pop()
+		if c != 0 {
+			m.push(a)
+		} else {
+			m.push(b)
+		}
+		return nil
+	})
+
+	define("local.get", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.push(f.locals[e.LocalIndex])
+		return nil
+	})
+	define("local.set", func(m *Machine, f *frame, e *expression.Expression) error {
+		f.locals[e.LocalIndex] = m.pop()
+		return nil
+	})
+	define("local.tee", func(m *Machine, f *frame, e *expression.Expression) error {
+		f.locals[e.LocalIndex] = m.stack[len(m.stack)-1]
+		return nil
+	})
+	define("global.get", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.push(m.globals[e.GlobalIndex])
+		return nil
+	})
+	define("global.set", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.globals[e.GlobalIndex] = m.pop()
+		return nil
+	})
+
+	le := binary.LittleEndian
+	load("i32.load", 4, func(b []byte) uint64 { return uint64(le.Uint32(b)) })
+	load("i64.load", 8, func(b []byte) uint64 { return le.Uint64(b) })
+	load("f32.load", 4, func(b []byte) uint64 { return uint64(le.Uint32(b)) })
+	load("f64.load", 8, func(b []byte) uint64 { return le.Uint64(b) })
+	load("i32.load8_s", 1, func(b []byte) uint64 { return uint64(uint32(int8(b[0]))) })
+	load("i32.load8_u", 1, func(b []byte) uint64 { return uint64(b[0]) })
+	load("i32.load16_s", 2, func(b []byte) uint64 { return uint64(uint32(int16(le.Uint16(b)))) })
+	load("i32.load16_u", 2, func(b []byte) uint64 { return uint64(le.Uint16(b)) })
+	load("i64.load8_s", 1, func(b []byte) uint64 { return uint64(int8(b[0])) })
+	load("i64.load8_u", 1, func(b []byte) uint64 { return uint64(b[0]) })
+	load("i64.load16_s", 2, func(b []byte) uint64 { return uint64(int16(le.Uint16(b))) })
+	load("i64.load16_u", 2, func(b []byte) uint64 { return uint64(le.Uint16(b)) })
+	load("i64.load32_s", 4, func(b []byte) uint64 { return uint64(int32(le.Uint32(b))) })
+	load("i64.load32_u", 4, func(b []byte) uint64 { return uint64(le.Uint32(b)) })
+	store("i32.store", 4, func(b []byte, v uint64) { le.PutUint32(b, uint32(v)) })
+	store("i64.store", 8, func(b []byte, v uint64) { le.PutUint64(b, v) })
+	store("f32.store", 4, func(b []byte, v uint64) { le.PutUint32(b, uint32(v)) })
+	store("f64.store", 8, func(b []byte, v uint64) { le.PutUint64(b, v) })
+	store("i32.store8", 1, func(b []byte, v uint64) { b[0] = byte(v) })
+	store("i32.store16", 2, func(b []byte, v uint64) { le.PutUint16(b, uint16(v)) })
+	store("i64.store8", 1, func(b []byte, v uint64) { b[0] = byte(v) })
+	store("i64.store16", 2, func(b []byte, v uint64) { le.PutUint16(b, uint16(v)) })
+	store("i64.store32", 4, func(b []byte, v uint64) { le.PutUint32(b, uint32(v)) })
+
+	define("memory.size", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.push(uint64(len(m.memory) / pageSize))
+		return nil
+	})
+	define("memory.grow", func(m *Machine, f *frame, e *expression.Expression) error {
+		n := uint64(uint32(m.pop()))
+		old := uint64(len(m.memory) / pageSize)
+		if old+n > uint64(m.memMax) {
+			m.push(uint64(uint32(0xffffffff)))
+			return nil
+		}
+		m.memory = append(m.memory, make([]byte, n*pageSize)...)
+		m.push(old)
+		return nil
+	})
+	define("memory.fill", func(m *Machine, f *frame, e *expression.Expression) error {
+		n := uint64(uint32(m.pop()))
+		v := byte(m.pop())
+		d := uint64(uint32(m.pop()))
+		if d+n > uint64(len(m.memory)) {
+			return trap("out of bounds memory access")
+		}
+		b := m.memory[d : d+n]
+		for i := range b {
+			b[i] = v
+		}
+		return nil
+	})
+	define("memory.copy", func(m *Machine, f *frame, e *expression.Expression) error {
+		n := uint64(uint32(m.pop()))
+		s := uint64(uint32(m.pop()))
+		d := uint64(uint32(m.pop()))
+		if s+n > uint64(len(m.memory)) || d+n > uint64(len(m.memory)) {
+			return trap("out of bounds memory access")
+		}
+		copy(m.memory[d:d+n], m.memory[s:s+n])
+		return nil
+	})
+
+	defineNumeric()
+}
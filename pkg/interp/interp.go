@@ -0,0 +1,420 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package interp
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+const pageSize = 65536
+
+// The call depth allowed when none is given
+const DefaultMaxDepth = 10000
+
+// A function the host provides for an import. Values are passed as their bits, eg an f32 is math.Float32bits.
+type HostFunc func(m *Machine, params []uint64) ([]uint64, error)
+
+type Interp_config struct {
+	Args     []string
+	Env      []string // eg "HOME=/"
+	Stdin    io.Reader
+	Stdout   io.Writer
+	Stderr   io.Writer
+	Random   io.Reader            // Source for random_get. Defaults to crypto/rand
+	Imports  map[string]HostFunc  // Host functions by module:name. These are used before the WASI shims
+	MaxDepth int                  // Calls deeper than this trap. Defaults to DefaultMaxDepth
+	Record   func(call *WasiCall) // Called after each WASI call, with what it was given and did
+	Replay   []*WasiCall          // WASI calls are answered from this log, in order, until it runs out
+}
+
+// A trap stops the code running. It says which function and instruction it happened at.
+type Trap struct {
+	Message  string
+	Function int
+	PC       uint64
+
+	located bool
+}
+
+func (t *Trap) Error() string {
+	return fmt.Sprintf("wasm trap: %s (function %d, PC %d)", t.Message, t.Function, t.PC)
+}
+
+func trap(format string, args ...interface{}) error {
+	return &Trap{Message: fmt.Sprintf(format, args...)}
+}
+
+// Returned when the module calls proc_exit
+type ExitError struct {
+	Code uint32
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit code %d", e.Code)
+}
+
+// Where a call currently is
+type Frame struct {
+	Function int
+	PC       uint64 // PC of the next instruction, or of the end of the function once it has all run. For a caller, the PC of the call.
+}
+
+// A label on the control stack of a function
+type label struct {
+	arity  int  // The number of values a branch to it takes
+	height int  // The stack height below the params of the block
+	cont   int  // The instruction a branch carries on at
+	loop   bool // A branch to a loop goes back to the start, and keeps the label
+	fn     bool // The label of the function body. A branch to it returns
+}
+
+type frame struct {
+	fid     int
+	code    []*expression.Expression
+	info    *codeInfo
+	pc      int // Index of the next instruction
+	locals  []uint64
+	labels  []label
+	base    int // The stack height the function started at, after its params were taken
+	results int
+}
+
+type Machine struct {
+	wf      *wasmfile.WasmFile
+	config  Interp_config
+	memory  []byte
+	memMax  int // In pages
+	globals []uint64
+	table   []int // Function index of each table entry, or -1
+	host    []HostFunc
+
+	stack   []uint64
+	frames  []*frame
+	code    []*codeInfo
+	results []uint64
+	err     error // Once a call has trapped or exited, this is returned by Step
+	steps   uint64
+
+	wasiCalls int
+	touched   []touched // Memory given to a WASI call while it's being recorded
+}
+
+/**
+ * Instantiate a module to run in the interpreter. Memory, globals, the table and data are set up,
+ * and every import must be provided, either by config.Imports or by the WASI shims.
+ * The module must have its names resolved, as it would for EncodeBinary.
+ */
+func New(wf *wasmfile.WasmFile, config Interp_config) (*Machine, error) {
+	if config.MaxDepth == 0 {
+		config.MaxDepth = DefaultMaxDepth
+	}
+	if config.Stdout == nil {
+		config.Stdout = io.Discard
+	}
+	if config.Stderr == nil {
+		config.Stderr = io.Discard
+	}
+	if config.Random == nil {
+		config.Random = rand.Reader
+	}
+
+	m := &Machine{
+		wf:     wf,
+		config: config,
+		code:   make([]*codeInfo, len(wf.Code)),
+	}
+
+	if len(wf.Function) != len(wf.Code) {
+		return nil, fmt.Errorf("The module has %d functions but %d code entries", len(wf.Function), len(wf.Code))
+	}
+
+	for _, imp := range wf.Import {
+		if imp.Type != types.ExportFunc {
+			return nil, fmt.Errorf("Import %s:%s isn't a function, which isn't supported atm", imp.Module, imp.Name)
+		}
+		if imp.Index < 0 || imp.Index >= len(wf.Type) {
+			return nil, fmt.Errorf("Import %s:%s has an invalid type %d", imp.Module, imp.Name, imp.Index)
+		}
+		fn, ok := config.Imports[imp.Module+":"+imp.Name]
+		if !ok && imp.Module == "wasi_snapshot_preview1" {
+			fn, ok = wasiFunction(imp.Name)
+		}
+		if !ok {
+			return nil, fmt.Errorf("Import %s:%s isn't provided", imp.Module, imp.Name)
+		}
+		if imp.Module == "wasi_snapshot_preview1" && (config.Record != nil || config.Replay != nil) {
+			fn = recordWasi(imp.Name, fn)
+		}
+		m.host = append(m.host, fn)
+	}
+
+	if len(wf.Memory) > 1 {
+		return nil, errors.New("Only modules with a single memory are supported")
+	}
+	m.memMax = pageSize
+	if len(wf.Memory) == 1 {
+		m.memory = make([]byte, wf.Memory[0].LimitMin*pageSize)
+		if wf.Memory[0].LimitMax != 0 {
+			m.memMax = wf.Memory[0].LimitMax
+		}
+	}
+
+	for idx, g := range wf.Global {
+		v, err := m.evalConst(g.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("Global %d: %w", idx, err)
+		}
+		m.globals = append(m.globals, v)
+	}
+
+	if len(wf.Table) > 1 {
+		return nil, errors.New("Only modules with a single table are supported")
+	}
+	if len(wf.Table) == 1 {
+		m.table = make([]int, wf.Table[0].LimitMin)
+		for i := range m.table {
+			m.table[i] = -1
+		}
+	}
+	for idx, el := range wf.Elem {
+		v, err := m.evalConst(el.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("Elem %d: %w", idx, err)
+		}
+		offset := uint64(uint32(v))
+		if offset+uint64(len(el.Indexes)) > uint64(len(m.table)) {
+			return nil, fmt.Errorf("Elem %d doesn't fit in the table", idx)
+		}
+		for i, fid := range el.Indexes {
+			m.table[offset+uint64(i)] = int(fid)
+		}
+	}
+
+	for idx, d := range wf.Data {
+		v, err := m.evalConst(d.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("Data %d: %w", idx, err)
+		}
+		offset := uint64(uint32(v))
+		if offset+uint64(len(d.Data)) > uint64(len(m.memory)) {
+			return nil, fmt.Errorf("Data %d doesn't fit in memory", idx)
+		}
+		copy(m.memory[offset:], d.Data)
+	}
+
+	return m, nil
+}
+
+// Evaluate a constant expression, as used for global initializers and segment offsets
+func (m *Machine) evalConst(exp []*expression.Expression) (uint64, error) {
+	vals := make([]uint64, 0)
+	for _, e := range exp {
+		switch e.Opcode {
+		case expression.InstrToOpcode["i32.const"]:
+			vals = append(vals, uint64(uint32(e.I32Value)))
+		case expression.InstrToOpcode["i64.const"]:
+			vals = append(vals, uint64(e.I64Value))
+		case expression.InstrToOpcode["f32.const"]:
+			vals = append(vals, uint64(math.Float32bits(e.F32Value)))
+		case expression.InstrToOpcode["f64.const"]:
+			vals = append(vals, math.Float64bits(e.F64Value))
+		case expression.InstrToOpcode["global.get"]:
+			if e.GlobalIndex < 0 || e.GlobalIndex >= len(m.globals) {
+				return 0, fmt.Errorf("Global %d isn't set yet", e.GlobalIndex)
+			}
+			vals = append(vals, m.globals[e.GlobalIndex])
+		case expression.InstrToOpcode["end"]:
+		default:
+			return 0, fmt.Errorf("%s isn't supported in a constant expression", e.Name())
+		}
+	}
+	if len(vals) != 1 {
+		return 0, fmt.Errorf("Constant expression gives %d values", len(vals))
+	}
+	return vals[0], nil
+}
+
+// Look up an exported function
+func (m *Machine) exportedFunction(name string) (int, error) {
+	for _, e := range m.wf.Export {
+		if e.Name == name && e.Type == types.ExportFunc {
+			return e.Index, nil
+		}
+	}
+	return -1, fmt.Errorf("The module doesn't export a function %s", name)
+}
+
+/**
+ * Call an exported function, and run it to completion.
+ *
+ */
+func (m *Machine) Call(name string, params ...uint64) ([]uint64, error) {
+	fid, err := m.exportedFunction(name)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Start(fid, params)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Run()
+	if err != nil {
+		return nil, err
+	}
+	return m.Results(), nil
+}
+
+/**
+ * Set up a call to a function without running any of it, so it can be single stepped with Step.
+ * Anything left over from a previous call is thrown away, but memory and globals are kept.
+ */
+func (m *Machine) Start(fid int, params []uint64) error {
+	te, err := m.functionType(fid)
+	if err != nil {
+		return err
+	}
+	if len(params) != len(te.Param) {
+		return fmt.Errorf("Function %d takes %d params, not %d", fid, len(te.Param), len(params))
+	}
+
+	m.stack = append(m.stack[:0], params...)
+	m.frames = m.frames[:0]
+	m.results = nil
+	m.err = nil
+
+	if fid < len(m.wf.Import) {
+		// Nothing to step through, so just call it
+		results, err := m.callHost(fid, params)
+		if err != nil {
+			m.err = err
+			return nil
+		}
+		m.results = results
+		return nil
+	}
+	return m.pushFrame(fid)
+}
+
+/**
+ * Run the current call until it finishes, traps or exits.
+ *
+ */
+func (m *Machine) Run() error {
+	for !m.Done() {
+		err := m.Step()
+		if err != nil {
+			return err
+		}
+	}
+	return m.err
+}
+
+// True once the current call has finished, trapped or exited
+func (m *Machine) Done() bool {
+	return len(m.frames) == 0 || m.err != nil
+}
+
+// The results of the last call, once it's done
+func (m *Machine) Results() []uint64 {
+	return m.results
+}
+
+// The number of instructions run so far
+func (m *Machine) Steps() uint64 {
+	return m.steps
+}
+
+// The calls in progress, innermost last
+func (m *Machine) Frames() []Frame {
+	frames := make([]Frame, 0, len(m.frames))
+	for i, f := range m.frames {
+		fr := Frame{Function: f.fid}
+		if i < len(m.frames)-1 && f.pc > 0 {
+			fr.PC = f.code[f.pc-1].PC
+		} else if f.pc < len(f.code) {
+			fr.PC = f.code[f.pc].PC
+		} else if len(f.code) > 0 {
+			fr.PC = f.code[len(f.code)-1].PC
+		}
+		frames = append(frames, fr)
+	}
+	return frames
+}
+
+// The instruction Step will run next, or nil if there isn't one
+func (m *Machine) Next() *expression.Expression {
+	if m.Done() {
+		return nil
+	}
+	f := m.frames[len(m.frames)-1]
+	if f.pc >= len(f.code) {
+		return nil
+	}
+	return f.code[f.pc]
+}
+
+// The operand stack of the innermost call
+func (m *Machine) Stack() []uint64 {
+	if len(m.frames) == 0 {
+		return m.stack
+	}
+	return m.stack[m.frames[len(m.frames)-1].base:]
+}
+
+// The params and locals of the innermost call
+func (m *Machine) Locals() []uint64 {
+	if len(m.frames) == 0 {
+		return nil
+	}
+	return m.frames[len(m.frames)-1].locals
+}
+
+// The linear memory. This is the memory itself, so changes to it are seen by the module.
+func (m *Machine) Memory() []byte {
+	return m.memory
+}
+
+func (m *Machine) Global(idx int) uint64 {
+	return m.globals[idx]
+}
+
+func (m *Machine) SetGlobal(idx int, v uint64) {
+	m.globals[idx] = v
+}
+
+func (m *Machine) functionType(fid int) (*wasmfile.TypeEntry, error) {
+	tidx := -1
+	if fid >= 0 && fid < len(m.wf.Import) {
+		tidx = m.wf.Import[fid].Index
+	} else if fid >= len(m.wf.Import) && fid < len(m.wf.Import)+len(m.wf.Function) {
+		tidx = m.wf.Function[fid-len(m.wf.Import)].TypeIndex
+	} else {
+		return nil, fmt.Errorf("Function %d not found", fid)
+	}
+	if tidx < 0 || tidx >= len(m.wf.Type) {
+		return nil, fmt.Errorf("Function %d has an invalid type %d", fid, tidx)
+	}
+	return m.wf.Type[tidx], nil
+}
@@ -0,0 +1,281 @@
+package interp
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32) (result i32)))
+  (type (func (param i32 i32) (result i32)))
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (type (func (param i32)))
+  (type (func))
+  (type (func (param i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (type 2)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (type 3)))
+  (memory 1)
+  (table 2 funcref)
+  (elem (i32.const 0) func $add $sub)
+  (data (i32.const 16) "hello\n")
+  (func $fact (type 0)
+    (local i32)
+    i32.const 1
+    local.set 1
+    block
+      loop
+        local.get 0
+        i32.eqz
+        br_if 1
+        local.get 1
+        local.get 0
+        i32.mul
+        local.set 1
+        local.get 0
+        i32.const 1
+        i32.sub
+        local.set 0
+        br 0
+      end
+    end
+    local.get 1
+  )
+  (func $add (type 1)
+    local.get 0
+    local.get 1
+    i32.add
+  )
+  (func $sub (type 1)
+    local.get 0
+    local.get 1
+    i32.sub
+  )
+  (func $apply (type 5)
+    local.get 1
+    local.get 2
+    local.get 0
+    call_indirect (type 1)
+  )
+  (func $store (type 1)
+    local.get 0
+    local.get 1
+    i32.store offset=4
+    local.get 0
+    i32.load offset=4
+  )
+  (func $div (type 1)
+    local.get 0
+    local.get 1
+    i32.div_s
+  )
+  (func $hello (type 4)
+    i32.const 0
+    i32.const 16
+    i32.store
+    i32.const 4
+    i32.const 6
+    i32.store
+    i32.const 1
+    i32.const 0
+    i32.const 1
+    i32.const 8
+    call $fd_write
+    drop
+  )
+  (func $exit (type 3)
+    local.get 0
+    call $proc_exit
+    unreachable
+  )
+  (export "fact" (func $fact))
+  (export "apply" (func $apply))
+  (export "store" (func $store))
+  (export "div" (func $div))
+  (export "hello" (func $hello))
+  (export "exit" (func $exit))
+)
+`
+
+func testMachine(t *testing.T, config Interp_config) *Machine {
+	wf := wasmfile.NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(testWat)))
+	for _, c := range wf.Code {
+		assert.NoError(t, c.ResolveLengths(wf))
+		assert.NoError(t, c.ResolveRelocations(wf, 0))
+		assert.NoError(t, c.ResolveGlobals(wf))
+		assert.NoError(t, c.ResolveFunctions(wf))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	wf2 := &wasmfile.WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	m, err := New(wf2, config)
+	assert.NoError(t, err)
+	return m
+}
+
+func TestCall(t *testing.T) {
+	m := testMachine(t, Interp_config{})
+
+	res, err := m.Call("fact", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{120}, res)
+
+	_, err = m.Call("apply", 1, 7, 3, 0)
+	assert.Error(t, err)
+	res, err = m.Call("apply", 1, 7, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{4}, res)
+
+	res, err = m.Call("store", 100, 0xdeadbeef)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0xdeadbeef}, res)
+	assert.Equal(t, []byte{0xef, 0xbe, 0xad, 0xde}, m.Memory()[104:108])
+
+	res, err = m.Call("div", uint64(uint32(0xfffffff8)), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{uint64(uint32(0xfffffffc))}, res)
+
+	_, err = m.Call("nothing")
+	assert.Error(t, err)
+}
+
+func TestTrap(t *testing.T) {
+	m := testMachine(t, Interp_config{})
+
+	_, err := m.Call("div", 1, 0)
+	var trap *Trap
+	assert.True(t, errors.As(err, &trap))
+	assert.Equal(t, 7, trap.Function)
+
+	// An undefined table entry
+	_, err = m.Call("apply", 5, 1, 1)
+	assert.True(t, errors.As(err, &trap))
+	assert.Equal(t, 5, trap.Function)
+
+	_, err = m.Call("store", 65535, 1)
+	assert.True(t, errors.As(err, &trap))
+	assert.Equal(t, "out of bounds memory access", trap.Message)
+
+	// The machine can be used again after a trap
+	res, err := m.Call("fact", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{6}, res)
+}
+
+func TestWasi(t *testing.T) {
+	var out bytes.Buffer
+	m := testMachine(t, Interp_config{Stdout: &out})
+	_, err := m.Call("hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", out.String())
+
+	_, err = m.Call("exit", 3)
+	var exit *ExitError
+	assert.True(t, errors.As(err, &exit))
+	assert.Equal(t, uint32(3), exit.Code)
+
+	_, err = New(&wasmfile.WasmFile{
+		Type:   []*wasmfile.TypeEntry{{}},
+		Import: []*wasmfile.ImportEntry{{Module: "env", Name: "missing"}},
+	}, Interp_config{})
+	assert.Error(t, err)
+}
+
+func TestStep(t *testing.T) {
+	m := testMachine(t, Interp_config{})
+	assert.NoError(t, m.Start(5, []uint64{0, 6, 2}))
+
+	// local.get 1, local.get 2 and local.get 0, then call_indirect into $add
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, m.Step())
+	}
+	assert.Equal(t, expression.InstrToOpcode["call_indirect"], m.Next().Opcode)
+	assert.Equal(t, []uint64{6, 2, 0}, m.Stack())
+	assert.NoError(t, m.Step())
+
+	frames := m.Frames()
+	assert.Equal(t, 2, len(frames))
+	assert.Equal(t, 5, frames[0].Function)
+	assert.Equal(t, 3, frames[1].Function)
+	assert.Equal(t, []uint64{6, 2}, m.Locals())
+
+	assert.NoError(t, m.Run())
+	assert.True(t, m.Done())
+	assert.Equal(t, []uint64{8}, m.Results())
+	assert.Equal(t, 0, len(m.Frames()))
+}
+
+const numericWat = `(module
+  (type (func (param i64 i64) (result i64)))
+  (type (func (param f64) (result i64)))
+  (type (func (param i32 i32) (result i32)))
+  (func $rotl (type 0)
+    local.get 0
+    local.get 1
+    i64.rotl
+  )
+  (func $div (type 0)
+    local.get 0
+    local.get 1
+    i64.div_s
+  )
+  (func $trunc_sat (type 1)
+    local.get 0
+    i64.trunc_sat_f64_s
+  )
+  (func $trunc (type 1)
+    local.get 0
+    i64.trunc_f64_u
+  )
+  (func $clz_extend (type 2)
+    local.get 0
+    i32.clz
+    local.get 1
+    i32.extend8_s
+    i32.add
+  )
+  (export "rotl" (func $rotl))
+  (export "div" (func $div))
+  (export "trunc_sat" (func $trunc_sat))
+  (export "trunc" (func $trunc))
+  (export "clz_extend" (func $clz_extend))
+)
+`
+
+func TestNumeric(t *testing.T) {
+	wf := wasmfile.NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(numericWat)))
+	m, err := New(wf, Interp_config{})
+	assert.NoError(t, err)
+
+	res, err := m.Call("rotl", 0x8000000000000001, 65)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3}, res)
+
+	_, err = m.Call("div", 0x8000000000000000, 0xffffffffffffffff)
+	assert.Error(t, err)
+
+	res, err = m.Call("trunc_sat", math.Float64bits(-1e300))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0x8000000000000000}, res)
+	res, err = m.Call("trunc_sat", math.Float64bits(math.NaN()))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0}, res)
+
+	res, err = m.Call("trunc", math.Float64bits(1.8e19))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{18000000000000000000}, res)
+	_, err = m.Call("trunc", math.Float64bits(-1))
+	assert.Error(t, err)
+
+	res, err = m.Call("clz_extend", 1, 0xff)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{30}, res)
+}
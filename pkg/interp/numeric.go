@@ -0,0 +1,422 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package interp
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+)
+
+// Values are kept as their bits. An i32 or f32 is in the low 32 bits, and the rest are zero.
+
+func f32(v uint64) float32 {
+	return math.Float32frombits(uint32(v))
+}
+
+func fromF32(v float32) uint64 {
+	return uint64(math.Float32bits(v))
+}
+
+func f64(v uint64) float64 {
+	return math.Float64frombits(v)
+}
+
+func fromF64(v float64) uint64 {
+	return math.Float64bits(v)
+}
+
+func fromI32(v int32) uint64 {
+	return uint64(uint32(v))
+}
+
+func fromBool(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func unop(name string, fn func(a uint64) uint64) {
+	define(name, func(m *Machine, f *frame, e *expression.Expression) error {
+		m.stack[len(m.stack)-1] = fn(m.stack[len(m.stack)-1])
+		return nil
+	})
+}
+
+func unopErr(name string, fn func(a uint64) (uint64, error)) {
+	define(name, func(m *Machine, f *frame, e *expression.Expression) error {
+		v, err := fn(m.stack[len(m.stack)-1])
+		if err != nil {
+			return err
+		}
+		m.stack[len(m.stack)-1] = v
+		return nil
+	})
+}
+
+func binop(name string, fn func(a, b uint64) uint64) {
+	define(name, func(m *Machine, f *frame, e *expression.Expression) error {
+		b := m.pop()
+		m.stack[len(m.stack)-1] = fn(m.stack[len(m.stack)-1], b)
+		return nil
+	})
+}
+
+func binopErr(name string, fn func(a, b uint64) (uint64, error)) {
+	define(name, func(m *Machine, f *frame, e *expression.Expression) error {
+		b := m.pop()
+		v, err := fn(m.stack[len(m.stack)-1], b)
+		if err != nil {
+			return err
+		}
+		m.stack[len(m.stack)-1] = v
+		return nil
+	})
+}
+
+// math.Min and math.Max give an infinity over NaN, but in wasm NaN always wins
+func fmin(a float64, b float64) float64 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.NaN()
+	}
+	return math.Min(a, b)
+}
+
+func fmax(a float64, b float64) float64 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.NaN()
+	}
+	return math.Max(a, b)
+}
+
+const errDivideByZero = "integer divide by zero"
+const errOverflow = "integer overflow"
+const errInvalidConversion = "invalid conversion to integer"
+
+// Truncate a float to an integer in [min, max], trapping if it doesn't fit
+func trunc(x float64, min float64, max float64) (float64, error) {
+	if math.IsNaN(x) {
+		return 0, trap(errInvalidConversion)
+	}
+	t := math.Trunc(x)
+	if t < min || t > max {
+		return 0, trap(errOverflow)
+	}
+	return t, nil
+}
+
+// Truncate a float to an integer in [min, max], clamping it if it doesn't fit. NaN gives 0.
+func truncSat(x float64, min float64, max float64) (float64, bool) {
+	if math.IsNaN(x) {
+		return 0, false
+	}
+	t := math.Trunc(x)
+	if t < min || t > max {
+		return t, false
+	}
+	return t, true
+}
+
+const (
+	minI32 = -2147483648.0
+	maxI32 = 2147483647.0
+	maxU32 = 4294967295.0
+	minI64 = -9223372036854775808.0
+	// The largest floats below 2^63 and 2^64, since 2^63-1 and 2^64-1 round up to them
+	maxI64 = 9223372036854774784.0
+	maxU64 = 18446744073709549568.0
+)
+
+func defineConversions() {
+	truncI32S := func(x float64) (uint64, error) {
+		t, err := trunc(x, minI32, maxI32)
+		return fromI32(int32(t)), err
+	}
+	truncI32U := func(x float64) (uint64, error) {
+		t, err := trunc(x, 0, maxU32)
+		return uint64(uint32(t)), err
+	}
+	truncI64S := func(x float64) (uint64, error) {
+		t, err := trunc(x, minI64, maxI64)
+		return uint64(int64(t)), err
+	}
+	truncI64U := func(x float64) (uint64, error) {
+		t, err := trunc(x, 0, maxU64)
+		return uint64(t), err
+	}
+	unopErr("i32.trunc_f32_s", func(a uint64) (uint64, error) { return truncI32S(float64(f32(a))) })
+	unopErr("i32.trunc_f32_u", func(a uint64) (uint64, error) { return truncI32U(float64(f32(a))) })
+	unopErr("i32.trunc_f64_s", func(a uint64) (uint64, error) { return truncI32S(f64(a)) })
+	unopErr("i32.trunc_f64_u", func(a uint64) (uint64, error) { return truncI32U(f64(a)) })
+	unopErr("i64.trunc_f32_s", func(a uint64) (uint64, error) { return truncI64S(float64(f32(a))) })
+	unopErr("i64.trunc_f32_u", func(a uint64) (uint64, error) { return truncI64U(float64(f32(a))) })
+	unopErr("i64.trunc_f64_s", func(a uint64) (uint64, error) { return truncI64S(f64(a)) })
+	unopErr("i64.trunc_f64_u", func(a uint64) (uint64, error) { return truncI64U(f64(a)) })
+
+	satI32S := func(x float64) uint64 {
+		t, ok := truncSat(x, minI32, maxI32)
+		if !ok {
+			if math.IsNaN(x) {
+				return 0
+			} else if t < 0 {
+				return fromI32(math.MinInt32)
+			}
+			return fromI32(math.MaxInt32)
+		}
+		return fromI32(int32(t))
+	}
+	satI32U := func(x float64) uint64 {
+		t, ok := truncSat(x, 0, maxU32)
+		if !ok {
+			if math.IsNaN(x) || t < 0 {
+				return 0
+			}
+			return math.MaxUint32
+		}
+		return uint64(uint32(t))
+	}
+	satI64S := func(x float64) uint64 {
+		t, ok := truncSat(x, minI64, maxI64)
+		if !ok {
+			if math.IsNaN(x) {
+				return 0
+			} else if t < 0 {
+				return 1 << 63
+			}
+			return math.MaxInt64
+		}
+		return uint64(int64(t))
+	}
+	satI64U := func(x float64) uint64 {
+		t, ok := truncSat(x, 0, maxU64)
+		if !ok {
+			if math.IsNaN(x) || t < 0 {
+				return 0
+			}
+			return math.MaxUint64
+		}
+		return uint64(t)
+	}
+	unop("i32.trunc_sat_f32_s", func(a uint64) uint64 { return satI32S(float64(f32(a))) })
+	unop("i32.trunc_sat_f32_u", func(a uint64) uint64 { return satI32U(float64(f32(a))) })
+	unop("i32.trunc_sat_f64_s", func(a uint64) uint64 { return satI32S(f64(a)) })
+	unop("i32.trunc_sat_f64_u", func(a uint64) uint64 { return satI32U(f64(a)) })
+	unop("i64.trunc_sat_f32_s", func(a uint64) uint64 { return satI64S(float64(f32(a))) })
+	unop("i64.trunc_sat_f32_u", func(a uint64) uint64 { return satI64U(float64(f32(a))) })
+	unop("i64.trunc_sat_f64_s", func(a uint64) uint64 { return satI64S(f64(a)) })
+	unop("i64.trunc_sat_f64_u", func(a uint64) uint64 { return satI64U(f64(a)) })
+
+	unop("i32.wrap_i64", func(a uint64) uint64 { return uint64(uint32(a)) })
+	unop("i64.extend_i32_s", func(a uint64) uint64 { return uint64(int64(int32(a))) })
+	unop("i64.extend_i32_u", func(a uint64) uint64 { return uint64(uint32(a)) })
+	unop("f32.convert_i32_s", func(a uint64) uint64 { return fromF32(float32(int32(a))) })
+	unop("f32.convert_i32_u", func(a uint64) uint64 { return fromF32(float32(uint32(a))) })
+	unop("f32.convert_i64_s", func(a uint64) uint64 { return fromF32(float32(int64(a))) })
+	unop("f32.convert_i64_u", func(a uint64) uint64 { return fromF32(float32(a)) })
+	unop("f32.demote_f64", func(a uint64) uint64 { return fromF32(float32(f64(a))) })
+	unop("f64.convert_i32_s", func(a uint64) uint64 { return fromF64(float64(int32(a))) })
+	unop("f64.convert_i32_u", func(a uint64) uint64 { return fromF64(float64(uint32(a))) })
+	unop("f64.convert_i64_s", func(a uint64) uint64 { return fromF64(float64(int64(a))) })
+	unop("f64.convert_i64_u", func(a uint64) uint64 { return fromF64(float64(a)) })
+	unop("f64.promote_f32", func(a uint64) uint64 { return fromF64(float64(f32(a))) })
+	// The bits are kept as they are, so reinterpreting doesn't change anything
+	unop("i32.reinterpret_f32", func(a uint64) uint64 { return a })
+	unop("i64.reinterpret_f64", func(a uint64) uint64 { return a })
+	unop("f32.reinterpret_i32", func(a uint64) uint64 { return a })
+	unop("f64.reinterpret_i64", func(a uint64) uint64 { return a })
+	unop("i32.extend8_s", func(a uint64) uint64 { return fromI32(int32(int8(a))) })
+	unop("i32.extend16_s", func(a uint64) uint64 { return fromI32(int32(int16(a))) })
+	unop("i64.extend8_s", func(a uint64) uint64 { return uint64(int64(int8(a))) })
+	unop("i64.extend16_s", func(a uint64) uint64 { return uint64(int64(int16(a))) })
+	unop("i64.extend32_s", func(a uint64) uint64 { return uint64(int64(int32(a))) })
+}
+
+func defineNumeric() {
+	define("i32.const", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.push(fromI32(e.I32Value))
+		return nil
+	})
+	define("i64.const", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.push(uint64(e.I64Value))
+		return nil
+	})
+	define("f32.const", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.push(fromF32(e.F32Value))
+		return nil
+	})
+	define("f64.const", func(m *Machine, f *frame, e *expression.Expression) error {
+		m.push(fromF64(e.F64Value))
+		return nil
+	})
+
+	// i32
+	unop("i32.eqz", func(a uint64) uint64 { return fromBool(uint32(a) == 0) })
+	binop("i32.eq", func(a, b uint64) uint64 { return fromBool(uint32(a) == uint32(b)) })
+	binop("i32.ne", func(a, b uint64) uint64 { return fromBool(uint32(a) != uint32(b)) })
+	binop("i32.lt_s", func(a, b uint64) uint64 { return fromBool(int32(a) < int32(b)) })
+	binop("i32.lt_u", func(a, b uint64) uint64 { return fromBool(uint32(a) < uint32(b)) })
+	binop("i32.gt_s", func(a, b uint64) uint64 { return fromBool(int32(a) > int32(b)) })
+	binop("i32.gt_u", func(a, b uint64) uint64 { return fromBool(uint32(a) > uint32(b)) })
+	binop("i32.le_s", func(a, b uint64) uint64 { return fromBool(int32(a) <= int32(b)) })
+	binop("i32.le_u", func(a, b uint64) uint64 { return fromBool(uint32(a) <= uint32(b)) })
+	binop("i32.ge_s", func(a, b uint64) uint64 { return fromBool(int32(a) >= int32(b)) })
+	binop("i32.ge_u", func(a, b uint64) uint64 { return fromBool(uint32(a) >= uint32(b)) })
+	unop("i32.clz", func(a uint64) uint64 { return uint64(bits.LeadingZeros32(uint32(a))) })
+	unop("i32.ctz", func(a uint64) uint64 { return uint64(bits.TrailingZeros32(uint32(a))) })
+	unop("i32.popcnt", func(a uint64) uint64 { return uint64(bits.OnesCount32(uint32(a))) })
+	binop("i32.add", func(a, b uint64) uint64 { return uint64(uint32(a) + uint32(b)) })
+	binop("i32.sub", func(a, b uint64) uint64 { return uint64(uint32(a) - uint32(b)) })
+	binop("i32.mul", func(a, b uint64) uint64 { return uint64(uint32(a) * uint32(b)) })
+	binopErr("i32.div_s", func(a, b uint64) (uint64, error) {
+		if int32(b) == 0 {
+			return 0, trap(errDivideByZero)
+		}
+		if int32(a) == math.MinInt32 && int32(b) == -1 {
+			return 0, trap(errOverflow)
+		}
+		return fromI32(int32(a) / int32(b)), nil
+	})
+	binopErr("i32.div_u", func(a, b uint64) (uint64, error) {
+		if uint32(b) == 0 {
+			return 0, trap(errDivideByZero)
+		}
+		return uint64(uint32(a) / uint32(b)), nil
+	})
+	binopErr("i32.rem_s", func(a, b uint64) (uint64, error) {
+		if int32(b) == 0 {
+			return 0, trap(errDivideByZero)
+		}
+		// MinInt32 % -1 is 0 in Go, the same as wasm
+		return fromI32(int32(a) % int32(b)), nil
+	})
+	binopErr("i32.rem_u", func(a, b uint64) (uint64, error) {
+		if uint32(b) == 0 {
+			return 0, trap(errDivideByZero)
+		}
+		return uint64(uint32(a) % uint32(b)), nil
+	})
+	binop("i32.and", func(a, b uint64) uint64 { return a & b })
+	binop("i32.or", func(a, b uint64) uint64 { return a | b })
+	binop("i32.xor", func(a, b uint64) uint64 { return a ^ b })
+	binop("i32.shl", func(a, b uint64) uint64 { return uint64(uint32(a) << (b & 31)) })
+	binop("i32.shr_s", func(a, b uint64) uint64 { return fromI32(int32(a) >> (b & 31)) })
+	binop("i32.shr_u", func(a, b uint64) uint64 { return uint64(uint32(a) >> (b & 31)) })
+	binop("i32.rotl", func(a, b uint64) uint64 { return uint64(bits.RotateLeft32(uint32(a), int(b&31))) })
+	binop("i32.rotr", func(a, b uint64) uint64 { return uint64(bits.RotateLeft32(uint32(a), -int(b&31))) })
+
+	// i64
+	unop("i64.eqz", func(a uint64) uint64 { return fromBool(a == 0) })
+	binop("i64.eq", func(a, b uint64) uint64 { return fromBool(a == b) })
+	binop("i64.ne", func(a, b uint64) uint64 { return fromBool(a != b) })
+	binop("i64.lt_s", func(a, b uint64) uint64 { return fromBool(int64(a) < int64(b)) })
+	binop("i64.lt_u", func(a, b uint64) uint64 { return fromBool(a < b) })
+	binop("i64.gt_s", func(a, b uint64) uint64 { return fromBool(int64(a) > int64(b)) })
+	binop("i64.gt_u", func(a, b uint64) uint64 { return fromBool(a > b) })
+	binop("i64.le_s", func(a, b uint64) uint64 { return fromBool(int64(a) <= int64(b)) })
+	binop("i64.le_u", func(a, b uint64) uint64 { return fromBool(a <= b) })
+	binop("i64.ge_s", func(a, b uint64) uint64 { return fromBool(int64(a) >= int64(b)) })
+	binop("i64.ge_u", func(a, b uint64) uint64 { return fromBool(a >= b) })
+	unop("i64.clz", func(a uint64) uint64 { return uint64(bits.LeadingZeros64(a)) })
+	unop("i64.ctz", func(a uint64) uint64 { return uint64(bits.TrailingZeros64(a)) })
+	unop("i64.popcnt", func(a uint64) uint64 { return uint64(bits.OnesCount64(a)) })
+	binop("i64.add", func(a, b uint64) uint64 { return a + b })
+	binop("i64.sub", func(a, b uint64) uint64 { return a - b })
+	binop("i64.mul", func(a, b uint64) uint64 { return a * b })
+	binopErr("i64.div_s", func(a, b uint64) (uint64, error) {
+		if b == 0 {
+			return 0, trap(errDivideByZero)
+		}
+		if int64(a) == math.MinInt64 && int64(b) == -1 {
+			return 0, trap(errOverflow)
+		}
+		return uint64(int64(a) / int64(b)), nil
+	})
+	binopErr("i64.div_u", func(a, b uint64) (uint64, error) {
+		if b == 0 {
+			return 0, trap(errDivideByZero)
+		}
+		return a / b, nil
+	})
+	binopErr("i64.rem_s", func(a, b uint64) (uint64, error) {
+		if b == 0 {
+			return 0, trap(errDivideByZero)
+		}
+		return uint64(int64(a) % int64(b)), nil
+	})
+	binopErr("i64.rem_u", func(a, b uint64) (uint64, error) {
+		if b == 0 {
+			return 0, trap(errDivideByZero)
+		}
+		return a % b, nil
+	})
+	binop("i64.and", func(a, b uint64) uint64 { return a & b })
+	binop("i64.or", func(a, b uint64) uint64 { return a | b })
+	binop("i64.xor", func(a, b uint64) uint64 { return a ^ b })
+	binop("i64.shl", func(a, b uint64) uint64 { return a << (b & 63) })
+	binop("i64.shr_s", func(a, b uint64) uint64 { return uint64(int64(a) >> (b & 63)) })
+	binop("i64.shr_u", func(a, b uint64) uint64 { return a >> (b & 63) })
+	binop("i64.rotl", func(a, b uint64) uint64 { return bits.RotateLeft64(a, int(b&63)) })
+	binop("i64.rotr", func(a, b uint64) uint64 { return bits.RotateLeft64(a, -int(b&63)) })
+
+	// f32. The explicit conversions stop any operations being fused.
+	binop("f32.eq", func(a, b uint64) uint64 { return fromBool(f32(a) == f32(b)) })
+	binop("f32.ne", func(a, b uint64) uint64 { return fromBool(f32(a) != f32(b)) })
+	binop("f32.lt", func(a, b uint64) uint64 { return fromBool(f32(a) < f32(b)) })
+	binop("f32.gt", func(a, b uint64) uint64 { return fromBool(f32(a) > f32(b)) })
+	binop("f32.le", func(a, b uint64) uint64 { return fromBool(f32(a) <= f32(b)) })
+	binop("f32.ge", func(a, b uint64) uint64 { return fromBool(f32(a) >= f32(b)) })
+	unop("f32.abs", func(a uint64) uint64 { return a &^ (1 << 31) })
+	unop("f32.neg", func(a uint64) uint64 { return a ^ (1 << 31) })
+	unop("f32.ceil", func(a uint64) uint64 { return fromF32(float32(math.Ceil(float64(f32(a))))) })
+	unop("f32.floor", func(a uint64) uint64 { return fromF32(float32(math.Floor(float64(f32(a))))) })
+	unop("f32.trunc", func(a uint64) uint64 { return fromF32(float32(math.Trunc(float64(f32(a))))) })
+	unop("f32.nearest", func(a uint64) uint64 { return fromF32(float32(math.RoundToEven(float64(f32(a))))) })
+	unop("f32.sqrt", func(a uint64) uint64 { return fromF32(float32(math.Sqrt(float64(f32(a))))) })
+	binop("f32.add", func(a, b uint64) uint64 { return fromF32(float32(f32(a) + f32(b))) })
+	binop("f32.sub", func(a, b uint64) uint64 { return fromF32(float32(f32(a) - f32(b))) })
+	binop("f32.mul", func(a, b uint64) uint64 { return fromF32(float32(f32(a) * f32(b))) })
+	binop("f32.div", func(a, b uint64) uint64 { return fromF32(float32(f32(a) / f32(b))) })
+	binop("f32.min", func(a, b uint64) uint64 { return fromF32(float32(fmin(float64(f32(a)), float64(f32(b))))) })
+	binop("f32.max", func(a, b uint64) uint64 { return fromF32(float32(fmax(float64(f32(a)), float64(f32(b))))) })
+	binop("f32.copysign", func(a, b uint64) uint64 { return a&^(1<<31) | b&(1<<31) })
+
+	// f64
+	binop("f64.eq", func(a, b uint64) uint64 { return fromBool(f64(a) == f64(b)) })
+	binop("f64.ne", func(a, b uint64) uint64 { return fromBool(f64(a) != f64(b)) })
+	binop("f64.lt", func(a, b uint64) uint64 { return fromBool(f64(a) < f64(b)) })
+	binop("f64.gt", func(a, b uint64) uint64 { return fromBool(f64(a) > f64(b)) })
+	binop("f64.le", func(a, b uint64) uint64 { return fromBool(f64(a) <= f64(b)) })
+	binop("f64.ge", func(a, b uint64) uint64 { return fromBool(f64(a) >= f64(b)) })
+	unop("f64.abs", func(a uint64) uint64 { return a &^ (1 << 63) })
+	unop("f64.neg", func(a uint64) uint64 { return a ^ (1 << 63) })
+	unop("f64.ceil", func(a uint64) uint64 { return fromF64(math.Ceil(f64(a))) })
+	unop("f64.floor", func(a uint64) uint64 { return fromF64(math.Floor(f64(a))) })
+	unop("f64.trunc", func(a uint64) uint64 { return fromF64(math.Trunc(f64(a))) })
+	unop("f64.nearest", func(a uint64) uint64 { return fromF64(math.RoundToEven(f64(a))) })
+	unop("f64.sqrt", func(a uint64) uint64 { return fromF64(math.Sqrt(f64(a))) })
+	binop("f64.add", func(a, b uint64) uint64 { return fromF64(float64(f64(a) + f64(b))) })
+	binop("f64.sub", func(a, b uint64) uint64 { return fromF64(float64(f64(a) - f64(b))) })
+	binop("f64.mul", func(a, b uint64) uint64 { return fromF64(float64(f64(a) * f64(b))) })
+	binop("f64.div", func(a, b uint64) uint64 { return fromF64(float64(f64(a) / f64(b))) })
+	binop("f64.min", func(a, b uint64) uint64 { return fromF64(fmin(f64(a), f64(b))) })
+	binop("f64.max", func(a, b uint64) uint64 { return fromF64(fmax(f64(a), f64(b))) })
+	binop("f64.copysign", func(a, b uint64) uint64 { return a&^(1<<63) | b&(1<<63) })
+
+	defineConversions()
+}
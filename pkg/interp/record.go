@@ -0,0 +1,179 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package interp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Record and replay of WASI calls. Every WASI import the interpreter answers is wrapped, so a run can be recorded,
+// then run again exactly the same way with each call answered from the log rather than the host. The module
+// itself isn't changed, so this only works in the interpreter.
+
+// What a WASI call was given, and everything it did
+type WasiCall struct {
+	Name    string        `json:"name"`
+	Params  []uint64      `json:"params"`
+	Results []uint64      `json:"results,omitempty"`
+	Writes  []MemoryWrite `json:"writes,omitempty"` // The memory it changed
+	Exit    *uint32       `json:"exit,omitempty"`   // Set if it was proc_exit
+}
+
+type MemoryWrite struct {
+	Addr uint32 `json:"addr"`
+	Data []byte `json:"data"`
+}
+
+// A part of memory a host function has been given, and what was in it before
+type touched struct {
+	ptr    uint64
+	before []byte
+}
+
+// Read a log of WASI calls, written as a line of JSON each
+func ReadWasiLog(r io.Reader) ([]*WasiCall, error) {
+	calls := make([]*WasiCall, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		call := &WasiCall{}
+		err := json.Unmarshal(scanner.Bytes(), call)
+		if err != nil {
+			return nil, fmt.Errorf("WASI log line %d: %w", len(calls)+1, err)
+		}
+		calls = append(calls, call)
+	}
+	return calls, scanner.Err()
+}
+
+// Write a WASI call as a line of JSON, for ReadWasiLog
+func WriteWasiCall(w io.Writer, call *WasiCall) error {
+	data, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// How many WASI calls have been made, whether they ran or were replayed
+func (m *Machine) WasiCalls() int {
+	return m.wasiCalls
+}
+
+/**
+ * Wrap a WASI function for record and replay. While there's still some of config.Replay left, the
+ * call has to match the next one in it, and its results and memory writes are used. After that,
+ * calls go to the host. Either way, config.Record is told about it.
+ */
+func recordWasi(name string, fn HostFunc) HostFunc {
+	return func(m *Machine, params []uint64) ([]uint64, error) {
+		n := m.wasiCalls
+		m.wasiCalls++
+
+		if n < len(m.config.Replay) {
+			call := m.config.Replay[n]
+			if call.Name != name || !equalParams(call.Params, params) {
+				return nil, fmt.Errorf("Replay diverged at WASI call %d: the log has %s%v but the module called %s%v", n, call.Name, call.Params, name, params)
+			}
+			for _, w := range call.Writes {
+				b := m.memoryRange(uint64(w.Addr), uint64(len(w.Data)))
+				if b == nil {
+					return nil, fmt.Errorf("Replay of WASI call %d writes outside memory", n)
+				}
+				copy(b, w.Data)
+			}
+			if m.config.Record != nil {
+				m.config.Record(call)
+			}
+			if call.Exit != nil {
+				return nil, &ExitError{Code: *call.Exit}
+			}
+			return append([]uint64{}, call.Results...), nil
+		}
+
+		if m.config.Record == nil {
+			return fn(m, params)
+		}
+
+		m.touched = make([]touched, 0)
+		results, err := fn(m, params)
+		writes := m.changes()
+		m.touched = nil
+
+		call := &WasiCall{
+			Name:    name,
+			Params:  append([]uint64{}, params...),
+			Results: results,
+			Writes:  writes,
+		}
+		var exit *ExitError
+		if errors.As(err, &exit) {
+			code := exit.Code
+			call.Exit = &code
+		} else if err != nil {
+			return nil, err
+		}
+		m.config.Record(call)
+		return results, err
+	}
+}
+
+// Find what changed in the memory the host function was given, keeping the span from the first change to the last in each part
+func (m *Machine) changes() []MemoryWrite {
+	writes := make([]MemoryWrite, 0)
+	for _, t := range m.touched {
+		after := m.memory[t.ptr : t.ptr+uint64(len(t.before))]
+		first := -1
+		last := -1
+		for i := range after {
+			if after[i] != t.before[i] {
+				if first == -1 {
+					first = i
+				}
+				last = i
+			}
+		}
+		if first != -1 {
+			writes = append(writes, MemoryWrite{
+				Addr: uint32(t.ptr) + uint32(first),
+				Data: append([]byte{}, after[first:last+1]...),
+			})
+		}
+	}
+	return writes
+}
+
+func equalParams(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
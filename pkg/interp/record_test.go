@@ -0,0 +1,59 @@
+package interp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var out bytes.Buffer
+	var log bytes.Buffer
+	m := testMachine(t, Interp_config{Stdout: &out, Record: func(call *WasiCall) {
+		assert.NoError(t, WriteWasiCall(&log, call))
+	}})
+	_, err := m.Call("hello")
+	assert.NoError(t, err)
+	_, err = m.Call("exit", 3)
+	var exit *ExitError
+	assert.True(t, errors.As(err, &exit))
+	assert.Equal(t, "hello\n", out.String())
+	assert.Equal(t, 2, m.WasiCalls())
+
+	calls, err := ReadWasiLog(&log)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(calls))
+	assert.Equal(t, "fd_write", calls[0].Name)
+	assert.Equal(t, []uint64{1, 0, 1, 8}, calls[0].Params)
+	assert.Equal(t, []uint64{0}, calls[0].Results)
+	// Only nwritten changed, not the iovec or the string it wrote
+	assert.Equal(t, []MemoryWrite{{Addr: 8, Data: []byte{6}}}, calls[0].Writes)
+	assert.Equal(t, "proc_exit", calls[1].Name)
+	assert.Equal(t, uint32(3), *calls[1].Exit)
+
+	// Replaying doesn't write anything out, but the module sees the same results
+	out.Reset()
+	calls[0].Results = []uint64{5}
+	calls[0].Writes[0].Data = []byte{42}
+	m = testMachine(t, Interp_config{Stdout: &out, Replay: calls})
+	_, err = m.Call("hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "", out.String())
+	assert.Equal(t, byte(42), m.Memory()[8])
+	_, err = m.Call("exit", 3)
+	assert.True(t, errors.As(err, &exit))
+	assert.Equal(t, uint32(3), exit.Code)
+
+	// Once the log runs out the host is used
+	_, err = m.Call("hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", out.String())
+
+	// The module has to make the same calls
+	m = testMachine(t, Interp_config{Replay: calls})
+	_, err = m.Call("exit", 4)
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &exit))
+}
@@ -0,0 +1,365 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package interp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm"
+)
+
+// The WASI shims only give the module stdin, stdout and stderr. There are no files or sockets,
+// and anything else returns ENOSYS.
+
+var (
+	errnoSuccess = uint64(wasm.Wasi_errors["WASI_ESUCCESS"])
+	errnoBadf    = uint64(wasm.Wasi_errors["WASI_EBADF"])
+	errnoFault   = uint64(wasm.Wasi_errors["WASI_EFAULT"])
+	errnoInval   = uint64(wasm.Wasi_errors["WASI_EINVAL"])
+	errnoNosys   = uint64(wasm.Wasi_errors["WASI_ENOSYS"])
+	errnoSpipe   = uint64(wasm.Wasi_errors["WASI_ESPIPE"])
+)
+
+const (
+	filetypeCharacterDevice = 2
+	rightFdRead             = 1 << 1
+	rightFdWrite            = 1 << 6
+
+	eventTypeClock = 0
+)
+
+var wasiStart = time.Now()
+
+var wasiFunctions = map[string]HostFunc{
+	"args_get":          wasiArgsGet,
+	"args_sizes_get":    wasiArgsSizesGet,
+	"environ_get":       wasiEnvironGet,
+	"environ_sizes_get": wasiEnvironSizesGet,
+	"clock_res_get":     wasiClockResGet,
+	"clock_time_get":    wasiClockTimeGet,
+	"fd_close":          wasiFdClose,
+	"fd_fdstat_get":     wasiFdFdstatGet,
+	"fd_fdstat_set_flags": func(m *Machine, params []uint64) ([]uint64, error) {
+		return []uint64{stdioErrno(params[0], errnoSuccess)}, nil
+	},
+	"fd_filestat_get": wasiFdFilestatGet,
+	"fd_prestat_get": func(m *Machine, params []uint64) ([]uint64, error) {
+		// No preopened directories
+		return []uint64{errnoBadf}, nil
+	},
+	"fd_prestat_dir_name": func(m *Machine, params []uint64) ([]uint64, error) {
+		return []uint64{errnoBadf}, nil
+	},
+	"fd_read": wasiFdRead,
+	"fd_seek": func(m *Machine, params []uint64) ([]uint64, error) {
+		return []uint64{stdioErrno(params[0], errnoSpipe)}, nil
+	},
+	"fd_write":    wasiFdWrite,
+	"poll_oneoff": wasiPollOneoff,
+	"proc_exit": func(m *Machine, params []uint64) ([]uint64, error) {
+		return nil, &ExitError{Code: uint32(params[0])}
+	},
+	"random_get": wasiRandomGet,
+	"sched_yield": func(m *Machine, params []uint64) ([]uint64, error) {
+		return []uint64{errnoSuccess}, nil
+	},
+}
+
+// Get the shim for a WASI preview1 function
+func wasiFunction(name string) (HostFunc, bool) {
+	fn, ok := wasiFunctions[name]
+	if ok {
+		return fn, true
+	}
+	_, ok = wasm.Debug_wasi_snapshot_preview1[name]
+	if !ok {
+		return nil, false
+	}
+	return func(m *Machine, params []uint64) ([]uint64, error) {
+		return []uint64{errnoNosys}, nil
+	}, true
+}
+
+// Only stdin, stdout and stderr exist
+func stdioErrno(fd uint64, errno uint64) uint64 {
+	if uint32(fd) > 2 {
+		return errnoBadf
+	}
+	return errno
+}
+
+/**
+ * Get part of memory, or nil if it's out of bounds. The shims only get at memory through this, so
+ * while a call is being recorded, it keeps what was there to find out what the call changed.
+ */
+func (m *Machine) memoryRange(ptr uint64, length uint64) []byte {
+	ptr = uint64(uint32(ptr))
+	length = uint64(uint32(length))
+	if ptr+length > uint64(len(m.memory)) {
+		return nil
+	}
+	if m.touched != nil {
+		m.touched = append(m.touched, touched{ptr: ptr, before: append([]byte{}, m.memory[ptr:ptr+length]...)})
+	}
+	return m.memory[ptr : ptr+length]
+}
+
+var errFault = errors.New("fault")
+
+func (m *Machine) putUint32(ptr uint64, v uint32) error {
+	b := m.memoryRange(ptr, 4)
+	if b == nil {
+		return errFault
+	}
+	binary.LittleEndian.PutUint32(b, v)
+	return nil
+}
+
+func (m *Machine) putUint64(ptr uint64, v uint64) error {
+	b := m.memoryRange(ptr, 8)
+	if b == nil {
+		return errFault
+	}
+	binary.LittleEndian.PutUint64(b, v)
+	return nil
+}
+
+// Write a list of strings as args_get and environ_get do, with pointers to each nul terminated string
+func (m *Machine) putStrings(list []string, ptrs uint64, buf uint64) uint64 {
+	for i, s := range list {
+		b := m.memoryRange(buf, uint64(len(s)+1))
+		if b == nil || m.putUint32(ptrs+uint64(i*4), uint32(buf)) != nil {
+			return errnoFault
+		}
+		copy(b, s)
+		b[len(s)] = 0
+		buf += uint64(len(s) + 1)
+	}
+	return errnoSuccess
+}
+
+func (m *Machine) putStringSizes(list []string, countPtr uint64, sizePtr uint64) uint64 {
+	size := 0
+	for _, s := range list {
+		size += len(s) + 1
+	}
+	if m.putUint32(countPtr, uint32(len(list))) != nil || m.putUint32(sizePtr, uint32(size)) != nil {
+		return errnoFault
+	}
+	return errnoSuccess
+}
+
+func wasiArgsGet(m *Machine, params []uint64) ([]uint64, error) {
+	return []uint64{m.putStrings(m.config.Args, params[0], params[1])}, nil
+}
+
+func wasiArgsSizesGet(m *Machine, params []uint64) ([]uint64, error) {
+	return []uint64{m.putStringSizes(m.config.Args, params[0], params[1])}, nil
+}
+
+func wasiEnvironGet(m *Machine, params []uint64) ([]uint64, error) {
+	return []uint64{m.putStrings(m.config.Env, params[0], params[1])}, nil
+}
+
+func wasiEnvironSizesGet(m *Machine, params []uint64) ([]uint64, error) {
+	return []uint64{m.putStringSizes(m.config.Env, params[0], params[1])}, nil
+}
+
+func wasiClockResGet(m *Machine, params []uint64) ([]uint64, error) {
+	if uint32(params[0]) > 3 {
+		return []uint64{errnoInval}, nil
+	}
+	if m.putUint64(params[1], 1) != nil {
+		return []uint64{errnoFault}, nil
+	}
+	return []uint64{errnoSuccess}, nil
+}
+
+func wasiClockTimeGet(m *Machine, params []uint64) ([]uint64, error) {
+	var t uint64
+	switch uint32(params[0]) {
+	case 0: // Realtime
+		t = uint64(time.Now().UnixNano())
+	case 1, 2, 3: // Monotonic, and process and thread CPU time
+		t = uint64(time.Since(wasiStart).Nanoseconds())
+	default:
+		return []uint64{errnoInval}, nil
+	}
+	if m.putUint64(params[2], t) != nil {
+		return []uint64{errnoFault}, nil
+	}
+	return []uint64{errnoSuccess}, nil
+}
+
+func wasiFdClose(m *Machine, params []uint64) ([]uint64, error) {
+	return []uint64{stdioErrno(params[0], errnoSuccess)}, nil
+}
+
+func wasiFdFdstatGet(m *Machine, params []uint64) ([]uint64, error) {
+	fd := uint32(params[0])
+	if fd > 2 {
+		return []uint64{errnoBadf}, nil
+	}
+	// struct fdstat { u8 filetype; u16 flags; u64 rights_base; u64 rights_inheriting }
+	b := m.memoryRange(params[1], 24)
+	if b == nil {
+		return []uint64{errnoFault}, nil
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	b[0] = filetypeCharacterDevice
+	rights := uint64(rightFdWrite)
+	if fd == 0 {
+		rights = rightFdRead
+	}
+	binary.LittleEndian.PutUint64(b[8:], rights)
+	return []uint64{errnoSuccess}, nil
+}
+
+func wasiFdFilestatGet(m *Machine, params []uint64) ([]uint64, error) {
+	if uint32(params[0]) > 2 {
+		return []uint64{errnoBadf}, nil
+	}
+	// struct filestat { u64 dev; u64 ino; u8 filetype; u64 nlink; u64 size; u64 atim; u64 mtim; u64 ctim }
+	b := m.memoryRange(params[1], 64)
+	if b == nil {
+		return []uint64{errnoFault}, nil
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	b[16] = filetypeCharacterDevice
+	return []uint64{errnoSuccess}, nil
+}
+
+// Get the buffers of an iovec list
+func (m *Machine) iovecs(iovs uint64, count uint64) ([][]byte, bool) {
+	list := m.memoryRange(iovs, count*8)
+	if list == nil {
+		return nil, false
+	}
+	bufs := make([][]byte, 0, count)
+	for i := 0; i < len(list); i += 8 {
+		b := m.memoryRange(uint64(binary.LittleEndian.Uint32(list[i:])), uint64(binary.LittleEndian.Uint32(list[i+4:])))
+		if b == nil {
+			return nil, false
+		}
+		bufs = append(bufs, b)
+	}
+	return bufs, true
+}
+
+func wasiFdWrite(m *Machine, params []uint64) ([]uint64, error) {
+	var w io.Writer
+	switch uint32(params[0]) {
+	case 1:
+		w = m.config.Stdout
+	case 2:
+		w = m.config.Stderr
+	default:
+		return []uint64{errnoBadf}, nil
+	}
+	bufs, ok := m.iovecs(params[1], params[2])
+	if !ok {
+		return []uint64{errnoFault}, nil
+	}
+	n := 0
+	for _, b := range bufs {
+		wn, err := w.Write(b)
+		n += wn
+		if err != nil {
+			break
+		}
+	}
+	if m.putUint32(params[3], uint32(n)) != nil {
+		return []uint64{errnoFault}, nil
+	}
+	return []uint64{errnoSuccess}, nil
+}
+
+func wasiFdRead(m *Machine, params []uint64) ([]uint64, error) {
+	if uint32(params[0]) != 0 {
+		return []uint64{errnoBadf}, nil
+	}
+	bufs, ok := m.iovecs(params[1], params[2])
+	if !ok {
+		return []uint64{errnoFault}, nil
+	}
+	n := 0
+	if m.config.Stdin != nil {
+		for _, b := range bufs {
+			rn, err := m.config.Stdin.Read(b)
+			n += rn
+			// Stop at the end of the input, or once there's nothing more ready to read
+			if err != nil || rn < len(b) {
+				break
+			}
+		}
+	}
+	if m.putUint32(params[3], uint32(n)) != nil {
+		return []uint64{errnoFault}, nil
+	}
+	return []uint64{errnoSuccess}, nil
+}
+
+/**
+ * Every subscription is reported as ready straight away. Clocks don't actually wait, so a module
+ * sleeping doesn't hold up single stepping.
+ */
+func wasiPollOneoff(m *Machine, params []uint64) ([]uint64, error) {
+	count := uint64(uint32(params[2]))
+	subs := m.memoryRange(params[0], count*48)
+	events := m.memoryRange(params[1], count*32)
+	if subs == nil || events == nil {
+		return []uint64{errnoFault}, nil
+	}
+	for i := uint64(0); i < count; i++ {
+		// struct subscription { u64 userdata; u8 tag; ... }
+		// struct event { u64 userdata; u16 error; u8 type; u64 nbytes; u16 flags }
+		sub := subs[i*48 : i*48+48]
+		ev := events[i*32 : i*32+32]
+		for j := range ev {
+			ev[j] = 0
+		}
+		copy(ev[0:8], sub[0:8])
+		ev[10] = sub[8]
+		if sub[8] != eventTypeClock {
+			// Pretend one byte is ready to read or write
+			binary.LittleEndian.PutUint64(ev[16:], 1)
+		}
+	}
+	if m.putUint32(params[3], uint32(count)) != nil {
+		return []uint64{errnoFault}, nil
+	}
+	return []uint64{errnoSuccess}, nil
+}
+
+func wasiRandomGet(m *Machine, params []uint64) ([]uint64, error) {
+	b := m.memoryRange(params[0], params[1])
+	if b == nil {
+		return []uint64{errnoFault}, nil
+	}
+	_, err := io.ReadFull(m.config.Random, b)
+	if err != nil {
+		return nil, err
+	}
+	return []uint64{errnoSuccess}, nil
+}
@@ -0,0 +1,212 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package meter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+// The fuel global is exported with this name, so the host can read it or add more
+const FuelExport = "__wasm_toolkit_fuel"
+
+type Meter_config struct {
+	Fuel        int64            // Starting fuel
+	HostHandler bool             // Call the wasm_toolkit.out_of_fuel import when the fuel runs out, instead of trapping
+	Costs       map[string]int64 // Cost of instructions by name, as changes to DefaultCosts
+}
+
+// Every instruction costs 1, apart from these. The 0xfc prefixed instructions (eg memory.copy) can't be changed from 1.
+var DefaultCosts = map[string]int64{
+	"block":         0,
+	"loop":          0,
+	"else":          0,
+	"end":           0,
+	"nop":           0,
+	"call":          5,
+	"call_indirect": 10,
+	"memory.grow":   100,
+}
+
+/**
+ * Work out the cost of each instruction, from the defaults and any changes.
+ *
+ */
+func GetCosts(changes map[string]int64) (map[expression.Opcode]int64, error) {
+	costs := make(map[expression.Opcode]int64)
+	for _, c := range []map[string]int64{DefaultCosts, changes} {
+		for name, cost := range c {
+			op, ok := expression.InstrToOpcode[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown instruction %q", name)
+			}
+			if cost < 0 {
+				return nil, fmt.Errorf("Cost of %s must not be negative", name)
+			}
+			costs[op] = cost
+		}
+	}
+	return costs, nil
+}
+
+/**
+ * Split some code into basic blocks, and charge for each block at its start.
+ * A new block starts after each instruction that code can branch to or from (loop, if, else, end and br_if).
+ * Instructions after a br / return / unreachable are charged for even though they never run.
+ */
+func MeterCode(exp []*expression.Expression, costs map[expression.Opcode]int64, exhausted string) ([]*expression.Expression, error) {
+	newCode := make([]*expression.Expression, 0, len(exp))
+	pending := make([]*expression.Expression, 0)
+	cost := int64(0)
+
+	flush := func() error {
+		if cost > 0 {
+			charge, err := expression.ExpressionFromWat(fmt.Sprintf(`global.get $meter_fuel
+				i64.const %d
+				i64.sub
+				global.set $meter_fuel
+				global.get $meter_fuel
+				i64.const 0
+				i64.lt_s
+				if
+				call %s
+				end`, cost, exhausted))
+			if err != nil {
+				return err
+			}
+			newCode = append(newCode, charge...)
+		}
+		newCode = append(newCode, pending...)
+		pending = make([]*expression.Expression, 0)
+		cost = 0
+		return nil
+	}
+
+	for _, e := range exp {
+		pending = append(pending, e)
+		c, ok := costs[e.Opcode]
+		if !ok {
+			c = 1
+		}
+		cost += c
+
+		switch e.Opcode {
+		case expression.InstrToOpcode["loop"],
+			expression.InstrToOpcode["if"],
+			expression.InstrToOpcode["else"],
+			expression.InstrToOpcode["end"],
+			expression.InstrToOpcode["br_if"]:
+			err := flush()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err := flush()
+	if err != nil {
+		return nil, err
+	}
+	return newCode, nil
+}
+
+/**
+ * Add fuel metering to a wasm.
+ *
+ */
+func AddMeter(wasmInput []byte, config Meter_config) ([]byte, error) {
+	if config.Fuel <= 0 {
+		return nil, errors.New("The fuel must be more than 0")
+	}
+	costs, err := GetCosts(config.Costs)
+	if err != nil {
+		return nil, err
+	}
+
+	wfile := &wasmfile.WasmFile{}
+	err = wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	for _, e := range wfile.Export {
+		if e.Name == FuelExport {
+			return nil, fmt.Errorf("The module already exports %s", FuelExport)
+		}
+	}
+
+	originalFunctionLength := len(wfile.Code)
+
+	// Load up the individual wat files, and add them in
+	files := []string{"meter.wat"}
+	exhausted := "$meter_exhausted"
+	if config.HostHandler {
+		files = append(files, "meter_host.wat")
+		exhausted = "$meter_exhausted_host"
+	}
+
+	err = wfile.AddWatFuncs(files)
+	if err != nil {
+		return nil, err
+	}
+
+	err = wfile.SetGlobal("$meter_fuel", types.ValI64, fmt.Sprintf("i64.const %d", config.Fuel))
+	if err != nil {
+		return nil, err
+	}
+	wfile.Export = append(wfile.Export, &wasmfile.ExportEntry{
+		Name:  FuelExport,
+		Type:  types.ExportGlobal,
+		Index: wfile.Debug.LookupGlobalID("$meter_fuel"),
+	})
+
+	for idx, c := range wfile.Code {
+		if idx < originalFunctionLength {
+			c.Expression, err = MeterCode(c.Expression, costs, exhausted)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = c.ResolveGlobals(wfile)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.ResolveFunctions(wfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
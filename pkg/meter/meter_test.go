@@ -0,0 +1,48 @@
+package meter
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCosts(t *testing.T) {
+	costs, err := GetCosts(map[string]int64{"call": 20, "i32.add": 3})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), costs[expression.InstrToOpcode["call"]])
+	assert.Equal(t, int64(3), costs[expression.InstrToOpcode["i32.add"]])
+	assert.Equal(t, int64(0), costs[expression.InstrToOpcode["end"]])
+
+	_, err = GetCosts(map[string]int64{"i32.nope": 1})
+	assert.Error(t, err)
+
+	_, err = GetCosts(map[string]int64{"call": -1})
+	assert.Error(t, err)
+}
+
+func TestMeterCode(t *testing.T) {
+	code, err := expression.ExpressionFromWat(`local.get 0
+		if
+		i32.const 1
+		call 0
+		end
+		i32.const 2`)
+	assert.NoError(t, err)
+
+	costs, err := GetCosts(nil)
+	assert.NoError(t, err)
+
+	metered, err := MeterCode(code, costs, "$meter_exhausted")
+	assert.NoError(t, err)
+
+	// Each block is charged at its start
+	charges := make([]int64, 0)
+	for i, e := range metered {
+		if e.Opcode == expression.InstrToOpcode["global.get"] && metered[i+2].Opcode == expression.InstrToOpcode["i64.sub"] {
+			charges = append(charges, metered[i+1].I64Value)
+		}
+	}
+	assert.Equal(t, []int64{2, 6, 1}, charges)
+	assert.Equal(t, len(code)+3*10, len(metered))
+}
@@ -95,13 +95,16 @@ func AddOtel(wasmInput []byte, config Otel_config) ([]byte, error) {
 			return nil, err
 		}
 		mod := &wasmfile.WasmFile{}
-		err = mod.DecodeWat(data)
+		err = mod.DecodeWatFile(file, data)
 		if err != nil {
 			return nil, err
 		}
 
-		ptr = wfile.AddDataFrom(ptr, mod)
-		wfile.AddFuncsFrom(mod, func(remap map[int]int) {
+		ptr, err = wfile.AddDataFrom(ptr, mod)
+		if err != nil {
+			return nil, err
+		}
+		err = wfile.AddFuncsFrom(mod, func(remap map[int]int) {
 			// Fixup
 			// wasi_functions
 			newmap := make(map[int]string)
@@ -113,15 +116,24 @@ func AddOtel(wasmInput []byte, config Otel_config) ([]byte, error) {
 			}
 			wasi_functions = newmap
 		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	watch_memory := false
 	if wfile.LookupImport("scale:watch") != -1 {
 		watch_memory = true
-		wfile.RedirectImport("scale", "watch", "$watch_add")
+		err = wfile.RedirectImport("scale", "watch", "$watch_add")
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	err = wfile.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	if err != nil {
+		return nil, err
+	}
 
 	// Parse the dwarf stuff *here*
 	err = wfile.Debug.ParseDwarfLineNumbers()
@@ -159,9 +171,15 @@ func AddOtel(wasmInput []byte, config Otel_config) ([]byte, error) {
 	// Add the wasi error info
 	addWasiErrorInfo(wfile)
 	// Add function info
-	addFunctionInfo(wfile)
+	err = addFunctionInfo(wfile)
+	if err != nil {
+		return nil, err
+	}
 
-	wfile.AddGlobal("$trace_enable", types.ValI32, "i32.const 1")
+	_, err = wfile.AddGlobal("$trace_enable", types.ValI32, true, "i32.const 1")
+	if err != nil {
+		return nil, err
+	}
 
 	// Now do function adjustments
 	for idx, c := range wfile.Code {
@@ -537,7 +555,7 @@ func AddOtel(wasmInput []byte, config Otel_config) ([]byte, error) {
 
 							wcex, err := expression.ExpressionFromWat(wcode)
 							if err != nil {
-								panic(err)
+								return nil, err
 							}
 							newCode = append(newCode, wcex...)
 						}
@@ -593,11 +611,17 @@ func AddOtel(wasmInput []byte, config Otel_config) ([]byte, error) {
 
 	payload_size := (total_payload_data + 65535) >> 16
 
-	wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	err = wfile.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	if err != nil {
+		return nil, err
+	}
 	wfile.Memory[0].LimitMin = wfile.Memory[0].LimitMin + payload_size
 
 	var buf bytes.Buffer
 	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
 
 	return buf.Bytes(), nil
 }
@@ -693,7 +717,7 @@ func addWasiErrorInfo(wfile *wasmfile.WasmFile) {
  * Add function info to the wasm file.
  *
  */
-func addFunctionInfo(wfile *wasmfile.WasmFile) {
+func addFunctionInfo(wfile *wasmfile.WasmFile) error {
 	// Get a function name map, and add it as data...
 	data_function_names := make([]byte, 0)
 	data_function_names_locs := make([]byte, 0)
@@ -733,5 +757,5 @@ func addFunctionInfo(wfile *wasmfile.WasmFile) {
 	wfile.AddData("$wt_all_function_sigs_locs", []byte(data_function_sigs_locs))
 	wfile.AddData("$wt_all_function_srcs", []byte(data_function_srcs))
 	wfile.AddData("$wt_all_function_srcs_locs", []byte(data_function_srcs_locs))
-	wfile.SetGlobal("$wt_all_function_length", types.ValI32, fmt.Sprintf("i32.const %d", num_functions))
+	return wfile.SetGlobal("$wt_all_function_length", types.ValI32, fmt.Sprintf("i32.const %d", num_functions))
 }
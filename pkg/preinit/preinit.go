@@ -0,0 +1,388 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package preinit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Init functions looked for when none is given, in order
+var DefaultFuncs = []string{"wizer.initialize", "_initialize", "_start"}
+
+// Runs of zero bytes shorter than this are kept inside a data segment, rather than starting a new one
+const dataGap = 16
+
+type Preinit_config struct {
+	Func   string    // Export to run. If empty, the first of DefaultFuncs the module exports
+	Marker string    // Import (module:name) the module calls once it's initialized. The run stops there
+	Args   []string  // Arguments the module sees
+	Stdout io.Writer // Where the module's stdout goes during the run
+	Stderr io.Writer // Where the module's stderr goes during the run
+}
+
+var errMarker = errors.New("marker reached")
+
+const globalExportPrefix = "__wt_preinit_global_"
+
+/**
+ * Run the module's init function, and write the memory and mutable globals it ends up with back
+ * into the module, so it starts up already initialized.
+ */
+func Preinit(wasmInput []byte, config Preinit_config) ([]byte, error) {
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	if len(wfile.Memory) > 1 {
+		return nil, errors.New("Only modules with a single memory are supported")
+	}
+
+	fn := config.Func
+	if fn == "" {
+		for _, f := range DefaultFuncs {
+			if findExport(wfile, f, types.ExportFunc) != -1 {
+				fn = f
+				break
+			}
+		}
+		if fn == "" {
+			return nil, fmt.Errorf("The module exports none of %s", strings.Join(DefaultFuncs, ", "))
+		}
+	}
+	fnExport := findExport(wfile, fn, types.ExportFunc)
+	if fnExport == -1 {
+		return nil, fmt.Errorf("The module doesn't export %s", fn)
+	}
+	if fn == "_start" && config.Marker == "" {
+		return nil, errors.New("_start needs a marker, or it would run the whole program")
+	}
+
+	markerModule, markerName := "", ""
+	if config.Marker != "" {
+		var ok bool
+		markerModule, markerName, ok = strings.Cut(config.Marker, ":")
+		if !ok {
+			return nil, fmt.Errorf("Marker %q should be module:name", config.Marker)
+		}
+		if markerModule == wasi_snapshot_preview1.ModuleName {
+			return nil, errors.New("The marker can't be a wasi import")
+		}
+		if wfile.LookupImport(config.Marker) == -1 {
+			return nil, fmt.Errorf("The module doesn't import %s", config.Marker)
+		}
+	}
+
+	// Export every mutable global, so they can be read after the run
+	originalExports := wfile.Export
+	wfile.Export = append([]*wasmfile.ExportEntry{}, originalExports...)
+	for idx, g := range wfile.Global {
+		if g.Mut == 1 {
+			wfile.Export = append(wfile.Export, &wasmfile.ExportEntry{
+				Name:  fmt.Sprintf("%s%d", globalExportPrefix, idx),
+				Type:  types.ExportGlobal,
+				Index: idx,
+			})
+		}
+	}
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+	wfile.Export = originalExports
+
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+
+	mod, err := run(ctx, r, wfile, buf.Bytes(), fn, markerModule, markerName, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the snapshot
+	if len(wfile.Memory) == 1 {
+		mem := mod.Memory()
+		data, ok := mem.Read(0, mem.Size())
+		if !ok {
+			return nil, errors.New("Could not read memory")
+		}
+		pages := int(mem.Size() / 65536)
+		if wfile.Memory[0].LimitMax != 0 && pages > wfile.Memory[0].LimitMax {
+			return nil, fmt.Errorf("Memory grew to %d pages, past its maximum of %d", pages, wfile.Memory[0].LimitMax)
+		}
+		wfile.Memory[0].LimitMin = pages
+		wfile.Data = dataSegments(data)
+		wfile.Debug.DataNames = make(map[int]string)
+	}
+
+	for idx, g := range wfile.Global {
+		if g.Mut != 1 {
+			continue
+		}
+		eg := mod.ExportedGlobal(fmt.Sprintf("%s%d", globalExportPrefix, idx))
+		if eg == nil {
+			return nil, fmt.Errorf("Global %d wasn't exported", idx)
+		}
+		e, err := globalValue(g.Type, eg.Get())
+		if err != nil {
+			return nil, fmt.Errorf("Global %d: %w", idx, err)
+		}
+		g.Expression = []*expression.Expression{e}
+	}
+
+	// The init function has been run, so it shouldn't be run again. _start still has to run the program.
+	if fn != "_start" {
+		wfile.Export = append(wfile.Export[:fnExport], wfile.Export[fnExport+1:]...)
+	}
+
+	if config.Marker != "" {
+		err = stubMarker(wfile, markerModule, markerName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	var out bytes.Buffer
+	err = wfile.EncodeBinary(&out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+func findExport(wfile *wasmfile.WasmFile, name string, t types.ExportType) int {
+	for idx, e := range wfile.Export {
+		if e.Name == name && e.Type == t {
+			return idx
+		}
+	}
+	return -1
+}
+
+/**
+ * Instantiate the module and call the init function. Imports other than wasi are there so the
+ * module can be instantiated, but fail if they're called, apart from the marker which stops the run.
+ */
+func run(ctx context.Context, r wazero.Runtime, wfile *wasmfile.WasmFile, wasm []byte, fn string, markerModule string, markerName string, config Preinit_config) (api.Module, error) {
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+
+	hostModules := make(map[string]wazero.HostModuleBuilder)
+	moduleNames := make([]string, 0)
+	done := make(map[string]bool)
+	for _, i := range wfile.Import {
+		if i.Module == wasi_snapshot_preview1.ModuleName {
+			continue
+		}
+		full := fmt.Sprintf("%s:%s", i.Module, i.Name)
+		if done[full] {
+			continue
+		}
+		done[full] = true
+		hm, ok := hostModules[i.Module]
+		if !ok {
+			hm = r.NewHostModuleBuilder(i.Module)
+			hostModules[i.Module] = hm
+			moduleNames = append(moduleNames, i.Module)
+		}
+
+		t := wfile.Type[i.Index]
+		params := make([]api.ValueType, 0)
+		for _, p := range t.Param {
+			params = append(params, api.ValueType(p))
+		}
+		results := make([]api.ValueType, 0)
+		for _, rt := range t.Result {
+			results = append(results, api.ValueType(rt))
+		}
+
+		isMarker := i.Module == markerModule && i.Name == markerName
+		hm.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, m api.Module, stack []uint64) {
+			if isMarker {
+				panic(errMarker)
+			}
+			panic(fmt.Errorf("The import %s can't be called during preinit", full))
+		}), params, results).Export(i.Name)
+	}
+
+	sort.Strings(moduleNames)
+	for _, n := range moduleNames {
+		_, err := hostModules[n].Instantiate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	modConfig := wazero.NewModuleConfig().
+		WithStartFunctions().
+		WithArgs(append([]string{"wasm"}, config.Args...)...).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader)
+	if config.Stdout != nil {
+		modConfig = modConfig.WithStdout(config.Stdout)
+	}
+	if config.Stderr != nil {
+		modConfig = modConfig.WithStderr(config.Stderr)
+	}
+
+	mod, err := r.InstantiateWithConfig(ctx, wasm, modConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	f := mod.ExportedFunction(fn)
+	if len(f.Definition().ParamTypes()) != 0 {
+		return nil, fmt.Errorf("%s takes parameters", fn)
+	}
+
+	_, err = f.Call(ctx)
+	if errors.Is(err, errMarker) {
+		return mod, nil
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("The module exited with code %d during preinit", exitErr.ExitCode())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if markerModule != "" {
+		return nil, fmt.Errorf("%s returned without calling %s:%s", fn, markerModule, markerName)
+	}
+	return mod, nil
+}
+
+/**
+ * Make data segments for memory, leaving out long runs of zeros.
+ *
+ */
+func dataSegments(mem []byte) []*wasmfile.DataEntry {
+	segments := make([]*wasmfile.DataEntry, 0)
+	ptr := 0
+	for ptr < len(mem) {
+		if mem[ptr] == 0 {
+			ptr++
+			continue
+		}
+		start := ptr
+		end := ptr
+		for ptr < len(mem) {
+			if mem[ptr] != 0 {
+				ptr++
+				end = ptr
+				continue
+			}
+			// Look for the end of the zeros
+			z := ptr
+			for z < len(mem) && mem[z] == 0 && z-end < dataGap {
+				z++
+			}
+			if z == len(mem) || z-end >= dataGap {
+				break
+			}
+			ptr = z
+		}
+		data := make([]byte, end-start)
+		copy(data, mem[start:end])
+		segments = append(segments, &wasmfile.DataEntry{
+			MemIndex: 0,
+			Offset: []*expression.Expression{
+				{Opcode: expression.InstrToOpcode["i32.const"], I32Value: int32(start)},
+			},
+			Data: data,
+		})
+		ptr = end
+	}
+	return segments
+}
+
+/**
+ * Make a const expression for a global value read from wazero.
+ *
+ */
+func globalValue(t types.ValType, v uint64) (*expression.Expression, error) {
+	switch t {
+	case types.ValI32:
+		return &expression.Expression{Opcode: expression.InstrToOpcode["i32.const"], I32Value: int32(uint32(v))}, nil
+	case types.ValI64:
+		return &expression.Expression{Opcode: expression.InstrToOpcode["i64.const"], I64Value: int64(v)}, nil
+	case types.ValF32:
+		return &expression.Expression{Opcode: expression.InstrToOpcode["f32.const"], F32Value: math.Float32frombits(uint32(v))}, nil
+	case types.ValF64:
+		return &expression.Expression{Opcode: expression.InstrToOpcode["f64.const"], F64Value: math.Float64frombits(v)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported global type %d", t)
+}
+
+/**
+ * Replace the marker import with a function that does nothing, so the module doesn't need it any more.
+ *
+ */
+func stubMarker(wfile *wasmfile.WasmFile, module string, name string) error {
+	iid := wfile.LookupImport(fmt.Sprintf("%s:%s", module, name))
+	t := wfile.Type[wfile.Import[iid].Index]
+
+	expr := make([]*expression.Expression, 0)
+	for _, rt := range t.Result {
+		e, err := globalValue(rt, 0)
+		if err != nil {
+			return err
+		}
+		expr = append(expr, e)
+	}
+
+	newidx := len(wfile.Import) + len(wfile.Code)
+	stub := "$wt_preinit_marker"
+	wfile.Function = append(wfile.Function, &wasmfile.FunctionEntry{
+		TypeIndex: wfile.Import[iid].Index,
+	})
+	wfile.Code = append(wfile.Code, &wasmfile.CodeEntry{
+		Locals:     make([]types.ValType, 0),
+		Expression: expr,
+	})
+	wfile.Debug.FunctionNames[newidx] = stub
+
+	return wfile.RedirectImport(module, name, stub)
+}
@@ -0,0 +1,115 @@
+package preinit
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero"
+)
+
+const testWat = `(module
+  (type (func))
+  (type (func (result i32)))
+  (import "env" "ready" (func $ready (type 0)))
+  (memory 1)
+  (global $counter (mut i32) (i32.const 0))
+  (global $big (mut i64) (i64.const 0))
+  (func $init (type 0)
+    i32.const 100
+    i32.const 305419896
+    i32.store
+    i32.const 1
+    memory.grow
+    drop
+    i32.const 70000
+    i32.const 42
+    i32.store
+    i32.const 5
+    global.set $counter
+    i64.const -3
+    global.set $big
+  )
+  (func $start (type 0)
+    i32.const 7
+    global.set $counter
+    call 0
+    i32.const 99
+    global.set $counter
+  )
+  (func $get (type 1)
+    global.get $counter
+    i32.const 100
+    i32.load
+    i32.add
+  )
+  (export "memory" (memory 0))
+  (export "wizer.initialize" (func 1))
+  (export "_start" (func 2))
+  (export "get" (func 3))
+)
+`
+
+func TestPreinit(t *testing.T) {
+	out, err := Preinit(testutil.Binary(t, testWat), Preinit_config{})
+	assert.NoError(t, err)
+
+	wf := &wasmfile.WasmFile{}
+	assert.NoError(t, wf.DecodeBinary(out))
+	assert.NoError(t, wf.Validate())
+
+	for _, e := range wf.Export {
+		assert.NotEqual(t, "wizer.initialize", e.Name)
+	}
+	assert.Equal(t, 2, wf.Memory[0].LimitMin)
+	assert.Equal(t, int32(5), wf.Global[0].Expression[0].I32Value)
+	assert.Equal(t, int64(-3), wf.Global[1].Expression[0].I64Value)
+	assert.Equal(t, 2, len(wf.Data))
+
+	// The snapshot should be there as soon as it's instantiated
+	ctx, r := testutil.Runtime(t)
+	_, err = r.NewHostModuleBuilder("env").NewFunctionBuilder().WithFunc(func() {}).Export("ready").Instantiate(ctx)
+	assert.NoError(t, err)
+	mod, err := r.InstantiateWithConfig(ctx, out, wazero.NewModuleConfig().WithStartFunctions())
+	assert.NoError(t, err)
+	res, err := mod.ExportedFunction("get").Call(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(305419901), res[0])
+	v, ok := mod.Memory().ReadUint32Le(70000)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(42), v)
+}
+
+func TestPreinitMarker(t *testing.T) {
+	_, err := Preinit(testutil.Binary(t, testWat), Preinit_config{Func: "_start"})
+	assert.Error(t, err)
+
+	out, err := Preinit(testutil.Binary(t, testWat), Preinit_config{Func: "_start", Marker: "env:ready"})
+	assert.NoError(t, err)
+
+	wf := &wasmfile.WasmFile{}
+	assert.NoError(t, wf.DecodeBinary(out))
+	assert.NoError(t, wf.Validate())
+
+	// Stopped at the marker, which has gone
+	assert.Equal(t, 0, len(wf.Import))
+	assert.Equal(t, expression.InstrToOpcode["i32.const"], wf.Global[0].Expression[0].Opcode)
+	assert.Equal(t, int32(7), wf.Global[0].Expression[0].I32Value)
+	assert.Equal(t, 0, len(wf.Data))
+	assert.Equal(t, 1, wf.Memory[0].LimitMin)
+
+	// _start is still there to run the program
+	ctx, r := testutil.Runtime(t)
+	mod, err := r.InstantiateWithConfig(ctx, out, wazero.NewModuleConfig().WithStartFunctions())
+	assert.NoError(t, err)
+	_, err = mod.ExportedFunction("_start").Call(ctx)
+	assert.NoError(t, err)
+	res, err := mod.ExportedFunction("get").Call(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(99), res[0])
+
+	_, err = Preinit(testutil.Binary(t, testWat), Preinit_config{Func: "_start", Marker: "env:missing"})
+	assert.Error(t, err)
+}
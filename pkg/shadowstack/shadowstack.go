@@ -0,0 +1,164 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package shadowstack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+// The export a host calls to get the backtrace, as __backtrace(ptr i32, len i32) -> i32
+const Export = "__backtrace"
+
+// How many calls are kept if the config doesn't say
+const DefaultSize = 1024
+
+type Shadowstack_config struct {
+	Size int // The most calls kept, innermost first. 0 for DefaultSize
+}
+
+/**
+ * Add a shadow call stack to a wasm. Every function pushes its ID on entry and pops it on exit, and
+ * __backtrace is exported so a host can get the calls in progress, such as after a trap.
+ * Function IDs are the same as in the input, so the host can use its name section.
+ */
+func AddShadowStack(wasmInput []byte, config Shadowstack_config) ([]byte, error) {
+	if config.Size < 0 {
+		return nil, errors.New("The size must not be negative")
+	}
+	size := config.Size
+	if size == 0 {
+		size = DefaultSize
+	}
+
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	if len(wfile.Memory) == 0 {
+		return nil, errors.New("The module has no memory")
+	}
+	for _, e := range wfile.Export {
+		if e.Name == Export {
+			return nil, fmt.Errorf("The module already exports %s", Export)
+		}
+	}
+
+	originalFunctionLength := len(wfile.Code)
+
+	// Load up the individual wat files, and add them in
+	files := []string{
+		"memory.wat",
+		"shadowstack.wat"}
+
+	payload, err := wfile.AddPayload(files)
+	if err != nil {
+		return nil, err
+	}
+
+	payload.AddData("$shadow_stack", make([]byte, size*4))
+
+	err = wfile.SetGlobal("$shadow_size", types.ValI32, fmt.Sprintf("i32.const %d", size))
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, c := range wfile.Code {
+		if idx < originalFunctionLength {
+			functionIndex := idx + len(wfile.Import)
+
+			err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
+			if err != nil {
+				return nil, err
+			}
+			err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
+			if err != nil {
+				return nil, err
+			}
+
+			blockInstr := "block"
+			t := wfile.Type[wfile.Function[idx].TypeIndex]
+			if len(t.Result) > 0 {
+				blockInstr = fmt.Sprintf("block (result %s)", types.ByteToValType[t.Result[0]])
+			}
+
+			startCode := fmt.Sprintf(`i32.const %d
+				call $shadow_enter`, functionIndex)
+			endCode := "call $shadow_exit"
+
+			err = c.InsertFuncStart(wfile, startCode+"\n"+blockInstr)
+			if err != nil {
+				return nil, err
+			}
+			err = c.ReplaceInstr(wfile, "return", endCode+"\nreturn")
+			if err != nil {
+				return nil, err
+			}
+			err = c.InsertFuncEnd(wfile, "end\n"+endCode)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = payload.Resolve(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wfile.Export = append(wfile.Export, &wasmfile.ExportEntry{
+		Name:  Export,
+		Type:  types.ExportFunc,
+		Index: wfile.Debug.LookupFunctionID("$" + Export),
+	})
+
+	_, err = payload.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode what __backtrace wrote, given the count it returned
+func DecodeBacktrace(data []byte, count uint32) []int {
+	fids := make([]int, 0)
+	for i := 0; i+4 <= len(data) && uint32(len(fids)) < count; i += 4 {
+		fids = append(fids, int(binary.LittleEndian.Uint32(data[i:])))
+	}
+	return fids
+}
@@ -0,0 +1,119 @@
+package shadowstack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const testWat = `(module
+  (type (func (param i32) (result i32)))
+  (type (func (result i32)))
+  (memory 2)
+  (func $outer (type 0)
+    local.get 0
+    call 1
+    i32.const 1
+    i32.add
+  )
+  (func $middle (type 0)
+    local.get 0
+    i32.eqz
+    if
+      i32.const 0
+      return
+    end
+    local.get 0
+    call 2
+  )
+  (func $inner (type 0)
+    i32.const 100
+    local.get 0
+    i32.const 1
+    i32.sub
+    i32.div_u
+  )
+  (func $grow (type 1)
+    i32.const 1
+    memory.grow
+    drop
+    memory.size
+  )
+  (func $greeting (type 1)
+    i32.const 100000
+    i32.const 4096
+    i32.load
+    i32.store
+    i32.const 100000
+    i32.load
+  )
+  (export "memory" (memory 0))
+  (export "outer" (func 0))
+  (export "grow" (func 3))
+  (export "greeting" (func 4))
+  (data (i32.const 4096) "hi!!")
+)
+`
+
+func backtrace(t *testing.T, mod api.Module, room uint32) []int {
+	res, err := mod.ExportedFunction(Export).Call(context.Background(), 16, uint64(room))
+	assert.NoError(t, err)
+	data, ok := mod.Memory().Read(16, room)
+	assert.True(t, ok)
+	return DecodeBacktrace(data, uint32(res[0]))
+}
+
+func TestShadowStack(t *testing.T) {
+	out, err := AddShadowStack(testutil.Binary(t, testWat), Shadowstack_config{Size: 2})
+	assert.NoError(t, err)
+
+	wf := &wasmfile.WasmFile{}
+	assert.NoError(t, wf.DecodeBinary(out))
+	assert.NoError(t, wf.Validate())
+
+	_, err = AddShadowStack(out, Shadowstack_config{})
+	assert.Error(t, err)
+
+	ctx, mod := testutil.Instantiate(t, out)
+
+	// Early returns pop the stack too
+	res, err := mod.ExportedFunction("outer").Call(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, res)
+	assert.Equal(t, []int{}, backtrace(t, mod, 64))
+
+	res, err = mod.ExportedFunction("outer").Call(ctx, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{26}, res)
+
+	// Divide by zero in $inner. Only the innermost two calls fit in the ring.
+	_, err = mod.ExportedFunction("outer").Call(ctx, 1)
+	assert.Error(t, err)
+	assert.Equal(t, []int{2, 1}, backtrace(t, mod, 64))
+	assert.Equal(t, []int{2}, backtrace(t, mod, 4))
+
+	// The payload goes after all of the module's memory, not after its data
+	res, err = mod.ExportedFunction("greeting").Call(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0x21216968}, res)
+
+	// The module only sees its own memory
+	res, err = mod.ExportedFunction("grow").Call(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3}, res)
+}
+
+func TestShadowStackDepth(t *testing.T) {
+	out, err := AddShadowStack(testutil.Binary(t, testWat), Shadowstack_config{})
+	assert.NoError(t, err)
+
+	ctx, mod := testutil.Instantiate(t, out)
+
+	_, err = mod.ExportedFunction("outer").Call(ctx, 1)
+	assert.Error(t, err)
+	assert.Equal(t, []int{2, 1, 0}, backtrace(t, mod, 64))
+}
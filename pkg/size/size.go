@@ -0,0 +1,143 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package size
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+const (
+	KindFunction = "function"
+	KindData     = "data"
+	KindCustom   = "custom"
+)
+
+type Item struct {
+	Kind string
+	Name string
+	Size int
+}
+
+type Report struct {
+	Items []*Item
+	Total int // Total size of the module, for percentages
+}
+
+/**
+ * Work out how many bytes each function, data segment and custom section takes up.
+ * Function sizes are the encoded body size including locals, taken from the original binary
+ * where possible.
+ */
+func Profile(wf *wasmfile.WasmFile) (*Report, error) {
+	r := &Report{}
+
+	var buf bytes.Buffer
+	err := wf.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+	r.Total = buf.Len()
+
+	for idx, c := range wf.Code {
+		fid := len(wf.Import) + idx
+		name := wf.Debug.GetFunctionIdentifier(fid, true)
+		if name == "" {
+			name = fmt.Sprintf("code[%d]", idx)
+		}
+		size := int(c.CodeSectionLen)
+		if size == 0 {
+			// Not from a binary, so encode it to find out.
+			var cbuf bytes.Buffer
+			err = c.EncodeBinary(&cbuf)
+			if err != nil {
+				return nil, err
+			}
+			// Don't count the length prefix, to match CodeSectionLen
+			_, l := binary.Uvarint(cbuf.Bytes())
+			size = cbuf.Len() - l
+		}
+		r.Items = append(r.Items, &Item{Kind: KindFunction, Name: name, Size: size})
+	}
+
+	for idx, d := range wf.Data {
+		name := wf.Debug.DataNames[idx]
+		if name == "" {
+			name = fmt.Sprintf("data[%d]", idx)
+		}
+		r.Items = append(r.Items, &Item{Kind: KindData, Name: name, Size: len(d.Data)})
+	}
+
+	for _, c := range wf.Custom {
+		r.Items = append(r.Items, &Item{Kind: KindCustom, Name: c.Name, Size: len(c.Data)})
+	}
+
+	return r, nil
+}
+
+// Sort by size, largest first. Items of the same size are sorted by name.
+func (r *Report) SortBySize() {
+	sort.SliceStable(r.Items, func(i, j int) bool {
+		if r.Items[i].Size != r.Items[j].Size {
+			return r.Items[i].Size > r.Items[j].Size
+		}
+		return r.Items[i].Name < r.Items[j].Name
+	})
+}
+
+func (r *Report) SortByName() {
+	sort.SliceStable(r.Items, func(i, j int) bool {
+		return r.Items[i].Name < r.Items[j].Name
+	})
+}
+
+// Only keep the first n items. Anything else is summed up in a single item.
+func (r *Report) Top(n int) {
+	if n <= 0 || n >= len(r.Items) {
+		return
+	}
+	rest := &Item{}
+	for _, i := range r.Items[n:] {
+		rest.Size += i.Size
+	}
+	rest.Name = fmt.Sprintf("... and %d more", len(r.Items)-n)
+	r.Items = append(r.Items[:n], rest)
+}
+
+func (r *Report) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%10s %7s  %-9s %s\n", "Bytes", "%", "Kind", "Name")
+	if err != nil {
+		return err
+	}
+	for _, i := range r.Items {
+		percent := 0.0
+		if r.Total > 0 {
+			percent = float64(i.Size) * 100 / float64(r.Total)
+		}
+		_, err = fmt.Fprintf(w, "%10d %6.2f%%  %-9s %s\n", i.Size, percent, i.Kind, i.Name)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "%10d %6.2f%%  %-9s %s\n", r.Total, 100.0, "", "Total")
+	return err
+}
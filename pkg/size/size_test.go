@@ -0,0 +1,53 @@
+package size
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (memory 1)
+
+  (func $small
+    nop
+  )
+
+  (func $big (result i32)
+    i32.const 1
+    i32.const 2
+    i32.add
+    i32.const 3
+    i32.add
+  )
+
+  (data $message "Hello world, this is a longer message")
+)
+`
+
+func TestProfile(t *testing.T) {
+	wf := wasmfile.NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(testWat)))
+	wf.Custom = append(wf.Custom, &wasmfile.CustomEntry{Name: "license", Data: []byte("MIT")})
+
+	r, err := Profile(wf)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(r.Items))
+
+	r.SortBySize()
+	assert.Equal(t, "$message", r.Items[0].Name)
+	assert.Equal(t, 37, r.Items[0].Size)
+	assert.Equal(t, "$big", r.Items[1].Name)
+	assert.Equal(t, KindFunction, r.Items[1].Kind)
+
+	r.Top(2)
+	assert.Equal(t, 3, len(r.Items))
+	assert.Equal(t, "... and 2 more", r.Items[2].Name)
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.WriteText(&buf))
+	assert.True(t, strings.Contains(buf.String(), "$message"))
+}
@@ -0,0 +1,251 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/wat"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+// The functions the host uses to checkpoint and roll back the module
+var Exports = []string{"__snapshot", "__restore"}
+
+// Layout of the snapshot buffer. See snapshot.wat
+const (
+	BitmapOffset  = 8
+	GlobalsOffset = 8200
+	PageRecord    = 65540
+)
+
+// Bytes written by each instruction that writes to memory. The bulk instructions take a length.
+var writeSizes = map[string]int{
+	"i32.store":   4,
+	"i64.store":   8,
+	"f32.store":   4,
+	"f64.store":   8,
+	"i32.store8":  1,
+	"i32.store16": 2,
+	"i64.store8":  1,
+	"i64.store16": 2,
+	"i64.store32": 4,
+	"memory.fill": 0,
+	"memory.copy": 0,
+}
+
+/**
+ * Get the size of the buffer needed to save a number of pages.
+ *
+ */
+func BufferSize(wfile *wasmfile.WasmFile, pages int) int {
+	return GlobalsOffset + 8*len(mutableGlobals(wfile)) + pages*PageRecord
+}
+
+func mutableGlobals(wfile *wasmfile.WasmFile) []int {
+	globals := make([]int, 0)
+	for idx, g := range wfile.Global {
+		if g.Mut == 1 {
+			globals = append(globals, idx)
+		}
+	}
+	return globals
+}
+
+/**
+ * Add snapshot and restore exports to a wasm, with tracking of the pages written to.
+ *
+ */
+func AddSnapshot(wasmInput []byte) ([]byte, error) {
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	if len(wfile.Memory) == 0 {
+		return nil, errors.New("The module has no memory")
+	}
+	for _, e := range wfile.Export {
+		for _, name := range Exports {
+			if e.Name == name {
+				return nil, fmt.Errorf("The module already exports %s", name)
+			}
+		}
+	}
+
+	// Only the module's own globals are saved
+	globals := mutableGlobals(wfile)
+	saveCode := make([]string, 0)
+	loadCode := make([]string, 0)
+	for n, idx := range globals {
+		t := wfile.Global[idx].Type
+		tname, ok := types.ByteToValType[t]
+		if !ok || (t != types.ValI32 && t != types.ValI64 && t != types.ValF32 && t != types.ValF64) {
+			return nil, fmt.Errorf("Global %d has a type that can't be saved", idx)
+		}
+		saveCode = append(saveCode, fmt.Sprintf(`local.get $ptr
+			global.get %d
+			%s.store offset=%d`, idx, tname, n*8))
+		loadCode = append(loadCode, fmt.Sprintf(`local.get $ptr
+			%s.load offset=%d
+			global.set %d`, tname, n*8, idx))
+	}
+
+	originalFunctionLength := len(wfile.Code)
+
+	// There's no payload data, so the code can go straight in
+	data, err := wat.Wat_content.ReadFile(path.Join("wat_code", "snapshot.wat"))
+	if err != nil {
+		return nil, err
+	}
+	mod := &wasmfile.WasmFile{}
+	err = mod.DecodeWatFile("snapshot.wat", data)
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.AddFuncsFrom(mod, func(remap map[int]int) {})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = wfile.AddFunctionFromWat("$__snapshot_save_globals", fmt.Sprintf("(func (param $ptr i32) %s)", strings.Join(saveCode, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	_, err = wfile.AddFunctionFromWat("$__snapshot_load_globals", fmt.Sprintf("(func (param $ptr i32) %s)", strings.Join(loadCode, "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	err = wfile.SetGlobal("$__snapshot_globals_size", types.ValI32, fmt.Sprintf("i32.const %d", len(globals)*8))
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, c := range wfile.Code {
+		if idx < originalFunctionLength {
+			err = TrackWrites(c, wfile.Type[wfile.Function[idx].TypeIndex])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = c.ResolveGlobals(wfile)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.ResolveFunctions(wfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range Exports {
+		wfile.Export = append(wfile.Export, &wasmfile.ExportEntry{
+			Name:  name,
+			Type:  types.ExportFunc,
+			Index: wfile.Debug.LookupFunctionID("$" + name),
+		})
+	}
+
+	wfile.SetCustomSection("name", wfile.Debug.EncodeNameSectionData())
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+/**
+ * Call $__snapshot_touch before every write to memory in some code.
+ *
+ */
+func TrackWrites(c *wasmfile.CodeEntry, te *wasmfile.TypeEntry) error {
+	// Scratch locals - the address, the i32 value or length, the fill value, and the other value types
+	localAddr := len(te.Param) + len(c.Locals)
+	localI32 := localAddr + 1
+	localFill := localAddr + 2
+	localByType := map[types.ValType]int{
+		types.ValI32: localI32,
+		types.ValI64: localAddr + 3,
+		types.ValF32: localAddr + 4,
+		types.ValF64: localAddr + 5,
+	}
+	tracked := false
+
+	newCode := make([]*expression.Expression, 0, len(c.Expression))
+	for _, e := range c.Expression {
+		name := e.Name()
+		size, ok := writeSizes[name]
+		if !ok {
+			newCode = append(newCode, e)
+			continue
+		}
+		tracked = true
+
+		var wcode string
+		if size == 0 {
+			wcode = fmt.Sprintf(`local.set %d
+				local.set %d
+				local.tee %d
+				i32.const 0
+				local.get %d
+				call $__snapshot_touch
+				local.get %d
+				local.get %d
+				local.get %d`, localI32, localFill, localAddr, localI32, localAddr, localFill, localI32)
+		} else {
+			// The value type is in the name, eg i64.store8 stores an i64
+			t := types.ValTypeToByte[name[:3]]
+			wcode = fmt.Sprintf(`local.set %d
+				local.tee %d
+				i32.const %d
+				i32.const %d
+				call $__snapshot_touch
+				local.get %d
+				local.get %d`, localByType[t], localAddr, int32(uint32(e.MemOffset)), size, localAddr, localByType[t])
+		}
+		wcex, err := expression.ExpressionFromWat(wcode)
+		if err != nil {
+			return err
+		}
+		newCode = append(newCode, wcex...)
+		newCode = append(newCode, e)
+	}
+
+	if tracked {
+		c.Locals = append(c.Locals, types.ValI32, types.ValI32, types.ValI32, types.ValI64, types.ValF32, types.ValF64)
+		c.Expression = newCode
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/testutil"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (type (func (param i32 i32)))
+  (type (func (param i32 i32 i32)))
+  (type (func (result i32)))
+  (memory 5)
+  (global $count (mut i32) (i32.const 0))
+  (global $last (mut i64) (i64.const 0))
+  (func $write (type 0)
+    local.get 0
+    local.get 1
+    i32.store
+    global.get $count
+    i32.const 1
+    i32.add
+    global.set $count
+  )
+  (func $write64 (type 0)
+    local.get 0
+    local.get 1
+    i64.extend_i32_u
+    i64.store offset=65535
+    local.get 1
+    i64.extend_i32_u
+    global.set $last
+  )
+  (func $fill (type 1)
+    local.get 0
+    local.get 1
+    local.get 2
+    memory.fill
+  )
+  (func $count (type 2)
+    global.get $count
+  )
+  (export "memory" (memory 0))
+  (export "write" (func 0))
+  (export "write64" (func 1))
+  (export "fill" (func 2))
+  (export "count" (func 3))
+)
+`
+
+func TestSnapshot(t *testing.T) {
+	out, err := AddSnapshot(testutil.Binary(t, testWat))
+	assert.NoError(t, err)
+
+	wf := &wasmfile.WasmFile{}
+	assert.NoError(t, wf.DecodeBinary(out))
+	assert.NoError(t, wf.Validate())
+
+	_, err = AddSnapshot(out)
+	assert.Error(t, err)
+
+	ctx, mod := testutil.Instantiate(t, out)
+	mem := mod.Memory()
+
+	call := func(name string, params ...uint64) {
+		_, err := mod.ExportedFunction(name).Call(ctx, params...)
+		assert.NoError(t, err)
+	}
+	read := func(addr uint32) uint32 {
+		v, ok := mem.ReadUint32Le(addr)
+		assert.True(t, ok)
+		return v
+	}
+
+	// The buffer goes in the last three pages, out of the module's way
+	const buf = 2 * 65536
+	mem.WriteUint32Le(buf, 5*65536)
+
+	call("write", 100, 1)
+	call("__snapshot", buf)
+	assert.Equal(t, uint32(0), read(buf+BitmapOffset))
+
+	call("write", 100, 2)
+	call("write64", 4, 7)
+	call("fill", 10, 9, 20)
+	assert.Equal(t, uint32(2), read(100))
+	assert.Equal(t, uint32(7), read(65539))
+
+	// Pages 0 and 1 are dirty
+	assert.Equal(t, uint32(3), read(buf+BitmapOffset))
+	assert.Equal(t, uint32(buf+GlobalsOffset+16+2*PageRecord), read(buf+4))
+
+	call("__restore", buf)
+	assert.Equal(t, uint32(1), read(100))
+	assert.Equal(t, uint32(0), read(65539))
+	assert.Equal(t, uint32(0), read(10))
+	assert.Equal(t, uint32(0), read(buf+BitmapOffset))
+	res, err := mod.ExportedFunction("count").Call(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), res[0])
+
+	// And again
+	call("write", 100, 3)
+	call("__restore", buf)
+	assert.Equal(t, uint32(1), read(100))
+
+	// Stopped, so nothing is saved
+	call("__snapshot", 0)
+	call("write", 100, 4)
+	assert.Equal(t, uint32(0), read(buf+BitmapOffset))
+}
@@ -0,0 +1,233 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package stackdepth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+type Stackdepth_config struct {
+	Limit    int    // Trap when the call depth goes over this. 0 for no limit
+	SPGlobal string // Name or index of the stack pointer global. If empty, __stack_pointer is used if there is one
+}
+
+/**
+ * Find the stack pointer global, and its starting value. Returns -1 if there isn't one.
+ *
+ */
+func FindStackPointer(wfile *wasmfile.WasmFile, name string) (int, int32, error) {
+	gid := -1
+	if name == "" {
+		gid = wfile.Debug.LookupGlobalID("$__stack_pointer")
+		if gid == -1 {
+			return -1, 0, nil
+		}
+	} else if idx, err := strconv.Atoi(name); err == nil {
+		gid = idx
+	} else {
+		if name[0] != '$' {
+			name = "$" + name
+		}
+		gid = wfile.Debug.LookupGlobalID(name)
+	}
+	if gid < 0 || gid >= len(wfile.Global) {
+		return -1, 0, fmt.Errorf("Stack pointer global %s not found", name)
+	}
+
+	g := wfile.Global[gid]
+	if g.Type != types.ValI32 || len(g.Expression) != 1 || g.Expression[0].Opcode != expression.InstrToOpcode["i32.const"] {
+		return -1, 0, fmt.Errorf("Stack pointer global %s should be an i32 set to a constant", name)
+	}
+	return gid, g.Expression[0].I32Value, nil
+}
+
+/**
+ * Add stack depth tracking to a wasm.
+ *
+ */
+func AddStackdepth(wasmInput []byte, config Stackdepth_config) ([]byte, error) {
+	if config.Limit < 0 {
+		return nil, errors.New("The depth limit must not be negative")
+	}
+
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	if len(wfile.Memory) == 0 {
+		return nil, errors.New("The module has no memory")
+	}
+
+	// Globals from the wat code go after the existing ones, so this index stays the same
+	spGlobal, spStart, err := FindStackPointer(wfile, config.SPGlobal)
+	if err != nil {
+		return nil, err
+	}
+
+	originalFunctionLength := len(wfile.Code)
+
+	// Load up the individual wat files, and add them in
+	files := []string{
+		"memory.wat",
+		"stdout.wat",
+		"stackdepth.wat"}
+
+	payload, err := wfile.AddPayload(files)
+	if err != nil {
+		return nil, err
+	}
+
+	num_functions := len(wfile.Import) + len(wfile.Code)
+	data_function_names := make([]byte, 0)
+	data_function_locs := make([]byte, 0)
+	for fid := 0; fid < num_functions; fid++ {
+		name := wfile.Debug.GetFunctionIdentifier(fid, false)
+		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len(data_function_names)))
+		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len([]byte(name))))
+		data_function_names = append(data_function_names, []byte(name)...)
+	}
+	payload.AddData("$wt_all_function_names", data_function_names)
+	payload.AddData("$wt_all_function_names_locs", data_function_locs)
+
+	for _, g := range []struct {
+		name  string
+		value int
+	}{
+		{"$stack_limit", config.Limit},
+		{"$stack_sp_tracked", boolToInt(spGlobal != -1)},
+		{"$stack_sp_start", int(spStart)},
+	} {
+		err = wfile.SetGlobal(g.name, types.ValI32, fmt.Sprintf("i32.const %d", g.value))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The report is shown at proc_exit, or when _start returns
+	procExit := -1
+	for idx, i := range wfile.Import {
+		if i.Module == "wasi_snapshot_preview1" && i.Name == "proc_exit" {
+			procExit = idx
+		}
+	}
+	startFid := -1
+	for _, ex := range wfile.Export {
+		if ex.Type == types.ExportFunc && ex.Name == "_start" {
+			startFid = ex.Index
+		}
+	}
+
+	for idx, c := range wfile.Code {
+		if idx < originalFunctionLength {
+			functionIndex := idx + len(wfile.Import)
+
+			// Report before exit
+			newCode := make([]*expression.Expression, 0)
+			for _, e := range c.Expression {
+				if e.Opcode == expression.InstrToOpcode["call"] && !e.FunctionNeedsLinking && e.FuncIndex == procExit {
+					wcex, err := expression.ExpressionFromWat("call $stack_report")
+					if err != nil {
+						return nil, err
+					}
+					newCode = append(newCode, wcex...)
+				}
+				newCode = append(newCode, e)
+			}
+			c.Expression = newCode
+
+			err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
+			if err != nil {
+				return nil, err
+			}
+			err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
+			if err != nil {
+				return nil, err
+			}
+
+			blockInstr := "block"
+			t := wfile.Type[wfile.Function[idx].TypeIndex]
+			if len(t.Result) > 0 {
+				blockInstr = fmt.Sprintf("block (result %s)", types.ByteToValType[t.Result[0]])
+			}
+
+			startCode := fmt.Sprintf(`i32.const %d
+				call $stack_enter`, functionIndex)
+			if spGlobal != -1 {
+				startCode = fmt.Sprintf(`i32.const %d
+				global.get %d
+				call $stack_enter_sp`, functionIndex, spGlobal)
+			}
+			endCode := "call $stack_exit"
+			if functionIndex == startFid {
+				endCode = "call $stack_exit\ncall $stack_report"
+			}
+
+			err = c.InsertFuncStart(wfile, startCode+"\n"+blockInstr)
+			if err != nil {
+				return nil, err
+			}
+			err = c.ReplaceInstr(wfile, "return", endCode+"\nreturn")
+			if err != nil {
+				return nil, err
+			}
+			err = c.InsertFuncEnd(wfile, "end\n"+endCode)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = payload.Resolve(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = payload.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,48 @@
+package stackdepth
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+	"github.com/stretchr/testify/assert"
+)
+
+const testWat = `(module
+  (memory 1)
+  (global $counter (mut i32) (i32.const 0))
+  (global $__stack_pointer (mut i32) (i32.const 65536))
+  (global $big (mut i64) (i64.const 0))
+)
+`
+
+func TestFindStackPointer(t *testing.T) {
+	wf := wasmfile.NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(testWat)))
+
+	gid, start, err := FindStackPointer(wf, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, gid)
+	assert.Equal(t, int32(65536), start)
+
+	gid, start, err = FindStackPointer(wf, "0")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, gid)
+	assert.Equal(t, int32(0), start)
+
+	gid, _, err = FindStackPointer(wf, "counter")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, gid)
+
+	_, _, err = FindStackPointer(wf, "big")
+	assert.Error(t, err)
+
+	_, _, err = FindStackPointer(wf, "missing")
+	assert.Error(t, err)
+
+	// No stack pointer is fine, unless one was asked for
+	wf = wasmfile.NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte("(module (memory 1))")))
+	gid, _, err = FindStackPointer(wf, "")
+	assert.NoError(t, err)
+	assert.Equal(t, -1, gid)
+}
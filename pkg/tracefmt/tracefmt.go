@@ -0,0 +1,162 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tracefmt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Event is a single chrome trace event, as written by strace --format=chrome
+type Event struct {
+	Ph   string          `json:"ph"`
+	Pid  int             `json:"pid"`
+	Tid  int             `json:"tid"`
+	Ts   float64         `json:"ts"`
+	S    string          `json:"s,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// ReadEvents reads the trace events from a strace --format=chrome log.
+// The trace is usually mixed in with the program's own output, so anything that isn't an event is skipped.
+func ReadEvents(r io.Reader) ([]*Event, error) {
+	events := make([]*Event, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Program output without a newline can end up in front of the event
+		idx := strings.Index(line, `{"ph":`)
+		if idx == -1 {
+			continue
+		}
+		line = strings.TrimSuffix(strings.TrimSpace(line[idx:]), ",")
+
+		ev := &Event{}
+		err := json.Unmarshal([]byte(line), ev)
+		if err != nil {
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// WriteChrome writes the events as a complete JSON array, for chrome://tracing, perfetto or speedscope
+func WriteChrome(w io.Writer, events []*Event) error {
+	_, err := io.WriteString(w, "[\n")
+	if err != nil {
+		return err
+	}
+	for i, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		sep := ",\n"
+		if i == len(events)-1 {
+			sep = "\n"
+		}
+		_, err = fmt.Fprintf(w, "%s%s", data, sep)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
+
+type frame struct {
+	name  string
+	start float64
+	child float64
+}
+
+// Folded works out the self time in ns for each distinct call stack.
+// Calls which haven't returned by the end of the trace are ended at the last timestamp.
+func Folded(events []*Event) map[string]uint64 {
+	totals := make(map[string]float64)
+	stacks := make(map[int][]*frame)
+	last := 0.0
+
+	pop := func(tid int, ts float64) {
+		stack := stacks[tid]
+		f := stack[len(stack)-1]
+		names := make([]string, len(stack))
+		for i, sf := range stack {
+			names[i] = sf.name
+		}
+		duration := ts - f.start
+		totals[strings.Join(names, ";")] += duration - f.child
+		stack = stack[:len(stack)-1]
+		if len(stack) > 0 {
+			stack[len(stack)-1].child += duration
+		}
+		stacks[tid] = stack
+	}
+
+	for _, ev := range events {
+		if ev.Ts > last {
+			last = ev.Ts
+		}
+		switch ev.Ph {
+		case "B":
+			stacks[ev.Tid] = append(stacks[ev.Tid], &frame{name: ev.Name, start: ev.Ts})
+		case "E":
+			if len(stacks[ev.Tid]) > 0 {
+				pop(ev.Tid, ev.Ts)
+			}
+		}
+	}
+
+	for tid := range stacks {
+		for len(stacks[tid]) > 0 {
+			pop(tid, last)
+		}
+	}
+
+	folded := make(map[string]uint64)
+	for stack, us := range totals {
+		folded[stack] = uint64(math.Round(math.Max(us, 0) * 1000))
+	}
+	return folded
+}
+
+// WriteFolded writes the events as folded stack lines "a;b;c <self ns>", for flamegraph.pl or speedscope
+func WriteFolded(w io.Writer, events []*Event) error {
+	folded := Folded(events)
+	stacks := make([]string, 0, len(folded))
+	for stack := range folded {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	for _, stack := range stacks {
+		// Names can't have spaces in them in this format
+		_, err := fmt.Fprintf(w, "%s %d\n", strings.ReplaceAll(stack, " ", "_"), folded[stack])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package tracefmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTrace = `Hello from the program
+[
+{"ph":"B","pid":1,"tid":1,"ts":0.000,"name":"main","args":{"params":[]}},
+{"ph":"B","pid":1,"tid":1,"ts":10.000,"name":"$work fn","args":{"params":[{"type":"i32","value":"0x00000001"}]}},
+{"ph":"i","s":"t","pid":1,"tid":1,"ts":10,"name":"context","args":{"text":"work.c:1-5"}},
+partial line{"ph":"E","pid":1,"tid":1,"ts":25.500,"name":"$work fn","args":{"result":{"type":"i32","value":"0x00000002"}}},
+{"ph":"B","pid":1,"tid":1,"ts":30.000,"name":"proc_exit","args":{"params":[]}},
+`
+
+func TestReadEvents(t *testing.T) {
+	events, err := ReadEvents(strings.NewReader(testTrace))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(events))
+	assert.Equal(t, "E", events[3].Ph)
+	assert.Equal(t, 25.5, events[3].Ts)
+	assert.Equal(t, "$work fn", events[3].Name)
+}
+
+func TestWriteChrome(t *testing.T) {
+	events, err := ReadEvents(strings.NewReader(testTrace))
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteChrome(&buf, events))
+
+	var decoded []*Event
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, events, decoded)
+}
+
+func TestWriteFolded(t *testing.T) {
+	events, err := ReadEvents(strings.NewReader(testTrace))
+	assert.NoError(t, err)
+
+	folded := Folded(events)
+	assert.Equal(t, map[string]uint64{
+		"main":           14500,
+		"main;$work fn":  15500,
+		"main;proc_exit": 0,
+	}, folded)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteFolded(&buf, events))
+	assert.Equal(t, "main 14500\nmain;$work_fn 15500\nmain;proc_exit 0\n", buf.String())
+}
@@ -0,0 +1,244 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package traps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/wasmfile"
+)
+
+type Traps_config struct {
+	DebugDir  string // Where to look for split dwarf files. If empty, only the dwarf sections in the wasm are used
+	AllLocals bool   // Show locals that have no dwarf name as well
+}
+
+// Call sites, with the line strings shared between them
+type trapSites struct {
+	sites     []byte
+	lines     []byte
+	lineLocs  []byte
+	lineIndex map[string]int
+	count     int
+}
+
+func (ts *trapSites) add(pc uint64, line string) int {
+	lidx := -1
+	if line != "" {
+		var ok bool
+		lidx, ok = ts.lineIndex[line]
+		if !ok {
+			lidx = len(ts.lineIndex)
+			ts.lineIndex[line] = lidx
+			ts.lineLocs = binary.LittleEndian.AppendUint32(ts.lineLocs, uint32(len(ts.lines)))
+			ts.lineLocs = binary.LittleEndian.AppendUint32(ts.lineLocs, uint32(len(line)))
+			ts.lines = append(ts.lines, []byte(line)...)
+		}
+	}
+	ts.sites = binary.LittleEndian.AppendUint32(ts.sites, uint32(pc))
+	ts.sites = binary.LittleEndian.AppendUint32(ts.sites, uint32(int32(lidx)))
+	ts.count++
+	return ts.count - 1
+}
+
+/**
+ * Add trap reports to a wasm. Each unreachable prints the call stack and locals before it traps.
+ *
+ */
+func AddTraps(wasmInput []byte, config Traps_config) ([]byte, error) {
+	wfile := &wasmfile.WasmFile{}
+	err := wfile.DecodeBinary(wasmInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse custom name section
+	wfile.Debug = &debug.WasmDebug{}
+	wfile.Debug.ParseNameSectionData(wfile.GetCustomSectionData("name"))
+
+	// Parse the dwarf before anything is added, so the PCs match up
+	debugSections, err := wfile.DebugSections(config.DebugDir)
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.Debug.ParseDwarf(debugSections)
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.Debug.ParseDwarfLineNumbers()
+	if err != nil {
+		return nil, err
+	}
+	err = wfile.Debug.ParseDwarfVariables(wfile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wfile.Memory) == 0 {
+		return nil, errors.New("The module has no memory")
+	}
+
+	originalFunctionLength := len(wfile.Code)
+
+	// Load up the individual wat files, and add them in
+	files := []string{
+		"memory.wat",
+		"stdout.wat",
+		"traps.wat"}
+
+	payload, err := wfile.AddPayload(files)
+	if err != nil {
+		return nil, err
+	}
+
+	num_functions := len(wfile.Import) + len(wfile.Code)
+	data_function_names := make([]byte, 0)
+	data_function_locs := make([]byte, 0)
+	for fid := 0; fid < num_functions; fid++ {
+		name := wfile.Debug.GetFunctionIdentifier(fid, false)
+		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len(data_function_names)))
+		data_function_locs = binary.LittleEndian.AppendUint32(data_function_locs, uint32(len([]byte(name))))
+		data_function_names = append(data_function_names, []byte(name)...)
+	}
+	payload.AddData("$wt_all_function_names", data_function_names)
+	payload.AddData("$wt_all_function_names_locs", data_function_locs)
+
+	sites := &trapSites{
+		sites:     make([]byte, 0),
+		lines:     make([]byte, 0),
+		lineLocs:  make([]byte, 0),
+		lineIndex: make(map[string]int),
+	}
+
+	// Instrument the original functions first, so that all the call sites are known
+	for idx, c := range wfile.Code[:originalFunctionLength] {
+		functionIndex := idx + len(wfile.Import)
+		functionType := wfile.Type[wfile.Function[idx].TypeIndex]
+
+		newCode := make([]*expression.Expression, 0)
+		for _, e := range c.Expression {
+			wcode := ""
+			if (e.Opcode == expression.InstrToOpcode["call"] && !e.FunctionNeedsLinking) ||
+				e.Opcode == expression.InstrToOpcode["call_indirect"] {
+				site := sites.add(e.PC, wfile.Debug.GetLineNumberBefore(c.CodeSectionPtr, e.PC))
+				wcode = fmt.Sprintf(`i32.const %d
+					global.set $trap_site`, site)
+			} else if e.Opcode == expression.InstrToOpcode["unreachable"] {
+				site := sites.add(e.PC, wfile.Debug.GetLineNumberBefore(c.CodeSectionPtr, e.PC))
+				wcode = fmt.Sprintf(`i32.const %d
+					call $trap_start`, site)
+
+				// Show the locals, with their dwarf names
+				localTypes := append(append([]types.ValType{}, functionType.Param...), c.Locals...)
+				for lidx, vt := range localTypes {
+					name := wfile.Debug.GetLocalVarName(e.PC, lidx)
+					if name == "" {
+						if !config.AllLocals {
+							continue
+						}
+						name = fmt.Sprintf("local %d", lidx)
+					}
+					if vt != types.ValI32 && vt != types.ValI64 && vt != types.ValF32 && vt != types.ValF64 {
+						continue
+					}
+					dataName := fmt.Sprintf("$trap_local_%d_%d_%d", functionIndex, e.PC, lidx)
+					payload.AddData(dataName, []byte(name))
+					wcode = fmt.Sprintf(`%s
+						i32.const offset(%s)
+						i32.const length(%s)
+						local.get %d
+						call $trap_local_%s`, wcode, dataName, dataName, lidx, types.ByteToValType[vt])
+				}
+
+				wcode = fmt.Sprintf(`%s
+					i32.const %d
+					call $trap_backtrace`, wcode, site)
+			}
+
+			if wcode != "" {
+				wcex, err := expression.ExpressionFromWat(wcode)
+				if err != nil {
+					return nil, err
+				}
+				newCode = append(newCode, wcex...)
+			}
+			newCode = append(newCode, e)
+		}
+		c.Expression = newCode
+
+		err = c.ReplaceInstr(wfile, "memory.grow", "call $debug_memory_grow")
+		if err != nil {
+			return nil, err
+		}
+		err = c.ReplaceInstr(wfile, "memory.size", "call $debug_memory_size")
+		if err != nil {
+			return nil, err
+		}
+
+		blockInstr := "block"
+		if len(functionType.Result) > 0 {
+			blockInstr = fmt.Sprintf("block (result %s)", types.ByteToValType[functionType.Result[0]])
+		}
+
+		startCode := fmt.Sprintf(`i32.const %d
+			call $trap_enter`, functionIndex)
+		endCode := "call $trap_exit"
+
+		err = c.InsertFuncStart(wfile, startCode+"\n"+blockInstr)
+		if err != nil {
+			return nil, err
+		}
+		err = c.ReplaceInstr(wfile, "return", endCode+"\nreturn")
+		if err != nil {
+			return nil, err
+		}
+		err = c.InsertFuncEnd(wfile, "end\n"+endCode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payload.AddData("$trap_sites", sites.sites)
+	payload.AddData("$trap_lines", sites.lines)
+	payload.AddData("$trap_lines_locs", sites.lineLocs)
+
+	for _, c := range wfile.Code {
+		err = payload.Resolve(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = payload.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = wfile.EncodeBinary(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
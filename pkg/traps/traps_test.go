@@ -0,0 +1,36 @@
+package traps
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrapSites(t *testing.T) {
+	ts := &trapSites{
+		sites:     make([]byte, 0),
+		lines:     make([]byte, 0),
+		lineLocs:  make([]byte, 0),
+		lineIndex: make(map[string]int),
+	}
+
+	assert.Equal(t, 0, ts.add(0x10, "main.c:4"))
+	assert.Equal(t, 1, ts.add(0x20, ""))
+	assert.Equal(t, 2, ts.add(0x30, "main.c:4"))
+	assert.Equal(t, 3, ts.add(0x40, "main.c:9"))
+
+	// Lines are only stored once
+	assert.Equal(t, "main.c:4main.c:9", string(ts.lines))
+	assert.Equal(t, []uint32{0, 8, 8, 8}, toUint32s(ts.lineLocs))
+
+	assert.Equal(t, []uint32{0x10, 0, 0x20, 0xffffffff, 0x30, 0, 0x40, 1}, toUint32s(ts.sites))
+}
+
+func toUint32s(data []byte) []uint32 {
+	r := make([]uint32, 0)
+	for i := 0; i < len(data); i += 4 {
+		r = append(r, binary.LittleEndian.Uint32(data[i:]))
+	}
+	return r
+}
@@ -25,17 +25,38 @@ type WasmDebug struct {
 	FunctionNames map[int]string
 	GlobalNames   map[int]string
 	DataNames     map[int]string
+	// Local names from the name section, by function id and then local index
+	FunctionLocalNames map[int]map[int]string
 
 	// dwarf debugging data
 	DwarfLoc    *DwarfLocations
 	DwarfData   *dwarf.Data
-	LineNumbers map[uint64]LineInfo
-	// debug info derived from dwarf
-	FunctionDebug     map[int]string
-	FunctionSignature map[int]string
+	lines       []lineRow // The line table, sorted by address when linesSorted is set
+	linesSorted bool
+	lineFiles   []string // Interned filenames from the line table
+	lineFileIDs map[string]uint32
+	lineIndex   map[string]map[int][]uint64 // file -> line -> addresses, built when needed
+	// debug info derived from dwarf, indexed by function id
+	functionDebug     []string
+	functionSignature []string
 	LocalNames        []*LocalNameData
+	Inlines           []*InlineInfo
+	CallFrames        *CallFrameInfo
+
+	// LocalNames sorted by StartPC, for GetLocalIdentifiers. Rebuilt when LocalNames changes.
+	localNameIndex      []*LocalNameData
+	localNameIndexLen   int
+	localNameIndexFirst **LocalNameData
+
+	// If set, the per function debug text for wat output isn't built. This is for big modules on small machines.
+	LowMemory bool
 
 	GlobalAddresses map[string]*GlobalNameData
+
+	// If set, function identifiers are demangled
+	Demangle      bool
+	demangled     map[string]string
+	demangledUsed map[string]bool
 }
 
 func NewEmpty() *WasmDebug {
@@ -43,29 +64,87 @@ func NewEmpty() *WasmDebug {
 	wd.FunctionNames = make(map[int]string)
 	wd.GlobalNames = make(map[int]string)
 	wd.DataNames = make(map[int]string)
+	wd.FunctionLocalNames = make(map[int]map[int]string)
 
-	wd.LineNumbers = make(map[uint64]LineInfo)
-	wd.FunctionDebug = make(map[int]string)
-	wd.FunctionSignature = make(map[int]string)
 	wd.LocalNames = make([]*LocalNameData, 0)
 	wd.GlobalAddresses = make(map[string]*GlobalNameData)
 
 	return wd
 }
 
+/**
+ * Clone the debug info.
+ * The parsed dwarf data is read only, so it is shared rather than copied.
+ */
+func (wd *WasmDebug) Clone() *WasmDebug {
+	nwd := &WasmDebug{
+		DwarfLoc:   wd.DwarfLoc,
+		DwarfData:  wd.DwarfData,
+		Inlines:    wd.Inlines,
+		CallFrames: wd.CallFrames,
+		Demangle:   wd.Demangle,
+		LowMemory:  wd.LowMemory,
+	}
+	nwd.FunctionNames = cloneMap(wd.FunctionNames)
+	nwd.GlobalNames = cloneMap(wd.GlobalNames)
+	nwd.DataNames = cloneMap(wd.DataNames)
+	if wd.FunctionLocalNames != nil {
+		nwd.FunctionLocalNames = make(map[int]map[int]string, len(wd.FunctionLocalNames))
+		for fid, names := range wd.FunctionLocalNames {
+			nwd.FunctionLocalNames[fid] = cloneMap(names)
+		}
+	}
+	nwd.lines = append([]lineRow(nil), wd.lines...)
+	nwd.linesSorted = wd.linesSorted
+	nwd.lineFiles = append([]string(nil), wd.lineFiles...)
+	nwd.lineFileIDs = cloneMap(wd.lineFileIDs)
+	nwd.functionDebug = append([]string(nil), wd.functionDebug...)
+	nwd.functionSignature = append([]string(nil), wd.functionSignature...)
+
+	if wd.LocalNames != nil {
+		nwd.LocalNames = make([]*LocalNameData, len(wd.LocalNames))
+		for i, l := range wd.LocalNames {
+			nl := *l
+			nwd.LocalNames[i] = &nl
+		}
+	}
+
+	if wd.GlobalAddresses != nil {
+		nwd.GlobalAddresses = make(map[string]*GlobalNameData)
+		for n, g := range wd.GlobalAddresses {
+			ng := *g
+			nwd.GlobalAddresses[n] = &ng
+		}
+	}
+	return nwd
+}
+
+func cloneMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	nm := make(map[K]V, len(m))
+	for k, v := range m {
+		nm[k] = v
+	}
+	return nm
+}
+
 type LocalNameData struct {
 	StartPC uint64
 	EndPC   uint64
 	Index   int
 	VarName string
 	VarType string
+	Type    dwarf.Type // The parsed type, for looking inside values
 }
 
 type GlobalNameData struct {
-	Name    string
-	Address uint64
-	Size    uint64
-	Type    string
+	Name      string
+	Address   uint64
+	Size      uint64
+	Type      string
+	DwarfType dwarf.Type // The parsed type, for looking inside values
 }
 
 type CustomSectionProvider interface {
@@ -83,14 +162,40 @@ func (wd *WasmDebug) ParseDwarf(wf CustomSectionProvider) error {
 
 	debug_loc := wf.GetCustomSectionData(".debug_loc")
 	wd.DwarfLoc = NewDwarfLocations(debug_loc)
+	wd.DwarfLoc.AddDwarf5(debug_info, wf.GetCustomSectionData(".debug_loclists"), wf.GetCustomSectionData(".debug_addr"))
+
+	debug_frame := make([]byte, 0) // call frame info, which dwarf.New doesn't use
 
-	debug_frame := make([]byte, 0) // call frame info
+	// Call frame info for unwinding. Errors here aren't fatal, we just can't unwind.
+	frameData := wf.GetCustomSectionData(".debug_frame")
+	isEH := false
+	if frameData == nil {
+		frameData = wf.GetCustomSectionData(".eh_frame")
+		isEH = true
+	}
+	if frameData != nil {
+		cfi, err := ParseCallFrameInfo(frameData, isEH)
+		if err == nil {
+			wd.CallFrames = cfi
+		}
+	}
 
 	dd, err := dwarf.New(debug_abbrev, debug_aranges, debug_frame, debug_info, debug_line, debug_pubnames, debug_ranges, debug_str)
 	if err != nil {
 		return nil // ok, but lets move on and ignore the error.
 	}
 
+	// Dwarf 5 keeps strings, addresses and ranges in extra sections
+	for _, name := range []string{".debug_addr", ".debug_str_offsets", ".debug_line_str", ".debug_rnglists"} {
+		data := wf.GetCustomSectionData(name)
+		if data != nil {
+			err = dd.AddSection(name, data)
+			if err != nil {
+				return nil
+			}
+		}
+	}
+
 	wd.DwarfData = dd
 	return nil
 }
@@ -99,23 +204,61 @@ func (wd *WasmDebug) ParseDwarf(wf CustomSectionProvider) error {
 func (wd *WasmDebug) RenumberFunctions(remap map[int]int) {
 	// This modifies FunctionNames, functionDebug, functionSignature
 	newFunctionNames := make(map[int]string)
-	newFunctionDebug := make(map[int]string)
-	newFunctionSignature := make(map[int]string)
+	var newFunctionDebug []string
+	var newFunctionSignature []string
 	for o, n := range remap {
 		v, ok := wd.FunctionNames[o]
 		if ok {
 			newFunctionNames[n] = v
 		}
-		v, ok = wd.FunctionDebug[o]
+		v = getIndexed(wd.functionDebug, o)
+		if v != "" {
+			newFunctionDebug = setIndexed(newFunctionDebug, n, v)
+		}
+		v = getIndexed(wd.functionSignature, o)
+		if v != "" {
+			newFunctionSignature = setIndexed(newFunctionSignature, n, v)
+		}
+	}
+	wd.FunctionNames = newFunctionNames
+	wd.functionDebug = newFunctionDebug
+	wd.functionSignature = newFunctionSignature
+}
+
+func getIndexed(s []string, i int) string {
+	if i < 0 || i >= len(s) {
+		return ""
+	}
+	return s[i]
+}
+
+// Set s[i], growing s if needed
+func setIndexed(s []string, i int, v string) []string {
+	if i >= len(s) {
+		s = append(s, make([]string, i+1-len(s))...)
+	}
+	s[i] = v
+	return s
+}
+
+func (wd *WasmDebug) RenumberGlobals(remap map[int]int) {
+	newGlobalNames := make(map[int]string)
+	for o, n := range remap {
+		v, ok := wd.GlobalNames[o]
 		if ok {
-			newFunctionDebug[n] = v
+			newGlobalNames[n] = v
 		}
-		v, ok = wd.FunctionSignature[o]
+	}
+	wd.GlobalNames = newGlobalNames
+}
+
+func (wd *WasmDebug) RenumberData(remap map[int]int) {
+	newDataNames := make(map[int]string)
+	for o, n := range remap {
+		v, ok := wd.DataNames[o]
 		if ok {
-			newFunctionSignature[n] = v
+			newDataNames[n] = v
 		}
 	}
-	wd.FunctionNames = newFunctionNames
-	wd.FunctionDebug = newFunctionDebug
-	wd.FunctionSignature = newFunctionSignature
+	wd.DataNames = newDataNames
 }
@@ -0,0 +1,876 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package debug
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/encoding"
+)
+
+// Call frame information from .debug_frame or .eh_frame
+type CallFrameInfo struct {
+	FDEs []*FrameDescription // Sorted by StartAddress
+}
+
+type commonInformation struct {
+	codeAlign     uint64
+	dataAlign     int64
+	returnReg     uint64
+	ptrEncoding   byte
+	instructions  []byte
+	hasAugmentZ   bool
+	augmentations string
+}
+
+type FrameDescription struct {
+	StartAddress uint64
+	EndAddress   uint64 // Exclusive
+	cie          *commonInformation
+	instructions []byte
+}
+
+// How to find the value of a register in the caller
+const (
+	RuleUndefined = iota
+	RuleSameValue
+	RuleOffset     // Saved at CFA+Offset
+	RuleValOffset  // The value is CFA+Offset
+	RuleRegister   // Saved in another register
+	RuleExpression // Saved at the address given by an expression
+	RuleValExpression
+)
+
+type RegisterRule struct {
+	Kind       int
+	Offset     int64
+	Register   uint64
+	Expression []byte
+}
+
+// The CFA is either register+offset or the result of an expression
+type CFARule struct {
+	Register   uint64
+	Offset     int64
+	Expression []byte
+}
+
+type FrameRow struct {
+	Address       uint64
+	CFA           CFARule
+	Registers     map[uint64]RegisterRule
+	ReturnAddress uint64 // The register holding the return address
+}
+
+const DW_CFA_advance_loc = 0x40
+const DW_CFA_offset = 0x80
+const DW_CFA_restore = 0xc0
+
+const DW_CFA_nop = 0x00
+const DW_CFA_set_loc = 0x01
+const DW_CFA_advance_loc1 = 0x02
+const DW_CFA_advance_loc2 = 0x03
+const DW_CFA_advance_loc4 = 0x04
+const DW_CFA_offset_extended = 0x05
+const DW_CFA_restore_extended = 0x06
+const DW_CFA_undefined = 0x07
+const DW_CFA_same_value = 0x08
+const DW_CFA_register = 0x09
+const DW_CFA_remember_state = 0x0a
+const DW_CFA_restore_state = 0x0b
+const DW_CFA_def_cfa = 0x0c
+const DW_CFA_def_cfa_register = 0x0d
+const DW_CFA_def_cfa_offset = 0x0e
+const DW_CFA_def_cfa_expression = 0x0f
+const DW_CFA_expression = 0x10
+const DW_CFA_offset_extended_sf = 0x11
+const DW_CFA_def_cfa_sf = 0x12
+const DW_CFA_def_cfa_offset_sf = 0x13
+const DW_CFA_val_offset = 0x14
+const DW_CFA_val_offset_sf = 0x15
+const DW_CFA_val_expression = 0x16
+
+// Pointer encodings used in .eh_frame
+const DW_EH_PE_absptr = 0x00
+const DW_EH_PE_uleb128 = 0x01
+const DW_EH_PE_udata2 = 0x02
+const DW_EH_PE_udata4 = 0x03
+const DW_EH_PE_udata8 = 0x04
+const DW_EH_PE_sleb128 = 0x09
+const DW_EH_PE_sdata2 = 0x0a
+const DW_EH_PE_sdata4 = 0x0b
+const DW_EH_PE_sdata8 = 0x0c
+const DW_EH_PE_pcrel = 0x10
+const DW_EH_PE_omit = 0xff
+
+var errFrameTruncated = errors.New("Call frame info truncated")
+
+// A simple reader over frame info data
+type frameReader struct {
+	data []byte
+	ptr  uint64
+}
+
+func (r *frameReader) u8() (byte, error) {
+	if r.ptr >= uint64(len(r.data)) {
+		return 0, errFrameTruncated
+	}
+	v := r.data[r.ptr]
+	r.ptr++
+	return v, nil
+}
+
+func (r *frameReader) fixed(size uint64) (uint64, error) {
+	if r.ptr+size > uint64(len(r.data)) {
+		return 0, errFrameTruncated
+	}
+	v := uint64(0)
+	for i := size; i > 0; i-- {
+		v = (v << 8) | uint64(r.data[r.ptr+i-1])
+	}
+	r.ptr += size
+	return v, nil
+}
+
+func (r *frameReader) uleb() (uint64, error) {
+	if r.ptr >= uint64(len(r.data)) {
+		return 0, errFrameTruncated
+	}
+	v, l := binary.Uvarint(r.data[r.ptr:])
+	if l <= 0 {
+		return 0, errFrameTruncated
+	}
+	r.ptr += uint64(l)
+	return v, nil
+}
+
+func (r *frameReader) sleb() (int64, error) {
+	if r.ptr >= uint64(len(r.data)) {
+		return 0, errFrameTruncated
+	}
+	v, l := encoding.DecodeSleb128(r.data[r.ptr:])
+	if l <= 0 {
+		return 0, errFrameTruncated
+	}
+	r.ptr += uint64(l)
+	return v, nil
+}
+
+func (r *frameReader) bytes(n uint64) ([]byte, error) {
+	if r.ptr+n > uint64(len(r.data)) {
+		return nil, errFrameTruncated
+	}
+	b := r.data[r.ptr : r.ptr+n]
+	r.ptr += n
+	return b, nil
+}
+
+func (r *frameReader) cstring() (string, error) {
+	for i := r.ptr; i < uint64(len(r.data)); i++ {
+		if r.data[i] == 0 {
+			s := string(r.data[r.ptr:i])
+			r.ptr = i + 1
+			return s, nil
+		}
+	}
+	return "", errFrameTruncated
+}
+
+// Read a pointer in an .eh_frame encoding. Only pc relative is supported as an application.
+func (r *frameReader) pointer(enc byte) (uint64, error) {
+	if enc == DW_EH_PE_omit {
+		return 0, nil
+	}
+	pos := r.ptr
+	var v uint64
+	var err error
+	switch enc & 0x0f {
+	case DW_EH_PE_absptr, DW_EH_PE_udata4:
+		v, err = r.fixed(4)
+	case DW_EH_PE_udata2:
+		v, err = r.fixed(2)
+	case DW_EH_PE_udata8:
+		v, err = r.fixed(8)
+	case DW_EH_PE_sdata2:
+		var u uint64
+		u, err = r.fixed(2)
+		v = uint64(int64(int16(u)))
+	case DW_EH_PE_sdata4:
+		var u uint64
+		u, err = r.fixed(4)
+		v = uint64(int64(int32(u)))
+	case DW_EH_PE_sdata8:
+		v, err = r.fixed(8)
+	case DW_EH_PE_uleb128:
+		v, err = r.uleb()
+	case DW_EH_PE_sleb128:
+		var s int64
+		s, err = r.sleb()
+		v = uint64(s)
+	default:
+		return 0, fmt.Errorf("Unsupported pointer encoding 0x%x", enc)
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch enc & 0x70 {
+	case 0:
+	case DW_EH_PE_pcrel:
+		v += pos
+	default:
+		return 0, fmt.Errorf("Unsupported pointer encoding 0x%x", enc)
+	}
+	return v & 0xffffffff, nil
+}
+
+/**
+ * Parse call frame info. isEH selects the .eh_frame format, where CIE pointers are relative and
+ * addresses can use the augmentation pointer encodings.
+ *
+ */
+func ParseCallFrameInfo(data []byte, isEH bool) (*CallFrameInfo, error) {
+	cfi := &CallFrameInfo{
+		FDEs: make([]*FrameDescription, 0),
+	}
+	cies := make(map[uint64]*commonInformation)
+
+	r := &frameReader{data: data}
+	for r.ptr+4 <= uint64(len(data)) {
+		start := r.ptr
+		length, _ := r.fixed(4)
+		if length == 0 {
+			if isEH {
+				// Terminator
+				break
+			}
+			continue
+		}
+		if length >= 0xfffffff0 {
+			// 64 bit dwarf isn't used for wasm32
+			return nil, errors.New("64 bit call frame info is not supported")
+		}
+		end := r.ptr + length
+		if end > uint64(len(data)) {
+			return nil, errFrameTruncated
+		}
+		idPos := r.ptr
+		id, _ := r.fixed(4)
+
+		isCIE := (isEH && id == 0) || (!isEH && id == 0xffffffff)
+		entry := &frameReader{data: data[:end], ptr: r.ptr}
+		if isCIE {
+			cie, err := parseCIE(entry)
+			if err != nil {
+				return nil, err
+			}
+			cies[start] = cie
+		} else {
+			cieOffset := id
+			if isEH {
+				cieOffset = idPos - id
+			}
+			cie, ok := cies[cieOffset]
+			if !ok {
+				// CIEs nearly always come first, but they don't have to.
+				cr := &frameReader{data: data, ptr: cieOffset}
+				l, err := cr.fixed(4)
+				if err != nil || cieOffset+4+l > uint64(len(data)) {
+					return nil, fmt.Errorf("FDE at %d refers to missing CIE %d", start, cieOffset)
+				}
+				cr.data = data[:cieOffset+4+l]
+				cr.ptr += 4
+				cie, err = parseCIE(cr)
+				if err != nil {
+					return nil, err
+				}
+				cies[cieOffset] = cie
+			}
+			fde, err := parseFDE(entry, cie)
+			if err != nil {
+				return nil, err
+			}
+			cfi.FDEs = append(cfi.FDEs, fde)
+		}
+		r.ptr = end
+	}
+
+	sort.Slice(cfi.FDEs, func(i, j int) bool {
+		return cfi.FDEs[i].StartAddress < cfi.FDEs[j].StartAddress
+	})
+	return cfi, nil
+}
+
+func parseCIE(r *frameReader) (*commonInformation, error) {
+	cie := &commonInformation{
+		ptrEncoding: DW_EH_PE_absptr,
+	}
+	version, err := r.u8()
+	if err != nil {
+		return nil, err
+	}
+	cie.augmentations, err = r.cstring()
+	if err != nil {
+		return nil, err
+	}
+	if version >= 4 {
+		// address_size, segment_size
+		_, err = r.bytes(2)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cie.codeAlign, err = r.uleb()
+	if err != nil {
+		return nil, err
+	}
+	cie.dataAlign, err = r.sleb()
+	if err != nil {
+		return nil, err
+	}
+	if version == 1 {
+		var ra byte
+		ra, err = r.u8()
+		cie.returnReg = uint64(ra)
+	} else {
+		cie.returnReg, err = r.uleb()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cie.augmentations) > 0 && cie.augmentations[0] == 'z' {
+		cie.hasAugmentZ = true
+		l, err := r.uleb()
+		if err != nil {
+			return nil, err
+		}
+		augEnd := r.ptr + l
+		for _, a := range cie.augmentations[1:] {
+			switch a {
+			case 'R':
+				cie.ptrEncoding, err = r.u8()
+			case 'L':
+				_, err = r.u8()
+			case 'P':
+				var enc byte
+				enc, err = r.u8()
+				if err == nil {
+					_, err = r.pointer(enc)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.ptr = augEnd
+	} else if cie.augmentations != "" {
+		return nil, fmt.Errorf("Unsupported CIE augmentation %q", cie.augmentations)
+	}
+
+	cie.instructions = r.data[r.ptr:]
+	return cie, nil
+}
+
+func parseFDE(r *frameReader, cie *commonInformation) (*FrameDescription, error) {
+	start, err := r.pointer(cie.ptrEncoding)
+	if err != nil {
+		return nil, err
+	}
+	// The range uses the same format, but is never relative
+	length, err := r.pointer(cie.ptrEncoding & 0x0f)
+	if err != nil {
+		return nil, err
+	}
+	if cie.hasAugmentZ {
+		l, err := r.uleb()
+		if err != nil {
+			return nil, err
+		}
+		r.ptr += l
+	}
+	if r.ptr > uint64(len(r.data)) {
+		return nil, errFrameTruncated
+	}
+	return &FrameDescription{
+		StartAddress: start,
+		EndAddress:   start + length,
+		cie:          cie,
+		instructions: r.data[r.ptr:],
+	}, nil
+}
+
+// Find the FDE covering a pc
+func (cfi *CallFrameInfo) FindFDE(pc uint64) *FrameDescription {
+	i := sort.Search(len(cfi.FDEs), func(i int) bool {
+		return cfi.FDEs[i].EndAddress > pc
+	})
+	for ; i < len(cfi.FDEs); i++ {
+		f := cfi.FDEs[i]
+		if f.StartAddress > pc {
+			break
+		}
+		if pc < f.EndAddress {
+			return f
+		}
+	}
+	return nil
+}
+
+/**
+ * Work out the unwind rules in effect at a pc, by running the CIE and FDE instructions.
+ *
+ */
+func (cfi *CallFrameInfo) FindRow(pc uint64) (*FrameRow, error) {
+	fde := cfi.FindFDE(pc)
+	if fde == nil {
+		return nil, fmt.Errorf("No call frame info for pc 0x%x", pc)
+	}
+	row := &FrameRow{
+		Address:       fde.StartAddress,
+		Registers:     make(map[uint64]RegisterRule),
+		ReturnAddress: fde.cie.returnReg,
+	}
+	err := row.execute(fde.cie.instructions, fde.cie, nil, ^uint64(0))
+	if err != nil {
+		return nil, err
+	}
+	initial := make(map[uint64]RegisterRule, len(row.Registers))
+	for k, v := range row.Registers {
+		initial[k] = v
+	}
+	err = row.execute(fde.instructions, fde.cie, initial, pc)
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// Run CFA instructions until the location passes pc
+func (row *FrameRow) execute(instructions []byte, cie *commonInformation, initial map[uint64]RegisterRule, pc uint64) error {
+	r := &frameReader{data: instructions}
+	type savedState struct {
+		cfa       CFARule
+		registers map[uint64]RegisterRule
+	}
+	stack := make([]savedState, 0)
+
+	advance := func(delta uint64) bool {
+		next := row.Address + delta*cie.codeAlign
+		if next > pc {
+			return false
+		}
+		row.Address = next
+		return true
+	}
+	restore := func(reg uint64) {
+		rule, ok := initial[reg]
+		if ok {
+			row.Registers[reg] = rule
+		} else {
+			delete(row.Registers, reg)
+		}
+	}
+
+	for r.ptr < uint64(len(r.data)) {
+		op, _ := r.u8()
+		var err error
+		switch op & 0xc0 {
+		case DW_CFA_advance_loc:
+			if !advance(uint64(op & 0x3f)) {
+				return nil
+			}
+			continue
+		case DW_CFA_offset:
+			var off uint64
+			off, err = r.uleb()
+			if err != nil {
+				return err
+			}
+			row.Registers[uint64(op&0x3f)] = RegisterRule{Kind: RuleOffset, Offset: int64(off) * cie.dataAlign}
+			continue
+		case DW_CFA_restore:
+			restore(uint64(op & 0x3f))
+			continue
+		}
+
+		var reg, v uint64
+		var s int64
+		var expr []byte
+		switch op {
+		case DW_CFA_nop:
+		case DW_CFA_set_loc:
+			v, err = r.pointer(cie.ptrEncoding)
+			if err == nil {
+				if v > pc {
+					return nil
+				}
+				row.Address = v
+			}
+		case DW_CFA_advance_loc1, DW_CFA_advance_loc2, DW_CFA_advance_loc4:
+			size := map[byte]uint64{DW_CFA_advance_loc1: 1, DW_CFA_advance_loc2: 2, DW_CFA_advance_loc4: 4}[op]
+			v, err = r.fixed(size)
+			if err == nil && !advance(v) {
+				return nil
+			}
+		case DW_CFA_offset_extended, DW_CFA_val_offset:
+			reg, err = r.uleb()
+			if err == nil {
+				v, err = r.uleb()
+			}
+			kind := RuleOffset
+			if op == DW_CFA_val_offset {
+				kind = RuleValOffset
+			}
+			row.Registers[reg] = RegisterRule{Kind: kind, Offset: int64(v) * cie.dataAlign}
+		case DW_CFA_offset_extended_sf, DW_CFA_val_offset_sf:
+			reg, err = r.uleb()
+			if err == nil {
+				s, err = r.sleb()
+			}
+			kind := RuleOffset
+			if op == DW_CFA_val_offset_sf {
+				kind = RuleValOffset
+			}
+			row.Registers[reg] = RegisterRule{Kind: kind, Offset: s * cie.dataAlign}
+		case DW_CFA_restore_extended:
+			reg, err = r.uleb()
+			restore(reg)
+		case DW_CFA_undefined:
+			reg, err = r.uleb()
+			row.Registers[reg] = RegisterRule{Kind: RuleUndefined}
+		case DW_CFA_same_value:
+			reg, err = r.uleb()
+			row.Registers[reg] = RegisterRule{Kind: RuleSameValue}
+		case DW_CFA_register:
+			reg, err = r.uleb()
+			if err == nil {
+				v, err = r.uleb()
+			}
+			row.Registers[reg] = RegisterRule{Kind: RuleRegister, Register: v}
+		case DW_CFA_remember_state:
+			regs := make(map[uint64]RegisterRule, len(row.Registers))
+			for k, rr := range row.Registers {
+				regs[k] = rr
+			}
+			stack = append(stack, savedState{cfa: row.CFA, registers: regs})
+		case DW_CFA_restore_state:
+			if len(stack) == 0 {
+				return errors.New("DW_CFA_restore_state without remember_state")
+			}
+			st := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			row.CFA = st.cfa
+			row.Registers = st.registers
+		case DW_CFA_def_cfa:
+			reg, err = r.uleb()
+			if err == nil {
+				v, err = r.uleb()
+			}
+			row.CFA = CFARule{Register: reg, Offset: int64(v)}
+		case DW_CFA_def_cfa_sf:
+			reg, err = r.uleb()
+			if err == nil {
+				s, err = r.sleb()
+			}
+			row.CFA = CFARule{Register: reg, Offset: s * cie.dataAlign}
+		case DW_CFA_def_cfa_register:
+			reg, err = r.uleb()
+			row.CFA.Register = reg
+			row.CFA.Expression = nil
+		case DW_CFA_def_cfa_offset:
+			v, err = r.uleb()
+			row.CFA.Offset = int64(v)
+		case DW_CFA_def_cfa_offset_sf:
+			s, err = r.sleb()
+			row.CFA.Offset = s * cie.dataAlign
+		case DW_CFA_def_cfa_expression:
+			v, err = r.uleb()
+			if err == nil {
+				expr, err = r.bytes(v)
+			}
+			row.CFA = CFARule{Expression: expr}
+		case DW_CFA_expression, DW_CFA_val_expression:
+			reg, err = r.uleb()
+			if err == nil {
+				v, err = r.uleb()
+			}
+			if err == nil {
+				expr, err = r.bytes(v)
+			}
+			kind := RuleExpression
+			if op == DW_CFA_val_expression {
+				kind = RuleValExpression
+			}
+			row.Registers[reg] = RegisterRule{Kind: kind, Expression: expr}
+		default:
+			return fmt.Errorf("Unknown call frame instruction 0x%x", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Access to the registers and memory of a paused frame
+type FrameState interface {
+	Register(reg uint64) (uint64, bool)
+	ReadMemory(addr uint64, size int) ([]byte, error)
+}
+
+// A frame found while unwinding
+type StackFrame struct {
+	PC     uint64
+	CFA    uint64
+	Locals []*LocalNameData // Locals in scope at PC
+}
+
+// Register values for a caller frame, layered over the frame it was unwound from
+type unwoundState struct {
+	regs  map[uint64]uint64
+	inner FrameState
+}
+
+func (us *unwoundState) Register(reg uint64) (uint64, bool) {
+	v, ok := us.regs[reg]
+	return v, ok
+}
+
+func (us *unwoundState) ReadMemory(addr uint64, size int) ([]byte, error) {
+	return us.inner.ReadMemory(addr, size)
+}
+
+const DW_OP_lit0 = 0x30
+const DW_OP_lit31 = 0x4f
+const DW_OP_breg0 = 0x70
+const DW_OP_breg31 = 0x8f
+
+/**
+ * Evaluate the simple dwarf expressions found in call frame info.
+ * Only constants, register bases, arithmetic and deref are supported.
+ */
+func evalFrameExpression(expr []byte, state FrameState, initial []uint64) (uint64, error) {
+	stack := append(make([]uint64, 0), initial...)
+	r := &frameReader{data: expr}
+	pop := func() (uint64, error) {
+		if len(stack) == 0 {
+			return 0, errors.New("Dwarf expression stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	for r.ptr < uint64(len(expr)) {
+		op, _ := r.u8()
+		switch {
+		case op >= DW_OP_lit0 && op <= DW_OP_lit31:
+			stack = append(stack, uint64(op-DW_OP_lit0))
+		case op >= DW_OP_breg0 && op <= DW_OP_breg31:
+			off, err := r.sleb()
+			if err != nil {
+				return 0, err
+			}
+			v, ok := state.Register(uint64(op - DW_OP_breg0))
+			if !ok {
+				return 0, fmt.Errorf("Register %d not available", op-DW_OP_breg0)
+			}
+			stack = append(stack, uint64(int64(v)+off))
+		case op == DW_OP_bregx:
+			reg, err := r.uleb()
+			if err != nil {
+				return 0, err
+			}
+			off, err := r.sleb()
+			if err != nil {
+				return 0, err
+			}
+			v, ok := state.Register(reg)
+			if !ok {
+				return 0, fmt.Errorf("Register %d not available", reg)
+			}
+			stack = append(stack, uint64(int64(v)+off))
+		case op == DW_OP_constu:
+			v, err := r.uleb()
+			if err != nil {
+				return 0, err
+			}
+			stack = append(stack, v)
+		case op == DW_OP_consts:
+			v, err := r.sleb()
+			if err != nil {
+				return 0, err
+			}
+			stack = append(stack, uint64(v))
+		case op == DW_OP_plus_uconst:
+			v, err := r.uleb()
+			if err != nil {
+				return 0, err
+			}
+			a, err := pop()
+			if err != nil {
+				return 0, err
+			}
+			stack = append(stack, a+v)
+		case op == DW_OP_plus || op == DW_OP_minus:
+			b, err := pop()
+			if err != nil {
+				return 0, err
+			}
+			a, err := pop()
+			if err != nil {
+				return 0, err
+			}
+			if op == DW_OP_plus {
+				stack = append(stack, a+b)
+			} else {
+				stack = append(stack, a-b)
+			}
+		case op == DW_OP_deref:
+			a, err := pop()
+			if err != nil {
+				return 0, err
+			}
+			data, err := state.ReadMemory(a, 4)
+			if err != nil {
+				return 0, err
+			}
+			stack = append(stack, uint64(binary.LittleEndian.Uint32(data)))
+		default:
+			return 0, fmt.Errorf("Unsupported dwarf expression opcode 0x%x in call frame info", op)
+		}
+	}
+	return pop()
+}
+
+/**
+ * Unwind a single frame. Returns the CFA of the frame at pc, and the register state of its caller.
+ * The caller pc is in the row's ReturnAddress register.
+ */
+func (cfi *CallFrameInfo) UnwindFrame(pc uint64, state FrameState) (uint64, FrameState, *FrameRow, error) {
+	row, err := cfi.FindRow(pc)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	var cfa uint64
+	if row.CFA.Expression != nil {
+		cfa, err = evalFrameExpression(row.CFA.Expression, state, nil)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+	} else {
+		v, ok := state.Register(row.CFA.Register)
+		if !ok {
+			return 0, nil, nil, fmt.Errorf("Register %d not available for CFA", row.CFA.Register)
+		}
+		cfa = uint64(int64(v) + row.CFA.Offset)
+	}
+
+	caller := &unwoundState{
+		regs:  make(map[uint64]uint64),
+		inner: state,
+	}
+	// Registers without a rule keep their value
+	for reg := uint64(0); reg < 128; reg++ {
+		v, ok := state.Register(reg)
+		if ok {
+			caller.regs[reg] = v
+		}
+	}
+	for reg, rule := range row.Registers {
+		switch rule.Kind {
+		case RuleUndefined:
+			delete(caller.regs, reg)
+		case RuleSameValue:
+		case RuleOffset, RuleExpression:
+			addr := uint64(int64(cfa) + rule.Offset)
+			if rule.Kind == RuleExpression {
+				addr, err = evalFrameExpression(rule.Expression, state, []uint64{cfa})
+				if err != nil {
+					return 0, nil, nil, err
+				}
+			}
+			data, err := state.ReadMemory(addr, 4)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			caller.regs[reg] = uint64(binary.LittleEndian.Uint32(data))
+		case RuleValOffset:
+			caller.regs[reg] = uint64(int64(cfa) + rule.Offset)
+		case RuleValExpression:
+			v, err := evalFrameExpression(rule.Expression, state, []uint64{cfa})
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			caller.regs[reg] = v
+		case RuleRegister:
+			v, ok := state.Register(rule.Register)
+			if ok {
+				caller.regs[reg] = v
+			} else {
+				delete(caller.regs, reg)
+			}
+		}
+	}
+	return cfa, caller, row, nil
+}
+
+/**
+ * Walk the stack from pc using the call frame info, returning each frame along with its locals.
+ * Stops when there's no more frame info, no return address, or after maxDepth frames.
+ */
+func (wd *WasmDebug) Unwind(pc uint64, state FrameState, maxDepth int) ([]*StackFrame, error) {
+	if wd.CallFrames == nil {
+		return nil, errors.New("No call frame info")
+	}
+	frames := make([]*StackFrame, 0)
+	for len(frames) < maxDepth {
+		cfa, caller, row, err := wd.CallFrames.UnwindFrame(pc, state)
+		if err != nil {
+			if len(frames) == 0 {
+				return nil, err
+			}
+			break
+		}
+		frames = append(frames, &StackFrame{
+			PC:     pc,
+			CFA:    cfa,
+			Locals: wd.GetLocalsAt(pc),
+		})
+		ra, ok := caller.Register(row.ReturnAddress)
+		if !ok || ra == 0 || ra == pc {
+			break
+		}
+		pc = ra
+		state = caller
+	}
+	return frames, nil
+}
+
+// Get the locals which are in scope at a pc
+func (wd *WasmDebug) GetLocalsAt(pc uint64) []*LocalNameData {
+	locals := make([]*LocalNameData, 0)
+	for _, l := range wd.LocalNames {
+		if pc >= l.StartPC && pc <= l.EndPC {
+			locals = append(locals, l)
+		}
+	}
+	return locals
+}
@@ -0,0 +1,85 @@
+package debug
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testFrameState struct {
+	regs map[uint64]uint64
+	mem  map[uint64]uint32
+}
+
+func (ts *testFrameState) Register(reg uint64) (uint64, bool) {
+	v, ok := ts.regs[reg]
+	return v, ok
+}
+
+func (ts *testFrameState) ReadMemory(addr uint64, size int) ([]byte, error) {
+	v, ok := ts.mem[addr]
+	if !ok {
+		return nil, errors.New("not mapped")
+	}
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, v)
+	return data, nil
+}
+
+func frameEntry(id uint32, body ...byte) []byte {
+	e := make([]byte, 8)
+	binary.LittleEndian.PutUint32(e, uint32(4+len(body)))
+	binary.LittleEndian.PutUint32(e[4:], id)
+	return append(e, body...)
+}
+
+func TestCallFrameInfo(t *testing.T) {
+	// CIE: version 1, no augmentation, code align 1, data align -4, return address in r8, cfa = r1
+	data := frameEntry(0xffffffff, 1, 0, 1, 0x7c, 8, DW_CFA_def_cfa, 1, 0)
+	// FDE for 0x100-0x120: after 4 bytes the cfa is r1+16, and r8 is saved at cfa-4
+	fde := []byte{0, 0, 0, 0, 0, 0, 0, 0, DW_CFA_advance_loc | 4, DW_CFA_def_cfa_offset, 16, DW_CFA_offset | 8, 1}
+	binary.LittleEndian.PutUint32(fde, 0x100)
+	binary.LittleEndian.PutUint32(fde[4:], 0x20)
+	data = append(data, frameEntry(0, fde...)...)
+
+	cfi, err := ParseCallFrameInfo(data, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cfi.FDEs))
+	assert.Nil(t, cfi.FindFDE(0x120))
+
+	row, err := cfi.FindRow(0x102)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), row.CFA.Offset)
+	assert.Equal(t, 0, len(row.Registers))
+
+	row, err = cfi.FindRow(0x108)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x104), row.Address)
+	assert.Equal(t, uint64(1), row.CFA.Register)
+	assert.Equal(t, int64(16), row.CFA.Offset)
+	assert.Equal(t, RegisterRule{Kind: RuleOffset, Offset: -4}, row.Registers[8])
+
+	wd := NewEmpty()
+	wd.CallFrames = cfi
+	wd.LocalNames = append(wd.LocalNames, &LocalNameData{StartPC: 0x100, EndPC: 0x110, VarName: "x"})
+	state := &testFrameState{
+		regs: map[uint64]uint64{1: 0x1000},
+		mem:  map[uint64]uint32{0x100c: 0x150},
+	}
+	frames, err := wd.Unwind(0x108, state, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, uint64(0x1010), frames[0].CFA)
+	assert.Equal(t, "x", frames[0].Locals[0].VarName)
+
+	_, caller, _, err := cfi.UnwindFrame(0x108, state)
+	assert.NoError(t, err)
+	ra, ok := caller.Register(8)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0x150), ra)
+
+	_, err = wd.Unwind(0x200, state, 10)
+	assert.Error(t, err)
+}
@@ -0,0 +1,197 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package debug
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A range of code which was inlined from another function
+type InlineInfo struct {
+	Name     string // The function which was inlined
+	Caller   string // The function it was inlined into
+	StartPC  uint64
+	EndPC    uint64 // Exclusive
+	CallFile string
+	CallLine int
+	Depth    int // 1 for something inlined directly into a real function
+}
+
+// Find the name of a subprogram, following abstract_origin and specification as needed
+func (wd *WasmDebug) dwarfEntryName(entry *dwarf.Entry, cache map[dwarf.Offset]string) string {
+	name, ok := entry.Val(dwarf.AttrName).(string)
+	if ok {
+		return name
+	}
+	for _, attr := range []dwarf.Attr{dwarf.AttrAbstractOrigin, dwarf.AttrSpecification} {
+		off, ok := entry.Val(attr).(dwarf.Offset)
+		if !ok {
+			continue
+		}
+		name, ok = cache[off]
+		if ok {
+			return name
+		}
+		r := wd.DwarfData.Reader()
+		r.Seek(off)
+		origin, err := r.Next()
+		if err != nil || origin == nil {
+			continue
+		}
+		// Guard against loops while we look it up
+		cache[off] = "<unknown>"
+		name = wd.dwarfEntryName(origin, cache)
+		cache[off] = name
+		return name
+	}
+	return "<unknown>"
+}
+
+/**
+ * Parse DW_TAG_inlined_subroutine entries, so that we know which code has been inlined from where.
+ *
+ */
+func (wd *WasmDebug) ParseDwarfInlines() error {
+	wd.Inlines = make([]*InlineInfo, 0)
+
+	if wd.DwarfData == nil {
+		return nil
+	}
+
+	cache := make(map[dwarf.Offset]string)
+	entryReader := wd.DwarfData.Reader()
+
+	// The names of the enclosing scopes, "" for anything which isn't a function
+	scopes := make([]string, 0)
+	var files []*dwarf.LineFile
+
+	for {
+		entry, err := entryReader.Next()
+		if entry == nil || err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Tag == 0 {
+			if len(scopes) > 0 {
+				scopes = scopes[:len(scopes)-1]
+			}
+			continue
+		}
+
+		name := ""
+		if entry.Tag == dwarf.TagCompileUnit {
+			files = nil
+			lr, err := wd.DwarfData.LineReader(entry)
+			if err == nil && lr != nil {
+				files = lr.Files()
+			}
+		} else if entry.Tag == dwarf.TagSubprogram {
+			name = wd.dwarfEntryName(entry, cache)
+		} else if entry.Tag == dwarf.TagInlinedSubroutine {
+			name = wd.dwarfEntryName(entry, cache)
+
+			// The caller is the nearest enclosing function, and each enclosing one adds to the depth
+			caller := ""
+			depth := 0
+			for i := len(scopes) - 1; i >= 0; i-- {
+				if scopes[i] != "" {
+					if caller == "" {
+						caller = scopes[i]
+					}
+					depth++
+				}
+			}
+
+			callFile := ""
+			if idx, ok := entry.Val(dwarf.AttrCallFile).(int64); ok && idx >= 0 && int(idx) < len(files) && files[idx] != nil {
+				callFile = files[idx].Name
+			}
+			callLine := 0
+			if line, ok := entry.Val(dwarf.AttrCallLine).(int64); ok {
+				callLine = int(line)
+			}
+
+			ranges, err := wd.DwarfData.Ranges(entry)
+			if err == nil {
+				for _, r := range ranges {
+					wd.Inlines = append(wd.Inlines, &InlineInfo{
+						Name:     name,
+						Caller:   caller,
+						StartPC:  r[0],
+						EndPC:    r[1],
+						CallFile: callFile,
+						CallLine: callLine,
+						Depth:    depth,
+					})
+				}
+			}
+		}
+
+		if entry.Children {
+			scopes = append(scopes, name)
+		}
+	}
+
+	return nil
+}
+
+// Get the functions inlined at a pc, innermost first.
+func (wd *WasmDebug) GetInlineStack(pc uint64) []*InlineInfo {
+	return InlineStackAt(wd.Inlines, pc)
+}
+
+// Get the inlined ranges which overlap some code, so that lookups within it are quicker.
+func (wd *WasmDebug) GetInlinesInRange(start uint64, end uint64) []*InlineInfo {
+	inlines := make([]*InlineInfo, 0)
+	for _, in := range wd.Inlines {
+		if in.StartPC < end && in.EndPC > start {
+			inlines = append(inlines, in)
+		}
+	}
+	return inlines
+}
+
+func InlineStackAt(inlines []*InlineInfo, pc uint64) []*InlineInfo {
+	stack := make([]*InlineInfo, 0)
+	for _, in := range inlines {
+		if pc >= in.StartPC && pc < in.EndPC {
+			stack = append(stack, in)
+		}
+	}
+	sort.SliceStable(stack, func(i, j int) bool {
+		return stack[i].Depth > stack[j].Depth
+	})
+	return stack
+}
+
+// Describe an inline stack, eg "a() inlined into b() inlined into c()"
+func FormatInlineStack(stack []*InlineInfo) string {
+	if len(stack) == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("%s()", stack[0].Name)
+	for _, in := range stack {
+		s = fmt.Sprintf("%s inlined into %s()", s, in.Caller)
+	}
+	return s
+}
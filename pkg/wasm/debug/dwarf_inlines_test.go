@@ -0,0 +1,24 @@
+package debug
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineStack(t *testing.T) {
+	wd := NewEmpty()
+	wd.Inlines = []*InlineInfo{
+		{Name: "b", Caller: "a", StartPC: 10, EndPC: 30, Depth: 1},
+		{Name: "c", Caller: "b", StartPC: 15, EndPC: 20, Depth: 2},
+		{Name: "d", Caller: "a", StartPC: 40, EndPC: 50, Depth: 1},
+	}
+
+	assert.Equal(t, 0, len(wd.GetInlineStack(5)))
+	assert.Equal(t, "b() inlined into a()", FormatInlineStack(wd.GetInlineStack(10)))
+	assert.Equal(t, "c() inlined into b() inlined into a()", FormatInlineStack(wd.GetInlineStack(15)))
+	assert.Equal(t, "b() inlined into a()", FormatInlineStack(wd.GetInlineStack(20)))
+
+	assert.Equal(t, 2, len(wd.GetInlinesInRange(0, 20)))
+	assert.Equal(t, 1, len(wd.GetInlinesInRange(30, 100)))
+}
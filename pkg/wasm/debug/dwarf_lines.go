@@ -20,6 +20,10 @@ import (
 	"debug/dwarf"
 	"fmt"
 	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type LineInfo struct {
@@ -28,8 +32,43 @@ type LineInfo struct {
 	Column     int
 }
 
+// A line table row, covering the addresses from start up to end. The file is an index into lineFiles.
+type lineRow struct {
+	start  uint64
+	end    uint64
+	file   uint32
+	line   uint32
+	column uint32
+}
+
+func (wd *WasmDebug) rowInfo(r *lineRow) LineInfo {
+	return LineInfo{
+		Filename:   wd.lineFiles[r.file],
+		Linenumber: int(r.line),
+		Column:     int(r.column),
+	}
+}
+
+// Filenames repeat across compile units, so only keep one copy of each
+func (wd *WasmDebug) internFile(name string) uint32 {
+	if wd.lineFileIDs == nil {
+		wd.lineFileIDs = make(map[string]uint32)
+	}
+	id, ok := wd.lineFileIDs[name]
+	if !ok {
+		id = uint32(len(wd.lineFiles))
+		wd.lineFiles = append(wd.lineFiles, name)
+		wd.lineFileIDs[name] = id
+	}
+	return id
+}
+
 func (wd *WasmDebug) ParseDwarfLineNumbers() error {
-	wd.LineNumbers = make(map[uint64]LineInfo)
+	wd.lines = nil
+	wd.linesSorted = false
+	wd.lineIndex = nil
+	wd.lineFiles = nil
+	wd.lineFileIDs = nil
 
 	if wd.DwarfData == nil {
 		return nil
@@ -52,17 +91,29 @@ func (wd *WasmDebug) ParseDwarfLineNumbers() error {
 			}
 			if liner != nil {
 				ent := dwarf.LineEntry{}
+				// Each row runs until the next one in its sequence
+				inSequence := false
 				for {
 					err = liner.Next(&ent)
 					if err == io.EOF {
 						break
 					}
 
-					wd.LineNumbers[ent.Address] = LineInfo{
-						Filename:   ent.File.Name,
-						Linenumber: ent.Line,
-						Column:     ent.Column,
+					if inSequence {
+						wd.lines[len(wd.lines)-1].end = ent.Address
 					}
+					inSequence = !ent.EndSequence
+					if ent.EndSequence {
+						continue
+					}
+
+					wd.lines = append(wd.lines, lineRow{
+						start:  ent.Address,
+						end:    ent.Address + 1,
+						file:   wd.internFile(ent.File.Name),
+						line:   uint32(ent.Line),
+						column: uint32(ent.Column),
+					})
 				}
 			}
 		}
@@ -71,43 +122,125 @@ func (wd *WasmDebug) ParseDwarfLineNumbers() error {
 	return nil
 }
 
+/**
+ * Add line info for a single address, eg for code that was added. The line table is sorted again when it's next used.
+ *
+ */
+func (wd *WasmDebug) AddLineInfo(pc uint64, li LineInfo) {
+	wd.lines = append(wd.lines, lineRow{
+		start:  pc,
+		end:    pc + 1,
+		file:   wd.internFile(li.Filename),
+		line:   uint32(li.Linenumber),
+		column: uint32(li.Column),
+	})
+	wd.linesSorted = false
+	wd.lineIndex = nil
+}
+
+// Get the line table sorted by address. As with the dwarf, a later row for the same address wins.
+func (wd *WasmDebug) sortedLines() []lineRow {
+	if !wd.linesSorted {
+		sort.SliceStable(wd.lines, func(i, j int) bool { return wd.lines[i].start < wd.lines[j].start })
+		n := 0
+		for i := range wd.lines {
+			if n > 0 && wd.lines[n-1].start == wd.lines[i].start {
+				n--
+			}
+			wd.lines[n] = wd.lines[i]
+			n++
+		}
+		wd.lines = wd.lines[:n]
+		wd.linesSorted = true
+	}
+	return wd.lines
+}
+
+// Find the first row starting at or after pc
+func (wd *WasmDebug) searchLines(pc uint64) int {
+	rows := wd.sortedLines()
+	return sort.Search(len(rows), func(i int) bool { return rows[i].start >= pc })
+}
+
+/**
+ * Get the line info for the row starting at an address.
+ *
+ */
+func (wd *WasmDebug) LineInfoAt(pc uint64) (LineInfo, bool) {
+	i := wd.searchLines(pc)
+	if i == len(wd.lines) || wd.lines[i].start != pc {
+		return LineInfo{}, false
+	}
+	return wd.rowInfo(&wd.lines[i]), true
+}
+
+/**
+ * Call fn for each row of the line table which overlaps start to end (inclusive), in address order.
+ *
+ */
+func (wd *WasmDebug) EachLineInRange(start uint64, end uint64, fn func(start uint64, end uint64, li LineInfo)) {
+	i := wd.searchLines(start)
+	// The row before may run on into the range
+	if i > 0 && wd.lines[i-1].end > start {
+		i--
+	}
+	for ; i < len(wd.lines) && wd.lines[i].start <= end; i++ {
+		r := &wd.lines[i]
+		fn(r.start, r.end, wd.rowInfo(r))
+	}
+}
+
+/**
+ * Call fn for each row of the line table, in address order.
+ *
+ */
+func (wd *WasmDebug) EachLine(fn func(start uint64, end uint64, li LineInfo)) {
+	wd.EachLineInRange(0, math.MaxUint64, fn)
+}
+
+// The number of rows in the line table
+func (wd *WasmDebug) NumLines() int {
+	return len(wd.sortedLines())
+}
+
 func (wd *WasmDebug) GetLineNumberInfo(pc uint64) string {
 	// See if we have any line info...
 	lineInfo := ""
-	li, ok := wd.LineNumbers[pc]
+	li, ok := wd.LineInfoAt(pc)
 	if ok {
 		lineInfo = fmt.Sprintf("%s:%d.%d", li.Filename, li.Linenumber, li.Column)
 	}
 	return lineInfo
 }
 
+/**
+ * Find the addresses from start to end (inclusive) where a row of the line table starts, sorted.
+ *
+ */
+func (wd *WasmDebug) LinePCsInRange(start uint64, end uint64) []uint64 {
+	var pcs []uint64
+	for i := wd.searchLines(start); i < len(wd.lines) && wd.lines[i].start <= end; i++ {
+		pcs = append(pcs, wd.lines[i].start)
+	}
+	return pcs
+}
+
 func (wd *WasmDebug) GetLineNumberBefore(start uint64, codePC uint64) string {
-	for pc := codePC; pc >= start; pc-- {
-		l := wd.GetLineNumberInfo(pc)
-		if l != "" {
-			return l
-		}
+	// Find the last row starting at or before codePC
+	i := wd.searchLines(codePC + 1)
+	if i == 0 || wd.lines[i-1].start < start {
+		return ""
 	}
-	return ""
+	return wd.GetLineNumberInfo(wd.lines[i-1].start)
 }
 
 func (wd *WasmDebug) GetLineNumberRange(start uint64, end uint64) string {
 	// Collect all the ranges together...
 	ranges := make(map[string][]int)
 
-	for pc := start; pc <= end; pc++ {
-		// Look it up...
-		li, ok := wd.LineNumbers[pc]
-		if ok {
-			m, ok2 := ranges[li.Filename]
-			if ok2 {
-				// Add it on...
-				ranges[li.Filename] = append(m, li.Linenumber)
-			} else {
-				ranges[li.Filename] = []int{li.Linenumber}
-			}
-		}
-	}
+	wd.EachLineInRange(start, end, func(_ uint64, _ uint64, li LineInfo) {
+		ranges[li.Filename] = append(ranges[li.Filename], li.Linenumber)
+	})
 
 	// Now lets bring things together...
 	info := ""
@@ -131,3 +264,36 @@ func (wd *WasmDebug) GetLineNumberRange(start uint64, end uint64) string {
 
 	return info
 }
+
+// Index the line table by file and line, for looking up addresses from a source location
+func (wd *WasmDebug) buildLineIndex() {
+	wd.lineIndex = make(map[string]map[int][]uint64)
+	wd.EachLine(func(pc uint64, _ uint64, li LineInfo) {
+		lines, ok := wd.lineIndex[li.Filename]
+		if !ok {
+			lines = make(map[int][]uint64)
+			wd.lineIndex[li.Filename] = lines
+		}
+		lines[li.Linenumber] = append(lines[li.Linenumber], pc)
+	})
+}
+
+/**
+ * Find all the code addresses for a source line, sorted.
+ * The file can be the full path, or a path suffix such as "main.go" or "pkg/main.go".
+ */
+func (wd *WasmDebug) FindAddressesForLine(file string, line int) []uint64 {
+	if wd.lineIndex == nil {
+		wd.buildLineIndex()
+	}
+	addrs := make([]uint64, 0)
+	file = filepath.ToSlash(file)
+	for filename, lines := range wd.lineIndex {
+		fn := filepath.ToSlash(filename)
+		if fn == file || strings.HasSuffix(fn, "/"+file) {
+			addrs = append(addrs, lines[line]...)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
@@ -0,0 +1,50 @@
+package debug
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineNumberLookups(t *testing.T) {
+	wd := NewEmpty()
+	wd.AddLineInfo(0x10, LineInfo{Filename: "main.go", Linenumber: 3, Column: 1})
+	wd.AddLineInfo(0x18, LineInfo{Filename: "main.go", Linenumber: 5, Column: 2})
+	wd.AddLineInfo(0x30, LineInfo{Filename: "util.go", Linenumber: 9, Column: 4})
+
+	assert.Equal(t, []uint64{0x10, 0x18}, wd.LinePCsInRange(0x10, 0x20))
+	assert.Equal(t, []uint64{0x18}, wd.LinePCsInRange(0x11, 0x18))
+	assert.Equal(t, 0, len(wd.LinePCsInRange(0x19, 0x2f)))
+
+	assert.Equal(t, "main.go:5.2", wd.GetLineNumberBefore(0x10, 0x20))
+	assert.Equal(t, "main.go:3.1", wd.GetLineNumberBefore(0x10, 0x10))
+	assert.Equal(t, "", wd.GetLineNumberBefore(0x20, 0x2f))
+	assert.Equal(t, "", wd.GetLineNumberBefore(0, 0x0f))
+
+	assert.Equal(t, "main.go(3-5)", wd.GetLineNumberRange(0x00, 0x20))
+
+	// Changes to the line numbers are picked up
+	wd.AddLineInfo(0x28, LineInfo{Filename: "util.go", Linenumber: 7, Column: 1})
+	assert.Equal(t, "util.go:7.1", wd.GetLineNumberBefore(0x20, 0x2f))
+	assert.Equal(t, "util.go(7-9)", wd.GetLineNumberRange(0x20, 0x40))
+}
+
+func TestFunctionDebugRenumber(t *testing.T) {
+	wd := NewEmpty()
+	wd.SetFunctionSignature(2, "main(argc, argv)")
+	wd.functionDebug = setIndexed(wd.functionDebug, 2, ";; main(argc, argv)\n")
+	wd.FunctionNames[2] = "$main"
+
+	assert.Equal(t, "", wd.GetFunctionSignature(0))
+	assert.Equal(t, "", wd.GetFunctionSignature(100))
+
+	wd.RenumberFunctions(map[int]int{0: 0, 1: 1, 2: 5})
+	assert.Equal(t, "main(argc, argv)", wd.GetFunctionSignature(5))
+	assert.Equal(t, ";; main(argc, argv)\n", wd.GetFunctionDebug(5))
+	assert.Equal(t, "", wd.GetFunctionSignature(2))
+	assert.Equal(t, "$main", wd.FunctionNames[5])
+
+	c := wd.Clone()
+	c.SetFunctionSignature(5, "changed()")
+	assert.Equal(t, "main(argc, argv)", wd.GetFunctionSignature(5))
+}
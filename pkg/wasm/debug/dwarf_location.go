@@ -17,12 +17,27 @@
 package debug
 
 import (
+	"debug/dwarf"
 	"encoding/binary"
 	"errors"
+	"fmt"
 )
 
 type DwarfLocations struct {
-	data []byte
+	data     []byte // .debug_loc (dwarf 4)
+	loclists []byte // .debug_loclists (dwarf 5)
+	addr     []byte // .debug_addr (dwarf 5)
+	units    []*DwarfUnit
+}
+
+// Per compile unit information needed to read dwarf 5 location lists
+type DwarfUnit struct {
+	Offset       uint64 // Offset of the unit header in .debug_info
+	End          uint64
+	Version      int
+	BaseAddress  uint64
+	AddrBase     uint64
+	LoclistsBase uint64
 }
 
 type LocationData struct {
@@ -37,6 +52,221 @@ func NewDwarfLocations(d []byte) *DwarfLocations {
 	}
 }
 
+/**
+ * Add the dwarf 5 sections. The unit headers in .debug_info are read so that we know which
+ * version each unit uses.
+ */
+func (dl *DwarfLocations) AddDwarf5(debug_info []byte, debug_loclists []byte, debug_addr []byte) {
+	dl.loclists = debug_loclists
+	dl.addr = debug_addr
+	dl.units = make([]*DwarfUnit, 0)
+
+	ptr := uint64(0)
+	for ptr+6 <= uint64(len(debug_info)) {
+		length := uint64(binary.LittleEndian.Uint32(debug_info[ptr:]))
+		if length >= 0xfffffff0 {
+			// 64 bit dwarf isn't used for wasm32
+			break
+		}
+		dl.units = append(dl.units, &DwarfUnit{
+			Offset:  ptr,
+			End:     ptr + 4 + length,
+			Version: int(binary.LittleEndian.Uint16(debug_info[ptr+4:])),
+		})
+		ptr += 4 + length
+	}
+}
+
+// Find the unit containing a debug_info offset
+func (dl *DwarfLocations) FindUnit(offset uint64) *DwarfUnit {
+	for _, u := range dl.units {
+		if offset >= u.Offset && offset < u.End {
+			return u
+		}
+	}
+	return nil
+}
+
+// Find the unit for a compile unit entry, and fill in its base addresses
+func (dl *DwarfLocations) unitForEntry(entry *dwarf.Entry) *DwarfUnit {
+	if dl == nil {
+		return nil
+	}
+	u := dl.FindUnit(uint64(entry.Offset))
+	if u == nil {
+		return nil
+	}
+	lowpc, ok := entry.Val(dwarf.AttrLowpc).(uint64)
+	if ok {
+		u.BaseAddress = lowpc
+	}
+	addrBase, ok := entry.Val(dwarf.AttrAddrBase).(int64)
+	if ok {
+		u.AddrBase = uint64(addrBase)
+	}
+	loclistsBase, ok := entry.Val(dwarf.AttrLoclistsBase).(int64)
+	if ok {
+		u.LoclistsBase = uint64(loclistsBase)
+	}
+	return u
+}
+
+/**
+ * Read a location list for a unit. Dwarf 5 units use .debug_loclists, anything else uses .debug_loc.
+ * If isIndex is set, p is a DW_FORM_loclistx index rather than an offset.
+ */
+func (dl *DwarfLocations) ReadUnitLocation(u *DwarfUnit, p uint64, isIndex bool) ([]*LocationData, error) {
+	if u == nil || u.Version < 5 {
+		if isIndex {
+			return nil, errors.New("Location list index used before dwarf 5")
+		}
+		return dl.ReadLocation(p), nil
+	}
+	if isIndex {
+		ptr := u.LoclistsBase + 4*p
+		if ptr+4 > uint64(len(dl.loclists)) {
+			return nil, fmt.Errorf("Location list index %d out of range", p)
+		}
+		p = u.LoclistsBase + uint64(binary.LittleEndian.Uint32(dl.loclists[ptr:]))
+	}
+	return dl.readLocList(u, p)
+}
+
+func (dl *DwarfLocations) readAddress(u *DwarfUnit, index uint64) (uint64, error) {
+	ptr := u.AddrBase + 4*index
+	if ptr+4 > uint64(len(dl.addr)) {
+		return 0, fmt.Errorf("Address index %d out of range", index)
+	}
+	return uint64(binary.LittleEndian.Uint32(dl.addr[ptr:])), nil
+}
+
+const DW_LLE_end_of_list = 0x00
+const DW_LLE_base_addressx = 0x01
+const DW_LLE_startx_endx = 0x02
+const DW_LLE_startx_length = 0x03
+const DW_LLE_offset_pair = 0x04
+const DW_LLE_default_location = 0x05
+const DW_LLE_base_address = 0x06
+const DW_LLE_start_end = 0x07
+const DW_LLE_start_length = 0x08
+
+// Read a dwarf 5 location list from .debug_loclists
+func (dl *DwarfLocations) readLocList(u *DwarfUnit, p uint64) ([]*LocationData, error) {
+	baseAddress := u.BaseAddress
+	ld := make([]*LocationData, 0)
+	data := dl.loclists
+	ptr := p
+
+	uvarint := func() (uint64, error) {
+		if ptr >= uint64(len(data)) {
+			return 0, errors.New("Location list truncated")
+		}
+		v, l := binary.Uvarint(data[ptr:])
+		if l <= 0 {
+			return 0, errors.New("Location list truncated")
+		}
+		ptr += uint64(l)
+		return v, nil
+	}
+	address := func() (uint64, error) {
+		if ptr+4 > uint64(len(data)) {
+			return 0, errors.New("Location list truncated")
+		}
+		v := binary.LittleEndian.Uint32(data[ptr:])
+		ptr += 4
+		return uint64(v), nil
+	}
+
+	for {
+		if ptr >= uint64(len(data)) {
+			return nil, errors.New("Location list truncated")
+		}
+		kind := data[ptr]
+		ptr++
+
+		var start, end, v1, v2 uint64
+		var err error
+		if kind == DW_LLE_end_of_list {
+			return ld, nil
+		} else if kind == DW_LLE_base_addressx {
+			v1, err = uvarint()
+			if err != nil {
+				return nil, err
+			}
+			baseAddress, err = dl.readAddress(u, v1)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if kind == DW_LLE_base_address {
+			baseAddress, err = address()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if kind == DW_LLE_startx_endx || kind == DW_LLE_startx_length || kind == DW_LLE_offset_pair {
+			v1, err = uvarint()
+			if err != nil {
+				return nil, err
+			}
+			v2, err = uvarint()
+			if err != nil {
+				return nil, err
+			}
+			if kind == DW_LLE_offset_pair {
+				start = baseAddress + v1
+				end = baseAddress + v2
+			} else {
+				start, err = dl.readAddress(u, v1)
+				if err != nil {
+					return nil, err
+				}
+				if kind == DW_LLE_startx_endx {
+					end, err = dl.readAddress(u, v2)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					end = start + v2
+				}
+			}
+		} else if kind == DW_LLE_default_location {
+			start = 0
+			end = 0xffffffff
+		} else if kind == DW_LLE_start_end || kind == DW_LLE_start_length {
+			start, err = address()
+			if err != nil {
+				return nil, err
+			}
+			if kind == DW_LLE_start_end {
+				end, err = address()
+			} else {
+				v2, err = uvarint()
+				end = start + v2
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, fmt.Errorf("Unknown location list entry %d", kind)
+		}
+
+		explen, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if ptr+explen > uint64(len(data)) {
+			return nil, errors.New("Location list truncated")
+		}
+		ld = append(ld, &LocationData{
+			StartAddress: uint32(start),
+			EndAddress:   uint32(end),
+			Expression:   data[ptr : ptr+explen],
+		})
+		ptr += explen
+	}
+}
+
 func (dl *DwarfLocations) ReadLocation(p uint64) []*LocationData {
 	baseAddress := uint32(0)
 	ld := make([]*LocationData, 0)
@@ -216,3 +446,15 @@ func (ld *LocationData) GetAddress() (uint32, error) {
 	}
 	return 0, errors.New("Address not found.")
 }
+
+// Get the address, including DW_OP_addrx which dwarf 5 uses to refer to .debug_addr
+func (dl *DwarfLocations) GetUnitAddress(u *DwarfUnit, ld *LocationData) (uint32, error) {
+	if u != nil && len(ld.Expression) > 1 && ld.Expression[0] == DW_OP_addrx {
+		index, l := binary.Uvarint(ld.Expression[1:])
+		if l > 0 && l == len(ld.Expression)-1 {
+			addr, err := dl.readAddress(u, index)
+			return uint32(addr), err
+		}
+	}
+	return ld.GetAddress()
+}
@@ -0,0 +1,63 @@
+package debug
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadLocList(t *testing.T) {
+	// .debug_addr: an 8 byte header, then two addresses
+	addr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(addr[8:], 0x100)
+	binary.LittleEndian.PutUint32(addr[12:], 0x200)
+
+	// .debug_loclists: a 12 byte header, an offset table with one entry, then the list
+	loclists := make([]byte, 16)
+	binary.LittleEndian.PutUint32(loclists[12:], 4)
+	loclists = append(loclists,
+		DW_LLE_base_addressx, 0,
+		DW_LLE_offset_pair, 0x10, 0x20, 3, DW_OP_WASM_location, DW_Location_Local, 3,
+		DW_LLE_startx_length, 1, 8, 1, DW_OP_stack_value,
+		DW_LLE_end_of_list,
+	)
+
+	// .debug_info: a single dwarf 5 unit header
+	info := make([]byte, 12)
+	binary.LittleEndian.PutUint32(info, 8)
+	binary.LittleEndian.PutUint16(info[4:], 5)
+
+	dl := NewDwarfLocations(nil)
+	dl.AddDwarf5(info, loclists, addr)
+
+	u := dl.FindUnit(11)
+	assert.NotNil(t, u)
+	assert.Equal(t, 5, u.Version)
+	assert.Nil(t, dl.FindUnit(12))
+
+	u.AddrBase = 8
+	u.LoclistsBase = 12
+
+	ld, err := dl.ReadUnitLocation(u, 0, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(ld))
+
+	assert.Equal(t, uint32(0x110), ld[0].StartAddress)
+	assert.Equal(t, uint32(0x120), ld[0].EndAddress)
+	locs := ld[0].ExtractWasmLocations()
+	assert.Equal(t, 1, len(locs))
+	assert.True(t, locs[0].IsLocal)
+	assert.Equal(t, uint64(3), locs[0].Index)
+
+	assert.Equal(t, uint32(0x200), ld[1].StartAddress)
+	assert.Equal(t, uint32(0x208), ld[1].EndAddress)
+
+	// Addresses through DW_OP_addrx
+	a, err := dl.GetUnitAddress(u, &LocationData{Expression: []byte{DW_OP_addrx, 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x200), a)
+
+	_, err = dl.ReadUnitLocation(u, 5, true)
+	assert.Error(t, err)
+}
@@ -18,8 +18,10 @@ package debug
 
 import (
 	"debug/dwarf"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 )
 
@@ -41,27 +43,101 @@ func (wd *WasmDebug) GetLocalVarType(pc uint64, index int) string {
 	return ""
 }
 
-func (wd *WasmDebug) GetFunctionDebug(fid int) string {
-	de, ok := wd.FunctionDebug[fid]
-	if ok {
-		return de
+func (wd *WasmDebug) GetLocalVarDwarfType(pc uint64, index int) dwarf.Type {
+	for _, lnd := range wd.LocalNames {
+		if lnd.Index == index && (pc >= lnd.StartPC && pc <= lnd.EndPC) {
+			return lnd.Type
+		}
 	}
-	return ""
+	return nil
 }
 
-func (wd *WasmDebug) SetFunctionSignature(fid int, de string) {
-	if wd.FunctionSignature == nil {
-		wd.FunctionSignature = make(map[int]string)
+/**
+ * Get wat identifiers for the params and locals of a function, or "" for any without a name.
+ * Names come from the name section, or else from dwarf if one variable uses the local for the whole function.
+ * Names are made unique, in the same way as duplicate function names.
+ */
+func (wd *WasmDebug) GetLocalIdentifiers(fid int, startPC uint64, endPC uint64, count int) []string {
+	ids := make([]string, count)
+	if wd == nil {
+		return ids
 	}
-	wd.FunctionSignature[fid] = de
+
+	names := wd.FunctionLocalNames[fid]
+	dwarfNames := make(map[int]string)
+	if len(names) == 0 && len(wd.LocalNames) > 0 {
+		// The dwarf name for each local, or "" if it has more than one
+		wd.buildLocalNameIndex()
+		i := sort.Search(len(wd.localNameIndex), func(i int) bool {
+			return wd.localNameIndex[i].StartPC >= startPC
+		})
+		for ; i < len(wd.localNameIndex) && wd.localNameIndex[i].StartPC < endPC; i++ {
+			lnd := wd.localNameIndex[i]
+			n, ok := dwarfNames[lnd.Index]
+			if !ok {
+				dwarfNames[lnd.Index] = lnd.VarName
+			} else if n != lnd.VarName {
+				dwarfNames[lnd.Index] = ""
+			}
+		}
+	}
+
+	used := make(map[string]bool)
+	for idx := range ids {
+		n, ok := names[idx]
+		if !ok && dwarfNames[idx] != "" {
+			n = "$" + dwarfNames[idx]
+		}
+		if n == "" || n == "$" {
+			continue
+		}
+		n = watIdentifier(n)
+		id := n
+		for dupidx := 2; used[id]; dupidx++ {
+			id = fmt.Sprintf("%s_%d", n, dupidx)
+		}
+		used[id] = true
+		ids[idx] = id
+	}
+	return ids
 }
 
-func (wd *WasmDebug) GetFunctionSignature(fid int) string {
-	de, ok := wd.FunctionSignature[fid]
-	if ok {
-		return de
+// Sort LocalNames by StartPC, unless they haven't changed since last time
+func (wd *WasmDebug) buildLocalNameIndex() {
+	if len(wd.LocalNames) == wd.localNameIndexLen && (len(wd.LocalNames) == 0 || &wd.LocalNames[0] == wd.localNameIndexFirst) {
+		return
+	}
+	wd.localNameIndex = append([]*LocalNameData(nil), wd.LocalNames...)
+	sort.SliceStable(wd.localNameIndex, func(i, j int) bool {
+		return wd.localNameIndex[i].StartPC < wd.localNameIndex[j].StartPC
+	})
+	wd.localNameIndexLen = len(wd.LocalNames)
+	wd.localNameIndexFirst = nil
+	if len(wd.LocalNames) > 0 {
+		wd.localNameIndexFirst = &wd.LocalNames[0]
 	}
-	return ""
+}
+
+// Replace anything that can't go in a wat identifier with _
+func watIdentifier(n string) string {
+	return "$" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("!#$%&'*+-./:<=>?@\\^_`|~", r) {
+			return r
+		}
+		return '_'
+	}, n[1:])
+}
+
+func (wd *WasmDebug) GetFunctionDebug(fid int) string {
+	return getIndexed(wd.functionDebug, fid)
+}
+
+func (wd *WasmDebug) SetFunctionSignature(fid int, de string) {
+	wd.functionSignature = setIndexed(wd.functionSignature, fid, de)
+}
+
+func (wd *WasmDebug) GetFunctionSignature(fid int) string {
+	return getIndexed(wd.functionSignature, fid)
 }
 
 type FunctionFinder interface {
@@ -76,6 +152,7 @@ func (wd *WasmDebug) ParseDwarfGlobals() {
 	}
 
 	entryReader := wd.DwarfData.Reader()
+	var unit *DwarfUnit
 
 	for {
 		// Read all entries in sequence
@@ -85,6 +162,10 @@ func (wd *WasmDebug) ParseDwarfGlobals() {
 			break
 		}
 
+		if entry.Tag == dwarf.TagCompileUnit {
+			unit = wd.DwarfLoc.unitForEntry(entry)
+		}
+
 		if entry.Tag == dwarf.TagVariable {
 
 			// Parse the location address
@@ -92,6 +173,7 @@ func (wd *WasmDebug) ParseDwarfGlobals() {
 			var vaddr []byte
 			vsize := int64(0)
 			vtype := ""
+			var vdtype dwarf.Type
 			for _, field := range entry.Field {
 				if field.Attr == dwarf.AttrName {
 					vname = field.Val.(string)
@@ -107,6 +189,7 @@ func (wd *WasmDebug) ParseDwarfGlobals() {
 					if err == nil {
 						vsize = ty.Size()
 						vtype = ty.String()
+						vdtype = ty
 					}
 				}
 			}
@@ -116,14 +199,15 @@ func (wd *WasmDebug) ParseDwarfGlobals() {
 				ld := &LocationData{
 					Expression: vaddr,
 				}
-				addr, err := ld.GetAddress()
+				addr, err := wd.DwarfLoc.GetUnitAddress(unit, ld)
 				if err == nil {
 
 					globalInfo := &GlobalNameData{
-						Name:    vname,
-						Address: uint64(addr),
-						Size:    uint64(vsize),
-						Type:    vtype,
+						Name:      vname,
+						Address:   uint64(addr),
+						Size:      uint64(vsize),
+						Type:      vtype,
+						DwarfType: vdtype,
 					}
 					wd.GlobalAddresses[vname] = globalInfo
 				} else {
@@ -139,13 +223,174 @@ func (wd *WasmDebug) ParseDwarfGlobals() {
 	}
 }
 
+// The dwarf tags that name a type
+var typeTags = map[dwarf.Tag]bool{
+	dwarf.TagBaseType:        true,
+	dwarf.TagStructType:      true,
+	dwarf.TagUnionType:       true,
+	dwarf.TagClassType:       true,
+	dwarf.TagEnumerationType: true,
+	dwarf.TagTypedef:         true,
+	dwarf.TagArrayType:       true,
+	dwarf.TagPointerType:     true,
+}
+
+/**
+ * Find a dwarf type by name, eg "main.point", "[]int" or "struct point".
+ * A complete definition is used in preference to a declaration.
+ */
+func (wd *WasmDebug) LookupType(name string) (dwarf.Type, error) {
+	if wd.DwarfData == nil {
+		return nil, errors.New("No dwarf data")
+	}
+	var declaration dwarf.Offset
+	found := false
+	entryReader := wd.DwarfData.Reader()
+	for {
+		entry, err := entryReader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if !typeTags[entry.Tag] {
+			continue
+		}
+		ename, _ := entry.Val(dwarf.AttrName).(string)
+		if ename != name {
+			// C structs can be asked for as "struct point"
+			if !strings.Contains(name, " ") {
+				continue
+			}
+			ty, err := wd.DwarfData.Type(entry.Offset)
+			if err != nil || ty.String() != name {
+				continue
+			}
+		}
+		if isDecl, _ := entry.Val(dwarf.AttrDeclaration).(bool); isDecl {
+			if !found {
+				declaration = entry.Offset
+				found = true
+			}
+			continue
+		}
+		return wd.DwarfData.Type(entry.Offset)
+	}
+	if found {
+		return wd.DwarfData.Type(declaration)
+	}
+	return nil, fmt.Errorf("Type %s not found", name)
+}
+
+type ParamData struct {
+	Name string
+	Type dwarf.Type // nil if the dwarf doesn't give one
+}
+
+/**
+ * Find the params of a function by its name or linkage name. This works for the declarations of
+ * imported functions too, which have no code. The first function found with the name is used.
+ */
+func (wd *WasmDebug) LookupFunctionParams(name string) ([]*ParamData, error) {
+	if wd.DwarfData == nil {
+		return nil, errors.New("No dwarf data")
+	}
+	entryReader := wd.DwarfData.Reader()
+	for {
+		entry, err := entryReader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		ename, _ := entry.Val(dwarf.AttrName).(string)
+		lname, _ := entry.Val(dwarf.AttrLinkageName).(string)
+		if ename != name && lname != name {
+			if entry.Children {
+				entryReader.SkipChildren()
+			}
+			continue
+		}
+
+		params := make([]*ParamData, 0)
+		if !entry.Children {
+			return params, nil
+		}
+		for {
+			child, err := entryReader.Next()
+			if err != nil {
+				return nil, err
+			}
+			if child == nil || child.Tag == 0 {
+				break
+			}
+			if child.Tag == dwarf.TagFormalParameter {
+				p := &ParamData{}
+				p.Name, _ = child.Val(dwarf.AttrName).(string)
+				if off, ok := child.Val(dwarf.AttrType).(dwarf.Offset); ok {
+					p.Type, _ = wd.DwarfData.Type(off)
+				}
+				params = append(params, p)
+			}
+			if child.Children {
+				entryReader.SkipChildren()
+			}
+		}
+		return params, nil
+	}
+	return nil, fmt.Errorf("Function %s not found", name)
+}
+
+/**
+ * Get the names of the functions the dwarf has code for, by their low pc. Use FindFunction on the
+ * pc to get the function index.
+ */
+func (wd *WasmDebug) GetSubprogramNames() (map[uint64]string, error) {
+	if wd.DwarfData == nil {
+		return nil, errors.New("No dwarf data")
+	}
+	names := make(map[uint64]string)
+	entryReader := wd.DwarfData.Reader()
+	for {
+		entry, err := entryReader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		lowpc, ok := entry.Val(dwarf.AttrLowpc).(uint64)
+		// Functions that were optimized away are left at 0
+		if ok && name != "" && lowpc != 0 {
+			if _, dup := names[lowpc]; !dup {
+				names[lowpc] = name
+			}
+		}
+		if entry.Children {
+			entryReader.SkipChildren()
+		}
+	}
+	return names, nil
+}
+
 func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 	wd.ParseDwarfGlobals()
 
-	wd.FunctionDebug = make(map[int]string)
-	if wd.FunctionSignature == nil {
-		wd.FunctionSignature = make(map[int]string)
+	err := wd.ParseDwarfInlines()
+	if err != nil {
+		return err
 	}
+
+	wd.functionDebug = nil
 	wd.LocalNames = make([]*LocalNameData, 0)
 
 	if wd.DwarfData == nil {
@@ -153,6 +398,7 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 	}
 
 	entryReader := wd.DwarfData.Reader()
+	var unit *DwarfUnit
 
 	for {
 		// Read all entries in sequence
@@ -162,9 +408,15 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 			break
 		}
 
+		if entry.Tag == dwarf.TagCompileUnit {
+			unit = wd.DwarfLoc.unitForEntry(entry)
+		}
+
 		if entry.Tag == dwarf.TagSubprogram {
 			spname := "<unknown>"
 			sploc := uint64(0)
+			spend := uint64(0)
+			spendOffset := false
 			for _, field := range entry.Field {
 				//				log.Printf("Field %v\n", field)
 				if field.Attr == dwarf.AttrName {
@@ -174,8 +426,20 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 					case uint64:
 						sploc = field.Val.(uint64)
 					}
+				} else if field.Attr == dwarf.AttrHighpc {
+					switch field.Val.(type) {
+					case uint64:
+						spend = field.Val.(uint64)
+					case int64:
+						// An offset from lowpc
+						spend = uint64(field.Val.(int64))
+						spendOffset = true
+					}
 				}
 			}
+			if spendOffset {
+				spend += sploc
+			}
 
 			log := false
 			if strings.HasPrefix(spname, "main.") ||
@@ -204,7 +468,9 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 
 					vname := "<unknown>"
 					vtype := ""
+					var vdtype dwarf.Type
 					vloc := int64(-1)
+					vlocIsIndex := false
 					vlocbytes := make([]byte, 0)
 					for _, field := range entry.Field {
 						if log {
@@ -219,12 +485,14 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 								ty, err := wd.DwarfData.Type(t)
 								if err == nil {
 									vtype = ty.String()
+									vdtype = ty
 								}
 							}
 						} else if field.Attr == dwarf.AttrLocation {
 							switch field.Val.(type) {
 							case int64:
 								vloc = field.Val.(int64)
+								vlocIsIndex = field.Class == dwarf.ClassLocList
 							case []byte:
 								vlocbytes = field.Val.([]byte)
 							}
@@ -233,7 +501,8 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 
 					if entry.Tag == dwarf.TagFormalParameter {
 						if vloc != -1 {
-							locdata := wd.DwarfLoc.ReadLocation(uint64(vloc))
+							// A broken location list just means we don't know where the variable is
+							locdata, _ := wd.DwarfLoc.ReadUnitLocation(unit, uint64(vloc), vlocIsIndex)
 							for _, ld := range locdata {
 								// We have code ptr range here...
 								if log {
@@ -248,6 +517,7 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 											Index:   int(l.Index),
 											VarName: vname,
 											VarType: vtype,
+											Type:    vdtype,
 										})
 										if log {
 											//fmt.Printf("LocationLocal %s %s (%d-%d) %d local %d\n", spname, vname, ld.StartAddress, ld.EndAddress, sploc, l.Index)
@@ -259,6 +529,11 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 							ld := &LocationData{
 								Expression: vlocbytes,
 							}
+							if vname != "<unknown>" {
+								// A single location is good for the whole function
+								ld.StartAddress = uint32(sploc)
+								ld.EndAddress = uint32(spend)
+							}
 							locs := ld.ExtractWasmLocations()
 							for _, l := range locs {
 								if l.IsLocal {
@@ -268,6 +543,7 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 										Index:   int(l.Index),
 										VarName: vname,
 										VarType: vtype,
+										Type:    vdtype,
 									})
 									if log {
 										//fmt.Printf("LocationLocal %s %s (%d-%d) %d local %d\n", spname, vname, ld.StartAddress, ld.EndAddress, sploc, l.Index)
@@ -286,7 +562,8 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 						}
 
 						if vloc != -1 {
-							locdata := wd.DwarfLoc.ReadLocation(uint64(vloc))
+							// A broken location list just means we don't know where the variable is
+							locdata, _ := wd.DwarfLoc.ReadUnitLocation(unit, uint64(vloc), vlocIsIndex)
 							for _, ld := range locdata {
 
 								if log {
@@ -302,6 +579,8 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 											EndPC:   uint64(ld.EndAddress),
 											Index:   int(l.Index),
 											VarName: vname,
+											VarType: vtype,
+											Type:    vdtype,
 										})
 
 										//										fmt.Printf("LocationLocalVariable %s %s %d-%d  local %d\n", spname, vname, ld.StartAddress, ld.EndAddress, l.Index)
@@ -315,13 +594,13 @@ func (wd *WasmDebug) ParseDwarfVariables(wf FunctionFinder) error {
 				}
 			}
 
-			function_debug := fmt.Sprintf(";; %s(%s)\n%s", spname, params, locals)
-
 			fid := wf.FindFunction(sploc)
 
 			if fid != -1 {
-				wd.FunctionSignature[fid] = fmt.Sprintf("%s(%s)", spname, params)
-				wd.FunctionDebug[fid] = function_debug
+				wd.functionSignature = setIndexed(wd.functionSignature, fid, fmt.Sprintf("%s(%s)", spname, params))
+				if !wd.LowMemory {
+					wd.functionDebug = setIndexed(wd.functionDebug, fid, fmt.Sprintf(";; %s(%s)\n%s", spname, params, locals))
+				}
 			}
 		}
 	}
@@ -0,0 +1,145 @@
+package debug
+
+import (
+	"debug/dwarf"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendName(b []byte, idx int, name string) []byte {
+	b = binary.AppendUvarint(b, uint64(idx))
+	b = binary.AppendUvarint(b, uint64(len(name)))
+	return append(b, name...)
+}
+
+func TestGetLocalIdentifiers(t *testing.T) {
+	// Local names for function 1: 0 = "n", 2 = "n" again, 3 = "a b"
+	locals := binary.AppendUvarint(nil, 1)
+	locals = binary.AppendUvarint(locals, 1)
+	locals = binary.AppendUvarint(locals, 3)
+	locals = appendName(locals, 0, "n")
+	locals = appendName(locals, 2, "n")
+	locals = appendName(locals, 3, "a b")
+	nameData := []byte{subsectionLocalNames}
+	nameData = binary.AppendUvarint(nameData, uint64(len(locals)))
+	nameData = append(nameData, locals...)
+
+	wd := NewEmpty()
+	wd.ParseNameSectionData(nameData)
+	assert.Equal(t, map[int]string{0: "$n", 2: "$n", 3: "$a b"}, wd.FunctionLocalNames[1])
+	assert.Equal(t, []string{"$n", "", "$n_2", "$a_b"}, wd.GetLocalIdentifiers(1, 0x100, 0x200, 4))
+
+	// Without a name section, dwarf names are used if a local only ever holds one variable
+	wd.LocalNames = append(wd.LocalNames,
+		&LocalNameData{StartPC: 0x310, EndPC: 0x320, Index: 1, VarName: "x"},
+		&LocalNameData{StartPC: 0x300, EndPC: 0x310, Index: 0, VarName: "total"},
+		&LocalNameData{StartPC: 0x340, EndPC: 0x350, Index: 0, VarName: "total"},
+		&LocalNameData{StartPC: 0x320, EndPC: 0x330, Index: 1, VarName: "y"},
+		&LocalNameData{StartPC: 0x400, EndPC: 0x410, Index: 2, VarName: "other"},
+	)
+	assert.Equal(t, []string{"$total", "", ""}, wd.GetLocalIdentifiers(2, 0x300, 0x400, 3))
+	assert.Equal(t, []string{"", "", "$other"}, wd.GetLocalIdentifiers(2, 0x400, 0x500, 3))
+
+	// The index is rebuilt when the dwarf names change
+	wd.LocalNames = []*LocalNameData{{StartPC: 0x300, EndPC: 0x310, Index: 1, VarName: "z"}}
+	assert.Equal(t, []string{"", "$z"}, wd.GetLocalIdentifiers(2, 0x300, 0x400, 2))
+}
+
+func TestLookupFunctionParams(t *testing.T) {
+	abbrev := []byte{
+		1, 0x11, 1, 0x03, 0x08, 0, 0, // compile_unit: name
+		2, 0x2e, 1, 0x03, 0x08, 0x3c, 0x19, 0, 0, // subprogram: name, declaration
+		3, 0x05, 0, 0x03, 0x08, 0x49, 0x13, 0, 0, // formal_parameter: name, type
+		4, 0x24, 0, 0x03, 0x08, 0x3e, 0x0b, 0x0b, 0x0b, 0, 0, // base_type: name, encoding, byte_size
+		5, 0x0f, 0, 0x49, 0x13, 0x0b, 0x0b, 0, 0, // pointer_type: type, byte_size
+		6, 0x2e, 0, 0x03, 0x08, 0, 0, // subprogram without children: name
+		0,
+	}
+	info := make([]byte, 4)
+	info = binary.LittleEndian.AppendUint16(info, 4) // version
+	info = binary.LittleEndian.AppendUint32(info, 0) // abbrev offset
+	info = append(info, 4)                           // address size
+	info = append(info, 1)
+	info = append(info, "test.c\x00"...)
+	intOffset := len(info)
+	info = append(info, 4)
+	info = append(info, "int\x00"...)
+	info = append(info, 5, 4)
+	ptrOffset := len(info)
+	info = append(info, 5)
+	info = binary.LittleEndian.AppendUint32(info, uint32(intOffset))
+	info = append(info, 4)
+	info = append(info, 2)
+	info = append(info, "add\x00"...)
+	info = append(info, 3)
+	info = append(info, "a\x00"...)
+	info = binary.LittleEndian.AppendUint32(info, uint32(intOffset))
+	info = append(info, 3)
+	info = append(info, "result\x00"...)
+	info = binary.LittleEndian.AppendUint32(info, uint32(ptrOffset))
+	info = append(info, 0)
+	info = append(info, 6)
+	info = append(info, "tick\x00"...)
+	info = append(info, 0)
+	binary.LittleEndian.PutUint32(info, uint32(len(info)-4))
+
+	data, err := dwarf.New(abbrev, nil, nil, info, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	wd := NewEmpty()
+	_, err = wd.LookupFunctionParams("add")
+	assert.Error(t, err)
+	wd.DwarfData = data
+
+	params, err := wd.LookupFunctionParams("add")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(params))
+	assert.Equal(t, "a", params[0].Name)
+	assert.Equal(t, "int", params[0].Type.String())
+	assert.Equal(t, "result", params[1].Name)
+	assert.Equal(t, "*int", params[1].Type.String())
+
+	params, err = wd.LookupFunctionParams("tick")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(params))
+
+	_, err = wd.LookupFunctionParams("missing")
+	assert.Error(t, err)
+}
+
+func TestGetSubprogramNames(t *testing.T) {
+	abbrev := []byte{
+		1, 0x11, 1, 0x03, 0x08, 0, 0, // compile_unit: name
+		2, 0x2e, 0, 0x03, 0x08, 0x11, 0x01, 0, 0, // subprogram: name, low_pc
+		3, 0x2e, 0, 0x03, 0x08, 0, 0, // subprogram without code: name
+		0,
+	}
+	info := make([]byte, 4)
+	info = binary.LittleEndian.AppendUint16(info, 4) // version
+	info = binary.LittleEndian.AppendUint32(info, 0) // abbrev offset
+	info = append(info, 4)                           // address size
+	info = append(info, 1)
+	info = append(info, "test.c\x00"...)
+	info = append(info, 2)
+	info = append(info, "main\x00"...)
+	info = binary.LittleEndian.AppendUint32(info, 0x20)
+	info = append(info, 2)
+	info = append(info, "removed\x00"...)
+	info = binary.LittleEndian.AppendUint32(info, 0)
+	info = append(info, 3)
+	info = append(info, "imported\x00"...)
+	info = append(info, 0)
+	binary.LittleEndian.PutUint32(info, uint32(len(info)-4))
+
+	data, err := dwarf.New(abbrev, nil, nil, info, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	wd := NewEmpty()
+	_, err = wd.GetSubprogramNames()
+	assert.Error(t, err)
+	wd.DwarfData = data
+
+	names, err := wd.GetSubprogramNames()
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint64]string{0x20: "main"}, names)
+}
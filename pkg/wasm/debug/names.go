@@ -19,7 +19,10 @@ package debug
 import (
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/demangle"
 )
 
 const subsectionModuleNames = 0
@@ -40,6 +43,7 @@ func (wd *WasmDebug) ParseNameSectionData(nameData []byte) {
 	wd.FunctionNames = make(map[int]string)
 	wd.GlobalNames = make(map[int]string)
 	wd.DataNames = make(map[int]string)
+	wd.FunctionLocalNames = make(map[int]map[int]string)
 
 	if nameData == nil {
 		return // Nothing to do.
@@ -95,6 +99,30 @@ func (wd *WasmDebug) ParseNameSectionData(nameData []byte) {
 				}
 			}
 
+		} else if subsectionID == subsectionLocalNames {
+			// A vector of functions, each with a vector of local names
+			funcVecLength, l := binary.Uvarint(data)
+			data = data[l:]
+
+			for i := 0; i < int(funcVecLength); i++ {
+				fidx, l := binary.Uvarint(data)
+				data = data[l:]
+				nameVecLength, l := binary.Uvarint(data)
+				data = data[l:]
+
+				names := make(map[int]string)
+				for j := 0; j < int(nameVecLength); j++ {
+					idx, l := binary.Uvarint(data)
+					data = data[l:]
+					nameLength, l := binary.Uvarint(data)
+					data = data[l:]
+					nameValue := data[:nameLength]
+					data = data[nameLength:]
+
+					names[int(idx)] = fmt.Sprintf("$%s", string(nameValue))
+				}
+				wd.FunctionLocalNames[int(fidx)] = names
+			}
 		} else if subsectionID == subsectionGlobalNames {
 			// Now read all the global names...
 			nameVecLength, l := binary.Uvarint(data)
@@ -131,9 +159,51 @@ func (wd *WasmDebug) ParseNameSectionData(nameData []byte) {
 
 }
 
+/**
+ * Encode the function, global and data names as a custom name section.
+ * The $ on the front of identifiers is dropped, as it is in the binary format.
+ */
+func (wd *WasmDebug) EncodeNameSectionData() []byte {
+	data := make([]byte, 0)
+	for _, sub := range []struct {
+		id    byte
+		names map[int]string
+	}{
+		{subsectionFunctionNames, wd.FunctionNames},
+		{subsectionGlobalNames, wd.GlobalNames},
+		{subsectionDataNames, wd.DataNames},
+	} {
+		if len(sub.names) == 0 {
+			continue
+		}
+		indexes := make([]int, 0, len(sub.names))
+		for idx := range sub.names {
+			indexes = append(indexes, idx)
+		}
+		sort.Ints(indexes)
+
+		content := binary.AppendUvarint(make([]byte, 0), uint64(len(indexes)))
+		for _, idx := range indexes {
+			n := strings.TrimPrefix(sub.names[idx], "$")
+			content = binary.AppendUvarint(content, uint64(idx))
+			content = binary.AppendUvarint(content, uint64(len(n)))
+			content = append(content, []byte(n)...)
+		}
+		data = append(data, sub.id)
+		data = binary.AppendUvarint(data, uint64(len(content)))
+		data = append(data, content...)
+	}
+	return data
+}
+
 func (wd *WasmDebug) GetFunctionIdentifier(fid int, defaultEmpty bool) string {
 	f, ok := wd.FunctionNames[fid]
 	if ok {
+		if wd.Demangle {
+			f = wd.demangleName(f)
+		}
+		f = strings.ReplaceAll(f, " ", "_")
+		f = strings.ReplaceAll(f, "\"", "_")
 		f = strings.ReplaceAll(f, "(", "_")
 		f = strings.ReplaceAll(f, ")", "_")
 		f = strings.ReplaceAll(f, "{", "_")
@@ -149,6 +219,65 @@ func (wd *WasmDebug) GetFunctionIdentifier(fid int, defaultEmpty bool) string {
 	return fmt.Sprintf("%d", fid)
 }
 
+/**
+ * Demangle a function name. Different names can demangle to the same thing (eg rust legacy names
+ * only differ by hash), so those get a suffix in the same way as duplicates in the name section.
+ *
+ */
+func (wd *WasmDebug) demangleName(name string) string {
+	if wd.demangled == nil {
+		wd.demangled = make(map[string]string)
+		wd.demangledUsed = make(map[string]bool)
+		for _, n := range wd.FunctionNames {
+			wd.demangledUsed[n] = true
+		}
+	}
+	d, ok := wd.demangled[name]
+	if ok {
+		return d
+	}
+	d = demangle.Demangle(name)
+	if d != name {
+		base := d
+		for dupidx := 2; wd.demangledUsed[d]; dupidx++ {
+			d = fmt.Sprintf("%s_%d", base, dupidx)
+		}
+		wd.demangledUsed[d] = true
+	}
+	wd.demangled[name] = d
+	return d
+}
+
+/**
+ * Get the raw name of a function from the name section, if demangling changed it.
+ * Returns "" if the name isn't demangled.
+ */
+func (wd *WasmDebug) GetMangledName(fid int) string {
+	f, ok := wd.FunctionNames[fid]
+	if !ok || !wd.Demangle || wd.demangleName(f) == f {
+		return ""
+	}
+	return f
+}
+
+/**
+ * Get every name a function can be matched on: the identifier, the raw name from the name
+ * section and the demangled name.
+ *
+ */
+func (wd *WasmDebug) GetFunctionMatchNames(fid int) []string {
+	names := []string{wd.GetFunctionIdentifier(fid, false)}
+	f, ok := wd.FunctionNames[fid]
+	if ok {
+		for _, n := range []string{f, demangle.Demangle(f)} {
+			if n != names[0] && (len(names) == 1 || n != names[1]) {
+				names = append(names, n)
+			}
+		}
+	}
+	return names
+}
+
 func (wd *WasmDebug) GetGlobalIdentifier(gid int, defaultEmpty bool) string {
 	f, ok := wd.GlobalNames[gid]
 	if ok {
@@ -0,0 +1,186 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasm
+
+import (
+	"debug/dwarf"
+	"fmt"
+)
+
+type DataAdder interface {
+	AddData(name string, data []byte)
+}
+
+// The most struct fields we'll show
+const maxTypedFields = 8
+
+// Remove typedefs and const/volatile
+func underlyingType(ty dwarf.Type) dwarf.Type {
+	for {
+		if t, ok := ty.(*dwarf.TypedefType); ok {
+			ty = t.Type
+		} else if t, ok := ty.(*dwarf.QualType); ok {
+			ty = t.Type
+		} else {
+			return ty
+		}
+	}
+}
+
+// Is this a pointer/length pair, such as a Go string or Rust &str
+func isStringHeader(st *dwarf.StructType) bool {
+	if len(st.Field) != 2 || st.Field[0].ByteOffset != 0 || st.Field[1].ByteOffset != 4 {
+		return false
+	}
+	ptrNames := map[string]bool{"str": true, "data_ptr": true, "ptr": true}
+	lenNames := map[string]bool{"len": true, "length": true}
+	_, isPtr := underlyingType(st.Field[0].Type).(*dwarf.PtrType)
+	return isPtr && ptrNames[st.Field[0].Name] && lenNames[st.Field[1].Name] && st.Field[1].Type.Size() == 4
+}
+
+// Is this a single byte character
+func isChar(ty dwarf.Type) bool {
+	switch t := underlyingType(ty).(type) {
+	case *dwarf.CharType:
+		return t.Size() == 1
+	case *dwarf.UcharType:
+		return t.Size() == 1
+	}
+	return false
+}
+
+// Can we load and show this as a single number
+func isScalar(ty dwarf.Type) bool {
+	switch underlyingType(ty).(type) {
+	case *dwarf.IntType, *dwarf.UintType, *dwarf.CharType, *dwarf.UcharType, *dwarf.BoolType,
+		*dwarf.FloatType, *dwarf.PtrType, *dwarf.EnumType:
+		return true
+	}
+	return false
+}
+
+/**
+ * Get wat to show what an i32 param points to, using its dwarf type.
+ * C strings and string headers (Go string, Rust &str) are shown as strings, and other structs
+ * show their scalar fields. Returns "" if there's nothing more useful than the raw value to show.
+ */
+func GetTypedParamCode(wf DataAdder, ty dwarf.Type, local int, prefix string) string {
+	if ty == nil {
+		return ""
+	}
+	pt, ok := underlyingType(ty).(*dwarf.PtrType)
+	if !ok || pt.Type == nil {
+		return ""
+	}
+
+	if isChar(pt.Type) {
+		return fmt.Sprintf(`i32.const offset($debug_typed_start)
+					i32.const length($debug_typed_start)
+					call $wt_print
+					local.get %d
+					call $debug_print_cstring
+					i32.const offset($debug_typed_end)
+					i32.const length($debug_typed_end)
+					call $wt_print
+					`, local)
+	}
+
+	st, ok := underlyingType(pt.Type).(*dwarf.StructType)
+	if !ok || st.Incomplete || st.Kind != "struct" {
+		return ""
+	}
+
+	body := ""
+	if isStringHeader(st) {
+		body = fmt.Sprintf(`local.get %d
+					i32.load
+					local.get %d
+					i32.load offset=4
+					call $debug_print_string
+					`, local, local)
+	} else {
+		count := 0
+		for _, f := range st.Field {
+			if count == maxTypedFields {
+				break
+			}
+			if f.BitSize != 0 || !isScalar(f.Type) {
+				continue
+			}
+			load := ""
+			size := f.Type.Size()
+			if size == 1 {
+				load = "i32.load8_u"
+			} else if size == 2 {
+				load = "i32.load16_u"
+			} else if size == 4 {
+				load = "i32.load"
+			} else if size == 8 {
+				load = "i64.load"
+			} else {
+				continue
+			}
+
+			name := fmt.Sprintf("%s_%d", prefix, count)
+			label := fmt.Sprintf("%s=", f.Name)
+			if count > 0 {
+				label = ", " + label
+			}
+			wf.AddData(name, []byte(label))
+
+			body = fmt.Sprintf(`%si32.const offset(%s)
+					i32.const length(%s)
+					call $wt_print
+					local.get %d
+					%s offset=%d
+					`, body, name, name, local, load, f.ByteOffset)
+			if size == 8 {
+				body = body + `call $wt_format_i64_hex
+					i32.const offset($db_number_i64)
+					i32.const 16
+					call $wt_print
+					`
+			} else {
+				body = body + `call $wt_format_i32_hex
+					i32.const offset($db_number_i32)
+					i32.const 8
+					call $wt_print
+					`
+			}
+			count++
+		}
+		if count == 0 {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf(`i32.const offset($debug_typed_start)
+					i32.const length($debug_typed_start)
+					call $wt_print
+					local.get %d
+					i32.eqz
+					if
+					i32.const offset($debug_null)
+					i32.const length($debug_null)
+					call $wt_print
+					else
+					%send
+					i32.const offset($debug_typed_end)
+					i32.const length($debug_typed_end)
+					call $wt_print
+					`, local, body)
+}
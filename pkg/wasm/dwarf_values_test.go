@@ -0,0 +1,49 @@
+package wasm
+
+import (
+	"debug/dwarf"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testData map[string][]byte
+
+func (td testData) AddData(name string, data []byte) {
+	td[name] = data
+}
+
+func TestGetTypedParamCode(t *testing.T) {
+	td := make(testData)
+	i32 := &dwarf.IntType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 4, Name: "int"}}}
+	char := &dwarf.CharType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 1, Name: "char"}}}
+	charPtr := &dwarf.PtrType{CommonType: dwarf.CommonType{ByteSize: 4}, Type: char}
+
+	// Not a pointer
+	assert.Equal(t, "", GetTypedParamCode(td, i32, 0, "$p"))
+
+	// C string
+	code := GetTypedParamCode(td, charPtr, 1, "$p")
+	assert.True(t, strings.Contains(code, "local.get 1\n"))
+	assert.True(t, strings.Contains(code, "call $debug_print_cstring"))
+
+	// Go string header
+	str := &dwarf.StructType{StructName: "string", Kind: "struct", Field: []*dwarf.StructField{
+		{Name: "str", Type: charPtr, ByteOffset: 0},
+		{Name: "len", Type: i32, ByteOffset: 4},
+	}}
+	code = GetTypedParamCode(td, &dwarf.PtrType{Type: str}, 0, "$p")
+	assert.True(t, strings.Contains(code, "call $debug_print_string"))
+	assert.Equal(t, 0, len(td))
+
+	// Any other struct shows its fields
+	point := &dwarf.StructType{StructName: "point", Kind: "struct", Field: []*dwarf.StructField{
+		{Name: "x", Type: i32, ByteOffset: 0},
+		{Name: "y", Type: i32, ByteOffset: 4},
+	}}
+	code = GetTypedParamCode(td, &dwarf.PtrType{Type: point}, 2, "$p")
+	assert.True(t, strings.Contains(code, "i32.load offset=4"))
+	assert.Equal(t, []byte("x="), td["$p_0"])
+	assert.Equal(t, []byte(", y="), td["$p_1"])
+}
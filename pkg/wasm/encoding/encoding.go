@@ -19,9 +19,13 @@ package encoding
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 func WriteString(w io.Writer, s string) error {
@@ -48,72 +52,103 @@ func WriteVarint(w io.Writer, v int64) error {
 
 const Whitespace = " \t\r\n"
 
+var ErrUnclosedComment = errors.New("Unclosed (; ;) comment")
+
 // Skip a multiline comment (; ;)
-func SkipComment(text string) string {
+func SkipComment(text string) (string, error) {
 	if strings.HasPrefix(text, "(;") {
 		p := strings.Index(text, ";)")
 		if p == -1 {
-			panic("Unclosed (; ;) comment")
+			return "", ErrUnclosedComment
 		}
 		text = strings.TrimLeft(text[p+2:], Whitespace)
 	}
-	return text
+	return text, nil
 }
 
-// Reads non-whitespace token
-func ReadToken(text string) (string, string) {
-	text = SkipComment(text)
-
-	token := ""
-	r := bufio.NewReader(strings.NewReader(text))
-	for {
-		ch, _, err := r.ReadRune()
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Fatal(err)
+/**
+ * Find the first (; ;) comment which isn't closed, ignoring any in strings or ;; comments.
+ * Returns its offset, or -1 if they're all closed.
+ * The Read functions treat an unclosed comment as running to the end of the text, so check with this first.
+ */
+func FindUnclosedComment(text string) int {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '"' {
+			// Skip the string, and anything escaped in it
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+		} else if strings.HasPrefix(text[i:], ";;") {
+			p := strings.IndexByte(text[i:], '\n')
+			if p == -1 {
+				return -1
+			}
+			i += p
+		} else if strings.HasPrefix(text[i:], "(;") {
+			p := strings.Index(text[i+2:], ";)")
+			if p == -1 {
+				return i
 			}
+			i += p + 3
 		}
+	}
+	return -1
+}
 
-		if ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n' {
-			break
-		}
+// Skip a comment for the Read functions, where an unclosed one runs to the end of the text
+func skipCommentToEnd(text string) string {
+	text, err := SkipComment(text)
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// Reads non-whitespace token
+func ReadToken(text string) (string, string) {
+	text = skipCommentToEnd(text)
 
-		token = token + string(ch)
+	// The whitespace is all ascii, so we don't need to decode the runes
+	current := strings.IndexAny(text, Whitespace)
+	if current == -1 {
+		current = len(text)
 	}
-	return token, strings.TrimLeft(text[len(token):], Whitespace)
+	return text[:current], strings.TrimLeft(text[current:], Whitespace)
 }
 
 // Reads a string enclosed with ""
 func ReadString(text string) (string, string) {
-	text = SkipComment(text)
+	text = skipCommentToEnd(text)
 
-	token := ""
+	current := 0
+	escaped := false
 	r := bufio.NewReader(strings.NewReader(text))
 	for {
-		ch, _, err := r.ReadRune()
+		ch, size, err := r.ReadRune()
+		// A strings.Reader only ever fails with io.EOF
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Fatal(err)
-			}
+			break
 		}
 
-		token = token + string(ch)
+		current += size
 
-		if ch == '"' && len(token) > 1 {
+		if escaped {
+			escaped = false
+		} else if ch == '\\' {
+			escaped = true
+		} else if ch == '"' && current > 1 {
 			break
 		}
 	}
-	return token, strings.TrimLeft(text[len(token):], Whitespace)
+	return text[:current], strings.TrimLeft(text[current:], Whitespace)
 }
 
 // This reads an element enclosed with parenthesis.
 // It also keeps track of speechmarks
 func ReadElement(text string) (string, string) {
-	text = SkipComment(text)
+	text = skipCommentToEnd(text)
 
 	bracketCount := 0
 	inString := false
@@ -122,18 +157,26 @@ func ReadElement(text string) (string, string) {
 	current := 0
 
 	r := bufio.NewReader(strings.NewReader(text))
+	escaped := false
 	for {
-		ch, _, err := r.ReadRune()
+		ch, size, err := r.ReadRune()
 
+		// A strings.Reader only ever fails with io.EOF
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Fatal(err)
-			}
+			break
 		}
 
-		current++
+		current += size
+
+		// Skip anything escaped inside a string, so \" doesn't end it
+		if escaped {
+			escaped = false
+			continue
+		}
+		if inString && ch == '\\' {
+			escaped = true
+			continue
+		}
 
 		if ch == '"' {
 			inString = !inString
@@ -156,3 +199,76 @@ func ReadElement(text string) (string, string) {
 
 	return text[:current], strings.TrimLeft(text[current:], Whitespace)
 }
+
+// Decodes a string enclosed with "", as read by ReadString, handling escapes such as \n, \22 and \u{263a}
+func DecodeString(text string) ([]byte, error) {
+	if len(text) < 2 || text[0] != '"' || text[len(text)-1] != '"' {
+		return nil, fmt.Errorf("string %s is not enclosed with \"\"", text)
+	}
+	text = text[1 : len(text)-1]
+
+	data := make([]byte, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			if text[i] == '"' {
+				return nil, errors.New("unescaped \" in string")
+			}
+			data = append(data, text[i])
+			continue
+		}
+		i++
+		if i == len(text) {
+			return nil, errors.New("string ends with \\")
+		}
+		switch text[i] {
+		case 't':
+			data = append(data, '\t')
+		case 'n':
+			data = append(data, '\n')
+		case 'r':
+			data = append(data, '\r')
+		case '"', '\'', '\\':
+			data = append(data, text[i])
+		case 'u':
+			// \u{hex}, written out as utf8
+			end := strings.IndexByte(text[i:], '}')
+			if !strings.HasPrefix(text[i:], "u{") || end == -1 {
+				return nil, errors.New("invalid \\u escape in string")
+			}
+			cp, err := strconv.ParseUint(strings.ReplaceAll(text[i+2:i+end], "_", ""), 16, 32)
+			if err != nil || cp > unicode.MaxRune || (cp >= 0xd800 && cp < 0xe000) {
+				return nil, fmt.Errorf("invalid \\u escape %s in string", text[i-1:i+end+1])
+			}
+			data = utf8.AppendRune(data, rune(cp))
+			i += end
+		default:
+			if i+1 == len(text) {
+				return nil, errors.New("string ends in the middle of an escape")
+			}
+			bv, err := strconv.ParseUint(text[i:i+2], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape \\%s in string", text[i:i+2])
+			}
+			data = append(data, byte(bv))
+			i++
+		}
+	}
+	return data, nil
+}
+
+// Escapes data for a wat string, without the enclosing "". Printable ascii is left as it is, and anything else is written as hex.
+func EscapeString(data []byte) string {
+	var sb strings.Builder
+	for _, b := range data {
+		if b >= 0x20 && b < 0x7f && b != '"' && b != '\\' {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteByte('\\')
+			sb.WriteByte(hexDigits[b>>4])
+			sb.WriteByte(hexDigits[b&15])
+		}
+	}
+	return sb.String()
+}
+
+const hexDigits = "0123456789abcdef"
@@ -16,11 +16,17 @@
 
 package encoding
 
+import "encoding/binary"
+
+// Decode a signed leb128. Like binary.Uvarint, n is 0 if it's truncated or too long for 64 bits.
 func DecodeSleb128(b []byte) (s int64, n int) {
 	result := int64(0)
 	shift := 0
 	ptr := 0
 	for {
+		if ptr == len(b) || ptr == binary.MaxVarintLen64 {
+			return 0, 0
+		}
 		by := b[ptr]
 		ptr++
 		result = result | (int64(by&0x7f) << shift)
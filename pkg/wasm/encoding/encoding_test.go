@@ -1,6 +1,8 @@
 package encoding
 
 import (
+	"bytes"
+
 	"github.com/stretchr/testify/assert"
 
 	"testing"
@@ -25,4 +27,67 @@ func TestEncodingSleb(t *testing.T) {
 	}
 
 	assert.Equal(t, len(b), 0)
+
+	// Truncated or overlong numbers don't decode
+	for _, b := range [][]byte{{}, {0x80}, {0xff, 0xff}, bytes.Repeat([]byte{0x80}, 11)} {
+		_, l := DecodeSleb128(b)
+		assert.Equal(t, 0, l, b)
+	}
+}
+
+func TestSkipComment(t *testing.T) {
+	text, err := SkipComment("(; a comment ;) i32.const 1")
+	assert.NoError(t, err)
+	assert.Equal(t, "i32.const 1", text)
+
+	_, err = SkipComment("(; a comment")
+	assert.ErrorIs(t, err, ErrUnclosedComment)
+
+	assert.Equal(t, -1, FindUnclosedComment(`(module "(;" ;; (;`+"\n)"))
+	assert.Equal(t, 14, FindUnclosedComment("(module (; ;) (; \n)"))
+}
+
+func TestDecodeString(t *testing.T) {
+	for text, expected := range map[string]string{
+		`"hello world"`:       "hello world",
+		`"\0d\0a\00\ff"`:      "\r\n\x00\xff",
+		`"\t\n\r\"\'\\"`:      "\t\n\r\"'\\",
+		`"\u{41}\u{263a}"`:    "A☺",
+		`"\u{1_f600}"`:        "\U0001f600",
+		`"caf\c3\a9 café"`:    "café café",
+		`""`:                  "",
+		`"a\22b\22c"`:         "a\"b\"c",
+		`"{\22ph\22:\22B\22"`: "{\"ph\":\"B\"",
+	} {
+		data, err := DecodeString(text)
+		assert.NoError(t, err, text)
+		assert.Equal(t, expected, string(data), text)
+	}
+
+	for _, text := range []string{`"\`, `"\q"`, `"\0"`, `"\u{d800}"`, `"\u{110000}"`, `"\u41"`, `"a"b"`, `abc`} {
+		_, err := DecodeString(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestEscapeString(t *testing.T) {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	text := `"` + EscapeString(data) + `"`
+	decoded, err := DecodeString(text)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decoded)
+	assert.Equal(t, `say \22hi\22 \5c\0a`, EscapeString([]byte("say \"hi\" \\\n")))
+}
+
+func TestReadStringEscapes(t *testing.T) {
+	s, rest := ReadString(`"a\"b\\" "c"`)
+	assert.Equal(t, `"a\"b\\"`, s)
+	assert.Equal(t, `"c"`, rest)
+
+	el, rest := ReadElement(`(data "x\")" "é(") (next)`)
+	assert.Equal(t, `(data "x\")" "é(")`, el)
+	assert.Equal(t, `(next)`, rest)
 }
@@ -34,6 +34,14 @@ type WasmLookupContext interface {
  *
  */
 func ExpressionFromWat(d string) ([]*Expression, error) {
+	return ExpressionFromWatWithLocals(d, nil)
+}
+
+/**
+ * Create an Expression from some wat source, which can refer to the given locals by name.
+ * Labels must be declared in the same source, eg block $done ... br_if $done
+ */
+func ExpressionFromWatWithLocals(d string, localNames map[string]int) ([]*Expression, error) {
 	newex := make([]*Expression, 0)
 	lines := strings.Split(d, "\n")
 	for _, toline := range lines {
@@ -45,22 +53,71 @@ func ExpressionFromWat(d string) ([]*Expression, error) {
 		toline = strings.Trim(toline, encoding.Whitespace)
 		if len(toline) > 0 {
 			newe := &Expression{}
-			err := newe.DecodeWat(toline, nil)
+			err := newe.DecodeWat(toline, localNames)
 			if err != nil {
 				return newex, err
 			}
 			newex = append(newex, newe)
 		}
 	}
-	return newex, nil
+	return newex, ResolveLabels(newex)
+}
+
+/**
+ * Turn any branches to named labels into depths. The code doesn't need to be balanced, so a
+ * snippet can open a block and leave the end to another one, but the names must be in scope.
+ */
+func ResolveLabels(exp []*Expression) error {
+	blocks := make([]string, 0)
+	depth := func(id string) (int, error) {
+		for i := len(blocks) - 1; i >= 0; i-- {
+			if blocks[i] == id {
+				return len(blocks) - 1 - i, nil
+			}
+		}
+		return 0, fmt.Errorf("Label %s not found", id)
+	}
+
+	var err error
+	for _, e := range exp {
+		if e.Opcode == InstrToOpcode["block"] ||
+			e.Opcode == InstrToOpcode["loop"] ||
+			e.Opcode == InstrToOpcode["if"] {
+			blocks = append(blocks, e.BlockId)
+			e.BlockId = ""
+		} else if e.Opcode == InstrToOpcode["end"] {
+			if len(blocks) > 0 {
+				blocks = blocks[:len(blocks)-1]
+			}
+		} else if e.LabelNeedsLinking {
+			for i, id := range e.LabelIds {
+				if id != "" {
+					e.Labels[i], err = depth(id)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if e.LabelId != "" {
+				e.LabelIndex, err = depth(e.LabelId)
+				if err != nil {
+					return err
+				}
+			}
+			e.LabelNeedsLinking = false
+			e.LabelId = ""
+			e.LabelIds = nil
+		}
+	}
+	return nil
 }
 
 /**
  * Add an expression to the start of some code
  *
  */
-func AddExpressionStart(exp []*Expression, to string) ([]*Expression, error) {
-	newex, err := ExpressionFromWat(to)
+func AddExpressionStart(exp []*Expression, to string, localNames map[string]int) ([]*Expression, error) {
+	newex, err := ExpressionFromWatWithLocals(to, localNames)
 	if err != nil {
 		return nil, err
 	}
@@ -75,8 +132,8 @@ func AddExpressionStart(exp []*Expression, to string) ([]*Expression, error) {
  * Add an expression to the end of some code
  *
  */
-func AddExpressionEnd(exp []*Expression, to string) ([]*Expression, error) {
-	newex, err := ExpressionFromWat(to)
+func AddExpressionEnd(exp []*Expression, to string, localNames map[string]int) ([]*Expression, error) {
+	newex, err := ExpressionFromWatWithLocals(to, localNames)
 	if err != nil {
 		return nil, err
 	}
@@ -91,21 +148,19 @@ func AddExpressionEnd(exp []*Expression, to string) ([]*Expression, error) {
  * Insert an expression after any instructions that need relocation fixup (offset())
  *
  */
-func InsertAfterRelocating(exp []*Expression, to string) ([]*Expression, error) {
-	newex, err := ExpressionFromWat(to)
+func InsertAfterRelocating(exp []*Expression, to string, localNames map[string]int) ([]*Expression, error) {
+	newex, err := ExpressionFromWatWithLocals(to, localNames)
 	if err != nil {
 		return nil, err
 	}
 
 	// Now we need to find where to insert the code
-	adjustedExpression := make([]*Expression, 0)
-	for _, e := range exp {
-		adjustedExpression = append(adjustedExpression, e)
+	return Walk(exp, -1, func(ctx *WalkContext, e *Expression) WalkAction {
 		if e.DataOffsetNeedsAdjusting {
-			adjustedExpression = append(adjustedExpression, newex...)
+			ctx.InsertAfter(newex...)
 		}
-	}
-	return adjustedExpression, nil
+		return WalkContinue
+	}), nil
 }
 
 /**
@@ -114,9 +169,24 @@ func InsertAfterRelocating(exp []*Expression, to string) ([]*Expression, error)
  */
 func ModifyAllGlobalIndexes(exp []*Expression, m map[int]int) {
 	for _, e := range exp {
-		newid, ok := m[e.GlobalIndex]
-		if ok {
-			e.GlobalIndex = newid
+		if e.Opcode == InstrToOpcode["global.get"] ||
+			e.Opcode == InstrToOpcode["global.set"] {
+			newid, ok := m[e.GlobalIndex]
+			if ok {
+				e.GlobalIndex = newid
+			}
+		}
+	}
+}
+
+// Remap the types used by call_indirect and typed blocks
+func ModifyAllTypeIndexes(exp []*Expression, m map[int]int) {
+	for _, e := range exp {
+		if e.HasTypeIndex() {
+			newid, ok := m[e.TypeIndex]
+			if ok {
+				e.TypeIndex = newid
+			}
 		}
 	}
 }
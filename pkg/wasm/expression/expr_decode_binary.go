@@ -18,6 +18,7 @@ package expression
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 
@@ -46,120 +47,160 @@ func NewExpression(data []byte, pc uint64) ([]*Expression, int, error) {
 			Opcode: Opcode(opcode),
 		}
 
-		// First deal with simple opcodes (No args)
-		if expr.HasNoArgs() && expr.Opcode != InstrToOpcode["end"] {
-			// Fall through and add it as it is.
-		} else if Opcode(opcode) == InstrToOpcode["br_table"] {
-			numLabels, l := binary.Uvarint(data[ptr:])
+		if expr.Opcode == ExtendedOpcodeFC {
+			opcode2, l, err := readUvarintAt(data, ptr)
+			if err != nil {
+				return nil, 0, err
+			}
+			ptr += l
+			expr.OpcodeExt = int(opcode2)
+		}
+
+		info := expr.Info()
+		if info == nil || info.Immediate == ImmediateUnsupported {
+			if expr.Opcode == ExtendedOpcodeFC {
+				return nil, 0, fmt.Errorf("Unsupported opcode 0xfc %d", expr.OpcodeExt)
+			}
+			return nil, 0, fmt.Errorf("Unsupported opcode %d", opcode)
+		}
+
+		var err error
+		switch info.Immediate {
+		case ImmediateNone:
+			if expr.Opcode == InstrToOpcode["end"] {
+				nestCounter--
+			}
+		case ImmediateBlockType:
+			// Read the blocktype, which is either 0x40, a value type, or a type index as an s33
+			var bt int64
+			var l int
+			bt, l, err = readSleb128At(data, ptr)
+			if err != nil {
+				break
+			}
+			if bt < 0 {
+				expr.Result = types.ValType(data[ptr])
+				ptr++
+			} else {
+				expr.Result = types.ValNone
+				expr.TypedBlock = true
+				expr.TypeIndex = int(bt)
+				ptr += l
+			}
+			nestCounter++
+		case ImmediateLabel:
+			var val uint64
+			var l int
+			val, l, err = readUvarintAt(data, ptr)
+			ptr += l
+			expr.LabelIndex = int(val)
+		case ImmediateLabelTable:
+			var numLabels uint64
+			var l int
+			numLabels, l, err = readUvarintAt(data, ptr)
 			ptr += l
 			labels := make([]int, 0)
-			for ll := 0; ll < int(numLabels); ll++ {
-				labelIdx, l := binary.Uvarint(data[ptr:])
+			for ll := 0; ll < int(numLabels) && err == nil; ll++ {
+				var labelIdx uint64
+				labelIdx, l, err = readUvarintAt(data, ptr)
 				ptr += l
 				labels = append(labels, int(labelIdx))
 			}
-			defaultLabelIdx, l := binary.Uvarint(data[ptr:])
+			if err != nil {
+				break
+			}
+			var defaultLabelIdx uint64
+			defaultLabelIdx, l, err = readUvarintAt(data, ptr)
 			ptr += l
 			expr.Labels = labels
 			expr.LabelIndex = int(defaultLabelIdx)
-		} else if Opcode(opcode) == InstrToOpcode["br"] ||
-			Opcode(opcode) == InstrToOpcode["br_if"] {
-			val, l := binary.Uvarint(data[ptr:])
+		case ImmediateFunc:
+			var val uint64
+			var l int
+			val, l, err = readUvarintAt(data, ptr)
 			ptr += l
-			expr.LabelIndex = int(val)
-		} else if expr.HasMemoryArgs() {
-			align, l := binary.Uvarint(data[ptr:])
-			ptr += l
-			offset, l := binary.Uvarint(data[ptr:])
+			expr.FuncIndex = int(val)
+		case ImmediateCallIndirect:
+			var typeIdx, tableIdx uint64
+			var l int
+			typeIdx, l, err = readUvarintAt(data, ptr)
 			ptr += l
-			expr.MemAlign = int(align)
-			expr.MemOffset = int(offset)
-		} else if Opcode(opcode) == InstrToOpcode["memory.size"] ||
-			Opcode(opcode) == InstrToOpcode["memory.grow"] {
-			//				memoryIndex := data[ptr]
-			// TODO: Use this to support multiple memories etc
-			ptr++
-		} else if Opcode(opcode) == InstrToOpcode["block"] ||
-			Opcode(opcode) == InstrToOpcode["if"] ||
-			Opcode(opcode) == InstrToOpcode["loop"] {
-			// Read the blocktype
-			valType := data[ptr]
-			ptr++
-
-			expr.Result = types.ValType(valType)
-			nestCounter++
-		} else if Opcode(opcode) == InstrToOpcode["end"] {
-			nestCounter--
-			if nestCounter == 0 {
+			if err != nil {
 				break
 			}
-		} else if Opcode(opcode) == InstrToOpcode["i32.const"] {
-			val, l := encoding.DecodeSleb128(data[ptr:])
-			ptr += int(l)
-			expr.I32Value = int32(val)
-		} else if Opcode(opcode) == InstrToOpcode["i64.const"] {
-			val, l := encoding.DecodeSleb128(data[ptr:])
-			ptr += int(l)
-			expr.I64Value = int64(val)
-		} else if Opcode(opcode) == InstrToOpcode["f32.const"] {
-			ival := binary.LittleEndian.Uint32(data[ptr : ptr+4])
-			val := math.Float32frombits(ival)
-			ptr += 4
-			expr.F32Value = float32(val)
-		} else if Opcode(opcode) == InstrToOpcode["f64.const"] {
-			ival := binary.LittleEndian.Uint64(data[ptr : ptr+8])
-			val := math.Float64frombits(ival)
-			ptr += 8
-			expr.F64Value = float64(val)
-		} else if Opcode(opcode) == InstrToOpcode["local.get"] ||
-			Opcode(opcode) == InstrToOpcode["local.set"] ||
-			Opcode(opcode) == InstrToOpcode["local.tee"] {
-			val, l := binary.Uvarint(data[ptr:])
+			tableIdx, l, err = readUvarintAt(data, ptr)
+			ptr += l
+			expr.TypeIndex = int(typeIdx)
+			expr.TableIndex = int(tableIdx)
+		case ImmediateLocal:
+			var val uint64
+			var l int
+			val, l, err = readUvarintAt(data, ptr)
 			ptr += l
 			expr.LocalIndex = int(val)
-		} else if Opcode(opcode) == InstrToOpcode["global.get"] ||
-			Opcode(opcode) == InstrToOpcode["global.set"] {
-			val, l := binary.Uvarint(data[ptr:])
+		case ImmediateGlobal:
+			var val uint64
+			var l int
+			val, l, err = readUvarintAt(data, ptr)
 			ptr += l
 			expr.GlobalIndex = int(val)
-		} else if Opcode(opcode) == InstrToOpcode["call"] {
-			val, l := binary.Uvarint(data[ptr:])
+		case ImmediateMemArg:
+			var align, offset uint64
+			var l int
+			align, l, err = readUvarintAt(data, ptr)
 			ptr += l
-			expr.FuncIndex = int(val)
-		} else if Opcode(opcode) == InstrToOpcode["call_indirect"] {
-			typeIdx, l := binary.Uvarint(data[ptr:])
+			if err != nil {
+				break
+			}
+			offset, l, err = readUvarintAt(data, ptr)
 			ptr += l
-			tableIdx, l := binary.Uvarint(data[ptr:])
+			expr.MemAlign = int(align)
+			expr.MemOffset = int(offset)
+		case ImmediateMemory:
+			// TODO: Use the memory index to support multiple memories etc
+			ptr++
+		case ImmediateMemoryPair:
+			// For now we expect two 0 bytes.
+			ptr += 2
+		case ImmediateI32:
+			var val int64
+			var l int
+			val, l, err = readSleb128At(data, ptr)
 			ptr += l
-			expr.TypeIndex = int(typeIdx)
-			expr.TableIndex = int(tableIdx)
-		} else if Opcode(opcode) == ExtendedOpcodeFC {
-			opcode2, l := binary.Uvarint(data[ptr:])
+			expr.I32Value = int32(val)
+		case ImmediateI64:
+			var val int64
+			var l int
+			val, l, err = readSleb128At(data, ptr)
 			ptr += l
-			expr.OpcodeExt = int(opcode2)
-			// Now deal with opcode2...
-			if int(opcode2) == instrToOpcodeFC["memory.copy"] {
-				// For now we expect two 0 bytes.
-				ptr += 2
-			} else if int(opcode2) == instrToOpcodeFC["memory.fill"] {
-				// For now we expect one 0 byte.
-				ptr++
-			} else if int(opcode2) == instrToOpcodeFC["i32.trunc_sat_f32_s"] ||
-				int(opcode2) == instrToOpcodeFC["i32.trunc_sat_f32_u"] ||
-				int(opcode2) == instrToOpcodeFC["i32.trunc_sat_f64_s"] ||
-				int(opcode2) == instrToOpcodeFC["i32.trunc_sat_f64_u"] ||
-				int(opcode2) == instrToOpcodeFC["i64.trunc_sat_f32_s"] ||
-				int(opcode2) == instrToOpcodeFC["i64.trunc_sat_f32_u"] ||
-				int(opcode2) == instrToOpcodeFC["i64.trunc_sat_f64_s"] ||
-				int(opcode2) == instrToOpcodeFC["i64.trunc_sat_f64_u"] {
-
-			} else {
-				return nil, 0, fmt.Errorf("Unsupported opcode 0xfc %d", opcode2)
+			expr.I64Value = int64(val)
+		case ImmediateF32:
+			if ptr+4 > len(data) {
+				err = errTruncated
+				break
 			}
+			ival := binary.LittleEndian.Uint32(data[ptr : ptr+4])
+			ptr += 4
+			expr.F32Value = math.Float32frombits(ival)
+		case ImmediateF64:
+			if ptr+8 > len(data) {
+				err = errTruncated
+				break
+			}
+			ival := binary.LittleEndian.Uint64(data[ptr : ptr+8])
+			ptr += 8
+			expr.F64Value = math.Float64frombits(ival)
+		}
+		if err == nil && ptr > len(data) {
+			err = errTruncated
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("Error decoding %s at PC %d: %w", info.Name, expr.PC, err)
+		}
 
-		} else {
-			ptr--
-			return nil, 0, fmt.Errorf("Unsupported opcode %d", data[ptr])
+		// The final end isn't part of the expression
+		if nestCounter == 0 {
+			break
 		}
 
 		expr.PCNext = pc + uint64(ptr)
@@ -169,3 +210,29 @@ func NewExpression(data []byte, pc uint64) ([]*Expression, int, error) {
 	}
 	return exps, ptr, nil
 }
+
+var errTruncated = errors.New("not enough data")
+
+// Read a uvarint at ptr, returning its length in bytes
+func readUvarintAt(data []byte, ptr int) (uint64, int, error) {
+	if ptr > len(data) {
+		return 0, 0, errTruncated
+	}
+	v, l := binary.Uvarint(data[ptr:])
+	if l <= 0 {
+		return 0, 0, errTruncated
+	}
+	return v, l, nil
+}
+
+// Read a signed leb128 at ptr, returning its length in bytes
+func readSleb128At(data []byte, ptr int) (int64, int, error) {
+	if ptr > len(data) {
+		return 0, 0, errTruncated
+	}
+	v, l := encoding.DecodeSleb128(data[ptr:])
+	if l <= 0 {
+		return 0, 0, errTruncated
+	}
+	return v, l, nil
+}
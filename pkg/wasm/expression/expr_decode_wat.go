@@ -19,6 +19,7 @@ package expression
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
@@ -27,157 +28,34 @@ import (
 )
 
 func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
-	s = encoding.SkipComment(s)
+	s, err := encoding.SkipComment(s)
+	if err != nil {
+		return err
+	}
 	s = strings.Trim(s, encoding.Whitespace)
 
 	opcode, s := encoding.ReadToken(s)
 
-	// First deal with simple opcodes (No args)
-	if opcode == "unreachable" ||
-		opcode == "nop" ||
-		opcode == "return" ||
-		opcode == "drop" ||
-		opcode == "select" ||
-		opcode == "i32.eqz" ||
-		opcode == "i32.eq" ||
-		opcode == "i32.ne" ||
-		opcode == "i32.lt_s" ||
-		opcode == "i32.lt_u" ||
-		opcode == "i32.gt_s" ||
-		opcode == "i32.gt_u" ||
-		opcode == "i32.le_s" ||
-		opcode == "i32.le_u" ||
-		opcode == "i32.ge_s" ||
-		opcode == "i32.ge_u" ||
-		opcode == "i64.eqz" ||
-		opcode == "i64.eq" ||
-		opcode == "i64.ne" ||
-		opcode == "i64.lt_s" ||
-		opcode == "i64.lt_u" ||
-		opcode == "i64.gt_s" ||
-		opcode == "i64.gt_u" ||
-		opcode == "i64.le_s" ||
-		opcode == "i64.le_u" ||
-		opcode == "i64.ge_s" ||
-		opcode == "i64.ge_u" ||
-		opcode == "f32.eq" ||
-		opcode == "f32.ne" ||
-		opcode == "f32.lt" ||
-		opcode == "f32.gt" ||
-		opcode == "f32.le" ||
-		opcode == "f32.ge" ||
-		opcode == "f64.eq" ||
-		opcode == "f64.ne" ||
-		opcode == "f64.lt" ||
-		opcode == "f64.gt" ||
-		opcode == "f64.le" ||
-		opcode == "f64.ge" ||
-
-		opcode == "i32.clz" ||
-		opcode == "i32.ctz" ||
-		opcode == "i32.popcnt" ||
-		opcode == "i32.add" ||
-		opcode == "i32.sub" ||
-		opcode == "i32.mul" ||
-		opcode == "i32.div_s" ||
-		opcode == "i32.div_u" ||
-		opcode == "i32.rem_s" ||
-		opcode == "i32.rem_u" ||
-		opcode == "i32.and" ||
-		opcode == "i32.or" ||
-		opcode == "i32.xor" ||
-		opcode == "i32.shl" ||
-		opcode == "i32.shr_s" ||
-		opcode == "i32.shr_u" ||
-		opcode == "i32.rotl" ||
-		opcode == "i32.rotr" ||
-
-		opcode == "i64.clz" ||
-		opcode == "i64.ctz" ||
-		opcode == "i64.popcnt" ||
-		opcode == "i64.add" ||
-		opcode == "i64.sub" ||
-		opcode == "i64.mul" ||
-		opcode == "i64.div_s" ||
-		opcode == "i64.div_u" ||
-		opcode == "i64.rem_s" ||
-		opcode == "i64.rem_u" ||
-		opcode == "i64.and" ||
-		opcode == "i64.or" ||
-		opcode == "i64.xor" ||
-		opcode == "i64.shl" ||
-		opcode == "i64.shr_s" ||
-		opcode == "i64.shr_u" ||
-		opcode == "i64.rotl" ||
-		opcode == "i64.rotr" ||
-
-		opcode == "f32.abs" ||
-		opcode == "f32.neg" ||
-		opcode == "f32.ceil" ||
-		opcode == "f32.floor" ||
-		opcode == "f32.trunc" ||
-		opcode == "f32.nearest" ||
-		opcode == "f32.sqrt" ||
-		opcode == "f32.add" ||
-		opcode == "f32.sub" ||
-		opcode == "f32.mul" ||
-		opcode == "f32.div" ||
-		opcode == "f32.min" ||
-		opcode == "f32.max" ||
-		opcode == "f32.copysign" ||
-
-		opcode == "f64.abs" ||
-		opcode == "f64.neg" ||
-		opcode == "f64.ceil" ||
-		opcode == "f64.floor" ||
-		opcode == "f64.trunc" ||
-		opcode == "f64.nearest" ||
-		opcode == "f64.sqrt" ||
-		opcode == "f64.add" ||
-		opcode == "f64.sub" ||
-		opcode == "f64.mul" ||
-		opcode == "f64.div" ||
-		opcode == "f64.min" ||
-		opcode == "f64.max" ||
-		opcode == "f64.copysign" ||
-
-		opcode == "i32.wrap_i64" ||
-		opcode == "i32.trunc_f32_s" ||
-		opcode == "i32.trunc_f32_u" ||
-		opcode == "i32.trunc_f64_s" ||
-		opcode == "i32.trunc_f64_u" ||
-		opcode == "i64.extend_i32_s" ||
-		opcode == "i64.extend_i32_u" ||
-		opcode == "i64.trunc_f32_s" ||
-		opcode == "i64.trunc_f32_u" ||
-		opcode == "i64.trunc_f64_s" ||
-		opcode == "i64.trunc_f64_u" ||
-		opcode == "f32.convert_i32_s" ||
-		opcode == "f32.convert_i32_u" ||
-		opcode == "f32.convert_i64_s" ||
-		opcode == "f32.convert_i64_u" ||
-		opcode == "f32.demote_f64" ||
-		opcode == "f64.convert_i32_s" ||
-		opcode == "f64.convert_i32_u" ||
-		opcode == "f64.convert_i64_s" ||
-		opcode == "f64.convert_i64_u" ||
-		opcode == "f64.promote_f32" ||
-		opcode == "i32.reinterpret_f32" ||
-		opcode == "i64.reinterpret_f64" ||
-		opcode == "f32.reinterpret_i32" ||
-		opcode == "f64.reinterpret_i64" ||
-
-		opcode == "i32.extend8_s" ||
-		opcode == "i32.extend16_s" ||
-		opcode == "i64.extend8_s" ||
-		opcode == "i64.extend16_s" ||
-		opcode == "i64.extend32_s" {
+	info := LookupOpcode(opcode)
+	if info == nil {
+		return fmt.Errorf("unknown instruction \"%s\"", opcode)
+	}
+	if info.Immediate == ImmediateUnsupported {
+		return fmt.Errorf("unsupported instruction \"%s\"", opcode)
+	}
+	e.Opcode = info.Opcode
+	e.OpcodeExt = info.OpcodeExt
 
-		e.Opcode = InstrToOpcode[opcode]
+	switch info.Immediate {
+	case ImmediateNone:
+		// else and end are read like blocks, but never have a result
+		if opcode == "else" || opcode == "end" {
+			e.Result = types.ValNone
+		}
 		return nil
-	} else if opcode == "br_table" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateLabelTable:
 		e.Labels = make([]int, 0)
+		ids := make([]string, 0)
 		var err error
 		var br_target string
 		var li int
@@ -187,52 +65,46 @@ func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
 				break
 			}
 			br_target, s = encoding.ReadToken(s)
+			if br_target[0] == '$' {
+				e.LabelNeedsLinking = true
+				e.Labels = append(e.Labels, 0)
+				ids = append(ids, br_target)
+				continue
+			}
 			li, err = strconv.Atoi(br_target)
 			if err != nil {
 				return err
 			}
 			e.Labels = append(e.Labels, li)
+			ids = append(ids, "")
+		}
+		if len(e.Labels) == 0 {
+			return errors.New("br_table needs a default label")
 		}
 
 		// Remove the last label and put it into default
 		e.LabelIndex = e.Labels[len(e.Labels)-1]
 		e.Labels = e.Labels[:len(e.Labels)-1]
+		if e.LabelNeedsLinking {
+			e.LabelId = ids[len(ids)-1]
+			e.LabelIds = ids[:len(ids)-1]
+		}
 		return nil
-	} else if opcode == "br" ||
-		opcode == "br_if" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateLabel:
 		var err error
 		var br_target string
 		br_target, s = encoding.ReadToken(s)
+		if strings.HasPrefix(br_target, "$") {
+			e.LabelNeedsLinking = true
+			e.LabelId = br_target
+			return nil
+		}
 		e.LabelIndex, err = strconv.Atoi(br_target)
 		if err != nil {
 			return err
 		}
 		return nil
-	} else if opcode == "i32.load" ||
-		opcode == "i64.load" ||
-		opcode == "f32.load" ||
-		opcode == "f64.load" ||
-		opcode == "i32.load8_s" ||
-		opcode == "i32.load8_u" ||
-		opcode == "i32.load16_s" ||
-		opcode == "i32.load16_u" ||
-		opcode == "i64.load8_s" ||
-		opcode == "i64.load8_u" ||
-		opcode == "i64.load16_s" ||
-		opcode == "i64.load16_u" ||
-		opcode == "i64.load32_s" ||
-		opcode == "i64.load32_u" ||
-		opcode == "i32.store" ||
-		opcode == "i64.store" ||
-		opcode == "f32.store" ||
-		opcode == "f64.store" ||
-		opcode == "i32.store8" ||
-		opcode == "i32.store16" ||
-		opcode == "i64.store8" ||
-		opcode == "i64.store16" ||
-		opcode == "i64.store32" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateMemArg:
 		for {
 			var t string
 			s = strings.Trim(s, encoding.Whitespace)
@@ -275,55 +147,96 @@ func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
 			}
 		}
 		return nil
-	} else if opcode == "memory.size" ||
-		opcode == "memory.grow" {
-		e.Opcode = InstrToOpcode[opcode]
-		return nil
-	} else if opcode == "block" ||
-		opcode == "if" ||
-		opcode == "loop" ||
-		opcode == "else" ||
-		opcode == "end" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateBlockType:
 		e.Result = types.ValNone
-		// Optional result type...
+		// Optional label, eg block $done
 		s = strings.Trim(s, encoding.Whitespace)
-		if len(s) == 0 {
-			return nil
+		if strings.HasPrefix(s, "$") {
+			e.BlockId, s = encoding.ReadToken(s)
+			s = strings.Trim(s, encoding.Whitespace)
 		}
-		if s[0] == '(' {
-			// eg (result i32)
-			var ok bool
-			var rtype string
-			rtype, s = encoding.ReadElement(s)
-			if strings.HasPrefix(rtype, "(result") {
-				rtype = strings.Trim(rtype[7:len(rtype)-1], encoding.Whitespace)
-				e.Result, ok = types.ValTypeToByte[rtype]
-				if !ok {
-					return errors.New("Error parsing block result")
+		// Optional type, eg (result i32), (type 3) or (param i32) (result i32 i64)
+		params := make([]types.ValType, 0)
+		results := make([]types.ValType, 0)
+		for strings.HasPrefix(s, "(") {
+			var el string
+			el, s = encoding.ReadElement(s)
+			s = strings.Trim(s, encoding.Whitespace)
+			if len(el) < 2 || !strings.HasSuffix(el, ")") {
+				return fmt.Errorf("Error parsing block type %s", el)
+			}
+			kind, vals := encoding.ReadToken(el[1 : len(el)-1])
+			if kind == "type" {
+				var err error
+				e.TypeIndex, err = strconv.Atoi(strings.Trim(vals, encoding.Whitespace))
+				if err != nil {
+					return fmt.Errorf("Error parsing block type: %w", err)
 				}
+				e.TypedBlock = true
+				continue
+			}
+			if kind != "param" && kind != "result" {
+				return fmt.Errorf("Error parsing block type %s", el)
+			}
+			for {
+				vals = strings.Trim(vals, encoding.Whitespace)
+				if len(vals) == 0 {
+					break
+				}
+				var v string
+				v, vals = encoding.ReadToken(vals)
+				vt, ok := types.ValTypeToByte[v]
+				if !ok || vt == types.ValNone {
+					return fmt.Errorf("Error parsing block %s %s", kind, v)
+				}
+				if kind == "param" {
+					params = append(params, vt)
+				} else {
+					results = append(results, vt)
+				}
+			}
+		}
+		if e.TypedBlock {
+			// Any params and results given with a type index just repeat it
+			return nil
+		}
+		if len(params) == 0 && len(results) <= 1 {
+			if len(results) == 1 {
+				e.Result = results[0]
 			}
+			return nil
 		}
+		e.BlockTypeNeedsLinking = true
+		e.BlockParams = params
+		e.BlockResults = results
 		return nil
-	} else if opcode == "i32.const" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateI32:
 		s = strings.Trim(s, encoding.Whitespace)
 		v, _ := encoding.ReadToken(s)
 		if strings.HasPrefix(v, "offset(") {
-			dname := v[7 : len(v)-1]
+			dname, err := readDataLink(v, "offset(")
+			if err != nil {
+				return err
+			}
 			e.DataOffsetNeedsLinking = true
 			e.DataOffsetNeedsAdjusting = true
 			e.I32DataId = dname
 			return nil
 		} else if strings.HasPrefix(v, "reloffset(") {
-			dname := v[7 : len(v)-1]
+			dname, err := readDataLink(v, "reloffset(")
+			if err != nil {
+				return err
+			}
 			e.DataOffsetNeedsLinking = true
 			e.DataOffsetNeedsAdjusting = false
 			e.I32DataId = dname
 			return nil
 		} else if strings.HasPrefix(v, "length(") {
 			// Lookup the data length...
-			dname := v[7 : len(v)-1]
+			dname, err := readDataLink(v, "length(")
+			if err != nil {
+				return err
+			}
 			e.DataLengthNeedsLinking = true
 			e.I32DataId = dname
 			return nil
@@ -344,8 +257,7 @@ func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
 		}
 		e.I32Value = int32(vv)
 		return nil
-	} else if opcode == "i64.const" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateI64:
 		s = strings.Trim(s, encoding.Whitespace)
 		v, _ := encoding.ReadToken(s)
 		// Support other bases...
@@ -365,35 +277,30 @@ func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
 		}
 		e.I64Value = int64(vv)
 		return nil
-	} else if opcode == "f32.const" {
+	case ImmediateF32:
 		s = strings.Trim(s, encoding.Whitespace)
 		v, _ := encoding.ReadToken(s)
-		vv, err := strconv.ParseFloat(v, 32)
+		bits, err := parseWatFloat(v, 32)
 		if err != nil {
 			return err
 		}
-		e.Opcode = InstrToOpcode[opcode]
-		e.F32Value = float32(vv)
+		e.F32Value = math.Float32frombits(uint32(bits))
 		return nil
-	} else if opcode == "f64.const" {
+	case ImmediateF64:
 		s = strings.Trim(s, encoding.Whitespace)
 		v, _ := encoding.ReadToken(s)
-		vv, err := strconv.ParseFloat(v, 64)
+		bits, err := parseWatFloat(v, 64)
 		if err != nil {
 			return err
 		}
-		e.Opcode = InstrToOpcode[opcode]
-		e.F64Value = float64(vv)
+		e.F64Value = math.Float64frombits(bits)
 		return nil
-	} else if opcode == "local.get" ||
-		opcode == "local.set" ||
-		opcode == "local.tee" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateLocal:
 		var target string
 		var lid int
 		var err error
 		target, s = encoding.ReadToken(s)
-		if localNames != nil && strings.HasPrefix(target, "$") {
+		if strings.HasPrefix(target, "$") {
 			// Find the id for it...
 			lid, ok := localNames[target]
 			if !ok {
@@ -408,14 +315,12 @@ func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
 		}
 		e.LocalIndex = lid
 		return nil
-	} else if opcode == "global.get" ||
-		opcode == "global.set" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateGlobal:
 		var target string
 		var gid int
 		var err error
 		target, s = encoding.ReadToken(s)
-		if target[0] == '$' {
+		if strings.HasPrefix(target, "$") {
 			e.GlobalNeedsLinking = true
 			e.GlobalId = target
 			return nil
@@ -427,13 +332,12 @@ func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
 			e.GlobalIndex = gid
 			return nil
 		}
-	} else if opcode == "call" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateFunc:
 		var target string
 		var fid int
 		var err error
 		target, s = encoding.ReadToken(s)
-		if target[0] == '$' {
+		if strings.HasPrefix(target, "$") {
 			e.FunctionNeedsLinking = true
 			e.FunctionId = target
 			return nil
@@ -445,12 +349,11 @@ func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
 			e.FuncIndex = fid
 			return nil
 		}
-	} else if opcode == "call_indirect" {
-		e.Opcode = InstrToOpcode[opcode]
+	case ImmediateCallIndirect:
 		s = strings.Trim(s, encoding.Whitespace)
-		if s[0] == '(' {
+		if strings.HasPrefix(s, "(") {
 			typeInfo, _ := encoding.ReadElement(s)
-			if strings.HasPrefix(typeInfo, "(type") {
+			if strings.HasPrefix(typeInfo, "(type") && strings.HasSuffix(typeInfo, ")") {
 				typeInfo = strings.Trim(typeInfo[5:len(typeInfo)-1], encoding.Whitespace)
 				var err error
 				e.TypeIndex, err = strconv.Atoi(typeInfo)
@@ -463,25 +366,65 @@ func (e *Expression) DecodeWat(s string, localNames map[string]int) error {
 		} else {
 			return errors.New("Error parsing call_indirect")
 		}
-	} else if opcode == "memory.copy" {
-		e.Opcode = ExtendedOpcodeFC
-		e.OpcodeExt = instrToOpcodeFC[opcode]
-	} else if opcode == "memory.fill" {
-		e.Opcode = ExtendedOpcodeFC
-		e.OpcodeExt = instrToOpcodeFC[opcode]
-	} else if opcode == "i32.trunc_sat_f32_s" ||
-		opcode == "i32.trunc_sat_f32_u" ||
-		opcode == "i32.trunc_sat_f64_s" ||
-		opcode == "i32.trunc_sat_f64_u" ||
-		opcode == "i64.trunc_sat_f32_s" ||
-		opcode == "i64.trunc_sat_f32_u" ||
-		opcode == "i64.trunc_sat_f64_s" ||
-		opcode == "i64.trunc_sat_f64_u" {
-		e.Opcode = ExtendedOpcodeFC
-		e.OpcodeExt = instrToOpcodeFC[opcode]
-	} else {
-		return fmt.Errorf("Unsupported opcode %s", opcode)
 	}
 
 	return nil
 }
+
+/**
+ * Parse a wat float, returning its raw bits. As well as decimals this handles hex floats,
+ * _ between digits, inf, nan and nan:0x with a payload.
+ */
+func parseWatFloat(v string, bitSize int) (uint64, error) {
+	var sign uint64
+	s := v
+	if strings.HasPrefix(s, "-") {
+		sign = 1
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	expBits, mantBits := uint64(0x7ff), 52
+	if bitSize == 32 {
+		expBits, mantBits = 0xff, 23
+	}
+	if strings.HasPrefix(s, "nan") {
+		payload := uint64(1) << (mantBits - 1)
+		if strings.HasPrefix(s, "nan:0x") {
+			var err error
+			payload, err = strconv.ParseUint(strings.ReplaceAll(s[6:], "_", ""), 16, mantBits)
+			if err != nil || payload == 0 {
+				return 0, fmt.Errorf("invalid nan payload %s", v)
+			}
+		} else if s != "nan" {
+			return 0, fmt.Errorf("invalid float %s", v)
+		}
+		return sign<<(bitSize-1) | expBits<<mantBits | payload, nil
+	}
+
+	s = strings.ReplaceAll(s, "_", "")
+	// Go needs an exponent on a hex float
+	if strings.HasPrefix(s, "0x") && !strings.ContainsAny(s, "pP") {
+		s += "p0"
+	}
+	f, err := strconv.ParseFloat(s, bitSize)
+	if err != nil {
+		return 0, err
+	}
+	if sign == 1 {
+		f = -f
+	}
+	if bitSize == 32 {
+		return uint64(math.Float32bits(float32(f))), nil
+	}
+	return math.Float64bits(f), nil
+}
+
+// Read the name of some data from an offset(), reloffset() or length(), eg $message from offset($message)
+func readDataLink(v string, prefix string) (string, error) {
+	if len(v) <= len(prefix) || !strings.HasSuffix(v, ")") {
+		return "", fmt.Errorf("Error parsing %s", v)
+	}
+	return v[len(prefix) : len(v)-1], nil
+}
@@ -26,150 +26,75 @@ import (
 )
 
 func (e *Expression) EncodeBinary(w io.Writer) error {
-
-	// First deal with simple opcodes (No args)
-	if e.HasNoArgs() {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		return err
-	} else if e.Opcode == InstrToOpcode["br_table"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		err = encoding.WriteUvarint(w, uint64(len(e.Labels)))
-		if err != nil {
-			return err
-		}
-		for _, l := range e.Labels {
-			err = encoding.WriteUvarint(w, uint64(l))
-			if err != nil {
-				return err
-			}
-		}
-		return encoding.WriteUvarint(w, uint64(e.LabelIndex))
-	} else if e.Opcode == InstrToOpcode["br"] ||
-		e.Opcode == InstrToOpcode["br_if"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		return encoding.WriteUvarint(w, uint64(e.LabelIndex))
-	} else if e.HasMemoryArgs() {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		err = encoding.WriteUvarint(w, uint64(e.MemAlign))
-		return encoding.WriteUvarint(w, uint64(e.MemOffset))
-	} else if e.Opcode == InstrToOpcode["memory.size"] ||
-		e.Opcode == InstrToOpcode["memory.grow"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		_, err = w.Write([]byte{byte(0x00)})
-		return err
-	} else if e.Opcode == InstrToOpcode["block"] ||
-		e.Opcode == InstrToOpcode["if"] ||
-		e.Opcode == InstrToOpcode["loop"] {
-		_, err := w.Write([]byte{byte(e.Opcode), byte(e.Result)})
-		if err != nil {
-			return err
-		}
-		return err
-	} else if e.Opcode == InstrToOpcode["i32.const"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		return encoding.WriteVarint(w, int64(e.I32Value))
-	} else if e.Opcode == InstrToOpcode["i64.const"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		return encoding.WriteVarint(w, e.I64Value)
-	} else if e.Opcode == InstrToOpcode["f32.const"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		ival := math.Float32bits(e.F32Value)
-		b := binary.LittleEndian.AppendUint32(make([]byte, 0), ival)
-		_, err = w.Write(b)
+	b, err := e.AppendBinary(make([]byte, 0, 16))
+	if err != nil {
 		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
 
-	} else if e.Opcode == InstrToOpcode["f64.const"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		ival := math.Float64bits(e.F64Value)
-		b := binary.LittleEndian.AppendUint64(make([]byte, 0), ival)
-		_, err = w.Write(b)
-		return err
-	} else if e.Opcode == InstrToOpcode["local.get"] ||
-		e.Opcode == InstrToOpcode["local.set"] ||
-		e.Opcode == InstrToOpcode["local.tee"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		return encoding.WriteUvarint(w, uint64(e.LocalIndex))
-	} else if e.Opcode == InstrToOpcode["global.get"] ||
-		e.Opcode == InstrToOpcode["global.set"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		return encoding.WriteUvarint(w, uint64(e.GlobalIndex))
-	} else if e.Opcode == InstrToOpcode["call"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		return encoding.WriteUvarint(w, uint64(e.FuncIndex))
-	} else if e.Opcode == InstrToOpcode["call_indirect"] {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		err = encoding.WriteUvarint(w, uint64(e.TypeIndex))
-		if err != nil {
-			return err
-		}
-		return encoding.WriteUvarint(w, uint64(e.TableIndex))
-	} else if e.Opcode == ExtendedOpcodeFC {
-		_, err := w.Write([]byte{byte(e.Opcode)})
-		if err != nil {
-			return err
-		}
-		err = encoding.WriteUvarint(w, uint64(e.OpcodeExt))
-		if err != nil {
-			return err
-		}
+/**
+ * Append the binary encoding of an expression to b. This lets a caller reuse a single buffer for a whole function.
+ *
+ */
+func (e *Expression) AppendBinary(b []byte) ([]byte, error) {
+	info := e.Info()
+	if info == nil || info.Immediate == ImmediateUnsupported {
+		if e.Opcode == ExtendedOpcodeFC {
+			return b, fmt.Errorf("Unsupported opcode 0xfc %d", e.OpcodeExt)
+		}
+		return b, fmt.Errorf("Unsupported opcode %d", e.Opcode)
+	}
 
-		// Now deal with opcodeExt...
-		if e.OpcodeExt == instrToOpcodeFC["memory.copy"] {
-			_, err := w.Write([]byte{byte(0), byte(0)})
-			return err
-		} else if e.OpcodeExt == instrToOpcodeFC["memory.fill"] {
-			_, err := w.Write([]byte{byte(0)})
-			return err
-		} else if e.OpcodeExt == instrToOpcodeFC["i32.trunc_sat_f32_s"] ||
-			e.OpcodeExt == instrToOpcodeFC["i32.trunc_sat_f32_u"] ||
-			e.OpcodeExt == instrToOpcodeFC["i32.trunc_sat_f64_s"] ||
-			e.OpcodeExt == instrToOpcodeFC["i32.trunc_sat_f64_u"] ||
-			e.OpcodeExt == instrToOpcodeFC["i64.trunc_sat_f32_s"] ||
-			e.OpcodeExt == instrToOpcodeFC["i64.trunc_sat_f32_u"] ||
-			e.OpcodeExt == instrToOpcodeFC["i64.trunc_sat_f64_s"] ||
-			e.OpcodeExt == instrToOpcodeFC["i64.trunc_sat_f64_u"] {
-			return nil
-		} else {
-			return fmt.Errorf("Unsupported opcode 0xfc %d", e.OpcodeExt)
-		}
-	} else {
-		return fmt.Errorf("Unsupported opcode %d", e.Opcode)
+	b = append(b, byte(e.Opcode))
+	if e.Opcode == ExtendedOpcodeFC {
+		b = binary.AppendUvarint(b, uint64(e.OpcodeExt))
 	}
 
+	switch info.Immediate {
+	case ImmediateNone:
+		return b, nil
+	case ImmediateBlockType:
+		if e.BlockTypeNeedsLinking {
+			return b, fmt.Errorf("%s needs a type for its params and results", info.Name)
+		}
+		if e.TypedBlock {
+			return encoding.AppendSleb128(b, int64(e.TypeIndex)), nil
+		}
+		return append(b, byte(e.Result)), nil
+	case ImmediateLabel:
+		return binary.AppendUvarint(b, uint64(e.LabelIndex)), nil
+	case ImmediateLabelTable:
+		b = binary.AppendUvarint(b, uint64(len(e.Labels)))
+		for _, l := range e.Labels {
+			b = binary.AppendUvarint(b, uint64(l))
+		}
+		return binary.AppendUvarint(b, uint64(e.LabelIndex)), nil
+	case ImmediateFunc:
+		return binary.AppendUvarint(b, uint64(e.FuncIndex)), nil
+	case ImmediateCallIndirect:
+		b = binary.AppendUvarint(b, uint64(e.TypeIndex))
+		return binary.AppendUvarint(b, uint64(e.TableIndex)), nil
+	case ImmediateLocal:
+		return binary.AppendUvarint(b, uint64(e.LocalIndex)), nil
+	case ImmediateGlobal:
+		return binary.AppendUvarint(b, uint64(e.GlobalIndex)), nil
+	case ImmediateMemArg:
+		b = binary.AppendUvarint(b, uint64(e.MemAlign))
+		return binary.AppendUvarint(b, uint64(e.MemOffset)), nil
+	case ImmediateMemory:
+		return append(b, 0), nil
+	case ImmediateMemoryPair:
+		return append(b, 0, 0), nil
+	case ImmediateI32:
+		return encoding.AppendSleb128(b, int64(e.I32Value)), nil
+	case ImmediateI64:
+		return encoding.AppendSleb128(b, e.I64Value), nil
+	case ImmediateF32:
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(e.F32Value)), nil
+	case ImmediateF64:
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(e.F64Value)), nil
+	}
+	return b, fmt.Errorf("Unsupported immediate for %s", info.Name)
 }
@@ -17,9 +17,10 @@
 package expression
 
 import (
-	"bufio"
 	"fmt"
 	"io"
+	"math"
+	"strconv"
 
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
 )
@@ -31,148 +32,144 @@ type WasmDebugContext interface {
 	GetLocalVarName(pc uint64, localIdx int) string
 }
 
-func (e *Expression) EncodeWat(w io.Writer, prefix string, wd WasmDebugContext) error {
-	comment := "" //fmt.Sprintf("    ;; PC=%d", e.PC) // TODO From line numbers, vars etc
+// A WasmDebugContext can also have identifiers for the locals of the function being written
+type LocalIdentifierContext interface {
+	GetLocalIdentifier(localIdx int) string
+}
 
-	lineNumberData := wd.GetLineNumberInfo(e.PC)
-	if lineNumberData != "" {
-		comment = fmt.Sprintf(" ;; Src = %s", lineNumberData)
+func (e *Expression) EncodeWat(w io.Writer, prefix string, wd WasmDebugContext) error {
+	line, err := e.AppendWat(make([]byte, 0, 64), prefix, wd)
+	if err != nil {
+		return err
 	}
+	_, err = w.Write(line)
+	return err
+}
 
-	wr := bufio.NewWriter(w)
-
-	defer func() {
-		wr.Flush()
-	}()
+/**
+ * Append the wat for an expression (one line) to b. This lets a caller reuse a single buffer for a whole function.
+ *
+ */
+func (e *Expression) AppendWat(b []byte, prefix string, wd WasmDebugContext) ([]byte, error) {
+	info := e.Info()
+	if info == nil || info.Immediate == ImmediateUnsupported {
+		if e.Opcode == ExtendedOpcodeFC {
+			return b, fmt.Errorf("Unsupported opcode 0xfc %d", e.OpcodeExt)
+		}
+		return b, fmt.Errorf("Unsupported opcode %d", e.Opcode)
+	}
 
-	// First deal with simple opcodes (No args)
-	if e.HasNoArgs() {
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s\n", prefix, opcodeToInstr[e.Opcode], comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["br_table"] {
-		targets := ""
+	b = append(b, prefix...)
+	b = append(b, info.Name...)
+
+	localName := ""
+	switch info.Immediate {
+	case ImmediateBlockType:
+		if e.TypedBlock {
+			b = append(b, " (type"...)
+			b = appendInt(b, int64(e.TypeIndex))
+			b = append(b, ')')
+		} else if e.Result != types.ValNone {
+			b = append(b, " (result "...)
+			b = append(b, types.ByteToValType[e.Result]...)
+			b = append(b, ')')
+		}
+	case ImmediateLabel:
+		b = appendInt(b, int64(e.LabelIndex))
+	case ImmediateLabelTable:
 		for _, l := range e.Labels {
-			targets = fmt.Sprintf("%s %d", targets, l)
+			b = appendInt(b, int64(l))
 		}
-		defaultTarget := fmt.Sprintf(" %d", e.LabelIndex)
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], targets, defaultTarget, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["br"] ||
-		e.Opcode == InstrToOpcode["br_if"] {
-		target := fmt.Sprintf(" %d", e.LabelIndex)
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], target, comment))
-		return err
-	} else if e.HasMemoryArgs() {
-		modAlign := fmt.Sprintf(" align=%d", 1<<e.MemAlign)
-		modOffset := fmt.Sprintf(" offset=%d", e.MemOffset)
-		if e.MemOffset == 0 {
-			modOffset = ""
+		b = appendInt(b, int64(e.LabelIndex))
+	case ImmediateFunc:
+		b = append(b, ' ')
+		b = append(b, wd.GetFunctionIdentifier(e.FuncIndex, false)...)
+	case ImmediateCallIndirect:
+		b = append(b, " (type"...)
+		b = appendInt(b, int64(e.TypeIndex))
+		b = append(b, ')')
+	case ImmediateLocal:
+		localName = wd.GetLocalVarName(e.PC, e.LocalIndex)
+		//
+		if localName == "" {
+			localName = wd.GetLocalVarName(e.PCNext, e.LocalIndex)
 		}
-		// TODO: Default align?
-		/*
-			if e.MemAlign == 0 {
-				modAlign = ""
+		id := ""
+		lc, ok := wd.(LocalIdentifierContext)
+		if ok {
+			id = lc.GetLocalIdentifier(e.LocalIndex)
+		}
+		if id != "" {
+			b = append(b, ' ')
+			b = append(b, id...)
+			// No need for a comment that just repeats the identifier
+			if "$"+localName == id {
+				localName = ""
 			}
-		*/
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], modOffset, modAlign, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["memory.size"] ||
-		e.Opcode == InstrToOpcode["memory.grow"] {
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s\n", prefix, opcodeToInstr[e.Opcode], comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["block"] ||
-		e.Opcode == InstrToOpcode["if"] ||
-		e.Opcode == InstrToOpcode["loop"] {
-
-		result := ""
-		if e.Result != types.ValNone {
-			result = fmt.Sprintf(" (result %s)", types.ByteToValType[e.Result])
+		} else {
+			b = appendInt(b, int64(e.LocalIndex))
+		}
+	case ImmediateGlobal:
+		b = append(b, ' ')
+		b = append(b, wd.GetGlobalIdentifier(e.GlobalIndex, false)...)
+	case ImmediateMemArg:
+		// TODO: Default align?
+		if e.MemOffset != 0 {
+			b = append(b, " offset="...)
+			b = strconv.AppendInt(b, int64(e.MemOffset), 10)
 		}
+		b = append(b, " align="...)
+		b = strconv.AppendInt(b, int64(1)<<e.MemAlign, 10)
+	case ImmediateI32:
+		b = appendInt(b, int64(e.I32Value))
+	case ImmediateI64:
+		b = appendInt(b, e.I64Value)
+	case ImmediateF32:
+		b = appendFloat(b, float64(e.F32Value), uint64(math.Float32bits(e.F32Value)), 32)
+	case ImmediateF64:
+		b = appendFloat(b, e.F64Value, math.Float64bits(e.F64Value), 64)
+	}
 
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], result, comment))
+	lineNumberData := wd.GetLineNumberInfo(e.PC)
+	if lineNumberData != "" {
+		b = append(b, " ;; Src = "...)
+		b = append(b, lineNumberData...)
+	}
+	if localName != "" {
+		b = append(b, " ;; Variable "...)
+		b = append(b, localName...)
+	}
+	return append(b, '\n'), nil
+}
 
-		return err
-	} else if e.Opcode == InstrToOpcode["i32.const"] {
-		value := fmt.Sprintf(" %d", e.I32Value)
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], value, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["i64.const"] {
-		value := fmt.Sprintf(" %d", e.I64Value)
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], value, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["f32.const"] {
-		value := fmt.Sprintf(" %f", e.F32Value)
-		if value == " +Inf" || value == " -Inf" {
-			value = " inf"
-		} else if value == " NaN" {
-			value = " nan"
-		}
+func appendInt(b []byte, v int64) []byte {
+	b = append(b, ' ')
+	return strconv.AppendInt(b, v, 10)
+}
 
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], value, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["f64.const"] {
-		value := fmt.Sprintf(" %f", e.F64Value)
-		if value == " +Inf" || value == " -Inf" {
-			value = " inf"
-		} else if value == " NaN" {
-			value = " nan"
+/**
+ * Write a float exactly, as the shortest decimal that reads back as the same value.
+ * wat spells infinity and NaN differently to Go, and a NaN can have a payload, so bits are the raw bits of the value.
+ */
+func appendFloat(b []byte, v float64, bits uint64, bitSize int) []byte {
+	b = append(b, ' ')
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		if math.Signbit(v) {
+			b = append(b, '-')
 		}
-
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], value, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["local.get"] ||
-		e.Opcode == InstrToOpcode["local.set"] ||
-		e.Opcode == InstrToOpcode["local.tee"] {
-		tname := wd.GetLocalVarName(e.PC, e.LocalIndex)
-		//
-		if tname == "" {
-			tname = wd.GetLocalVarName(e.PCNext, e.LocalIndex)
+		if math.IsInf(v, 0) {
+			return append(b, "inf"...)
 		}
-
-		if tname != "" {
-			comment = comment + " ;; Variable " + tname
+		b = append(b, "nan"...)
+		payload, canonical := bits&(1<<52-1), uint64(1<<51)
+		if bitSize == 32 {
+			payload, canonical = bits&(1<<23-1), uint64(1<<22)
 		}
-		localTarget := fmt.Sprintf(" %d", e.LocalIndex)
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], localTarget, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["global.get"] ||
-		e.Opcode == InstrToOpcode["global.set"] {
-		g := wd.GetGlobalIdentifier(e.GlobalIndex, false)
-		globalTarget := fmt.Sprintf(" %s", g)
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], globalTarget, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["call"] {
-		f := wd.GetFunctionIdentifier(e.FuncIndex, false)
-		callTarget := fmt.Sprintf(" %s", f)
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], callTarget, comment))
-		return err
-	} else if e.Opcode == InstrToOpcode["call_indirect"] {
-		typeIndex := fmt.Sprintf(" (type %d)", e.TypeIndex)
-		_, err := wr.WriteString(fmt.Sprintf("%s%s%s%s\n", prefix, opcodeToInstr[e.Opcode], typeIndex, comment))
-		return err
-	} else if e.Opcode == ExtendedOpcodeFC {
-		// Now deal with opcode2...
-		if e.OpcodeExt == instrToOpcodeFC["memory.copy"] {
-			_, err := wr.WriteString(fmt.Sprintf("%s%s%s\n", prefix, opcodeToInstrFC[e.OpcodeExt], comment))
-			return err
-		} else if e.OpcodeExt == instrToOpcodeFC["memory.fill"] {
-			_, err := wr.WriteString(fmt.Sprintf("%s%s%s\n", prefix, opcodeToInstrFC[e.OpcodeExt], comment))
-			return err
-		} else if e.OpcodeExt == instrToOpcodeFC["i32.trunc_sat_f32_s"] ||
-			e.OpcodeExt == instrToOpcodeFC["i32.trunc_sat_f32_u"] ||
-			e.OpcodeExt == instrToOpcodeFC["i32.trunc_sat_f64_s"] ||
-			e.OpcodeExt == instrToOpcodeFC["i32.trunc_sat_f64_u"] ||
-			e.OpcodeExt == instrToOpcodeFC["i64.trunc_sat_f32_s"] ||
-			e.OpcodeExt == instrToOpcodeFC["i64.trunc_sat_f32_u"] ||
-			e.OpcodeExt == instrToOpcodeFC["i64.trunc_sat_f64_s"] ||
-			e.OpcodeExt == instrToOpcodeFC["i64.trunc_sat_f64_u"] {
-			_, err := wr.WriteString(fmt.Sprintf("%s%s%s\n", prefix, opcodeToInstrFC[e.OpcodeExt], comment))
-			return err
-		} else {
-			return fmt.Errorf("Unsupported opcode 0xfc %d", e.OpcodeExt)
+		if payload != canonical {
+			b = append(b, ":0x"...)
+			b = strconv.AppendUint(b, payload, 16)
 		}
-	} else {
-		return fmt.Errorf("Unsupported opcode %d", e.Opcode)
+		return b
 	}
-
+	return strconv.AppendFloat(b, v, 'g', -1, bitSize)
 }
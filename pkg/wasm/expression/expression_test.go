@@ -2,6 +2,7 @@ package expression
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
 	"github.com/stretchr/testify/assert"
@@ -117,6 +118,78 @@ func TestBlockIfLoop(t *testing.T) {
 	}
 }
 
+func TestTypedBlock(t *testing.T) {
+	for _, idx := range []int{3, 64, 300} {
+		expr := &Expression{
+			Opcode:     InstrToOpcode["block"],
+			Result:     types.ValNone,
+			TypedBlock: true,
+			TypeIndex:  idx,
+		}
+
+		expr2 := verifyEncodeDecode(t, expr)
+		assert.True(t, expr2.TypedBlock)
+		assert.Equal(t, idx, expr2.TypeIndex)
+
+		exp, err := ExpressionFromWat(fmt.Sprintf("block (type %d)", idx))
+		assert.NoError(t, err)
+		assert.True(t, exp[0].Equals(expr))
+	}
+
+	// Params or several results need a type adding to the module
+	exp, err := ExpressionFromWat("loop $l (param i32) (result i32 i64)")
+	assert.NoError(t, err)
+	assert.True(t, exp[0].BlockTypeNeedsLinking)
+	assert.Equal(t, []types.ValType{types.ValI32}, exp[0].BlockParams)
+	assert.Equal(t, []types.ValType{types.ValI32, types.ValI64}, exp[0].BlockResults)
+	var buf bytes.Buffer
+	assert.Error(t, exp[0].EncodeBinary(&buf))
+
+	_, err = ExpressionFromWat("block (result nonsense)")
+	assert.Error(t, err)
+}
+
+func TestNamedLabels(t *testing.T) {
+	exp, err := ExpressionFromWat(`block $done
+  loop $again
+    local.get 0
+    br_if $done
+    local.get 0
+    br_table $again $done 1
+    if $inner (result i32)
+      br $again
+    end
+    br $again
+  end
+end`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, exp[3].LabelIndex)
+	assert.Equal(t, []int{0, 1}, exp[5].Labels)
+	assert.Equal(t, 1, exp[5].LabelIndex)
+	assert.Equal(t, types.ValI32, exp[6].Result)
+	assert.Equal(t, 1, exp[7].LabelIndex)
+	assert.Equal(t, 0, exp[9].LabelIndex)
+	for _, e := range exp {
+		assert.False(t, e.LabelNeedsLinking)
+		assert.Equal(t, "", e.BlockId)
+	}
+
+	// A snippet can close a block it didn't open, but can only use labels it declares
+	exp, err = ExpressionFromWat("end\nblock $b\nbr $b")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, exp[2].LabelIndex)
+	_, err = ExpressionFromWat("block\nbr $missing\nend")
+	assert.Error(t, err)
+
+	// Locals by name
+	exp, err = ExpressionFromWatWithLocals("local.get $x\nlocal.set $y", map[string]int{"$x": 2, "$y": 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, exp[0].LocalIndex)
+	assert.Equal(t, 3, exp[1].LocalIndex)
+	_, err = ExpressionFromWat("local.get $x")
+	assert.Error(t, err)
+}
+
 func TestI32Const(t *testing.T) {
 	for _, v := range []int32{1, -90, 123456, 90000000} {
 		expr := &Expression{
@@ -0,0 +1,294 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package expression
+
+// The kind of immediate operands an instruction has, which decides how all the codecs handle it
+type Immediate int
+
+const (
+	ImmediateNone         Immediate = iota
+	ImmediateBlockType              // block, loop, if - a result type
+	ImmediateLabel                  // br, br_if - a label index
+	ImmediateLabelTable             // br_table - label indexes and a default
+	ImmediateFunc                   // call - a function index
+	ImmediateCallIndirect           // call_indirect - a type index and a table index
+	ImmediateLocal                  // a local index
+	ImmediateGlobal                 // a global index
+	ImmediateMemArg                 // loads and stores - align and offset
+	ImmediateMemory                 // a memory index, which is always 0
+	ImmediateMemoryPair             // memory.copy - dest and source memory indexes
+	ImmediateI32
+	ImmediateI64
+	ImmediateF32
+	ImmediateF64
+	ImmediateUnsupported // Known, but the codecs can't handle it yet
+)
+
+// Arity of instructions whose stack effect depends on types or labels
+const VariableArity = -1
+
+type OpcodeInfo struct {
+	Name      string
+	Opcode    Opcode
+	OpcodeExt int // For ExtendedOpcodeFC
+	Immediate Immediate
+	Pop       int // Values taken off the stack, or VariableArity
+	Push      int // Values left on the stack, or VariableArity
+}
+
+// Every instruction known. The name maps and the codecs are all driven from this.
+var Opcodes = []*OpcodeInfo{
+	// Control
+	{"unreachable", Opcode(0x00), 0, ImmediateNone, 0, 0},
+	{"nop", Opcode(0x01), 0, ImmediateNone, 0, 0},
+	{"block", Opcode(0x02), 0, ImmediateBlockType, VariableArity, VariableArity},
+	{"loop", Opcode(0x03), 0, ImmediateBlockType, VariableArity, VariableArity},
+	{"if", Opcode(0x04), 0, ImmediateBlockType, VariableArity, VariableArity},
+	{"else", Opcode(0x05), 0, ImmediateNone, VariableArity, VariableArity},
+	{"end", Opcode(0x0b), 0, ImmediateNone, VariableArity, VariableArity},
+	{"br", Opcode(0x0c), 0, ImmediateLabel, VariableArity, VariableArity},
+	{"br_if", Opcode(0x0d), 0, ImmediateLabel, VariableArity, VariableArity},
+	{"br_table", Opcode(0x0e), 0, ImmediateLabelTable, VariableArity, VariableArity},
+	{"return", Opcode(0x0f), 0, ImmediateNone, VariableArity, VariableArity},
+	{"call", Opcode(0x10), 0, ImmediateFunc, VariableArity, VariableArity},
+	{"call_indirect", Opcode(0x11), 0, ImmediateCallIndirect, VariableArity, VariableArity},
+
+	// Parametric
+	{"drop", Opcode(0x1a), 0, ImmediateNone, 1, 0},
+	{"select", Opcode(0x1b), 0, ImmediateNone, 3, 1},
+
+	// Variable
+	{"local.get", Opcode(0x20), 0, ImmediateLocal, 0, 1},
+	{"local.set", Opcode(0x21), 0, ImmediateLocal, 1, 0},
+	{"local.tee", Opcode(0x22), 0, ImmediateLocal, 1, 1},
+	{"global.get", Opcode(0x23), 0, ImmediateGlobal, 0, 1},
+	{"global.set", Opcode(0x24), 0, ImmediateGlobal, 1, 0},
+
+	// Memory
+	{"i32.load", Opcode(0x28), 0, ImmediateMemArg, 1, 1},
+	{"i64.load", Opcode(0x29), 0, ImmediateMemArg, 1, 1},
+	{"f32.load", Opcode(0x2a), 0, ImmediateMemArg, 1, 1},
+	{"f64.load", Opcode(0x2b), 0, ImmediateMemArg, 1, 1},
+	{"i32.load8_s", Opcode(0x2c), 0, ImmediateMemArg, 1, 1},
+	{"i32.load8_u", Opcode(0x2d), 0, ImmediateMemArg, 1, 1},
+	{"i32.load16_s", Opcode(0x2e), 0, ImmediateMemArg, 1, 1},
+	{"i32.load16_u", Opcode(0x2f), 0, ImmediateMemArg, 1, 1},
+	{"i64.load8_s", Opcode(0x30), 0, ImmediateMemArg, 1, 1},
+	{"i64.load8_u", Opcode(0x31), 0, ImmediateMemArg, 1, 1},
+	{"i64.load16_s", Opcode(0x32), 0, ImmediateMemArg, 1, 1},
+	{"i64.load16_u", Opcode(0x33), 0, ImmediateMemArg, 1, 1},
+	{"i64.load32_s", Opcode(0x34), 0, ImmediateMemArg, 1, 1},
+	{"i64.load32_u", Opcode(0x35), 0, ImmediateMemArg, 1, 1},
+	{"i32.store", Opcode(0x36), 0, ImmediateMemArg, 2, 0},
+	{"i64.store", Opcode(0x37), 0, ImmediateMemArg, 2, 0},
+	{"f32.store", Opcode(0x38), 0, ImmediateMemArg, 2, 0},
+	{"f64.store", Opcode(0x39), 0, ImmediateMemArg, 2, 0},
+	{"i32.store8", Opcode(0x3a), 0, ImmediateMemArg, 2, 0},
+	{"i32.store16", Opcode(0x3b), 0, ImmediateMemArg, 2, 0},
+	{"i64.store8", Opcode(0x3c), 0, ImmediateMemArg, 2, 0},
+	{"i64.store16", Opcode(0x3d), 0, ImmediateMemArg, 2, 0},
+	{"i64.store32", Opcode(0x3e), 0, ImmediateMemArg, 2, 0},
+	{"memory.size", Opcode(0x3f), 0, ImmediateMemory, 0, 1},
+	{"memory.grow", Opcode(0x40), 0, ImmediateMemory, 1, 1},
+
+	// Numeric
+	{"i32.const", Opcode(0x41), 0, ImmediateI32, 0, 1},
+	{"i64.const", Opcode(0x42), 0, ImmediateI64, 0, 1},
+	{"f32.const", Opcode(0x43), 0, ImmediateF32, 0, 1},
+	{"f64.const", Opcode(0x44), 0, ImmediateF64, 0, 1},
+	{"i32.eqz", Opcode(0x45), 0, ImmediateNone, 1, 1},
+	{"i32.eq", Opcode(0x46), 0, ImmediateNone, 2, 1},
+	{"i32.ne", Opcode(0x47), 0, ImmediateNone, 2, 1},
+	{"i32.lt_s", Opcode(0x48), 0, ImmediateNone, 2, 1},
+	{"i32.lt_u", Opcode(0x49), 0, ImmediateNone, 2, 1},
+	{"i32.gt_s", Opcode(0x4a), 0, ImmediateNone, 2, 1},
+	{"i32.gt_u", Opcode(0x4b), 0, ImmediateNone, 2, 1},
+	{"i32.le_s", Opcode(0x4c), 0, ImmediateNone, 2, 1},
+	{"i32.le_u", Opcode(0x4d), 0, ImmediateNone, 2, 1},
+	{"i32.ge_s", Opcode(0x4e), 0, ImmediateNone, 2, 1},
+	{"i32.ge_u", Opcode(0x4f), 0, ImmediateNone, 2, 1},
+	{"i64.eqz", Opcode(0x50), 0, ImmediateNone, 1, 1},
+	{"i64.eq", Opcode(0x51), 0, ImmediateNone, 2, 1},
+	{"i64.ne", Opcode(0x52), 0, ImmediateNone, 2, 1},
+	{"i64.lt_s", Opcode(0x53), 0, ImmediateNone, 2, 1},
+	{"i64.lt_u", Opcode(0x54), 0, ImmediateNone, 2, 1},
+	{"i64.gt_s", Opcode(0x55), 0, ImmediateNone, 2, 1},
+	{"i64.gt_u", Opcode(0x56), 0, ImmediateNone, 2, 1},
+	{"i64.le_s", Opcode(0x57), 0, ImmediateNone, 2, 1},
+	{"i64.le_u", Opcode(0x58), 0, ImmediateNone, 2, 1},
+	{"i64.ge_s", Opcode(0x59), 0, ImmediateNone, 2, 1},
+	{"i64.ge_u", Opcode(0x5a), 0, ImmediateNone, 2, 1},
+	{"f32.eq", Opcode(0x5b), 0, ImmediateNone, 2, 1},
+	{"f32.ne", Opcode(0x5c), 0, ImmediateNone, 2, 1},
+	{"f32.lt", Opcode(0x5d), 0, ImmediateNone, 2, 1},
+	{"f32.gt", Opcode(0x5e), 0, ImmediateNone, 2, 1},
+	{"f32.le", Opcode(0x5f), 0, ImmediateNone, 2, 1},
+	{"f32.ge", Opcode(0x60), 0, ImmediateNone, 2, 1},
+	{"f64.eq", Opcode(0x61), 0, ImmediateNone, 2, 1},
+	{"f64.ne", Opcode(0x62), 0, ImmediateNone, 2, 1},
+	{"f64.lt", Opcode(0x63), 0, ImmediateNone, 2, 1},
+	{"f64.gt", Opcode(0x64), 0, ImmediateNone, 2, 1},
+	{"f64.le", Opcode(0x65), 0, ImmediateNone, 2, 1},
+	{"f64.ge", Opcode(0x66), 0, ImmediateNone, 2, 1},
+	{"i32.clz", Opcode(0x67), 0, ImmediateNone, 1, 1},
+	{"i32.ctz", Opcode(0x68), 0, ImmediateNone, 1, 1},
+	{"i32.popcnt", Opcode(0x69), 0, ImmediateNone, 1, 1},
+	{"i32.add", Opcode(0x6a), 0, ImmediateNone, 2, 1},
+	{"i32.sub", Opcode(0x6b), 0, ImmediateNone, 2, 1},
+	{"i32.mul", Opcode(0x6c), 0, ImmediateNone, 2, 1},
+	{"i32.div_s", Opcode(0x6d), 0, ImmediateNone, 2, 1},
+	{"i32.div_u", Opcode(0x6e), 0, ImmediateNone, 2, 1},
+	{"i32.rem_s", Opcode(0x6f), 0, ImmediateNone, 2, 1},
+	{"i32.rem_u", Opcode(0x70), 0, ImmediateNone, 2, 1},
+	{"i32.and", Opcode(0x71), 0, ImmediateNone, 2, 1},
+	{"i32.or", Opcode(0x72), 0, ImmediateNone, 2, 1},
+	{"i32.xor", Opcode(0x73), 0, ImmediateNone, 2, 1},
+	{"i32.shl", Opcode(0x74), 0, ImmediateNone, 2, 1},
+	{"i32.shr_s", Opcode(0x75), 0, ImmediateNone, 2, 1},
+	{"i32.shr_u", Opcode(0x76), 0, ImmediateNone, 2, 1},
+	{"i32.rotl", Opcode(0x77), 0, ImmediateNone, 2, 1},
+	{"i32.rotr", Opcode(0x78), 0, ImmediateNone, 2, 1},
+	{"i64.clz", Opcode(0x79), 0, ImmediateNone, 1, 1},
+	{"i64.ctz", Opcode(0x7a), 0, ImmediateNone, 1, 1},
+	{"i64.popcnt", Opcode(0x7b), 0, ImmediateNone, 1, 1},
+	{"i64.add", Opcode(0x7c), 0, ImmediateNone, 2, 1},
+	{"i64.sub", Opcode(0x7d), 0, ImmediateNone, 2, 1},
+	{"i64.mul", Opcode(0x7e), 0, ImmediateNone, 2, 1},
+	{"i64.div_s", Opcode(0x7f), 0, ImmediateNone, 2, 1},
+	{"i64.div_u", Opcode(0x80), 0, ImmediateNone, 2, 1},
+	{"i64.rem_s", Opcode(0x81), 0, ImmediateNone, 2, 1},
+	{"i64.rem_u", Opcode(0x82), 0, ImmediateNone, 2, 1},
+	{"i64.and", Opcode(0x83), 0, ImmediateNone, 2, 1},
+	{"i64.or", Opcode(0x84), 0, ImmediateNone, 2, 1},
+	{"i64.xor", Opcode(0x85), 0, ImmediateNone, 2, 1},
+	{"i64.shl", Opcode(0x86), 0, ImmediateNone, 2, 1},
+	{"i64.shr_s", Opcode(0x87), 0, ImmediateNone, 2, 1},
+	{"i64.shr_u", Opcode(0x88), 0, ImmediateNone, 2, 1},
+	{"i64.rotl", Opcode(0x89), 0, ImmediateNone, 2, 1},
+	{"i64.rotr", Opcode(0x8a), 0, ImmediateNone, 2, 1},
+	{"f32.abs", Opcode(0x8b), 0, ImmediateNone, 1, 1},
+	{"f32.neg", Opcode(0x8c), 0, ImmediateNone, 1, 1},
+	{"f32.ceil", Opcode(0x8d), 0, ImmediateNone, 1, 1},
+	{"f32.floor", Opcode(0x8e), 0, ImmediateNone, 1, 1},
+	{"f32.trunc", Opcode(0x8f), 0, ImmediateNone, 1, 1},
+	{"f32.nearest", Opcode(0x90), 0, ImmediateNone, 1, 1},
+	{"f32.sqrt", Opcode(0x91), 0, ImmediateNone, 1, 1},
+	{"f32.add", Opcode(0x92), 0, ImmediateNone, 2, 1},
+	{"f32.sub", Opcode(0x93), 0, ImmediateNone, 2, 1},
+	{"f32.mul", Opcode(0x94), 0, ImmediateNone, 2, 1},
+	{"f32.div", Opcode(0x95), 0, ImmediateNone, 2, 1},
+	{"f32.min", Opcode(0x96), 0, ImmediateNone, 2, 1},
+	{"f32.max", Opcode(0x97), 0, ImmediateNone, 2, 1},
+	{"f32.copysign", Opcode(0x98), 0, ImmediateNone, 2, 1},
+	{"f64.abs", Opcode(0x99), 0, ImmediateNone, 1, 1},
+	{"f64.neg", Opcode(0x9a), 0, ImmediateNone, 1, 1},
+	{"f64.ceil", Opcode(0x9b), 0, ImmediateNone, 1, 1},
+	{"f64.floor", Opcode(0x9c), 0, ImmediateNone, 1, 1},
+	{"f64.trunc", Opcode(0x9d), 0, ImmediateNone, 1, 1},
+	{"f64.nearest", Opcode(0x9e), 0, ImmediateNone, 1, 1},
+	{"f64.sqrt", Opcode(0x9f), 0, ImmediateNone, 1, 1},
+	{"f64.add", Opcode(0xa0), 0, ImmediateNone, 2, 1},
+	{"f64.sub", Opcode(0xa1), 0, ImmediateNone, 2, 1},
+	{"f64.mul", Opcode(0xa2), 0, ImmediateNone, 2, 1},
+	{"f64.div", Opcode(0xa3), 0, ImmediateNone, 2, 1},
+	{"f64.min", Opcode(0xa4), 0, ImmediateNone, 2, 1},
+	{"f64.max", Opcode(0xa5), 0, ImmediateNone, 2, 1},
+	{"f64.copysign", Opcode(0xa6), 0, ImmediateNone, 2, 1},
+	{"i32.wrap_i64", Opcode(0xa7), 0, ImmediateNone, 1, 1},
+	{"i32.trunc_f32_s", Opcode(0xa8), 0, ImmediateNone, 1, 1},
+	{"i32.trunc_f32_u", Opcode(0xa9), 0, ImmediateNone, 1, 1},
+	{"i32.trunc_f64_s", Opcode(0xaa), 0, ImmediateNone, 1, 1},
+	{"i32.trunc_f64_u", Opcode(0xab), 0, ImmediateNone, 1, 1},
+	{"i64.extend_i32_s", Opcode(0xac), 0, ImmediateNone, 1, 1},
+	{"i64.extend_i32_u", Opcode(0xad), 0, ImmediateNone, 1, 1},
+	{"i64.trunc_f32_s", Opcode(0xae), 0, ImmediateNone, 1, 1},
+	{"i64.trunc_f32_u", Opcode(0xaf), 0, ImmediateNone, 1, 1},
+	{"i64.trunc_f64_s", Opcode(0xb0), 0, ImmediateNone, 1, 1},
+	{"i64.trunc_f64_u", Opcode(0xb1), 0, ImmediateNone, 1, 1},
+	{"f32.convert_i32_s", Opcode(0xb2), 0, ImmediateNone, 1, 1},
+	{"f32.convert_i32_u", Opcode(0xb3), 0, ImmediateNone, 1, 1},
+	{"f32.convert_i64_s", Opcode(0xb4), 0, ImmediateNone, 1, 1},
+	{"f32.convert_i64_u", Opcode(0xb5), 0, ImmediateNone, 1, 1},
+	{"f32.demote_f64", Opcode(0xb6), 0, ImmediateNone, 1, 1},
+	{"f64.convert_i32_s", Opcode(0xb7), 0, ImmediateNone, 1, 1},
+	{"f64.convert_i32_u", Opcode(0xb8), 0, ImmediateNone, 1, 1},
+	{"f64.convert_i64_s", Opcode(0xb9), 0, ImmediateNone, 1, 1},
+	{"f64.convert_i64_u", Opcode(0xba), 0, ImmediateNone, 1, 1},
+	{"f64.promote_f32", Opcode(0xbb), 0, ImmediateNone, 1, 1},
+	{"i32.reinterpret_f32", Opcode(0xbc), 0, ImmediateNone, 1, 1},
+	{"i64.reinterpret_f64", Opcode(0xbd), 0, ImmediateNone, 1, 1},
+	{"f32.reinterpret_i32", Opcode(0xbe), 0, ImmediateNone, 1, 1},
+	{"f64.reinterpret_i64", Opcode(0xbf), 0, ImmediateNone, 1, 1},
+	{"i32.extend8_s", Opcode(0xc0), 0, ImmediateNone, 1, 1},
+	{"i32.extend16_s", Opcode(0xc1), 0, ImmediateNone, 1, 1},
+	{"i64.extend8_s", Opcode(0xc2), 0, ImmediateNone, 1, 1},
+	{"i64.extend16_s", Opcode(0xc3), 0, ImmediateNone, 1, 1},
+	{"i64.extend32_s", Opcode(0xc4), 0, ImmediateNone, 1, 1},
+
+	// Extended 0xfc instructions
+	{"i32.trunc_sat_f32_s", ExtendedOpcodeFC, 0, ImmediateNone, 1, 1},
+	{"i32.trunc_sat_f32_u", ExtendedOpcodeFC, 1, ImmediateNone, 1, 1},
+	{"i32.trunc_sat_f64_s", ExtendedOpcodeFC, 2, ImmediateNone, 1, 1},
+	{"i32.trunc_sat_f64_u", ExtendedOpcodeFC, 3, ImmediateNone, 1, 1},
+	{"i64.trunc_sat_f32_s", ExtendedOpcodeFC, 4, ImmediateNone, 1, 1},
+	{"i64.trunc_sat_f32_u", ExtendedOpcodeFC, 5, ImmediateNone, 1, 1},
+	{"i64.trunc_sat_f64_s", ExtendedOpcodeFC, 6, ImmediateNone, 1, 1},
+	{"i64.trunc_sat_f64_u", ExtendedOpcodeFC, 7, ImmediateNone, 1, 1},
+	{"memory.init", ExtendedOpcodeFC, 8, ImmediateUnsupported, VariableArity, VariableArity},
+	{"data.drop", ExtendedOpcodeFC, 9, ImmediateUnsupported, VariableArity, VariableArity},
+	{"memory.copy", ExtendedOpcodeFC, 10, ImmediateMemoryPair, 3, 0},
+	{"memory.fill", ExtendedOpcodeFC, 11, ImmediateMemory, 3, 0},
+	{"table.init", ExtendedOpcodeFC, 12, ImmediateUnsupported, VariableArity, VariableArity},
+	{"elem.drop", ExtendedOpcodeFC, 13, ImmediateUnsupported, VariableArity, VariableArity},
+	{"table.copy", ExtendedOpcodeFC, 14, ImmediateUnsupported, VariableArity, VariableArity},
+	{"table.grow", ExtendedOpcodeFC, 15, ImmediateUnsupported, VariableArity, VariableArity},
+	{"table.size", ExtendedOpcodeFC, 16, ImmediateUnsupported, VariableArity, VariableArity},
+	{"table.fill", ExtendedOpcodeFC, 17, ImmediateUnsupported, VariableArity, VariableArity},
+}
+
+var opcodeInfo [256]*OpcodeInfo
+var opcodeInfoFC = make(map[int]*OpcodeInfo)
+var opcodeInfoByName = make(map[string]*OpcodeInfo)
+
+var InstrToOpcode = make(map[string]Opcode)
+var instrToOpcodeFC = make(map[string]int)
+
+func init() {
+	for _, o := range Opcodes {
+		opcodeInfoByName[o.Name] = o
+		if o.Opcode == ExtendedOpcodeFC {
+			opcodeInfoFC[o.OpcodeExt] = o
+			instrToOpcodeFC[o.Name] = o.OpcodeExt
+		} else {
+			opcodeInfo[o.Opcode] = o
+			InstrToOpcode[o.Name] = o.Opcode
+		}
+	}
+}
+
+// Returns the metadata for the expression's instruction, or nil if it isn't known
+func (e *Expression) Info() *OpcodeInfo {
+	if e.Opcode == ExtendedOpcodeFC {
+		return opcodeInfoFC[e.OpcodeExt]
+	}
+	return opcodeInfo[e.Opcode]
+}
+
+// Returns the metadata for an instruction name, or nil if it isn't known
+func LookupOpcode(name string) *OpcodeInfo {
+	return opcodeInfoByName[name]
+}
@@ -0,0 +1,56 @@
+package expression
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type emptyDebug struct{}
+
+func (emptyDebug) GetLineNumberInfo(pc uint64) string                          { return "" }
+func (emptyDebug) GetGlobalIdentifier(globalIdx int, defaultEmpty bool) string { return "0" }
+func (emptyDebug) GetFunctionIdentifier(funcIdx int, defaultEmpty bool) string { return "0" }
+func (emptyDebug) GetLocalVarName(pc uint64, localIdx int) string              { return "" }
+
+func TestOpcodeTable(t *testing.T) {
+	names := make(map[string]bool)
+	for _, o := range Opcodes {
+		assert.False(t, names[o.Name], o.Name)
+		names[o.Name] = true
+
+		e := &Expression{Opcode: o.Opcode, OpcodeExt: o.OpcodeExt}
+		assert.Equal(t, o, e.Info())
+		assert.Equal(t, o.Name, e.Name())
+		assert.Equal(t, o, LookupOpcode(o.Name))
+
+		if o.Immediate == ImmediateUnsupported {
+			assert.Error(t, e.EncodeBinary(&bytes.Buffer{}))
+			assert.Error(t, (&Expression{}).DecodeWat(o.Name, nil))
+			continue
+		}
+
+		// Every instruction goes through all the codecs, apart from the end of a body
+		if o.Name == "end" {
+			continue
+		}
+		if o.Immediate == ImmediateBlockType {
+			e.Result = 0x40
+		} else if o.Immediate == ImmediateLabelTable {
+			e.Labels = []int{1, 2}
+		}
+		verifyEncodeDecode(t, e)
+
+		var buf bytes.Buffer
+		assert.NoError(t, e.EncodeWat(&buf, "", emptyDebug{}))
+		e2 := &Expression{}
+		assert.NoError(t, e2.DecodeWat(buf.String(), nil), buf.String())
+		assert.Equal(t, o, e2.Info())
+	}
+	assert.Equal(t, len(InstrToOpcode)+len(instrToOpcodeFC), len(Opcodes))
+
+	assert.Nil(t, LookupOpcode("i32.nope"))
+	assert.Nil(t, (&Expression{Opcode: 0xff}).Info())
+	assert.Equal(t, "0xff", (&Expression{Opcode: 0xff}).Name())
+}
@@ -0,0 +1,103 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package expression
+
+type WalkAction int
+
+const (
+	WalkContinue WalkAction = iota // Keep the instruction and carry on
+	WalkStop                       // Keep the instruction and stop walking
+	WalkRemove                     // Remove the instruction
+	WalkReplace                    // Replace the instruction with WalkContext.Replacement
+)
+
+// Structural context for the instruction being visited
+type WalkContext struct {
+	FunctionIndex int           // Function index of the code being walked, or -1 if not known
+	Index         int           // Index of the instruction in the original expression list
+	PC            uint64        // PC of the instruction
+	Depth         int           // Block nesting depth. 0 is the function body
+	Blocks        []*Expression // Enclosing block / loop / if instructions, outermost first
+
+	// Set this and return WalkReplace to replace the instruction
+	Replacement []*Expression
+
+	before []*Expression
+	after  []*Expression
+}
+
+// Insert some instructions before the current one
+func (ctx *WalkContext) InsertBefore(e ...*Expression) {
+	ctx.before = append(ctx.before, e...)
+}
+
+// Insert some instructions after the current one
+func (ctx *WalkContext) InsertAfter(e ...*Expression) {
+	ctx.after = append(ctx.after, e...)
+}
+
+/**
+ * Walk some code, calling fn for each instruction, and return the (possibly modified) code.
+ * Instructions inserted or used as replacements are not themselves visited.
+ */
+func Walk(exp []*Expression, functionIndex int, fn func(ctx *WalkContext, e *Expression) WalkAction) []*Expression {
+	ctx := &WalkContext{
+		FunctionIndex: functionIndex,
+	}
+
+	blocks := make([]*Expression, 0)
+	adjustedExpression := make([]*Expression, 0, len(exp))
+	for idx, e := range exp {
+		// The end / else of a block belong to the enclosing depth
+		depth := len(blocks)
+		if (e.Opcode == InstrToOpcode["end"] || e.Opcode == InstrToOpcode["else"]) && depth > 0 {
+			depth--
+		}
+
+		ctx.Index = idx
+		ctx.PC = e.PC
+		ctx.Depth = depth
+		ctx.Blocks = blocks[:depth]
+		ctx.Replacement = nil
+		ctx.before = nil
+		ctx.after = nil
+
+		action := fn(ctx, e)
+
+		adjustedExpression = append(adjustedExpression, ctx.before...)
+		if action == WalkReplace {
+			adjustedExpression = append(adjustedExpression, ctx.Replacement...)
+		} else if action != WalkRemove {
+			adjustedExpression = append(adjustedExpression, e)
+		}
+		adjustedExpression = append(adjustedExpression, ctx.after...)
+
+		if e.Opcode == InstrToOpcode["end"] && len(blocks) > 0 {
+			blocks = blocks[:len(blocks)-1]
+		} else if e.Opcode == InstrToOpcode["block"] ||
+			e.Opcode == InstrToOpcode["loop"] ||
+			e.Opcode == InstrToOpcode["if"] {
+			blocks = append(blocks, e)
+		}
+
+		if action == WalkStop {
+			adjustedExpression = append(adjustedExpression, exp[idx+1:]...)
+			break
+		}
+	}
+	return adjustedExpression
+}
@@ -0,0 +1,63 @@
+package expression
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalk(t *testing.T) {
+	exp, err := ExpressionFromWat(`i32.const 1
+	block
+	  i32.const 2
+	  if
+	    nop
+	  else
+	    loop
+	      drop
+	    end
+	  end
+	end
+	nop`)
+	assert.NoError(t, err)
+
+	depths := make([]int, 0)
+	parents := make([]string, 0)
+	Walk(exp, 5, func(ctx *WalkContext, e *Expression) WalkAction {
+		assert.Equal(t, 5, ctx.FunctionIndex)
+		depths = append(depths, ctx.Depth)
+		parent := ""
+		if len(ctx.Blocks) > 0 {
+			parent = ctx.Blocks[len(ctx.Blocks)-1].Name()
+		}
+		parents = append(parents, parent)
+		return WalkContinue
+	})
+	assert.Equal(t, []int{0, 0, 1, 1, 2, 1, 2, 3, 2, 1, 0, 0}, depths)
+	assert.Equal(t, []string{"", "", "block", "block", "if", "block", "if", "loop", "if", "block", "", ""}, parents)
+
+	// Rewrite all nops, and stop at the first drop
+	nop, err := ExpressionFromWat("i32.const 7\ndrop")
+	assert.NoError(t, err)
+	visited := 0
+	newexp := Walk(exp, -1, func(ctx *WalkContext, e *Expression) WalkAction {
+		visited++
+		if e.Opcode == InstrToOpcode["nop"] {
+			ctx.Replacement = nop
+			return WalkReplace
+		} else if e.Opcode == InstrToOpcode["i32.const"] && e.I32Value == 2 {
+			return WalkRemove
+		} else if e.Opcode == InstrToOpcode["loop"] {
+			ctx.InsertBefore(&Expression{Opcode: InstrToOpcode["nop"]})
+			ctx.InsertAfter(&Expression{Opcode: InstrToOpcode["nop"]})
+		} else if e.Opcode == InstrToOpcode["drop"] {
+			return WalkStop
+		}
+		return WalkContinue
+	})
+	assert.Equal(t, 8, visited)
+	assert.Equal(t, len(exp)+1-1+2, len(newexp))
+	assert.Equal(t, "i32.const", newexp[3].Name())
+	assert.Equal(t, "nop", newexp[6].Name())
+	assert.Equal(t, "nop", newexp[len(newexp)-1].Name())
+}
@@ -0,0 +1,331 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package predicate
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+// What a predicate can refer to, at the place it's compiled for
+type Scope struct {
+	Locals      []types.ValType // Types of the params then the locals of the function
+	LocalNames  map[string]int  // Names for locals, eg from dwarf or the name section
+	Globals     []types.ValType // Types of every global, in index order
+	GlobalNames map[string]int  // Names for globals, eg $__stack_pointer
+}
+
+// The loads for mem[T:addr], which all leave an i64
+var memLoads = map[string]string{
+	"i8":  "i64.load8_s",
+	"u8":  "i64.load8_u",
+	"i16": "i64.load16_s",
+	"u16": "i64.load16_u",
+	"i32": "i64.load32_s",
+	"u32": "i64.load32_u",
+	"i64": "i64.load",
+	"u64": "i64.load",
+}
+
+// Binary operators, loosest first. Comparisons are signed.
+var binaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*"},
+}
+
+var binaryInstrs = map[string]string{
+	"|":  "i64.or",
+	"^":  "i64.xor",
+	"&":  "i64.and",
+	"==": "i64.eq\ni64.extend_i32_u",
+	"!=": "i64.ne\ni64.extend_i32_u",
+	"<":  "i64.lt_s\ni64.extend_i32_u",
+	"<=": "i64.le_s\ni64.extend_i32_u",
+	">":  "i64.gt_s\ni64.extend_i32_u",
+	">=": "i64.ge_s\ni64.extend_i32_u",
+	"<<": "i64.shl",
+	">>": "i64.shr_s",
+	"+":  "i64.add",
+	"-":  "i64.sub",
+	"*":  "i64.mul",
+}
+
+// Longest first, so "<=" isn't read as "<"
+var punctuation = []string{"||", "&&", "==", "!=", "<=", ">=", "<<", ">>",
+	"<", ">", "|", "^", "&", "+", "-", "*", "!", "(", ")", "[", "]", ":"}
+
+/**
+ * Compile a predicate such as `local0 == 5 && mem[i32:0x1000] != 0` to wat that leaves an i32 on
+ * the stack, 1 if it holds and 0 if not. Everything is worked out as an i64, and i32 values are
+ * sign extended. Variables are localN, globalN, or a name from the scope. mem[T:addr] loads from
+ * linear memory, where T is one of i8 u8 i16 u16 i32 u32 i64.
+ */
+func Compile(src string, scope *Scope) (string, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return "", err
+	}
+	if len(toks) == 0 {
+		return "", errors.New("Empty predicate")
+	}
+	p := &parser{toks: toks, scope: scope}
+	code, err := p.binary(0)
+	if err != nil {
+		return "", err
+	}
+	if p.pos < len(p.toks) {
+		return "", fmt.Errorf("Unexpected %q in predicate", p.toks[p.pos])
+	}
+	return code + "i64.eqz\ni32.eqz\n", nil
+}
+
+func tokenize(src string) ([]string, error) {
+	toks := make([]string, 0)
+	i := 0
+outer:
+	for i < len(src) {
+		c := src[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			i++
+			continue
+		}
+		if isIdent(c) {
+			j := i
+			for j < len(src) && (isIdent(src[j]) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+			continue
+		}
+		for _, p := range punctuation {
+			if strings.HasPrefix(src[i:], p) {
+				toks = append(toks, p)
+				i += len(p)
+				continue outer
+			}
+		}
+		return nil, fmt.Errorf("Unexpected %q in predicate", c)
+	}
+	return toks, nil
+}
+
+func isIdent(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '$'
+}
+
+type parser struct {
+	toks  []string
+	pos   int
+	scope *Scope
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) expect(tok string) error {
+	if p.peek() != tok {
+		if p.pos >= len(p.toks) {
+			return fmt.Errorf("Expected %q at the end of the predicate", tok)
+		}
+		return fmt.Errorf("Expected %q but found %q in predicate", tok, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+// Parse the operators at level and tighter. Each piece of code leaves one i64.
+func (p *parser) binary(level int) (string, error) {
+	if level == len(binaryOps) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return "", err
+	}
+	for {
+		op := ""
+		for _, o := range binaryOps[level] {
+			if p.peek() == o {
+				op = o
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return "", err
+		}
+		// The logical ones only look at the right when they need to, so it's safe to guard a load
+		switch op {
+		case "&&":
+			left = left + "i64.eqz\nif (result i64)\ni64.const 0\nelse\n" + right + "i64.eqz\ni64.eqz\ni64.extend_i32_u\nend\n"
+		case "||":
+			left = left + "i64.eqz\nif (result i64)\n" + right + "i64.eqz\ni64.eqz\ni64.extend_i32_u\nelse\ni64.const 1\nend\n"
+		default:
+			left = left + right + binaryInstrs[op] + "\n"
+		}
+	}
+}
+
+func (p *parser) unary() (string, error) {
+	switch p.peek() {
+	case "!":
+		p.pos++
+		v, err := p.unary()
+		if err != nil {
+			return "", err
+		}
+		return v + "i64.eqz\ni64.extend_i32_u\n", nil
+	case "-":
+		p.pos++
+		v, err := p.unary()
+		if err != nil {
+			return "", err
+		}
+		return "i64.const 0\n" + v + "i64.sub\n", nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (string, error) {
+	tok := p.peek()
+	if tok == "" {
+		return "", errors.New("Unexpected end of predicate")
+	}
+	p.pos++
+	if tok == "(" {
+		v, err := p.binary(0)
+		if err != nil {
+			return "", err
+		}
+		return v, p.expect(")")
+	}
+	if tok[0] >= '0' && tok[0] <= '9' {
+		n, err := strconv.ParseUint(tok, 0, 64)
+		if err != nil {
+			return "", fmt.Errorf("Invalid number %q in predicate", tok)
+		}
+		return fmt.Sprintf("i64.const %d\n", int64(n)), nil
+	}
+	if tok == "mem" && p.peek() == "[" {
+		return p.memory()
+	}
+	if !isIdent(tok[0]) {
+		return "", fmt.Errorf("Unexpected %q in predicate", tok)
+	}
+	return p.variable(tok)
+}
+
+// mem[T:addr], after the mem
+func (p *parser) memory() (string, error) {
+	p.pos++
+	ty := p.peek()
+	load, ok := memLoads[ty]
+	if !ok {
+		return "", fmt.Errorf("Unknown memory type %q, expected one of i8 u8 i16 u16 i32 u32 i64", ty)
+	}
+	p.pos++
+	err := p.expect(":")
+	if err != nil {
+		return "", err
+	}
+	addr, err := p.binary(0)
+	if err != nil {
+		return "", err
+	}
+	err = p.expect("]")
+	if err != nil {
+		return "", err
+	}
+	return addr + "i32.wrap_i64\n" + load + "\n", nil
+}
+
+func (p *parser) variable(name string) (string, error) {
+	if idx, ok := numbered(name, "local"); ok {
+		return p.local(name, idx)
+	}
+	if idx, ok := numbered(name, "global"); ok {
+		return p.global(name, idx)
+	}
+	for _, n := range []string{name, "$" + name} {
+		if idx, ok := p.scope.LocalNames[n]; ok {
+			return p.local(name, idx)
+		}
+	}
+	for _, n := range []string{name, "$" + name} {
+		if idx, ok := p.scope.GlobalNames[n]; ok {
+			return p.global(name, idx)
+		}
+	}
+	return "", fmt.Errorf("Unknown variable %s in predicate", name)
+}
+
+func (p *parser) local(name string, idx int) (string, error) {
+	if idx >= len(p.scope.Locals) {
+		return "", fmt.Errorf("Local %s not found", name)
+	}
+	return load(name, fmt.Sprintf("local.get %d", idx), p.scope.Locals[idx])
+}
+
+func (p *parser) global(name string, idx int) (string, error) {
+	if idx >= len(p.scope.Globals) {
+		return "", fmt.Errorf("Global %s not found", name)
+	}
+	return load(name, fmt.Sprintf("global.get %d", idx), p.scope.Globals[idx])
+}
+
+// Get a value and make it an i64
+func load(name string, get string, vt types.ValType) (string, error) {
+	switch vt {
+	case types.ValI32:
+		return get + "\ni64.extend_i32_s\n", nil
+	case types.ValI64:
+		return get + "\n", nil
+	}
+	return "", fmt.Errorf("%s is a %s, only i32 and i64 are supported atm", name, types.ByteToValType[vt])
+}
+
+// Split a name such as local3 into its index
+func numbered(name string, prefix string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(name[len(prefix):])
+	if err != nil || idx < 0 {
+		return 0, false
+	}
+	return idx, true
+}
@@ -0,0 +1,68 @@
+package predicate
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var testScope = &Scope{
+	Locals:      []types.ValType{types.ValI32, types.ValI64, types.ValF32},
+	LocalNames:  map[string]int{"n": 0, "$count": 1, "$ratio": 2},
+	Globals:     []types.ValType{types.ValI32},
+	GlobalNames: map[string]int{"$__stack_pointer": 0},
+}
+
+func TestCompile(t *testing.T) {
+	code, err := Compile("local0 == 5", testScope)
+	assert.NoError(t, err)
+	assert.Equal(t, "local.get 0\ni64.extend_i32_s\ni64.const 5\ni64.eq\ni64.extend_i32_u\ni64.eqz\ni32.eqz\n", code)
+
+	// Names, and i64 locals aren't extended
+	code, err = Compile("n < count", testScope)
+	assert.NoError(t, err)
+	assert.Equal(t, "local.get 0\ni64.extend_i32_s\nlocal.get 1\ni64.lt_s\ni64.extend_i32_u\ni64.eqz\ni32.eqz\n", code)
+
+	// Precedence, so this is 1 + (2 * 3)
+	code, err = Compile("1 + 2 * 3", testScope)
+	assert.NoError(t, err)
+	assert.Equal(t, "i64.const 1\ni64.const 2\ni64.const 3\ni64.mul\ni64.add\ni64.eqz\ni32.eqz\n", code)
+
+	code, err = Compile("mem[u8:0x10 + global0]", testScope)
+	assert.NoError(t, err)
+	assert.Equal(t, "i64.const 16\nglobal.get 0\ni64.extend_i32_s\ni64.add\ni32.wrap_i64\ni64.load8_u\ni64.eqz\ni32.eqz\n", code)
+
+	// Everything that parses is valid wat
+	for _, src := range []string{
+		"local0 == 5 && mem[i32:0x1000] != 0",
+		"!(n >= -1) || $__stack_pointer & 0xff",
+		"(count << 2 >> 1 ^ 7 | 8) <= 0xffffffffffffffff",
+	} {
+		code, err = Compile(src, testScope)
+		assert.NoError(t, err, src)
+		_, err = expression.ExpressionFromWat(code)
+		assert.NoError(t, err, src)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"local0 ==",
+		"(local0",
+		"local9",
+		"global3",
+		"missing",
+		"ratio > 1",
+		"mem[f32:0]",
+		"mem[i32 0]",
+		"local0 = 1",
+		"1 2",
+		"0xzz",
+	} {
+		_, err := Compile(src, testScope)
+		assert.Error(t, err, src)
+	}
+}
@@ -16,6 +16,8 @@
 
 package types
 
+import "fmt"
+
 type ValType byte
 
 const (
@@ -63,9 +65,34 @@ const (
 	SectionDataCount SectionId = 12
 )
 
+var sectionNames = map[SectionId]string{
+	SectionCustom:    "custom",
+	SectionType:      "type",
+	SectionImport:    "import",
+	SectionFunction:  "function",
+	SectionTable:     "table",
+	SectionMemory:    "memory",
+	SectionGlobal:    "global",
+	SectionExport:    "export",
+	SectionStart:     "start",
+	SectionElem:      "elem",
+	SectionCode:      "code",
+	SectionData:      "data",
+	SectionDataCount: "datacount",
+}
+
+func (s SectionId) String() string {
+	n, ok := sectionNames[s]
+	if ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", byte(s))
+}
+
 const (
-	LimitTypeMin    byte = 0x00
-	LimitTypeMinMax byte = 0x01
+	LimitTypeMin          byte = 0x00
+	LimitTypeMinMax       byte = 0x01
+	LimitTypeMinMaxShared byte = 0x03
 )
 
 type ExportType byte
@@ -1,5 +1,7 @@
 package wasm
 
+import "fmt"
+
 var Debug_wasi_snapshot_preview1 = map[string]string{
 	"args_get":               "args_get(argv, argv_buf)",
 	"args_sizes_get":         "args_sizes_get(argc, argvBufSize)",
@@ -43,9 +45,10 @@ var Debug_wasi_snapshot_preview1 = map[string]string{
 	"proc_raise":             "proc_raise(sig)",
 	"random_get":             "random_get(bufPtr, bufLen)",
 	"sched_yield":            "sched_yield()",
-	"sock_recv":              "sock_recv",
-	"sock_send":              "sock_send",
-	"sock_shutdown":          "sock_shutdown",
+	"sock_accept":            "sock_accept(fd, flags, fdPtr)",
+	"sock_recv":              "sock_recv(fd, riData, riDataLen, riFlags, roDataLen, roFlags)",
+	"sock_send":              "sock_send(fd, siData, siDataLen, siFlags, soDataLen)",
+	"sock_shutdown":          "sock_shutdown(fd, how)",
 }
 
 var Wasi_errors = map[string]int{
@@ -138,7 +141,7 @@ func GetWasiParamCodeEnter(wasi_name string) string {
 					call $debug_func_wasi_context
 					local.get 2
 					local.get 3
-					call $wt_print
+					call $debug_print_path
 					call $debug_func_wasi_done_string
 					`
 	} else if wasi_name == "path_create_directory" {
@@ -148,7 +151,7 @@ func GetWasiParamCodeEnter(wasi_name string) string {
 					call $debug_func_wasi_context
 					local.get 1
 					local.get 2
-					call $wt_print
+					call $debug_print_path
 					call $debug_func_wasi_done_string
 					`
 	} else if wasi_name == "path_remove_directory" {
@@ -158,7 +161,7 @@ func GetWasiParamCodeEnter(wasi_name string) string {
 					call $debug_func_wasi_context
 					local.get 1
 					local.get 2
-					call $wt_print
+					call $debug_print_path
 					call $debug_func_wasi_done_string
 					`
 	} else if wasi_name == "path_unlink_file" {
@@ -168,7 +171,7 @@ func GetWasiParamCodeEnter(wasi_name string) string {
 					call $debug_func_wasi_context
 					local.get 1
 					local.get 2
-					call $wt_print
+					call $debug_print_path
 					call $debug_func_wasi_done_string
 					`
 	} else if wasi_name == "path_rename" {
@@ -178,16 +181,25 @@ func GetWasiParamCodeEnter(wasi_name string) string {
 						call $debug_func_wasi_context
 						local.get 1
 						local.get 2
-						call $wt_print
+						call $debug_print_path
 						i32.const offset($dd_wasi_var_rename)
 						i32.const length($dd_wasi_var_rename)
 						call $wt_print
 						local.get 4
 						local.get 5
-						call $wt_print
+						call $debug_print_path
 
 						call $debug_func_wasi_done_string
 						`
+	} else if wasi_name == "fd_write" || wasi_name == "fd_pwrite" || wasi_name == "sock_send" {
+		// Print out the data being written
+		return `i32.const offset($dd_wasi_var_data)
+					i32.const length($dd_wasi_var_data)
+					local.get 1
+					local.get 2
+					i32.const 0x7fffffff
+					call $debug_print_iovecs
+					`
 	} else if wasi_name == "proc_exit" {
 		// Print out timings summary here for definite
 		return `call $show_timings_summary
@@ -204,23 +216,91 @@ func GetWasiParamCodeExit(wasi_name string) string {
 					call $debug_func_wasi_context
 					local.get 1
 					local.get 2
-					call $wt_print
+					call $debug_print_path
 					call $debug_func_wasi_done_string
 					`
-	} else if wasi_name == "fd_read" {
+	} else if wasi_name == "fd_read" || wasi_name == "fd_pread" {
+		// Show the number of bytes, and the data read
+		nread := 3
+		if wasi_name == "fd_pread" {
+			nread = 4
+		}
+		return fmt.Sprintf(`i32.const offset($dd_wasi_res_bytes)
+					i32.const length($dd_wasi_res_bytes)
+					call $debug_func_wasi_context
+
+					local.get %d
+					i32.load
+					call $wt_format_i32_dec
+
+					i32.const offset($db_number_i32)
+					i32.const 10
+					call $wt_print
+								
+					call $debug_func_wasi_done
+
+					i32.const offset($dd_wasi_res_data)
+					i32.const length($dd_wasi_res_data)
+					local.get 1
+					local.get 2
+					local.get %d
+					i32.load
+					call $debug_print_iovecs
+					`, nread, nread)
+	} else if wasi_name == "sock_recv" {
+		// Show the number of bytes, and the data received
+		return `i32.const offset($dd_wasi_res_bytes)
+					i32.const length($dd_wasi_res_bytes)
+					call $debug_func_wasi_context
+
+					local.get 4
+					i32.load
+					call $wt_format_i32_dec
+
+					i32.const offset($db_number_i32)
+					i32.const 10
+					call $wt_print
+
+					call $debug_func_wasi_done
+
+					i32.const offset($dd_wasi_res_data)
+					i32.const length($dd_wasi_res_data)
+					local.get 1
+					local.get 2
+					local.get 4
+					i32.load
+					call $debug_print_iovecs
+					`
+	} else if wasi_name == "sock_send" {
 		// Show the number of bytes
 		return `i32.const offset($dd_wasi_res_bytes)
 					i32.const length($dd_wasi_res_bytes)
 					call $debug_func_wasi_context
 
-					local.get 3
+					local.get 4
 					i32.load
 					call $wt_format_i32_dec
 
 					i32.const offset($db_number_i32)
 					i32.const 10
 					call $wt_print
-								
+
+					call $debug_func_wasi_done
+					`
+	} else if wasi_name == "sock_accept" {
+		// Show the new fd
+		return `i32.const offset($dd_wasi_res_fd)
+					i32.const length($dd_wasi_res_fd)
+					call $debug_func_wasi_context
+
+					local.get 2
+					i32.load
+					call $wt_format_i32_dec
+
+					i32.const offset($db_number_i32)
+					i32.const 10
+					call $wt_print
+
 					call $debug_func_wasi_done
 					`
 	} else if wasi_name == "fd_write" {
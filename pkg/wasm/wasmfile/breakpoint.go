@@ -0,0 +1,187 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/predicate"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+// The function a breakpoint calls. It takes the PC of the instruction the breakpoint is at.
+const BreakpointHandler = "$__break"
+
+/**
+ * Add a breakpoint at a source line. A call to $__break is spliced in before each instruction the
+ * line table has for the line, passing the original PC of the instruction so the handler can tell
+ * them apart. $__break must already be in the module, with the type (func (param i32)).
+ * The PCs are the ones from decoding, so every breakpoint must be added before the code is encoded again.
+ * Returns the PCs the breakpoint was added at.
+ */
+func (wf *WasmFile) InsertBreakpoint(file string, line int) ([]uint64, error) {
+	return wf.InsertConditionalBreakpoint(file, line, "")
+}
+
+/**
+ * Add a breakpoint at a source line that only calls $__break when cond holds. The condition is a
+ * predicate (see pkg/wasm/predicate), compiled into a guard at each place, so it can use the dwarf
+ * locals in scope there. An empty cond is the same as InsertBreakpoint.
+ */
+func (wf *WasmFile) InsertConditionalBreakpoint(file string, line int, cond string) ([]uint64, error) {
+	handler := wf.Debug.LookupFunctionID(BreakpointHandler)
+	if handler == -1 {
+		return nil, fmt.Errorf("Function %s not found", BreakpointHandler)
+	}
+	te, err := wf.functionType(handler)
+	if err != nil {
+		return nil, err
+	}
+	if len(te.Param) != 1 || te.Param[0] != types.ValI32 || len(te.Result) != 0 {
+		return nil, fmt.Errorf("Function %s should have the type (func (param i32))", BreakpointHandler)
+	}
+
+	// Group the addresses by function, so each function is only walked once
+	pcs := make(map[int]map[uint64]bool)
+	fids := make([]int, 0)
+	for _, pc := range wf.FindAddressesForLine(file, line) {
+		fid := wf.FindFunction(pc)
+		if fid == -1 {
+			continue
+		}
+		if pcs[fid] == nil {
+			pcs[fid] = make(map[uint64]bool)
+			fids = append(fids, fid)
+		}
+		pcs[fid][pc] = true
+	}
+
+	added := make([]uint64, 0)
+	for _, fid := range fids {
+		c := wf.Code[fid-len(wf.Import)]
+		scope, err := wf.predicateScope(fid)
+		if err != nil {
+			return nil, err
+		}
+		exp := c.Expression
+		var guardErr error
+		newExp := expression.Walk(exp, fid, func(ctx *expression.WalkContext, e *expression.Expression) expression.WalkAction {
+			// Code that has already been inserted has no PC
+			if guardErr != nil || e.PCNext == 0 || !pcs[fid][e.PC] {
+				return expression.WalkContinue
+			}
+			bp := []*expression.Expression{
+				{Opcode: expression.InstrToOpcode["i32.const"], I32Value: int32(e.PC)},
+				{Opcode: expression.InstrToOpcode["call"], FuncIndex: handler},
+			}
+			if cond != "" {
+				bp, guardErr = wf.breakpointGuard(scope, e.PC, cond, handler)
+				if guardErr != nil {
+					return expression.WalkStop
+				}
+			}
+			// Adding the same breakpoint again leaves the code as it is, and an unconditional one covers any condition
+			if e.Opcode == expression.InstrToOpcode["else"] {
+				// Before the else would only be reached from the if branch
+				if !isBreakpoint(exp, ctx.Index+1, e.PC, handler) {
+					ctx.InsertAfter(bp...)
+				}
+			} else if !isBreakpoint(exp, ctx.Index-2, e.PC, handler) {
+				ctx.InsertBefore(bp...)
+			}
+			added = append(added, e.PC)
+			return expression.WalkContinue
+		})
+		if guardErr != nil {
+			return nil, guardErr
+		}
+		c.Expression = newExp
+		c.dirty = true
+	}
+
+	if len(added) == 0 {
+		return nil, fmt.Errorf("No code found for %s:%d", file, line)
+	}
+	return added, nil
+}
+
+// What a breakpoint condition in a function can see, apart from the dwarf locals which depend on the PC
+func (wf *WasmFile) predicateScope(fid int) (*predicate.Scope, error) {
+	te, err := wf.functionType(fid)
+	if err != nil {
+		return nil, err
+	}
+	scope := &predicate.Scope{
+		Locals:      append(append([]types.ValType{}, te.Param...), wf.Code[fid-len(wf.Import)].Locals...),
+		LocalNames:  make(map[string]int),
+		Globals:     make([]types.ValType, 0, len(wf.Global)),
+		GlobalNames: make(map[string]int),
+	}
+	for idx, name := range wf.Debug.FunctionLocalNames[fid] {
+		scope.LocalNames[name] = idx
+	}
+	for _, g := range wf.Global {
+		scope.Globals = append(scope.Globals, g.Type)
+	}
+	for idx, name := range wf.Debug.GlobalNames {
+		scope.GlobalNames[name] = idx
+	}
+	return scope, nil
+}
+
+// The code for a conditional breakpoint at pc: the condition, then a call to the handler if it holds
+func (wf *WasmFile) breakpointGuard(scope *predicate.Scope, pc uint64, cond string, handler int) ([]*expression.Expression, error) {
+	at := &predicate.Scope{
+		Locals:      scope.Locals,
+		LocalNames:  make(map[string]int),
+		Globals:     scope.Globals,
+		GlobalNames: scope.GlobalNames,
+	}
+	for name, idx := range scope.LocalNames {
+		at.LocalNames[name] = idx
+	}
+	// Inner scopes come later, so they win
+	for _, l := range wf.Debug.GetLocalsAt(pc) {
+		at.LocalNames[l.VarName] = l.Index
+	}
+
+	code, err := predicate.Compile(cond, at)
+	if err != nil {
+		return nil, fmt.Errorf("Breakpoint condition %q: %v", cond, err)
+	}
+	guard, err := expression.ExpressionFromWat(code + "if\nend")
+	if err != nil {
+		return nil, err
+	}
+	// The call goes inside the if
+	end := guard[len(guard)-1]
+	guard = append(guard[:len(guard)-1],
+		&expression.Expression{Opcode: expression.InstrToOpcode["i32.const"], I32Value: int32(pc)},
+		&expression.Expression{Opcode: expression.InstrToOpcode["call"], FuncIndex: handler},
+		end)
+	return guard, nil
+}
+
+// Is there already a breakpoint for pc at exp[i]
+func isBreakpoint(exp []*expression.Expression, i int, pc uint64, handler int) bool {
+	if i < 0 || i+1 >= len(exp) {
+		return false
+	}
+	return exp[i].Opcode == expression.InstrToOpcode["i32.const"] && exp[i].I32Value == int32(pc) &&
+		exp[i+1].Opcode == expression.InstrToOpcode["call"] && exp[i+1].FuncIndex == handler
+}
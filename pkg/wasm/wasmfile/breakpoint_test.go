@@ -0,0 +1,99 @@
+package wasmfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertBreakpoint(t *testing.T) {
+	wf := newTestModule(t)
+	assert.NoError(t, wf.AddWatDebugSections("test.wat"))
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	wf2.Debug = &debug.WasmDebug{}
+	wf2.Debug.ParseNameSectionData(wf2.GetCustomSectionData("name"))
+	assert.NoError(t, wf2.Debug.ParseDwarf(wf2))
+	assert.NoError(t, wf2.Debug.ParseDwarfLineNumbers())
+
+	_, err := wf2.InsertBreakpoint("test.wat", 23)
+	assert.Error(t, err)
+
+	_, err = wf2.AddFunctionFromWat("$__break", "(func (param i32))")
+	assert.NoError(t, err)
+	handler := wf2.Debug.LookupFunctionID("$__break")
+
+	hello := wf2.Code[1]
+	target := hello.Expression[9]
+	pcs, err := wf2.InsertBreakpoint("test.wat", 23)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{target.PC}, pcs)
+	assert.Equal(t, expression.InstrToOpcode["i32.const"], hello.Expression[9].Opcode)
+	assert.Equal(t, int32(target.PC), hello.Expression[9].I32Value)
+	assert.Equal(t, expression.InstrToOpcode["call"], hello.Expression[10].Opcode)
+	assert.Equal(t, handler, hello.Expression[10].FuncIndex)
+	assert.Equal(t, target, hello.Expression[11])
+
+	// Adding it again doesn't change anything
+	n := len(hello.Expression)
+	pcs, err = wf2.InsertBreakpoint("test.wat", 23)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{target.PC}, pcs)
+	assert.Equal(t, n, len(hello.Expression))
+
+	// An unconditional breakpoint already covers a conditional one
+	pcs, err = wf2.InsertConditionalBreakpoint("test.wat", 23, "1 == 1")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{target.PC}, pcs)
+	assert.Equal(t, n, len(hello.Expression))
+
+	_, err = wf2.InsertConditionalBreakpoint("test.wat", 23, "1 ==")
+	assert.Error(t, err)
+	assert.Equal(t, n, len(hello.Expression))
+
+	_, err = wf2.InsertBreakpoint("test.wat", 1000)
+	assert.Error(t, err)
+	assert.NoError(t, wf2.Validate())
+}
+
+func TestInsertConditionalBreakpoint(t *testing.T) {
+	wf := newTestModule(t)
+	assert.NoError(t, wf.AddWatDebugSections("test.wat"))
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	wf2.Debug = &debug.WasmDebug{}
+	wf2.Debug.ParseNameSectionData(wf2.GetCustomSectionData("name"))
+	assert.NoError(t, wf2.Debug.ParseDwarf(wf2))
+	assert.NoError(t, wf2.Debug.ParseDwarfLineNumbers())
+	_, err := wf2.AddFunctionFromWat("$__break", "(func (param i32))")
+	assert.NoError(t, err)
+	handler := wf2.Debug.LookupFunctionID("$__break")
+
+	hello := wf2.Code[1]
+	target := hello.Expression[9]
+	pcs, err := wf2.InsertConditionalBreakpoint("test.wat", 23, "mem[i32:16] != 0")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{target.PC}, pcs)
+
+	// The guard is the condition, then an if around the call
+	guard := hello.Expression[9:]
+	i := 0
+	for guard[i].Opcode != expression.InstrToOpcode["if"] {
+		i++
+	}
+	assert.Equal(t, expression.InstrToOpcode["i32.const"], guard[i+1].Opcode)
+	assert.Equal(t, int32(target.PC), guard[i+1].I32Value)
+	assert.Equal(t, handler, guard[i+2].FuncIndex)
+	assert.Equal(t, expression.InstrToOpcode["end"], guard[i+3].Opcode)
+	assert.Equal(t, target, guard[i+4])
+	assert.NoError(t, wf2.Validate())
+}
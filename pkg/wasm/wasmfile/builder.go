@@ -0,0 +1,226 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+/**
+ * Builder constructs a module from Go.
+ * Each Add method returns the resolved index of the new item. The first error is remembered, and
+ * returned from Build, so calls can be chained without checking each one.
+ *
+ * Function bodies may refer to functions, globals and data by name (eg "call $foo" or
+ * "i32.const offset($data)"). These are resolved when Build is called.
+ */
+type Builder struct {
+	wf  *WasmFile
+	err error
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		wf: NewEmpty(),
+	}
+}
+
+// Err returns the first error seen by the builder
+func (b *Builder) Err() error {
+	return b.err
+}
+
+func (b *Builder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+/**
+ * Add a function import. Imports come first in the function index space, so they must be
+ * added before any functions.
+ */
+func (b *Builder) AddImportFunc(module string, name string, id string, params []types.ValType, results []types.ValType) int {
+	if len(b.wf.Code) > 0 {
+		b.setErr(fmt.Errorf("Import %s:%s must be added before any functions", module, name))
+		return -1
+	}
+	if id != "" && b.wf.Debug.LookupFunctionID(id) != -1 {
+		b.setErr(fmt.Errorf("Function %s already exists", id))
+		return -1
+	}
+
+	idx := len(b.wf.Import)
+	b.wf.Import = append(b.wf.Import, &ImportEntry{
+		Module: module,
+		Name:   name,
+		Type:   types.ExportFunc,
+		Index:  b.wf.AddTypeMaybe(&TypeEntry{Param: params, Result: results}),
+	})
+	if id != "" {
+		b.wf.Debug.FunctionNames[idx] = id
+	}
+	return idx
+}
+
+/**
+ * Add a function with the given signature and body. The body does not include the final end.
+ *
+ */
+func (b *Builder) AddTypedFunction(name string, params []types.ValType, results []types.ValType, body []*expression.Expression) int {
+	if name != "" && b.wf.Debug.LookupFunctionID(name) != -1 {
+		b.setErr(fmt.Errorf("Function %s already exists", name))
+		return -1
+	}
+
+	fid := len(b.wf.Import) + len(b.wf.Code)
+	b.wf.Function = append(b.wf.Function, &FunctionEntry{
+		TypeIndex: b.wf.AddTypeMaybe(&TypeEntry{Param: params, Result: results}),
+	})
+	b.wf.Code = append(b.wf.Code, &CodeEntry{
+		Locals:     make([]types.ValType, 0),
+		Expression: body,
+	})
+	if name != "" {
+		b.wf.Debug.FunctionNames[fid] = name
+	}
+	return fid
+}
+
+/**
+ * Add a function, with the body given as wat instructions (one per line).
+ *
+ */
+func (b *Builder) AddTypedFunctionWat(name string, params []types.ValType, results []types.ValType, body string) int {
+	ex, err := expression.ExpressionFromWat(body)
+	if err != nil {
+		b.setErr(fmt.Errorf("Function %s: %w", name, err))
+		return -1
+	}
+	b.wf.ResolveBlockTypes(ex)
+	return b.AddTypedFunction(name, params, results, ex)
+}
+
+/**
+ * Add a local to a function, and return the local index (after the params).
+ *
+ */
+func (b *Builder) AddLocal(fid int, t types.ValType) int {
+	cid := fid - len(b.wf.Import)
+	if cid < 0 || cid >= len(b.wf.Code) {
+		b.setErr(fmt.Errorf("AddLocal: function %d not found", fid))
+		return -1
+	}
+	te := b.wf.Type[b.wf.Function[cid].TypeIndex]
+	c := b.wf.Code[cid]
+	c.Locals = append(c.Locals, t)
+	return len(te.Param) + len(c.Locals) - 1
+}
+
+func (b *Builder) AddExport(name string, t types.ExportType, index int) int {
+	for _, e := range b.wf.Export {
+		if e.Name == name {
+			b.setErr(fmt.Errorf("Export %s already exists", name))
+			return -1
+		}
+	}
+	b.wf.Export = append(b.wf.Export, &ExportEntry{
+		Name:  name,
+		Type:  t,
+		Index: index,
+	})
+	return len(b.wf.Export) - 1
+}
+
+/**
+ * Add a memory. A max of 0 means no maximum.
+ *
+ */
+func (b *Builder) AddMemory(min int, max int) int {
+	if len(b.wf.Memory) > 0 {
+		b.setErr(errors.New("Only one memory is supported"))
+		return -1
+	}
+	b.wf.Memory = append(b.wf.Memory, &MemoryEntry{
+		LimitMin: min,
+		LimitMax: max,
+	})
+	return len(b.wf.Memory) - 1
+}
+
+/**
+ * Add a global, with the init expression given as wat (eg "i32.const 0").
+ *
+ */
+func (b *Builder) AddGlobal(name string, t types.ValType, mutable bool, init string) int {
+	idx, err := b.wf.AddGlobal(name, t, mutable, init)
+	if err != nil {
+		b.setErr(err)
+	}
+	return idx
+}
+
+/**
+ * Add a data segment. It is placed after any existing data.
+ *
+ */
+func (b *Builder) AddData(name string, data []byte) int {
+	if name != "" && b.wf.Debug.LookupDataId(name) != -1 {
+		b.setErr(fmt.Errorf("Data %s already exists", name))
+		return -1
+	}
+	b.wf.AddData(name, data)
+	return len(b.wf.Data) - 1
+}
+
+/**
+ * Resolve any references by name, validate the module and return it.
+ *
+ */
+func (b *Builder) Build() (*WasmFile, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	wf := b.wf
+	for _, c := range wf.Code {
+		err := c.ResolveLengths(wf)
+		if err != nil {
+			return nil, err
+		}
+		err = c.ResolveRelocations(wf, 0)
+		if err != nil {
+			return nil, err
+		}
+		err = c.ResolveGlobals(wf)
+		if err != nil {
+			return nil, err
+		}
+		err = c.ResolveFunctions(wf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := wf.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
@@ -0,0 +1,73 @@
+package wasmfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuilder(t *testing.T) {
+	i32 := types.ValI32
+	b := NewBuilder()
+
+	fdWrite := b.AddImportFunc("wasi_snapshot_preview1", "fd_write", "$fd_write", []types.ValType{i32, i32, i32, i32}, []types.ValType{i32})
+	assert.Equal(t, 0, fdWrite)
+
+	assert.Equal(t, 0, b.AddMemory(1, 0))
+	assert.Equal(t, 0, b.AddGlobal("$counter", i32, true, "i32.const 0"))
+	assert.Equal(t, 0, b.AddData("$message", []byte("Hello world")))
+
+	add := b.AddTypedFunctionWat("$add", []types.ValType{i32, i32}, []types.ValType{i32}, `
+		local.get 0
+		local.get 1
+		i32.add`)
+	assert.Equal(t, 1, add)
+
+	hello := b.AddTypedFunctionWat("$hello", nil, nil, `
+		global.get $counter
+		i32.const length($message)
+		call $add
+		local.tee 0
+		global.set $counter`)
+	assert.Equal(t, 2, hello)
+	assert.Equal(t, 0, b.AddLocal(hello, i32))
+
+	assert.Equal(t, 0, b.AddExport("hello", types.ExportFunc, hello))
+
+	// Adding imports after functions would renumber them
+	assert.Equal(t, -1, b.AddImportFunc("env", "late", "$late", nil, nil))
+	assert.Error(t, b.Err())
+	b.err = nil
+
+	wf, err := b.Build()
+	assert.NoError(t, err)
+
+	// Types are shared where possible
+	assert.Equal(t, 3, len(wf.Type))
+	assert.Equal(t, add, wf.Code[1].Expression[2].FuncIndex)
+	assert.Equal(t, int32(11), wf.Code[1].Expression[1].I32Value)
+
+	var buf bytes.Buffer
+	err = wf.EncodeBinary(&buf)
+	assert.NoError(t, err)
+
+	wf2, err := NewFromReader(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, wf2.Validate())
+	assert.Equal(t, 2, len(wf2.Code))
+}
+
+func TestBuilderErrors(t *testing.T) {
+	b := NewBuilder()
+	b.AddTypedFunctionWat("$f", nil, nil, "call $missing")
+	_, err := b.Build()
+	assert.Error(t, err)
+
+	b = NewBuilder()
+	b.AddTypedFunctionWat("$f", nil, nil, "nop")
+	b.AddTypedFunctionWat("$f", nil, nil, "nop")
+	_, err = b.Build()
+	assert.Error(t, err)
+}
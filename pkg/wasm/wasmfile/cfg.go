@@ -0,0 +1,332 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+)
+
+// A straight line run of instructions
+type BasicBlock struct {
+	Index   int    // Index into CFG.Blocks
+	Start   int    // First instruction index (into CodeEntry.Expression)
+	End     int    // One past the last instruction index
+	StartPC uint64 // PC of the first instruction, if known
+	Succ    []int  // Successor block indexes
+	Pred    []int  // Predecessor block indexes
+}
+
+// Control flow graph for a single function
+type CFG struct {
+	FunctionIndex int
+	Blocks        []*BasicBlock
+	Entry         int // Entry block (always 0)
+	Exit          int // A virtual empty block which every return / fall off the end goes to
+}
+
+// Matching structure for a block / loop / if
+type cfgFrame struct {
+	start  int // Index of the block / loop / if
+	elseAt int // Index of the else, or -1
+	end    int // Index of the matching end
+}
+
+/**
+ * Build the control flow graph for a function (in the function index space).
+ *
+ */
+func (wf *WasmFile) BuildCFG(funcIndex int) (*CFG, error) {
+	cid := funcIndex - len(wf.Import)
+	if funcIndex < len(wf.Import) || cid >= len(wf.Code) {
+		return nil, fmt.Errorf("Function %d has no code", funcIndex)
+	}
+	cfg, err := buildCFG(wf.Code[cid].Expression)
+	if err != nil {
+		return nil, fmt.Errorf("Function %d: %w", funcIndex, err)
+	}
+	cfg.FunctionIndex = funcIndex
+	return cfg, nil
+}
+
+func buildCFG(exp []*expression.Expression) (*CFG, error) {
+	opBlock := expression.InstrToOpcode["block"]
+	opLoop := expression.InstrToOpcode["loop"]
+	opIf := expression.InstrToOpcode["if"]
+	opElse := expression.InstrToOpcode["else"]
+	opEnd := expression.InstrToOpcode["end"]
+	opBr := expression.InstrToOpcode["br"]
+	opBrIf := expression.InstrToOpcode["br_if"]
+	opBrTable := expression.InstrToOpcode["br_table"]
+	opReturn := expression.InstrToOpcode["return"]
+	opUnreachable := expression.InstrToOpcode["unreachable"]
+
+	// First match up the structure, and record the enclosing frames of each branch.
+	frames := make(map[int]*cfgFrame) // keyed by start, else and end index
+	enclosing := make(map[int][]*cfgFrame)
+	stack := make([]*cfgFrame, 0)
+	for idx, e := range exp {
+		if e.Opcode == opBlock || e.Opcode == opLoop || e.Opcode == opIf {
+			f := &cfgFrame{start: idx, elseAt: -1}
+			frames[idx] = f
+			stack = append(stack, f)
+		} else if e.Opcode == opElse {
+			if len(stack) == 0 || exp[stack[len(stack)-1].start].Opcode != opIf {
+				return nil, fmt.Errorf("else without if at %d", idx)
+			}
+			f := stack[len(stack)-1]
+			f.elseAt = idx
+			frames[idx] = f
+		} else if e.Opcode == opEnd {
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("end without block at %d", idx)
+			}
+			f := stack[len(stack)-1]
+			f.end = idx
+			frames[idx] = f
+			stack = stack[:len(stack)-1]
+		} else if e.Opcode == opBr || e.Opcode == opBrIf || e.Opcode == opBrTable {
+			enclosing[idx] = append([]*cfgFrame{}, stack...)
+		}
+	}
+	if len(stack) != 0 {
+		return nil, errors.New("unclosed block")
+	}
+
+	exit := len(exp)
+
+	// Where a branch to label l from instruction idx goes. exit for the function body.
+	target := func(idx int, l int) (int, error) {
+		st := enclosing[idx]
+		if l == len(st) {
+			return exit, nil
+		}
+		if l < 0 || l > len(st) {
+			return 0, fmt.Errorf("label %d out of range at %d", l, idx)
+		}
+		f := st[len(st)-1-l]
+		if exp[f.start].Opcode == opLoop {
+			return f.start, nil
+		}
+		return f.end, nil
+	}
+
+	// Find the leaders
+	leaders := map[int]bool{0: true, exit: true}
+	for idx, e := range exp {
+		if e.Opcode == opLoop || e.Opcode == opEnd {
+			leaders[idx] = true
+		} else if e.Opcode == opIf || e.Opcode == opElse ||
+			e.Opcode == opBr || e.Opcode == opBrIf || e.Opcode == opBrTable ||
+			e.Opcode == opReturn || e.Opcode == opUnreachable {
+			leaders[idx+1] = true
+		}
+	}
+
+	starts := make([]int, 0, len(leaders))
+	for l := range leaders {
+		starts = append(starts, l)
+	}
+	sort.Ints(starts)
+
+	cfg := &CFG{}
+	blockAt := make(map[int]int)
+	for i, s := range starts {
+		end := s
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		b := &BasicBlock{
+			Index: len(cfg.Blocks),
+			Start: s,
+			End:   end,
+		}
+		if s < len(exp) {
+			b.StartPC = exp[s].PC
+		}
+		blockAt[s] = b.Index
+		cfg.Blocks = append(cfg.Blocks, b)
+	}
+	cfg.Entry = blockAt[0]
+	cfg.Exit = blockAt[exit]
+
+	// Now add the edges, based on the last instruction of each block
+	for _, b := range cfg.Blocks {
+		if b.Index == cfg.Exit {
+			continue
+		}
+		last := b.End - 1
+		e := exp[last]
+		succ := make([]int, 0)
+		if e.Opcode == opBr {
+			t, err := target(last, e.LabelIndex)
+			if err != nil {
+				return nil, err
+			}
+			succ = append(succ, t)
+		} else if e.Opcode == opBrIf {
+			t, err := target(last, e.LabelIndex)
+			if err != nil {
+				return nil, err
+			}
+			succ = append(succ, t, b.End)
+		} else if e.Opcode == opBrTable {
+			labels := append([]int{}, e.Labels...)
+			for _, l := range append(labels, e.LabelIndex) {
+				t, err := target(last, l)
+				if err != nil {
+					return nil, err
+				}
+				succ = append(succ, t)
+			}
+		} else if e.Opcode == opReturn {
+			succ = append(succ, exit)
+		} else if e.Opcode == opUnreachable {
+			// Traps, so nothing follows
+		} else if e.Opcode == opIf {
+			f := frames[last]
+			succ = append(succ, b.End)
+			if f.elseAt != -1 {
+				succ = append(succ, f.elseAt+1)
+			} else {
+				succ = append(succ, f.end)
+			}
+		} else if e.Opcode == opElse {
+			// End of the then branch
+			succ = append(succ, frames[last].end)
+		} else {
+			succ = append(succ, b.End)
+		}
+
+		for _, s := range succ {
+			cfg.addEdge(b.Index, blockAt[s])
+		}
+	}
+
+	return cfg, nil
+}
+
+func (cfg *CFG) addEdge(from int, to int) {
+	for _, s := range cfg.Blocks[from].Succ {
+		if s == to {
+			return
+		}
+	}
+	cfg.Blocks[from].Succ = append(cfg.Blocks[from].Succ, to)
+	cfg.Blocks[to].Pred = append(cfg.Blocks[to].Pred, from)
+}
+
+/**
+ * Work out the immediate dominator of each block. Unreachable blocks, and the entry, get -1.
+ * This is the simple iterative algorithm from Cooper, Harvey and Kennedy.
+ */
+func (cfg *CFG) Dominators() []int {
+	// Reverse postorder
+	order := make([]int, 0, len(cfg.Blocks))
+	visited := make([]bool, len(cfg.Blocks))
+	var visit func(b int)
+	visit = func(b int) {
+		visited[b] = true
+		for _, s := range cfg.Blocks[b].Succ {
+			if !visited[s] {
+				visit(s)
+			}
+		}
+		order = append(order, b)
+	}
+	visit(cfg.Entry)
+	rpo := make([]int, len(cfg.Blocks))
+	for i, b := range order {
+		rpo[b] = len(order) - 1 - i
+	}
+
+	idom := make([]int, len(cfg.Blocks))
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[cfg.Entry] = cfg.Entry
+
+	intersect := func(a int, b int) int {
+		for a != b {
+			for rpo[a] > rpo[b] {
+				a = idom[a]
+			}
+			for rpo[b] > rpo[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	changed := true
+	for changed {
+		changed = false
+		for i := len(order) - 1; i >= 0; i-- {
+			b := order[i]
+			if b == cfg.Entry {
+				continue
+			}
+			newIdom := -1
+			for _, p := range cfg.Blocks[b].Pred {
+				if idom[p] == -1 {
+					continue
+				}
+				if newIdom == -1 {
+					newIdom = p
+				} else {
+					newIdom = intersect(p, newIdom)
+				}
+			}
+			if newIdom != idom[b] {
+				idom[b] = newIdom
+				changed = true
+			}
+		}
+	}
+	idom[cfg.Entry] = -1
+	return idom
+}
+
+/**
+ * Find the loop headers, ie blocks which are the target of a back edge (from a block they dominate).
+ *
+ */
+func (cfg *CFG) LoopHeaders() []int {
+	idom := cfg.Dominators()
+	dominates := func(a int, b int) bool {
+		for b != -1 {
+			if a == b {
+				return true
+			}
+			b = idom[b]
+		}
+		return false
+	}
+	headers := make([]int, 0)
+	for _, b := range cfg.Blocks {
+		for _, p := range b.Pred {
+			if dominates(b.Index, p) {
+				headers = append(headers, b.Index)
+				break
+			}
+		}
+	}
+	return headers
+}
@@ -0,0 +1,68 @@
+package wasmfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildCFG(t *testing.T) {
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte(`(module
+  (func $f (param $a i32) (result i32)
+    block
+      loop
+        local.get $a
+        i32.eqz
+        br_if 1
+        local.get $a
+        i32.const 1
+        i32.sub
+        local.set $a
+        br 0
+      end
+    end
+    local.get $a
+    if (result i32)
+      i32.const 1
+    else
+      i32.const 2
+    end
+  )
+)`))
+	assert.NoError(t, err)
+
+	// Imports have no code
+	_, err = wf.BuildCFG(1)
+	assert.Error(t, err)
+
+	cfg, err := wf.BuildCFG(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cfg.FunctionIndex)
+
+	starts := make([]int, 0)
+	for _, b := range cfg.Blocks {
+		starts = append(starts, b.Start)
+	}
+	// entry, loop, after br_if, end(loop), end(block), then, else, end(if), exit
+	assert.Equal(t, []int{0, 1, 5, 10, 11, 14, 16, 17, 18}, starts)
+
+	// br_if 1 goes to the end of the block, or falls through
+	assert.Equal(t, []int{4, 2}, cfg.Blocks[1].Succ)
+	// br 0 goes back to the loop
+	assert.Equal(t, []int{1}, cfg.Blocks[2].Succ)
+	// if goes to then or else
+	assert.Equal(t, []int{5, 6}, cfg.Blocks[4].Succ)
+	// then skips over the else
+	assert.Equal(t, []int{7}, cfg.Blocks[5].Succ)
+	assert.Equal(t, []int{8}, cfg.Blocks[7].Succ)
+	assert.Equal(t, cfg.Exit, 8)
+
+	// The loop end is unreachable, since the loop only exits through br_if
+	assert.Equal(t, 0, len(cfg.Blocks[3].Pred))
+
+	idom := cfg.Dominators()
+	assert.Equal(t, []int{-1, 0, 1, -1, 1, 4, 4, 4, 7}, idom)
+
+	assert.Equal(t, []int{1}, cfg.LoopHeaders())
+}
@@ -0,0 +1,150 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+/**
+ * Clone returns a deep copy of the WasmFile.
+ * AddFuncsFrom and AddDataFrom take over the entries of the source module, so clone a template
+ * first if it is going to be used more than once.
+ */
+func (wf *WasmFile) Clone() *WasmFile {
+	nwf := &WasmFile{
+		Function: cloneEntries(wf.Function),
+		Type:     cloneEntries(wf.Type),
+		Custom:   cloneEntries(wf.Custom),
+		Export:   cloneEntries(wf.Export),
+		Import:   cloneEntries(wf.Import),
+		Table:    cloneEntries(wf.Table),
+		Global:   cloneEntries(wf.Global),
+		Memory:   cloneEntries(wf.Memory),
+		Code:     cloneEntries(wf.Code),
+		Data:     cloneEntries(wf.Data),
+		Elem:     cloneEntries(wf.Elem),
+	}
+	if wf.Debug != nil {
+		nwf.Debug = wf.Debug.Clone()
+	}
+	nwf.KeepLayout = wf.KeepLayout
+	if wf.Layout != nil {
+		// The original section data is never modified, so can be shared.
+		nwf.Layout = make([]*SectionLayout, len(wf.Layout))
+		for i, sl := range wf.Layout {
+			nsl := *sl
+			for ci, c := range wf.Custom {
+				if c == sl.Custom {
+					nsl.Custom = nwf.Custom[ci]
+				}
+			}
+			nwf.Layout[i] = &nsl
+		}
+	}
+	return nwf
+}
+
+func cloneEntries[T interface{ Clone() T }](entries []T) []T {
+	if entries == nil {
+		return nil
+	}
+	n := make([]T, len(entries))
+	for i, e := range entries {
+		n[i] = e.Clone()
+	}
+	return n
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	nb := make([]byte, len(b))
+	copy(nb, b)
+	return nb
+}
+
+func (f *FunctionEntry) Clone() *FunctionEntry {
+	nf := *f
+	return &nf
+}
+
+func (c *CustomEntry) Clone() *CustomEntry {
+	return &CustomEntry{
+		Name: c.Name,
+		Data: cloneBytes(c.Data),
+	}
+}
+
+func (e *ExportEntry) Clone() *ExportEntry {
+	ne := *e
+	return &ne
+}
+
+func (i *ImportEntry) Clone() *ImportEntry {
+	ni := *i
+	return &ni
+}
+
+func (t *TableEntry) Clone() *TableEntry {
+	nt := *t
+	return &nt
+}
+
+func (g *GlobalEntry) Clone() *GlobalEntry {
+	return &GlobalEntry{
+		Type:       g.Type,
+		Mut:        g.Mut,
+		Expression: expression.CloneExpressions(g.Expression),
+	}
+}
+
+func (m *MemoryEntry) Clone() *MemoryEntry {
+	nm := *m
+	return &nm
+}
+
+func (c *CodeEntry) Clone() *CodeEntry {
+	nc := *c
+	nc.Locals = append([]types.ValType{}, c.Locals...)
+	nc.Expression = expression.CloneExpressions(c.Expression)
+	if c.LocalNames != nil {
+		nc.LocalNames = make(map[string]int, len(c.LocalNames))
+		for n, i := range c.LocalNames {
+			nc.LocalNames[n] = i
+		}
+	}
+	return &nc
+}
+
+func (d *DataEntry) Clone() *DataEntry {
+	return &DataEntry{
+		MemIndex: d.MemIndex,
+		Offset:   expression.CloneExpressions(d.Offset),
+		Data:     cloneBytes(d.Data),
+	}
+}
+
+func (e *ElemEntry) Clone() *ElemEntry {
+	return &ElemEntry{
+		TableIndex: e.TableIndex,
+		Offset:     expression.CloneExpressions(e.Offset),
+		Indexes:    append([]uint64{}, e.Indexes...),
+	}
+}
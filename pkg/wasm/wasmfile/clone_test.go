@@ -0,0 +1,40 @@
+package wasmfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClone(t *testing.T) {
+	template := NewEmpty()
+	err := template.DecodeWat([]byte(testModuleWat))
+	assert.NoError(t, err)
+
+	var before bytes.Buffer
+	err = template.EncodeWat(&before)
+	assert.NoError(t, err)
+
+	// Use the template twice, in two different outputs
+	for i := 0; i < 2; i++ {
+		wf := NewEmpty()
+		mod := template.Clone()
+		err = wf.AddFuncsFrom(mod, func(m map[int]int) {})
+		assert.NoError(t, err)
+		_, err = wf.AddDataFrom(int32(4096*(i+1)), mod)
+		assert.NoError(t, err)
+	}
+
+	var after bytes.Buffer
+	err = template.EncodeWat(&after)
+	assert.NoError(t, err)
+	assert.Equal(t, before.String(), after.String())
+
+	// Expressions are copied, not shared
+	c := template.Clone()
+	c.Code[0].Expression[0].LocalIndex = 99
+	c.Debug.FunctionNames[0] = "$changed"
+	assert.Equal(t, 0, template.Code[0].Expression[0].LocalIndex)
+	assert.Equal(t, "$fd_write", template.Debug.FunctionNames[0])
+}
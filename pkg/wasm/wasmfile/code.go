@@ -17,7 +17,6 @@
 package wasmfile
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"strings"
@@ -32,14 +31,117 @@ import (
  * The imported function will be removed.
  * The target function must already exist, with a name.
  */
-func (wf *WasmFile) RedirectImport(fromModule string, from string, to string) {
+func (wf *WasmFile) RedirectImport(fromModule string, from string, to string) error {
 
 	fid := wf.Debug.LookupFunctionID(to)
 
 	if fid == -1 {
-		panic("Target function not found!")
+		return fmt.Errorf("Redirect import %s:%s target function %s not found", fromModule, from, to)
 	}
 
+	wf.redirectImportToFunction(fromModule, from, fid)
+	return nil
+}
+
+/**
+ * Redirect an import to a function (eg $my_fd_read) or to another import (module:name).
+ * The signatures must match, and the redirected import is removed. If the target import doesn't
+ * exist yet, the import is renamed to it instead.
+ */
+func (wf *WasmFile) RedirectImportTo(fromModule string, from string, to string) error {
+	fid := wf.LookupImport(fmt.Sprintf("%s:%s", fromModule, from))
+	if fid == -1 {
+		return fmt.Errorf("Import %s:%s not found", fromModule, from)
+	}
+
+	var tid int
+	if strings.HasPrefix(to, "$") {
+		tid = wf.Debug.LookupFunctionID(to)
+		if tid == -1 {
+			return fmt.Errorf("Redirect import %s:%s target function %s not found", fromModule, from, to)
+		}
+	} else {
+		toModule, toName, ok := strings.Cut(to, ":")
+		if !ok {
+			return fmt.Errorf("Redirect import %s:%s target %s should be $function or module:name", fromModule, from, to)
+		}
+		tid = wf.LookupImport(to)
+		if tid == -1 {
+			return wf.RenameImport(fromModule, from, toModule, toName)
+		}
+	}
+	if tid == fid {
+		return fmt.Errorf("Import %s:%s can't be redirected to itself", fromModule, from)
+	}
+
+	fromType, err := wf.functionType(fid)
+	if err != nil {
+		return err
+	}
+	toType, err := wf.functionType(tid)
+	if err != nil {
+		return err
+	}
+	if !fromType.Equals(toType) {
+		return fmt.Errorf("Redirect import %s:%s target %s has a different signature", fromModule, from, to)
+	}
+
+	wf.redirectImportToFunction(fromModule, from, tid)
+	return nil
+}
+
+/**
+ * Redirect the calls some code makes to imports, given as module:name, to functions (eg $my_fd_read).
+ * The same function may be imported more than once (Go does this), so every matching import is redirected.
+ * Unlike RedirectImport the imports are kept, so the functions they're redirected to can still call them.
+ * Returns the import ids which were redirected, and what to.
+ */
+func (wf *WasmFile) RedirectImportCalls(redirects map[string]string, code []*CodeEntry) (map[int]int, error) {
+	remap := make(map[int]int)
+	// Code added from wat may not have had its calls resolved yet
+	remapNames := make(map[string]string)
+	for fid, i := range wf.Import {
+		to, ok := redirects[fmt.Sprintf("%s:%s", i.Module, i.Name)]
+		if !ok {
+			continue
+		}
+		tid := wf.Debug.LookupFunctionID(to)
+		if tid == -1 {
+			return nil, fmt.Errorf("Redirect import %s:%s target function %s not found", i.Module, i.Name, to)
+		}
+		remap[fid] = tid
+		remapNames[wf.Debug.GetFunctionIdentifier(fid, false)] = to
+	}
+
+	if len(remap) > 0 {
+		for _, c := range code {
+			c.ModifyAllCalls(remap)
+			err := c.ModifyUnresolvedFunctions(remapNames)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return remap, nil
+}
+
+/**
+ * Remove any imported functions nothing calls, references or exports, and return how many went.
+ *
+ */
+func (wf *WasmFile) RemoveUnusedImports() int {
+	removed := 0
+	for fid := len(wf.Import) - 1; fid >= 0; fid-- {
+		// RemoveFunction refuses if the import is still used
+		if wf.RemoveFunction(fid) == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Redirect an import to a function index, removing the import
+func (wf *WasmFile) redirectImportToFunction(fromModule string, from string, fid int) {
 	remap := map[int]int{}
 	remap_imports := map[int]int{}
 
@@ -66,10 +168,15 @@ func (wf *WasmFile) RedirectImport(fromModule string, from string, to string) {
 	}
 
 	wf.Import = newImports
+	wf.MarkSectionDirty(types.SectionElem)
 
 	// We also need to fixup any Elems sections
 	for _, el := range wf.Elem {
 		for idx, funcidx := range el.Indexes {
+			target, ok := remap_imports[int(funcidx)]
+			if ok {
+				funcidx = uint64(target)
+			}
 			newidx, ok := remap[int(funcidx)]
 			if ok {
 				el.Indexes[idx] = uint64(newidx)
@@ -80,6 +187,10 @@ func (wf *WasmFile) RedirectImport(fromModule string, from string, to string) {
 	// Fixup exports
 	for _, ex := range wf.Export {
 		if ex.Type == types.ExportFunc {
+			target, ok := remap_imports[ex.Index]
+			if ok {
+				ex.Index = target
+			}
 			newidx, ok := remap[ex.Index]
 			if ok {
 				ex.Index = newidx
@@ -90,62 +201,267 @@ func (wf *WasmFile) RedirectImport(fromModule string, from string, to string) {
 	wf.Debug.RenumberFunctions(remap)
 }
 
-func (wf *WasmFile) AddExports(wfsource *WasmFile) {
+/**
+ * Add an export. The name must not already be exported, and what it exports must exist.
+ *
+ */
+func (wf *WasmFile) AddExport(name string, t types.ExportType, index int) error {
+	for _, e := range wf.Export {
+		if e.Name != name {
+			continue
+		}
+		if e.Type == t && e.Index == index {
+			return fmt.Errorf("Export %s already exists for the same item", name)
+		}
+		return fmt.Errorf("Export %s already exists", name)
+	}
+
+	count := 0
+	switch t {
+	case types.ExportFunc:
+		count = len(wf.Import) + len(wf.Code)
+	case types.ExportTable:
+		count = len(wf.Table)
+	case types.ExportMem:
+		count = len(wf.Memory)
+	case types.ExportGlobal:
+		count = len(wf.Global)
+	default:
+		return fmt.Errorf("Export %s: unknown export type %d", name, t)
+	}
+	if index < 0 || index >= count {
+		return fmt.Errorf("Export %s: index %d out of range", name, index)
+	}
+
+	wf.Export = append(wf.Export, &ExportEntry{
+		Name:  name,
+		Type:  t,
+		Index: index,
+	})
+	return nil
+}
+
+/**
+ * Change the limits of a memory, in pages. A max of 0 means no maximum, and shared memory needs a max.
+ * Data segments must still fit in the minimum size, otherwise nothing is changed.
+ */
+func (wf *WasmFile) SetMemoryLimits(idx int, min int, max int, shared bool) error {
+	if idx < 0 || idx >= len(wf.Memory) {
+		return fmt.Errorf("Memory %d not found", idx)
+	}
+	err := validateLimits(min, max)
+	if err != nil {
+		return fmt.Errorf("Memory %d: %w", idx, err)
+	}
+	if shared && max == 0 {
+		return fmt.Errorf("Memory %d: shared memory needs a max", idx)
+	}
+
+	m := wf.Memory[idx]
+	old := *m
+	m.LimitMin = min
+	m.LimitMax = max
+	m.Shared = shared
+	for didx, d := range wf.Data {
+		if d.MemIndex != idx {
+			continue
+		}
+		err = wf.validateData(d)
+		if err != nil {
+			*m = old
+			return fmt.Errorf("Data %d (%s): %w", didx, wf.dataName(didx), err)
+		}
+	}
+	wf.MarkSectionDirty(types.SectionMemory)
+	return nil
+}
+
+func (wf *WasmFile) AddExports(wfsource *WasmFile) error {
 	for _, e := range wfsource.Export {
 		// TODO: Support other types
 		if e.Type != types.ExportFunc {
-			panic("Cannot deal with non func export yet")
-		} else {
-			fname := wf.Debug.GetFunctionIdentifier(e.Index, true)
-			if fname == "" {
-				panic("Function not found")
-			} else {
-				nfid := wf.Debug.LookupFunctionID(fname)
-				if nfid == -1 {
-					panic("Function not found in output")
-				} else {
-					// Now put it in the new wf...
-					wf.Export = append(wf.Export, &ExportEntry{
-						Type:  e.Type,
-						Name:  e.Name,
-						Index: nfid,
-					})
-				}
-			}
+			return fmt.Errorf("Export %s: cannot deal with non func export yet", e.Name)
 		}
+		fname := wf.Debug.GetFunctionIdentifier(e.Index, true)
+		if fname == "" {
+			return fmt.Errorf("Export %s: function %d not found", e.Name, e.Index)
+		}
+		nfid := wf.Debug.LookupFunctionID(fname)
+		if nfid == -1 {
+			return fmt.Errorf("Export %s: function %s not found in output", e.Name, fname)
+		}
+		// Now put it in the new wf...
+		wf.Export = append(wf.Export, &ExportEntry{
+			Type:  e.Type,
+			Name:  e.Name,
+			Index: nfid,
+		})
 	}
+	return nil
 }
 
-func (wf *WasmFile) AddGlobal(name string, t types.ValType, expr string) {
-	ex := make([]*expression.Expression, 0)
+/**
+ * Add a global, with the init expression given as wat (eg "i32.const 0" or "global.get $other").
+ * The name is registered so that code can refer to it, and the new global index is returned.
+ */
+func (wf *WasmFile) AddGlobal(name string, t types.ValType, mutable bool, init string) (int, error) {
+	if name != "" && wf.Debug.LookupGlobalID(name) != -1 {
+		return -1, fmt.Errorf("Global %s already exists", name)
+	}
+
 	e := &expression.Expression{}
-	e.DecodeWat(expr, nil)
-	ex = append(ex, e)
+	err := e.DecodeWat(init, nil)
+	if err != nil {
+		return -1, fmt.Errorf("Global %s: %w", name, err)
+	}
+	if e.GlobalNeedsLinking {
+		e.GlobalIndex = wf.Debug.LookupGlobalID(e.GlobalId)
+		if e.GlobalIndex == -1 {
+			return -1, fmt.Errorf("Global %s: global %s not found", name, e.GlobalId)
+		}
+	}
+	ex := []*expression.Expression{e}
+	err = wf.validateConstExpression(ex, t)
+	if err != nil {
+		return -1, fmt.Errorf("Global %s: %w", name, err)
+	}
 
-	idx := len(wf.Global)
+	var mut byte
+	if mutable {
+		mut = 1
+	}
 
-	wf.Debug.GlobalNames[idx] = name
+	idx := len(wf.Global)
+	if name != "" {
+		wf.Debug.GlobalNames[idx] = name
+	}
 
 	wf.Global = append(wf.Global, &GlobalEntry{
 		Type:       t,
 		Expression: ex,
-		Mut:        1,
+		Mut:        mut,
 	})
+	return idx, nil
+}
+
+/**
+ * Add a single function given as wat, eg "(func $helper (param i32) (result i32) ...)".
+ * Calls, globals and data references are resolved against this module, and the new function
+ * index is returned. If name is empty, the identifier from the wat is used.
+ */
+func (wf *WasmFile) AddFunctionFromWat(name string, watBody string) (int, error) {
+	text := strings.Trim(watBody, encoding.Whitespace)
+	if !strings.HasPrefix(text, "(func") || text[len(text)-1] != ')' {
+		return -1, errors.New("Expected a single (func ...)")
+	}
+	el, rest := encoding.ReadElement(text)
+	if strings.Trim(rest, encoding.Whitespace) != "" {
+		return -1, errors.New("Expected a single (func ...)")
+	}
+
+	// Take the identifier off, since we register the name ourselves
+	body := strings.TrimLeft(el[5:], encoding.Whitespace)
+	if strings.HasPrefix(body, "$") {
+		var id string
+		id, body = encoding.ReadToken(body)
+		if name == "" {
+			name = id
+		}
+	}
+	if name == "" {
+		return -1, errors.New("Function needs a name")
+	}
+	if wf.Debug.LookupFunctionID(name) != -1 {
+		return -1, fmt.Errorf("Function %s already exists", name)
+	}
+	text = "(func " + body
+
+	fe := &FunctionEntry{}
+	err := fe.DecodeWat(text, wf)
+	if err != nil {
+		return -1, fmt.Errorf("Function %s: %w", name, err)
+	}
+	ce := &CodeEntry{}
+	err = ce.DecodeWat(text, wf)
+	if err != nil {
+		return -1, fmt.Errorf("Function %s: %w", name, err)
+	}
+
+	fid := len(wf.Import) + len(wf.Code)
+	wf.Function = append(wf.Function, fe)
+	wf.Code = append(wf.Code, ce)
+	wf.Debug.FunctionNames[fid] = name
+
+	err = ce.ResolveLengths(wf)
+	if err == nil {
+		err = ce.ResolveRelocations(wf, 0)
+	}
+	if err == nil {
+		err = ce.ResolveGlobals(wf)
+	}
+	if err == nil {
+		err = ce.ResolveFunctions(wf)
+	}
+	if err != nil {
+		// Take it back out again
+		wf.Function = wf.Function[:len(wf.Function)-1]
+		wf.Code = wf.Code[:len(wf.Code)-1]
+		delete(wf.Debug.FunctionNames, fid)
+		return -1, fmt.Errorf("Function %s: %w", name, err)
+	}
+	return fid, nil
 }
 
-func (wf *WasmFile) SetGlobal(name string, t types.ValType, expr string) {
+func (wf *WasmFile) SetGlobal(name string, t types.ValType, expr string) error {
 	ex := make([]*expression.Expression, 0)
 	e := &expression.Expression{}
-	e.DecodeWat(expr, nil)
+	err := e.DecodeWat(expr, nil)
+	if err != nil {
+		return fmt.Errorf("Global %s: %w", name, err)
+	}
 	ex = append(ex, e)
 
 	idx := wf.Debug.LookupGlobalID(name)
 	if idx == -1 {
-		panic("Global not found")
+		return fmt.Errorf("Global %s not found", name)
 	}
 
 	wf.Global[idx].Type = t
 	wf.Global[idx].Expression = ex
+	wf.MarkSectionDirty(types.SectionGlobal)
+	return nil
+}
+
+/**
+ * Change the initial value of a global, given as wat (eg "i32.const 42" or "global.get $other").
+ * The value must have the type of the global.
+ */
+func (wf *WasmFile) SetGlobalInit(idx int, init string) error {
+	if idx < 0 || idx >= len(wf.Global) {
+		return fmt.Errorf("Global %d not found", idx)
+	}
+
+	e := &expression.Expression{}
+	err := e.DecodeWat(init, nil)
+	if err != nil {
+		return fmt.Errorf("Global %d: %w", idx, err)
+	}
+	if e.GlobalNeedsLinking {
+		e.GlobalIndex = wf.Debug.LookupGlobalID(e.GlobalId)
+		if e.GlobalIndex == -1 {
+			return fmt.Errorf("Global %d: global %s not found", idx, e.GlobalId)
+		}
+		e.GlobalNeedsLinking = false
+	}
+	ex := []*expression.Expression{e}
+	err = wf.validateConstExpression(ex, wf.Global[idx].Type)
+	if err != nil {
+		return fmt.Errorf("Global %d: %w", idx, err)
+	}
+
+	wf.Global[idx].Expression = ex
+	wf.MarkSectionDirty(types.SectionGlobal)
+	return nil
 }
 
 /**
@@ -162,9 +478,26 @@ func (wf *WasmFile) AddTypeMaybe(te *TypeEntry) int {
 	return len(wf.Type) - 1
 }
 
+/**
+ * Give any blocks with params or multiple results a type, adding it if needed.
+ *
+ */
+func (wf *WasmFile) ResolveBlockTypes(exp []*expression.Expression) {
+	for _, e := range exp {
+		if e.BlockTypeNeedsLinking {
+			e.TypeIndex = wf.AddTypeMaybe(&TypeEntry{Param: e.BlockParams, Result: e.BlockResults})
+			e.TypedBlock = true
+			e.BlockTypeNeedsLinking = false
+			e.BlockParams = nil
+			e.BlockResults = nil
+		}
+	}
+}
+
 const ALIGN_DATA = 8
 
-func (wf *WasmFile) AddDataFrom(addr int32, wfSource *WasmFile) int32 {
+// Note that the data entries of wfSource are moved into wf, so Clone it first if it needs reusing.
+func (wf *WasmFile) AddDataFrom(addr int32, wfSource *WasmFile) (int32, error) {
 	ptr := addr
 	for idx, d := range wfSource.Data {
 		src_name := wfSource.Debug.GetDataIdentifier(idx)
@@ -182,16 +515,67 @@ func (wf *WasmFile) AddDataFrom(addr int32, wfSource *WasmFile) int32 {
 		ptr += int32(len(d.Data))
 		ptr = (ptr + ALIGN_DATA - 1) & -ALIGN_DATA
 
+		if src_name == "" {
+			continue
+		}
 		for _, n := range wf.Debug.DataNames {
 			if n == src_name {
-				panic(fmt.Sprintf("Data conflict for '%s'", src_name))
+				return ptr, fmt.Errorf("Data conflict for '%s'", src_name)
 			}
 		}
 
 		// Copy over the data name
 		wf.Debug.DataNames[newidx] = src_name
 	}
-	return ptr
+	return ptr, nil
+}
+
+/**
+ * Overwrite the initial contents of memory at an address. Bytes in existing data segments are
+ * changed in place. If any of them aren't in a data segment (eg zero initialized), a new segment
+ * is added for the whole range, which takes priority since segments are applied in order.
+ */
+func (wf *WasmFile) PatchData(addr uint64, data []byte) error {
+	if len(wf.Memory) == 0 {
+		return errors.New("The module has no memory")
+	}
+	end := addr + uint64(len(data))
+	if end > uint64(wf.Memory[0].LimitMin)*wasmPageSize {
+		return fmt.Errorf("Data at %d-%d is beyond memory size %d pages", addr, end, wf.Memory[0].LimitMin)
+	}
+
+	covered := make([]bool, len(data))
+	for _, d := range wf.Data {
+		if d.MemIndex != 0 || len(d.Offset) != 1 || d.Offset[0].Opcode != expression.InstrToOpcode["i32.const"] {
+			continue
+		}
+		start := uint64(uint32(d.Offset[0].I32Value))
+		for i := range data {
+			a := addr + uint64(i)
+			if a >= start && a < start+uint64(len(d.Data)) {
+				d.Data[a-start] = data[i]
+				covered[i] = true
+			}
+		}
+	}
+
+	for _, c := range covered {
+		if !c {
+			wf.Data = append(wf.Data, &DataEntry{
+				MemIndex: 0,
+				Offset: []*expression.Expression{
+					{
+						Opcode:   expression.InstrToOpcode["i32.const"],
+						I32Value: int32(uint32(addr)),
+					},
+				},
+				Data: append([]byte{}, data...),
+			})
+			break
+		}
+	}
+	wf.MarkSectionDirty(types.SectionData)
+	return nil
 }
 
 func (wf *WasmFile) AddData(name string, data []byte) {
@@ -200,7 +584,11 @@ func (wf *WasmFile) AddData(name string, data []byte) {
 		prev := wf.Data[len(wf.Data)-1]
 		ptr = prev.Offset[0].I32Value + int32(len(prev.Data))
 	}
+	wf.addDataAt(ptr, name, data)
+}
 
+// Add a data entry at an address, aligned up. Returns the end of it.
+func (wf *WasmFile) addDataAt(ptr int32, name string, data []byte) int32 {
 	// Align data items...
 	ptr = (ptr + ALIGN_DATA - 1) & -ALIGN_DATA
 
@@ -216,9 +604,11 @@ func (wf *WasmFile) AddData(name string, data []byte) {
 		Data: data,
 	})
 	wf.Debug.DataNames[idx] = name
+	return ptr + int32(len(data))
 }
 
-func (wf *WasmFile) AddFuncsFrom(wfSource *WasmFile, remap_callback func(remap map[int]int)) {
+// Note that the entries of wfSource are moved into wf and modified, so Clone it first if it needs reusing.
+func (wf *WasmFile) AddFuncsFrom(wfSource *WasmFile, remap_callback func(remap map[int]int)) error {
 	globalModification := make(map[int]int)
 	for idx, g := range wfSource.Global {
 		newidx := len(wf.Global)
@@ -234,7 +624,11 @@ func (wf *WasmFile) AddFuncsFrom(wfSource *WasmFile, remap_callback func(remap m
 
 	importFuncModifications := make(map[string]string) // old name -> new name
 
-	// Deal with any imports
+	// Deal with any imports. New imports go on the end of the imports, which moves every function
+	// after them, so they're all added first and then everything is renumbered in one go.
+	firstNew := len(wf.Import)
+	added := make([]int, 0)   // source import index of each new import
+	matched := make([]int, 0) // source imports which are already imported
 	for idx, i := range wfSource.Import {
 		// Check if it's already being imported as something else...
 		var newidx = -1
@@ -245,62 +639,71 @@ func (wf *WasmFile) AddFuncsFrom(wfSource *WasmFile, remap_callback func(remap m
 			}
 		}
 		if newidx != -1 {
-			// Add the name modification
-			fnFrom := wfSource.Debug.GetFunctionIdentifier(idx, false)
-			fnTo := wf.Debug.GetFunctionIdentifier(newidx, false)
-			importFuncModifications[fnFrom] = fnTo
 			callModification[idx] = newidx
+			matched = append(matched, idx)
 		} else {
 			// Need to add a new import then... (This means relocating every call as well)
 			callModification[idx] = len(wf.Import)
-			newidx := len(wf.Import)
 
 			// Might need to add a type if there isn't one already
 			t := wfSource.Type[i.Index]
 			i.Index = wf.AddTypeMaybe(t)
 
 			wf.Import = append(wf.Import, i)
+			added = append(added, idx)
+		}
+	}
 
-			rmap := make(map[int]int)
-			for i := 0; i < len(wf.Code)+len(wf.Import); i++ {
-				// Relocate everything at or above newidx
-				if i >= newidx {
-					rmap[i] = i + 1
-				} else {
-					rmap[i] = i
-				}
+	if len(added) > 0 {
+		shift := len(added)
+		rmap := make(map[int]int)
+		for i := 0; i < firstNew+len(wf.Code); i++ {
+			// Relocate everything at or above firstNew
+			if i >= firstNew {
+				rmap[i] = i + shift
+			} else {
+				rmap[i] = i
 			}
+		}
 
-			wf.Debug.RenumberFunctions(rmap)
+		wf.Debug.RenumberFunctions(rmap)
+		for n, idx := range added {
 			name := wfSource.Debug.GetFunctionIdentifier(idx, true)
 			if name != "" {
-				wf.Debug.FunctionNames[newidx] = name
+				wf.Debug.FunctionNames[firstNew+n] = name
 			}
+		}
 
-			// Modify any exports
-			for _, ex := range wf.Export {
-				if ex.Type == types.ExportFunc && ex.Index >= newidx {
-					ex.Index++
-				}
+		// Modify any exports
+		for _, ex := range wf.Export {
+			if ex.Type == types.ExportFunc && ex.Index >= firstNew {
+				ex.Index += shift
 			}
+		}
 
-			for _, ce := range wf.Code {
-				ce.ModifyAllCalls(rmap)
-			}
+		for _, ce := range wf.Code {
+			ce.ModifyAllCalls(rmap)
+		}
 
-			// We also need to fixup any Elems sections
-			for _, el := range wf.Elem {
-				for idx, funcidx := range el.Indexes {
-					newidx, ok := rmap[int(funcidx)]
-					if ok {
-						el.Indexes[idx] = uint64(newidx)
-					}
+		// We also need to fixup any Elems sections
+		for _, el := range wf.Elem {
+			for idx, funcidx := range el.Indexes {
+				newidx, ok := rmap[int(funcidx)]
+				if ok {
+					el.Indexes[idx] = uint64(newidx)
 				}
 			}
-
-			// Do some callbacks
-			remap_callback(rmap)
 		}
+
+		// Do some callbacks
+		remap_callback(rmap)
+	}
+
+	// Add the name modifications, now the new imports have their names
+	for _, idx := range matched {
+		fnFrom := wfSource.Debug.GetFunctionIdentifier(idx, false)
+		fnTo := wf.Debug.GetFunctionIdentifier(callModification[idx], false)
+		importFuncModifications[fnFrom] = fnTo
 	}
 
 	for idx, f := range wfSource.Function {
@@ -321,88 +724,156 @@ func (wf *WasmFile) AddFuncsFrom(wfSource *WasmFile, remap_callback func(remap m
 		callModification[len(wfSource.Import)+idx] = newidx
 	}
 
+	// Types used in the code need to be in wf too
+	typeModification := make(map[int]int)
+	for _, c := range wfSource.Code {
+		for _, e := range c.Expression {
+			_, done := typeModification[e.TypeIndex]
+			if e.HasTypeIndex() && !done && e.TypeIndex < len(wfSource.Type) {
+				typeModification[e.TypeIndex] = wf.AddTypeMaybe(wfSource.Type[e.TypeIndex])
+			}
+		}
+	}
+
 	// Now add the code
 	for _, c := range wfSource.Code {
 
 		c.ModifyAllCalls(callModification)
 		c.ModifyAllGlobals(globalModification)
+		c.ModifyAllTypes(typeModification)
 
-		c.ModifyUnresolvedFunctions(importFuncModifications)
+		err := c.ModifyUnresolvedFunctions(importFuncModifications)
+		if err != nil {
+			return err
+		}
 
 		wf.Code = append(wf.Code, c)
 	}
-
+	return nil
 }
 
 func (ce *CodeEntry) ModifyAllGlobals(m map[int]int) {
+	ce.dirty = true
 	expression.ModifyAllGlobalIndexes(ce.Expression, m)
 }
 
+func (ce *CodeEntry) ModifyAllTypes(m map[int]int) {
+	ce.dirty = true
+	expression.ModifyAllTypeIndexes(ce.Expression, m)
+}
+
 func (ce *CodeEntry) ModifyAllCalls(m map[int]int) {
+	ce.dirty = true
 	expression.ModifyAllFunctionIndexes(ce.Expression, m)
 }
 
-func (ce *CodeEntry) ModifyUnresolvedFunctions(m map[string]string) {
-	err := expression.ModifyUnresolvedFunctions(ce.Expression, m)
-	if err != nil {
-		panic(err)
-	}
+func (ce *CodeEntry) ModifyUnresolvedFunctions(m map[string]string) error {
+	ce.dirty = true
+	return expression.ModifyUnresolvedFunctions(ce.Expression, m)
 }
 
 func (ce *CodeEntry) InsertFuncStart(wf *WasmFile, to string) error {
-	var err error
-	ce.Expression, err = expression.AddExpressionStart(ce.Expression, to)
-	return err
+	ce.dirty = true
+	// Leave the code alone if the wat is bad
+	ex, err := expression.AddExpressionStart(ce.Expression, to, ce.LocalNames)
+	if err != nil {
+		return err
+	}
+	wf.ResolveBlockTypes(ex)
+	ce.Expression = ex
+	return nil
 }
 
 func (ce *CodeEntry) InsertFuncEnd(wf *WasmFile, to string) error {
-	var err error
-	ce.Expression, err = expression.AddExpressionEnd(ce.Expression, to)
-	return err
+	ce.dirty = true
+	ex, err := expression.AddExpressionEnd(ce.Expression, to, ce.LocalNames)
+	if err != nil {
+		return err
+	}
+	wf.ResolveBlockTypes(ex)
+	ce.Expression = ex
+	return nil
 }
 
 func (ce *CodeEntry) ResolveGlobals(wf *WasmFile) error {
+	ce.dirty = true
 	err := expression.ResolveGlobals(ce.Expression, wf.Debug)
 	return err
 }
 
 func (ce *CodeEntry) ResolveFunctions(wf *WasmFile) error {
+	ce.dirty = true
 	err := expression.ResolveFunctions(ce.Expression, wf.Debug)
 	return err
 }
 
+/**
+ * Replace every instruction matching from (a single instruction in wat, eg "memory.grow") with the wat in to.
+ * Instructions are matched on their opcode and immediates, so nothing is encoded to wat.
+ */
 func (ce *CodeEntry) ReplaceInstr(wf *WasmFile, from string, to string) error {
+	newex, err := expression.ExpressionFromWatWithLocals(to, ce.LocalNames)
+	if err != nil {
+		return err
+	}
+	wf.ResolveBlockTypes(newex)
 
-	newex, err := expression.ExpressionFromWat(to)
+	pattern, err := expression.ExpressionFromWat(from)
 	if err != nil {
 		return err
 	}
+	if len(pattern) != 1 {
+		return fmt.Errorf("Can only replace a single instruction, not %q", from)
+	}
+	p := pattern[0]
+	// A name that can't be found can't match anything
+	if expression.ResolveFunctions(pattern, wf.Debug) != nil || expression.ResolveGlobals(pattern, wf.Debug) != nil {
+		return nil
+	}
 
-	// Now we need to find where to replace this code...
-	adjustedExpression := make([]*expression.Expression, 0)
+	found := false
 	for _, e := range ce.Expression {
-		var buf bytes.Buffer
-		e.EncodeWat(&buf, "", wf.Debug)
-		cd := buf.String()
-		cend := strings.Index(cd, ";;")
-		if cend != -1 {
-			cd = cd[:cend]
+		if e.Matches(p) {
+			found = true
+			break
 		}
+	}
+	if !found {
+		return nil
+	}
 
-		if strings.Trim(cd, encoding.Whitespace) == from {
+	// Now we need to find where to replace this code...
+	ce.Walk(wf, func(ctx *expression.WalkContext, e *expression.Expression) expression.WalkAction {
+		if e.Matches(p) {
 			// Replace it!
-			for _, ne := range newex {
-				adjustedExpression = append(adjustedExpression, ne)
+			ctx.Replacement = newex
+			return expression.WalkReplace
+		}
+		return expression.WalkContinue
+	})
+	return nil
+}
+
+/**
+ * Walk the code, calling fn for each instruction. The code is updated with any changes fn makes.
+ *
+ */
+func (ce *CodeEntry) Walk(wf *WasmFile, fn func(ctx *expression.WalkContext, e *expression.Expression) expression.WalkAction) {
+	ce.dirty = true
+	fid := -1
+	if wf != nil {
+		for idx, c := range wf.Code {
+			if c == ce {
+				fid = len(wf.Import) + idx
+				break
 			}
-		} else {
-			adjustedExpression = append(adjustedExpression, e)
 		}
 	}
-	ce.Expression = adjustedExpression
-	return nil
+	ce.Expression = expression.Walk(ce.Expression, fid, fn)
 }
 
 func (ce *CodeEntry) ResolveLengths(wf *WasmFile) error {
+	ce.dirty = true
 	for _, e := range ce.Expression {
 		if e.DataLengthNeedsLinking {
 			did := wf.Debug.LookupDataId(e.I32DataId)
@@ -416,6 +887,7 @@ func (ce *CodeEntry) ResolveLengths(wf *WasmFile) error {
 }
 
 func (ce *CodeEntry) ResolveRelocations(wf *WasmFile, base_pointer int) error {
+	ce.dirty = true
 	for _, e := range ce.Expression {
 		if e.DataOffsetNeedsLinking {
 			did := wf.Debug.LookupDataId(e.I32DataId)
@@ -435,9 +907,14 @@ func (ce *CodeEntry) ResolveRelocations(wf *WasmFile, base_pointer int) error {
 }
 
 func (ce *CodeEntry) InsertAfterRelocating(wf *WasmFile, to string) error {
-	var err error
-	ce.Expression, err = expression.InsertAfterRelocating(ce.Expression, to)
-	return err
+	ce.dirty = true
+	ex, err := expression.InsertAfterRelocating(ce.Expression, to, ce.LocalNames)
+	if err != nil {
+		return err
+	}
+	wf.ResolveBlockTypes(ex)
+	ce.Expression = ex
+	return nil
 }
 
 func (te *TypeEntry) Equals(te2 *TypeEntry) bool {
@@ -0,0 +1,369 @@
+package wasmfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddGlobal(t *testing.T) {
+	wf := newTestModule(t)
+
+	idx, err := wf.AddGlobal("$limit", types.ValI64, false, "i64.const 100")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, idx)
+	assert.Equal(t, byte(0), wf.Global[idx].Mut)
+	assert.Equal(t, idx, wf.Debug.LookupGlobalID("$limit"))
+
+	idx, err = wf.AddGlobal("$copy", types.ValI64, true, "global.get $limit")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, idx)
+	assert.Equal(t, 1, wf.Global[idx].Expression[0].GlobalIndex)
+
+	// Duplicate names, bad types and unknown globals are rejected
+	_, err = wf.AddGlobal("$limit", types.ValI64, false, "i64.const 1")
+	assert.Error(t, err)
+	_, err = wf.AddGlobal("$bad", types.ValI64, false, "i32.const 1")
+	assert.Error(t, err)
+	_, err = wf.AddGlobal("$bad", types.ValI32, false, "global.get $counter")
+	assert.Error(t, err)
+	_, err = wf.AddGlobal("$bad", types.ValI32, false, "global.get $missing")
+	assert.Error(t, err)
+	assert.Equal(t, 3, len(wf.Global))
+
+	assert.NoError(t, wf.Validate())
+}
+
+func TestAddFunctionFromWat(t *testing.T) {
+	wf := newTestModule(t)
+
+	fid, err := wf.AddFunctionFromWat("", `(func $bump (param $by i32) (result i32)
+    global.get $counter
+    local.get $by
+    call $add
+    global.set $counter
+    i32.const offset($message)
+  )`)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fid)
+	assert.Equal(t, fid, wf.Debug.LookupFunctionID("$bump"))
+	assert.Equal(t, 1, wf.Code[fid-1].Expression[2].FuncIndex)
+
+	// The name argument takes priority over the identifier
+	fid, err = wf.AddFunctionFromWat("$bump2", `(func $ignored
+    i32.const 1
+    call $bump
+    drop
+  )`)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, fid)
+	assert.Equal(t, -1, wf.Debug.LookupFunctionID("$ignored"))
+	assert.NoError(t, wf.Validate())
+
+	// Duplicates, unknown targets and anything other than one func are errors
+	_, err = wf.AddFunctionFromWat("$bump", `(func nop)`)
+	assert.Error(t, err)
+	_, err = wf.AddFunctionFromWat("$new", "(func\n call $missing\n)")
+	assert.Error(t, err)
+	assert.Equal(t, -1, wf.Debug.LookupFunctionID("$new"))
+	_, err = wf.AddFunctionFromWat("$new", `(global i32)`)
+	assert.Error(t, err)
+	assert.Equal(t, 4, len(wf.Code))
+}
+
+const redirectModuleWat = `(module
+  (type (func (param i32) (result i32)))
+  (import "env" "first" (func $first (type 0)))
+  (import "env" "second" (func $second (type 0)))
+  (import "env" "unused" (func $unused (type 0)))
+  (func $both (type 0)
+    local.get 0
+    call 0
+    call 1
+  )
+  (export "both" (func 3))
+)
+`
+
+func TestRedirectImportTo(t *testing.T) {
+	wf := newTestModule(t)
+
+	assert.Error(t, wf.RedirectImportTo("missing", "fd_write", "$add"))
+	assert.Error(t, wf.RedirectImportTo("wasi_snapshot_preview1", "fd_write", "$missing"))
+	assert.Error(t, wf.RedirectImportTo("wasi_snapshot_preview1", "fd_write", "nonsense"))
+	// Different signature
+	assert.Error(t, wf.RedirectImportTo("wasi_snapshot_preview1", "fd_write", "$add"))
+
+	_, err := wf.AddFunctionFromWat("$my_fd_write", `(func (param i32 i32 i32 i32) (result i32)
+		i32.const 0
+	)`)
+	assert.NoError(t, err)
+	assert.NoError(t, wf.RedirectImportTo("wasi_snapshot_preview1", "fd_write", "$my_fd_write"))
+	assert.Equal(t, 0, len(wf.Import))
+	assert.Equal(t, 2, wf.Debug.LookupFunctionID("$my_fd_write"))
+	assert.NoError(t, wf.Validate())
+
+	// Module to module
+	wf = NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(redirectModuleWat)))
+	assert.Error(t, wf.RedirectImportTo("env", "first", "env:first"))
+	assert.NoError(t, wf.RedirectImportTo("env", "first", "host:first"))
+	assert.Equal(t, 0, wf.LookupImport("host:first"))
+	assert.NoError(t, wf.RedirectImportTo("env", "second", "host:first"))
+	assert.Equal(t, 2, len(wf.Import))
+	assert.Equal(t, 0, wf.Code[0].Expression[1].FuncIndex)
+	assert.Equal(t, 0, wf.Code[0].Expression[2].FuncIndex)
+	assert.Equal(t, 2, wf.Export[0].Index)
+	assert.NoError(t, wf.Validate())
+}
+
+func TestRedirectImportCalls(t *testing.T) {
+	wf := NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(`(module
+  (type (func (param i32) (result i32)))
+  (import "env" "first" (func $first (type 0)))
+  (import "env" "first" (func $first_again (type 0)))
+  (func $both (type 0)
+    local.get 0
+    call 0
+    call 1
+  )
+  (func $wrap (type 0)
+    local.get 0
+    call 1
+  )
+  (func $named (type 0)
+    local.get 0
+    call $first
+  )
+)
+`)))
+
+	_, err := wf.RedirectImportCalls(map[string]string{"env:first": "$missing"}, wf.Code)
+	assert.Error(t, err)
+
+	// Both imports go, but only in the code given, so $wrap still calls the import
+	redirected, err := wf.RedirectImportCalls(map[string]string{"env:first": "$wrap", "env:other": "$both"}, wf.Code[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 3, 1: 3}, redirected)
+	assert.Equal(t, 3, wf.Code[0].Expression[1].FuncIndex)
+	assert.Equal(t, 3, wf.Code[0].Expression[2].FuncIndex)
+	assert.Equal(t, 1, wf.Code[1].Expression[1].FuncIndex)
+	assert.Equal(t, 2, len(wf.Import))
+
+	// Calls which haven't been resolved yet are redirected by name
+	_, err = wf.RedirectImportCalls(map[string]string{"env:first": "$wrap"}, wf.Code[2:])
+	assert.NoError(t, err)
+	assert.NoError(t, wf.Code[2].ResolveFunctions(wf))
+	assert.Equal(t, 3, wf.Code[2].Expression[1].FuncIndex)
+}
+
+func TestRemoveUnusedImports(t *testing.T) {
+	wf := NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(redirectModuleWat)))
+
+	assert.Equal(t, 1, wf.RemoveUnusedImports())
+	assert.Equal(t, -1, wf.LookupImport("env:unused"))
+	assert.Equal(t, 2, wf.Export[0].Index)
+	assert.Equal(t, 0, wf.RemoveUnusedImports())
+	assert.NoError(t, wf.Validate())
+}
+
+func TestAddExport(t *testing.T) {
+	wf := newTestModule(t)
+	add := wf.Debug.LookupFunctionID("$add")
+
+	assert.NoError(t, wf.AddExport("add", types.ExportFunc, add))
+	assert.Equal(t, add, wf.Export[len(wf.Export)-1].Index)
+
+	// Names can't be exported twice
+	assert.Error(t, wf.AddExport("add", types.ExportFunc, add))
+	assert.Error(t, wf.AddExport("hello", types.ExportFunc, add))
+
+	assert.Error(t, wf.AddExport("missing", types.ExportFunc, 10))
+	assert.Error(t, wf.AddExport("table", types.ExportTable, 0))
+	assert.NoError(t, wf.AddExport("counter", types.ExportGlobal, 0))
+	assert.NoError(t, wf.Validate())
+}
+
+func TestSetMemoryLimits(t *testing.T) {
+	wf := newTestModule(t)
+
+	assert.NoError(t, wf.SetMemoryLimits(0, 2, 10, false))
+	assert.Equal(t, 2, wf.Memory[0].LimitMin)
+	assert.Equal(t, 10, wf.Memory[0].LimitMax)
+
+	assert.Error(t, wf.SetMemoryLimits(1, 1, 0, false))
+	assert.Error(t, wf.SetMemoryLimits(0, 3, 2, false))
+	assert.Error(t, wf.SetMemoryLimits(0, 1, 0, true))
+	assert.Equal(t, 2, wf.Memory[0].LimitMin)
+
+	// The data has to fit, and nothing changes if it doesn't
+	assert.Error(t, wf.SetMemoryLimits(0, 0, 0, false))
+	assert.Equal(t, 2, wf.Memory[0].LimitMin)
+	assert.Equal(t, 10, wf.Memory[0].LimitMax)
+
+	// Shared memory survives a round trip
+	assert.NoError(t, wf.SetMemoryLimits(0, 1, 4, true))
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	assert.Equal(t, &MemoryEntry{LimitMin: 1, LimitMax: 4, Shared: true}, wf2.Memory[0])
+
+	buf.Reset()
+	assert.NoError(t, wf.EncodeWat(&buf))
+	assert.Contains(t, buf.String(), "(memory 1 4 shared)")
+}
+
+func TestSetGlobalInit(t *testing.T) {
+	wf := newTestModule(t)
+	counter := wf.Debug.LookupGlobalID("$counter")
+
+	assert.NoError(t, wf.SetGlobalInit(counter, "i32.const 42"))
+	assert.Equal(t, int32(42), wf.Global[counter].Expression[0].I32Value)
+
+	assert.Error(t, wf.SetGlobalInit(counter, "i64.const 42"))
+	assert.Error(t, wf.SetGlobalInit(counter, "global.get $missing"))
+	// Mutable globals can't be used as values
+	assert.Error(t, wf.SetGlobalInit(counter, "global.get $counter"))
+	assert.Error(t, wf.SetGlobalInit(10, "i32.const 1"))
+	assert.Equal(t, int32(42), wf.Global[counter].Expression[0].I32Value)
+}
+
+func TestPatchData(t *testing.T) {
+	wf := newTestModule(t)
+	start := uint64(wf.Data[0].Offset[0].I32Value)
+
+	assert.NoError(t, wf.PatchData(start+6, []byte("there")))
+	assert.Equal(t, "Hello there", string(wf.Data[0].Data))
+	assert.Equal(t, 1, len(wf.Data))
+
+	// Past the end of the segment
+	assert.NoError(t, wf.PatchData(start+6, []byte("there!")))
+	assert.Equal(t, "Hello there", string(wf.Data[0].Data))
+	assert.Equal(t, 2, len(wf.Data))
+	assert.Equal(t, "there!", string(wf.Data[1].Data))
+
+	assert.Error(t, wf.PatchData(65535, []byte("xx")))
+	assert.NoError(t, wf.Validate())
+}
+
+func TestReplaceInstr(t *testing.T) {
+	wf := newTestModule(t)
+	hello := wf.Code[1]
+	count := func(wat string) int {
+		p, err := expression.ExpressionFromWat(wat)
+		assert.NoError(t, err)
+		assert.NoError(t, expression.ResolveFunctions(p, wf.Debug))
+		n := 0
+		for _, e := range hello.Expression {
+			if e.Matches(p[0]) {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Equal(t, 3, count("i32.const 1"))
+
+	// Only the immediates the instruction has are compared
+	assert.NoError(t, hello.ReplaceInstr(wf, "i32.const 1", "i32.const 2"))
+	assert.Equal(t, 0, count("i32.const 1"))
+	assert.Equal(t, 3, count("i32.const 2"))
+	// The data offset is a 0 too
+	assert.Equal(t, 2, count("i32.const 0"))
+
+	// Names are resolved
+	assert.NoError(t, hello.ReplaceInstr(wf, "call $fd_write", "drop\ndrop\ndrop\ndrop\ni32.const 0"))
+	assert.Equal(t, 0, count("call $fd_write"))
+	assert.Equal(t, 1, count("call $add"))
+
+	// Nothing to replace
+	l := len(hello.Expression)
+	assert.NoError(t, hello.ReplaceInstr(wf, "call $missing", "nop"))
+	assert.NoError(t, hello.ReplaceInstr(wf, "memory.grow", "nop"))
+	assert.Equal(t, l, len(hello.Expression))
+
+	assert.Error(t, hello.ReplaceInstr(wf, "nop\nnop", "nop"))
+	assert.Error(t, hello.ReplaceInstr(wf, "nop", "not.an.instr"))
+	assert.NoError(t, wf.Validate())
+}
+
+func TestAddFuncsFromImports(t *testing.T) {
+	wf := newTestModule(t)
+	mod := NewEmpty()
+	assert.NoError(t, mod.DecodeWat([]byte(`(module
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (type (func))
+  (import "wasi_snapshot_preview1" "fd_write" (func $write (type 0)))
+  (import "env" "a" (func $a (type 1)))
+  (import "env" "b" (func $b (type 1)))
+  (func $both (type 1)
+    call 1
+    call 2
+  )
+)`)))
+
+	calls := 0
+	var remap map[int]int
+	assert.NoError(t, wf.AddFuncsFrom(mod, func(m map[int]int) {
+		calls++
+		remap = m
+	}))
+
+	// Both new imports are handled in one renumbering pass
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, map[int]int{0: 0, 1: 3, 2: 4}, remap)
+	assert.Equal(t, 3, len(wf.Import))
+	assert.Equal(t, []string{"$fd_write", "$a", "$b", "$add", "$hello", "$both"}, []string{
+		wf.Debug.FunctionNames[0], wf.Debug.FunctionNames[1], wf.Debug.FunctionNames[2],
+		wf.Debug.FunctionNames[3], wf.Debug.FunctionNames[4], wf.Debug.FunctionNames[5],
+	})
+	assert.Equal(t, 4, wf.Export[0].Index)
+	assert.Equal(t, 3, wf.Code[1].Expression[len(wf.Code[1].Expression)-2].FuncIndex)
+	assert.Equal(t, 1, wf.Code[2].Expression[0].FuncIndex)
+	assert.Equal(t, 2, wf.Code[2].Expression[1].FuncIndex)
+	assert.NoError(t, wf.Validate())
+}
+
+func TestNamedLocalsAndLabels(t *testing.T) {
+	wf := newTestModule(t)
+
+	fid, err := wf.AddFunctionFromWat("", `(func $count (param $n i32) (result i32)
+    (local $i i32)
+    block $done
+      loop $again
+        local.get $i
+        local.get $n
+        i32.ge_u
+        br_if $done
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $again
+      end
+    end
+    local.get $i
+  )`)
+	assert.NoError(t, err)
+	c := wf.Code[fid-len(wf.Import)]
+	assert.NoError(t, wf.Validate())
+	assert.Equal(t, 1, c.Expression[5].LabelIndex)
+	assert.Equal(t, 0, c.Expression[10].LabelIndex)
+
+	// Snippets can use the names of the function's locals
+	assert.NoError(t, c.InsertFuncStart(wf, "i32.const 3\nlocal.set $i"))
+	assert.Equal(t, 1, c.Expression[1].LocalIndex)
+	assert.Error(t, c.InsertFuncEnd(wf, "local.get $missing\ndrop"))
+	assert.NoError(t, wf.Validate())
+
+	// A clone has its own names
+	c2 := c.Clone()
+	c2.LocalNames["$j"] = 1
+	_, ok := c.LocalNames["$j"]
+	assert.False(t, ok)
+}
@@ -17,10 +17,13 @@
 package wasmfile
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
@@ -30,21 +33,25 @@ import (
 
 // Create a new WasmFile from a file
 func New(filename string) (*WasmFile, error) {
-	data, err := os.ReadFile(filename)
+	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
+	return NewFromReader(f)
+}
+
+// Create a new WasmFile from a reader
+// Sections are decoded one at a time, so the whole module is never held in memory twice.
+func NewFromReader(r io.Reader) (*WasmFile, error) {
 	wf := &WasmFile{}
-	err = wf.DecodeBinary(data)
+	err := wf.DecodeBinaryReader(r)
 	if err != nil {
 		return wf, err
 	}
 	wf.Debug = &debug.WasmDebug{}
-	nameData := wf.GetCustomSectionData("name")
-	if nameData != nil {
-		wf.Debug.ParseNameSectionData(nameData)
-	}
+	wf.Debug.ParseNameSectionData(wf.GetCustomSectionData("name"))
 	return wf, err
 }
 
@@ -52,94 +59,175 @@ func New(filename string) (*WasmFile, error) {
  * Decode a wasm binary into a WasmFile
  *
  */
-func (wf *WasmFile) DecodeBinary(data []byte) (err error) {
-	/*
-		defer func() {
-			r := recover()
-			if r != nil {
-				switch x := r.(type) {
-				case string:
-					err = errors.New(x)
-				case error:
-					err = x
-				default:
-					err = errors.New("unknown panic")
-				}
-			}
-		}()
-	*/
-	hd := binary.LittleEndian.Uint32(data)
-	vr := binary.LittleEndian.Uint32(data[4:])
+func (wf *WasmFile) DecodeBinary(data []byte) error {
+	return wf.DecodeBinaryReader(bytes.NewReader(data))
+}
 
-	if hd != WasmHeader || vr != WasmVersion {
-		return fmt.Errorf("Invalid header/version %x/%x", hd, vr)
+/**
+ * Decode a wasm binary from a reader into a WasmFile
+ * Only a single section is buffered at any one time.
+ */
+func (wf *WasmFile) DecodeBinaryReader(r io.Reader) error {
+	// We need to read single bytes for the section headers
+	rr, ok := r.(byteReader)
+	if !ok {
+		rr = bufio.NewReader(r)
 	}
 
-	data = data[8:]
+	header := make([]byte, 8)
+	_, err := io.ReadFull(rr, header)
+	if err != nil {
+		return fmt.Errorf("Error reading header: %w", err)
+	}
 
-	rr := bytes.NewReader(data)
+	hd := binary.LittleEndian.Uint32(header)
+	vr := binary.LittleEndian.Uint32(header[4:])
 
+	if hd != WasmHeader || vr != WasmVersion {
+		return fmt.Errorf("Invalid header/version %x/%x", hd, vr)
+	}
+
+	offset := len(header)
 	for {
 		sectionType, err := rr.ReadByte()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
-		}
-		sectionLength, err := binary.ReadUvarint(rr)
-		if err == io.EOF {
-			break
+			return fmt.Errorf("Error reading section header at offset %d: %w", offset, err)
 		}
+		sectionLength, lengthBytes, err := readUvarintBytes(rr)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error reading section %d length at offset %d: %w", sectionType, offset, err)
 		}
 
-		sectionData := make([]byte, sectionLength)
-
-		_, err = rr.Read(sectionData)
-		if err == io.EOF {
-			break
+		sectionData, err := readSectionData(rr, sectionLength)
+		if err != nil {
+			return fmt.Errorf("Error reading section %d (%d bytes) at offset %d: %w", sectionType, sectionLength, offset, err)
 		}
 
-		// Process each section
-
-		if sectionType == byte(types.SectionCustom) {
-			err = wf.ParseSectionCustom(sectionData)
-		} else if sectionType == byte(types.SectionType) {
-			err = wf.ParseSectionType(sectionData)
-		} else if sectionType == byte(types.SectionImport) {
-			err = wf.ParseSectionImport(sectionData)
-		} else if sectionType == byte(types.SectionFunction) {
-			err = wf.ParseSectionFunction(sectionData)
-		} else if sectionType == byte(types.SectionTable) {
-			err = wf.ParseSectionTable(sectionData)
-		} else if sectionType == byte(types.SectionMemory) {
-			err = wf.ParseSectionMemory(sectionData)
-		} else if sectionType == byte(types.SectionGlobal) {
-			err = wf.ParseSectionGlobal(sectionData)
-		} else if sectionType == byte(types.SectionExport) {
-			err = wf.ParseSectionExport(sectionData)
-		} else if sectionType == byte(types.SectionStart) {
-			err = wf.ParseSectionStart(sectionData)
-		} else if sectionType == byte(types.SectionElem) {
-			err = wf.ParseSectionElem(sectionData)
-		} else if sectionType == byte(types.SectionCode) {
-			err = wf.ParseSectionCode(sectionData)
-		} else if sectionType == byte(types.SectionData) {
-			err = wf.ParseSectionData(sectionData)
-		} else if sectionType == byte(types.SectionDataCount) {
-			err = wf.ParseSectionDataCount(sectionData)
-		} else {
-			return fmt.Errorf("Unknown section %d", sectionType)
+		sectionOffset := offset
+		// Skip over the section id and length
+		offset += 1 + len(lengthBytes)
+
+		customs := len(wf.Custom)
+		err = wf.DecodeSection(sectionType, sectionData)
+		if wf.KeepLayout && (err == nil || errors.Is(err, errUnknownSection)) {
+			sl := &SectionLayout{
+				Id:     types.SectionId(sectionType),
+				Offset: sectionOffset,
+				Header: append([]byte{sectionType}, lengthBytes...),
+				Data:   sectionData,
+			}
+			if len(wf.Custom) > customs {
+				sl.Custom = wf.Custom[customs]
+			}
+			wf.Layout = append(wf.Layout, sl)
+			err = nil
 		}
 		if err != nil {
-			return err
+			return fmt.Errorf("Error decoding section %d at offset %d: %w", sectionType, offset, err)
 		}
+		offset += int(sectionLength)
+	}
+
+	// Each function has a body in the code section
+	if len(wf.Function) != len(wf.Code) {
+		return fmt.Errorf("The function section has %d entries, but the code section has %d", len(wf.Function), len(wf.Code))
 	}
 	return nil
 }
 
+/**
+ * Read the data of a section. The length comes from the module, so a big section is read in
+ * pieces rather than trusting it to allocate the whole thing up front.
+ */
+func readSectionData(r io.Reader, length uint64) ([]byte, error) {
+	if length > math.MaxUint32 {
+		return nil, fmt.Errorf("Section length %d is too big", length)
+	}
+	if length <= sectionPreallocate {
+		data := make([]byte, length)
+		_, err := io.ReadFull(r, data)
+		return data, err
+	}
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, r, int64(length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// Sections up to this size are allocated up front
+const sectionPreallocate = 1 << 20
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Read a uvarint, and also return the bytes it was encoded as (which may be padded)
+func readUvarintBytes(r io.ByteReader) (uint64, []byte, error) {
+	data := make([]byte, 0, binary.MaxVarintLen64)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(data) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, data, err
+		}
+		data = append(data, b)
+		if b&0x80 == 0 {
+			break
+		}
+		if len(data) == binary.MaxVarintLen64 {
+			return 0, data, errors.New("uvarint overflows a 64-bit integer")
+		}
+	}
+	v, l := binary.Uvarint(data)
+	if l <= 0 {
+		return 0, data, errors.New("uvarint overflows a 64-bit integer")
+	}
+	return v, data, nil
+}
+
+/**
+ * Decode a single section
+ *
+ */
+func (wf *WasmFile) DecodeSection(sectionType byte, sectionData []byte) error {
+	if sectionType == byte(types.SectionCustom) {
+		return wf.ParseSectionCustom(sectionData)
+	} else if sectionType == byte(types.SectionType) {
+		return wf.ParseSectionType(sectionData)
+	} else if sectionType == byte(types.SectionImport) {
+		return wf.ParseSectionImport(sectionData)
+	} else if sectionType == byte(types.SectionFunction) {
+		return wf.ParseSectionFunction(sectionData)
+	} else if sectionType == byte(types.SectionTable) {
+		return wf.ParseSectionTable(sectionData)
+	} else if sectionType == byte(types.SectionMemory) {
+		return wf.ParseSectionMemory(sectionData)
+	} else if sectionType == byte(types.SectionGlobal) {
+		return wf.ParseSectionGlobal(sectionData)
+	} else if sectionType == byte(types.SectionExport) {
+		return wf.ParseSectionExport(sectionData)
+	} else if sectionType == byte(types.SectionStart) {
+		return wf.ParseSectionStart(sectionData)
+	} else if sectionType == byte(types.SectionElem) {
+		return wf.ParseSectionElem(sectionData)
+	} else if sectionType == byte(types.SectionCode) {
+		return wf.ParseSectionCode(sectionData)
+	} else if sectionType == byte(types.SectionData) {
+		return wf.ParseSectionData(sectionData)
+	} else if sectionType == byte(types.SectionDataCount) {
+		return wf.ParseSectionDataCount(sectionData)
+	}
+	return fmt.Errorf("%w %d", errUnknownSection, sectionType)
+}
+
 /**
  * Parse a DataCount section
  *
@@ -161,22 +249,48 @@ func getDataContext(data []byte) []byte {
 	return data[:l]
 }
 
+// Read a uvarint from ptr in some section data, returning its length in bytes
+func readUvarintAt(data []byte, ptr int, what string) (uint64, int, error) {
+	if ptr > len(data) {
+		return 0, 0, fmt.Errorf("Error decoding %s not enough data", what)
+	}
+	v, l := binary.Uvarint(data[ptr:])
+	if l <= 0 {
+		return 0, 0, fmt.Errorf("Error decoding %s %x", what, getDataContext(data[ptr:]))
+	}
+	return v, l, nil
+}
+
+// Read a byte from ptr in some section data
+func readByteAt(data []byte, ptr int, what string) (byte, error) {
+	if ptr >= len(data) {
+		return 0, fmt.Errorf("Error decoding %s not enough data", what)
+	}
+	return data[ptr], nil
+}
+
+// Read length bytes from ptr in some section data
+func readBytesAt(data []byte, ptr int, length uint64, what string) ([]byte, error) {
+	if ptr > len(data) || length > uint64(len(data)-ptr) {
+		return nil, fmt.Errorf("Error decoding %s not enough data %d > %d", what, uint64(ptr)+length, len(data))
+	}
+	return data[ptr : ptr+int(length)], nil
+}
+
 /**
  * Parse a Data section
  *
  */
 func (wf *WasmFile) ParseSectionData(data []byte) error {
-	ptr := 0
-	dataVecLength, l := binary.Uvarint(data)
-	if l <= 0 {
-		return fmt.Errorf("Error decoding SectionData dataVecLength %x", getDataContext(data))
+	dataVecLength, ptr, err := readUvarintAt(data, 0, "SectionData dataVecLength")
+	if err != nil {
+		return err
 	}
-	ptr += l
 
 	for i := 0; i < int(dataVecLength); i++ {
-		memindex, l := binary.Uvarint(data[ptr:])
-		if l <= 0 {
-			return fmt.Errorf("Error decoding SectionData memindex %x", getDataContext(data))
+		memindex, l, err := readUvarintAt(data, ptr, "SectionData memindex")
+		if err != nil {
+			return err
 		}
 		ptr += l
 		offset, l, err := expression.NewExpression(data[ptr:], 0)
@@ -184,15 +298,19 @@ func (wf *WasmFile) ParseSectionData(data []byte) error {
 			return err
 		}
 		ptr += l
-		bytesLength, l := binary.Uvarint(data[ptr:])
-		if l <= 0 {
-			return fmt.Errorf("Error decoding SectionData bytesLength %x", getDataContext(data))
+		bytesLength, l, err := readUvarintAt(data, ptr, "SectionData bytesLength")
+		if err != nil {
+			return err
 		}
 		ptr += l
-		if ptr+int(bytesLength) > len(data) {
-			return fmt.Errorf("Error decoding SectionData not enough data %d > %d", ptr+int(bytesLength), len(data))
+		dataBytes, err := readBytesAt(data, ptr, bytesLength, "SectionData")
+		if err != nil {
+			return err
+		}
+		if wf.KeepLayout {
+			// Don't share with the section, which must stay as it was originally
+			dataBytes = cloneBytes(dataBytes)
 		}
-		dataBytes := data[ptr : ptr+int(bytesLength)]
 		ptr += int(bytesLength)
 
 		d := &DataEntry{
@@ -211,64 +329,99 @@ func (wf *WasmFile) ParseSectionData(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionCode(data []byte) error {
-	ptr := 0
-	codeVecLength, l := binary.Uvarint(data)
-	if l <= 0 {
-		return fmt.Errorf("Error decoding SectionCode codeVecLength %x", getDataContext(data))
+	codeVecLength, ptr, err := readUvarintAt(data, 0, "SectionCode codeVecLength")
+	if err != nil {
+		return err
 	}
-	ptr += l
 
+	// Find where each body is first, then decode the bodies in parallel since they're independent
+	ptrs := make([]int, 0)
+	lens := make([]uint64, 0)
 	for i := 0; i < int(codeVecLength); i++ {
-		clen, l := binary.Uvarint(data[ptr:])
-		if l <= 0 {
-			return fmt.Errorf("Error decoding SectionCode clen %x", getDataContext(data))
+		clen, l, err := readUvarintAt(data, ptr, "SectionCode clen")
+		if err != nil {
+			return err
 		}
 		ptr += l
-		if ptr+int(clen) > len(data) {
-			return fmt.Errorf("Error decoding SectionCode not enough data %d > %d", ptr+int(clen), len(data))
+		_, err = readBytesAt(data, ptr, clen, "SectionCode")
+		if err != nil {
+			return err
 		}
-
-		codeptr := uint64(ptr) // Start of the code
-		code := data[ptr : ptr+int(clen)]
+		ptrs = append(ptrs, ptr)
+		lens = append(lens, clen)
 		ptr += int(clen)
+	}
 
-		locals := make([]types.ValType, 0)
-
-		vclen, l := binary.Uvarint(code)
-		if l <= 0 {
-			return fmt.Errorf("Error decoding SectionCode vclen %x", getDataContext(data))
+	entries := make([]*CodeEntry, len(ptrs))
+	err = parallelFor(len(ptrs), func(i int) error {
+		c, err := decodeCodeEntry(data, ptrs[i], lens[i], wf.KeepLayout)
+		if err != nil {
+			return fmt.Errorf("Error decoding code for function %d at offset %d: %w", i, ptrs[i], err)
 		}
-		locptr := l
+		entries[i] = c
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wf.Code = append(wf.Code, entries...)
+	return nil
+}
 
-		for lo := 0; lo < int(vclen); lo++ {
-			paramLen, ll := binary.Uvarint(code[locptr:])
-			if l <= 0 {
-				return fmt.Errorf("Error decoding SectionCode paramLen %x", getDataContext(data))
-			}
-			locptr += ll
-			ty := code[locptr]
-			locptr++
+// The most locals a function can have, which is the limit in the JS API
+const maxLocals = 50000
 
-			for lod := 0; lod < int(paramLen); lod++ {
-				locals = append(locals, types.ValType(ty))
-			}
-		}
+/**
+ * Decode a single function body, which starts at ptr in the code section data.
+ * With keep, the original bytes are kept so an unchanged body can be copied when encoding.
+ */
+func decodeCodeEntry(data []byte, ptr int, clen uint64, keep bool) (*CodeEntry, error) {
+	codeptr := uint64(ptr) // Start of the code
+	code := data[ptr : ptr+int(clen)]
 
-		expression, _, err := expression.NewExpression(code[locptr:], codeptr+uint64(locptr))
+	locals := make([]types.ValType, 0)
+
+	vclen, locptr, err := readUvarintAt(code, 0, "SectionCode vclen")
+	if err != nil {
+		return nil, err
+	}
+
+	for lo := 0; lo < int(vclen); lo++ {
+		paramLen, ll, err := readUvarintAt(code, locptr, "SectionCode paramLen")
 		if err != nil {
-			return err
+			return nil, err
+		}
+		locptr += ll
+		ty, err := readByteAt(code, locptr, "SectionCode local type")
+		if err != nil {
+			return nil, err
+		}
+		locptr++
+		if paramLen > maxLocals-uint64(len(locals)) {
+			return nil, fmt.Errorf("Error decoding SectionCode more than %d locals", maxLocals)
 		}
 
-		c := &CodeEntry{
-			Locals:         locals,
-			PCValid:        true,
-			CodeSectionPtr: codeptr,
-			CodeSectionLen: clen,
-			Expression:     expression,
+		for lod := 0; lod < int(paramLen); lod++ {
+			locals = append(locals, types.ValType(ty))
 		}
-		wf.Code = append(wf.Code, c)
 	}
-	return nil
+
+	expression, _, err := expression.NewExpression(code[locptr:], codeptr+uint64(locptr))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CodeEntry{
+		Locals:         locals,
+		PCValid:        true,
+		CodeSectionPtr: codeptr,
+		CodeSectionLen: clen,
+		Expression:     expression,
+	}
+	if keep {
+		c.original = code
+	}
+	return c, nil
 }
 
 /**
@@ -276,12 +429,16 @@ func (wf *WasmFile) ParseSectionCode(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionElem(data []byte) error {
-	ptr := 0
-	elemVecLength, l := binary.Uvarint(data)
-	ptr += l
+	elemVecLength, ptr, err := readUvarintAt(data, 0, "SectionElem elemVecLength")
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < int(elemVecLength); i++ {
-		tableIndex, l := binary.Uvarint(data[ptr:])
+		tableIndex, l, err := readUvarintAt(data, ptr, "SectionElem tableIndex")
+		if err != nil {
+			return err
+		}
 		ptr += l
 		offset, l, err := expression.NewExpression(data[ptr:], 0)
 		if err != nil {
@@ -289,11 +446,17 @@ func (wf *WasmFile) ParseSectionElem(data []byte) error {
 		}
 
 		ptr += l
-		funcVecLength, l := binary.Uvarint(data[ptr:])
+		funcVecLength, l, err := readUvarintAt(data, ptr, "SectionElem funcVecLength")
+		if err != nil {
+			return err
+		}
 		ptr += l
 		indexes := make([]uint64, 0)
 		for f := 0; f < int(funcVecLength); f++ {
-			funcIndex, l := binary.Uvarint(data[ptr:])
+			funcIndex, l, err := readUvarintAt(data, ptr, "SectionElem funcIndex")
+			if err != nil {
+				return err
+			}
 			ptr += l
 			indexes = append(indexes, funcIndex)
 		}
@@ -312,22 +475,41 @@ func (wf *WasmFile) ParseSectionElem(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionImport(data []byte) error {
-	ptr := 0
-	importVecLength, l := binary.Uvarint(data)
-	ptr += l
+	importVecLength, ptr, err := readUvarintAt(data, 0, "SectionImport importVecLength")
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < int(importVecLength); i++ {
-		modLength, l := binary.Uvarint(data[ptr:])
+		modLength, l, err := readUvarintAt(data, ptr, "SectionImport modLength")
+		if err != nil {
+			return err
+		}
 		ptr += l
-		mod := data[ptr : ptr+int(modLength)]
+		mod, err := readBytesAt(data, ptr, modLength, "SectionImport module")
+		if err != nil {
+			return err
+		}
 		ptr += int(modLength)
-		nameLength, l := binary.Uvarint(data[ptr:])
+		nameLength, l, err := readUvarintAt(data, ptr, "SectionImport nameLength")
+		if err != nil {
+			return err
+		}
 		ptr += l
-		name := data[ptr : ptr+int(nameLength)]
+		name, err := readBytesAt(data, ptr, nameLength, "SectionImport name")
+		if err != nil {
+			return err
+		}
 		ptr += int(nameLength)
-		importType := data[ptr]
+		importType, err := readByteAt(data, ptr, "SectionImport importType")
+		if err != nil {
+			return err
+		}
 		ptr++
-		importIndex, l := binary.Uvarint(data[ptr:])
+		importIndex, l, err := readUvarintAt(data, ptr, "SectionImport importIndex")
+		if err != nil {
+			return err
+		}
 		ptr += l
 		e := &ImportEntry{
 			Module: string(mod),
@@ -345,12 +527,16 @@ func (wf *WasmFile) ParseSectionImport(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionFunction(data []byte) error {
-	ptr := 0
-	funcVecLength, l := binary.Uvarint(data)
-	ptr += l
+	funcVecLength, ptr, err := readUvarintAt(data, 0, "SectionFunction funcVecLength")
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < int(funcVecLength); i++ {
-		id, l := binary.Uvarint(data[ptr:])
+		id, l, err := readUvarintAt(data, ptr, "SectionFunction typeIndex")
+		if err != nil {
+			return err
+		}
 
 		f := &FunctionEntry{
 			TypeIndex: int(id),
@@ -366,29 +552,22 @@ func (wf *WasmFile) ParseSectionFunction(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionTable(data []byte) error {
-	ptr := 0
-	tableVecLength, l := binary.Uvarint(data)
-	ptr += l
+	tableVecLength, ptr, err := readUvarintAt(data, 0, "SectionTable tableVecLength")
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < int(tableVecLength); i++ {
-		tableType := data[ptr]
+		tableType, err := readByteAt(data, ptr, "SectionTable tableType")
+		if err != nil {
+			return err
+		}
 		ptr++
-		limitMax := uint64(0)
-		limitMin := uint64(0)
-		var l int
-		if data[ptr] == types.LimitTypeMin {
-			ptr++
-			limitMin, l = binary.Uvarint(data[ptr:])
-			ptr += l
-		} else if data[ptr] == types.LimitTypeMinMax {
-			ptr++
-			limitMin, l = binary.Uvarint(data[ptr:])
-			ptr += l
-			limitMax, l = binary.Uvarint(data[ptr:])
-			ptr += l
-		} else {
-			return fmt.Errorf("Invalid limit type in TableSection %d", data[ptr])
+		limitMin, limitMax, _, l, err := readLimitsAt(data, ptr, "SectionTable")
+		if err != nil {
+			return err
 		}
+		ptr += l
 		t := &TableEntry{
 			TableType: tableType,
 			LimitMin:  int(limitMin),
@@ -399,35 +578,52 @@ func (wf *WasmFile) ParseSectionTable(data []byte) error {
 	return nil
 }
 
+// Read the limits of a table or memory, returning their length in bytes
+func readLimitsAt(data []byte, ptr int, section string) (uint64, uint64, bool, int, error) {
+	limitType, err := readByteAt(data, ptr, section+" limit type")
+	if err != nil {
+		return 0, 0, false, 0, err
+	}
+	if limitType != types.LimitTypeMin && limitType != types.LimitTypeMinMax &&
+		(section != "SectionMemory" || limitType != types.LimitTypeMinMaxShared) {
+		return 0, 0, false, 0, fmt.Errorf("Invalid limit type in %s %d", section, limitType)
+	}
+	limitMin, l, err := readUvarintAt(data, ptr+1, section+" limitMin")
+	if err != nil {
+		return 0, 0, false, 0, err
+	}
+	length := 1 + l
+	limitMax := uint64(0)
+	if limitType != types.LimitTypeMin {
+		limitMax, l, err = readUvarintAt(data, ptr+length, section+" limitMax")
+		if err != nil {
+			return 0, 0, false, 0, err
+		}
+		length += l
+	}
+	return limitMin, limitMax, limitType == types.LimitTypeMinMaxShared, length, nil
+}
+
 /**
  * Parse a Memory section
  *
  */
 func (wf *WasmFile) ParseSectionMemory(data []byte) error {
-	ptr := 0
-	memoryVecLength, l := binary.Uvarint(data)
-	ptr += l
+	memoryVecLength, ptr, err := readUvarintAt(data, 0, "SectionMemory memoryVecLength")
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < int(memoryVecLength); i++ {
-		limitMax := uint64(0)
-		limitMin := uint64(0)
-		var l int
-		if data[ptr] == types.LimitTypeMin {
-			ptr++
-			limitMin, l = binary.Uvarint(data[ptr:])
-			ptr += l
-		} else if data[ptr] == types.LimitTypeMinMax {
-			ptr++
-			limitMin, l = binary.Uvarint(data[ptr:])
-			ptr += l
-			limitMax, l = binary.Uvarint(data[ptr:])
-			ptr += l
-		} else {
-			return fmt.Errorf("Invalid limit type in MemorySection %d", data[ptr])
+		limitMin, limitMax, shared, l, err := readLimitsAt(data, ptr, "SectionMemory")
+		if err != nil {
+			return err
 		}
+		ptr += l
 		m := &MemoryEntry{
 			LimitMin: int(limitMin),
 			LimitMax: int(limitMax),
+			Shared:   shared,
 		}
 		wf.Memory = append(wf.Memory, m)
 	}
@@ -439,14 +635,21 @@ func (wf *WasmFile) ParseSectionMemory(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionGlobal(data []byte) error {
-	ptr := 0
-	globalVecLength, l := binary.Uvarint(data)
-	ptr += l
+	globalVecLength, ptr, err := readUvarintAt(data, 0, "SectionGlobal globalVecLength")
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < int(globalVecLength); i++ {
-		valType := data[ptr]
+		valType, err := readByteAt(data, ptr, "SectionGlobal valType")
+		if err != nil {
+			return err
+		}
 		ptr++
-		valMut := data[ptr]
+		valMut, err := readByteAt(data, ptr, "SectionGlobal valMut")
+		if err != nil {
+			return err
+		}
 		ptr++
 		// Read the init expression
 		expression, n, err := expression.NewExpression(data[ptr:], 0)
@@ -471,18 +674,31 @@ func (wf *WasmFile) ParseSectionGlobal(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionExport(data []byte) error {
-	ptr := 0
-	exportVecLength, l := binary.Uvarint(data)
-	ptr += l
+	exportVecLength, ptr, err := readUvarintAt(data, 0, "SectionExport exportVecLength")
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < int(exportVecLength); i++ {
-		nameLength, l := binary.Uvarint(data[ptr:])
+		nameLength, l, err := readUvarintAt(data, ptr, "SectionExport nameLength")
+		if err != nil {
+			return err
+		}
 		ptr += l
-		name := data[ptr : ptr+int(nameLength)]
+		name, err := readBytesAt(data, ptr, nameLength, "SectionExport name")
+		if err != nil {
+			return err
+		}
 		ptr += int(nameLength)
-		exportType := data[ptr]
+		exportType, err := readByteAt(data, ptr, "SectionExport exportType")
+		if err != nil {
+			return err
+		}
 		ptr++
-		exportIndex, l := binary.Uvarint(data[ptr:])
+		exportIndex, l, err := readUvarintAt(data, ptr, "SectionExport exportIndex")
+		if err != nil {
+			return err
+		}
 		ptr += l
 		e := &ExportEntry{
 			Name:  string(name),
@@ -508,11 +724,15 @@ func (wf *WasmFile) ParseSectionStart(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionCustom(data []byte) error {
-	ptr := 0
-	nameLength, l := binary.Uvarint(data)
-	ptr += l
+	nameLength, ptr, err := readUvarintAt(data, 0, "SectionCustom nameLength")
+	if err != nil {
+		return err
+	}
 
-	nameData := data[ptr : ptr+int(nameLength)]
+	nameData, err := readBytesAt(data, ptr, nameLength, "SectionCustom name")
+	if err != nil {
+		return err
+	}
 	ptr += int(nameLength)
 
 	c := &CustomEntry{
@@ -529,9 +749,10 @@ func (wf *WasmFile) ParseSectionCustom(data []byte) error {
  *
  */
 func (wf *WasmFile) ParseSectionType(data []byte) error {
-	ptr := 0
-	typeVecLength, l := binary.Uvarint(data)
-	ptr += l
+	typeVecLength, ptr, err := readUvarintAt(data, 0, "SectionType typeVecLength")
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < int(typeVecLength); i++ {
 		t := &TypeEntry{
@@ -540,25 +761,42 @@ func (wf *WasmFile) ParseSectionType(data []byte) error {
 		}
 
 		// Read a functype
-		if data[ptr] == types.FuncTypePrefix {
-			ptr++
-			// Now read param / result vectors
-			paramVecLength, l := binary.Uvarint(data[ptr:])
-			ptr += l
-			for p := 0; p < int(paramVecLength); p++ {
-				t.Param = append(t.Param, types.ValType(data[ptr]))
-				ptr++
-			}
-			resultVecLength, l := binary.Uvarint(data[ptr:])
-			ptr += l
-			for p := 0; p < int(resultVecLength); p++ {
-				t.Result = append(t.Result, types.ValType(data[ptr]))
-				ptr++
-			}
-			wf.Type = append(wf.Type, t)
-		} else {
-			return fmt.Errorf("Invalid type %d", data[ptr])
+		prefix, err := readByteAt(data, ptr, "SectionType prefix")
+		if err != nil {
+			return err
+		}
+		if prefix != types.FuncTypePrefix {
+			return fmt.Errorf("Invalid type %d", prefix)
+		}
+		ptr++
+		// Now read param / result vectors
+		paramVecLength, l, err := readUvarintAt(data, ptr, "SectionType paramVecLength")
+		if err != nil {
+			return err
+		}
+		ptr += l
+		params, err := readBytesAt(data, ptr, paramVecLength, "SectionType params")
+		if err != nil {
+			return err
+		}
+		for _, p := range params {
+			t.Param = append(t.Param, types.ValType(p))
+		}
+		ptr += len(params)
+		resultVecLength, l, err := readUvarintAt(data, ptr, "SectionType resultVecLength")
+		if err != nil {
+			return err
+		}
+		ptr += l
+		results, err := readBytesAt(data, ptr, resultVecLength, "SectionType results")
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			t.Result = append(t.Result, types.ValType(r))
 		}
+		ptr += len(results)
+		wf.Type = append(wf.Type, t)
 	}
 	return nil
 }
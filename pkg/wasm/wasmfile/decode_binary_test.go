@@ -0,0 +1,297 @@
+package wasmfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/wat"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const testModuleWat = `(module
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (type 0)))
+  (memory 1)
+  (global $counter (mut i32) (i32.const 0))
+
+  (func $add (param $a i32) (param $b i32) (result i32)
+    local.get $a
+    local.get $b
+    i32.add
+  )
+
+  (func $hello
+    i32.const 1
+    i32.const offset($message)
+    i32.const 1
+    i32.const 0
+    call $fd_write
+    drop
+    global.get $counter
+    i32.const 1
+    call $add
+    global.set $counter
+  )
+
+  (data $message "Hello world")
+  (export "hello" (func $hello))
+)
+`
+
+func newTestModule(t *testing.T) *WasmFile {
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte(testModuleWat))
+	assert.NoError(t, err)
+
+	for _, c := range wf.Code {
+		assert.NoError(t, c.ResolveLengths(wf))
+		assert.NoError(t, c.ResolveRelocations(wf, 0))
+		assert.NoError(t, c.ResolveGlobals(wf))
+		assert.NoError(t, c.ResolveFunctions(wf))
+	}
+	return wf
+}
+
+func TestDecodeBinaryReader(t *testing.T) {
+	wf := newTestModule(t)
+
+	var buf bytes.Buffer
+	err := wf.EncodeBinary(&buf)
+	assert.NoError(t, err)
+
+	// Decode from a byte slice
+	wfBytes := &WasmFile{}
+	err = wfBytes.DecodeBinary(buf.Bytes())
+	assert.NoError(t, err)
+
+	// Decode from a reader which only gives us a byte at a time
+	wfReader, err := NewFromReader(iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+	assert.NoError(t, err)
+
+	assert.Equal(t, len(wfBytes.Type), len(wfReader.Type))
+	assert.Equal(t, len(wfBytes.Import), len(wfReader.Import))
+	assert.Equal(t, len(wfBytes.Code), len(wfReader.Code))
+	assert.Equal(t, len(wfBytes.Data), len(wfReader.Data))
+	assert.Equal(t, len(wfBytes.Export), len(wfReader.Export))
+
+	for idx, c := range wfBytes.Code {
+		c2 := wfReader.Code[idx]
+		assert.Equal(t, c.CodeSectionPtr, c2.CodeSectionPtr)
+		assert.Equal(t, len(c.Expression), len(c2.Expression))
+		for i, e := range c.Expression {
+			assert.True(t, e.Equals(c2.Expression[i]))
+		}
+	}
+}
+
+func TestDecodeBinaryReaderTruncated(t *testing.T) {
+	wf := newTestModule(t)
+
+	var buf bytes.Buffer
+	err := wf.EncodeBinary(&buf)
+	assert.NoError(t, err)
+
+	_, err = NewFromReader(bytes.NewReader(buf.Bytes()[:buf.Len()-4]))
+	assert.Error(t, err)
+
+	_, err = NewFromReader(bytes.NewReader(buf.Bytes()[:4]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestDecodeBinaryMalformed(t *testing.T) {
+	wf := newTestModule(t)
+
+	var buf bytes.Buffer
+	err := wf.EncodeBinary(&buf)
+	assert.NoError(t, err)
+
+	// Corrupt the body of the code section, but leave the section lengths intact.
+	data := buf.Bytes()
+	for i := len(data) - 40; i < len(data); i++ {
+		data[i] = 0xff
+	}
+
+	_, err = NewFromReader(bytes.NewReader(data))
+	assert.Error(t, err)
+
+	// A body in the code section without a function entry
+	_, err = NewFromReader(bytes.NewReader([]byte("\x00asm\x01\x00\x00\x00\x0a\x04\x01\x02\x00\x0b")))
+	assert.EqualError(t, err, "The function section has 0 entries, but the code section has 1")
+
+	// The wat encoder doesn't trust the counts either
+	wf.Function = wf.Function[:1]
+	assert.EqualError(t, wf.EncodeFunctionWat(io.Discard, 1), "Function code 1 not found")
+}
+
+func TestErrors(t *testing.T) {
+	wf := newTestModule(t)
+
+	err := wf.SetGlobal("$does_not_exist", types.ValI32, "i32.const 1")
+	assert.Error(t, err)
+
+	err = wf.RedirectImport("wasi_snapshot_preview1", "fd_write", "$does_not_exist")
+	assert.Error(t, err)
+
+	err = NewEmpty().DecodeWat([]byte(`(module (nonsense 1))`))
+	assert.Error(t, err)
+
+	err = NewEmpty().DecodeWat([]byte(`(module (; unclosed`))
+	assert.Error(t, err)
+
+	// Truncated or oversized sections are errors, not panics
+	err = NewEmpty().DecodeBinary([]byte("\x00asm\x01\x00\x00\x00\x01\x05\x01\x60\x01"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	err = NewEmpty().DecodeBinary([]byte("\x00asm\x01\x00\x00\x00\n\x01\x00\xdf\xdf\xdf\xdf\xdf\xdf\xdf0"))
+	assert.ErrorContains(t, err, "too big")
+}
+
+func TestParallelCode(t *testing.T) {
+	// Make sure the worker pool is used, even on one CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// Enough bodies that every worker gets some
+	wf := newTestModule(t)
+	for i := 0; i < 64; i++ {
+		wf.Function = append(wf.Function, wf.Function[i%2])
+		wf.Code = append(wf.Code, wf.Code[i%2])
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	assert.Equal(t, len(wf.Code), len(wf2.Code))
+
+	var buf2 bytes.Buffer
+	assert.NoError(t, wf2.EncodeBinary(&buf2))
+	assert.Equal(t, buf.Bytes(), buf2.Bytes())
+
+	// Same as encoding each body in turn
+	var seq bytes.Buffer
+	assert.NoError(t, writeVectorSection(&seq, types.SectionCode, wf2.Code))
+	var par bytes.Buffer
+	assert.NoError(t, writeCodeSection(&par, wf2.Code))
+	assert.Equal(t, seq.Bytes(), par.Bytes())
+
+	// The error is always for the first bad body
+	err := parallelFor(100, func(i int) error {
+		if i%10 == 7 {
+			return fmt.Errorf("bad %d", i)
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "bad 7")
+}
+
+func TestEncodeBinaryPipe(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	wf := newTestModule(t)
+	for i := 0; i < 64; i++ {
+		wf.Function = append(wf.Function, wf.Function[i%2])
+		wf.Code = append(wf.Code, wf.Code[i%2])
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+
+	// A pipe doesn't buffer anything, so each write has to be right as it's made
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(wf.EncodeBinary(w))
+	}()
+	piped, err := io.ReadAll(iotest.OneByteReader(r))
+	assert.NoError(t, err)
+	assert.Equal(t, buf.Bytes(), piped)
+
+	// The code section is the same as encoding each body in turn
+	var seq bytes.Buffer
+	assert.NoError(t, writeVectorSection(&seq, types.SectionCode, wf.Code))
+	assert.True(t, bytes.Contains(piped, seq.Bytes()))
+
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(piped))
+	assert.Equal(t, len(wf.Code), len(wf2.Code))
+}
+
+// Measures the live heap as it's written to
+type heapWriter struct {
+	writes int
+	n      int
+	peak   uint64
+}
+
+func (hw *heapWriter) Write(p []byte) (int, error) {
+	hw.writes++
+	hw.n += len(p)
+	if hw.writes%32 == 0 {
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		if ms.HeapAlloc > hw.peak {
+			hw.peak = ms.HeapAlloc
+		}
+	}
+	return len(p), nil
+}
+
+func TestWriteCodeSectionMemory(t *testing.T) {
+	// The same big body many times over, so the encoded section is much bigger than the module
+	wat := strings.Repeat("i32.const 1000000\ndrop\n", 2000)
+	body, err := expression.ExpressionFromWat(wat)
+	assert.NoError(t, err)
+	c := &CodeEntry{Expression: body}
+	entries := make([]*CodeEntry, 2000)
+	for i := range entries {
+		entries[i] = c
+	}
+
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+
+	hw := &heapWriter{}
+	assert.NoError(t, writeCodeSection(hw, entries))
+	assert.Greater(t, hw.n, 20000000)
+
+	// Only a chunk of the bodies is held at once, not the whole section
+	assert.Less(t, int(hw.peak)-int(ms.HeapAlloc), hw.n/4)
+}
+
+func FuzzDecodeBinary(f *testing.F) {
+	var buf bytes.Buffer
+	assert.NoError(f, newTestModule(&testing.T{}).EncodeBinary(&buf))
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Anything that decodes can be encoded again
+		wf, err := NewFromReader(bytes.NewReader(data))
+		if err == nil {
+			_ = wf.EncodeWat(io.Discard)
+			_ = wf.EncodeBinary(io.Discard)
+		}
+	})
+}
+
+func FuzzDecodeWat(f *testing.F) {
+	f.Add(testModuleWat)
+	f.Add(`(module (memory (data "hi")) (table funcref (elem $f)) (func $f (export "f") (result i32) (; c ;) i32.const 1))`)
+	for _, name := range []string{"memory.wat", "stackdepth.wat", "json.wat"} {
+		data, err := wat.Wat_content.ReadFile("wat_code/" + name)
+		assert.NoError(f, err)
+		f.Add(string(data))
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		NewEmpty().DecodeWat([]byte(text))
+	})
+}
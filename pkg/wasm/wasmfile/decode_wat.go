@@ -17,6 +17,7 @@
 package wasmfile
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -37,56 +38,126 @@ func NewFromWat(filename string) (*WasmFile, error) {
 	}
 
 	wf := &WasmFile{}
-	err = wf.DecodeWat(data)
+	err = wf.DecodeWatFile(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	err = wf.AddWatDebugSections(filename)
 	return wf, err
 }
 
+// An error in some wat, with where it was found. Columns count bytes from 1.
+type WatError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *WatError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%d:%d: %v", e.Line, e.Column, e.Err)
+	}
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+func (e *WatError) Unwrap() error {
+	return e.Err
+}
+
+// An error at an offset into the text of an element, so DecodeWat can say exactly where it was
+type watOffsetError struct {
+	offset int
+	err    error
+}
+
+func (e *watOffsetError) Error() string {
+	return e.err.Error()
+}
+
+func (e *watOffsetError) Unwrap() error {
+	return e.err
+}
+
+/**
+ * Make a WatError for an error at offset in data. If the error has a more exact offset
+ * (relative to the offset given), that is used instead.
+ */
+func newWatError(file string, data []byte, offset int, err error) *WatError {
+	var oe *watOffsetError
+	if errors.As(err, &oe) {
+		offset += oe.offset
+		err = oe.err
+	}
+	if offset > len(data) {
+		offset = len(data)
+	}
+	lineStart := bytes.LastIndexByte(data[:offset], '\n') + 1
+	return &WatError{
+		File:   file,
+		Line:   bytes.Count(data[:offset], []byte{'\n'}) + 1,
+		Column: offset - lineStart + 1,
+		Err:    err,
+	}
+}
+
+// The Register functions name the entry being decoded, by the index it will get.
+// Entries without a name still take an index, so this can't just count the names.
+
 func (wf *WasmFile) RegisterNextFunctionName(n string) {
-	idx := len(wf.Debug.FunctionNames)
+	// Imports always come before the functions
+	idx := len(wf.Import) + len(wf.Function)
 	wf.Debug.FunctionNames[idx] = n
 }
 
 func (wf *WasmFile) RegisterNextGlobalName(n string) {
-	idx := len(wf.Debug.GlobalNames)
+	idx := len(wf.Global)
 	wf.Debug.GlobalNames[idx] = n
 }
 
 func (wf *WasmFile) RegisterNextDataName(n string) {
-	idx := len(wf.Debug.DataNames)
+	idx := len(wf.Data)
 	wf.Debug.DataNames[idx] = n
 }
 
-func (wf *WasmFile) DecodeWat(data []byte) (err error) {
-	/*
-		defer func() {
-			r := recover()
-			if r != nil {
-				switch x := r.(type) {
-				case string:
-					err = errors.New(x)
-				case error:
-					err = x
-				default:
-					err = errors.New("unknown panic")
-				}
-			}
-		}()
-	*/
+func (wf *WasmFile) DecodeWat(data []byte) error {
+	return wf.DecodeWatFile("", data)
+}
+
+/**
+ * Decode a wat module. Any error is a *WatError, giving the file name and the line and column.
+ *
+ */
+func (wf *WasmFile) DecodeWatFile(filename string, data []byte) (err error) {
+	// Offset of the element being decoded
+	pos := 0
+	fail := func(err error) error {
+		return newWatError(filename, data, pos, err)
+	}
+
 	// Parse the wat file and fill in all the data...
 	wf.Debug = &debug.WasmDebug{}
 	wf.Debug.FunctionNames = make(map[int]string)
 	wf.Debug.GlobalNames = make(map[int]string)
 	wf.Debug.DataNames = make(map[int]string)
+	wf.Debug.FunctionLocalNames = make(map[int]map[int]string)
 
 	text := string(data)
 
-	// Read the module
-	moduleText, _ := encoding.ReadElement(text)
-
-	moduleType, _ := encoding.ReadToken(moduleText[1:])
+	// The encoding helpers would read an unclosed comment as running to the end
+	pos = encoding.FindUnclosedComment(text)
+	if pos != -1 {
+		return fail(encoding.ErrUnclosedComment)
+	}
+	pos = 0
 
+	// Read the module
+	moduleType := ""
+	if strings.HasPrefix(text, "(") {
+		moduleType, _ = encoding.ReadToken(text[1:])
+	}
 	if moduleType != "module" {
-		return errors.New("Invalud module. Expected 'module'")
+		return fail(errors.New("Invalid module. Expected 'module'"))
 	}
 
 	// Now read all the individual elements from within the module...
@@ -94,39 +165,50 @@ func (wf *WasmFile) DecodeWat(data []byte) (err error) {
 	text = text[len(moduleType)+1:]
 	bodytext := text // Save it for a second pass
 
+	// Elements using the inline import, export, data or elem abbreviations, by their offset
+	inlines := make(map[int]*watInline)
+
 	for {
-		text = strings.TrimLeft(text, encoding.Whitespace) // Skip to next bit
+		var e, eType string
+		text, e, eType, err = readWatModuleElement(text)
+		pos = len(data) - len(text)
+		if err != nil {
+			return fail(err)
+		}
 		// End of the module?
-		if text[0] == ')' {
+		if e == "" {
 			break
 		}
 
-		// Skip any single line comments
-		for {
-			if strings.HasPrefix(text, ";;") {
-				// Skip to end of line
-				p := strings.Index(text, "\n")
-				if p == -1 {
-					panic("TODO: Comment without newline")
+		if eType == "func" || eType == "memory" || eType == "table" || eType == "global" {
+			inline, err := readInlineImportExport(e, eType)
+			if err != nil {
+				return fail(err)
+			}
+			if eType == "memory" {
+				err = inline.readSegment(eType, "data")
+			} else if eType == "table" {
+				err = inline.readSegment(eType, "elem")
+			}
+			if err != nil {
+				return fail(err)
+			}
+			if inline.imported != nil || len(inline.exports) > 0 || inline.segment != "" {
+				err = wf.addInlineImportExport(inline, eType)
+				if err != nil {
+					return fail(err)
 				}
-				text = text[p+1:]
-				text = strings.TrimLeft(text, encoding.Whitespace) // Skip to next bit
-			} else {
-				break
+				inlines[pos] = inline
+				e = inline.text
 			}
 		}
 
-		e, _ := encoding.ReadElement(text)
-		eType, _ := encoding.ReadToken(e[1:])
-
-		if eType == "data" {
+		if inlines[pos] != nil && inlines[pos].imported != nil {
+			// Already added as an import
+		} else if eType == "data" {
 			de := &DataEntry{}
 			err = de.DecodeWat(e, wf)
 			wf.Data = append(wf.Data, de)
-		} else if eType == "elem" {
-			ee := &ElemEntry{}
-			err = ee.DecodeWat(e, wf)
-			wf.Elem = append(wf.Elem, ee)
 		} else if eType == "func" {
 			ee := &FunctionEntry{}
 			err = ee.DecodeWat(e, wf)
@@ -141,23 +223,38 @@ func (wf *WasmFile) DecodeWat(data []byte) (err error) {
 			wf.Import = append(wf.Import, ie)
 		} else if eType == "memory" {
 			ee := &MemoryEntry{}
-			err = ee.DecodeWat(e)
+			inline := inlines[pos]
+			if inline == nil || inline.segment == "" || inline.limits {
+				err = ee.DecodeWat(e)
+			}
+			if err == nil && inline != nil && inline.segment != "" {
+				err = wf.decodeInlineData(ee, inline)
+			}
 			wf.Memory = append(wf.Memory, ee)
 		} else if eType == "table" {
 			ee := &TableEntry{}
-			err = ee.DecodeWat(e)
+			inline := inlines[pos]
+			if inline != nil && inline.segment != "" && !inline.limits {
+				// The size comes from the elem segment, in the second pass
+				if inline.refType != "funcref" {
+					err = errors.New("Only table funcref supported atm")
+				}
+				ee.TableType = types.TableTypeFuncref
+			} else {
+				err = ee.DecodeWat(e)
+			}
 			wf.Table = append(wf.Table, ee)
 		} else if eType == "type" {
 			ee := &TypeEntry{}
 			err = ee.DecodeWat(e)
 			wf.Type = append(wf.Type, ee)
-		} else if eType == "export" {
-			// Deal with it in 2nd pass
+		} else if eType == "export" || eType == "elem" {
+			// Deal with it in 2nd pass, once all the function names are known
 		} else {
-			panic(fmt.Sprintf("Unknown element \"%s\"", eType))
+			return fail(fmt.Errorf("unknown element \"%s\"", eType))
 		}
 		if err != nil {
-			return err
+			return fail(err)
 		}
 
 		// Skip over this element
@@ -166,43 +263,54 @@ func (wf *WasmFile) DecodeWat(data []byte) (err error) {
 
 	// Second pass
 	text = bodytext
+	line := 1 // Line number of linePos in the data
+	linePos := 0
 
 	for {
-		text = strings.TrimLeft(text, encoding.Whitespace) // Skip to next bit
+		var e, eType string
+		text, e, eType, err = readWatModuleElement(text)
+		pos = len(data) - len(text)
+		if err != nil {
+			return fail(err)
+		}
 		// End of the module?
-		if text[0] == ')' {
+		if e == "" {
 			break
 		}
 
-		// Skip any single line comments
-		for {
-			if strings.HasPrefix(text, ";;") {
-				// Skip to end of line
-				p := strings.Index(text, "\n")
-				if p == -1 {
-					panic("TODO: Comment without newline")
-				}
-				text = text[p+1:]
-				text = strings.TrimLeft(text, encoding.Whitespace) // Skip to next bit
-			} else {
-				break
-			}
+		// Inline exports go in the same order as they're written
+		inline := inlines[pos]
+		if inline != nil {
+			wf.Export = append(wf.Export, inline.exports...)
+			e = inline.text
 		}
 
-		e, _ := encoding.ReadElement(text)
-		eType, _ := encoding.ReadToken(e[1:])
-
-		if eType == "export" {
+		if inline != nil && inline.imported != nil {
+			// Imports don't have any code
+		} else if eType == "export" {
 			ee := &ExportEntry{}
 			err = ee.DecodeWat(e, wf)
 			wf.Export = append(wf.Export, ee)
+		} else if eType == "elem" {
+			ee := &ElemEntry{}
+			err = ee.DecodeWat(e, wf)
+			wf.Elem = append(wf.Elem, ee)
+		} else if eType == "table" && inline != nil && inline.segment != "" {
+			err = wf.decodeInlineElem(inline)
 		} else if eType == "func" {
 			ce := &CodeEntry{}
 			err = ce.DecodeWat(e, wf)
+			// Make the lines relative to the whole file
+			pos := len(data) - len(text)
+			line += strings.Count(string(data[linePos:pos]), "\n")
+			linePos = pos
+			for i := range ce.WatLines {
+				ce.WatLines[i] += line
+			}
 			wf.Code = append(wf.Code, ce)
 		}
 		if err != nil {
-			return err
+			return fail(err)
 		}
 
 		// Skip over this element
@@ -212,11 +320,283 @@ func (wf *WasmFile) DecodeWat(data []byte) (err error) {
 	return nil
 }
 
+// The type of an element, eg func for (func $f ...). It's empty if there's no element.
+func watElementType(el string) string {
+	if !strings.HasPrefix(el, "(") {
+		return ""
+	}
+	t, _ := encoding.ReadToken(el[1:])
+	return t
+}
+
+/**
+ * Read the next element of a module and its type, skipping any whitespace and comments before it.
+ * The text is returned from the start of the element, or where the problem is. At the end of the module,
+ * the element is empty.
+ */
+func readWatModuleElement(text string) (string, string, string, error) {
+	for {
+		text = strings.TrimLeft(text, encoding.Whitespace)
+		if strings.HasPrefix(text, ";;") {
+			p := strings.Index(text, "\n")
+			if p == -1 {
+				return text, "", "", errors.New("The file ends in a ;; comment, before the module is closed")
+			}
+			text = text[p+1:]
+		} else if strings.HasPrefix(text, "(;") {
+			rest, err := encoding.SkipComment(text)
+			if err != nil {
+				return text, "", "", err
+			}
+			text = rest
+		} else {
+			break
+		}
+	}
+
+	if len(text) == 0 {
+		return text, "", "", errors.New("The module isn't closed with )")
+	}
+	if text[0] == ')' {
+		return text, "", "", nil
+	}
+	if text[0] != '(' {
+		tok, _ := encoding.ReadToken(text)
+		return text, "", "", fmt.Errorf("Expected an element, found %s", tok)
+	}
+	e, rest := encoding.ReadElement(text)
+	if len(rest) == 0 {
+		// Either the element or the module isn't closed
+		return text, "", "", errors.New("The element isn't closed with ), or the module isn't")
+	}
+	return text, e, watElementType(e), nil
+}
+
+// The inline abbreviations of a func, table, memory or global
+type watInline struct {
+	text     string // The element with the abbreviations blanked out
+	index    int    // The index of the func, table, memory or global
+	exports  []*ExportEntry
+	imported *ImportEntry
+
+	segment string // The contents of an inline data or elem segment
+	limits  bool   // If a memory or table with a segment still gives its limits
+	refType string
+}
+
+/**
+ * Read the inline abbreviations from an element, eg (func $f (export "f") (param i32)) or
+ * (func $x (import "env" "x") (type 0)). They're blanked out with spaces rather than removed,
+ * so the rest of the element keeps the same lines and columns.
+ */
+func readInlineImportExport(e string, eType string) (*watInline, error) {
+	inline := &watInline{
+		exports: make([]*ExportEntry, 0),
+	}
+	blanked := []byte(e)
+
+	s := strings.TrimLeft(e[1+len(eType):], encoding.Whitespace)
+	// Optional identifier
+	if len(s) > 0 && s[0] == '$' {
+		_, s = encoding.ReadToken(s)
+	}
+
+	for {
+		var err error
+		s, err = encoding.SkipComment(s)
+		if err != nil {
+			return nil, err
+		}
+		s = strings.TrimLeft(s, encoding.Whitespace)
+		if !strings.HasPrefix(s, "(export") && !strings.HasPrefix(s, "(import") {
+			break
+		}
+		start := len(e) - len(s)
+		el, rest := encoding.ReadElement(s)
+		elType, args := encoding.ReadToken(el[1 : len(el)-1])
+		if elType == "export" {
+			name, _ := encoding.ReadString(args)
+			ndata, err := encoding.DecodeString(name)
+			if err != nil {
+				return nil, err
+			}
+			inline.exports = append(inline.exports, &ExportEntry{Name: string(ndata)})
+		} else if elType == "import" {
+			if inline.imported != nil {
+				return nil, fmt.Errorf("%s can only have one import", eType)
+			}
+			var module, name string
+			module, args = encoding.ReadString(args)
+			name, _ = encoding.ReadString(args)
+			mdata, err := encoding.DecodeString(module)
+			if err != nil {
+				return nil, err
+			}
+			ndata, err := encoding.DecodeString(name)
+			if err != nil {
+				return nil, err
+			}
+			inline.imported = &ImportEntry{
+				Module: string(mdata),
+				Name:   string(ndata),
+			}
+		} else {
+			break
+		}
+
+		for i := start; i < start+len(el); i++ {
+			if blanked[i] != '\n' {
+				blanked[i] = ' '
+			}
+		}
+		s = rest
+	}
+
+	inline.text = string(blanked)
+	return inline, nil
+}
+
+/**
+ * Add the import for an element using the inline import abbreviation, and fill in the index of the
+ * element and its inline exports. This needs to happen before the element itself is added.
+ */
+func (wf *WasmFile) addInlineImportExport(inline *watInline, eType string) error {
+	var etype types.ExportType
+	var index int
+	if eType == "func" {
+		etype = types.ExportFunc
+		index = len(wf.Import) + len(wf.Function)
+		if inline.imported != nil {
+			// Read the type and name just like a function
+			fe := &FunctionEntry{}
+			err := fe.DecodeWat(inline.text, wf)
+			if err != nil {
+				return err
+			}
+			index = len(wf.Import)
+			inline.imported.Type = types.ExportFunc
+			inline.imported.Index = fe.TypeIndex
+			wf.Import = append(wf.Import, inline.imported)
+		}
+	} else if inline.imported != nil {
+		return fmt.Errorf("Only func imports are supported (%s)", eType)
+	} else if eType == "memory" {
+		etype = types.ExportMem
+		index = len(wf.Memory)
+	} else if eType == "table" {
+		etype = types.ExportTable
+		index = len(wf.Table)
+	} else if eType == "global" {
+		etype = types.ExportGlobal
+		index = len(wf.Global)
+	}
+
+	inline.index = index
+	for _, ex := range inline.exports {
+		ex.Type = etype
+		ex.Index = index
+	}
+	return nil
+}
+
+/**
+ * Take an inline data or elem segment out of a memory or table, eg (memory (data "hello")) or
+ * (table funcref (elem $f $g)). It's blanked out in the same way as the imports and exports.
+ */
+func (inline *watInline) readSegment(eType string, segType string) error {
+	e := inline.text
+	blanked := []byte(e)
+	s := e[1+len(eType) : len(e)-1]
+	for {
+		var err error
+		s, err = encoding.SkipComment(strings.TrimLeft(s, encoding.Whitespace))
+		if err != nil {
+			return err
+		}
+		s = strings.TrimLeft(s, encoding.Whitespace)
+		if len(s) == 0 {
+			break
+		}
+		if s[0] != '(' {
+			var tok string
+			tok, s = encoding.ReadToken(s)
+			if tok[0] >= '0' && tok[0] <= '9' {
+				inline.limits = true
+			} else if tok[0] != '$' {
+				inline.refType = tok
+			}
+			continue
+		}
+		start := len(e) - 1 - len(s)
+		var el string
+		el, s = encoding.ReadElement(s)
+		tok, contents := encoding.ReadToken(el[1 : len(el)-1])
+		if tok == segType {
+			inline.segment = strings.Trim(contents, encoding.Whitespace)
+			for i := start; i < start+len(el); i++ {
+				if blanked[i] != '\n' {
+					blanked[i] = ' '
+				}
+			}
+		}
+	}
+	inline.text = string(blanked)
+	return nil
+}
+
+/**
+ * Add the data of a memory using the inline data abbreviation. It goes at the start of the memory,
+ * and a memory without limits is just big enough for it.
+ */
+func (wf *WasmFile) decodeInlineData(m *MemoryEntry, inline *watInline) error {
+	if inline.index != 0 {
+		return errors.New("Only memory 0 supported atm")
+	}
+	de := &DataEntry{}
+	err := de.DecodeWat("(data (i32.const 0) "+inline.segment+")", wf)
+	if err != nil {
+		return err
+	}
+	wf.Data = append(wf.Data, de)
+
+	if !inline.limits {
+		pages := (len(de.Data) + 65535) / 65536
+		m.LimitMin = pages
+		m.LimitMax = pages
+	}
+	return nil
+}
+
+/**
+ * Add the elem segment of a table using the inline elem abbreviation. It goes at the start of the table,
+ * and a table without limits is just big enough for it.
+ */
+func (wf *WasmFile) decodeInlineElem(inline *watInline) error {
+	if inline.index != 0 {
+		return errors.New("Only table 0 supported atm")
+	}
+	ee := &ElemEntry{}
+	err := ee.DecodeWat("(elem (i32.const 0) "+inline.segment+")", wf)
+	if err != nil {
+		return err
+	}
+	wf.Elem = append(wf.Elem, ee)
+
+	if !inline.limits {
+		t := wf.Table[inline.index]
+		t.LimitMin = len(ee.Indexes)
+		t.LimitMax = len(ee.Indexes)
+	}
+	return nil
+}
+
 func (e *TypeEntry) DecodeWat(d string) error {
 	//   (type (;0;) (func (param i32 i32 i32 i32) (result i32)))
 
-	s := strings.Trim(d[5:len(d)-1], encoding.Whitespace)
-	s = encoding.SkipComment(s)
+	s, err := encoding.SkipComment(strings.Trim(d[5:len(d)-1], encoding.Whitespace))
+	if err != nil {
+		return err
+	}
 	fspec, s := encoding.ReadElement(s)
 	if fspec == "(func)" {
 		// Special case, nothing else to do.
@@ -226,7 +606,10 @@ func (e *TypeEntry) DecodeWat(d string) error {
 		fspec = fspec[6 : len(fspec)-1]
 		for {
 			var el string
-			fspec = encoding.SkipComment(fspec)
+			fspec, err = encoding.SkipComment(fspec)
+			if err != nil {
+				return err
+			}
 			fspec = strings.Trim(fspec, encoding.Whitespace)
 			if len(fspec) == 0 {
 				break
@@ -237,7 +620,10 @@ func (e *TypeEntry) DecodeWat(d string) error {
 				el = el[7 : len(el)-1]
 				for {
 					var ptype string
-					el = encoding.SkipComment(el)
+					el, err = encoding.SkipComment(el)
+					if err != nil {
+						return err
+					}
 					el = strings.Trim(el, encoding.Whitespace)
 					if len(el) == 0 {
 						break
@@ -270,25 +656,32 @@ func (e *TypeEntry) DecodeWat(d string) error {
 func (e *TableEntry) DecodeWat(d string) error {
 	//  (table (;0;) 3 3 funcref)
 
-	s := strings.Trim(d[6:len(d)-1], encoding.Whitespace)
-	s = encoding.SkipComment(s)
+	s, err := encoding.SkipComment(strings.Trim(d[6:len(d)-1], encoding.Whitespace))
+	if err != nil {
+		return err
+	}
 	// Should be a number next (min)
 	var mmin string
 	var mmax string
-	var err error
 	mmin, s = encoding.ReadToken(s)
 	e.LimitMin, err = strconv.Atoi(mmin)
 	if err != nil {
 		return err
 	}
 
-	s = encoding.SkipComment(s)
-	s = strings.Trim(s, encoding.Whitespace)
-	mmax, s = encoding.ReadToken(s)
-	e.LimitMax, err = strconv.Atoi(mmax)
+	s, err = encoding.SkipComment(s)
 	if err != nil {
 		return err
 	}
+	s = strings.Trim(s, encoding.Whitespace)
+	// The max is optional
+	if len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+		mmax, s = encoding.ReadToken(s)
+		e.LimitMax, err = strconv.Atoi(mmax)
+		if err != nil {
+			return err
+		}
+	}
 
 	tabtype, s := encoding.ReadToken(s)
 	if tabtype != "funcref" {
@@ -301,19 +694,23 @@ func (e *TableEntry) DecodeWat(d string) error {
 func (e *MemoryEntry) DecodeWat(d string) error {
 	// (memory (;0;) 2)
 
-	s := strings.Trim(d[7:len(d)-1], encoding.Whitespace)
-	s = encoding.SkipComment(s)
+	s, err := encoding.SkipComment(strings.Trim(d[7:len(d)-1], encoding.Whitespace))
+	if err != nil {
+		return err
+	}
 	// Should be a number next (min)
 	var mmin string
 	var mmax string
-	var err error
 	mmin, s = encoding.ReadToken(s)
 	e.LimitMin, err = strconv.Atoi(mmin)
 	if err != nil {
 		return err
 	}
 
-	s = encoding.SkipComment(s)
+	s, err = encoding.SkipComment(s)
+	if err != nil {
+		return err
+	}
 	s = strings.Trim(s, encoding.Whitespace)
 	if len(s) > 0 {
 		mmax, s = encoding.ReadToken(s)
@@ -323,6 +720,16 @@ func (e *MemoryEntry) DecodeWat(d string) error {
 		}
 	}
 
+	s = strings.Trim(s, encoding.Whitespace)
+	if len(s) > 0 {
+		var shared string
+		shared, _ = encoding.ReadToken(s)
+		if shared != "shared" {
+			return fmt.Errorf("Unexpected %s in memory", shared)
+		}
+		e.Shared = true
+	}
+
 	return nil
 }
 
@@ -332,18 +739,27 @@ func (e *ImportEntry) DecodeWat(d string, wf *WasmFile) error {
 
 	s := strings.TrimLeft(d[7:len(d)-1], encoding.Whitespace)
 
-	e.Module, s = encoding.ReadString(s)
-	e.Module = e.Module[1 : len(e.Module)-1]
-	e.Name, s = encoding.ReadString(s)
-	e.Name = e.Name[1 : len(e.Name)-1]
+	var module, name string
+	module, s = encoding.ReadString(s)
+	name, s = encoding.ReadString(s)
+	mdata, err := encoding.DecodeString(module)
+	if err != nil {
+		return err
+	}
+	ndata, err := encoding.DecodeString(name)
+	if err != nil {
+		return err
+	}
+	e.Module = string(mdata)
+	e.Name = string(ndata)
 
-	var idata, typedata, tdata string
-	idata, s = encoding.ReadElement(s)
-	iType, _ := encoding.ReadToken(idata[1:])
+	var idata, typedata string
+	idata, _ = encoding.ReadElement(s)
+	iType := watElementType(idata)
 	if iType == "func" {
 		idata = strings.Trim(idata[5:len(idata)-1], encoding.Whitespace)
 		// Read the (optional) function name ID
-		if idata[0] != '(' {
+		if len(idata) > 0 && idata[0] != '(' {
 			var fname string
 			fname, idata = encoding.ReadToken(idata)
 			idata = strings.Trim(idata, encoding.Whitespace)
@@ -351,8 +767,7 @@ func (e *ImportEntry) DecodeWat(d string, wf *WasmFile) error {
 		}
 		// Now read the type...
 		typedata, _ = encoding.ReadElement(idata)
-		tdata, s = encoding.ReadToken(typedata[1:])
-		if tdata == "type" {
+		if watElementType(typedata) == "type" {
 			typedata = strings.Trim(typedata[5:len(typedata)-1], encoding.Whitespace)
 			// Read the value
 			e.Index, err = strconv.Atoi(typedata)
@@ -360,11 +775,11 @@ func (e *ImportEntry) DecodeWat(d string, wf *WasmFile) error {
 				return err
 			}
 		} else {
-			panic("Issue parsing import func")
+			return fmt.Errorf("Issue parsing import func %s", e.Name)
 		}
 
 	} else {
-		panic("TODO: Import other than func")
+		return fmt.Errorf("Only func imports are supported (%s)", iType)
 	}
 
 	return nil
@@ -374,7 +789,7 @@ func (e *GlobalEntry) DecodeWat(d string, wf *WasmFile) error {
 	//  (global $__stack_pointer (mut i32) (i32.const 65536))
 
 	s := strings.Trim(d[7:len(d)-1], encoding.Whitespace)
-	if s[0] == '$' {
+	if len(s) > 0 && s[0] == '$' {
 		// We have an identifier, lets use it
 		var id string
 		id, s = encoding.ReadToken(s)
@@ -384,7 +799,7 @@ func (e *GlobalEntry) DecodeWat(d string, wf *WasmFile) error {
 	// Next we either have a type, or (mut <type>)
 	var ty string
 	var ok bool
-	if s[0] == '(' {
+	if len(s) > 0 && s[0] == '(' {
 		var mutty string
 		mutty, s = encoding.ReadElement(s)
 		if strings.HasPrefix(mutty, "(mut ") && mutty[len(mutty)-1] == ')' {
@@ -405,6 +820,9 @@ func (e *GlobalEntry) DecodeWat(d string, wf *WasmFile) error {
 
 	s = strings.Trim(s, encoding.Whitespace)
 	expr, _ := encoding.ReadElement(s)
+	if !strings.HasPrefix(expr, "(") {
+		return fmt.Errorf("Global has no init expression in %s", d)
+	}
 	// Read the expression
 	expr = expr[1 : len(expr)-1]
 	// TODO: Support proper expressions. For now we only support a single instruction
@@ -421,11 +839,17 @@ func (e *GlobalEntry) DecodeWat(d string, wf *WasmFile) error {
 
 func (e *CodeEntry) DecodeWat(d string, wf *WasmFile) error {
 	e.Locals = make([]types.ValType, 0)
+	e.WatLines = make([]int, 0)
 
 	s := strings.Trim(d[5:len(d)-1], encoding.Whitespace)
+	// Where s starts in d, so that we can work out the line of each instruction
+	sStart := 5 + len(d[5:len(d)-1]) - len(strings.TrimLeft(d[5:len(d)-1], encoding.Whitespace))
+	sLen := len(s)
+	line := 0
+	linePos := 0
 
 	// Optional Identifier
-	if s[0] == '$' {
+	if len(s) > 0 && s[0] == '$' {
 		_, s = encoding.ReadToken(s)
 	}
 
@@ -457,7 +881,7 @@ func (e *CodeEntry) DecodeWat(d string, wf *WasmFile) error {
 			} else if eType == "param" {
 				// Might have a name here...
 				el = strings.Trim(el[6:len(el)-1], encoding.Whitespace)
-				if el[0] == '$' {
+				if len(el) > 0 && el[0] == '$' {
 					var name string
 					name, el = encoding.ReadToken(el)
 					localNames[name] = localIndex
@@ -517,6 +941,9 @@ func (e *CodeEntry) DecodeWat(d string, wf *WasmFile) error {
 			lend = len(s)
 		}
 		ecode := s[:lend]
+		pos := sStart + sLen - len(s)
+		line += strings.Count(d[linePos:pos], "\n")
+		linePos = pos
 		s = s[lend:]
 
 		// Ignore any ;; comments
@@ -531,13 +958,16 @@ func (e *CodeEntry) DecodeWat(d string, wf *WasmFile) error {
 			newe := &expression.Expression{}
 			err := newe.DecodeWat(ecode, localNames)
 			if err != nil {
-				return err
+				return &watOffsetError{offset: pos, err: err}
 			}
 			e.Expression = append(e.Expression, newe)
+			e.WatLines = append(e.WatLines, line)
 		}
 	}
 
-	return nil
+	e.LocalNames = localNames
+	wf.ResolveBlockTypes(e.Expression)
+	return expression.ResolveLabels(e.Expression)
 }
 
 func (e *FunctionEntry) DecodeWat(d string, wf *WasmFile) error {
@@ -545,7 +975,7 @@ func (e *FunctionEntry) DecodeWat(d string, wf *WasmFile) error {
 	// eg (func $write (type 7) (param i32 i32 i32) (result i32)
 
 	// Optional Identifier
-	if s[0] == '$' {
+	if len(s) > 0 && s[0] == '$' {
 		var fname string
 		fname, s = encoding.ReadToken(s)
 		// Store the name for lookups...
@@ -572,12 +1002,15 @@ func (e *FunctionEntry) DecodeWat(d string, wf *WasmFile) error {
 				// Now read each type
 				el = el[7 : len(el)-1]
 				// Could be a name here...
-				if el[0] == '$' {
+				if len(el) > 0 && el[0] == '$' {
 					_, el = encoding.ReadToken(el)
 				}
 				for {
 					var ptype string
-					el = encoding.SkipComment(el)
+					el, err = encoding.SkipComment(el)
+					if err != nil {
+						return err
+					}
 					el = strings.Trim(el, encoding.Whitespace)
 					if len(el) == 0 {
 						break
@@ -622,15 +1055,24 @@ func (e *FunctionEntry) DecodeWat(d string, wf *WasmFile) error {
 func (e *ExportEntry) DecodeWat(d string, wf *WasmFile) error {
 	//  (export "memory" (memory 0))
 	//  (export "hello" (func $hello))
+	//  (export "counter" (global $counter))
 
 	s := strings.TrimLeft(d[7:len(d)-1], encoding.Whitespace)
 
-	e.Name, s = encoding.ReadString(s)
-	e.Name = e.Name[1 : len(e.Name)-1]
+	var name string
+	name, s = encoding.ReadString(s)
+	ndata, err := encoding.DecodeString(name)
+	if err != nil {
+		return err
+	}
+	e.Name = string(ndata)
 	s = strings.Trim(s, encoding.Whitespace)
 	el, _ := encoding.ReadElement(s)
-	etype, erest := encoding.ReadToken(el[1:])
-	erest = erest[:len(erest)-1]
+	if !strings.HasPrefix(el, "(") {
+		return fmt.Errorf("Export \"%s\" doesn't say what to export", e.Name)
+	}
+	etype, erest := encoding.ReadToken(el[1 : len(el)-1])
+	erest = strings.Trim(erest, encoding.Whitespace)
 	if etype == "memory" {
 		e.Type = types.ExportMem
 		idx, err := strconv.Atoi(erest)
@@ -656,59 +1098,158 @@ func (e *ExportEntry) DecodeWat(d string, wf *WasmFile) error {
 			e.Index = idx
 
 		}
+	} else if etype == "global" {
+		e.Type = types.ExportGlobal
+		if strings.HasPrefix(erest, "$") {
+			gname, _ := encoding.ReadToken(erest)
+			gid := wf.Debug.LookupGlobalID(gname)
+			if gid == -1 {
+				return fmt.Errorf("Global %s not found in export", gname)
+			}
+			e.Index = gid
+		} else {
+			idx, err := strconv.Atoi(erest)
+			if err != nil {
+				return err
+			}
+			e.Index = idx
+		}
+	} else if etype == "table" {
+		e.Type = types.ExportTable
+		idx, err := strconv.Atoi(erest)
+		if err != nil {
+			return err
+		}
+		e.Index = idx
 	} else {
-		return errors.New("TODO: Support other exports")
+		return fmt.Errorf("Unsupported export type %s", etype)
 	}
 
 	return nil
 }
 
-func (e *ElemEntry) DecodeWat(d string, wf *WasmFile) error {
-	// (elem (;0;) (i32.const 1) func $runtime.memequal $runtime.hash32)
-	e.TableIndex = 0 // For now only one table
-
-	s := strings.Trim(d[5:len(d)-1], encoding.Whitespace)
-	s = encoding.SkipComment(s)
-
+/**
+ * Read the offset of an active segment, eg (i32.const 1024), (offset (i32.const 1024)) or (offset i32.const 1024).
+ *
+ */
+func readWatOffset(s string) ([]*expression.Expression, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		tok, _ := encoding.ReadToken(s)
+		return nil, s, fmt.Errorf("Expected an offset, found %s", tok)
+	}
 	expr, s := encoding.ReadElement(s)
-	// Read the expression
-	expr = expr[1 : len(expr)-1]
+	expr = strings.Trim(expr[1:len(expr)-1], encoding.Whitespace)
+	tok, rest := encoding.ReadToken(expr)
+	if tok == "offset" {
+		expr = rest
+		if strings.HasPrefix(expr, "(") {
+			expr, _ = encoding.ReadElement(expr)
+			expr = strings.Trim(expr[1:len(expr)-1], encoding.Whitespace)
+		}
+	}
 	// TODO: Support proper expressions. For now we only support a single instruction
-	e.Offset = make([]*expression.Expression, 0)
 	ex := &expression.Expression{}
 	err := ex.DecodeWat(expr, nil)
+	if err != nil {
+		return nil, s, err
+	}
+	return []*expression.Expression{ex}, s, nil
+}
+
+/**
+ * Read the (memory x) or (table x) of a segment, or the older form which just has the index before the offset.
+ *
+ */
+func readWatSegmentTarget(s string, target string) (string, string, bool) {
+	if strings.HasPrefix(s, "(") {
+		el, rest := encoding.ReadElement(s)
+		tok, args := encoding.ReadToken(el[1 : len(el)-1])
+		if tok == target {
+			return strings.Trim(args, encoding.Whitespace), rest, true
+		}
+	} else if len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+		idx, rest := encoding.ReadToken(s)
+		if strings.HasPrefix(rest, "(") {
+			return idx, rest, true
+		}
+	}
+	return "", s, false
+}
+
+func (e *ElemEntry) DecodeWat(d string, wf *WasmFile) error {
+	// (elem (;0;) (i32.const 1) func $runtime.memequal $runtime.hash32)
+	// (elem (table 0) (offset (i32.const 1)) funcref (ref.func $f) (item ref.func $g))
+	// (elem (i32.const 1) $f $g)
+
+	s, err := encoding.SkipComment(strings.Trim(d[5:len(d)-1], encoding.Whitespace))
+	if err != nil {
+		return err
+	}
+	// Elems can have an identifier, but nothing refers to them atm
+	if len(s) > 0 && s[0] == '$' {
+		_, s = encoding.ReadToken(s)
+	}
+
+	table, s, found := readWatSegmentTarget(s, "table")
+	e.TableIndex = 0 // For now only one table
+	if found && table != "0" {
+		return fmt.Errorf("Only table 0 supported atm (%s)", table)
+	}
+
+	e.Offset, s, err = readWatOffset(s)
 	if err != nil {
 		return err
 	}
-	e.Offset = append(e.Offset, ex)
 
 	s = strings.Trim(s, encoding.Whitespace)
-	var elemType string
-	elemType, s = encoding.ReadToken(s)
-	if elemType == "func" {
-		for {
-			s = strings.Trim(s, encoding.Whitespace)
-			if len(s) == 0 {
-				break
+	if len(s) > 0 && s[0] != '(' && s[0] != '$' && (s[0] < '0' || s[0] > '9') {
+		var elemType string
+		elemType, s = encoding.ReadToken(s)
+		if elemType != "func" && elemType != "funcref" {
+			return fmt.Errorf("Unknown type for elem %s", elemType)
+		}
+	}
+
+	e.Indexes = make([]uint64, 0)
+	for {
+		s = strings.Trim(s, encoding.Whitespace)
+		if len(s) == 0 {
+			break
+		}
+		var fid string
+		var findex int
+		if s[0] == '(' {
+			// eg (ref.func $f), (item ref.func $f) or (item (ref.func $f))
+			var item string
+			item, s = encoding.ReadElement(s)
+			item = strings.Trim(item[1:len(item)-1], encoding.Whitespace)
+			tok, rest := encoding.ReadToken(item)
+			if tok == "item" {
+				item = strings.Trim(rest, encoding.Whitespace)
+				if strings.HasPrefix(item, "(") {
+					item = strings.Trim(item[1:len(item)-1], encoding.Whitespace)
+				}
+				tok, rest = encoding.ReadToken(item)
+			}
+			if tok != "ref.func" {
+				return fmt.Errorf("Only ref.func supported in elem atm (%s)", item)
 			}
-			var fid string
-			var findex int
+			fid, _ = encoding.ReadToken(rest)
+		} else {
 			fid, s = encoding.ReadToken(s)
-			if strings.HasPrefix(fid, "$") {
-				findex = wf.Debug.LookupFunctionID(fid)
-				if findex == -1 {
-					return fmt.Errorf("Function not found %s", fid)
-				}
-			} else {
-				findex, err = strconv.Atoi(fid)
-				if err != nil {
-					return err
-				}
+		}
+		if strings.HasPrefix(fid, "$") {
+			findex = wf.Debug.LookupFunctionID(fid)
+			if findex == -1 {
+				return fmt.Errorf("Function not found %s", fid)
+			}
+		} else {
+			findex, err = strconv.Atoi(fid)
+			if err != nil {
+				return err
 			}
-			e.Indexes = append(e.Indexes, uint64(findex))
 		}
-	} else {
-		return fmt.Errorf("Unknown type for elem %s", elemType)
+		e.Indexes = append(e.Indexes, uint64(findex))
 	}
 
 	return nil
@@ -716,31 +1257,34 @@ func (e *ElemEntry) DecodeWat(d string, wf *WasmFile) error {
 
 func (e *DataEntry) DecodeWat(d string, wf *WasmFile) error {
 	//	* (data $.data (i32.const 66160) "x\9c\19\f6\dc\02\01\00\00\00\00\00\9c\03\01\00\c1\82\01\00\00\00\00\00\04\00\00\00\0c\00\00\00\01\00\00\00\00\00\00\00\01\00\00\00\00\00\00\00\02\00\00\00\a8\02\01\00\98\01\00\00\01\00\00\00\ff\01\01\00\0b\00\00\00\00\00\00\00 \01\01\00\13\00\00\003\01\01\00\13"))
+	//	* (data (;0;) (memory 0) (offset (i32.const 1024)) "hello")
 	//	* (data $.data 10)
 	//	* (data $.data "hello world")
 
-	s := strings.Trim(d[5:len(d)-1], encoding.Whitespace)
+	s, err := encoding.SkipComment(strings.Trim(d[5:len(d)-1], encoding.Whitespace))
+	if err != nil {
+		return err
+	}
 	var id string
 
-	if s[0] == '$' {
+	if len(s) > 0 && s[0] == '$' {
 		id, s = encoding.ReadToken(s)
 		wf.RegisterNextDataName(id)
 	}
 	s = strings.Trim(s, encoding.Whitespace)
-	if s[0] == '(' {
+
+	mem, s, found := readWatSegmentTarget(s, "memory")
+	if found && mem != "0" {
+		return fmt.Errorf("Only memory 0 supported atm (%s)", mem)
+	}
+
+	if len(s) > 0 && s[0] == '(' {
 		// Must have a specific Offset already set
-		var expr string
-		expr, s = encoding.ReadElement(s)
-		// Read the expression
-		expr = expr[1 : len(expr)-1]
-		// TODO: Support proper expressions. For now we only support a single instruction
-		e.Offset = make([]*expression.Expression, 0)
-		ex := &expression.Expression{}
-		err := ex.DecodeWat(expr, nil)
+		var err error
+		e.Offset, s, err = readWatOffset(s)
 		if err != nil {
 			return err
 		}
-		e.Offset = append(e.Offset, ex)
 	} else {
 		// Assume this data should go right after the last bit of data... (Aligned)
 		data_ptr := int32(0)
@@ -762,27 +1306,16 @@ func (e *DataEntry) DecodeWat(d string, wf *WasmFile) error {
 
 	s = strings.Trim(s, encoding.Whitespace)
 
-	if s[0] == '"' {
-		// Parse the data
-		s = s[1 : len(s)-1]
-		for {
-			if len(s) == 0 {
-				break
-			}
-			// TODO: \r\n\t
-			if s[0] == '\\' {
-				// Parse the byte value...
-				bval := s[1:3]
-				bv, err := strconv.ParseInt(bval, 16, 32)
-				if err != nil {
-					return err
-				}
-				e.Data = append(e.Data, byte(bv))
-				s = s[3:]
-			} else {
-				e.Data = append(e.Data, byte(s[0]))
-				s = s[1:]
+	if len(s) == 0 || s[0] == '"' {
+		// Parse the data, which can be split over several strings
+		for len(s) > 0 {
+			var str string
+			str, s = encoding.ReadString(s)
+			data, err := encoding.DecodeString(str)
+			if err != nil {
+				return err
 			}
+			e.Data = append(e.Data, data...)
 		}
 	} else {
 		// Assume it's a number...
@@ -790,6 +1323,9 @@ func (e *DataEntry) DecodeWat(d string, wf *WasmFile) error {
 		if err != nil {
 			return err
 		}
+		if length < 0 || length > wasmMaxPages*wasmPageSize {
+			return fmt.Errorf("Invalid data length %d", length)
+		}
 		e.Data = make([]byte, length)
 	}
 
@@ -0,0 +1,159 @@
+package wasmfile
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeWatErrors(t *testing.T) {
+	for _, c := range []struct {
+		wat string
+		err string
+	}{
+		{"(module\n  (func $f (result i32)\n    i32.const 1\n       i32.cnst 2\n  )\n)\n", `test.wat:4:8: unknown instruction "i32.cnst"`},
+		{"(module\n  (func $f\n    local.get $x\n  )\n)\n", `test.wat:3:5: Local name $x not found`},
+		{"(module\n  (memory 1)\n\n  (nonsense 1)\n)\n", `test.wat:4:3: unknown element "nonsense"`},
+		{"(module\n  (func $f\n    global.get\n  )\n)\n", `test.wat:3:5: strconv.Atoi: parsing "": invalid syntax`},
+		{"(modul)", `test.wat:1:1: Invalid module. Expected 'module'`},
+		{"(module\n  (memory 1) (; oops\n)\n", `test.wat:2:14: Unclosed (; ;) comment`},
+		{"(module\n  (memory 1)\n;; end", `test.wat:3:1: The file ends in a ;; comment, before the module is closed`},
+		{"(module\n  (memory 1)\n", `test.wat:2:3: The element isn't closed with ), or the module isn't`},
+		{"(module\n  (export \"x\")\n)\n", `test.wat:2:3: Export "x" doesn't say what to export`},
+		{"(module (data $d 99999999999))", `test.wat:1:9: Invalid data length 99999999999`},
+	} {
+		wf := &WasmFile{}
+		err := wf.DecodeWatFile("test.wat", []byte(c.wat))
+		assert.EqualError(t, err, c.err)
+		var we *WatError
+		assert.True(t, errors.As(err, &we))
+	}
+
+	// Without a file name, there's just the position
+	wf := &WasmFile{}
+	err := wf.DecodeWat([]byte("(module\n  (func $f\n    nope\n  )\n)\n"))
+	assert.EqualError(t, err, `3:5: unknown instruction "nope"`)
+}
+
+func TestWatStrings(t *testing.T) {
+	wf := &WasmFile{}
+	err := wf.DecodeWat([]byte(`(module
+  (import "env" "say \22hi\22" (func $hi (type 0)))
+  (type (;0;) (func))
+  (memory 1)
+  (data $a (i32.const 16) "quote\" tab\t" "\u{263a}\ff")
+  (export "a\u{263a}" (memory 0))
+)`))
+	assert.NoError(t, err)
+	assert.Equal(t, "say \"hi\"", wf.Import[0].Name)
+	assert.Equal(t, "a☺", wf.Export[0].Name)
+	assert.Equal(t, []byte("quote\" tab\t☺\xff"), wf.Data[0].Data)
+
+	// Every byte survives a trip through wat
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(255 - i)
+	}
+	wf.Data[0].Data = data
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeWat(&buf))
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeWat(buf.Bytes()))
+	assert.Equal(t, data, wf2.Data[0].Data)
+	assert.Equal(t, wf.Import[0].Name, wf2.Import[0].Name)
+	assert.Equal(t, wf.Export[0].Name, wf2.Export[0].Name)
+}
+
+func TestWatInlineImportExport(t *testing.T) {
+	wf := &WasmFile{}
+	err := wf.DecodeWat([]byte(`(module
+  (type (func (param i32)))
+  (func $log (import "env" "log") (type 0))
+  (func $now (import "env" "now") (result i64))
+  (memory (export "memory") 2)
+  (global $count (export "count") (mut i32) (i32.const 0))
+  (func $inc (export "inc") (export "increment")
+    global.get $count
+    i32.const 1
+    i32.add
+    global.set $count
+    global.get $count
+    call $log
+  )
+  (export "log" (func $log))
+)`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(wf.Import))
+	assert.Equal(t, ImportEntry{Module: "env", Name: "log", Type: types.ExportFunc, Index: 0}, *wf.Import[0])
+	assert.Equal(t, "now", wf.Import[1].Name)
+	assert.Equal(t, []types.ValType{types.ValI64}, wf.Type[wf.Import[1].Index].Result)
+	assert.Equal(t, 1, len(wf.Function))
+	assert.Equal(t, 1, len(wf.Code))
+	assert.Equal(t, 6, len(wf.Code[0].Expression))
+	assert.Equal(t, 2, wf.Debug.LookupFunctionID("$inc"))
+
+	assert.Equal(t, []*ExportEntry{
+		{Name: "memory", Type: types.ExportMem, Index: 0},
+		{Name: "count", Type: types.ExportGlobal, Index: 0},
+		{Name: "inc", Type: types.ExportFunc, Index: 2},
+		{Name: "increment", Type: types.ExportFunc, Index: 2},
+		{Name: "log", Type: types.ExportFunc, Index: 0},
+	}, wf.Export)
+
+	// Only functions can be imported
+	wf = &WasmFile{}
+	err = wf.DecodeWat([]byte("(module\n  (memory (import \"env\" \"mem\") 1)\n)\n"))
+	assert.EqualError(t, err, `2:3: Only func imports are supported (memory)`)
+}
+
+func TestWatInlineSegments(t *testing.T) {
+	wf := &WasmFile{}
+	err := wf.DecodeWat([]byte(`(module
+  (type (;0;) (func (result i32)))
+  (table funcref (elem $one $two))
+  (memory (data "hello" " world"))
+  (func $one (type 0)
+    i32.const 1
+  )
+  (func $two (type 0)
+    i32.const 2
+  )
+  (elem (;1;) (table 0) (offset (i32.const 1)) funcref (item ref.func $one))
+  (elem (i32.const 0) $two)
+  (data (;1;) (memory 0) (offset i32.const 16) "abc")
+  (data 0 (i32.const 32) "def")
+)`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, TableEntry{TableType: types.TableTypeFuncref, LimitMin: 2, LimitMax: 2}, *wf.Table[0])
+	assert.Equal(t, MemoryEntry{LimitMin: 1, LimitMax: 1}, *wf.Memory[0])
+
+	assert.Equal(t, 3, len(wf.Elem))
+	assert.Equal(t, []uint64{0, 1}, wf.Elem[0].Indexes)
+	assert.Equal(t, int32(0), wf.Elem[0].Offset[0].I32Value)
+	assert.Equal(t, []uint64{0}, wf.Elem[1].Indexes)
+	assert.Equal(t, int32(1), wf.Elem[1].Offset[0].I32Value)
+	assert.Equal(t, []uint64{1}, wf.Elem[2].Indexes)
+
+	assert.Equal(t, 3, len(wf.Data))
+	assert.Equal(t, []byte("hello world"), wf.Data[0].Data)
+	assert.Equal(t, int32(0), wf.Data[0].Offset[0].I32Value)
+	assert.Equal(t, []byte("abc"), wf.Data[1].Data)
+	assert.Equal(t, int32(16), wf.Data[1].Offset[0].I32Value)
+	assert.Equal(t, int32(32), wf.Data[2].Offset[0].I32Value)
+
+	// Limits can still be given
+	wf = &WasmFile{}
+	err = wf.DecodeWat([]byte("(module\n  (memory 1 2 (data \"x\"))\n)\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, MemoryEntry{LimitMin: 1, LimitMax: 2}, *wf.Memory[0])
+	assert.Equal(t, []byte("x"), wf.Data[0].Data)
+
+	wf = &WasmFile{}
+	err = wf.DecodeWat([]byte("(module\n  (memory 1)\n  (data (memory 1) (i32.const 0) \"x\")\n)\n"))
+	assert.EqualError(t, err, `3:3: Only memory 0 supported atm (1)`)
+}
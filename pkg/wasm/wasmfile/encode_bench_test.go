@@ -0,0 +1,67 @@
+package wasmfile
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// A module with lots of functions, using most kinds of immediate
+func benchModule(b *testing.B) *WasmFile {
+	var sb strings.Builder
+	sb.WriteString("(module\n  (memory 1)\n  (global $g (mut i32) (i32.const 0))\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&sb, `  (func $f%d (param i32) (result i32)
+    (local i64 f64)
+    block
+    local.get 0
+    i32.load offset=8 align=4
+    global.get $g
+    i32.add
+    i64.const 1234567890
+    local.set 1
+    f64.const 3.25
+    local.set 2
+    local.get 0
+    br_if 0
+    drop
+    end
+    local.get 0
+    call %d
+  )
+`, i, i)
+	}
+	sb.WriteString(")\n")
+
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte(sb.String()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return wf
+}
+
+func BenchmarkEncodeWat(b *testing.B) {
+	wf := benchModule(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := wf.EncodeWat(io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeBinary(b *testing.B) {
+	wf := benchModule(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := wf.EncodeBinary(io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package wasmfile
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/encoding"
@@ -33,242 +34,258 @@ func writeSectionHeader(w io.Writer, s byte, length int) error {
 	return err
 }
 
-func (wf *WasmFile) EncodeBinary(w io.Writer) error {
-	header := make([]byte, 8)
-	binary.LittleEndian.PutUint32(header, WasmHeader)
-	binary.LittleEndian.PutUint32(header[4:], WasmVersion)
-	_, err := w.Write(header)
+// countingWriter discards everything written to it, but keeps track of the length.
+type countingWriter struct {
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += len(p)
+	return len(p), nil
+}
+
+/**
+ * Write a section straight to the writer.
+ * The body is encoded twice. Once to find the length for the section header, and then for real.
+ * This means we never need to hold a whole section in memory.
+ */
+func writeSection(w io.Writer, s types.SectionId, encode func(w io.Writer) error) error {
+	var cw countingWriter
+	err := encode(&cw)
 	if err != nil {
 		return err
 	}
 
-	// Section Type
-	if len(wf.Type) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Type)))
-		for _, t := range wf.Type {
-			err = t.EncodeBinary(&buf)
-			if err != nil {
-				return err
-			}
-		}
+	err = writeSectionHeader(w, byte(s), cw.n)
+	if err != nil {
+		return err
+	}
 
-		// Write a single type section
-		writeSectionHeader(w, byte(types.SectionType), buf.Len())
-		_, err = w.Write(buf.Bytes())
+	return encode(w)
+}
+
+/**
+ * Write a vector section, where each entry knows how to encode itself.
+ *
+ */
+func writeVectorSection[T interface{ EncodeBinary(io.Writer) error }](w io.Writer, s types.SectionId, entries []T) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return writeSection(w, s, func(w io.Writer) error {
+		err := encoding.WriteUvarint(w, uint64(len(entries)))
 		if err != nil {
 			return err
 		}
-	}
-
-	// Section Import
-	if len(wf.Import) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Import)))
-		for _, i := range wf.Import {
-			err = i.EncodeBinary(&buf)
+		for _, e := range entries {
+			err = e.EncodeBinary(w)
 			if err != nil {
 				return err
 			}
 		}
+		return nil
+	})
+}
 
-		// Write a single import section
-		writeSectionHeader(w, byte(types.SectionImport), buf.Len())
-		_, err = w.Write(buf.Bytes())
-		if err != nil {
-			return err
+/**
+ * Encode each function body. Function bodies are independent, so they're encoded in parallel.
+ * With useOriginal, bodies which aren't dirty are copied as they were.
+ */
+func encodeCodeBodies(entries []*CodeEntry, useOriginal bool) ([][]byte, error) {
+	encoded := make([][]byte, len(entries))
+	err := parallelFor(len(entries), func(i int) error {
+		if useOriginal && entries[i].clean() {
+			original := entries[i].original
+			encoded[i] = append(binary.AppendUvarint(nil, uint64(len(original))), original...)
+			return nil
 		}
+		var buf bytes.Buffer
+		err := entries[i].EncodeBinary(&buf)
+		encoded[i] = buf.Bytes()
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return encoded, nil
+}
 
-	// Section Function
-	if len(wf.Function) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Function)))
-		for _, f := range wf.Function {
-			err = f.EncodeBinary(&buf)
-			if err != nil {
-				return err
-			}
-		}
+// Encode the code section body, with the bodies put together in order.
+func encodeCodeVector(entries []*CodeEntry, useOriginal bool) ([]byte, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	encoded, err := encodeCodeBodies(entries, useOriginal)
+	if err != nil {
+		return nil, err
+	}
 
-		// Write a single function section
-		writeSectionHeader(w, byte(types.SectionFunction), buf.Len())
-		_, err = w.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
+	var buf bytes.Buffer
+	err = encoding.WriteUvarint(&buf, uint64(len(entries)))
+	if err != nil {
+		return nil, err
 	}
+	for _, e := range encoded {
+		buf.Write(e)
+	}
+	return buf.Bytes(), nil
+}
 
-	// Section Table
-	if len(wf.Table) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Table)))
-		for _, t := range wf.Table {
-			err = t.EncodeBinary(&buf)
-			if err != nil {
-				return err
-			}
-		}
+// The code section is encoded this many bodies at a time, so only a chunk of it is held in memory.
+const codeChunk = 256
 
-		// Write a single table section
-		writeSectionHeader(w, byte(types.SectionTable), buf.Len())
-		_, err = w.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
+/**
+ * Write the code section. Like writeSection, the bodies are encoded twice. First to find their
+ * lengths for the section header, and then a chunk at a time, which is written straight to the writer in order.
+ * Both passes encode the bodies in parallel.
+ */
+func writeCodeSection(w io.Writer, entries []*CodeEntry) error {
+	if len(entries) == 0 {
+		return nil
 	}
 
-	// Section Memory
-	if len(wf.Memory) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Memory)))
-		for _, t := range wf.Memory {
-			err = t.EncodeBinary(&buf)
-			if err != nil {
-				return err
-			}
-		}
+	lengths := make([]int, len(entries))
+	err := parallelFor(len(entries), func(i int) error {
+		var cw countingWriter
+		err := entries[i].EncodeBinary(&cw)
+		lengths[i] = cw.n
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-		// Write a single memory section
-		writeSectionHeader(w, byte(types.SectionMemory), buf.Len())
-		_, err = w.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
+	count := binary.AppendUvarint(nil, uint64(len(entries)))
+	length := len(count)
+	for _, l := range lengths {
+		length += l
 	}
 
-	// Section Global
-	if len(wf.Global) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Global)))
-		for _, t := range wf.Global {
-			err = t.EncodeBinary(&buf)
-			if err != nil {
-				return err
-			}
-		}
+	err = writeSectionHeader(w, byte(types.SectionCode), length)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(count)
+	if err != nil {
+		return err
+	}
 
-		// Write a single memory section
-		writeSectionHeader(w, byte(types.SectionGlobal), buf.Len())
-		_, err = w.Write(buf.Bytes())
+	for start := 0; start < len(entries); start += codeChunk {
+		end := start + codeChunk
+		if end > len(entries) {
+			end = len(entries)
+		}
+		encoded, err := encodeCodeBodies(entries[start:end], false)
 		if err != nil {
 			return err
 		}
-	}
-
-	// Section Export
-	if len(wf.Export) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Export)))
-		for _, t := range wf.Export {
-			err = t.EncodeBinary(&buf)
+		for i, e := range encoded {
+			if len(e) != lengths[start+i] {
+				return fmt.Errorf("Function body %d changed length while it was encoded", start+i)
+			}
+			_, err = w.Write(e)
 			if err != nil {
 				return err
 			}
 		}
+	}
+	return nil
+}
 
-		// Write a single export section
-		writeSectionHeader(w, byte(types.SectionExport), buf.Len())
-		_, err = w.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
+func (wf *WasmFile) EncodeBinary(w io.Writer) error {
+	if wf.Layout != nil {
+		return wf.encodeBinaryLayout(w)
 	}
 
-	// TODO StartSection
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, WasmHeader)
+	binary.LittleEndian.PutUint32(header[4:], WasmVersion)
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
 
-	// Section Elem
-	if len(wf.Elem) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Elem)))
-		for _, t := range wf.Elem {
-			err = t.EncodeBinary(&buf)
-			if err != nil {
-				return err
-			}
-		}
+	err = writeVectorSection(w, types.SectionType, wf.Type)
+	if err != nil {
+		return err
+	}
 
-		// Write a single elem section
-		writeSectionHeader(w, byte(types.SectionElem), buf.Len())
-		_, err = w.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
+	err = writeVectorSection(w, types.SectionImport, wf.Import)
+	if err != nil {
+		return err
 	}
 
-	// Section DataCount
-	var buf bytes.Buffer
-	encoding.WriteUvarint(&buf, uint64(len(wf.Data)))
+	err = writeVectorSection(w, types.SectionFunction, wf.Function)
+	if err != nil {
+		return err
+	}
 
-	// Write a single data count section
-	writeSectionHeader(w, byte(types.SectionDataCount), buf.Len())
-	_, err = w.Write(buf.Bytes())
+	err = writeVectorSection(w, types.SectionTable, wf.Table)
 	if err != nil {
 		return err
 	}
 
-	// Section Code
-	if len(wf.Code) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Code)))
-		for _, c := range wf.Code {
-			err = c.EncodeBinary(&buf)
-			if err != nil {
-				return err
-			}
-		}
+	err = writeVectorSection(w, types.SectionMemory, wf.Memory)
+	if err != nil {
+		return err
+	}
 
-		// Write a single code section
-		writeSectionHeader(w, byte(types.SectionCode), buf.Len())
-		_, err = w.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
+	err = writeVectorSection(w, types.SectionGlobal, wf.Global)
+	if err != nil {
+		return err
 	}
 
-	// Section Data
-	if len(wf.Data) > 0 {
-		var buf bytes.Buffer
-		encoding.WriteUvarint(&buf, uint64(len(wf.Data)))
-		for _, t := range wf.Data {
-			err = t.EncodeBinary(&buf)
-			if err != nil {
-				return err
-			}
-		}
+	err = writeVectorSection(w, types.SectionExport, wf.Export)
+	if err != nil {
+		return err
+	}
 
-		// Write a single data section
-		writeSectionHeader(w, byte(types.SectionData), buf.Len())
-		_, err = w.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
+	// TODO StartSection
+
+	err = writeVectorSection(w, types.SectionElem, wf.Elem)
+	if err != nil {
+		return err
 	}
 
-	// Section Custom
-	if len(wf.Custom) > 0 {
-		for _, c := range wf.Custom {
-			var buf bytes.Buffer
-			// Write the name, and the data...
-			encoding.WriteString(&buf, c.Name)
-			// Now write the data into &buf
-			_, err := buf.Write(c.Data)
-			if err != nil {
-				return err
-			}
+	// Section DataCount
+	err = writeSection(w, types.SectionDataCount, func(w io.Writer) error {
+		return encoding.WriteUvarint(w, uint64(len(wf.Data)))
+	})
+	if err != nil {
+		return err
+	}
 
-			// Write a single type section
-			writeSectionHeader(w, byte(types.SectionCustom), buf.Len())
-			_, err = w.Write(buf.Bytes())
-			if err != nil {
-				return err
-			}
+	err = writeCodeSection(w, wf.Code)
+	if err != nil {
+		return err
+	}
+
+	err = writeVectorSection(w, types.SectionData, wf.Data)
+	if err != nil {
+		return err
+	}
+
+	// Section Custom
+	for _, c := range wf.Custom {
+		err = writeSection(w, types.SectionCustom, c.EncodeBinary)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+func (c *CustomEntry) EncodeBinary(w io.Writer) error {
+	// Write the name, and the data...
+	err := encoding.WriteString(w, c.Name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(c.Data)
+	return err
+}
+
 func (ie *ImportEntry) EncodeBinary(w io.Writer) error {
 	err := encoding.WriteString(w, ie.Module)
 	if err != nil {
@@ -350,7 +367,11 @@ func (c *TableEntry) EncodeBinary(w io.Writer) error {
 func (c *MemoryEntry) EncodeBinary(w io.Writer) error {
 	var buf bytes.Buffer
 
-	if c.LimitMax == 0 { // TODO: Fixme
+	if c.Shared {
+		buf.WriteByte(types.LimitTypeMinMaxShared)
+		encoding.WriteUvarint(&buf, uint64(c.LimitMin))
+		encoding.WriteUvarint(&buf, uint64(c.LimitMax))
+	} else if c.LimitMax == 0 { // TODO: Fixme
 		buf.WriteByte(types.LimitTypeMin)
 		encoding.WriteUvarint(&buf, uint64(c.LimitMin))
 	} else {
@@ -391,27 +412,27 @@ func (c *ExportEntry) EncodeBinary(w io.Writer) error {
 }
 
 func (c *CodeEntry) EncodeBinary(w io.Writer) error {
-	var buf bytes.Buffer
+	body := make([]byte, 0, 4*len(c.Expression)+len(c.Locals)*2+8)
 
-	encoding.WriteUvarint(&buf, uint64(len(c.Locals)))
+	body = binary.AppendUvarint(body, uint64(len(c.Locals)))
 	for _, l := range c.Locals {
-		encoding.WriteUvarint(&buf, 1)
-		buf.WriteByte(byte(l))
+		body = append(body, 1, byte(l))
 	}
 
+	var err error
 	for _, e := range c.Expression {
-		err := e.EncodeBinary(&buf)
+		body, err = e.AppendBinary(body)
 		if err != nil {
 			return err
 		}
 	}
-	buf.WriteByte(0x0b) // END
+	body = append(body, 0x0b) // END
 
-	err := encoding.WriteUvarint(w, uint64(buf.Len()))
+	err = encoding.WriteUvarint(w, uint64(len(body)))
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(buf.Bytes())
+	_, err = w.Write(body)
 	return err
 }
 
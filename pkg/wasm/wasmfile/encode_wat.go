@@ -23,6 +23,8 @@ import (
 	"io"
 	"strings"
 
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/encoding"
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
 )
 
@@ -77,7 +79,7 @@ func (wf *WasmFile) EncodeWat(w io.Writer) error {
 			exp = fmt.Sprintf("(table %d)", t.Index)
 		}
 
-		edata := fmt.Sprintf("    (import \"%s\" \"%s\" %s)\n", t.Module, t.Name, exp)
+		edata := fmt.Sprintf("    (import \"%s\" \"%s\" %s)\n", encoding.EscapeString([]byte(t.Module)), encoding.EscapeString([]byte(t.Name)), exp)
 		_, err = wr.WriteString(edata)
 		if err != nil {
 			return err
@@ -111,9 +113,12 @@ func (wf *WasmFile) EncodeWat(w io.Writer) error {
 	// #### Write out Memory
 	for _, m := range wf.Memory {
 		limits := fmt.Sprintf("%d", m.LimitMin)
-		if m.LimitMax != 0 {
+		if m.LimitMax != 0 || m.Shared {
 			limits = fmt.Sprintf("%s %d", limits, m.LimitMax)
 		}
+		if m.Shared {
+			limits = limits + " shared"
+		}
 
 		mdata := fmt.Sprintf("    (memory %s)\n", limits)
 		_, err = wr.WriteString(mdata)
@@ -139,78 +144,11 @@ func (wf *WasmFile) EncodeWat(w io.Writer) error {
 	}
 
 	// #### Write out Function/Code
-	for index, code := range wf.Code {
-		function := wf.Function[index]
-		tindex := function.TypeIndex
-		typedata := wf.Type[tindex]
-
-		params := ""
-		results := ""
-
-		if len(typedata.Param) > 0 {
-			for index, p := range typedata.Param {
-				comment := ""
-				vname := wf.Debug.GetLocalVarName(code.CodeSectionPtr, index)
-				if vname != "" {
-					comment = " ;; " + vname
-				}
-
-				params = fmt.Sprintf("%s\n        (param %s)%s", params, types.ByteToValType[p], comment)
-			}
-		}
-
-		if len(typedata.Result) > 0 {
-			results = "        (result"
-			for _, p := range typedata.Result {
-				results = results + " " + types.ByteToValType[p]
-			}
-			results = results + ")\n"
-		}
-
-		f := wf.Debug.GetFunctionIdentifier(index+len(wf.Import), true)
-
-		// Encode it and send it out...
-		d := wf.Debug.GetFunctionDebug(index + len(wf.Import))
-		tdata := fmt.Sprintf("\n    (func %s (type %d) ;; function_index=%d\n%s%s\n%s", f, tindex, index, d, params, results)
-		_, err = wr.WriteString(tdata)
+	for index := range wf.Code {
+		err = wf.EncodeFunctionWat(wr, index)
 		if err != nil {
 			return err
 		}
-
-		// Write out locals...
-		for _, l := range code.Locals {
-			_, err = wr.WriteString(fmt.Sprintf("        (local %s)\n", types.ByteToValType[l]))
-			if err != nil {
-				return err
-			}
-		}
-
-		var buf bytes.Buffer
-		for _, e := range code.Expression {
-			err = e.EncodeWat(&buf, "        ", wf.Debug)
-			if err != nil {
-				return err
-			}
-		}
-
-		_, err = wr.Write(buf.Bytes())
-		if err != nil {
-			return err
-		}
-
-		// Bit of a special case here. We know the function ends with an END opcode...
-		lastAddr := code.CodeSectionPtr + code.CodeSectionLen - 1
-		lineNumberData := wf.Debug.GetLineNumberInfo(lastAddr)
-		comment := ""
-		if lineNumberData != "" {
-			comment = fmt.Sprintf(" ;; Src = %s", lineNumberData)
-		}
-
-		_, err = wr.WriteString(fmt.Sprintf("    )%s\n", comment))
-		if err != nil {
-			return err
-		}
-
 	}
 
 	// #### Write out Export
@@ -226,7 +164,7 @@ func (wf *WasmFile) EncodeWat(w io.Writer) error {
 			exp = fmt.Sprintf("(table %d)", t.Index)
 		}
 
-		edata := fmt.Sprintf("    (export \"%s\" %s)\n", t.Name, exp)
+		edata := fmt.Sprintf("    (export \"%s\" %s)\n", encoding.EscapeString([]byte(t.Name)), exp)
 		_, err = wr.WriteString(edata)
 		if err != nil {
 			return err
@@ -287,15 +225,137 @@ func (wf *WasmFile) EncodeWat(w io.Writer) error {
 	return err
 }
 
-func (d *DataEntry) GetStringEncodedData() string {
-	allowed := "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ "
-	var buf bytes.Buffer
-	for _, b := range d.Data {
-		if strings.Index(allowed, string(rune(b))) != -1 {
-			buf.WriteRune(rune(b))
-		} else {
-			buf.WriteString(fmt.Sprintf("\\%02x", b))
+/**
+ * Write a single function out as wat. The index is into the code section.
+ *
+ */
+func (wf *WasmFile) EncodeFunctionWat(w io.Writer, index int) error {
+	if index < 0 || index >= len(wf.Code) || index >= len(wf.Function) {
+		return fmt.Errorf("Function code %d not found", index)
+	}
+	code := wf.Code[index]
+	function := wf.Function[index]
+	tindex := function.TypeIndex
+	if tindex < 0 || tindex >= len(wf.Type) {
+		return fmt.Errorf("Function code %d has an invalid type %d", index, tindex)
+	}
+	typedata := wf.Type[tindex]
+
+	params := ""
+	results := ""
+
+	// Params and locals with a name are declared with it, and used by it
+	wd := &functionWatDebug{
+		WasmDebug: wf.Debug,
+		locals:    wf.Debug.GetLocalIdentifiers(index+len(wf.Import), code.CodeSectionPtr, code.CodeSectionPtr+code.CodeSectionLen, len(typedata.Param)+len(code.Locals)),
+	}
+
+	if len(typedata.Param) > 0 {
+		for index, p := range typedata.Param {
+			comment := ""
+			vname := wf.Debug.GetLocalVarName(code.CodeSectionPtr, index)
+			if vname != "" && "$"+vname != wd.locals[index] {
+				comment = " ;; " + vname
+			}
+			id := ""
+			if wd.locals[index] != "" {
+				id = wd.locals[index] + " "
+			}
+
+			params = fmt.Sprintf("%s\n        (param %s%s)%s", params, id, types.ByteToValType[p], comment)
+		}
+	}
+
+	if len(typedata.Result) > 0 {
+		results = "        (result"
+		for _, p := range typedata.Result {
+			results = results + " " + types.ByteToValType[p]
 		}
+		results = results + ")\n"
+	}
+
+	f := wf.Debug.GetFunctionIdentifier(index+len(wf.Import), true)
+	mangled := ""
+	raw := wf.Debug.GetMangledName(index + len(wf.Import))
+	if raw != "" {
+		mangled = fmt.Sprintf(" mangled=%s", raw)
 	}
-	return buf.String()
+
+	// Encode it and send it out...
+	d := wf.Debug.GetFunctionDebug(index + len(wf.Import))
+	tdata := fmt.Sprintf("\n    (func %s (type %d) ;; function_index=%d%s\n%s%s\n%s", f, tindex, index, mangled, d, params, results)
+	_, err := io.WriteString(w, tdata)
+	if err != nil {
+		return err
+	}
+
+	// Write out locals, and then the body, into one buffer
+	var body []byte
+	for i, l := range code.Locals {
+		body = append(body, "        (local "...)
+		if wd.locals[len(typedata.Param)+i] != "" {
+			body = append(body, wd.locals[len(typedata.Param)+i]...)
+			body = append(body, ' ')
+		}
+		body = append(body, types.ByteToValType[l]...)
+		body = append(body, ")\n"...)
+	}
+
+	inlines := wf.Debug.GetInlinesInRange(code.CodeSectionPtr, code.CodeSectionPtr+code.CodeSectionLen)
+	if wf.FoldedWat {
+		body, err = wf.appendFoldedWat(body, code, typedata, wd, inlines)
+		if err != nil {
+			return err
+		}
+	} else {
+		lastInline := ""
+		for _, e := range code.Expression {
+			if len(inlines) > 0 {
+				inline := debug.FormatInlineStack(debug.InlineStackAt(inlines, e.PC))
+				if inline != lastInline && inline != "" {
+					body = append(body, "        ;; Inlined "...)
+					body = append(body, inline...)
+					body = append(body, '\n')
+				}
+				lastInline = inline
+			}
+			body, err = e.AppendWat(body, "        ", wd)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = w.Write(body)
+	if err != nil {
+		return err
+	}
+
+	// Bit of a special case here. We know the function ends with an END opcode...
+	lastAddr := code.CodeSectionPtr + code.CodeSectionLen - 1
+	lineNumberData := wf.Debug.GetLineNumberInfo(lastAddr)
+	comment := ""
+	if lineNumberData != "" {
+		comment = fmt.Sprintf(" ;; Src = %s", lineNumberData)
+	}
+
+	_, err = io.WriteString(w, fmt.Sprintf("    )%s\n", comment))
+	return err
+}
+
+// The debug context for writing a function, which also knows the identifiers of its locals
+type functionWatDebug struct {
+	*debug.WasmDebug
+	locals []string
+}
+
+func (wd *functionWatDebug) GetLocalIdentifier(localIdx int) string {
+	if localIdx < 0 || localIdx >= len(wd.locals) {
+		return ""
+	}
+	return wd.locals[localIdx]
+}
+
+func (d *DataEntry) GetStringEncodedData() string {
+	return encoding.EscapeString(d.Data)
 }
@@ -0,0 +1,279 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+// An instruction in folded wat, with the instructions that produce its operands, and for blocks the code inside
+type foldNode struct {
+	e        *expression.Expression
+	operands []*foldNode
+	results  int
+
+	body     []*foldNode
+	elseBody []*foldNode
+	elseExpr *expression.Expression
+	endExpr  *expression.Expression
+}
+
+// The instruction that runs first for a node
+func (n *foldNode) first() *expression.Expression {
+	if len(n.operands) > 0 {
+		return n.operands[0].first()
+	}
+	return n.e
+}
+
+type folder struct {
+	wf      *WasmFile
+	wd      expression.WasmDebugContext
+	code    []*expression.Expression
+	pos     int
+	locals  []types.ValType
+	results int
+	labels  []int // The number of values each enclosing label takes, innermost last
+
+	inlines    []*debug.InlineInfo
+	lastInline string
+}
+
+/**
+ * Append the body of a function as folded wat, with operands nested under the instruction that uses them.
+ * Nesting only changes how the code is written, since unfolding gives back the same instructions in the same order.
+ */
+func (wf *WasmFile) appendFoldedWat(b []byte, code *CodeEntry, typedata *TypeEntry, wd expression.WasmDebugContext, inlines []*debug.InlineInfo) ([]byte, error) {
+	f := &folder{
+		wf:      wf,
+		wd:      wd,
+		code:    code.Expression,
+		locals:  append(append([]types.ValType{}, typedata.Param...), code.Locals...),
+		results: len(typedata.Result),
+		labels:  []int{len(typedata.Result)},
+		inlines: inlines,
+	}
+	nodes, _ := f.fold()
+	return f.appendNodes(b, nodes, "        ")
+}
+
+// Fold instructions up to the next else or end (or the end of the function)
+func (f *folder) fold() ([]*foldNode, *expression.Expression) {
+	nodes := make([]*foldNode, 0)
+	for f.pos < len(f.code) {
+		e := f.code[f.pos]
+		f.pos++
+		if e.Opcode == expression.InstrToOpcode["end"] || e.Opcode == expression.InstrToOpcode["else"] {
+			return nodes, e
+		}
+
+		n := &foldNode{e: e}
+		params := 0
+		if e.Opcode == expression.InstrToOpcode["block"] ||
+			e.Opcode == expression.InstrToOpcode["loop"] ||
+			e.Opcode == expression.InstrToOpcode["if"] {
+			bparams, bresults, err := f.wf.blockType(e)
+			if err != nil {
+				bparams, bresults = nil, nil
+			}
+			n.results = len(bresults)
+			// Block params are left on the stack, but the condition of an if with no params can be folded
+			if e.Opcode == expression.InstrToOpcode["if"] && len(bparams) == 0 {
+				params = 1
+			}
+			if e.Opcode == expression.InstrToOpcode["loop"] {
+				f.labels = append(f.labels, len(bparams))
+			} else {
+				f.labels = append(f.labels, len(bresults))
+			}
+			var term *expression.Expression
+			n.body, term = f.fold()
+			if term != nil && term.Opcode == expression.InstrToOpcode["else"] {
+				n.elseExpr = term
+				n.elseBody, term = f.fold()
+			}
+			n.endExpr = term
+			f.labels = f.labels[:len(f.labels)-1]
+		} else {
+			params, n.results = f.effect(e)
+		}
+
+		n.operands, nodes = takeOperands(nodes, params)
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// How many values an instruction takes and leaves. Anything unknown just isn't folded.
+func (f *folder) effect(e *expression.Expression) (int, int) {
+	switch e.Opcode {
+	case expression.InstrToOpcode["drop"]:
+		return 1, 0
+	case expression.InstrToOpcode["select"]:
+		return 3, 1
+	case expression.InstrToOpcode["br"]:
+		return f.labelArity(e.LabelIndex), 0
+	case expression.InstrToOpcode["br_if"]:
+		arity := f.labelArity(e.LabelIndex)
+		return arity + 1, arity
+	case expression.InstrToOpcode["br_table"]:
+		return f.labelArity(e.LabelIndex) + 1, 0
+	case expression.InstrToOpcode["return"]:
+		return f.results, 0
+	}
+	params, results, err := f.wf.StackEffect(e, f.locals)
+	if err != nil {
+		return 0, 0
+	}
+	return len(params), len(results)
+}
+
+func (f *folder) labelArity(l int) int {
+	if l < 0 || l >= len(f.labels) {
+		return 0
+	}
+	return f.labels[len(f.labels)-1-l]
+}
+
+// Take the nodes that produce exactly the last n values, if there are any
+func takeOperands(nodes []*foldNode, n int) ([]*foldNode, []*foldNode) {
+	if n == 0 {
+		return nil, nodes
+	}
+	count := 0
+	i := len(nodes)
+	for i > 0 && count < n && nodes[i-1].results > 0 {
+		i--
+		count += nodes[i].results
+	}
+	if count != n {
+		return nil, nodes
+	}
+	return append([]*foldNode{}, nodes[i:]...), nodes[:i]
+}
+
+// Get the wat for a single instruction, and any comment to go after it
+func (f *folder) instrWat(e *expression.Expression) (string, string, error) {
+	line, err := e.AppendWat(nil, "", f.wd)
+	if err != nil {
+		return "", "", err
+	}
+	s := strings.TrimRight(string(line), "\n")
+	c := strings.Index(s, " ;; ")
+	if c == -1 {
+		return s, "", nil
+	}
+	return s[:c], s[c:], nil
+}
+
+func (f *folder) appendNodes(b []byte, nodes []*foldNode, indent string) ([]byte, error) {
+	var err error
+	for _, n := range nodes {
+		b, err = f.appendNode(b, n, indent)
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (f *folder) appendNode(b []byte, n *foldNode, indent string) ([]byte, error) {
+	if len(f.inlines) > 0 {
+		inline := debug.FormatInlineStack(debug.InlineStackAt(f.inlines, n.first().PC))
+		if inline != f.lastInline && inline != "" {
+			b = append(b, indent...)
+			b = append(b, ";; Inlined "...)
+			b = append(b, inline...)
+			b = append(b, '\n')
+		}
+		f.lastInline = inline
+	}
+
+	instr, comment, err := f.instrWat(n.e)
+	if err != nil {
+		return b, err
+	}
+
+	b = append(b, indent...)
+	b = append(b, '(')
+	b = append(b, instr...)
+
+	isBlock := n.e.Opcode == expression.InstrToOpcode["block"] ||
+		n.e.Opcode == expression.InstrToOpcode["loop"] ||
+		n.e.Opcode == expression.InstrToOpcode["if"]
+
+	if !isBlock && len(n.operands) == 0 {
+		b = append(b, ')')
+		b = append(b, comment...)
+		return append(b, '\n'), nil
+	}
+
+	b = append(b, comment...)
+	b = append(b, '\n')
+	inner := indent + "  "
+	b, err = f.appendNodes(b, n.operands, inner)
+	if err != nil {
+		return b, err
+	}
+
+	if n.e.Opcode == expression.InstrToOpcode["if"] {
+		b = append(b, inner...)
+		b = append(b, "(then\n"...)
+		b, err = f.appendNodes(b, n.body, inner+"  ")
+		if err != nil {
+			return b, err
+		}
+		b = append(b, inner...)
+		b = append(b, ")\n"...)
+		if n.elseExpr != nil {
+			_, elseComment, err := f.instrWat(n.elseExpr)
+			if err != nil {
+				return b, err
+			}
+			b = append(b, inner...)
+			b = append(b, "(else"...)
+			b = append(b, elseComment...)
+			b = append(b, '\n')
+			b, err = f.appendNodes(b, n.elseBody, inner+"  ")
+			if err != nil {
+				return b, err
+			}
+			b = append(b, inner...)
+			b = append(b, ")\n"...)
+		}
+	} else if isBlock {
+		b, err = f.appendNodes(b, n.body, inner)
+		if err != nil {
+			return b, err
+		}
+	}
+
+	b = append(b, indent...)
+	b = append(b, ')')
+	if n.endExpr != nil {
+		_, endComment, err := f.instrWat(n.endExpr)
+		if err != nil {
+			return b, err
+		}
+		b = append(b, endComment...)
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,86 @@
+package wasmfile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/stretchr/testify/assert"
+)
+
+// Unfold nodes back into the instructions they were made from
+func unfold(nodes []*foldNode) []*expression.Expression {
+	code := make([]*expression.Expression, 0)
+	for _, n := range nodes {
+		code = append(code, unfold(n.operands)...)
+		code = append(code, n.e)
+		code = append(code, unfold(n.body)...)
+		if n.elseExpr != nil {
+			code = append(code, n.elseExpr)
+			code = append(code, unfold(n.elseBody)...)
+		}
+		if n.endExpr != nil {
+			code = append(code, n.endExpr)
+		}
+	}
+	return code
+}
+
+func TestEncodeWatFolded(t *testing.T) {
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte(`(module
+  (type (func (param i32) (result i32)))
+  (func $f (type 0) (param $a i32) (result i32)
+    local.get 0
+    i32.const 1
+    i32.add
+    local.tee 0
+    if (result i32)
+      local.get 0
+    else
+      i32.const 2
+    end
+    local.get 0
+    br_if 0
+    drop
+    i32.const 3
+  )
+)`))
+	assert.NoError(t, err)
+	wf.FoldedWat = true
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeFunctionWat(&buf, 0))
+	body := buf.String()[strings.Index(buf.String(), "(result i32)\n")+13:]
+	assert.Equal(t, `        (drop
+          (br_if 0
+            (if (result i32)
+              (local.tee 0
+                (i32.add
+                  (local.get 0)
+                  (i32.const 1)
+                )
+              )
+              (then
+                (local.get 0)
+              )
+              (else
+                (i32.const 2)
+              )
+            )
+            (local.get 0)
+          )
+        )
+        (i32.const 3)
+    )
+`, body)
+
+	// Folding never changes the order of the instructions
+	wf = newTestModule(t)
+	for _, c := range wf.Code {
+		f := &folder{wf: wf, code: c.Expression, labels: []int{0}}
+		nodes, _ := f.fold()
+		assert.Equal(t, c.Expression, unfold(nodes))
+	}
+}
@@ -0,0 +1,65 @@
+package wasmfile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeWatLocalNames(t *testing.T) {
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte(`(module
+  (type (func (param i32 i32) (result i32)))
+  (func $f (type 0) (param i32) (param i32) (result i32)
+    (local i32)
+    (local i64)
+    local.get 0
+    local.get 1
+    i32.add
+    local.tee 2
+    local.get 2
+    i32.mul
+  )
+)`))
+	assert.NoError(t, err)
+	wf.Debug.FunctionLocalNames[0] = map[int]string{0: "$a", 1: "$b", 2: "$sum"}
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeWat(&buf))
+	wat := buf.String()
+	for _, s := range []string{"(param $a i32)", "(param $b i32)", "(local $sum i32)", "(local i64)", "local.get $a\n", "local.tee $sum\n"} {
+		assert.True(t, strings.Contains(wat, s), s)
+	}
+
+	// The output can be assembled again
+	wf2 := NewEmpty()
+	assert.NoError(t, wf2.DecodeWat(buf.Bytes()))
+	assert.Equal(t, len(wf.Code[0].Expression), len(wf2.Code[0].Expression))
+	for i, e := range wf.Code[0].Expression {
+		assert.True(t, e.Equals(wf2.Code[0].Expression[i]), i)
+	}
+}
+
+func TestEncodeWatMangledNames(t *testing.T) {
+	wf := NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(`(module
+  (type (func))
+  (func $a (type 0)
+  )
+  (func $b (type 0)
+  )
+)`)))
+	wf.Debug.FunctionNames[0] = "$_ZN3foo3barEv"
+	wf.Debug.FunctionNames[1] = "$not (mangled)"
+	wf.Debug.Demangle = true
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeWat(&buf))
+	wat := buf.String()
+
+	// Only the name that was demangled gets the raw name too, not the one which was just made into an identifier
+	assert.Contains(t, wat, "(func $foo::bar__ (type 0) ;; function_index=0 mangled=$_ZN3foo3barEv\n")
+	assert.Contains(t, wat, "(func $not__mangled_ (type 0) ;; function_index=1\n")
+}
@@ -0,0 +1,179 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+)
+
+/**
+ * Check if two modules are the same. Only the contents of the sections are compared, not how they
+ * were encoded (eg LEB widths or section order), or any debug info and PCs.
+ */
+func (wf *WasmFile) Equals(wf2 *WasmFile) bool {
+	return wf.CompareModule(wf2) == nil
+}
+
+/**
+ * Compare two modules in the same way as Equals, returning an error describing the first difference.
+ *
+ */
+func (wf *WasmFile) CompareModule(wf2 *WasmFile) error {
+	if len(wf.Type) != len(wf2.Type) {
+		return fmt.Errorf("type count %d != %d", len(wf.Type), len(wf2.Type))
+	}
+	for i, t := range wf.Type {
+		if !t.Equals(wf2.Type[i]) {
+			return fmt.Errorf("type %d differs", i)
+		}
+	}
+
+	if len(wf.Import) != len(wf2.Import) {
+		return fmt.Errorf("import count %d != %d", len(wf.Import), len(wf2.Import))
+	}
+	for i, imp := range wf.Import {
+		if *imp != *wf2.Import[i] {
+			return fmt.Errorf("import %d differs: %+v != %+v", i, *imp, *wf2.Import[i])
+		}
+	}
+
+	if len(wf.Function) != len(wf2.Function) {
+		return fmt.Errorf("function count %d != %d", len(wf.Function), len(wf2.Function))
+	}
+	for i, f := range wf.Function {
+		if *f != *wf2.Function[i] {
+			return fmt.Errorf("function %d type %d != %d", len(wf.Import)+i, f.TypeIndex, wf2.Function[i].TypeIndex)
+		}
+	}
+
+	if len(wf.Table) != len(wf2.Table) {
+		return fmt.Errorf("table count %d != %d", len(wf.Table), len(wf2.Table))
+	}
+	for i, t := range wf.Table {
+		if *t != *wf2.Table[i] {
+			return fmt.Errorf("table %d differs: %+v != %+v", i, *t, *wf2.Table[i])
+		}
+	}
+
+	if len(wf.Memory) != len(wf2.Memory) {
+		return fmt.Errorf("memory count %d != %d", len(wf.Memory), len(wf2.Memory))
+	}
+	for i, m := range wf.Memory {
+		if *m != *wf2.Memory[i] {
+			return fmt.Errorf("memory %d differs: %+v != %+v", i, *m, *wf2.Memory[i])
+		}
+	}
+
+	if len(wf.Global) != len(wf2.Global) {
+		return fmt.Errorf("global count %d != %d", len(wf.Global), len(wf2.Global))
+	}
+	for i, g := range wf.Global {
+		g2 := wf2.Global[i]
+		if g.Type != g2.Type || g.Mut != g2.Mut {
+			return fmt.Errorf("global %d type differs", i)
+		}
+		err := compareExpressions(g.Expression, g2.Expression)
+		if err != nil {
+			return fmt.Errorf("global %d init: %w", i, err)
+		}
+	}
+
+	if len(wf.Export) != len(wf2.Export) {
+		return fmt.Errorf("export count %d != %d", len(wf.Export), len(wf2.Export))
+	}
+	for i, e := range wf.Export {
+		if *e != *wf2.Export[i] {
+			return fmt.Errorf("export %d differs: %+v != %+v", i, *e, *wf2.Export[i])
+		}
+	}
+
+	if len(wf.Elem) != len(wf2.Elem) {
+		return fmt.Errorf("elem count %d != %d", len(wf.Elem), len(wf2.Elem))
+	}
+	for i, e := range wf.Elem {
+		e2 := wf2.Elem[i]
+		if e.TableIndex != e2.TableIndex || len(e.Indexes) != len(e2.Indexes) {
+			return fmt.Errorf("elem %d differs", i)
+		}
+		for j, idx := range e.Indexes {
+			if idx != e2.Indexes[j] {
+				return fmt.Errorf("elem %d entry %d: function %d != %d", i, j, idx, e2.Indexes[j])
+			}
+		}
+		err := compareExpressions(e.Offset, e2.Offset)
+		if err != nil {
+			return fmt.Errorf("elem %d offset: %w", i, err)
+		}
+	}
+
+	if len(wf.Code) != len(wf2.Code) {
+		return fmt.Errorf("code count %d != %d", len(wf.Code), len(wf2.Code))
+	}
+	for i, c := range wf.Code {
+		c2 := wf2.Code[i]
+		if !sameTypes(c.Locals, c2.Locals) {
+			return fmt.Errorf("function %d locals differ", len(wf.Import)+i)
+		}
+		err := compareExpressions(c.Expression, c2.Expression)
+		if err != nil {
+			return fmt.Errorf("function %d: %w", len(wf.Import)+i, err)
+		}
+	}
+
+	if len(wf.Data) != len(wf2.Data) {
+		return fmt.Errorf("data count %d != %d", len(wf.Data), len(wf2.Data))
+	}
+	for i, d := range wf.Data {
+		d2 := wf2.Data[i]
+		if d.MemIndex != d2.MemIndex {
+			return fmt.Errorf("data %d memory differs", i)
+		}
+		if !bytes.Equal(d.Data, d2.Data) {
+			return fmt.Errorf("data %d contents differ", i)
+		}
+		err := compareExpressions(d.Offset, d2.Offset)
+		if err != nil {
+			return fmt.Errorf("data %d offset: %w", i, err)
+		}
+	}
+
+	if len(wf.Custom) != len(wf2.Custom) {
+		return fmt.Errorf("custom section count %d != %d", len(wf.Custom), len(wf2.Custom))
+	}
+	for i, c := range wf.Custom {
+		c2 := wf2.Custom[i]
+		if c.Name != c2.Name || !bytes.Equal(c.Data, c2.Data) {
+			return fmt.Errorf("custom section %d (%s) differs", i, c.Name)
+		}
+	}
+	return nil
+}
+
+func compareExpressions(exp []*expression.Expression, exp2 []*expression.Expression) error {
+	if len(exp) != len(exp2) {
+		return fmt.Errorf("instruction count %d != %d", len(exp), len(exp2))
+	}
+	for i, e := range exp {
+		if !e.Equals(exp2[i]) {
+			return fmt.Errorf("instruction %d differs (%s != %s)", i, e.Name(), exp2[i].Name())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package wasmfile
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/stretchr/testify/assert"
+)
+
+func binaryRoundTrip(t *testing.T, wf *WasmFile) *WasmFile {
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	return wf2
+}
+
+func TestEquals(t *testing.T) {
+	wf := newTestModule(t)
+	wf2 := binaryRoundTrip(t, wf)
+	wf3 := binaryRoundTrip(t, wf)
+	assert.True(t, wf2.Equals(wf3))
+
+	// A changed instruction is reported with the function it's in
+	wf3.Code[1].Expression[0].I32Value = 2
+	assert.False(t, wf2.Equals(wf3))
+	err := wf2.CompareModule(wf3)
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "function 2"), err.Error())
+
+	wf3 = binaryRoundTrip(t, wf)
+	wf3.Export[0].Name = "goodbye"
+	err = wf2.CompareModule(wf3)
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "export 0"), err.Error())
+}
+
+func TestEqualsNaN(t *testing.T) {
+	e := &expression.Expression{Opcode: expression.InstrToOpcode["f64.const"], F64Value: math.NaN()}
+	e2 := &expression.Expression{Opcode: expression.InstrToOpcode["f64.const"], F64Value: math.NaN()}
+	assert.True(t, e.Equals(e2))
+
+	e2.F64Value = math.Float64frombits(math.Float64bits(math.NaN()) ^ 2)
+	assert.False(t, e.Equals(e2))
+}
+
+func TestWatRoundTripConstants(t *testing.T) {
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte(`(module
+  (type (func))
+  (table 2 funcref)
+  (func $f (type 0)
+    f32.const 0x1p-1
+    drop
+    f32.const -0
+    drop
+    f32.const 3.4e38
+    drop
+    f64.const 0.1
+    drop
+    f64.const -inf
+    drop
+    f64.const -nan:0x4
+    drop
+  )
+)`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, wf.Table[0].LimitMin)
+	assert.Equal(t, 0, wf.Table[0].LimitMax)
+
+	code := wf.Code[0].Expression
+	assert.Equal(t, float32(0.5), code[0].F32Value)
+	assert.Equal(t, uint32(0x80000000), math.Float32bits(code[2].F32Value))
+	assert.Equal(t, float32(3.4e38), code[4].F32Value)
+	assert.Equal(t, 0.1, code[6].F64Value)
+	assert.True(t, math.IsInf(code[8].F64Value, -1))
+	assert.Equal(t, uint64(0xfff0000000000004), math.Float64bits(code[10].F64Value))
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeWat(&buf))
+	wf2 := NewEmpty()
+	assert.NoError(t, wf2.DecodeWat(buf.Bytes()))
+	assert.NoError(t, wf.CompareModule(wf2))
+}
@@ -0,0 +1,379 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/encoding"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+// A section as it appeared in the original binary
+type SectionLayout struct {
+	Id     types.SectionId
+	Offset int          // Offset of the section header in the original binary
+	Header []byte       // Original section id and length, as the length may have been padded
+	Data   []byte       // Original section body
+	Custom *CustomEntry // The entry decoded from this section, for custom sections
+}
+
+var errUnknownSection = errors.New("Unknown section")
+
+// The order the spec requires known sections to appear in
+var sectionOrder = []types.SectionId{
+	types.SectionType,
+	types.SectionImport,
+	types.SectionFunction,
+	types.SectionTable,
+	types.SectionMemory,
+	types.SectionGlobal,
+	types.SectionExport,
+	types.SectionStart,
+	types.SectionElem,
+	types.SectionDataCount,
+	types.SectionCode,
+	types.SectionData,
+}
+
+// Create a new WasmFile from a file, recording the section layout so it can be reproduced exactly
+func NewWithLayout(filename string) (*WasmFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wf := &WasmFile{KeepLayout: true}
+	err = wf.DecodeBinaryReader(f)
+	if err != nil {
+		return wf, err
+	}
+	wf.Debug = &debug.WasmDebug{}
+	wf.Debug.ParseNameSectionData(wf.GetCustomSectionData("name"))
+	return wf, nil
+}
+
+/**
+ * Create a new WasmFile from a file for incremental re-encoding. Sections and function bodies
+ * which aren't marked dirty are copied from the original, so small patches to large modules are cheap.
+ */
+func NewIncremental(filename string) (*WasmFile, error) {
+	wf, err := NewWithLayout(filename)
+	if wf != nil {
+		wf.Incremental = true
+	}
+	return wf, err
+}
+
+// Mark sections as changed, so they are re-encoded
+func (wf *WasmFile) MarkSectionDirty(ids ...types.SectionId) {
+	if wf.dirtySections == nil {
+		wf.dirtySections = make(map[types.SectionId]bool)
+	}
+	for _, id := range ids {
+		wf.dirtySections[id] = true
+	}
+}
+
+// Mark the body as changed, so it is re-encoded
+func (c *CodeEntry) MarkDirty() {
+	c.dirty = true
+}
+
+func (c *CodeEntry) clean() bool {
+	return !c.dirty && c.original != nil
+}
+
+func (wf *WasmFile) sectionLen(id types.SectionId) int {
+	if id == types.SectionType {
+		return len(wf.Type)
+	} else if id == types.SectionImport {
+		return len(wf.Import)
+	} else if id == types.SectionFunction {
+		return len(wf.Function)
+	} else if id == types.SectionTable {
+		return len(wf.Table)
+	} else if id == types.SectionMemory {
+		return len(wf.Memory)
+	} else if id == types.SectionGlobal {
+		return len(wf.Global)
+	} else if id == types.SectionExport {
+		return len(wf.Export)
+	} else if id == types.SectionElem {
+		return len(wf.Elem)
+	} else if id == types.SectionDataCount || id == types.SectionData {
+		return len(wf.Data)
+	} else if id == types.SectionCode {
+		return len(wf.Code)
+	}
+	return -1
+}
+
+/**
+ * Work out if a section can be copied as it was, going by the dirty flags.
+ * Adding or removing entries is noticed without them, since the count changes.
+ */
+func (wf *WasmFile) sectionClean(sl *SectionLayout) bool {
+	if wf.dirtySections[sl.Id] {
+		return false
+	}
+	count, l := binary.Uvarint(sl.Data)
+	if l <= 0 || int(count) != wf.sectionLen(sl.Id) {
+		return false
+	}
+	if sl.Id == types.SectionCode {
+		for _, c := range wf.Code {
+			if !c.clean() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sectionRank(id types.SectionId) int {
+	for i, s := range sectionOrder {
+		if s == id {
+			return i
+		}
+	}
+	return -1
+}
+
+/**
+ * Encode a section body as it currently stands. Returns nil if the section would be empty.
+ *
+ */
+func (wf *WasmFile) encodeSectionBody(id types.SectionId) ([]byte, error) {
+	if id == types.SectionType {
+		return encodeVector(wf.Type)
+	} else if id == types.SectionImport {
+		return encodeVector(wf.Import)
+	} else if id == types.SectionFunction {
+		return encodeVector(wf.Function)
+	} else if id == types.SectionTable {
+		return encodeVector(wf.Table)
+	} else if id == types.SectionMemory {
+		return encodeVector(wf.Memory)
+	} else if id == types.SectionGlobal {
+		return encodeVector(wf.Global)
+	} else if id == types.SectionExport {
+		return encodeVector(wf.Export)
+	} else if id == types.SectionElem {
+		return encodeVector(wf.Elem)
+	} else if id == types.SectionDataCount {
+		return binary.AppendUvarint(nil, uint64(len(wf.Data))), nil
+	} else if id == types.SectionCode {
+		return encodeCodeVector(wf.Code, wf.Incremental)
+	} else if id == types.SectionData {
+		return encodeVector(wf.Data)
+	}
+	return nil, fmt.Errorf("Cannot encode section %d", id)
+}
+
+func encodeVector[T interface{ EncodeBinary(io.Writer) error }](entries []T) ([]byte, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	err := encoding.WriteUvarint(&buf, uint64(len(entries)))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		err = e.EncodeBinary(&buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+/**
+ * Work out if a section is unchanged since it was decoded.
+ * The original is decoded again and re-encoded, so that we compare like with like.
+ */
+func (wf *WasmFile) sectionUnchanged(sl *SectionLayout, current []byte) bool {
+	if sl.Id == types.SectionDataCount {
+		count, l := binary.Uvarint(sl.Data)
+		return l > 0 && int(count) == len(wf.Data)
+	}
+	original := &WasmFile{}
+	err := original.DecodeSection(byte(sl.Id), sl.Data)
+	if err != nil {
+		return false
+	}
+	encoded, err := original.encodeSectionBody(sl.Id)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(encoded, current)
+}
+
+// Write a section exactly as it was originally
+func writeOriginalSection(w io.Writer, sl *SectionLayout) error {
+	_, err := w.Write(sl.Header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sl.Data)
+	return err
+}
+
+func writeRawSection(w io.Writer, id types.SectionId, data []byte) error {
+	err := writeSectionHeader(w, byte(id), len(data))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+/**
+ * Encode using the recorded layout.
+ * Sections which have not been modified are written out byte for byte, in their original order
+ * (including any custom, start or unknown sections). Modified sections are re-encoded in place.
+ * Sections which did not exist originally are put in their usual place, and new custom sections
+ * go at the end. A DataCount section is only written if there was one originally.
+ * With Incremental, sections are only compared by their dirty flags and counts.
+ */
+func (wf *WasmFile) encodeBinaryLayout(w io.Writer) error {
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, WasmHeader)
+	binary.LittleEndian.PutUint32(header[4:], WasmVersion)
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[types.SectionId]bool)
+	for _, sl := range wf.Layout {
+		present[sl.Id] = true
+	}
+
+	// Write any new sections which belong before rank
+	nextNew := 0
+	writeNewSections := func(rank int) error {
+		for ; nextNew < len(sectionOrder) && nextNew < rank; nextNew++ {
+			id := sectionOrder[nextNew]
+			if present[id] || id == types.SectionStart || id == types.SectionDataCount {
+				continue
+			}
+			body, err := wf.encodeSectionBody(id)
+			if err != nil {
+				return err
+			}
+			if body != nil {
+				err = writeRawSection(w, id, body)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	customWritten := make(map[*CustomEntry]bool)
+	for _, sl := range wf.Layout {
+		if sl.Id == types.SectionCustom {
+			still := false
+			for _, c := range wf.Custom {
+				if c == sl.Custom {
+					still = true
+					break
+				}
+			}
+			if !still {
+				continue
+			}
+			customWritten[sl.Custom] = true
+			nameLength, l := binary.Uvarint(sl.Data)
+			if l > 0 && sl.Custom.Name == string(sl.Data[l:l+int(nameLength)]) &&
+				bytes.Equal(sl.Custom.Data, sl.Data[l+int(nameLength):]) {
+				err = writeOriginalSection(w, sl)
+			} else {
+				err = writeSection(w, types.SectionCustom, sl.Custom.EncodeBinary)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		rank := sectionRank(sl.Id)
+		if rank == -1 || sl.Id == types.SectionStart {
+			// Not something we model, so it can't have changed.
+			err = writeOriginalSection(w, sl)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = writeNewSections(rank)
+		if err != nil {
+			return err
+		}
+
+		if wf.Incremental && wf.sectionClean(sl) {
+			err = writeOriginalSection(w, sl)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		current, err := wf.encodeSectionBody(sl.Id)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			// Everything in it has been removed
+			continue
+		}
+		if !wf.Incremental && wf.sectionUnchanged(sl, current) {
+			err = writeOriginalSection(w, sl)
+		} else {
+			err = writeRawSection(w, sl.Id, current)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeNewSections(len(sectionOrder))
+	if err != nil {
+		return err
+	}
+
+	for _, c := range wf.Custom {
+		if !customWritten[c] {
+			err = writeSection(w, types.SectionCustom, c.EncodeBinary)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
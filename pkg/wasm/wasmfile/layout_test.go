@@ -0,0 +1,162 @@
+package wasmfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Build a binary in an unusual layout, with a custom section in the middle, a start section,
+// an unknown section and a padded section length.
+func newLayoutTestBinary(t *testing.T) []byte {
+	wf := newTestModule(t)
+
+	sections := make(map[types.SectionId][]byte)
+	for _, id := range sectionOrder {
+		if id == types.SectionStart {
+			continue
+		}
+		body, err := wf.encodeSectionBody(id)
+		assert.NoError(t, err)
+		sections[id] = body
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00})
+	for _, id := range sectionOrder {
+		if id == types.SectionCode {
+			// Custom section in the middle
+			buf.Write([]byte{0x00, 0x06, 0x04, 'm', 'i', 'd', 'l', 0x42})
+		}
+		if id == types.SectionStart {
+			buf.Write([]byte{byte(types.SectionStart), 0x01, 0x02})
+			continue
+		}
+		body := sections[id]
+		if body == nil {
+			continue
+		}
+		if id == types.SectionType {
+			// Padded length
+			buf.Write([]byte{byte(id), 0x80 | byte(len(body)), 0x80, 0x00})
+			buf.Write(body)
+			continue
+		}
+		assert.NoError(t, writeRawSection(&buf, id, body))
+	}
+	// Unknown section
+	buf.Write([]byte{0x0d, 0x02, 0x01, 0x00})
+	return buf.Bytes()
+}
+
+func TestLayoutRoundTrip(t *testing.T) {
+	original := newLayoutTestBinary(t)
+
+	wf := &WasmFile{KeepLayout: true}
+	assert.NoError(t, wf.DecodeBinary(original))
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	assert.Equal(t, original, buf.Bytes())
+
+	// A clone still round trips
+	buf.Reset()
+	assert.NoError(t, wf.Clone().EncodeBinary(&buf))
+	assert.Equal(t, original, buf.Bytes())
+
+	// Without KeepLayout, the unknown section is an error
+	assert.Error(t, (&WasmFile{}).DecodeBinary(original))
+}
+
+func TestLayoutModified(t *testing.T) {
+	original := newLayoutTestBinary(t)
+
+	wf := &WasmFile{KeepLayout: true}
+	assert.NoError(t, wf.DecodeBinary(original))
+	wf.Export[0].Name = "hellp"
+	wf.Custom = append(wf.Custom, &CustomEntry{Name: "new", Data: []byte{1}})
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	modified := buf.Bytes()
+
+	// Only the export name byte differs, apart from the new custom section on the end
+	newCustom := []byte{0x00, 0x05, 0x03, 'n', 'e', 'w', 0x01}
+	assert.Equal(t, len(original)+len(newCustom), len(modified))
+	assert.Equal(t, newCustom, modified[len(original):])
+	diffs := 0
+	for i := range original {
+		if original[i] != modified[i] {
+			diffs++
+		}
+	}
+	assert.Equal(t, 1, diffs)
+
+	wf2 := &WasmFile{}
+	wf2.KeepLayout = true
+	assert.NoError(t, wf2.DecodeBinary(modified))
+	assert.Equal(t, "hellp", wf2.Export[0].Name)
+	assert.Equal(t, "midl", wf2.Custom[0].Name)
+}
+
+func layoutSection(t *testing.T, data []byte, id types.SectionId) []byte {
+	wf := &WasmFile{KeepLayout: true}
+	assert.NoError(t, wf.DecodeBinary(data))
+	for _, sl := range wf.Layout {
+		if sl.Id == id {
+			return sl.Data
+		}
+	}
+	return nil
+}
+
+func TestLayoutIncremental(t *testing.T) {
+	original := newLayoutTestBinary(t)
+
+	wf := &WasmFile{KeepLayout: true, Incremental: true}
+	assert.NoError(t, wf.DecodeBinary(original))
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	assert.Equal(t, original, buf.Bytes())
+
+	// Bodies which aren't marked dirty are copied, not encoded again
+	wf.Code[0].Expression[0].LocalIndex = 1
+	buf.Reset()
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	assert.Equal(t, original, buf.Bytes())
+
+	wf.Code[0].MarkDirty()
+	buf.Reset()
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	assert.NotEqual(t, original, buf.Bytes())
+	wf2 := &WasmFile{KeepLayout: true}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	assert.Equal(t, 1, wf2.Code[0].Expression[0].LocalIndex)
+	assert.Equal(t, len(wf.Code[1].Expression), len(wf2.Code[1].Expression))
+}
+
+func TestLayoutIncrementalPatch(t *testing.T) {
+	original := newLayoutTestBinary(t)
+
+	wf := &WasmFile{KeepLayout: true, Incremental: true}
+	assert.NoError(t, wf.DecodeBinary(original))
+	assert.NoError(t, wf.SetGlobalInit(0, "i32.const 5"))
+	// Not marked, but noticed as the count changes
+	wf.Export = append(wf.Export, &ExportEntry{Name: "add", Type: types.ExportFunc, Index: 1})
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	modified := buf.Bytes()
+
+	wf2 := &WasmFile{KeepLayout: true}
+	assert.NoError(t, wf2.DecodeBinary(modified))
+	assert.Equal(t, int32(5), wf2.Global[0].Expression[0].I32Value)
+	assert.Equal(t, 2, len(wf2.Export))
+
+	for _, id := range []types.SectionId{types.SectionType, types.SectionCode, types.SectionData} {
+		assert.Equal(t, layoutSection(t, original, id), layoutSection(t, modified, id))
+	}
+}
@@ -0,0 +1,392 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+type LinkOptions struct {
+	// Imports from this module are satisfied by exports of the other module (eg "env")
+	Module string
+
+	// Keep the data and elem segments of the linked module at their original addresses, rather
+	// than relocating them past the end of this module. They must not overlap.
+	KeepAddresses bool
+}
+
+/**
+ * Link module b into this one.
+ *
+ * The functions, globals, data and elem segments of b are added, and any function import from
+ * opts.Module which matches a function export of the other module is replaced by a direct call.
+ * The exports of b are added, and names which clash are renamed in b first.
+ *
+ * Data and elem segments are moved as a block, so references to them from code are only fixed up
+ * where they are made by name (eg "i32.const offset($data)"). Code in b which uses absolute
+ * addresses or table slots needs KeepAddresses.
+ *
+ * The entries of b are moved into wf and modified, so Clone it first if it needs reusing.
+ */
+func (wf *WasmFile) Link(b *WasmFile, opts LinkOptions) error {
+	for _, i := range b.Import {
+		if i.Type != types.ExportFunc {
+			return fmt.Errorf("Import %s:%s: only function imports can be linked", i.Module, i.Name)
+		}
+	}
+
+	renameConflicts(wf, b)
+
+	codeBefore := len(wf.Code)
+	globalsBefore := len(wf.Global)
+
+	// Globals are appended, so any global.get in their init needs moving along too.
+	globalRemap := make(map[int]int)
+	for idx := range b.Global {
+		globalRemap[idx] = globalsBefore + idx
+	}
+	for _, g := range b.Global {
+		expression.ModifyAllGlobalIndexes(g.Expression, globalRemap)
+	}
+
+	err := wf.linkData(b, opts)
+	if err != nil {
+		return err
+	}
+
+	// Now the functions
+	bImports := b.Import
+	bImportCount := len(b.Import)
+	err = wf.AddFuncsFrom(b, func(remap map[int]int) {})
+	if err != nil {
+		return err
+	}
+
+	// Where the functions from b ended up
+	bFunction := func(fid int) (int, error) {
+		if fid < bImportCount {
+			i := bImports[fid]
+			for idx, i2 := range wf.Import {
+				if i.Module == i2.Module && i.Name == i2.Name {
+					return idx, nil
+				}
+			}
+			return -1, fmt.Errorf("Import %s:%s went missing", i.Module, i.Name)
+		}
+		cid := fid - bImportCount
+		if cid >= len(b.Code) {
+			return -1, fmt.Errorf("Function %d not found", fid)
+		}
+		return len(wf.Import) + codeBefore + cid, nil
+	}
+
+	for _, c := range wf.Code[codeBefore:] {
+		err = c.ResolveLengths(wf)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveRelocations(wf, 0)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveGlobals(wf)
+		if err != nil {
+			return err
+		}
+		err = c.ResolveFunctions(wf)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = wf.linkElems(b, opts, globalRemap, bFunction)
+	if err != nil {
+		return err
+	}
+
+	// Exports
+	exportTargets := make([]*ExportEntry, 0)
+	for _, ex := range wf.Export {
+		if ex.Type == types.ExportFunc {
+			exportTargets = append(exportTargets, ex)
+		}
+	}
+	for _, ex := range b.Export {
+		if ex.Type != types.ExportFunc && ex.Type != types.ExportGlobal {
+			// The memory and table of b are merged into ours
+			continue
+		}
+		for _, ex2 := range wf.Export {
+			if ex2.Name == ex.Name {
+				return fmt.Errorf("Export %s exists in both modules", ex.Name)
+			}
+		}
+		if ex.Type == types.ExportFunc {
+			ex.Index, err = bFunction(ex.Index)
+			if err != nil {
+				return err
+			}
+			exportTargets = append(exportTargets, ex)
+		} else {
+			ex.Index = globalRemap[ex.Index]
+		}
+		wf.Export = append(wf.Export, ex)
+	}
+
+	// Finally, resolve the imports which the other module exports.
+	for {
+		var imp *ImportEntry
+		var target *ExportEntry
+		for _, i := range wf.Import {
+			if i.Module != opts.Module {
+				continue
+			}
+			for _, ex := range exportTargets {
+				if ex.Name == i.Name {
+					imp = i
+					target = ex
+					break
+				}
+			}
+			if imp != nil {
+				break
+			}
+		}
+		if imp == nil {
+			break
+		}
+		te, err := wf.functionType(target.Index)
+		if err != nil {
+			return err
+		}
+		if !wf.Type[imp.Index].Equals(te) {
+			return fmt.Errorf("Import %s:%s does not match the type of the export", imp.Module, imp.Name)
+		}
+		wf.redirectImportToFunction(imp.Module, imp.Name, target.Index)
+	}
+	return nil
+}
+
+// Rename anything in b whose name is already used in wf, along with any references by name.
+func renameConflicts(wf *WasmFile, b *WasmFile) {
+	unique := func(n string, used func(string) bool) string {
+		for i := 1; ; i++ {
+			nn := fmt.Sprintf("%s.%d", n, i)
+			if !used(nn) {
+				return nn
+			}
+		}
+	}
+
+	funcRenames := make(map[string]string)
+	used := func(n string) bool {
+		return wf.Debug.LookupFunctionID(n) != -1 || b.Debug.LookupFunctionID(n) != -1
+	}
+	for fid, n := range b.Debug.FunctionNames {
+		if wf.Debug.LookupFunctionID(n) != -1 {
+			funcRenames[n] = unique(n, used)
+			b.Debug.FunctionNames[fid] = funcRenames[n]
+		}
+	}
+
+	globalRenames := make(map[string]string)
+	used = func(n string) bool {
+		return wf.Debug.LookupGlobalID(n) != -1 || b.Debug.LookupGlobalID(n) != -1
+	}
+	for gid, n := range b.Debug.GlobalNames {
+		if wf.Debug.LookupGlobalID(n) != -1 {
+			globalRenames[n] = unique(n, used)
+			b.Debug.GlobalNames[gid] = globalRenames[n]
+		}
+	}
+
+	dataRenames := make(map[string]string)
+	used = func(n string) bool {
+		return wf.Debug.LookupDataId(n) != -1 || b.Debug.LookupDataId(n) != -1
+	}
+	for did, n := range b.Debug.DataNames {
+		if n != "" && wf.Debug.LookupDataId(n) != -1 {
+			dataRenames[n] = unique(n, used)
+			b.Debug.DataNames[did] = dataRenames[n]
+		}
+	}
+
+	for _, c := range b.Code {
+		for _, e := range c.Expression {
+			if e.FunctionNeedsLinking {
+				nn, ok := funcRenames[e.FunctionId]
+				if ok {
+					e.FunctionId = nn
+				}
+			}
+			if e.GlobalNeedsLinking {
+				nn, ok := globalRenames[e.GlobalId]
+				if ok {
+					e.GlobalId = nn
+				}
+			}
+			if e.DataOffsetNeedsLinking || e.DataLengthNeedsLinking {
+				nn, ok := dataRenames[e.I32DataId]
+				if ok {
+					e.I32DataId = nn
+				}
+			}
+		}
+	}
+}
+
+// Find the constant address of a data or elem segment
+func segmentAddress(exp []*expression.Expression) (int, error) {
+	if len(exp) != 1 || exp[0].Opcode != expression.InstrToOpcode["i32.const"] {
+		return 0, errors.New("Can only deal with i32.const for now")
+	}
+	return int(uint32(exp[0].I32Value)), nil
+}
+
+// Add the data from b, and make sure the memory is big enough for it
+func (wf *WasmFile) linkData(b *WasmFile, opts LinkOptions) error {
+	if len(wf.Memory) == 0 && len(b.Memory) > 0 {
+		wf.Memory = append(wf.Memory, b.Memory[0])
+	}
+	if len(b.Data) == 0 {
+		return nil
+	}
+	if len(wf.Memory) == 0 {
+		return errors.New("Data can't be linked without a memory")
+	}
+
+	bStart := -1
+	for _, d := range b.Data {
+		addr, err := segmentAddress(d.Offset)
+		if err != nil {
+			return err
+		}
+		if bStart == -1 || addr < bStart {
+			bStart = addr
+		}
+	}
+
+	delta := 0
+	if opts.KeepAddresses {
+		for _, d := range wf.Data {
+			addr, err := segmentAddress(d.Offset)
+			if err != nil {
+				return err
+			}
+			for _, d2 := range b.Data {
+				addr2, _ := segmentAddress(d2.Offset)
+				if addr < addr2+len(d2.Data) && addr2 < addr+len(d.Data) {
+					return fmt.Errorf("Data at %d overlaps data at %d", addr2, addr)
+				}
+			}
+		}
+	} else {
+		// Move b's data past the end of our initial memory, keeping the offset within the page.
+		delta = wf.Memory[0].LimitMin*wasmPageSize - (bStart &^ (wasmPageSize - 1))
+	}
+
+	end := 0
+	for idx, d := range b.Data {
+		addr, _ := segmentAddress(d.Offset)
+		d.Offset[0].I32Value = int32(addr + delta)
+		if addr+delta+len(d.Data) > end {
+			end = addr + delta + len(d.Data)
+		}
+
+		newidx := len(wf.Data)
+		wf.Data = append(wf.Data, d)
+		name := b.Debug.GetDataIdentifier(idx)
+		if name != "" {
+			wf.Debug.DataNames[newidx] = name
+		}
+	}
+
+	pages := (end + wasmPageSize - 1) / wasmPageSize
+	mem := wf.Memory[0]
+	if pages > mem.LimitMin {
+		mem.LimitMin = pages
+	}
+	if mem.LimitMax != 0 && mem.LimitMax < mem.LimitMin {
+		mem.LimitMax = mem.LimitMin
+	}
+	return nil
+}
+
+// Add the elem segments from b, and make sure the table is big enough for them
+func (wf *WasmFile) linkElems(b *WasmFile, opts LinkOptions, globalRemap map[int]int, bFunction func(fid int) (int, error)) error {
+	if len(wf.Table) == 0 && len(b.Table) > 0 {
+		wf.Table = append(wf.Table, &TableEntry{
+			TableType: b.Table[0].TableType,
+		})
+	}
+	if len(b.Elem) == 0 {
+		return nil
+	}
+	if len(wf.Table) == 0 {
+		return errors.New("Elems can't be linked without a table")
+	}
+	table := wf.Table[0]
+
+	delta := 0
+	if !opts.KeepAddresses {
+		delta = table.LimitMin
+	}
+
+	end := 0
+	for _, el := range b.Elem {
+		for idx, fid := range el.Indexes {
+			nfid, err := bFunction(int(fid))
+			if err != nil {
+				return err
+			}
+			el.Indexes[idx] = uint64(nfid)
+		}
+		expression.ModifyAllGlobalIndexes(el.Offset, globalRemap)
+		addr, err := segmentAddress(el.Offset)
+		if err != nil {
+			return err
+		}
+		el.Offset[0].I32Value = int32(addr + delta)
+		if addr+delta+len(el.Indexes) > end {
+			end = addr + delta + len(el.Indexes)
+		}
+		if opts.KeepAddresses {
+			for _, el2 := range wf.Elem {
+				addr2, err := segmentAddress(el2.Offset)
+				if err != nil {
+					return err
+				}
+				if addr < addr2+len(el2.Indexes) && addr2 < addr+len(el.Indexes) {
+					return fmt.Errorf("Elem at %d overlaps elem at %d", addr, addr2)
+				}
+			}
+		}
+		wf.Elem = append(wf.Elem, el)
+	}
+
+	if end > table.LimitMin {
+		table.LimitMin = end
+	}
+	if table.LimitMax != 0 && table.LimitMax < table.LimitMin {
+		table.LimitMax = table.LimitMin
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package wasmfile
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLinkWat = `(module
+  (type (func))
+  (type (func (param i32 i32 i32 i32) (result i32)))
+  (import "env" "hello" (func $hello (type 0)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (type 1)))
+  (memory 1)
+  (global $counter (mut i32) (i32.const 5))
+
+  (func $add (param $a i32) (result i32)
+    local.get $a
+    global.get $counter
+    i32.add
+  )
+
+  (func $run
+    call $hello
+    i32.const 1
+    call $add
+    drop
+    i32.const offset($message)
+    drop
+  )
+
+  (data $message "Other message")
+  (export "run" (func $run))
+)
+`
+
+func TestLink(t *testing.T) {
+	wf := newTestModule(t)
+	b := NewEmpty()
+	assert.NoError(t, b.DecodeWat([]byte(testLinkWat)))
+	b.Export = append(b.Export, &ExportEntry{Name: "counter", Type: types.ExportGlobal, Index: 0})
+
+	// The test module imports env:run, which b exports
+	wf.Import = append(wf.Import, &ImportEntry{Module: "env", Name: "run", Type: types.ExportFunc, Index: wf.AddTypeMaybe(&TypeEntry{})})
+	wf.Debug.RenumberFunctions(map[int]int{0: 0, 1: 2, 2: 3})
+	wf.Debug.FunctionNames[1] = "$run_import"
+	for _, c := range wf.Code {
+		c.ModifyAllCalls(map[int]int{0: 0, 1: 2, 2: 3})
+	}
+	wf.Export[0].Index = 3
+	assert.NoError(t, wf.Validate())
+
+	assert.NoError(t, wf.Link(b, LinkOptions{Module: "env"}))
+	assert.NoError(t, wf.Validate())
+
+	// Both env imports are resolved, and fd_write is shared
+	assert.Equal(t, 1, len(wf.Import))
+	assert.Equal(t, "fd_write", wf.Import[0].Name)
+	assert.Equal(t, 4, len(wf.Code))
+
+	// Clashing names were renamed
+	addB := wf.Debug.LookupFunctionID("$add.1")
+	runB := wf.Debug.LookupFunctionID("$run")
+	hello := wf.Debug.LookupFunctionID("$hello")
+	assert.Equal(t, 3, addB)
+	assert.Equal(t, 4, runB)
+	assert.Equal(t, 2, hello)
+	assert.Equal(t, 1, wf.Debug.LookupGlobalID("$counter.1"))
+
+	// Calls in both directions go straight to the functions
+	run := wf.Code[runB-1].Expression
+	assert.Equal(t, hello, run[0].FuncIndex)
+	assert.Equal(t, addB, run[2].FuncIndex)
+	assert.Equal(t, 1, wf.Code[addB-1].Expression[1].GlobalIndex)
+
+	// The data from b was moved past the end of the original memory
+	did := wf.Debug.LookupDataId("$message.1")
+	assert.Equal(t, 1, did)
+	assert.Equal(t, int32(65536), wf.Data[did].Offset[0].I32Value)
+	assert.Equal(t, int32(65536), run[4].I32Value)
+	assert.Equal(t, 2, wf.Memory[0].LimitMin)
+
+	// Exports from b were added
+	assert.Equal(t, 3, len(wf.Export))
+	assert.Equal(t, "run", wf.Export[1].Name)
+	assert.Equal(t, runB, wf.Export[1].Index)
+	assert.Equal(t, 1, wf.Export[2].Index)
+}
+
+func TestLinkConflicts(t *testing.T) {
+	wf := newTestModule(t)
+	b := newTestModule(t)
+	assert.Error(t, wf.Link(b, LinkOptions{Module: "env"}))
+
+	// Overlapping data is rejected if it can't be moved
+	wf = newTestModule(t)
+	b = newTestModule(t)
+	b.Export = nil
+	assert.Error(t, wf.Link(b, LinkOptions{Module: "env", KeepAddresses: true}))
+}
@@ -0,0 +1,243 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+// wasm-objdump shows up to this many bytes on a line, and carries on with more lines
+const objdumpBytesPerLine = 9
+
+/**
+ * Write functions the way wabt's wasm-objdump -d does, with the file offset and bytes of each
+ * instruction, so scripts that read its output keep working. data must be the binary the module
+ * was decoded from, since the offsets come from it. If the dwarf line numbers have been parsed,
+ * they're added as comments. fid is the function to write, or -1 for all of them.
+ */
+func (wf *WasmFile) EncodeObjdump(w io.Writer, data []byte, fid int) error {
+	codeOffset, err := sectionOffset(data, types.SectionCode)
+	if err != nil {
+		return err
+	}
+
+	for idx, c := range wf.Code {
+		if fid != -1 && fid != idx+len(wf.Import) {
+			continue
+		}
+		if !c.PCValid || codeOffset+int(c.CodeSectionPtr+c.CodeSectionLen) > len(data) {
+			return errors.New("The code doesn't match the binary it was decoded from")
+		}
+		err = wf.objdumpFunction(w, data, codeOffset, idx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wf *WasmFile) objdumpFunction(w io.Writer, data []byte, codeOffset int, idx int) error {
+	c := wf.Code[idx]
+	fid := idx + len(wf.Import)
+	start := codeOffset + int(c.CodeSectionPtr)
+
+	var b []byte
+	b = fmt.Appendf(b, "%06x func[%d]", start, fid)
+	name := wf.objdumpFunctionName(fid)
+	if name != "" {
+		b = fmt.Appendf(b, " <%s>", name)
+	}
+	b = append(b, ":\n"...)
+
+	// The local declarations, as runs of the same type
+	params := 0
+	if idx < len(wf.Function) && wf.Function[idx].TypeIndex < len(wf.Type) {
+		params = len(wf.Type[wf.Function[idx].TypeIndex].Param)
+	}
+	decls, l := binary.Uvarint(data[start:])
+	if l <= 0 {
+		return fmt.Errorf("Invalid locals for function %d", fid)
+	}
+	ptr := start + l
+	local := params
+	for i := 0; i < int(decls); i++ {
+		count, ll := binary.Uvarint(data[ptr:])
+		if ll <= 0 || ptr+ll >= len(data) {
+			return fmt.Errorf("Invalid locals for function %d", fid)
+		}
+		text := fmt.Sprintf("local[%d", local)
+		if count != 1 {
+			text = fmt.Sprintf("%s..%d", text, local+int(count)-1)
+		}
+		text = fmt.Sprintf("%s] type=%s", text, types.ByteToValType[types.ValType(data[ptr+ll])])
+		b = appendObjdumpLine(b, data, ptr, ptr+ll+1, text)
+		local += int(count)
+		ptr += ll + 1
+	}
+
+	indent := 0
+	for _, e := range c.Expression {
+		info := e.Info()
+		if info == nil {
+			return fmt.Errorf("Unknown opcode %d in function %d", e.Opcode, fid)
+		}
+		if (info.Name == "end" || info.Name == "else") && indent > 0 {
+			indent--
+		}
+		text := strings.Repeat("  ", indent) + info.Name + wf.objdumpImmediate(e, info)
+		lineNumberData := wf.Debug.GetLineNumberInfo(e.PC)
+		if lineNumberData != "" {
+			text = text + " ;; Src = " + lineNumberData
+		}
+		b = appendObjdumpLine(b, data, codeOffset+int(e.PC), codeOffset+int(e.PCNext), text)
+		if info.Name == "block" || info.Name == "loop" || info.Name == "if" || info.Name == "else" {
+			indent++
+		}
+	}
+
+	// The end of the function isn't kept as an expression
+	end := codeOffset + int(c.CodeSectionPtr+c.CodeSectionLen) - 1
+	text := "end"
+	lineNumberData := wf.Debug.GetLineNumberInfo(c.CodeSectionPtr + c.CodeSectionLen - 1)
+	if lineNumberData != "" {
+		text = text + " ;; Src = " + lineNumberData
+	}
+	b = appendObjdumpLine(b, data, end, end+1, text)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// Write the offset and bytes, with the text after the first line of them
+func appendObjdumpLine(b []byte, data []byte, from int, to int, text string) []byte {
+	first := true
+	for first || from < to {
+		b = fmt.Appendf(b, " %06x:", from)
+		i := 0
+		for ; from < to && i < objdumpBytesPerLine; i++ {
+			b = fmt.Appendf(b, " %02x", data[from])
+			from++
+		}
+		b = append(b, strings.Repeat("   ", objdumpBytesPerLine-i)...)
+		b = append(b, " | "...)
+		if first {
+			b = append(b, text...)
+			first = false
+		}
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// wasm-objdump uses the name section, and otherwise an export or import name
+func (wf *WasmFile) objdumpFunctionName(fid int) string {
+	name := strings.TrimPrefix(wf.Debug.FunctionNames[fid], "$")
+	if name != "" {
+		return name
+	}
+	for _, e := range wf.Export {
+		if e.Type == types.ExportFunc && e.Index == fid {
+			return e.Name
+		}
+	}
+	if fid < len(wf.Import) {
+		return wf.Import[fid].Module + "." + wf.Import[fid].Name
+	}
+	return ""
+}
+
+func (wf *WasmFile) objdumpImmediate(e *expression.Expression, info *expression.OpcodeInfo) string {
+	switch info.Immediate {
+	case expression.ImmediateBlockType:
+		if e.TypedBlock {
+			return fmt.Sprintf(" type[%d]", e.TypeIndex)
+		} else if e.Result != types.ValNone {
+			return " " + types.ByteToValType[e.Result]
+		}
+	case expression.ImmediateLabel:
+		return fmt.Sprintf(" %d", e.LabelIndex)
+	case expression.ImmediateLabelTable:
+		s := ""
+		for _, l := range e.Labels {
+			s = fmt.Sprintf("%s %d", s, l)
+		}
+		return fmt.Sprintf("%s %d", s, e.LabelIndex)
+	case expression.ImmediateFunc:
+		name := wf.objdumpFunctionName(e.FuncIndex)
+		if name != "" {
+			return fmt.Sprintf(" %d <%s>", e.FuncIndex, name)
+		}
+		return fmt.Sprintf(" %d", e.FuncIndex)
+	case expression.ImmediateCallIndirect:
+		return fmt.Sprintf(" %d %d", e.TypeIndex, e.TableIndex)
+	case expression.ImmediateLocal:
+		return fmt.Sprintf(" %d", e.LocalIndex)
+	case expression.ImmediateGlobal:
+		name := strings.TrimPrefix(wf.Debug.GlobalNames[e.GlobalIndex], "$")
+		if name != "" {
+			return fmt.Sprintf(" %d <%s>", e.GlobalIndex, name)
+		}
+		return fmt.Sprintf(" %d", e.GlobalIndex)
+	case expression.ImmediateMemArg:
+		return fmt.Sprintf(" %d %d", e.MemAlign, e.MemOffset)
+	case expression.ImmediateMemory:
+		return " 0"
+	case expression.ImmediateMemoryPair:
+		return " 0 0"
+	case expression.ImmediateI32:
+		return fmt.Sprintf(" %d", e.I32Value)
+	case expression.ImmediateI64:
+		return fmt.Sprintf(" %d", e.I64Value)
+	case expression.ImmediateF32:
+		return " " + objdumpFloat(float64(e.F32Value), uint64(math.Float32bits(e.F32Value)), 32)
+	case expression.ImmediateF64:
+		return " " + objdumpFloat(e.F64Value, math.Float64bits(e.F64Value), 64)
+	}
+	return ""
+}
+
+// Floats are written in hex, as wabt does, eg 0x1.8p+1
+func objdumpFloat(v float64, bits uint64, bitSize int) string {
+	sign := ""
+	if math.Signbit(v) {
+		sign = "-"
+	}
+	if math.IsInf(v, 0) {
+		return sign + "inf"
+	}
+	if math.IsNaN(v) {
+		payload := bits & (1<<52 - 1)
+		if bitSize == 32 {
+			payload = bits & (1<<23 - 1)
+		}
+		return fmt.Sprintf("%snan:0x%x", sign, payload)
+	}
+	s := strconv.FormatFloat(v, 'x', -1, bitSize)
+	// Go pads the exponent to two digits
+	mantissa, exp, _ := strings.Cut(s, "p")
+	n, _ := strconv.Atoi(exp)
+	return fmt.Sprintf("%sp%+d", mantissa, n)
+}
@@ -0,0 +1,89 @@
+package wasmfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const objdumpWat = `(module
+  (type (func (param i32) (result i32)))
+  (type (func (param f32)))
+  (import "env" "imp" (func $imp (type 0)))
+  (global $sp (mut i32) (i32.const 1024))
+  (memory 1)
+  (func $f (type 0)
+    (local i64 i64)
+    local.get 0
+    if (result i32)
+      global.get 0
+      i32.load offset=8 align=4
+    else
+      i32.const -1
+      call 0
+    end
+  )
+  (func (type 1)
+    f32.const 3
+    drop
+    i64.const 1234567890123456789
+    drop
+  )
+)
+`
+
+func objdumpModule(t *testing.T) (*WasmFile, []byte) {
+	src := NewEmpty()
+	assert.NoError(t, src.DecodeWat([]byte(objdumpWat)))
+	src.SetCustomSection("name", src.Debug.EncodeNameSectionData())
+	var buf bytes.Buffer
+	assert.NoError(t, src.EncodeBinary(&buf))
+
+	wf, err := NewFromReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	return wf, buf.Bytes()
+}
+
+func TestEncodeObjdump(t *testing.T) {
+	wf, data := objdumpModule(t)
+	codeOffset, err := sectionOffset(data, types.SectionCode)
+	assert.NoError(t, err)
+	assert.Equal(t, 57, codeOffset)
+
+	var out bytes.Buffer
+	assert.NoError(t, wf.EncodeObjdump(&out, data, -1))
+	assert.Equal(t, `00003b func[1] <f>:
+ 00003c: 01 7e                      | local[1] type=i64
+ 00003e: 01 7e                      | local[2] type=i64
+ 000040: 20 00                      | local.get 0
+ 000042: 04 7f                      | if i32
+ 000044: 23 00                      |   global.get 0 <sp>
+ 000046: 28 02 08                   |   i32.load 2 8
+ 000049: 05                         | else
+ 00004a: 41 7f                      |   i32.const -1
+ 00004c: 10 00                      |   call 0 <imp>
+ 00004e: 0b                         | end
+ 00004f: 0b                         | end
+000051 func[2]:
+ 000052: 43 00 00 40 40             | f32.const 0x1.8p+1
+ 000057: 1a                         | drop
+ 000058: 42 95 82 a6 ef c7 9e 84 91 | i64.const 1234567890123456789
+ 000061: 11                         | 
+ 000062: 1a                         | drop
+ 000063: 0b                         | end
+`, out.String())
+
+	// Just the one function
+	out.Reset()
+	assert.NoError(t, wf.EncodeObjdump(&out, data, 2))
+	assert.Contains(t, out.String(), "000051 func[2]:\n")
+	assert.NotContains(t, out.String(), "func[1]")
+}
+
+func TestObjdumpFloat(t *testing.T) {
+	assert.Equal(t, "0x0p+0", objdumpFloat(0, 0, 64))
+	assert.Equal(t, "-0x1p-1", objdumpFloat(-0.5, 0, 64))
+	assert.Equal(t, "0x1.8p+10", objdumpFloat(1536, 0, 32))
+}
@@ -0,0 +1,181 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+
+	"github.com/loopholelabs/wasm-toolkit/internal/wat"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+/**
+ * The code and data an instrumenter adds to a module. The data goes after the module's initial
+ * memory, from DataPtr, and memory.wat hides it from the module by offsetting memory.size and
+ * memory.grow. Payload code refers to its data relative to $debug_start_mem.
+ */
+type Payload struct {
+	DataPtr int // Where the payload data starts
+	wf      *WasmFile
+	ptr     int32 // Where the next payload data goes
+}
+
+/**
+ * Add the functions and data of some of the embedded wat files to a module, as the start of a
+ * payload. One of them must be memory.wat.
+ */
+func (wf *WasmFile) AddPayload(files []string) (*Payload, error) {
+	if len(wf.Memory) == 0 {
+		return nil, errors.New("The module has no memory")
+	}
+	data_ptr := wf.Memory[0].LimitMin << 16
+	if data_ptr > math.MaxInt32 {
+		return nil, fmt.Errorf("The module's memory of %d pages leaves no room for a payload", wf.Memory[0].LimitMin)
+	}
+
+	p := &Payload{
+		DataPtr: data_ptr,
+		wf:      wf,
+		ptr:     int32(data_ptr),
+	}
+	for _, file := range files {
+		mod, err := loadWat(file)
+		if err != nil {
+			return nil, err
+		}
+
+		p.ptr, err = wf.AddDataFrom(p.ptr, mod)
+		if err != nil {
+			return nil, err
+		}
+		err = wf.AddFuncsFrom(mod, func(remap map[int]int) {})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := wf.SetGlobal("$debug_start_mem", types.ValI32, fmt.Sprintf("i32.const %d", data_ptr))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/**
+ * Add the functions and globals of some of the embedded wat files to a module, for instrumentation
+ * which doesn't need any memory of its own. Wat files with data need AddPayload instead.
+ */
+func (wf *WasmFile) AddWatFuncs(files []string) error {
+	for _, file := range files {
+		mod, err := loadWat(file)
+		if err != nil {
+			return err
+		}
+		if len(mod.Data) > 0 {
+			return fmt.Errorf("%s has data, so it has to be added as a payload", file)
+		}
+
+		err = wf.AddFuncsFrom(mod, func(remap map[int]int) {})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode one of the embedded wat files
+func loadWat(file string) (*WasmFile, error) {
+	data, err := wat.Wat_content.ReadFile(path.Join("wat_code", file))
+	if err != nil {
+		return nil, err
+	}
+	mod := &WasmFile{}
+	err = mod.DecodeWatFile(file, data)
+	if err != nil {
+		return nil, err
+	}
+	return mod, nil
+}
+
+// Add some data to the end of the payload
+func (p *Payload) AddData(name string, data []byte) {
+	p.ptr = p.wf.addDataAt(p.ptr, name, data)
+}
+
+/**
+ * Resolve the references to payload functions, globals and data in some code. This is done last,
+ * once all the instrumentation has been added to it.
+ */
+func (p *Payload) Resolve(c *CodeEntry) error {
+	// We need to fixup any instructions that refer to data that may move.
+	err := c.InsertAfterRelocating(p.wf, `global.get $debug_start_mem
+		i32.add`)
+	if err != nil {
+		return err
+	}
+
+	err = c.ResolveLengths(p.wf)
+	if err != nil {
+		return err
+	}
+
+	err = c.ResolveRelocations(p.wf, p.DataPtr)
+	if err != nil {
+		return err
+	}
+
+	err = c.ResolveGlobals(p.wf)
+	if err != nil {
+		return err
+	}
+
+	return c.ResolveFunctions(p.wf)
+}
+
+/**
+ * Grow memory to hold the payload data, and set $debug_mem_size so memory.wat can hide it.
+ * Returns the size of the payload in 64k pages.
+ */
+func (p *Payload) Finish() (int, error) {
+	end := p.DataPtr
+	for _, d := range p.wf.Data {
+		if len(d.Offset) == 0 || d.Offset[0].Opcode != expression.InstrToOpcode["i32.const"] {
+			continue
+		}
+		start := int(uint32(d.Offset[0].I32Value))
+		if start >= p.DataPtr && start+len(d.Data) > end {
+			end = start + len(d.Data)
+		}
+	}
+
+	total_payload_data := end - p.DataPtr
+	if total_payload_data <= 0 {
+		return 0, errors.New("The payload has no data")
+	}
+	payload_size := (total_payload_data + wasmPageSize - 1) / wasmPageSize
+
+	err := p.wf.SetGlobal("$debug_mem_size", types.ValI32, fmt.Sprintf("i32.const %d", payload_size)) // The size of our addition in 64k pages
+	if err != nil {
+		return 0, err
+	}
+	p.wf.Memory[0].LimitMin = p.wf.Memory[0].LimitMin + payload_size
+	return payload_size, nil
+}
@@ -0,0 +1,65 @@
+package wasmfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const payloadTestWat = `(module
+  (memory 2)
+  (data $hello (i32.const 1000) "hello")
+)
+`
+
+func TestPayload(t *testing.T) {
+	wf := NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(payloadTestWat)))
+
+	// memory.wat has no data, so the payload data has to start at the end of memory
+	p, err := wf.AddPayload([]string{"memory.wat"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2<<16, p.DataPtr)
+
+	p.AddData("$one", make([]byte, 3))
+	p.AddData("$two", make([]byte, 70000))
+	assert.Equal(t, int32(2<<16), wf.Data[1].Offset[0].I32Value)
+	assert.Equal(t, int32(2<<16+8), wf.Data[2].Offset[0].I32Value)
+
+	size, err := p.Finish()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+	assert.Equal(t, 4, wf.Memory[0].LimitMin)
+
+	g := wf.Global[wf.Debug.LookupGlobalID("$debug_mem_size")]
+	assert.Equal(t, int32(2), g.Expression[0].I32Value)
+	g = wf.Global[wf.Debug.LookupGlobalID("$debug_start_mem")]
+	assert.Equal(t, int32(2<<16), g.Expression[0].I32Value)
+}
+
+func TestPayloadErrors(t *testing.T) {
+	wf := NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(payloadTestWat)))
+	p, err := wf.AddPayload([]string{"memory.wat"})
+	assert.NoError(t, err)
+	_, err = p.Finish()
+	assert.Error(t, err)
+
+	wf = NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte(payloadTestWat)))
+	wf.Memory = nil
+	_, err = wf.AddPayload([]string{"memory.wat"})
+	assert.Error(t, err)
+}
+
+func TestAddWatFuncs(t *testing.T) {
+	// No memory is needed for wat files without data
+	wf := NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte("(module\n)")))
+	assert.NoError(t, wf.AddWatFuncs([]string{"meter.wat"}))
+	assert.NotEqual(t, -1, wf.Debug.LookupFunctionID("$meter_exhausted"))
+	assert.NotEqual(t, -1, wf.Debug.LookupGlobalID("$meter_fuel"))
+
+	assert.Error(t, wf.AddWatFuncs([]string{"addsource.wat"}))
+	assert.Error(t, wf.AddWatFuncs([]string{"missing.wat"}))
+}
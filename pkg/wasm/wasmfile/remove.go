@@ -0,0 +1,208 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+// Remap for removing item idx from a list of n items
+func removalRemap(n int, idx int) map[int]int {
+	remap := make(map[int]int)
+	for i := 0; i < n; i++ {
+		if i < idx {
+			remap[i] = i
+		} else if i > idx {
+			remap[i] = i - 1
+		}
+	}
+	return remap
+}
+
+/**
+ * Remove a function (import or code) and renumber everything after it.
+ * The removal is rejected if anything still refers to the function.
+ */
+func (wf *WasmFile) RemoveFunction(fid int) error {
+	numFunctions := len(wf.Import) + len(wf.Code)
+	if fid < 0 || fid >= numFunctions {
+		return fmt.Errorf("Function %d not found", fid)
+	}
+
+	name := wf.Debug.FunctionNames[fid]
+
+	// Check for any references
+	for idx, c := range wf.Code {
+		caller := len(wf.Import) + idx
+		if caller == fid {
+			continue
+		}
+		for _, e := range c.Expression {
+			if e.Opcode != expression.InstrToOpcode["call"] {
+				continue
+			}
+			if (e.FunctionNeedsLinking && e.FunctionId == name && name != "") ||
+				(!e.FunctionNeedsLinking && e.FuncIndex == fid) {
+				return fmt.Errorf("Function %d is still called from function %d PC %d", fid, caller, e.PC)
+			}
+		}
+	}
+	for idx, el := range wf.Elem {
+		for _, i := range el.Indexes {
+			if int(i) == fid {
+				return fmt.Errorf("Function %d is still referenced by elem %d", fid, idx)
+			}
+		}
+	}
+	for _, ex := range wf.Export {
+		if ex.Type == types.ExportFunc && ex.Index == fid {
+			return fmt.Errorf("Function %d is still exported as %s", fid, ex.Name)
+		}
+	}
+
+	// Now remove it
+	if fid < len(wf.Import) {
+		wf.Import = append(wf.Import[:fid], wf.Import[fid+1:]...)
+	} else {
+		cid := fid - len(wf.Import)
+		wf.Function = append(wf.Function[:cid], wf.Function[cid+1:]...)
+		wf.Code = append(wf.Code[:cid], wf.Code[cid+1:]...)
+	}
+
+	remap := removalRemap(numFunctions, fid)
+	for _, c := range wf.Code {
+		c.ModifyAllCalls(remap)
+	}
+	for _, el := range wf.Elem {
+		for idx, i := range el.Indexes {
+			el.Indexes[idx] = uint64(remap[int(i)])
+		}
+	}
+	for _, ex := range wf.Export {
+		if ex.Type == types.ExportFunc {
+			ex.Index = remap[ex.Index]
+		}
+	}
+	wf.MarkSectionDirty(types.SectionElem, types.SectionExport)
+	wf.Debug.RenumberFunctions(remap)
+	return nil
+}
+
+/**
+ * Remove a global and renumber everything after it.
+ * The removal is rejected if anything still refers to the global.
+ */
+func (wf *WasmFile) RemoveGlobal(gid int) error {
+	if gid < 0 || gid >= len(wf.Global) {
+		return fmt.Errorf("Global %d not found", gid)
+	}
+
+	name := wf.Debug.GlobalNames[gid]
+
+	refersTo := func(exp []*expression.Expression) bool {
+		for _, e := range exp {
+			if e.Opcode != expression.InstrToOpcode["global.get"] &&
+				e.Opcode != expression.InstrToOpcode["global.set"] {
+				continue
+			}
+			if (e.GlobalNeedsLinking && e.GlobalId == name && name != "") ||
+				(!e.GlobalNeedsLinking && e.GlobalIndex == gid) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for idx, c := range wf.Code {
+		if refersTo(c.Expression) {
+			return fmt.Errorf("Global %d is still used by function %d", gid, len(wf.Import)+idx)
+		}
+	}
+	for idx, g := range wf.Global {
+		if idx != gid && refersTo(g.Expression) {
+			return fmt.Errorf("Global %d is still used by global %d", gid, idx)
+		}
+	}
+	for idx, d := range wf.Data {
+		if refersTo(d.Offset) {
+			return fmt.Errorf("Global %d is still used by data %d", gid, idx)
+		}
+	}
+	for idx, el := range wf.Elem {
+		if refersTo(el.Offset) {
+			return fmt.Errorf("Global %d is still used by elem %d", gid, idx)
+		}
+	}
+	for _, ex := range wf.Export {
+		if ex.Type == types.ExportGlobal && ex.Index == gid {
+			return fmt.Errorf("Global %d is still exported as %s", gid, ex.Name)
+		}
+	}
+
+	remap := removalRemap(len(wf.Global), gid)
+	wf.Global = append(wf.Global[:gid], wf.Global[gid+1:]...)
+
+	for _, c := range wf.Code {
+		c.ModifyAllGlobals(remap)
+	}
+	for _, g := range wf.Global {
+		expression.ModifyAllGlobalIndexes(g.Expression, remap)
+	}
+	for _, d := range wf.Data {
+		expression.ModifyAllGlobalIndexes(d.Offset, remap)
+	}
+	for _, el := range wf.Elem {
+		expression.ModifyAllGlobalIndexes(el.Offset, remap)
+	}
+	for _, ex := range wf.Export {
+		if ex.Type == types.ExportGlobal {
+			ex.Index = remap[ex.Index]
+		}
+	}
+	wf.MarkSectionDirty(types.SectionGlobal, types.SectionData, types.SectionElem, types.SectionExport)
+	wf.Debug.RenumberGlobals(remap)
+	return nil
+}
+
+/**
+ * Remove a data entry.
+ * The removal is rejected if any code still refers to it by name (offset() / length()).
+ */
+func (wf *WasmFile) RemoveData(did int) error {
+	if did < 0 || did >= len(wf.Data) {
+		return fmt.Errorf("Data %d not found", did)
+	}
+
+	name := wf.Debug.DataNames[did]
+	if name != "" {
+		for idx, c := range wf.Code {
+			for _, e := range c.Expression {
+				if (e.DataOffsetNeedsLinking || e.DataLengthNeedsLinking) && e.I32DataId == name {
+					return fmt.Errorf("Data %d is still used by function %d PC %d", did, len(wf.Import)+idx, e.PC)
+				}
+			}
+		}
+	}
+
+	remap := removalRemap(len(wf.Data), did)
+	wf.Data = append(wf.Data[:did], wf.Data[did+1:]...)
+	wf.Debug.RenumberData(remap)
+	return nil
+}
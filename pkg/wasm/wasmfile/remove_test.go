@@ -0,0 +1,69 @@
+package wasmfile
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveFunction(t *testing.T) {
+	wf := newTestModule(t)
+
+	// $add is called by $hello, and $hello is exported
+	assert.Error(t, wf.RemoveFunction(1))
+	assert.Error(t, wf.RemoveFunction(2))
+	assert.Error(t, wf.RemoveFunction(3))
+
+	// Remove the export, then $hello, then $add, then the import
+	wf.Export = nil
+	assert.NoError(t, wf.RemoveFunction(2))
+	assert.Equal(t, 1, len(wf.Code))
+	assert.Equal(t, 1, len(wf.Function))
+	assert.NoError(t, wf.RemoveFunction(0))
+	assert.Equal(t, 0, len(wf.Import))
+	assert.Equal(t, "$add", wf.Debug.FunctionNames[0])
+	assert.NoError(t, wf.Validate())
+}
+
+func TestRemoveFunctionRenumbers(t *testing.T) {
+	wf := newTestModule(t)
+
+	// Nothing calls the import once $hello stops calling it
+	hello := wf.Code[1]
+	for i, e := range hello.Expression {
+		if e.Name() == "call" && e.FuncIndex == 0 {
+			hello.Expression = append(hello.Expression[:i-4], hello.Expression[i+2:]...)
+			break
+		}
+	}
+	assert.NoError(t, wf.RemoveFunction(0))
+
+	// Calls and exports have moved down one
+	assert.Equal(t, 1, wf.Export[0].Index)
+	for _, e := range hello.Expression {
+		if e.Name() == "call" {
+			assert.Equal(t, 0, e.FuncIndex)
+		}
+	}
+	assert.Equal(t, 1, wf.Debug.LookupFunctionID("$hello"))
+	assert.NoError(t, wf.Validate())
+}
+
+func TestRemoveGlobalAndData(t *testing.T) {
+	wf := newTestModule(t)
+	_, err := wf.AddGlobal("$unused", types.ValI32, true, "i32.const 5")
+	assert.NoError(t, err)
+
+	assert.Error(t, wf.RemoveGlobal(0))
+	assert.NoError(t, wf.RemoveGlobal(1))
+	assert.Equal(t, 1, len(wf.Global))
+
+	// $message is used by offset()
+	assert.Error(t, wf.RemoveData(0))
+	wf.AddData("$other", []byte("x"))
+	assert.NoError(t, wf.RemoveData(0+1))
+	assert.Equal(t, 1, len(wf.Data))
+	assert.Equal(t, "$message", wf.Debug.DataNames[0])
+	assert.NoError(t, wf.Validate())
+}
@@ -0,0 +1,142 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+/**
+ * Rename an export. The new name must not already be exported.
+ *
+ */
+func (wf *WasmFile) RenameExport(oldName string, newName string) error {
+	var found *ExportEntry
+	for _, e := range wf.Export {
+		if e.Name == newName && oldName != newName {
+			return fmt.Errorf("Export %s already exists", newName)
+		}
+		if e.Name == oldName {
+			found = e
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("Export %s not found", oldName)
+	}
+	found.Name = newName
+	wf.MarkSectionDirty(types.SectionExport)
+	return nil
+}
+
+/**
+ * Retarget an import to a different module and/or name. The function index and signature are unchanged.
+ *
+ */
+func (wf *WasmFile) RenameImport(module string, name string, newModule string, newName string) error {
+	found := false
+	for _, i := range wf.Import {
+		if i.Module == module && i.Name == name {
+			i.Module = newModule
+			i.Name = newName
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Import %s:%s not found", module, name)
+	}
+	wf.MarkSectionDirty(types.SectionImport)
+	return nil
+}
+
+/**
+ * Retarget every import from one module to another (eg wasi_unstable to wasi_snapshot_preview1).
+ *
+ */
+func (wf *WasmFile) RenameImportModule(module string, newModule string) error {
+	found := false
+	for _, i := range wf.Import {
+		if i.Module == module {
+			i.Module = newModule
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("No imports from module %s found", module)
+	}
+	wf.MarkSectionDirty(types.SectionImport)
+	return nil
+}
+
+/**
+ * Change the signature of a function import. Every function that calls it directly is validated against
+ * the new type, and if any of them no longer validates the import is left as it was.
+ * Table entries aren't checked, since call_indirect checks the type when it's called.
+ */
+func (wf *WasmFile) ResignImport(module string, name string, te *TypeEntry) error {
+	fid := -1
+	for idx, i := range wf.Import {
+		if i.Module == module && i.Name == name && i.Type == types.ExportFunc {
+			fid = idx
+			break
+		}
+	}
+	if fid == -1 {
+		return fmt.Errorf("Import %s:%s not found", module, name)
+	}
+
+	fname := ""
+	if wf.Debug != nil {
+		fname = wf.Debug.FunctionNames[fid]
+	}
+
+	oldIndex := wf.Import[fid].Index
+	oldTypes := len(wf.Type)
+	wf.Import[fid].Index = wf.AddTypeMaybe(te)
+
+	for idx, c := range wf.Code {
+		if !c.callsFunction(fid, fname) {
+			continue
+		}
+		caller := len(wf.Import) + idx
+		err := wf.validateCode(c, wf.Type[wf.Function[idx].TypeIndex])
+		if err != nil {
+			wf.Import[fid].Index = oldIndex
+			wf.Type = wf.Type[:oldTypes]
+			return fmt.Errorf("Import %s:%s is called from function %d (%s), which doesn't fit the new signature: %w", module, name, caller, wf.functionName(caller), err)
+		}
+	}
+
+	wf.MarkSectionDirty(types.SectionType, types.SectionImport)
+	return nil
+}
+
+// Check for a direct call to a function, by index or by name if the call isn't linked yet
+func (c *CodeEntry) callsFunction(fid int, name string) bool {
+	for _, e := range c.Expression {
+		if e.Opcode != expression.InstrToOpcode["call"] {
+			continue
+		}
+		if (e.FunctionNeedsLinking && e.FunctionId == name && name != "") ||
+			(!e.FunctionNeedsLinking && e.FuncIndex == fid) {
+			return true
+		}
+	}
+	return false
+}
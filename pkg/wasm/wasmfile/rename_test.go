@@ -0,0 +1,61 @@
+package wasmfile
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameExport(t *testing.T) {
+	wf := newTestModule(t)
+	name := wf.Export[0].Name
+
+	assert.Error(t, wf.RenameExport("missing", "other"))
+	assert.NoError(t, wf.RenameExport(name, "renamed"))
+	assert.Equal(t, "renamed", wf.Export[0].Name)
+
+	wf.Export = append(wf.Export, &ExportEntry{Name: "second", Type: wf.Export[0].Type, Index: wf.Export[0].Index})
+	assert.Error(t, wf.RenameExport("renamed", "second"))
+}
+
+func TestRenameImport(t *testing.T) {
+	wf := newTestModule(t)
+	module := wf.Import[0].Module
+	name := wf.Import[0].Name
+
+	assert.Error(t, wf.RenameImport("missing", name, "a", "b"))
+	assert.NoError(t, wf.RenameImport(module, name, "wasi_snapshot_preview1", "fd_write"))
+	assert.Equal(t, 0, wf.LookupImport("wasi_snapshot_preview1:fd_write"))
+
+	assert.NoError(t, wf.RenameImportModule("wasi_snapshot_preview1", "env"))
+	assert.Equal(t, "env", wf.Import[0].Module)
+	assert.Error(t, wf.RenameImportModule("wasi_snapshot_preview1", "env"))
+}
+
+func TestResignImport(t *testing.T) {
+	wf := newTestModule(t)
+	numTypes := len(wf.Type)
+
+	assert.Error(t, wf.ResignImport("missing", "fd_write", &TypeEntry{}))
+
+	// $hello calls it with 4 params, so it can't lose any
+	err := wf.ResignImport("wasi_snapshot_preview1", "fd_write", &TypeEntry{Param: []types.ValType{types.ValI32}, Result: []types.ValType{types.ValI32}})
+	assert.ErrorContains(t, err, "called from function 2")
+	assert.Equal(t, 0, wf.Import[0].Index)
+	assert.Equal(t, numTypes, len(wf.Type))
+
+	// The result is dropped, so it can change
+	i32 := types.ValI32
+	err = wf.ResignImport("wasi_snapshot_preview1", "fd_write", &TypeEntry{Param: []types.ValType{i32, i32, i32, i32}, Result: []types.ValType{types.ValI64}})
+	assert.NoError(t, err)
+	assert.Equal(t, numTypes, wf.Import[0].Index)
+	assert.Equal(t, []types.ValType{types.ValI64}, wf.Type[wf.Import[0].Index].Result)
+	assert.NoError(t, wf.Validate())
+
+	// Once nothing calls it, anything goes
+	wf.Code[1].Expression = wf.Code[1].Expression[6:]
+	assert.NoError(t, wf.ResignImport("wasi_snapshot_preview1", "fd_write", &TypeEntry{}))
+	assert.NoError(t, wf.Validate())
+}
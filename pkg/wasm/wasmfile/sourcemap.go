@@ -0,0 +1,154 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/encoding"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+// A version 3 source map, as used by browser devtools
+type SourceMap struct {
+	Version  int      `json:"version"`
+	Sources  []string `json:"sources"`
+	Names    []string `json:"names"`
+	Mappings string   `json:"mappings"`
+}
+
+const base64Chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+func writeVLQ(sb *strings.Builder, v int) {
+	u := v << 1
+	if v < 0 {
+		u = (-v << 1) | 1
+	}
+	for {
+		digit := u & 0x1f
+		u >>= 5
+		if u > 0 {
+			digit |= 0x20
+		}
+		sb.WriteByte(base64Chars[digit])
+		if u == 0 {
+			return
+		}
+	}
+}
+
+/**
+ * Find where the body of the code section will be in the encoded binary.
+ * The dwarf line table addresses are relative to this.
+ */
+func (wf *WasmFile) codeSectionOffset() (int, error) {
+	var buf bytes.Buffer
+	err := wf.EncodeBinary(&buf)
+	if err != nil {
+		return 0, err
+	}
+	return sectionOffset(buf.Bytes(), types.SectionCode)
+}
+
+// Find where the body of a section starts in a binary
+func sectionOffset(data []byte, sid types.SectionId) (int, error) {
+	ptr := 8
+	for ptr < len(data) {
+		id := data[ptr]
+		length, l := binary.Uvarint(data[ptr+1:])
+		if l <= 0 {
+			return 0, errors.New("Invalid section header")
+		}
+		ptr += 1 + l
+		if id == byte(sid) {
+			return ptr, nil
+		}
+		ptr += int(length)
+	}
+	return 0, fmt.Errorf("No %s section", sid)
+}
+
+/**
+ * Generate a source map from the dwarf line numbers, which must have been parsed already.
+ * Columns in the map are byte offsets in the encoded binary, which is how browsers map wasm.
+ */
+func (wf *WasmFile) GenerateSourceMap() (*SourceMap, error) {
+	if wf.Debug.NumLines() == 0 {
+		return nil, errors.New("No dwarf line numbers")
+	}
+
+	codeOffset, err := wf.codeSectionOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	sm := &SourceMap{
+		Version: 3,
+		Sources: make([]string, 0),
+		Names:   make([]string, 0),
+	}
+	sourceIndex := make(map[string]int)
+
+	var sb strings.Builder
+	lastColumn, lastSource, lastLine, lastSourceColumn := 0, 0, 0, 0
+	wf.Debug.EachLine(func(pc uint64, _ uint64, li debug.LineInfo) {
+		if li.Linenumber == 0 {
+			// Compiler generated code with no line
+			return
+		}
+		src, ok := sourceIndex[li.Filename]
+		if !ok {
+			src = len(sm.Sources)
+			sourceIndex[li.Filename] = src
+			sm.Sources = append(sm.Sources, li.Filename)
+		}
+		// Source map lines and columns are zero based
+		line := li.Linenumber - 1
+		column := li.Column - 1
+		if column < 0 {
+			column = 0
+		}
+
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		offset := codeOffset + int(pc)
+		writeVLQ(&sb, offset-lastColumn)
+		writeVLQ(&sb, src-lastSource)
+		writeVLQ(&sb, line-lastLine)
+		writeVLQ(&sb, column-lastSourceColumn)
+		lastColumn, lastSource, lastLine, lastSourceColumn = offset, src, line, column
+	})
+	sm.Mappings = sb.String()
+	return sm, nil
+}
+
+// Set the sourceMappingURL custom section, which tells browsers where to find the source map.
+func (wf *WasmFile) SetSourceMapURL(url string) error {
+	var buf bytes.Buffer
+	err := encoding.WriteString(&buf, url)
+	if err != nil {
+		return err
+	}
+	wf.SetCustomSection("sourceMappingURL", buf.Bytes())
+	return nil
+}
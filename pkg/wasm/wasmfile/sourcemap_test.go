@@ -0,0 +1,42 @@
+package wasmfile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteVLQ(t *testing.T) {
+	var sb strings.Builder
+	for _, v := range []int{0, 1, -1, 15, 16, 1000} {
+		writeVLQ(&sb, v)
+	}
+	assert.Equal(t, "ACDegBw+B", sb.String())
+}
+
+func TestGenerateSourceMap(t *testing.T) {
+	wf := NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte("(module\n(func $f\nnop\nnop\n)\n)\n")))
+
+	_, err := wf.GenerateSourceMap()
+	assert.Error(t, err)
+
+	wf.Debug.AddLineInfo(1, debug.LineInfo{Filename: "a.c", Linenumber: 10, Column: 1})
+	wf.Debug.AddLineInfo(2, debug.LineInfo{Filename: "a.c", Linenumber: 11, Column: 3})
+
+	sm, err := wf.GenerateSourceMap()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, sm.Version)
+	assert.Equal(t, []string{"a.c"}, sm.Sources)
+
+	// The code section body starts at 23 in this module
+	offset, err := wf.codeSectionOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, 23, offset)
+	assert.Equal(t, "wBASA,CACE", sm.Mappings)
+
+	assert.NoError(t, wf.SetSourceMapURL("f.wasm.map"))
+	assert.Equal(t, append([]byte{10}, []byte("f.wasm.map")...), wf.GetCustomSectionData("sourceMappingURL"))
+}
@@ -0,0 +1,88 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/encoding"
+)
+
+const externalDebugInfoSection = "external_debug_info"
+
+/**
+ * Move the dwarf sections out into a companion file, and point at it with an external_debug_info
+ * section. As with wasm-split-dwarf, the companion is a copy of the whole module so that code
+ * addresses match, and browsers can load it directly.
+ */
+func (wf *WasmFile) SplitDwarf(url string) (*WasmFile, error) {
+	found := false
+	for _, c := range wf.Custom {
+		if IsDwarfSection(c.Name) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("No dwarf sections found")
+	}
+
+	companion := wf.Clone()
+	companion.RemoveCustomSection(externalDebugInfoSection)
+
+	wf.StripCustom(IsDwarfSection)
+
+	var buf bytes.Buffer
+	err := encoding.WriteString(&buf, url)
+	if err != nil {
+		return nil, err
+	}
+	wf.SetCustomSection(externalDebugInfoSection, buf.Bytes())
+	return companion, nil
+}
+
+// Get the url from the external_debug_info section, or "" if there isn't one
+func (wf *WasmFile) ExternalDebugInfo() string {
+	data := wf.GetCustomSectionData(externalDebugInfoSection)
+	if data == nil {
+		return ""
+	}
+	length, l := binary.Uvarint(data)
+	if l <= 0 || l+int(length) > len(data) {
+		return ""
+	}
+	return string(data[l : l+int(length)])
+}
+
+/**
+ * Find where the dwarf sections are. If there's an external_debug_info section, the companion
+ * file is loaded (relative to dir), otherwise the dwarf is in this module.
+ */
+func (wf *WasmFile) DebugSections(dir string) (debug.CustomSectionProvider, error) {
+	url := wf.ExternalDebugInfo()
+	if url == "" {
+		return wf, nil
+	}
+	if !filepath.IsAbs(url) {
+		url = filepath.Join(dir, url)
+	}
+	return New(url)
+}
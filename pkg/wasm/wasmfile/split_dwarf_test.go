@@ -0,0 +1,42 @@
+package wasmfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitDwarf(t *testing.T) {
+	wf := NewEmpty()
+	assert.NoError(t, wf.DecodeWat([]byte("(module\n(func $f\nnop\n)\n)\n")))
+
+	_, err := wf.SplitDwarf("f.debug.wasm")
+	assert.Error(t, err)
+
+	wf.SetCustomSection(".debug_info", []byte{1, 2, 3})
+	wf.SetCustomSection("producers", []byte{4})
+
+	companion, err := wf.SplitDwarf("f.debug.wasm")
+	assert.NoError(t, err)
+
+	assert.Nil(t, wf.GetCustomSectionData(".debug_info"))
+	assert.NotNil(t, wf.GetCustomSectionData("producers"))
+	assert.Equal(t, "f.debug.wasm", wf.ExternalDebugInfo())
+
+	assert.Equal(t, []byte{1, 2, 3}, companion.GetCustomSectionData(".debug_info"))
+	assert.Equal(t, "", companion.ExternalDebugInfo())
+	assert.Equal(t, len(wf.Code), len(companion.Code))
+
+	// Find the dwarf through the companion file
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "f.debug.wasm"))
+	assert.NoError(t, err)
+	assert.NoError(t, companion.EncodeBinary(f))
+	assert.NoError(t, f.Close())
+
+	ds, err := wf.DebugSections(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, ds.GetCustomSectionData(".debug_info"))
+}
@@ -0,0 +1,826 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+)
+
+const wasmPageSize = 65536
+const wasmMaxPages = 65536
+
+// Used on the operand stack when the type is unknown (after unreachable / br etc)
+const valUnknown = types.ValType(0)
+
+/**
+ * Validate checks the module is well formed before it gets written out.
+ * Indexes, memory / table bounds, block nesting and the stack typing of every function are checked.
+ * The first problem found is returned.
+ */
+func (wf *WasmFile) Validate() error {
+	for idx, i := range wf.Import {
+		if i.Type != types.ExportFunc {
+			return fmt.Errorf("Import %d %s:%s: only func imports are supported", idx, i.Module, i.Name)
+		}
+		if i.Index < 0 || i.Index >= len(wf.Type) {
+			return fmt.Errorf("Import %d %s:%s: type index %d out of range", idx, i.Module, i.Name, i.Index)
+		}
+	}
+
+	if len(wf.Function) != len(wf.Code) {
+		return fmt.Errorf("Function section has %d entries but code section has %d", len(wf.Function), len(wf.Code))
+	}
+
+	for idx, f := range wf.Function {
+		if f.TypeIndex < 0 || f.TypeIndex >= len(wf.Type) {
+			return fmt.Errorf("Function %d: type index %d out of range", len(wf.Import)+idx, f.TypeIndex)
+		}
+	}
+
+	for idx, m := range wf.Memory {
+		err := validateLimits(m.LimitMin, m.LimitMax)
+		if err != nil {
+			return fmt.Errorf("Memory %d: %w", idx, err)
+		}
+		if m.Shared && m.LimitMax == 0 {
+			return fmt.Errorf("Memory %d: shared memory needs a max", idx)
+		}
+	}
+
+	for idx, t := range wf.Table {
+		if t.TableType != types.TableTypeFuncref {
+			return fmt.Errorf("Table %d: unsupported table type %x", idx, t.TableType)
+		}
+		if t.LimitMax != 0 && t.LimitMin > t.LimitMax {
+			return fmt.Errorf("Table %d: limit min %d > max %d", idx, t.LimitMin, t.LimitMax)
+		}
+	}
+
+	for idx, g := range wf.Global {
+		err := wf.validateConstExpression(g.Expression, g.Type)
+		if err != nil {
+			return fmt.Errorf("Global %d: %w", idx, err)
+		}
+	}
+
+	for idx, e := range wf.Export {
+		err := wf.validateExport(e)
+		if err != nil {
+			return fmt.Errorf("Export %d \"%s\": %w", idx, e.Name, err)
+		}
+	}
+
+	for idx, el := range wf.Elem {
+		err := wf.validateElem(el)
+		if err != nil {
+			return fmt.Errorf("Elem %d: %w", idx, err)
+		}
+	}
+
+	for idx, d := range wf.Data {
+		err := wf.validateData(d)
+		if err != nil {
+			return fmt.Errorf("Data %d (%s): %w", idx, wf.dataName(idx), err)
+		}
+	}
+
+	for idx, c := range wf.Code {
+		fid := len(wf.Import) + idx
+		err := wf.validateCode(c, wf.Type[wf.Function[idx].TypeIndex])
+		if err != nil {
+			return fmt.Errorf("Function %d (%s): %w", fid, wf.functionName(fid), err)
+		}
+	}
+
+	return nil
+}
+
+func (wf *WasmFile) functionName(fid int) string {
+	if wf.Debug == nil {
+		return ""
+	}
+	return wf.Debug.GetFunctionIdentifier(fid, true)
+}
+
+func (wf *WasmFile) dataName(idx int) string {
+	if wf.Debug == nil {
+		return ""
+	}
+	return wf.Debug.GetDataIdentifier(idx)
+}
+
+func validateLimits(min int, max int) error {
+	if min > wasmMaxPages {
+		return fmt.Errorf("limit min %d pages too large", min)
+	}
+	if max != 0 && min > max {
+		return fmt.Errorf("limit min %d > max %d", min, max)
+	}
+	if max > wasmMaxPages {
+		return fmt.Errorf("limit max %d pages too large", max)
+	}
+	return nil
+}
+
+/**
+ * Get the type of a function in the function index space (imports first)
+ *
+ */
+func (wf *WasmFile) functionType(fid int) (*TypeEntry, error) {
+	if fid < 0 || fid >= len(wf.Import)+len(wf.Code) {
+		return nil, fmt.Errorf("function index %d out of range", fid)
+	}
+	tidx := 0
+	if fid < len(wf.Import) {
+		tidx = wf.Import[fid].Index
+	} else {
+		tidx = wf.Function[fid-len(wf.Import)].TypeIndex
+	}
+	if tidx < 0 || tidx >= len(wf.Type) {
+		return nil, fmt.Errorf("type index %d out of range", tidx)
+	}
+	return wf.Type[tidx], nil
+}
+
+func (wf *WasmFile) validateExport(e *ExportEntry) error {
+	if e.Type == types.ExportFunc {
+		if e.Index < 0 || e.Index >= len(wf.Import)+len(wf.Code) {
+			return fmt.Errorf("function index %d out of range", e.Index)
+		}
+	} else if e.Type == types.ExportTable {
+		if e.Index < 0 || e.Index >= len(wf.Table) {
+			return fmt.Errorf("table index %d out of range", e.Index)
+		}
+	} else if e.Type == types.ExportMem {
+		if e.Index < 0 || e.Index >= len(wf.Memory) {
+			return fmt.Errorf("memory index %d out of range", e.Index)
+		}
+	} else if e.Type == types.ExportGlobal {
+		if e.Index < 0 || e.Index >= len(wf.Global) {
+			return fmt.Errorf("global index %d out of range", e.Index)
+		}
+	} else {
+		return fmt.Errorf("unknown export type %d", e.Type)
+	}
+	return nil
+}
+
+/**
+ * Check a constant expression (global init, data / elem offset)
+ *
+ */
+func (wf *WasmFile) validateConstExpression(exp []*expression.Expression, t types.ValType) error {
+	if len(exp) != 1 {
+		return fmt.Errorf("expected a single constant instruction, found %d", len(exp))
+	}
+	e := exp[0]
+	var et types.ValType
+	if e.Opcode == expression.InstrToOpcode["i32.const"] {
+		et = types.ValI32
+	} else if e.Opcode == expression.InstrToOpcode["i64.const"] {
+		et = types.ValI64
+	} else if e.Opcode == expression.InstrToOpcode["f32.const"] {
+		et = types.ValF32
+	} else if e.Opcode == expression.InstrToOpcode["f64.const"] {
+		et = types.ValF64
+	} else if e.Opcode == expression.InstrToOpcode["global.get"] {
+		if e.GlobalIndex < 0 || e.GlobalIndex >= len(wf.Global) {
+			return fmt.Errorf("global index %d out of range", e.GlobalIndex)
+		}
+		if wf.Global[e.GlobalIndex].Mut != 0 {
+			return fmt.Errorf("global %d is mutable, so cannot be used in a constant", e.GlobalIndex)
+		}
+		et = wf.Global[e.GlobalIndex].Type
+	} else {
+		return fmt.Errorf("opcode %d is not a constant instruction", e.Opcode)
+	}
+	if et != t {
+		return fmt.Errorf("constant type %s does not match %s", types.ByteToValType[et], types.ByteToValType[t])
+	}
+	return nil
+}
+
+func (wf *WasmFile) validateElem(el *ElemEntry) error {
+	if el.TableIndex < 0 || el.TableIndex >= len(wf.Table) {
+		return fmt.Errorf("table index %d out of range", el.TableIndex)
+	}
+	err := wf.validateConstExpression(el.Offset, types.ValI32)
+	if err != nil {
+		return err
+	}
+	for _, fid := range el.Indexes {
+		if fid >= uint64(len(wf.Import)+len(wf.Code)) {
+			return fmt.Errorf("function index %d out of range", fid)
+		}
+	}
+	if el.Offset[0].Opcode == expression.InstrToOpcode["i32.const"] {
+		end := int64(uint32(el.Offset[0].I32Value)) + int64(len(el.Indexes))
+		if end > int64(wf.Table[el.TableIndex].LimitMin) {
+			return fmt.Errorf("entries end at %d, beyond table size %d", end, wf.Table[el.TableIndex].LimitMin)
+		}
+	}
+	return nil
+}
+
+func (wf *WasmFile) validateData(d *DataEntry) error {
+	if d.MemIndex < 0 || d.MemIndex >= len(wf.Memory) {
+		return fmt.Errorf("memory index %d out of range", d.MemIndex)
+	}
+	err := wf.validateConstExpression(d.Offset, types.ValI32)
+	if err != nil {
+		return err
+	}
+	if d.Offset[0].Opcode == expression.InstrToOpcode["i32.const"] {
+		end := int64(uint32(d.Offset[0].I32Value)) + int64(len(d.Data))
+		if end > int64(wf.Memory[d.MemIndex].LimitMin)*wasmPageSize {
+			return fmt.Errorf("data ends at %d, beyond memory size %d pages", end, wf.Memory[d.MemIndex].LimitMin)
+		}
+	}
+	return nil
+}
+
+// A control frame (function body, block, loop or if)
+type validateFrame struct {
+	opcode      expression.Opcode
+	params      []types.ValType
+	results     []types.ValType
+	height      int
+	unreachable bool
+}
+
+// Labels for a loop refer to the start, so take the params. Everything else takes the results.
+func (f *validateFrame) labelTypes() []types.ValType {
+	if f.opcode == expression.InstrToOpcode["loop"] {
+		return f.params
+	}
+	return f.results
+}
+
+// Validation state for a single function
+type validator struct {
+	wf     *WasmFile
+	locals []types.ValType
+	stack  []types.ValType
+	frames []*validateFrame
+}
+
+func (v *validator) push(t ...types.ValType) {
+	v.stack = append(v.stack, t...)
+}
+
+func (v *validator) pop(expect types.ValType) (types.ValType, error) {
+	f := v.frames[len(v.frames)-1]
+	if len(v.stack) == f.height {
+		if f.unreachable {
+			return expect, nil
+		}
+		return valUnknown, errors.New("stack underflow")
+	}
+	t := v.stack[len(v.stack)-1]
+	v.stack = v.stack[:len(v.stack)-1]
+	if expect != valUnknown && t != valUnknown && t != expect {
+		return t, fmt.Errorf("expected %s on stack, found %s", types.ByteToValType[expect], types.ByteToValType[t])
+	}
+	if t == valUnknown {
+		return expect, nil
+	}
+	return t, nil
+}
+
+// Pop a list of values, last one first
+func (v *validator) popAll(expect []types.ValType) error {
+	for i := len(expect) - 1; i >= 0; i-- {
+		_, err := v.pop(expect[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameTypes(a []types.ValType, b []types.ValType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Anything after this in the current frame is unreachable
+func (v *validator) setUnreachable() {
+	f := v.frames[len(v.frames)-1]
+	v.stack = v.stack[:f.height]
+	f.unreachable = true
+}
+
+func (v *validator) label(l int) (*validateFrame, error) {
+	if l < 0 || l >= len(v.frames) {
+		return nil, fmt.Errorf("label %d out of range (depth %d)", l, len(v.frames))
+	}
+	return v.frames[len(v.frames)-1-l], nil
+}
+
+// Check the frame has exactly its results on the stack
+func (v *validator) checkFrameEnd(f *validateFrame) error {
+	err := v.popAll(f.results)
+	if err != nil {
+		return err
+	}
+	if len(v.stack) != f.height {
+		return fmt.Errorf("%d values left on stack at end of block", len(v.stack)-f.height)
+	}
+	return nil
+}
+
+// Returns the params and results of a block, loop or if
+func (wf *WasmFile) blockType(e *expression.Expression) ([]types.ValType, []types.ValType, error) {
+	if e.TypedBlock {
+		if e.TypeIndex < 0 || e.TypeIndex >= len(wf.Type) {
+			return nil, nil, fmt.Errorf("type index %d out of range", e.TypeIndex)
+		}
+		t := wf.Type[e.TypeIndex]
+		return t.Param, t.Result, nil
+	}
+	if e.Result == types.ValNone {
+		return nil, nil, nil
+	}
+	_, ok := types.ByteToValType[e.Result]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported block type %x", byte(e.Result))
+	}
+	return nil, []types.ValType{e.Result}, nil
+}
+
+func (wf *WasmFile) validateCode(c *CodeEntry, te *TypeEntry) error {
+	v := &validator{
+		wf: wf,
+	}
+	v.locals = append(v.locals, te.Param...)
+	v.locals = append(v.locals, c.Locals...)
+
+	v.frames = append(v.frames, &validateFrame{
+		opcode:  expression.InstrToOpcode["block"],
+		results: te.Result,
+	})
+
+	for _, e := range c.Expression {
+		err := v.validateInstr(e, te)
+		if err != nil {
+			return fmt.Errorf("PC %d (%s): %w", e.PC, e.Name(), err)
+		}
+	}
+
+	if len(v.frames) != 1 {
+		return fmt.Errorf("%d blocks not closed with end", len(v.frames)-1)
+	}
+	return v.checkFrameEnd(v.frames[0])
+}
+
+func (v *validator) validateInstr(e *expression.Expression, te *TypeEntry) error {
+	wf := v.wf
+
+	if e.Opcode == expression.InstrToOpcode["unreachable"] {
+		v.setUnreachable()
+	} else if e.Opcode == expression.InstrToOpcode["nop"] {
+		// Nothing to do
+	} else if e.Opcode == expression.InstrToOpcode["block"] ||
+		e.Opcode == expression.InstrToOpcode["loop"] ||
+		e.Opcode == expression.InstrToOpcode["if"] {
+		params, results, err := wf.blockType(e)
+		if err != nil {
+			return err
+		}
+		if e.Opcode == expression.InstrToOpcode["if"] {
+			_, err = v.pop(types.ValI32)
+			if err != nil {
+				return err
+			}
+		}
+		err = v.popAll(params)
+		if err != nil {
+			return err
+		}
+		v.frames = append(v.frames, &validateFrame{
+			opcode:  e.Opcode,
+			params:  params,
+			results: results,
+			height:  len(v.stack),
+		})
+		v.push(params...)
+	} else if e.Opcode == expression.InstrToOpcode["else"] {
+		f := v.frames[len(v.frames)-1]
+		if len(v.frames) == 1 || f.opcode != expression.InstrToOpcode["if"] {
+			return errors.New("else without if")
+		}
+		err := v.checkFrameEnd(f)
+		if err != nil {
+			return err
+		}
+		// The else branch starts again with the params
+		f.opcode = expression.InstrToOpcode["else"]
+		f.unreachable = false
+		v.push(f.params...)
+	} else if e.Opcode == expression.InstrToOpcode["end"] {
+		if len(v.frames) == 1 {
+			return errors.New("end without matching block")
+		}
+		f := v.frames[len(v.frames)-1]
+		err := v.checkFrameEnd(f)
+		if err != nil {
+			return err
+		}
+		// The missing else of an if passes the params straight through, so they must be the results.
+		if f.opcode == expression.InstrToOpcode["if"] && !sameTypes(f.params, f.results) {
+			return errors.New("if with a result needs an else")
+		}
+		v.frames = v.frames[:len(v.frames)-1]
+		v.push(f.results...)
+	} else if e.Opcode == expression.InstrToOpcode["br"] {
+		f, err := v.label(e.LabelIndex)
+		if err != nil {
+			return err
+		}
+		err = v.popAll(f.labelTypes())
+		if err != nil {
+			return err
+		}
+		v.setUnreachable()
+	} else if e.Opcode == expression.InstrToOpcode["br_if"] {
+		_, err := v.pop(types.ValI32)
+		if err != nil {
+			return err
+		}
+		f, err := v.label(e.LabelIndex)
+		if err != nil {
+			return err
+		}
+		err = v.popAll(f.labelTypes())
+		if err != nil {
+			return err
+		}
+		v.push(f.labelTypes()...)
+	} else if e.Opcode == expression.InstrToOpcode["br_table"] {
+		_, err := v.pop(types.ValI32)
+		if err != nil {
+			return err
+		}
+		def, err := v.label(e.LabelIndex)
+		if err != nil {
+			return err
+		}
+		for _, l := range e.Labels {
+			f, err := v.label(l)
+			if err != nil {
+				return err
+			}
+			if len(f.labelTypes()) != len(def.labelTypes()) {
+				return fmt.Errorf("label %d arity does not match default label %d", l, e.LabelIndex)
+			}
+		}
+		err = v.popAll(def.labelTypes())
+		if err != nil {
+			return err
+		}
+		v.setUnreachable()
+	} else if e.Opcode == expression.InstrToOpcode["return"] {
+		err := v.popAll(te.Result)
+		if err != nil {
+			return err
+		}
+		v.setUnreachable()
+	} else if e.Opcode == expression.InstrToOpcode["call"] {
+		ft, err := wf.functionType(e.FuncIndex)
+		if err != nil {
+			return err
+		}
+		err = v.popAll(ft.Param)
+		if err != nil {
+			return err
+		}
+		v.push(ft.Result...)
+	} else if e.Opcode == expression.InstrToOpcode["call_indirect"] {
+		if e.TableIndex < 0 || e.TableIndex >= len(wf.Table) {
+			return fmt.Errorf("table index %d out of range", e.TableIndex)
+		}
+		if e.TypeIndex < 0 || e.TypeIndex >= len(wf.Type) {
+			return fmt.Errorf("type index %d out of range", e.TypeIndex)
+		}
+		_, err := v.pop(types.ValI32)
+		if err != nil {
+			return err
+		}
+		ft := wf.Type[e.TypeIndex]
+		err = v.popAll(ft.Param)
+		if err != nil {
+			return err
+		}
+		v.push(ft.Result...)
+	} else if e.Opcode == expression.InstrToOpcode["drop"] {
+		_, err := v.pop(valUnknown)
+		if err != nil {
+			return err
+		}
+	} else if e.Opcode == expression.InstrToOpcode["select"] {
+		_, err := v.pop(types.ValI32)
+		if err != nil {
+			return err
+		}
+		t1, err := v.pop(valUnknown)
+		if err != nil {
+			return err
+		}
+		t2, err := v.pop(t1)
+		if err != nil {
+			return err
+		}
+		v.push(t2)
+	} else if e.Opcode == expression.InstrToOpcode["local.get"] ||
+		e.Opcode == expression.InstrToOpcode["local.set"] ||
+		e.Opcode == expression.InstrToOpcode["local.tee"] {
+		if e.LocalIndex < 0 || e.LocalIndex >= len(v.locals) {
+			return fmt.Errorf("local index %d out of range (%d locals)", e.LocalIndex, len(v.locals))
+		}
+		t := v.locals[e.LocalIndex]
+		if e.Opcode != expression.InstrToOpcode["local.get"] {
+			_, err := v.pop(t)
+			if err != nil {
+				return err
+			}
+		}
+		if e.Opcode != expression.InstrToOpcode["local.set"] {
+			v.push(t)
+		}
+	} else if e.Opcode == expression.InstrToOpcode["global.get"] ||
+		e.Opcode == expression.InstrToOpcode["global.set"] {
+		if e.GlobalIndex < 0 || e.GlobalIndex >= len(wf.Global) {
+			return fmt.Errorf("global index %d out of range", e.GlobalIndex)
+		}
+		g := wf.Global[e.GlobalIndex]
+		if e.Opcode == expression.InstrToOpcode["global.get"] {
+			v.push(g.Type)
+		} else {
+			if g.Mut == 0 {
+				return fmt.Errorf("global %d is immutable", e.GlobalIndex)
+			}
+			_, err := v.pop(g.Type)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		params, results, memWidth, ok := instrSignature(e)
+		if !ok {
+			return errors.New("unsupported opcode")
+		}
+		if memWidth > 0 || e.Opcode == expression.InstrToOpcode["memory.size"] ||
+			e.Opcode == expression.InstrToOpcode["memory.grow"] {
+			if len(wf.Memory) == 0 {
+				return errors.New("no memory defined")
+			}
+		}
+		if memWidth > 0 && (1<<e.MemAlign) > memWidth {
+			return fmt.Errorf("alignment %d larger than natural alignment %d", 1<<e.MemAlign, memWidth)
+		}
+		err := v.popAll(params)
+		if err != nil {
+			return err
+		}
+		v.push(results...)
+	}
+	return nil
+}
+
+/**
+ * Get the values an instruction takes off the stack, and the values it leaves, given the types of the locals.
+ * Control instructions, drop and select depend on the code around them, so they aren't handled here.
+ */
+func (wf *WasmFile) StackEffect(e *expression.Expression, locals []types.ValType) ([]types.ValType, []types.ValType, error) {
+	if e.Opcode == expression.InstrToOpcode["call"] {
+		ft, err := wf.functionType(e.FuncIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ft.Param, ft.Result, nil
+	} else if e.Opcode == expression.InstrToOpcode["call_indirect"] {
+		if e.TypeIndex < 0 || e.TypeIndex >= len(wf.Type) {
+			return nil, nil, fmt.Errorf("type index %d out of range", e.TypeIndex)
+		}
+		ft := wf.Type[e.TypeIndex]
+		params := append(append([]types.ValType{}, ft.Param...), types.ValI32)
+		return params, ft.Result, nil
+	} else if e.Opcode == expression.InstrToOpcode["local.get"] ||
+		e.Opcode == expression.InstrToOpcode["local.set"] ||
+		e.Opcode == expression.InstrToOpcode["local.tee"] {
+		if e.LocalIndex < 0 || e.LocalIndex >= len(locals) {
+			return nil, nil, fmt.Errorf("local index %d out of range (%d locals)", e.LocalIndex, len(locals))
+		}
+		t := []types.ValType{locals[e.LocalIndex]}
+		if e.Opcode == expression.InstrToOpcode["local.get"] {
+			return nil, t, nil
+		} else if e.Opcode == expression.InstrToOpcode["local.set"] {
+			return t, nil, nil
+		}
+		return t, t, nil
+	} else if e.Opcode == expression.InstrToOpcode["global.get"] ||
+		e.Opcode == expression.InstrToOpcode["global.set"] {
+		if e.GlobalIndex < 0 || e.GlobalIndex >= len(wf.Global) {
+			return nil, nil, fmt.Errorf("global index %d out of range", e.GlobalIndex)
+		}
+		t := []types.ValType{wf.Global[e.GlobalIndex].Type}
+		if e.Opcode == expression.InstrToOpcode["global.get"] {
+			return nil, t, nil
+		}
+		return t, nil, nil
+	}
+
+	params, results, _, ok := instrSignature(e)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported instruction %s", e.Name())
+	}
+	return params, results, nil
+}
+
+var (
+	sigI32 = []types.ValType{types.ValI32}
+	sigI64 = []types.ValType{types.ValI64}
+	sigF32 = []types.ValType{types.ValF32}
+	sigF64 = []types.ValType{types.ValF64}
+
+	sigI32I32 = []types.ValType{types.ValI32, types.ValI32}
+	sigI32I64 = []types.ValType{types.ValI32, types.ValI64}
+	sigI32F32 = []types.ValType{types.ValI32, types.ValF32}
+	sigI32F64 = []types.ValType{types.ValI32, types.ValF64}
+	sigI64I64 = []types.ValType{types.ValI64, types.ValI64}
+	sigF32F32 = []types.ValType{types.ValF32, types.ValF32}
+	sigF64F64 = []types.ValType{types.ValF64, types.ValF64}
+
+	sigI32I32I32 = []types.ValType{types.ValI32, types.ValI32, types.ValI32}
+)
+
+/**
+ * Get the stack signature of a simple instruction (memory / numeric).
+ * memWidth is the natural alignment in bytes for memory instructions, or 0.
+ */
+func instrSignature(e *expression.Expression) (params []types.ValType, results []types.ValType, memWidth int, ok bool) {
+	op := byte(e.Opcode)
+
+	if e.Opcode == expression.ExtendedOpcodeFC {
+		switch e.OpcodeExt {
+		case 0, 1:
+			return sigF32, sigI32, 0, true
+		case 2, 3:
+			return sigF64, sigI32, 0, true
+		case 4, 5:
+			return sigF32, sigI64, 0, true
+		case 6, 7:
+			return sigF64, sigI64, 0, true
+		case 10, 11: // memory.copy, memory.fill
+			return sigI32I32I32, nil, 1, true
+		}
+		return nil, nil, 0, false
+	}
+
+	switch {
+	// Loads
+	case op == 0x28:
+		return sigI32, sigI32, 4, true
+	case op == 0x29:
+		return sigI32, sigI64, 8, true
+	case op == 0x2a:
+		return sigI32, sigF32, 4, true
+	case op == 0x2b:
+		return sigI32, sigF64, 8, true
+	case op == 0x2c || op == 0x2d:
+		return sigI32, sigI32, 1, true
+	case op == 0x2e || op == 0x2f:
+		return sigI32, sigI32, 2, true
+	case op == 0x30 || op == 0x31:
+		return sigI32, sigI64, 1, true
+	case op == 0x32 || op == 0x33:
+		return sigI32, sigI64, 2, true
+	case op == 0x34 || op == 0x35:
+		return sigI32, sigI64, 4, true
+	// Stores
+	case op == 0x36:
+		return sigI32I32, nil, 4, true
+	case op == 0x37:
+		return sigI32I64, nil, 8, true
+	case op == 0x38:
+		return sigI32F32, nil, 4, true
+	case op == 0x39:
+		return sigI32F64, nil, 8, true
+	case op == 0x3a:
+		return sigI32I32, nil, 1, true
+	case op == 0x3b:
+		return sigI32I32, nil, 2, true
+	case op == 0x3c:
+		return sigI32I64, nil, 1, true
+	case op == 0x3d:
+		return sigI32I64, nil, 2, true
+	case op == 0x3e:
+		return sigI32I64, nil, 4, true
+	case op == 0x3f: // memory.size
+		return nil, sigI32, 0, true
+	case op == 0x40: // memory.grow
+		return sigI32, sigI32, 0, true
+	// Constants
+	case op == 0x41:
+		return nil, sigI32, 0, true
+	case op == 0x42:
+		return nil, sigI64, 0, true
+	case op == 0x43:
+		return nil, sigF32, 0, true
+	case op == 0x44:
+		return nil, sigF64, 0, true
+	// Comparisons
+	case op == 0x45:
+		return sigI32, sigI32, 0, true
+	case op >= 0x46 && op <= 0x4f:
+		return sigI32I32, sigI32, 0, true
+	case op == 0x50:
+		return sigI64, sigI32, 0, true
+	case op >= 0x51 && op <= 0x5a:
+		return sigI64I64, sigI32, 0, true
+	case op >= 0x5b && op <= 0x60:
+		return sigF32F32, sigI32, 0, true
+	case op >= 0x61 && op <= 0x66:
+		return sigF64F64, sigI32, 0, true
+	// Arithmetic
+	case op >= 0x67 && op <= 0x69:
+		return sigI32, sigI32, 0, true
+	case op >= 0x6a && op <= 0x78:
+		return sigI32I32, sigI32, 0, true
+	case op >= 0x79 && op <= 0x7b:
+		return sigI64, sigI64, 0, true
+	case op >= 0x7c && op <= 0x8a:
+		return sigI64I64, sigI64, 0, true
+	case op >= 0x8b && op <= 0x91:
+		return sigF32, sigF32, 0, true
+	case op >= 0x92 && op <= 0x98:
+		return sigF32F32, sigF32, 0, true
+	case op >= 0x99 && op <= 0x9f:
+		return sigF64, sigF64, 0, true
+	case op >= 0xa0 && op <= 0xa6:
+		return sigF64F64, sigF64, 0, true
+	// Conversions
+	case op == 0xa7:
+		return sigI64, sigI32, 0, true
+	case op == 0xa8 || op == 0xa9:
+		return sigF32, sigI32, 0, true
+	case op == 0xaa || op == 0xab:
+		return sigF64, sigI32, 0, true
+	case op == 0xac || op == 0xad:
+		return sigI32, sigI64, 0, true
+	case op == 0xae || op == 0xaf:
+		return sigF32, sigI64, 0, true
+	case op == 0xb0 || op == 0xb1:
+		return sigF64, sigI64, 0, true
+	case op == 0xb2 || op == 0xb3:
+		return sigI32, sigF32, 0, true
+	case op == 0xb4 || op == 0xb5:
+		return sigI64, sigF32, 0, true
+	case op == 0xb6:
+		return sigF64, sigF32, 0, true
+	case op == 0xb7 || op == 0xb8:
+		return sigI32, sigF64, 0, true
+	case op == 0xb9 || op == 0xba:
+		return sigI64, sigF64, 0, true
+	case op == 0xbb:
+		return sigF32, sigF64, 0, true
+	case op == 0xbc:
+		return sigF32, sigI32, 0, true
+	case op == 0xbd:
+		return sigF64, sigI64, 0, true
+	case op == 0xbe:
+		return sigI32, sigF32, 0, true
+	case op == 0xbf:
+		return sigI64, sigF64, 0, true
+	case op == 0xc0 || op == 0xc1:
+		return sigI32, sigI32, 0, true
+	case op >= 0xc2 && op <= 0xc4:
+		return sigI64, sigI64, 0, true
+	}
+	return nil, nil, 0, false
+}
@@ -0,0 +1,131 @@
+package wasmfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	wf := newTestModule(t)
+	assert.NoError(t, wf.Validate())
+
+	// Wrapping a function in a block is fine
+	err := wf.Code[1].InsertFuncStart(wf, "block")
+	assert.NoError(t, err)
+	err = wf.Code[1].InsertFuncEnd(wf, "end")
+	assert.NoError(t, err)
+	assert.NoError(t, wf.Validate())
+
+	// Unbalanced block
+	err = wf.Code[1].InsertFuncStart(wf, "block")
+	assert.NoError(t, err)
+	assert.Error(t, wf.Validate())
+}
+
+func TestValidateErrors(t *testing.T) {
+	sources := map[string]string{
+		"stack type": "(func $f (result i32)\n i64.const 1\n)",
+		"underflow":  "(func $f (result i32)\n i32.add\n)",
+		"leftover":   "(func $f\n i32.const 1\n)",
+		"local":      "(func $f (param $a i32)\n local.get 1\n drop\n)",
+		"label":      "(func $f\n br 1\n)",
+		"memory":     "(func $f\n i32.const 0\n i32.load\n drop\n)",
+		"if result":  "(func $f (result i32)\n i32.const 1\n if (result i32)\n i32.const 2\n end\n)",
+	}
+	for name, src := range sources {
+		wf := NewEmpty()
+		err := wf.DecodeWat([]byte("(module " + src + ")"))
+		assert.NoError(t, err, name)
+		err = wf.Validate()
+		assert.Error(t, err, name)
+	}
+
+	// Unreachable code is polymorphic, so this is valid
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte("(module (func $f (result i32)\n unreachable\n i32.add\n))"))
+	assert.NoError(t, err)
+	assert.NoError(t, wf.Validate())
+}
+
+func TestValidateMultiValueBlocks(t *testing.T) {
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte(`(module (func $f (param $a i32) (result i64)
+ local.get 0
+ block $b (param i32) (result i32 i64)
+  i64.const 2
+  local.get 0
+  br_if $b
+  drop
+  drop
+  i32.const 1
+  i64.const 2
+  br $b
+ end
+ drop
+ i32.const 5
+ loop (param i32)
+  local.get 0
+  br_if 0
+  drop
+ end
+ i64.extend_i32_u
+ i32.const 0
+ if (param i64) (result i64)
+  i64.const 3
+  i64.add
+ end
+))`))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(wf.Type))
+	assert.NoError(t, wf.Validate())
+
+	// The block types survive a binary round trip
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+	wf2 := NewEmpty()
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	assert.NoError(t, wf2.Validate())
+	assert.True(t, wf2.Code[0].Expression[1].TypedBlock)
+
+	// Block params come off the stack of the enclosing block
+	wf = NewEmpty()
+	err = wf.DecodeWat([]byte("(module (func $f\n block (param i32)\n drop\n end\n))"))
+	assert.NoError(t, err)
+	assert.Error(t, wf.Validate())
+}
+
+func TestStackEffect(t *testing.T) {
+	wf := NewEmpty()
+	err := wf.DecodeWat([]byte("(module (global $g (mut i64) (i64.const 0)) (func $f (param $a i32) (result i32)\n local.get 0\n))"))
+	assert.NoError(t, err)
+	locals := []types.ValType{types.ValI32, types.ValF64}
+
+	check := func(src string, params []types.ValType, results []types.ValType) {
+		code, err := expression.ExpressionFromWat(src)
+		assert.NoError(t, err)
+		p, r, err := wf.StackEffect(code[0], locals)
+		assert.NoError(t, err, src)
+		assert.Equal(t, len(params), len(p), src)
+		assert.Equal(t, len(results), len(r), src)
+		for i := range params {
+			assert.Equal(t, params[i], p[i], src)
+		}
+		for i := range results {
+			assert.Equal(t, results[i], r[i], src)
+		}
+	}
+	check("i32.add", []types.ValType{types.ValI32, types.ValI32}, []types.ValType{types.ValI32})
+	check("f64.load", []types.ValType{types.ValI32}, []types.ValType{types.ValF64})
+	check("local.tee 1", []types.ValType{types.ValF64}, []types.ValType{types.ValF64})
+	check("global.set 0", []types.ValType{types.ValI64}, nil)
+	check("call 0", []types.ValType{types.ValI32}, []types.ValType{types.ValI32})
+
+	code, err := expression.ExpressionFromWat("local.get 2")
+	assert.NoError(t, err)
+	_, _, err = wf.StackEffect(code[0], locals)
+	assert.Error(t, err)
+}
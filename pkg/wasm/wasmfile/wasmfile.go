@@ -18,6 +18,9 @@ package wasmfile
 
 import (
 	"fmt"
+	"path"
+	"sort"
+	"strings"
 
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
 	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
@@ -39,6 +42,25 @@ type WasmFile struct {
 	Elem     []*ElemEntry
 
 	Debug *debug.WasmDebug
+
+	// Set FoldedWat to have EncodeWat nest operands under the instructions that use them, and indent blocks.
+	FoldedWat bool
+
+	// Set KeepLayout before decoding to record the original sections in Layout.
+	// EncodeBinary then reproduces the original binary exactly, apart from any changes.
+	KeepLayout bool
+	Layout     []*SectionLayout
+
+	// With Incremental (and KeepLayout), EncodeBinary trusts the dirty flags rather than comparing
+	// each section, and copies anything not marked as changed. Use MarkSectionDirty or
+	// CodeEntry.MarkDirty after changing entries directly.
+	Incremental   bool
+	dirtySections map[types.SectionId]bool
+
+	// Code with valid PCs sorted by address, for FindFunction. Rebuilt when Code changes.
+	codeIndex      []codeRange
+	codeIndexLen   int
+	codeIndexFirst **CodeEntry
 }
 
 const WasmHeader uint32 = 0x6d736100
@@ -94,6 +116,7 @@ type GlobalEntry struct {
 type MemoryEntry struct {
 	LimitMin int
 	LimitMax int
+	Shared   bool
 }
 
 // CodeEntry
@@ -103,6 +126,11 @@ type CodeEntry struct {
 	CodeSectionPtr uint64
 	CodeSectionLen uint64
 	Expression     []*expression.Expression
+	WatLines       []int          // Source line of each expression, if decoded from wat
+	LocalNames     map[string]int // Names of the params and locals, if decoded from wat
+
+	original []byte // Original body, if decoded with KeepLayout
+	dirty    bool
 }
 
 // DataEntry
@@ -134,14 +162,175 @@ func (wf *WasmFile) GetCustomSectionData(name string) []byte {
 	return nil
 }
 
-func (wf *WasmFile) FindFunction(pc uint64) int {
+/**
+ * Set the data of a custom section. If there's already a section with this name it is updated in
+ * place, otherwise a new section is added at the end.
+ */
+func (wf *WasmFile) SetCustomSection(name string, data []byte) {
+	for _, c := range wf.Custom {
+		if c.Name == name {
+			c.Data = data
+			return
+		}
+	}
+	wf.Custom = append(wf.Custom, &CustomEntry{
+		Name: name,
+		Data: data,
+	})
+}
+
+// Remove all custom sections with this name, and return how many were removed.
+func (wf *WasmFile) RemoveCustomSection(name string) int {
+	return wf.StripCustom(func(n string) bool { return n == name })
+}
+
+/**
+ * Remove every custom section the matcher returns true for, and return how many were removed.
+ *
+ */
+func (wf *WasmFile) StripCustom(matcher func(name string) bool) int {
+	newCustom := make([]*CustomEntry, 0)
+	for _, c := range wf.Custom {
+		if !matcher(c.Name) {
+			newCustom = append(newCustom, c)
+		}
+	}
+	removed := len(wf.Custom) - len(newCustom)
+	wf.Custom = newCustom
+	return removed
+}
+
+// Is this the name of a DWARF custom section
+func IsDwarfSection(name string) bool {
+	return strings.HasPrefix(name, ".debug_")
+}
+
+// Get the functions which were inlined at a pc, innermost first
+func (wf *WasmFile) GetInlineStack(pc uint64) []*debug.InlineInfo {
+	return wf.Debug.GetInlineStack(pc)
+}
+
+// Find the code addresses for a source line, eg for setting a breakpoint at file:line
+func (wf *WasmFile) FindAddressesForLine(file string, line int) []uint64 {
+	return wf.Debug.FindAddressesForLine(file, line)
+}
+
+// Find the functions containing code for a source line
+func (wf *WasmFile) FindFunctionsForLine(file string, line int) []int {
+	fids := make([]int, 0)
+	seen := make(map[int]bool)
+	for _, pc := range wf.FindAddressesForLine(file, line) {
+		fid := wf.FindFunction(pc)
+		if fid != -1 && !seen[fid] {
+			seen[fid] = true
+			fids = append(fids, fid)
+		}
+	}
+	return fids
+}
+
+// Get the source files a function has line info for
+func (wf *WasmFile) GetFunctionSourceFiles(fid int) []string {
+	files := make([]string, 0)
+	idx := fid - len(wf.Import)
+	if idx < 0 || idx >= len(wf.Code) || !wf.Code[idx].PCValid {
+		return files
+	}
+	c := wf.Code[idx]
+	seen := make(map[string]bool)
+	wf.Debug.EachLineInRange(c.CodeSectionPtr, c.CodeSectionPtr+c.CodeSectionLen, func(_ uint64, _ uint64, li debug.LineInfo) {
+		if !seen[li.Filename] {
+			seen[li.Filename] = true
+			files = append(files, li.Filename)
+		}
+	})
+	sort.Strings(files)
+	return files
+}
+
+// Match a source path against a glob. Relative globs can match any trailing part of the path.
+func MatchSourcePath(pattern string, filename string) (bool, error) {
+	if strings.HasPrefix(pattern, "/") {
+		return path.Match(pattern, filename)
+	}
+	parts := strings.Split(filename, "/")
+	for i := range parts {
+		match, err := path.Match(pattern, strings.Join(parts[i:], "/"))
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+type codeRange struct {
+	index int
+	code  *CodeEntry
+}
+
+// Index the code with valid PCs by address, unless the code hasn't changed since last time
+func (wf *WasmFile) buildCodeIndex() {
+	if len(wf.Code) == wf.codeIndexLen && (len(wf.Code) == 0 || &wf.Code[0] == wf.codeIndexFirst) {
+		return
+	}
+	wf.codeIndex = make([]codeRange, 0, len(wf.Code))
 	for index, c := range wf.Code {
+		if c.PCValid {
+			wf.codeIndex = append(wf.codeIndex, codeRange{index: index, code: c})
+		}
+	}
+	sort.SliceStable(wf.codeIndex, func(i, j int) bool {
+		return wf.codeIndex[i].code.CodeSectionPtr < wf.codeIndex[j].code.CodeSectionPtr
+	})
+	wf.codeIndexLen = len(wf.Code)
+	wf.codeIndexFirst = nil
+	if len(wf.Code) > 0 {
+		wf.codeIndexFirst = &wf.Code[0]
+	}
+}
 
-		if c.PCValid && pc >= c.CodeSectionPtr && pc <= (c.CodeSectionPtr+c.CodeSectionLen) {
-			return len(wf.Import) + index
+// Find the function containing a PC, or -1
+func (wf *WasmFile) FindFunction(pc uint64) int {
+	wf.buildCodeIndex()
+	i := sort.Search(len(wf.codeIndex), func(i int) bool {
+		c := wf.codeIndex[i].code
+		return c.CodeSectionPtr+c.CodeSectionLen >= pc
+	})
+	if i == len(wf.codeIndex) {
+		return -1
+	}
+	cr := wf.codeIndex[i]
+	if cr.index >= len(wf.Code) || wf.Code[cr.index] != cr.code {
+		// The code was changed in place, so start again
+		wf.codeIndexLen = -1
+		return wf.FindFunction(pc)
+	}
+	if pc < cr.code.CodeSectionPtr {
+		return -1
+	}
+	return len(wf.Import) + cr.index
+}
+
+// Get the function in each slot of table 0, as set up by the elem segments. Empty slots are -1.
+// Segments with an offset that isn't a constant are skipped.
+func (wf *WasmFile) TableFunctions() []int {
+	funcs := make([]int, 0)
+	for _, el := range wf.Elem {
+		if el.TableIndex != 0 {
+			continue
+		}
+		addr, err := segmentAddress(el.Offset)
+		if err != nil {
+			continue
+		}
+		for len(funcs) < addr+len(el.Indexes) {
+			funcs = append(funcs, -1)
+		}
+		for i, fid := range el.Indexes {
+			funcs[addr+i] = int(fid)
 		}
 	}
-	return -1
+	return funcs
 }
 
 func (wf *WasmFile) LookupImport(n string) int {
@@ -0,0 +1,138 @@
+package wasmfile
+
+import (
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/expression"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripCustom(t *testing.T) {
+	wf := NewEmpty()
+	for _, n := range []string{"name", ".debug_info", ".debug_line", "producers", "other"} {
+		wf.Custom = append(wf.Custom, &CustomEntry{Name: n})
+	}
+
+	assert.Equal(t, 2, wf.StripCustom(IsDwarfSection))
+	assert.Equal(t, 0, wf.StripCustom(IsDwarfSection))
+	assert.Equal(t, 1, wf.StripCustom(func(name string) bool { return name == "producers" }))
+
+	assert.Equal(t, 2, len(wf.Custom))
+	assert.Equal(t, "name", wf.Custom[0].Name)
+	assert.Equal(t, "other", wf.Custom[1].Name)
+}
+
+func TestTableFunctions(t *testing.T) {
+	wf := NewEmpty()
+	assert.Equal(t, 0, len(wf.TableFunctions()))
+
+	wf.Elem = append(wf.Elem,
+		&ElemEntry{Offset: []*expression.Expression{{Opcode: expression.InstrToOpcode["i32.const"], I32Value: 3}}, Indexes: []uint64{7, 8}},
+		&ElemEntry{Offset: []*expression.Expression{{Opcode: expression.InstrToOpcode["i32.const"], I32Value: 1}}, Indexes: []uint64{4}},
+		&ElemEntry{Offset: []*expression.Expression{{Opcode: expression.InstrToOpcode["global.get"], GlobalIndex: 0}}, Indexes: []uint64{9}},
+	)
+	assert.Equal(t, []int{-1, 4, -1, 7, 8}, wf.TableFunctions())
+}
+
+func TestSetCustomSection(t *testing.T) {
+	wf := NewEmpty()
+	wf.SetCustomSection("license", []byte("MIT"))
+	wf.SetCustomSection("build_id", []byte{1, 2, 3})
+	wf.SetCustomSection("license", []byte("Apache-2.0"))
+
+	assert.Equal(t, 2, len(wf.Custom))
+	assert.Equal(t, []byte("Apache-2.0"), wf.GetCustomSectionData("license"))
+
+	assert.Equal(t, 1, wf.RemoveCustomSection("license"))
+	assert.Nil(t, wf.GetCustomSectionData("license"))
+	assert.Equal(t, 1, len(wf.Custom))
+}
+
+func TestFindAddressesForLine(t *testing.T) {
+	wf := NewEmpty()
+	wf.Code = []*CodeEntry{
+		{PCValid: true, CodeSectionPtr: 0x10, CodeSectionLen: 0x10},
+		{PCValid: true, CodeSectionPtr: 0x30, CodeSectionLen: 0x10},
+	}
+	wf.Debug.AddLineInfo(0x14, debug.LineInfo{Filename: "/src/app/main.go", Linenumber: 12})
+	wf.Debug.AddLineInfo(0x12, debug.LineInfo{Filename: "/src/app/main.go", Linenumber: 12})
+	wf.Debug.AddLineInfo(0x34, debug.LineInfo{Filename: "/src/app/main.go", Linenumber: 12})
+	wf.Debug.AddLineInfo(0x36, debug.LineInfo{Filename: "/src/app/main.go", Linenumber: 13})
+	wf.Debug.AddLineInfo(0x38, debug.LineInfo{Filename: "/src/other/domain.go", Linenumber: 12})
+
+	assert.Equal(t, []uint64{0x12, 0x14, 0x34}, wf.FindAddressesForLine("main.go", 12))
+	assert.Equal(t, []uint64{0x12, 0x14, 0x34}, wf.FindAddressesForLine("/src/app/main.go", 12))
+	assert.Equal(t, []uint64{0x38}, wf.FindAddressesForLine("domain.go", 12))
+	assert.Equal(t, 0, len(wf.FindAddressesForLine("main.go", 14)))
+	assert.Equal(t, 0, len(wf.FindAddressesForLine("in.go", 12)))
+
+	assert.Equal(t, []int{0, 1}, wf.FindFunctionsForLine("main.go", 12))
+	assert.Equal(t, []int{1}, wf.FindFunctionsForLine("main.go", 13))
+}
+
+func TestFindFunction(t *testing.T) {
+	wf := NewEmpty()
+	wf.Import = []*ImportEntry{{Module: "env", Name: "f"}}
+	wf.Code = []*CodeEntry{
+		{PCValid: true, CodeSectionPtr: 0x10, CodeSectionLen: 0x10},
+		{PCValid: false},
+		{PCValid: true, CodeSectionPtr: 0x20, CodeSectionLen: 0x08},
+		{PCValid: true, CodeSectionPtr: 0x40, CodeSectionLen: 0x10},
+	}
+
+	assert.Equal(t, -1, wf.FindFunction(0x0f))
+	assert.Equal(t, 1, wf.FindFunction(0x10))
+	assert.Equal(t, 1, wf.FindFunction(0x20))
+	assert.Equal(t, 3, wf.FindFunction(0x21))
+	assert.Equal(t, -1, wf.FindFunction(0x30))
+	assert.Equal(t, 4, wf.FindFunction(0x50))
+	assert.Equal(t, -1, wf.FindFunction(0x51))
+
+	// Removing code renumbers the functions
+	wf.Code = append(wf.Code[:1], wf.Code[2:]...)
+	assert.Equal(t, 2, wf.FindFunction(0x21))
+	assert.Equal(t, 3, wf.FindFunction(0x50))
+
+	wf.Code[0] = &CodeEntry{PCValid: true, CodeSectionPtr: 0x00, CodeSectionLen: 0x08}
+	assert.Equal(t, 1, wf.FindFunction(0x04))
+	assert.Equal(t, -1, wf.FindFunction(0x10))
+}
+
+func TestGetFunctionSourceFiles(t *testing.T) {
+	wf := NewEmpty()
+	wf.Import = []*ImportEntry{{Module: "env", Name: "f"}}
+	wf.Code = []*CodeEntry{
+		{PCValid: true, CodeSectionPtr: 0x10, CodeSectionLen: 0x10},
+		{PCValid: true, CodeSectionPtr: 0x30, CodeSectionLen: 0x10},
+	}
+	wf.Debug.AddLineInfo(0x12, debug.LineInfo{Filename: "/src/app/main.go", Linenumber: 12})
+	wf.Debug.AddLineInfo(0x14, debug.LineInfo{Filename: "/go/src/fmt/print.go", Linenumber: 40})
+	wf.Debug.AddLineInfo(0x16, debug.LineInfo{Filename: "/src/app/main.go", Linenumber: 13})
+
+	assert.Equal(t, []string{"/go/src/fmt/print.go", "/src/app/main.go"}, wf.GetFunctionSourceFiles(1))
+	assert.Equal(t, 0, len(wf.GetFunctionSourceFiles(2)))
+	assert.Equal(t, 0, len(wf.GetFunctionSourceFiles(0)))
+}
+
+func TestMatchSourcePath(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		filename string
+		match    bool
+	}{
+		{"main.go", "/src/app/main.go", true},
+		{"app/*.go", "/src/app/main.go", true},
+		{"/src/*/main.go", "/src/app/main.go", true},
+		{"/app/*.go", "/src/app/main.go", false},
+		{"fmt/*.go", "/src/app/main.go", false},
+		{"in.go", "/src/app/main.go", false},
+	} {
+		match, err := MatchSourcePath(tc.pattern, tc.filename)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.match, match, tc.pattern)
+	}
+
+	_, err := MatchSourcePath("[", "main.go")
+	assert.Error(t, err)
+}
@@ -0,0 +1,163 @@
+/*
+	Copyright 2023 Loophole Labs
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		   http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package wasmfile
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/encoding"
+)
+
+const dw_tag_compile_unit = 0x11
+const dw_at_name = 0x03
+const dw_at_stmt_list = 0x10
+const dw_at_low_pc = 0x11
+const dw_at_high_pc = 0x12
+const dw_form_addr = 0x01
+const dw_form_data4 = 0x06
+const dw_form_string = 0x08
+const dw_form_sec_offset = 0x17
+
+const dw_lns_copy = 0x01
+const dw_lns_advance_line = 0x03
+const dw_lne_end_sequence = 0x01
+const dw_lne_set_address = 0x02
+
+// The address of an instruction in the code section
+type watLineAddress struct {
+	address uint64
+	line    int
+}
+
+/**
+ * Work out where each instruction decoded from wat will be in the code section.
+ * Returns the addresses and the total length of the code section body.
+ */
+func (wf *WasmFile) watLineAddresses() ([]watLineAddress, uint64, error) {
+	addrs := make([]watLineAddress, 0)
+	ptr := uint64(len(binary.AppendUvarint(nil, uint64(len(wf.Code)))))
+
+	for _, c := range wf.Code {
+		var buf bytes.Buffer
+		encoding.WriteUvarint(&buf, uint64(len(c.Locals)))
+		for _, l := range c.Locals {
+			encoding.WriteUvarint(&buf, 1)
+			buf.WriteByte(byte(l))
+		}
+		pcs := make([]uint64, 0, len(c.Expression))
+		for _, e := range c.Expression {
+			pcs = append(pcs, uint64(buf.Len()))
+			err := e.EncodeBinary(&buf)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		buf.WriteByte(0x0b) // END
+
+		codeptr := ptr + uint64(len(binary.AppendUvarint(nil, uint64(buf.Len()))))
+		if len(c.WatLines) == len(c.Expression) {
+			for i, pc := range pcs {
+				addrs = append(addrs, watLineAddress{address: codeptr + pc, line: c.WatLines[i]})
+			}
+		}
+		ptr = codeptr + uint64(buf.Len())
+	}
+	return addrs, ptr, nil
+}
+
+/**
+ * Add a name section and a minimal set of dwarf sections, mapping each instruction back to its
+ * line in the wat file it was decoded from. Instructions added since decoding aren't mapped, and
+ * as the addresses depend on the encoding this should be called again if the code changes.
+ */
+func (wf *WasmFile) AddWatDebugSections(filename string) error {
+	wf.SetCustomSection("name", wf.Debug.EncodeNameSectionData())
+
+	addrs, codeLength, err := wf.watLineAddresses()
+	if err != nil {
+		return err
+	}
+
+	// .debug_abbrev with a single compile unit abbreviation
+	abbrev := []byte{
+		1, dw_tag_compile_unit, 0,
+		dw_at_name, dw_form_string,
+		dw_at_stmt_list, dw_form_sec_offset,
+		dw_at_low_pc, dw_form_addr,
+		dw_at_high_pc, dw_form_data4,
+		0, 0,
+		0,
+	}
+
+	// .debug_info with the compile unit
+	info := make([]byte, 4)
+	info = binary.LittleEndian.AppendUint16(info, 4) // version
+	info = binary.LittleEndian.AppendUint32(info, 0) // abbrev offset
+	info = append(info, 4)                           // address size
+	info = append(info, 1)
+	info = append(info, []byte(filename)...)
+	info = append(info, 0)
+	info = binary.LittleEndian.AppendUint32(info, 0) // stmt_list
+	info = binary.LittleEndian.AppendUint32(info, 0) // low_pc
+	info = binary.LittleEndian.AppendUint32(info, uint32(codeLength))
+	binary.LittleEndian.PutUint32(info, uint32(len(info)-4))
+
+	// .debug_line version 4, with one file and one sequence
+	header := []byte{
+		1,    // minimum_instruction_length
+		1,    // maximum_operations_per_instruction
+		1,    // default_is_stmt
+		0xfb, // line_base -5
+		14,   // line_range
+		13,   // opcode_base
+		0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1,
+		0, // No include directories
+	}
+	header = append(header, []byte(filename)...)
+	header = append(header, 0, 0, 0, 0, 0) // dir, mtime, length, end of files
+
+	program := make([]byte, 0)
+	setAddress := func(a uint64) {
+		program = append(program, 0, 5, dw_lne_set_address)
+		program = binary.LittleEndian.AppendUint32(program, uint32(a))
+	}
+	lastLine := 1
+	for _, a := range addrs {
+		setAddress(a.address)
+		if a.line != lastLine {
+			program = append(program, dw_lns_advance_line)
+			program = encoding.AppendSleb128(program, int64(a.line-lastLine))
+			lastLine = a.line
+		}
+		program = append(program, dw_lns_copy)
+	}
+	setAddress(codeLength)
+	program = append(program, 0, 1, dw_lne_end_sequence)
+
+	line := make([]byte, 4)
+	line = binary.LittleEndian.AppendUint16(line, 4)
+	line = binary.LittleEndian.AppendUint32(line, uint32(len(header)))
+	line = append(line, header...)
+	line = append(line, program...)
+	binary.LittleEndian.PutUint32(line, uint32(len(line)-4))
+
+	wf.SetCustomSection(".debug_abbrev", abbrev)
+	wf.SetCustomSection(".debug_info", info)
+	wf.SetCustomSection(".debug_line", line)
+	return nil
+}
@@ -0,0 +1,80 @@
+package wasmfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/loopholelabs/wasm-toolkit/pkg/wasm/debug"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddWatDebugSections(t *testing.T) {
+	wf := newTestModule(t)
+	assert.NoError(t, wf.AddWatDebugSections("test.wat"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+
+	wf2.Debug = &debug.WasmDebug{}
+	wf2.Debug.ParseNameSectionData(wf2.GetCustomSectionData("name"))
+	assert.Equal(t, "$add", wf2.Debug.GetFunctionIdentifier(1, false))
+	assert.Equal(t, "$counter", wf2.Debug.GetGlobalIdentifier(0, false))
+
+	assert.NoError(t, wf2.Debug.ParseDwarf(wf2))
+	assert.NoError(t, wf2.Debug.ParseDwarfLineNumbers())
+
+	// The first instructions of $add and $hello are on lines 8 and 14 of the test module
+	add := wf2.Code[0]
+	assert.Equal(t, "test.wat:8.0", wf2.Debug.GetLineNumberInfo(add.Expression[0].PC))
+	assert.Equal(t, "test.wat:10.0", wf2.Debug.GetLineNumberInfo(add.Expression[2].PC))
+	hello := wf2.Code[1]
+	assert.Equal(t, "test.wat:14.0", wf2.Debug.GetLineNumberInfo(hello.Expression[0].PC))
+	assert.Equal(t, hello.Expression[9].PC, wf2.FindAddressesForLine("test.wat", 23)[0])
+}
+
+func TestLineRanges(t *testing.T) {
+	wf := newTestModule(t)
+	assert.NoError(t, wf.AddWatDebugSections("test.wat"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, wf.EncodeBinary(&buf))
+
+	wf2 := &WasmFile{}
+	assert.NoError(t, wf2.DecodeBinary(buf.Bytes()))
+	wf2.Debug = &debug.WasmDebug{}
+	assert.NoError(t, wf2.Debug.ParseDwarf(wf2))
+	assert.NoError(t, wf2.Debug.ParseDwarfLineNumbers())
+
+	// Each row runs on to the next one. The module is a single sequence, so the last row runs into $hello.
+	add := wf2.Code[0]
+	addEnd := add.CodeSectionPtr + add.CodeSectionLen
+	rows := 0
+	last := uint64(0)
+	wf2.Debug.EachLineInRange(add.CodeSectionPtr, addEnd-1, func(start uint64, end uint64, li debug.LineInfo) {
+		if rows > 0 {
+			assert.Equal(t, last, start)
+		}
+		assert.True(t, end > start)
+		last = end
+		rows++
+	})
+	assert.Equal(t, 3, rows)
+	assert.Equal(t, wf2.Code[1].CodeSectionPtr+1, last)
+	assert.Equal(t, "test.wat(8-10)", wf2.Debug.GetLineNumberRange(add.CodeSectionPtr, addEnd-1))
+
+	// A range starting part way through a row still finds it
+	pc := add.Expression[1].PC
+	assert.Equal(t, "", wf2.Debug.GetLineNumberInfo(pc+1))
+	assert.Equal(t, "test.wat(9-9)", wf2.Debug.GetLineNumberRange(pc+1, pc+1))
+	assert.Equal(t, []string{"test.wat"}, wf2.GetFunctionSourceFiles(1))
+
+	// Clones have their own line table
+	c := wf2.Debug.Clone()
+	c.AddLineInfo(pc+1, debug.LineInfo{Filename: "other.wat", Linenumber: 1})
+	assert.Equal(t, "other.wat:1.0", c.GetLineNumberInfo(pc+1))
+	assert.Equal(t, "", wf2.Debug.GetLineNumberInfo(pc+1))
+	assert.Equal(t, wf2.Debug.NumLines()+1, c.NumLines())
+}
@@ -32,12 +32,17 @@ func TestWatStdout(t *testing.T) {
 	data_base := int(data_ptr)
 
 	wfile := wasmfile.NewEmpty()
-	wfile.AddFuncsFrom(stdout_test, func(m map[int]int) {})
-	data_ptr = wfile.AddDataFrom(data_ptr, stdout_test)
-	wfile.AddExports(stdout_test)
+	err = wfile.AddFuncsFrom(stdout_test, func(m map[int]int) {})
+	assert.NoError(t, err)
+	data_ptr, err = wfile.AddDataFrom(data_ptr, stdout_test)
+	assert.NoError(t, err)
+	err = wfile.AddExports(stdout_test)
+	assert.NoError(t, err)
 
-	wfile.AddFuncsFrom(stdout, func(m map[int]int) {})
-	data_ptr = wfile.AddDataFrom(data_ptr, stdout)
+	err = wfile.AddFuncsFrom(stdout, func(m map[int]int) {})
+	assert.NoError(t, err)
+	data_ptr, err = wfile.AddDataFrom(data_ptr, stdout)
+	assert.NoError(t, err)
 
 	// Resolve / link everything...
 	for _, c := range wfile.Code {
@@ -72,6 +77,9 @@ func TestWatStdout(t *testing.T) {
 		Index: 0,
 	})
 
+	err = wfile.Validate()
+	assert.NoError(t, err)
+
 	var buf bytes.Buffer
 	err = wfile.EncodeBinary(&buf)
 